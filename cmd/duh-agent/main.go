@@ -0,0 +1,323 @@
+// Command duh-agent runs on hosts duh provisioned. It checks in with duh
+// on a heartbeat, reports inventory and health, keeps a copy of the
+// host's configuration, reboots into a reinstall when asked, and attaches
+// a console command for duh's console page.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/justinpopa/duh/internal/agent"
+)
+
+var version = "dev"
+
+type options struct {
+	ServerURL  string
+	CertFile   string
+	KeyFile    string
+	ServerCA   string
+	Interval   time.Duration
+	ConfigFile string
+	OnConfig   string
+	ReimageCmd string
+	ConsoleCmd string
+}
+
+func main() {
+	var o options
+	showVersion := flag.Bool("version", false, "print version and exit")
+	flag.StringVar(&o.ServerURL, "server", os.Getenv("DUH_AGENT_SERVER"), "duh's HTTPS URL, e.g. https://duh.example.com:8443")
+	flag.StringVar(&o.CertFile, "cert", envOr("DUH_AGENT_CERT", "/etc/duh-agent/cert.pem"), "machine certificate issued by duh; rewritten on renewal")
+	flag.StringVar(&o.KeyFile, "key", envOr("DUH_AGENT_KEY", "/etc/duh-agent/key.pem"), "machine certificate's private key; rewritten on renewal")
+	flag.StringVar(&o.ServerCA, "server-ca", os.Getenv("DUH_AGENT_SERVER_CA"), "CA to verify duh's HTTPS certificate with, instead of the system roots")
+	flag.DurationVar(&o.Interval, "interval", 0, "heartbeat interval (default: whatever duh asks for)")
+	flag.StringVar(&o.ConfigFile, "config-file", envOr("DUH_AGENT_CONFIG_FILE", "/etc/duh-agent/config.json"), "where to keep the configuration fetched from duh")
+	flag.StringVar(&o.OnConfig, "on-config", os.Getenv("DUH_AGENT_ON_CONFIG"), "shell command to run after the configuration changes")
+	flag.StringVar(&o.ReimageCmd, "reimage-cmd", envOr("DUH_AGENT_REIMAGE_CMD", "reboot"), "shell command that reboots the host into a network boot")
+	flag.StringVar(&o.ConsoleCmd, "console-cmd", os.Getenv("DUH_AGENT_CONSOLE_CMD"), "shell command whose output is the console duh shows, with typed input on its stdin, e.g. 'tail -F /var/log/syslog' (default: no console)")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println("duh-agent " + version)
+		os.Exit(0)
+	}
+	if o.ServerURL == "" {
+		log.Fatal("agent: -server is required")
+	}
+
+	client, err := newClient(o)
+	if err != nil {
+		log.Fatalf("agent: %v", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	log.Printf("agent: duh-agent %s reporting to %s", version, o.ServerURL)
+	run(ctx, o, client)
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// newClient builds a client that presents the machine certificate,
+// reading it from disk on each connection so renewals take effect.
+func newClient(o options) (*agent.Client, error) {
+	tlsCfg := &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("load machine certificate: %w", err)
+			}
+			return &cert, nil
+		},
+	}
+	if o.ServerCA != "" {
+		pem, err := os.ReadFile(o.ServerCA)
+		if err != nil {
+			return nil, fmt.Errorf("read server CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", o.ServerCA)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	return &agent.Client{
+		ServerURL: o.ServerURL,
+		HTTP:      &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}, nil
+}
+
+// run sends heartbeats until ctx is done.
+func run(ctx context.Context, o options, client *agent.Client) {
+	interval := time.Minute
+	var configHash string
+	for {
+		if err := renewIfDue(ctx, o, client, time.Now()); err != nil {
+			log.Printf("agent: %v", err)
+		}
+
+		hostname, _ := os.Hostname()
+		reply, err := client.Heartbeat(ctx, agent.Heartbeat{
+			Version:   version,
+			Hostname:  hostname,
+			UptimeSec: agent.Uptime(),
+			Inventory: agent.CollectInventory(),
+			Health:    agent.CollectHealth(),
+		})
+		if err != nil {
+			log.Printf("agent: %v", err)
+		} else {
+			if reply.IntervalSec > 0 {
+				interval = time.Duration(reply.IntervalSec) * time.Second
+			}
+			if reply.ConfigHash != configHash {
+				if err := syncConfig(ctx, o, client); err != nil {
+					log.Printf("agent: %v", err)
+				} else {
+					configHash = reply.ConfigHash
+				}
+			}
+			for _, cmd := range reply.Commands {
+				execute(ctx, o, client, cmd)
+			}
+			if reply.Console {
+				startConsole(ctx, o, client)
+			}
+		}
+
+		wait := interval
+		if o.Interval > 0 {
+			wait = o.Interval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// syncConfig fetches the configuration, writes it to the config file and
+// runs the on-config hook with it on stdin.
+func syncConfig(ctx context.Context, o options, client *agent.Client) error {
+	cfg, err := client.Config(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if err := writeFileAtomic(o.ConfigFile, b, 0o644); err != nil {
+		return fmt.Errorf("write config: %w", err)
+	}
+	log.Printf("agent: configuration updated (%s, state %s)", cfg.Hostname, cfg.State)
+	if o.OnConfig == "" {
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", o.OnConfig)
+	cmd.Stdin = bytes.NewReader(b)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("on-config hook: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// execute runs a command from duh and reports how it went. A reimage is
+// reported before it runs, since a successful one doesn't return.
+func execute(ctx context.Context, o options, client *agent.Client, cmd agent.Command) {
+	switch cmd.Type {
+	case agent.CommandReimage:
+		log.Printf("agent: reimage requested, running %q", o.ReimageCmd)
+		if err := client.Report(ctx, cmd.ID, agent.CommandResult{OK: true, Message: "running " + o.ReimageCmd}); err != nil {
+			log.Printf("agent: %v", err)
+		}
+		out, err := exec.CommandContext(ctx, "/bin/sh", "-c", o.ReimageCmd).CombinedOutput()
+		if err != nil {
+			msg := fmt.Sprintf("%v: %s", err, strings.TrimSpace(string(out)))
+			log.Printf("agent: reimage: %s", msg)
+			if err := client.Report(ctx, cmd.ID, agent.CommandResult{Message: msg}); err != nil {
+				log.Printf("agent: %v", err)
+			}
+		}
+	default:
+		log.Printf("agent: ignoring unknown command %q", cmd.Type)
+		if err := client.Report(ctx, cmd.ID, agent.CommandResult{Message: "unknown command " + cmd.Type}); err != nil {
+			log.Printf("agent: %v", err)
+		}
+	}
+}
+
+// consoleRunning is set while a console is attached.
+var consoleRunning atomic.Bool
+
+// startConsole runs the console command, streaming its output to duh and
+// what duh sends back to its stdin, unless it is already running. It
+// stops when duh closes the stream or the command exits.
+func startConsole(ctx context.Context, o options, client *agent.Client) {
+	if o.ConsoleCmd == "" {
+		log.Printf("agent: console requested, but -console-cmd is not set")
+		return
+	}
+	if !consoleRunning.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer consoleRunning.Store(false)
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		pr, pw := io.Pipe()
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", o.ConsoleCmd)
+		cmd.Stdout = pw
+		cmd.Stderr = pw
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			log.Printf("agent: console: %v", err)
+			return
+		}
+		if err := cmd.Start(); err != nil {
+			log.Printf("agent: console: %v", err)
+			return
+		}
+		go func() {
+			err := cmd.Wait()
+			pw.CloseWithError(io.EOF)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("agent: console command: %v", err)
+			}
+		}()
+		log.Printf("agent: console attached")
+		input, err := client.Console(ctx, pr)
+		if err != nil {
+			log.Printf("agent: %v", err)
+			return
+		}
+		io.Copy(stdin, input)
+		input.Close()
+		log.Printf("agent: console detached")
+	}()
+}
+
+// renewIfDue replaces the machine certificate once half its lifetime has
+// passed.
+func renewIfDue(ctx context.Context, o options, client *agent.Client, now time.Time) error {
+	data, err := os.ReadFile(o.CertFile)
+	if err != nil {
+		return fmt.Errorf("read machine certificate: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New("machine certificate: no PEM data")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("parse machine certificate: %w", err)
+	}
+	halfLife := cert.NotBefore.Add(cert.NotAfter.Sub(cert.NotBefore) / 2)
+	if now.Before(halfLife) {
+		return nil
+	}
+	rc, err := client.RenewCert(ctx)
+	if err != nil {
+		return err
+	}
+	// A handshake that lands between the two writes fails to load a
+	// matching pair; the next heartbeat retries it.
+	if err := writeFileAtomic(o.KeyFile, []byte(rc.Key), 0o600); err != nil {
+		return fmt.Errorf("write machine key: %w", err)
+	}
+	if err := writeFileAtomic(o.CertFile, []byte(rc.Cert), 0o644); err != nil {
+		return fmt.Errorf("write machine certificate: %w", err)
+	}
+	log.Printf("agent: renewed machine certificate, valid until %s", rc.NotAfter)
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
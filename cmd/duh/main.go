@@ -2,24 +2,36 @@ package main
 
 import (
 	"context"
+	"crypto/fips140"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"golang.org/x/sync/errgroup"
 
+	"github.com/justinpopa/duh/internal/cache"
+	"github.com/justinpopa/duh/internal/catalog"
 	"github.com/justinpopa/duh/internal/config"
 	"github.com/justinpopa/duh/internal/db"
 	"github.com/justinpopa/duh/internal/httpserver"
+	"github.com/justinpopa/duh/internal/pki"
 	"github.com/justinpopa/duh/internal/proxydhcp"
 	"github.com/justinpopa/duh/internal/tftpserver"
 	duhtls "github.com/justinpopa/duh/internal/tls"
+	"github.com/justinpopa/duh/internal/tracing"
+	"github.com/justinpopa/duh/internal/vmsync"
 	"github.com/justinpopa/duh/web"
 )
 
@@ -33,6 +45,46 @@ func main() {
 		os.Exit(0)
 	}
 
+	if cfg.MigrateDryRun || cfg.MigrateDownTo >= 0 {
+		runMigrationCommand(cfg)
+		os.Exit(0)
+	}
+
+	if err := loadDBKey(cfg); err != nil {
+		log.Fatalf("database key: %v", err)
+	}
+
+	if cfg.DBDecrypt {
+		runDecryptCommand(cfg)
+		os.Exit(0)
+	}
+
+	if cfg.CacheOf != "" {
+		runCacheNode(cfg)
+		return
+	}
+
+	if cfg.ACMEAdvertise != "" {
+		serverURL, err := acmeServerURL(cfg)
+		if err != nil {
+			log.Fatalf("config: %v", err)
+		}
+		cfg.ServerURL = serverURL
+		log.Printf("tls: advertising %s", serverURL)
+	}
+
+	stopTracing, err := tracing.Setup(version)
+	if err != nil {
+		log.Fatalf("tracing: %v", err)
+	}
+	defer stopTracing()
+
+	if cfg.CatalogKey != "" {
+		if _, err := catalog.ParsePublicKey(cfg.CatalogKey); err != nil {
+			log.Fatalf("-catalog-key: %v", err)
+		}
+	}
+
 	database, err := db.Open(cfg.DataDir)
 	if err != nil {
 		log.Fatalf("database: %v", err)
@@ -52,7 +104,80 @@ func main() {
 	if err != nil {
 		log.Fatalf("http server: %v", err)
 	}
-	defer srv.Webhook.Close()
+	srv.HTTPSAddr = cfg.HTTPSAddr
+	// Flags and environment only seed the runtime settings; saved values
+	// win from then on.
+	err = srv.LoadSettings(map[string]string{
+		"https_redirect":    strconv.FormatBool(cfg.HTTPSRedirect),
+		"signed_chain":      strconv.FormatBool(cfg.SignedChain),
+		"vm_netboot":        strconv.FormatBool(cfg.VMNetBoot),
+		"agent_interval":    cfg.AgentInterval.String(),
+		"heartbeat_timeout": cfg.HeartbeatTimeout.String(),
+		"dhcp_iface":        cfg.DHCPIface,
+		"catalog_key":       cfg.CatalogKey,
+	})
+	if err != nil {
+		log.Fatalf("settings: %v", err)
+	}
+	srv.EnforceBackupQuota()
+	if version, err := srv.InstallDroppedBundle(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("ipxe bundle: %v", err)
+	} else if version != "" {
+		log.Printf("ipxe bundle: now serving iPXE %s", version)
+	}
+	cfg.ProxyDHCP = srv.SettingBool("proxy_dhcp")
+	cfg.DHCPIface = srv.Setting("dhcp_iface")
+	srv.ProxyDHCP = cfg.ProxyDHCP
+	srv.TFTPOptions = tftpserver.Options{
+		BlockSize:  cfg.TFTPBlockSize,
+		WindowSize: cfg.TFTPWindowSize,
+		Timeout:    cfg.TFTPTimeout,
+		Retries:    cfg.TFTPRetries,
+	}
+	switch {
+	case len(cfg.ACMEDomains) > 0:
+		// Let's Encrypt is trusted by stock iPXE builds.
+	case cfg.TLSCertFile != "":
+		srv.TrustCertFile = cfg.TLSCertFile
+	default:
+		srv.TrustCertFile = filepath.Join(cfg.DataDir, "tls", "cert.pem")
+	}
+	if cfg.TFTPWrite {
+		srv.Inbox = &tftpserver.Inbox{
+			Dir:       filepath.Join(cfg.DataDir, "tftp-inbox"),
+			MaxFile:   int64(cfg.TFTPWriteMaxFile),
+			MaxTotal:  int64(cfg.TFTPWriteMaxTotal),
+			ClientMAC: srv.MACForIP,
+			Room:      func() int64 { return srv.QuotaRoom("logs") },
+		}
+	}
+	if cfg.ProxmoxURL != "" {
+		srv.VMProviders = append(srv.VMProviders, vmsync.NewProxmox(cfg.ProxmoxURL, cfg.ProxmoxToken, cfg.ProxmoxInsecure))
+	}
+	if cfg.LibvirtURI != "" {
+		srv.VMProviders = append(srv.VMProviders, &vmsync.Libvirt{URI: cfg.LibvirtURI})
+	}
+	srv.MinFreeBytes = int64(cfg.MinFreeMB) << 20
+	if cfg.MachineCerts {
+		ca, err := pki.LoadOrCreate(filepath.Join(cfg.DataDir, "pki"))
+		if err != nil {
+			log.Fatalf("pki: %v", err)
+		}
+		srv.CA = ca
+		srv.MachineCertTTL = cfg.MachineCertTTL
+	}
+	if srv.SettingBool("signed_chain") && !cfg.ProxyDHCP {
+		log.Print("http: signed chain enabled without proxy DHCP; boot.ipxe will reject clients that have no chain token")
+	}
+
+	// Interrupted downloads resume from the job queue; any without a job
+	// to resume them never will.
+	if err := catalog.FailDeadDownloads(database); err != nil {
+		log.Printf("catalog: %v", err)
+	}
+	if !cfg.NoUtilities {
+		catalog.PullUtilities(database, cfg.DataDir, srv.Jobs)
+	}
 
 	handler := srv.Handler()
 
@@ -62,40 +187,43 @@ func main() {
 	g, ctx := errgroup.WithContext(ctx)
 
 	// TFTP server
-	tftpSrv := tftpserver.NewServer(cfg.TFTPAddr)
+	tftpSrv := tftpserver.NewServer(cfg.TFTPAddr, srv.Binaries, srv.Inbox, srv.TFTPStats, srv.TFTPOptions)
 	g.Go(func() error {
 		log.Printf("tftp: listening on %s", cfg.TFTPAddr)
 
 		ln, err := net.ListenPacket("udp", cfg.TFTPAddr)
 		if err != nil {
+			srv.SetListener(httpserver.ListenerTFTP, "", err)
 			return err
 		}
+		srv.SetListener(httpserver.ListenerTFTP, ln.LocalAddr().String(), nil)
 
 		go func() {
 			<-ctx.Done()
 			tftpSrv.Shutdown()
 		}()
 
-		return tftpSrv.Serve(ln.(*net.UDPConn))
+		err = tftpSrv.Serve(ln.(*net.UDPConn))
+		srv.SetListener(httpserver.ListenerTFTP, "", fmt.Errorf("stopped: %v", err))
+		return err
 	})
 
 	// HTTP server
 	g.Go(func() error {
-		httpHandler := handler
-		if cfg.HTTPSRedirect {
-			// Extract port from HTTPS address for redirect target
-			httpsPort := "443"
-			if _, p, err := net.SplitHostPort(cfg.HTTPSAddr); err == nil {
-				httpsPort = p
-			}
-			httpHandler = httpserver.HTTPSRedirectMiddleware(httpsPort, handler)
+		// Extract port from HTTPS address for redirect target
+		httpsPort := "443"
+		if _, p, err := net.SplitHostPort(cfg.HTTPSAddr); err == nil {
+			httpsPort = p
+		}
+		if srv.HTTPSRedirect() {
 			log.Print("http: HTTPS redirect enabled (iPXE clients excluded)")
 		}
-
-		httpSrv := &http.Server{
-			Addr:    cfg.HTTPAddr,
-			Handler: httpHandler,
+		if srv.HTTPBootOnly() {
+			log.Print("http: serving only the boot chain over HTTP")
 		}
+
+		httpSrv := httpserver.NewHTTPServer(cfg.HTTPAddr,
+			httpserver.HTTPPolicyMiddleware(httpsPort, srv.HTTPSRedirect, srv.HTTPBootOnly, handler))
 		log.Printf("http: listening on %s", cfg.HTTPAddr)
 
 		go func() {
@@ -111,24 +239,49 @@ func main() {
 
 	// HTTPS server
 	g.Go(func() error {
-		tlsCfg, err := duhtls.ProvideTLS(ctx, duhtls.Options{
+		var sans []string
+		if cfg.TLSSANs != "" {
+			sans = strings.Split(cfg.TLSSANs, ",")
+		}
+		tlsCfg, selfSigned, err := duhtls.ProvideTLS(ctx, duhtls.Options{
 			DataDir:     cfg.DataDir,
 			CertFile:    cfg.TLSCertFile,
 			KeyFile:     cfg.TLSKeyFile,
-			ACMEDomain:  cfg.ACMEDomain,
+			ACMEDomains: cfg.ACMEDomains,
 			ACMEEmail:   cfg.ACMEEmail,
 			ACMEStaging: cfg.ACMEStaging,
+			SelfSigned: duhtls.SelfSignedOptions{
+				SANs:    sans,
+				NoRegen: cfg.TLSNoRegen,
+			},
 		})
+		// The health checks look at the certificate for the advertised
+		// host, or the first domain.
+		certName := cfg.ACMEAdvertise
+		if certName == "" && len(cfg.ACMEDomains) > 0 {
+			certName = cfg.ACMEDomains[0]
+		}
+		srv.SetTLS(tlsCfg, certName, err)
+		if selfSigned != nil {
+			srv.SetCertRegenerator(selfSigned.Regenerate)
+		}
 		if err != nil {
 			log.Printf("tls: %v (HTTPS disabled)", err)
 			return nil
 		}
-
-		httpsSrv := &http.Server{
-			Addr:      cfg.HTTPSAddr,
-			Handler:   handler,
-			TLSConfig: tlsCfg,
+		if srv.CA != nil {
+			// Machines may present their certificate; browsers and
+			// everything else connect as before.
+			tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+			tlsCfg.ClientCAs = srv.CA.Pool()
 		}
+		srv.ApplyTLSPolicy(tlsCfg)
+		if fips140.Enabled() {
+			log.Print("https: FIPS 140-3 mode on")
+		}
+
+		httpsSrv := httpserver.NewHTTPServer(cfg.HTTPSAddr, handler)
+		httpsSrv.TLSConfig = tlsCfg
 		log.Printf("https: listening on %s", cfg.HTTPSAddr)
 
 		go func() {
@@ -147,6 +300,27 @@ func main() {
 		return nil
 	})
 
+	// Background jobs; drained on shutdown
+	g.Go(func() error {
+		return srv.Jobs.Run(ctx)
+	})
+
+	// Periodic tasks: catalog refresh, trash janitor, certificate checks
+	// and backups
+	g.Go(func() error {
+		return srv.RunScheduler(ctx)
+	})
+
+	// Transition timers
+	g.Go(func() error {
+		return srv.RunTransitionTimers(ctx)
+	})
+
+	// Forward and reverse DNS checks of systems
+	g.Go(func() error {
+		return srv.RunDNSChecks(ctx)
+	})
+
 	// Proxy DHCP server (optional)
 	if cfg.ProxyDHCP {
 		g.Go(func() error {
@@ -170,8 +344,20 @@ func main() {
 
 			log.Printf("proxydhcp: server IP %s on %s", serverIP, iface)
 
-			pdhcp := proxydhcp.New(serverIP, cfg.TFTPAddr, cfg.HTTPAddr, cfg.ServerURL, iface)
-			return pdhcp.ListenAndServe(ctx)
+			pdhcp := proxydhcp.New(serverIP, cfg.TFTPAddr, cfg.HTTPAddr, srv.Setting("server_url"), iface)
+			pdhcp.CurrentServerURL = func() string { return srv.Setting("server_url") }
+			pdhcp.BootFile = srv.BootFileFor
+			pdhcp.ExtraOptions = srv.DHCPOptions
+			pdhcp.Policy = srv.DHCPPolicy
+			pdhcp.KnownSystem = srv.KnownSystem
+			pdhcp.SystemSubnets = srv.TenantSubnets
+			pdhcp.Listening = func(ports []int) {
+				srv.SetListener(httpserver.ListenerProxyDHCP, fmt.Sprintf("%s ports %v", iface, ports), nil)
+			}
+			pdhcp.ChainToken = srv.ChainToken
+			err := pdhcp.ListenAndServe(ctx)
+			srv.SetListener(httpserver.ListenerProxyDHCP, "", fmt.Errorf("stopped: %v", err))
+			return err
 		})
 	}
 
@@ -179,3 +365,137 @@ func main() {
 		log.Fatalf("fatal: %v", err)
 	}
 }
+
+// acmeServerURL is the HTTPS server URL for -acme-advertise, which must be
+// a host covered by one of the ACME domains.
+func acmeServerURL(cfg *config.Config) (string, error) {
+	if cfg.ServerURL != "" {
+		return "", errors.New("-acme-advertise and -server-url can't both be set")
+	}
+	host := strings.ToLower(cfg.ACMEAdvertise)
+	if strings.Contains(host, "*") {
+		return "", fmt.Errorf("-acme-advertise %s: give a concrete host name, not a wildcard", host)
+	}
+	covered := slices.ContainsFunc(cfg.ACMEDomains, func(d string) bool {
+		return duhtls.DomainCovers(d, host)
+	})
+	if !covered {
+		return "", fmt.Errorf("-acme-advertise %s is not covered by any -acme-domain", host)
+	}
+	serverURL := "https://" + host
+	if _, port, err := net.SplitHostPort(cfg.HTTPSAddr); err == nil && port != "443" {
+		serverURL += ":" + port
+	}
+	return serverURL, nil
+}
+
+// runCacheNode serves image files for the primary at -cache-of, keeping a
+// copy of each under the data directory. Nothing else runs.
+func runCacheNode(cfg *config.Config) {
+	p := &cache.Proxy{
+		Upstream: cfg.CacheOf,
+		Dir:      filepath.Join(cfg.DataDir, "cache"),
+		Name:     cfg.CacheName,
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	httpSrv := httpserver.NewHTTPServer(cfg.HTTPAddr, p.Handler())
+	go func() {
+		<-ctx.Done()
+		httpSrv.Close()
+	}()
+	log.Printf("cache: caching %s, listening on %s", cfg.CacheOf, cfg.HTTPAddr)
+	if err := httpSrv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatalf("fatal: %v", err)
+	}
+}
+
+// loadDBKey sets the key encrypting secrets in the database from
+// DUH_DB_KEY, -db-key-file or -db-key-command, whichever is given.
+func loadDBKey(cfg *config.Config) error {
+	raw, source := os.Getenv("DUH_DB_KEY"), "DUH_DB_KEY"
+	switch {
+	case cfg.DBKeyFile != "":
+		b, err := os.ReadFile(cfg.DBKeyFile)
+		if err != nil {
+			return err
+		}
+		raw, source = string(b), cfg.DBKeyFile
+	case cfg.DBKeyCommand != "":
+		out, err := exec.Command("sh", "-c", cfg.DBKeyCommand).Output()
+		if err != nil {
+			return fmt.Errorf("-db-key-command: %w", err)
+		}
+		raw, source = string(out), "-db-key-command"
+	}
+	if raw == "" {
+		return nil
+	}
+	key, err := db.ParseKey(raw)
+	if err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+	log.Printf("db: encrypting secrets with the key from %s", source)
+	return db.SetKey(key)
+}
+
+// runDecryptCommand handles -db-decrypt, storing the database's secrets
+// plain so it can be opened without its key or encrypted under a new one.
+func runDecryptCommand(cfg *config.Config) {
+	database, err := db.Open(cfg.DataDir)
+	if err != nil {
+		log.Fatalf("database: %v", err)
+	}
+	defer database.Close()
+	if err := db.DecryptSecrets(database); err != nil {
+		log.Fatalf("decrypt: %v", err)
+	}
+	fmt.Println("secrets decrypted; start duh without a key, or with a new one to encrypt them again")
+}
+
+// runMigrationCommand handles the --migrate-dry-run and --migrate-down-to
+// maintenance flags. Neither starts any servers.
+func runMigrationCommand(cfg *config.Config) {
+	database, err := db.OpenRaw(cfg.DataDir)
+	if err != nil {
+		log.Fatalf("database: %v", err)
+	}
+	defer database.Close()
+
+	current, err := db.SchemaVersion(database)
+	if err != nil {
+		log.Fatalf("database: %v", err)
+	}
+
+	if cfg.MigrateDryRun {
+		pending, err := db.PendingMigrations(database)
+		if err != nil {
+			log.Fatalf("database: %v", err)
+		}
+		fmt.Printf("schema version %d, latest %d\n", current, db.LatestSchemaVersion())
+		if len(pending) == 0 {
+			fmt.Println("no pending migrations")
+			return
+		}
+		fmt.Println("pending migrations:")
+		for _, p := range pending {
+			fmt.Println("  " + p)
+		}
+		return
+	}
+
+	if cfg.MigrateDownTo >= current {
+		fmt.Printf("schema version %d, nothing to revert\n", current)
+		return
+	}
+	path, err := db.BackupToDir(database, filepath.Join(cfg.DataDir, "backups"), fmt.Sprintf("pre-down-v%d", cfg.MigrateDownTo))
+	if err != nil {
+		log.Fatalf("backup: %v", err)
+	}
+	log.Printf("db: backed up schema v%d to %s", current, path)
+	if err := db.MigrateDown(database, cfg.MigrateDownTo); err != nil {
+		log.Fatalf("migrate down: %v", err)
+	}
+	fmt.Printf("reverted schema version %d -> %d\n", current, cfg.MigrateDownTo)
+}
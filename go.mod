@@ -9,6 +9,7 @@ require (
 	github.com/pin/tftp/v3 v3.1.0
 	golang.org/x/crypto v0.47.0
 	golang.org/x/sync v0.19.0
+	gopkg.in/yaml.v3 v3.0.1
 	modernc.org/sqlite v1.34.5
 )
 
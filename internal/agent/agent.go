@@ -0,0 +1,99 @@
+// Package agent is the protocol between duh and duh-agent, the daemon
+// that provisioned hosts run to keep in touch after their install: it
+// sends heartbeats with inventory and health, fetches follow-up
+// configuration, and runs the commands duh queues for it.
+//
+// The agent authenticates with the machine certificate duh issued the
+// host, so it needs duh's -machine-certs.
+package agent
+
+// Paths of the agent endpoints, relative to the server URL.
+const (
+	PathHeartbeat = "/api/v1/agent/heartbeat"
+	PathConfig    = "/api/v1/agent/config"
+	PathCommands  = "/api/v1/agent/commands/" // followed by the command ID
+	PathConsole   = "/api/v1/agent/console"
+	PathRenewCert = "/api/v1/machine/cert"
+)
+
+// Command types.
+const (
+	// CommandReimage asks the host to reboot into a reinstall. duh has
+	// already queued the system, so the next network boot installs it.
+	CommandReimage = "reimage"
+)
+
+// Heartbeat is what the agent posts every interval.
+type Heartbeat struct {
+	Version   string    `json:"version"`
+	Hostname  string    `json:"hostname"`
+	UptimeSec int64     `json:"uptime_sec"`
+	Inventory Inventory `json:"inventory"`
+	Health    Health    `json:"health"`
+}
+
+// HeartbeatReply tells the agent when to check in next, whether its
+// configuration changed, and what to run. Console asks it to attach its
+// console, as someone is waiting to watch it.
+type HeartbeatReply struct {
+	IntervalSec int       `json:"interval_sec"`
+	ConfigHash  string    `json:"config_hash"`
+	Commands    []Command `json:"commands,omitempty"`
+	Console     bool      `json:"console,omitempty"`
+}
+
+// Command is work duh queued for the agent. The agent reports back with
+// a CommandResult.
+type Command struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+}
+
+// CommandResult is the outcome of a Command.
+type CommandResult struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// Config is the follow-up configuration duh holds for the host.
+type Config struct {
+	SystemID  int64             `json:"system_id"`
+	Hostname  string            `json:"hostname"`
+	State     string            `json:"state"`
+	ImageID   *int64            `json:"image_id"`
+	ProfileID *int64            `json:"profile_id"`
+	Tags      []string          `json:"tags"`
+	Vars      map[string]string `json:"vars"`
+}
+
+// Inventory describes the host's hardware and OS. It rarely changes.
+type Inventory struct {
+	OS          string      `json:"os,omitempty"`
+	Kernel      string      `json:"kernel,omitempty"`
+	Arch        string      `json:"arch"`
+	CPUs        int         `json:"cpus"`
+	MemoryBytes int64       `json:"memory_bytes,omitempty"`
+	Disks       []Disk      `json:"disks,omitempty"`
+	Interfaces  []Interface `json:"interfaces,omitempty"`
+}
+
+type Disk struct {
+	Name      string `json:"name"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+type Interface struct {
+	Name  string   `json:"name"`
+	MAC   string   `json:"mac,omitempty"`
+	Addrs []string `json:"addrs,omitempty"`
+}
+
+// Health is a snapshot of how the host is doing.
+type Health struct {
+	Load1          float64 `json:"load1"`
+	Load5          float64 `json:"load5"`
+	Load15         float64 `json:"load15"`
+	MemAvailBytes  int64   `json:"mem_avail_bytes,omitempty"`
+	RootFreeBytes  int64   `json:"root_free_bytes,omitempty"`
+	RootTotalBytes int64   `json:"root_total_bytes,omitempty"`
+}
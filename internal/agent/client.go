@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Client talks to duh on the agent's behalf. HTTP must present the
+// host's machine certificate.
+type Client struct {
+	ServerURL string
+	HTTP      *http.Client
+}
+
+// RenewedCert is a fresh machine certificate from duh.
+type RenewedCert struct {
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	CA       string `json:"ca"`
+	NotAfter string `json:"not_after"`
+}
+
+// Heartbeat checks in with duh.
+func (c *Client) Heartbeat(ctx context.Context, hb Heartbeat) (*HeartbeatReply, error) {
+	var reply HeartbeatReply
+	if err := c.do(ctx, http.MethodPost, PathHeartbeat, hb, &reply); err != nil {
+		return nil, fmt.Errorf("heartbeat: %w", err)
+	}
+	return &reply, nil
+}
+
+// Config fetches the host's configuration.
+func (c *Client) Config(ctx context.Context) (*Config, error) {
+	var cfg Config
+	if err := c.do(ctx, http.MethodGet, PathConfig, nil, &cfg); err != nil {
+		return nil, fmt.Errorf("fetch config: %w", err)
+	}
+	return &cfg, nil
+}
+
+// Report tells duh how a command went.
+func (c *Client) Report(ctx context.Context, id int64, res CommandResult) error {
+	if err := c.do(ctx, http.MethodPost, PathCommands+strconv.FormatInt(id, 10), res, nil); err != nil {
+		return fmt.Errorf("report command %d: %w", id, err)
+	}
+	return nil
+}
+
+// RenewCert asks duh for a new machine certificate.
+func (c *Client) RenewCert(ctx context.Context) (*RenewedCert, error) {
+	var rc RenewedCert
+	if err := c.do(ctx, http.MethodPost, PathRenewCert, nil, &rc); err != nil {
+		return nil, fmt.Errorf("renew certificate: %w", err)
+	}
+	return &rc, nil
+}
+
+// Console streams output, the host's console, to duh and returns the
+// input typed into it. The stream lasts until duh closes it, when nobody
+// is watching any more, or output ends.
+func (c *Client) Console(ctx context.Context, output io.Reader) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(c.ServerURL, "/")+PathConsole, output)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	// The client's timeout would cut the stream off.
+	hc := *c.HTTP
+	hc.Timeout = 0
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("console: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("console: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(c.ServerURL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// CollectInventory describes the host the agent runs on. Details the
+// platform doesn't expose through /proc and /sys are left out.
+func CollectInventory() Inventory {
+	inv := Inventory{
+		OS:     osName(),
+		Kernel: readLine("/proc/sys/kernel/osrelease"),
+		Arch:   runtime.GOARCH,
+		CPUs:   runtime.NumCPU(),
+	}
+	mem := meminfo()
+	inv.MemoryBytes = mem["MemTotal"]
+	inv.Disks = disks()
+	inv.Interfaces = interfaces()
+	return inv
+}
+
+// CollectHealth takes a snapshot of the host's load, memory and root
+// filesystem.
+func CollectHealth() Health {
+	var h Health
+	if f := strings.Fields(readLine("/proc/loadavg")); len(f) >= 3 {
+		h.Load1, _ = strconv.ParseFloat(f[0], 64)
+		h.Load5, _ = strconv.ParseFloat(f[1], 64)
+		h.Load15, _ = strconv.ParseFloat(f[2], 64)
+	}
+	h.MemAvailBytes = meminfo()["MemAvailable"]
+	if free, total, err := diskSpace("/"); err == nil {
+		h.RootFreeBytes, h.RootTotalBytes = free, total
+	}
+	return h
+}
+
+// Uptime returns the host's uptime in seconds, or 0 if it is unknown.
+func Uptime() int64 {
+	f := strings.Fields(readLine("/proc/uptime"))
+	if len(f) == 0 {
+		return 0
+	}
+	up, _ := strconv.ParseFloat(f[0], 64)
+	return int64(up)
+}
+
+func readLine(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	line, _, _ := strings.Cut(string(b), "\n")
+	return strings.TrimSpace(line)
+}
+
+// osName is PRETTY_NAME from os-release, falling back to GOOS.
+func osName() string {
+	f, err := os.Open("/etc/os-release")
+	if err != nil {
+		return runtime.GOOS
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "PRETTY_NAME="); ok {
+			return strings.Trim(v, `"'`)
+		}
+	}
+	return runtime.GOOS
+}
+
+// meminfo returns /proc/meminfo's fields in bytes.
+func meminfo() map[string]int64 {
+	out := make(map[string]int64)
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return out
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		key, rest, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			n *= 1024
+		}
+		out[key] = n
+	}
+	return out
+}
+
+// disks lists block devices from /sys/block, skipping virtual ones.
+func disks() []Disk {
+	entries, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return nil
+	}
+	var out []Disk
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") || strings.HasPrefix(name, "zram") {
+			continue
+		}
+		// size is always in 512-byte sectors, whatever the device's own.
+		sectors, err := strconv.ParseInt(readLine(filepath.Join("/sys/block", name, "size")), 10, 64)
+		if err != nil || sectors == 0 {
+			continue
+		}
+		out = append(out, Disk{Name: name, SizeBytes: sectors * 512})
+	}
+	return out
+}
+
+func interfaces() []Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var out []Interface
+	for _, ifc := range ifaces {
+		if ifc.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		i := Interface{Name: ifc.Name, MAC: ifc.HardwareAddr.String()}
+		if addrs, err := ifc.Addrs(); err == nil {
+			for _, a := range addrs {
+				i.Addrs = append(i.Addrs, a.String())
+			}
+		}
+		out = append(out, i)
+	}
+	return out
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package agent
+
+import "errors"
+
+func diskSpace(path string) (free, total int64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
@@ -0,0 +1,142 @@
+// Package attest checks the TPM endorsement keys systems enroll with
+// against the TPM manufacturers' CAs.
+//
+// It covers the endorsement key only: a system proves which TPM it has by
+// presenting the EK certificate its manufacturer issued, and duh pins
+// that EK. Attestation keys are recorded for later use, but credential
+// activation, which would prove the EK is present rather than copied, is
+// not done.
+package attest
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// oidSubjectAltName is the SAN extension. EK certificates put the TPM's
+// manufacturer, model and version in it as a directory name and mark it
+// critical, which crypto/x509 doesn't handle.
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// decode reads a PEM block or base64 DER; a TPM tool's output is usually
+// one or the other.
+func decode(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		return block.Bytes, nil
+	}
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// EK is a TPM's endorsement key.
+type EK struct {
+	Cert        *x509.Certificate // nil if only the key was sent
+	Public      crypto.PublicKey
+	Fingerprint string // hex SHA-256 of the key's PKIX DER
+}
+
+// ParseEK reads an EK from its certificate or public key, either PEM or
+// base64 DER. Given both, they must hold the same key.
+func ParseEK(certText, pubText string) (*EK, error) {
+	var ek EK
+	if strings.TrimSpace(certText) != "" {
+		der, err := decode(certText)
+		if err != nil {
+			return nil, fmt.Errorf("ek certificate: %w", err)
+		}
+		if ek.Cert, err = x509.ParseCertificate(der); err != nil {
+			return nil, fmt.Errorf("ek certificate: %w", err)
+		}
+		ek.Public = ek.Cert.PublicKey
+	}
+	if strings.TrimSpace(pubText) != "" {
+		der, err := decode(pubText)
+		if err != nil {
+			return nil, fmt.Errorf("ek public key: %w", err)
+		}
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("ek public key: %w", err)
+		}
+		if ek.Public != nil {
+			k, ok := pub.(interface{ Equal(crypto.PublicKey) bool })
+			if !ok || !k.Equal(ek.Public) {
+				return nil, errors.New("ek public key is not the certificate's key")
+			}
+		}
+		ek.Public = pub
+	}
+	if ek.Public == nil {
+		return nil, errors.New("an EK certificate or public key is required")
+	}
+	der, err := x509.MarshalPKIXPublicKey(ek.Public)
+	if err != nil {
+		return nil, fmt.Errorf("ek public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	ek.Fingerprint = hex.EncodeToString(sum[:])
+	return &ek, nil
+}
+
+// CertPEM is the EK certificate as PEM, or "" if there is none.
+func (ek *EK) CertPEM() string {
+	if ek.Cert == nil {
+		return ""
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ek.Cert.Raw}))
+}
+
+// PublicPEM is the EK's public key as PEM.
+func (ek *EK) PublicPEM() string {
+	der, _ := x509.MarshalPKIXPublicKey(ek.Public)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// ParseRoots reads the PEM certificates EK certificates are checked
+// against. Intermediates can be listed with the roots.
+func ParseRoots(s string) (*x509.CertPool, int, error) {
+	pool := x509.NewCertPool()
+	n := 0
+	rest := []byte(s)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, 0, fmt.Errorf("certificate %d: %w", n+1, err)
+		}
+		pool.AddCert(cert)
+		n++
+	}
+	if n == 0 && strings.TrimSpace(s) != "" {
+		return nil, 0, errors.New("no PEM certificates found")
+	}
+	return pool, n, nil
+}
+
+// VerifyEK checks that an EK certificate was issued by one of roots.
+func VerifyEK(cert *x509.Certificate, roots *x509.CertPool) error {
+	c := *cert
+	c.UnhandledCriticalExtensions = slices.DeleteFunc(slices.Clone(c.UnhandledCriticalExtensions),
+		func(oid asn1.ObjectIdentifier) bool { return oid.Equal(oidSubjectAltName) })
+	_, err := c.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
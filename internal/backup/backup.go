@@ -0,0 +1,165 @@
+// Package backup copies database backups to remote storage — an S3
+// bucket, a WebDAV folder or another duh server — and works out which to
+// keep.
+package backup
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Kinds of target.
+const (
+	KindS3     = "s3"
+	KindWebDAV = "webdav"
+	KindDuh    = "duh"
+)
+
+// Object is a backup kept on a target.
+type Object struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// Target is somewhere backups are kept.
+type Target interface {
+	Put(ctx context.Context, name string, body io.ReadSeeker, size int64) error
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	Delete(ctx context.Context, name string) error
+	// List returns the backups on the target, by name.
+	List(ctx context.Context) ([]Object, error)
+}
+
+// Config says where a target is and how to sign in to it.
+type Config struct {
+	Kind      string
+	URL       string // S3 endpoint (optional), WebDAV folder, or the other duh's base URL
+	Bucket    string // S3 only
+	Region    string // S3 only; us-east-1 if empty
+	Prefix    string // S3 only: prepended to every key
+	AccessKey string // S3 access key or WebDAV user
+	Secret    string // S3 secret key, WebDAV password or the other duh's store token
+}
+
+// uploadTimeout bounds one request to a target, uploads included.
+const uploadTimeout = 10 * time.Minute
+
+// New returns the target cfg describes.
+func New(cfg Config) (Target, error) {
+	client := &http.Client{Timeout: uploadTimeout}
+	switch cfg.Kind {
+	case KindS3:
+		return newS3(cfg, client)
+	case KindWebDAV:
+		u, err := parseURL(cfg.URL)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		return &webdav{base: u, user: cfg.AccessKey, password: cfg.Secret, client: client}, nil
+	case KindDuh:
+		u, err := parseURL(cfg.URL)
+		if err != nil {
+			return nil, err
+		}
+		u.Path = strings.TrimRight(u.Path, "/") + "/api/v1/backup-store/"
+		return &remoteDuh{base: u, token: cfg.Secret, client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown backup target %q", cfg.Kind)
+}
+
+func parseURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("backup target URL %q must be an http or https URL", raw)
+	}
+	return u, nil
+}
+
+// nameRe matches the names db.BackupToDir gives backups, which are all a
+// target is asked to keep: duh-<UTC time>-<label>.db.
+var nameRe = regexp.MustCompile(`^duh-(\d{8}-\d{6})-[a-z0-9-]+\.db$`)
+
+// ValidName reports whether name is a backup's name. Others are refused,
+// so a name can't reach outside a target's folder.
+func ValidName(name string) bool {
+	return nameRe.MatchString(name)
+}
+
+// Taken returns when the backup called name was taken, from its name.
+func Taken(name string) (time.Time, bool) {
+	m := nameRe.FindStringSubmatch(name)
+	if m == nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("20060102-150405", m[1])
+	return t, err == nil
+}
+
+// Expired returns the backups among names to delete so that only the
+// newest of each of the last daily days and of each of the last weekly ISO
+// weeks with a backup are kept. With both zero, none expire.
+func Expired(names []string, daily, weekly int) []string {
+	if daily <= 0 && weekly <= 0 {
+		return nil
+	}
+	type taken struct {
+		name string
+		at   time.Time
+	}
+	var all []taken
+	for _, n := range names {
+		if t, ok := Taken(n); ok {
+			all = append(all, taken{n, t})
+		}
+	}
+	slices.SortFunc(all, func(a, b taken) int { return b.at.Compare(a.at) })
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	var expired []string
+	for _, b := range all {
+		keep := false
+		if day := b.at.Format(time.DateOnly); len(days) < daily && !days[day] {
+			days[day] = true
+			keep = true
+		}
+		year, wk := b.at.ISOWeek()
+		if week := fmt.Sprintf("%d-%d", year, wk); len(weeks) < weekly && !weeks[week] {
+			weeks[week] = true
+			keep = true
+		}
+		if !keep {
+			expired = append(expired, b.name)
+		}
+	}
+	return expired
+}
+
+// sortObjects orders objects newest first.
+func sortObjects(objs []Object) {
+	slices.SortFunc(objs, func(a, b Object) int { return cmp.Compare(b.Name, a.Name) })
+}
+
+// checkStatus turns an error response into an error quoting the start of
+// its body.
+func checkStatus(resp *http.Response, what string) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	msg := strings.TrimSpace(string(b))
+	if msg == "" {
+		return fmt.Errorf("%s: %s", what, resp.Status)
+	}
+	return fmt.Errorf("%s: %s: %s", what, resp.Status, msg)
+}
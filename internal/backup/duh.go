@@ -0,0 +1,76 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// remoteDuh keeps backups on another duh server, in its backup store,
+// signed in with that server's store token.
+type remoteDuh struct {
+	base   *url.URL // the other server's /api/v1/backup-store/
+	token  string
+	client *http.Client
+}
+
+func (t *remoteDuh) do(ctx context.Context, method, name string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, t.base.JoinPath(name).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.client.Do(req)
+}
+
+func (t *remoteDuh) Put(ctx context.Context, name string, body io.ReadSeeker, size int64) error {
+	resp, err := t.do(ctx, http.MethodPut, name, body, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp, "upload "+name)
+}
+
+func (t *remoteDuh) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := t.do(ctx, http.MethodGet, name, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStatus(resp, "download "+name); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (t *remoteDuh) Delete(ctx context.Context, name string) error {
+	resp, err := t.do(ctx, http.MethodDelete, name, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp, "delete "+name)
+}
+
+func (t *remoteDuh) List(ctx context.Context) ([]Object, error) {
+	resp, err := t.do(ctx, http.MethodGet, "", nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, "list backups"); err != nil {
+		return nil, err
+	}
+	var objs []Object
+	if err := json.NewDecoder(resp.Body).Decode(&objs); err != nil {
+		return nil, err
+	}
+	sortObjects(objs)
+	return objs, nil
+}
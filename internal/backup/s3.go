@@ -0,0 +1,228 @@
+package backup
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the SHA-256 of an empty body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3 keeps backups in an S3 bucket, or any store speaking its API, using
+// path-style requests signed with Signature Version 4.
+type s3 struct {
+	endpoint          *url.URL
+	bucket, region    string
+	prefix            string
+	accessKey, secret string
+	client            *http.Client
+}
+
+func newS3(cfg Config, client *http.Client) (*s3, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("S3 bucket is required")
+	}
+	if cfg.AccessKey == "" || cfg.Secret == "" {
+		return nil, errors.New("S3 access key and secret are required")
+	}
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	raw := cfg.URL
+	if raw == "" {
+		raw = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := parseURL(raw)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	return &s3{
+		endpoint:  u,
+		bucket:    cfg.Bucket,
+		region:    region,
+		prefix:    cfg.Prefix,
+		accessKey: cfg.AccessKey,
+		secret:    cfg.Secret,
+		client:    client,
+	}, nil
+}
+
+func (t *s3) Put(ctx context.Context, name string, body io.ReadSeeker, size int64) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return fmt.Errorf("hash %s: %w", name, err)
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	resp, err := t.do(ctx, http.MethodPut, t.prefix+name, nil, body, size, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp, "upload "+name)
+}
+
+func (t *s3) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := t.do(ctx, http.MethodGet, t.prefix+name, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStatus(resp, "download "+name); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (t *s3) Delete(ctx context.Context, name string) error {
+	resp, err := t.do(ctx, http.MethodDelete, t.prefix+name, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp, "delete "+name)
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key  string
+		Size int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (t *s3) List(ctx context.Context) ([]Object, error) {
+	var objs []Object
+	q := url.Values{"list-type": {"2"}, "prefix": {t.prefix}}
+	for {
+		resp, err := t.do(ctx, http.MethodGet, "", q, nil, 0, emptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		var res listBucketResult
+		err = checkStatus(resp, "list bucket")
+		if err == nil {
+			err = xml.NewDecoder(resp.Body).Decode(&res)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range res.Contents {
+			if name := strings.TrimPrefix(c.Key, t.prefix); ValidName(name) {
+				objs = append(objs, Object{Name: name, Size: c.Size})
+			}
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			break
+		}
+		q.Set("continuation-token", res.NextContinuationToken)
+	}
+	sortObjects(objs)
+	return objs, nil
+}
+
+// do sends a signed request for key in the bucket, or for the bucket
+// itself if key is "".
+func (t *s3) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u := *t.endpoint
+	u.Path += "/" + t.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = ""
+	canonicalURI := uriEncode(u.Path, false)
+	u.RawPath = canonicalURI
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalURI,
+		u.RawQuery,
+		"host:" + u.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := now.Format("20060102") + "/" + t.region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+t.secret), now.Format("20060102"))
+	signingKey = hmacSHA256(signingKey, t.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.accessKey, scope, signedHeaders, signature))
+	return t.client.Do(req)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by key, as Signature Version 4
+// wants it.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes s as Signature Version 4 does: everything but
+// unreserved characters, and "/" too if encodeSlash.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,123 @@
+package backup
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// webdav keeps backups in a WebDAV folder, which must already exist.
+type webdav struct {
+	base           *url.URL
+	user, password string
+	client         *http.Client
+}
+
+func (t *webdav) request(ctx context.Context, method, name string, body io.Reader) (*http.Request, error) {
+	u := t.base
+	if name != "" {
+		u = t.base.JoinPath(name)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if t.user != "" || t.password != "" {
+		req.SetBasicAuth(t.user, t.password)
+	}
+	return req, nil
+}
+
+func (t *webdav) Put(ctx context.Context, name string, body io.ReadSeeker, size int64) error {
+	req, err := t.request(ctx, http.MethodPut, name, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp, "upload "+name)
+}
+
+func (t *webdav) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	req, err := t.request(ctx, http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStatus(resp, "download "+name); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (t *webdav) Delete(ctx context.Context, name string) error {
+	req, err := t.request(ctx, http.MethodDelete, name, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp, "delete "+name)
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><getcontentlength/></prop></propfind>`
+
+type multistatus struct {
+	Responses []struct {
+		Href   string `xml:"href"`
+		Length string `xml:"propstat>prop>getcontentlength"`
+	} `xml:"response"`
+}
+
+func (t *webdav) List(ctx context.Context) ([]Object, error) {
+	req, err := t.request(ctx, "PROPFIND", "", strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, "list folder"); err != nil {
+		return nil, err
+	}
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, err
+	}
+	var objs []Object
+	for _, r := range ms.Responses {
+		p, err := url.PathUnescape(r.Href)
+		if err != nil {
+			continue
+		}
+		name := path.Base(p)
+		if !ValidName(name) {
+			continue
+		}
+		size, _ := strconv.ParseInt(r.Length, 10, 64)
+		objs = append(objs, Object{Name: name, Size: size})
+	}
+	sortObjects(objs)
+	return objs, nil
+}
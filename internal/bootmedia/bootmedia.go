@@ -0,0 +1,40 @@
+// Package bootmedia builds small UEFI boot images: a USB disk image and an
+// ISO, each holding a FAT filesystem with the files given.
+package bootmedia
+
+import "encoding/binary"
+
+// partitionStart is where the USB image's only partition begins (1 MiB),
+// the alignment partitioning tools use.
+const partitionStart = 2048
+
+// USBImage returns a disk image, to write raw to a USB stick, with an MBR
+// and one EFI system partition holding files.
+func USBImage(files []File) ([]byte, error) {
+	fs, err := buildFAT(files, partitionStart)
+	if err != nil {
+		return nil, err
+	}
+	img := make([]byte, partitionStart*sectorSize+len(fs))
+	mbr := img[:sectorSize]
+	binary.LittleEndian.PutUint32(mbr[440:], 0x00D0B007) // disk signature
+	p := mbr[446:462]
+	copy(p[1:4], []byte{0xFE, 0xFF, 0xFF}) // CHS start: use LBA
+	p[4] = 0xEF                            // EFI system partition
+	copy(p[5:8], []byte{0xFE, 0xFF, 0xFF}) // CHS end: use LBA
+	binary.LittleEndian.PutUint32(p[8:], partitionStart)
+	binary.LittleEndian.PutUint32(p[12:], uint32(len(fs)/sectorSize))
+	mbr[510], mbr[511] = 0x55, 0xAA
+	copy(img[partitionStart*sectorSize:], fs)
+	return img, nil
+}
+
+// ISOImage returns an ISO image, to burn or attach as virtual media, that
+// boots files on UEFI firmware.
+func ISOImage(files []File, volumeID string) ([]byte, error) {
+	fs, err := buildFAT(files, 0)
+	if err != nil {
+		return nil, err
+	}
+	return buildISO(fs, volumeID), nil
+}
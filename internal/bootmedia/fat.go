@@ -0,0 +1,364 @@
+package bootmedia
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize  = 512
+	rootEntries = 512
+	dirEntSize  = 32
+
+	// FAT16 needs at least this many clusters; fewer would make it FAT12.
+	minFAT16Clusters = 4085
+)
+
+// File is a file to put on boot media. Path uses forward slashes and is
+// relative to the root, e.g. "EFI/BOOT/BOOTX64.EFI".
+type File struct {
+	Path string
+	Data []byte
+}
+
+// fatNode is a file or directory in the image being built.
+type fatNode struct {
+	name     string
+	data     []byte // files only
+	dir      bool
+	children []*fatNode
+	cluster  uint32
+	clusters uint32
+}
+
+// buildFAT returns a FAT16 filesystem image holding files. hidden is the
+// number of sectors before the filesystem on its disk, which goes into the
+// boot sector for firmware that checks it.
+func buildFAT(files []File, hidden uint32) ([]byte, error) {
+	root := &fatNode{dir: true}
+	for _, f := range files {
+		if err := addFile(root, f); err != nil {
+			return nil, err
+		}
+	}
+
+	// Clusters needed by everything but the fixed root directory.
+	var need uint32
+	var count func(n *fatNode)
+	count = func(n *fatNode) {
+		for _, c := range n.children {
+			if c.dir {
+				c.clusters = clustersFor(uint32(dirEntries(c, false) * dirEntSize))
+				count(c)
+			} else {
+				c.clusters = clustersFor(uint32(len(c.data)))
+			}
+			need += c.clusters
+		}
+	}
+	count(root)
+	if dirEntries(root, true) > rootEntries {
+		return nil, fmt.Errorf("too many files in root directory")
+	}
+
+	clusters := need + need/4 + 64 // leave some room to spare
+	if clusters < minFAT16Clusters+16 {
+		clusters = minFAT16Clusters + 16
+	}
+	if clusters > 65524 {
+		return nil, fmt.Errorf("files too large for boot image")
+	}
+	fatSectors := (clusters+2)*2/sectorSize + 1
+	rootSectors := uint32(rootEntries * dirEntSize / sectorSize)
+	const reserved = 1
+	dataStart := reserved + 2*fatSectors + rootSectors
+	total := dataStart + clusters
+
+	img := make([]byte, total*sectorSize)
+	writeBootSector(img, total, fatSectors, hidden)
+
+	// Allocate clusters in order, then fill in directories.
+	next := uint32(2)
+	var alloc func(n *fatNode)
+	alloc = func(n *fatNode) {
+		for _, c := range n.children {
+			if c.clusters > 0 {
+				c.cluster = next
+				next += c.clusters
+			}
+			if c.dir {
+				alloc(c)
+			}
+		}
+	}
+	alloc(root)
+
+	fat := make([]byte, fatSectors*sectorSize)
+	binary.LittleEndian.PutUint16(fat[0:], 0xFFF8)
+	binary.LittleEndian.PutUint16(fat[2:], 0xFFFF)
+	clusterOff := func(c uint32) int { return int(dataStart+c-2) * sectorSize }
+
+	var write func(n *fatNode, parent uint32)
+	write = func(n *fatNode, parent uint32) {
+		for _, c := range n.children {
+			for i := uint32(0); i < c.clusters; i++ {
+				v := uint16(c.cluster + i + 1)
+				if i == c.clusters-1 {
+					v = 0xFFFF
+				}
+				binary.LittleEndian.PutUint16(fat[(c.cluster+i)*2:], v)
+			}
+			if c.dir {
+				write(c, n.cluster)
+			} else {
+				copy(img[clusterOff(c.cluster):], c.data)
+			}
+		}
+		var entries []byte
+		if n == root {
+			entries = dirRecords(n, true, 0, 0)
+			copy(img[(reserved+2*fatSectors)*sectorSize:], entries)
+		} else {
+			entries = dirRecords(n, false, n.cluster, parent)
+			copy(img[clusterOff(n.cluster):], entries)
+		}
+	}
+	write(root, 0)
+
+	for i := uint32(0); i < 2; i++ {
+		copy(img[(reserved+i*fatSectors)*sectorSize:], fat)
+	}
+	return img, nil
+}
+
+func addFile(root *fatNode, f File) error {
+	parts := strings.Split(strings.Trim(path.Clean(f.Path), "/"), "/")
+	n := root
+	for i, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			return fmt.Errorf("invalid path %q", f.Path)
+		}
+		var child *fatNode
+		for _, c := range n.children {
+			if strings.EqualFold(c.name, p) {
+				child = c
+			}
+		}
+		last := i == len(parts)-1
+		if child == nil {
+			child = &fatNode{name: p, dir: !last}
+			n.children = append(n.children, child)
+		} else if last || !child.dir {
+			return fmt.Errorf("duplicate path %q", f.Path)
+		}
+		if last {
+			child.data = f.Data
+		}
+		n = child
+	}
+	return nil
+}
+
+func clustersFor(size uint32) uint32 {
+	if size == 0 {
+		return 0
+	}
+	return (size + sectorSize - 1) / sectorSize
+}
+
+// dirEntries counts the 32-byte entries a directory needs.
+func dirEntries(n *fatNode, isRoot bool) int {
+	count := 1 // volume label in the root, "." elsewhere
+	if !isRoot {
+		count++ // ".."
+	}
+	for _, c := range n.children {
+		count += 1 + len(lfnEntries(c.name, [11]byte{}))
+	}
+	return count
+}
+
+func dirRecords(n *fatNode, isRoot bool, self, parent uint32) []byte {
+	var buf []byte
+	if isRoot {
+		buf = append(buf, shortEntry(shortName83("DUH-BOOT"), 0x08, 0, 0)...)
+	} else {
+		var dot, dotdot [11]byte
+		copy(dot[:], ".          ")
+		copy(dotdot[:], "..         ")
+		buf = append(buf, shortEntry(dot, 0x10, self, 0)...)
+		buf = append(buf, shortEntry(dotdot, 0x10, parent, 0)...)
+	}
+
+	children := append([]*fatNode(nil), n.children...)
+	sort.SliceStable(children, func(i, j int) bool { return children[i].name < children[j].name })
+	used := make(map[[11]byte]bool)
+	for _, c := range children {
+		short, exact := shortName(c.name, used)
+		used[short] = true
+		if !exact {
+			buf = append(buf, lfnEntries(c.name, short)...)
+		}
+		attr := byte(0x20) // archive
+		size := uint32(len(c.data))
+		if c.dir {
+			attr, size = 0x10, 0
+		}
+		buf = append(buf, shortEntry(short, attr, c.cluster, size)...)
+	}
+	return buf
+}
+
+func shortEntry(name [11]byte, attr byte, cluster, size uint32) []byte {
+	e := make([]byte, dirEntSize)
+	copy(e[0:11], name[:])
+	e[11] = attr
+	// 2024-01-01 00:00, so images are reproducible.
+	const date = (2024-1980)<<9 | 1<<5 | 1
+	binary.LittleEndian.PutUint16(e[16:], date) // created
+	binary.LittleEndian.PutUint16(e[18:], date) // accessed
+	binary.LittleEndian.PutUint16(e[24:], date) // modified
+	binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(e[28:], size)
+	return e
+}
+
+// shortName83 pads an already valid 8.3 name into directory entry form.
+func shortName83(name string) [11]byte {
+	var s [11]byte
+	for i := range s {
+		s[i] = ' '
+	}
+	base, ext, _ := strings.Cut(name, ".")
+	copy(s[0:8], base)
+	copy(s[8:11], ext)
+	return s
+}
+
+// shortName returns the 8.3 name for name and whether it represents name
+// exactly; if not, a long name entry is needed too.
+func shortName(name string, used map[[11]byte]bool) ([11]byte, bool) {
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	valid := func(s string, max int) bool {
+		if len(s) == 0 && max == 8 || len(s) > max {
+			return false
+		}
+		for _, c := range s {
+			if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+				return false
+			}
+		}
+		return true
+	}
+	if valid(base, 8) && valid(ext, 3) {
+		return shortName83(name), true
+	}
+
+	clean := func(s string, max int) string {
+		var b strings.Builder
+		for _, c := range strings.ToUpper(s) {
+			if c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' {
+				b.WriteRune(c)
+			}
+			if b.Len() == max {
+				break
+			}
+		}
+		return b.String()
+	}
+	b, e := clean(base, 6), clean(ext, 3)
+	for i := 1; ; i++ {
+		tail := fmt.Sprintf("~%d", i)
+		stem := b
+		if len(stem)+len(tail) > 8 {
+			stem = stem[:8-len(tail)]
+		}
+		n := stem + tail
+		if e != "" {
+			n += "." + e
+		}
+		s := shortName83(n)
+		if !used[s] {
+			return s, false
+		}
+	}
+}
+
+// lfnEntries returns the long file name entries that precede short's entry,
+// last part first as they appear on disk. It returns nil for names that fit
+// 8.3 exactly; callers use that to size directories before short names are
+// assigned.
+func lfnEntries(name string, short [11]byte) []byte {
+	if _, exact := shortName(name, nil); exact {
+		return nil
+	}
+	units := utf16.Encode([]rune(name))
+	units = append(units, 0)
+	for len(units)%13 != 0 {
+		units = append(units, 0xFFFF)
+	}
+	var sum byte
+	for _, c := range short {
+		sum = (sum>>1 | sum<<7) + c
+	}
+	n := len(units) / 13
+	var buf []byte
+	for i := n; i >= 1; i-- {
+		e := make([]byte, dirEntSize)
+		e[0] = byte(i)
+		if i == n {
+			e[0] |= 0x40
+		}
+		e[11] = 0x0F
+		e[13] = sum
+		chunk := units[(i-1)*13 : i*13]
+		for j, u := range chunk {
+			var off int
+			switch {
+			case j < 5:
+				off = 1 + j*2
+			case j < 11:
+				off = 14 + (j-5)*2
+			default:
+				off = 28 + (j-11)*2
+			}
+			binary.LittleEndian.PutUint16(e[off:], u)
+		}
+		buf = append(buf, e...)
+	}
+	return buf
+}
+
+func writeBootSector(img []byte, total, fatSectors, hidden uint32) {
+	b := img[:sectorSize]
+	copy(b[0:], []byte{0xEB, 0x3C, 0x90})
+	copy(b[3:11], "DUH     ")
+	binary.LittleEndian.PutUint16(b[11:], sectorSize)
+	b[13] = 1                                // sectors per cluster
+	binary.LittleEndian.PutUint16(b[14:], 1) // reserved sectors
+	b[16] = 2                                // FATs
+	binary.LittleEndian.PutUint16(b[17:], rootEntries)
+	if total < 0x10000 {
+		binary.LittleEndian.PutUint16(b[19:], uint16(total))
+	} else {
+		binary.LittleEndian.PutUint32(b[32:], total)
+	}
+	b[21] = 0xF8 // fixed disk
+	binary.LittleEndian.PutUint16(b[22:], uint16(fatSectors))
+	binary.LittleEndian.PutUint16(b[24:], 32) // sectors per track
+	binary.LittleEndian.PutUint16(b[26:], 64) // heads
+	binary.LittleEndian.PutUint32(b[28:], hidden)
+	b[36] = 0x80 // drive number
+	b[38] = 0x29 // extended boot signature
+	binary.LittleEndian.PutUint32(b[39:], 0x00D0B007)
+	copy(b[43:54], "DUH-BOOT   ")
+	copy(b[54:62], "FAT16   ")
+	b[510], b[511] = 0x55, 0xAA
+}
@@ -0,0 +1,156 @@
+package bootmedia
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+const isoSectorSize = 2048
+
+// Sector layout of the ISO. Everything is small enough to fit in one sector.
+const (
+	pvdSector      = 16
+	bootRecSector  = 17
+	termSector     = 18
+	lPathSector    = 19
+	mPathSector    = 20
+	rootDirSector  = 21
+	catalogSector  = 22
+	efiImageSector = 23
+)
+
+// buildISO returns an ISO 9660 image that UEFI firmware boots through an El
+// Torito no-emulation entry pointing at efiImage, a FAT filesystem. The FAT
+// image is also visible on the disc as EFIBOOT.IMG.
+func buildISO(efiImage []byte, volumeID string) []byte {
+	efiSectors := (len(efiImage) + isoSectorSize - 1) / isoSectorSize
+	total := efiImageSector + efiSectors
+	img := make([]byte, total*isoSectorSize)
+	sector := func(n int) []byte { return img[n*isoSectorSize : (n+1)*isoSectorSize] }
+
+	// Primary volume descriptor
+	pvd := sector(pvdSector)
+	pvd[0] = 1
+	copy(pvd[1:6], "CD001")
+	pvd[6] = 1
+	fill(pvd[8:40], "")
+	fill(pvd[40:72], strings.ToUpper(volumeID))
+	bothEndian32(pvd[80:], uint32(total))
+	bothEndian16(pvd[120:], 1) // volume set size
+	bothEndian16(pvd[124:], 1) // volume sequence number
+	bothEndian16(pvd[128:], isoSectorSize)
+	bothEndian32(pvd[132:], 10) // path table size
+	binary.LittleEndian.PutUint32(pvd[140:], lPathSector)
+	binary.BigEndian.PutUint32(pvd[148:], mPathSector)
+	copy(pvd[156:], dirRecord([]byte{0}, rootDirSector, isoSectorSize, true))
+	fill(pvd[190:318], "") // volume set
+	fill(pvd[318:446], "") // publisher
+	fill(pvd[446:574], "") // data preparer
+	fill(pvd[574:702], "DUH")
+	fill(pvd[702:813], "") // copyright, abstract and bibliographic files
+	for _, off := range []int{813, 830, 847, 864} {
+		copy(pvd[off:off+16], "0000000000000000") // dates: unspecified
+	}
+	pvd[881] = 1 // file structure version
+
+	// El Torito boot record
+	br := sector(bootRecSector)
+	br[0] = 0
+	copy(br[1:6], "CD001")
+	br[6] = 1
+	copy(br[7:], "EL TORITO SPECIFICATION")
+	binary.LittleEndian.PutUint32(br[71:], catalogSector)
+
+	// Volume descriptor set terminator
+	term := sector(termSector)
+	term[0] = 255
+	copy(term[1:6], "CD001")
+	term[6] = 1
+
+	// Path tables, holding just the root directory
+	lpt := sector(lPathSector)
+	lpt[0] = 1
+	binary.LittleEndian.PutUint32(lpt[2:], rootDirSector)
+	binary.LittleEndian.PutUint16(lpt[6:], 1)
+	mpt := sector(mPathSector)
+	mpt[0] = 1
+	binary.BigEndian.PutUint32(mpt[2:], rootDirSector)
+	binary.BigEndian.PutUint16(mpt[6:], 1)
+
+	// Root directory
+	root := sector(rootDirSector)
+	off := 0
+	for _, rec := range [][]byte{
+		dirRecord([]byte{0}, rootDirSector, isoSectorSize, true),
+		dirRecord([]byte{1}, rootDirSector, isoSectorSize, true),
+		dirRecord([]byte("BOOT.CAT;1"), catalogSector, isoSectorSize, false),
+		dirRecord([]byte("EFIBOOT.IMG;1"), efiImageSector, len(efiImage), false),
+	} {
+		off += copy(root[off:], rec)
+	}
+
+	// Boot catalog: a validation entry for the EFI platform, then the
+	// default entry.
+	cat := sector(catalogSector)
+	cat[0] = 1    // header ID
+	cat[1] = 0xEF // platform: EFI
+	copy(cat[4:28], "DUH")
+	cat[30], cat[31] = 0x55, 0xAA
+	var sum uint16
+	for i := 0; i < 32; i += 2 {
+		sum += binary.LittleEndian.Uint16(cat[i:])
+	}
+	binary.LittleEndian.PutUint16(cat[28:], -sum)
+	entry := cat[32:64]
+	entry[0] = 0x88 // bootable
+	entry[1] = 0    // no emulation
+	// Virtual 512-byte sectors to load; firmware reads the whole FAT
+	// image from the catalog entry's start.
+	count := (len(efiImage) + 511) / 512
+	if count > 0xFFFF {
+		count = 0xFFFF
+	}
+	binary.LittleEndian.PutUint16(entry[6:], uint16(count))
+	binary.LittleEndian.PutUint32(entry[8:], efiImageSector)
+
+	copy(img[efiImageSector*isoSectorSize:], efiImage)
+	return img
+}
+
+// dirRecord builds an ISO 9660 directory record.
+func dirRecord(name []byte, extent, size int, dir bool) []byte {
+	n := 33 + len(name)
+	if n%2 != 0 {
+		n++
+	}
+	r := make([]byte, n)
+	r[0] = byte(n)
+	bothEndian32(r[2:], uint32(extent))
+	bothEndian32(r[10:], uint32(size))
+	copy(r[18:25], []byte{124, 1, 1, 0, 0, 0, 0}) // 2024-01-01 00:00 UTC
+	if dir {
+		r[25] = 2
+	}
+	bothEndian16(r[28:], 1)
+	r[32] = byte(len(name))
+	copy(r[33:], name)
+	return r
+}
+
+func bothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b[0:], v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func bothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:], v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+// fill writes s into a space-padded field.
+func fill(b []byte, s string) {
+	for i := range b {
+		b[i] = ' '
+	}
+	copy(b, s)
+}
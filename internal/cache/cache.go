@@ -0,0 +1,221 @@
+// Package cache runs duh as a cache node: an HTTP server at a remote site
+// that serves image files from a local copy, filled from the primary
+// server on first use. The primary still authorizes every download, since
+// each request's signed token is checked there before anything is sent.
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NodeHeader names the cache node on requests to the primary, which uses
+// it to show when the node was last seen.
+const NodeHeader = "X-Duh-Cache-Node"
+
+// Proxy serves /images/{id}/file/{name} from Dir, fetching from Upstream
+// what it doesn't have or what changed there.
+type Proxy struct {
+	Upstream string // primary server URL
+	Dir      string
+	Name     string // as registered on the primary
+	Client   *http.Client
+
+	mu      sync.Mutex
+	filling map[string]bool
+}
+
+// Handler returns the cache node's routes.
+func (p *Proxy) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /images/{id}/file/{name}", p.handleFile)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+func (p *Proxy) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return http.DefaultClient
+}
+
+func (p *Proxy) upstream(ctx context.Context, method string, r *http.Request) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(p.Upstream, "/")+r.URL.RequestURI(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.Name != "" {
+		req.Header.Set(NodeHeader, p.Name)
+	}
+	if rg := r.Header.Get("Range"); rg != "" && method == http.MethodGet {
+		req.Header.Set("Range", rg)
+	}
+	return p.client().Do(req)
+}
+
+func (p *Proxy) handleFile(w http.ResponseWriter, r *http.Request) {
+	id, name := filepath.Base(r.PathValue("id")), filepath.Base(r.PathValue("name"))
+	if id == "." || id == ".." || name == "." || name == ".." {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	path := filepath.Join(p.Dir, "images", id, name)
+
+	// The primary checks the token and tells us the file's current size
+	// and modification time. Nothing is served without that, not even
+	// files already cached.
+	head, err := p.upstream(r.Context(), http.MethodHead, r)
+	if err != nil {
+		log.Printf("cache: head %s: %v", r.URL.Path, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	head.Body.Close()
+	switch {
+	case head.StatusCode == http.StatusNotFound:
+		os.Remove(path)
+		fallthrough
+	case head.StatusCode != http.StatusOK:
+		http.Error(w, http.StatusText(head.StatusCode), head.StatusCode)
+		return
+	}
+	if r.Method == http.MethodHead {
+		copyHeader(w, head)
+		return
+	}
+	size := head.ContentLength
+	mod, _ := http.ParseTime(head.Header.Get("Last-Modified"))
+
+	if f, info, ok := openCached(path); ok {
+		defer f.Close()
+		if info.Size() == size && info.ModTime().Equal(mod) {
+			http.ServeContent(w, r, name, mod, f)
+			return
+		}
+	}
+
+	// Ranged requests and files another request is already filling go
+	// straight through.
+	if r.Header.Get("Range") != "" || !p.startFill(path) {
+		p.passThrough(w, r)
+		return
+	}
+	defer p.endFill(path)
+	p.fill(w, r, path, size, mod)
+}
+
+func openCached(path string) (*os.File, os.FileInfo, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, false
+	}
+	return f, info, true
+}
+
+func (p *Proxy) startFill(path string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.filling[path] {
+		return false
+	}
+	if p.filling == nil {
+		p.filling = make(map[string]bool)
+	}
+	p.filling[path] = true
+	return true
+}
+
+func (p *Proxy) endFill(path string) {
+	p.mu.Lock()
+	delete(p.filling, path)
+	p.mu.Unlock()
+}
+
+// copyHeaders are the response headers passed on from the primary.
+var copyHeaders = []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "Last-Modified"}
+
+func copyHeader(w http.ResponseWriter, resp *http.Response) {
+	for _, h := range copyHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+}
+
+func (p *Proxy) passThrough(w http.ResponseWriter, r *http.Request) {
+	resp, err := p.upstream(r.Context(), http.MethodGet, r)
+	if err != nil {
+		log.Printf("cache: get %s: %v", r.URL.Path, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	copyHeader(w, resp)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// fill sends the file to the client while saving it. The copy replaces the
+// cached one only once complete.
+func (p *Proxy) fill(w http.ResponseWriter, r *http.Request, path string, size int64, mod time.Time) {
+	resp, err := p.upstream(r.Context(), http.MethodGet, r)
+	if err != nil {
+		log.Printf("cache: get %s: %v", r.URL.Path, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	copyHeader(w, resp)
+	if resp.StatusCode != http.StatusOK {
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Printf("cache: %v", err)
+		io.Copy(w, resp.Body)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".fill-*")
+	if err != nil {
+		log.Printf("cache: %v", err)
+		io.Copy(w, resp.Body)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(io.MultiWriter(tmp, w), resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || n != size {
+		log.Printf("cache: fill %s: got %d of %d bytes: %v", r.URL.Path, n, size, err)
+		return
+	}
+	if err := os.Chtimes(tmp.Name(), mod, mod); err != nil {
+		log.Printf("cache: %v", err)
+		return
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		log.Printf("cache: %v", err)
+		return
+	}
+	log.Printf("cache: stored %s (%d bytes)", r.URL.Path, n)
+}
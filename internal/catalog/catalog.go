@@ -1,6 +1,9 @@
 package catalog
 
 import (
+	"archive/zip"
+	"context"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
@@ -13,11 +16,14 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/jobs"
 	"github.com/justinpopa/duh/internal/safenet"
+	"github.com/justinpopa/duh/internal/tracing"
 )
 
 type Catalog struct {
@@ -29,6 +35,10 @@ type File struct {
 	Name   string `json:"name"`
 	URL    string `json:"url"`
 	SHA256 string `json:"sha256,omitempty"`
+	Role   string `json:"role,omitempty"` // kernel, initrd, or an extra file role
+	// Extract names a member of a zip archive at URL; only that member is
+	// kept, saved as Name.
+	Extract string `json:"extract,omitempty"`
 }
 
 type VarDef struct {
@@ -57,6 +67,13 @@ type Entry struct {
 	KernelParams   string   `json:"kernel_params,omitempty"`
 	ConfigTemplate string   `json:"config_template,omitempty"`
 	Vars           []VarDef `json:"vars,omitempty"`
+	Utility        bool     `json:"utility,omitempty"` // offered as a one-shot boot rather than an install
+}
+
+// MetaChanged reports whether the entry's icon, icon color or description
+// differ from those of the image pulled from it.
+func MetaChanged(entry Entry, img *db.Image) bool {
+	return entry.Description != img.Description || entry.Icon != img.Icon || entry.IconColor != img.IconColor
 }
 
 // ProfileData holds the profile-related fields extracted from a catalog entry.
@@ -158,26 +175,59 @@ func (e Entry) Hash() string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func Fetch(catalogURL string) (*Catalog, error) {
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Get(catalogURL)
+// fetchClient fetches catalogs and their signatures.
+var fetchClient = &http.Client{Timeout: 30 * time.Second}
+
+// Fetch fetches and parses the catalog. With a key, the catalog's
+// detached signature must verify against it.
+func Fetch(catalogURL string, key ed25519.PublicKey) (*Catalog, error) {
+	cat, _, err := FetchIfChanged(catalogURL, "", key)
+	return cat, err
+}
+
+// FetchIfChanged fetches the catalog unless it still matches etag, the
+// ETag of an earlier fetch. It returns a nil catalog when nothing changed,
+// along with the ETag to send next time ("" if the server gave none).
+func FetchIfChanged(catalogURL, etag string, key ed25519.PublicKey) (*Catalog, string, error) {
+	req, err := http.NewRequest(http.MethodGet, catalogURL, nil)
 	if err != nil {
-		return nil, fmt.Errorf("fetch catalog: %w", err)
+		return nil, "", fmt.Errorf("fetch catalog: %w", err)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("fetch catalog: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if etag != "" && resp.StatusCode == http.StatusNotModified {
+		return nil, etag, nil
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("catalog returned %d", resp.StatusCode)
+		return nil, "", fmt.Errorf("catalog returned %d", resp.StatusCode)
 	}
 
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("fetch catalog: %w", err)
+	}
+	if key != nil {
+		if err := verify(catalogURL, body, key); err != nil {
+			return nil, "", err
+		}
+	}
 	var cat Catalog
-	if err := json.NewDecoder(resp.Body).Decode(&cat); err != nil {
-		return nil, fmt.Errorf("parse catalog: %w", err)
+	if err := json.Unmarshal(body, &cat); err != nil {
+		return nil, "", fmt.Errorf("parse catalog: %w", err)
 	}
-	return &cat, nil
+	return &cat, resp.Header.Get("ETag"), nil
 }
 
-func Pull(database *sql.DB, dataDir string, entry Entry, force bool) (int64, error) {
+// Pull creates or resets the image for a catalog entry and queues the
+// download of its files on q.
+func Pull(database *sql.DB, dataDir string, q *jobs.Queue, entry Entry, force bool) (int64, error) {
 	hash := entry.Hash()
 
 	// Check if already pulled
@@ -190,9 +240,9 @@ func Pull(database *sql.DB, dataDir string, entry Entry, force bool) (int64, err
 			return existing.ID, fmt.Errorf("already downloading")
 		}
 		if existing.Status == db.ImageStatusReady && !force {
-			// Update icon if catalog has newer data
-			if entry.Icon != existing.Icon || entry.IconColor != existing.IconColor {
-				db.UpdateImageIcon(database, existing.ID, entry.Icon, entry.IconColor)
+			// Update icon and description if catalog has newer data
+			if MetaChanged(entry, existing) {
+				db.UpdateImageCatalogMeta(database, existing.ID, entry.Description, entry.Icon, entry.IconColor)
 			}
 			return existing.ID, fmt.Errorf("already pulled")
 		}
@@ -200,7 +250,7 @@ func Pull(database *sql.DB, dataDir string, entry Entry, force bool) (int64, err
 			// Error state: delete and recreate
 			imageDir := filepath.Join(dataDir, "images", fmt.Sprintf("%d", existing.ID))
 			os.RemoveAll(imageDir)
-			db.DeleteImage(database, existing.ID)
+			db.PurgeImage(database, existing.ID)
 		}
 	}
 
@@ -222,53 +272,286 @@ func Pull(database *sql.DB, dataDir string, entry Entry, force bool) (int64, err
 			return 0, err
 		}
 	}
+	if err := db.SetImageUtility(database, id, entry.Utility); err != nil {
+		return 0, err
+	}
+	if err := db.SetImageArch(database, id, entry.Arch); err != nil {
+		return 0, err
+	}
 
-	// Download in background
-	go func() {
-		imageDir := filepath.Join(dataDir, "images", fmt.Sprintf("%d", id))
-		if err := os.MkdirAll(imageDir, 0755); err != nil {
-			db.UpdateImageStatus(database, id, db.ImageStatusError, err.Error())
-			return
+	// Roles and checksums are re-derived from the entry's files as they
+	// download.
+	if err := db.UpdateImageFileMap(database, id, db.ImageFiles{}); err != nil {
+		return 0, err
+	}
+	if err := db.DeleteImageFileSums(database, id); err != nil {
+		return 0, err
+	}
+	if err := db.ClearDownloadProgress(database, id); err != nil {
+		return 0, err
+	}
+
+	if err := QueueDownload(q, id, entry.Name, entry.Files); err != nil {
+		db.UpdateImageStatus(database, id, db.ImageStatusError, err.Error())
+		return 0, err
+	}
+	return id, nil
+}
+
+// JobDownload is the job type that downloads files into an image; its
+// payload is a DownloadJob.
+const JobDownload = "catalog.download"
+
+// DownloadJob is the payload of a JobDownload job.
+type DownloadJob struct {
+	ImageID int64  `json:"image_id"`
+	Label   string `json:"label"`
+	Files   []File `json:"files"`
+}
+
+// QueueDownload queues the download of files into image id. label names
+// the image in logs.
+func QueueDownload(q *jobs.Queue, id int64, label string, files []File) error {
+	_, err := q.Enqueue(JobDownload, DownloadJob{ImageID: id, Label: label, Files: files})
+	return err
+}
+
+// DownloadHandler runs JobDownload jobs.
+func DownloadHandler(database *sql.DB, dataDir string) jobs.Handler {
+	return func(ctx context.Context, payload []byte) error {
+		var job DownloadJob
+		if err := json.Unmarshal(payload, &job); err != nil {
+			return jobs.Permanent(err)
 		}
+		return DownloadFiles(ctx, database, dataDir, job.ImageID, job.Label, job.Files)
+	}
+}
 
-		var downloaded []string
-		for i, f := range entry.Files {
-			log.Printf("catalog: downloading %s for %s", f.Name, entry.Name)
-			db.UpdateImageStatus(database, id, db.ImageStatusDownloading,
-				fmt.Sprintf("%d/%d %s 0%%", i+1, len(entry.Files), f.Name))
-
-			var lastPct int64
-			var lastUpdate time.Time
-			onProgress := func(dl, total int64) {
-				pct := dl * 100 / total
-				if pct != lastPct && time.Since(lastUpdate) > time.Second {
-					lastPct = pct
-					lastUpdate = time.Now()
-					db.UpdateImageStatus(database, id, db.ImageStatusDownloading,
-						fmt.Sprintf("%d/%d %s %d%%", i+1, len(entry.Files), f.Name, pct))
-				}
+// DownloadFiles fetches files into an image's directory, reporting
+// progress through the image's status. The image becomes ready once all
+// of them arrived, or errored at the first failure. Files with a SHA256 are
+// verified, and every file's checksum is recorded. Roles are merged into
+// the image's file map, so files can be added to an existing image. label
+// names the image in logs. When ctx is done the download stops, leaving
+// the image downloading so it can be resumed: how far each file got is
+// kept in the database, files already fetched are skipped, and a partial
+// one continues where it stopped if the server still has the same file.
+func DownloadFiles(ctx context.Context, database *sql.DB, dataDir string, id int64, label string, files []File) error {
+	img, err := db.GetImage(database, id)
+	if err != nil {
+		return fmt.Errorf("get image %d: %w", id, err)
+	}
+	if img == nil {
+		// Deleted, or pulled again as a new image, while queued.
+		return jobs.Permanent(fmt.Errorf("image %d no longer exists", id))
+	}
+	imageDir := filepath.Join(dataDir, "images", fmt.Sprintf("%d", id))
+	if err := os.MkdirAll(imageDir, 0755); err != nil {
+		db.UpdateImageStatus(database, id, db.ImageStatusError, err.Error())
+		return err
+	}
+	fileMap := img.Files()
+	for i, f := range files {
+		safeName := filepath.Base(f.Name)
+		dst := filepath.Join(imageDir, safeName)
+
+		prog, err := db.GetDownloadProgress(database, id, safeName)
+		if err != nil {
+			log.Printf("catalog: %v", err)
+		}
+		if prog != nil && prog.URL != f.URL {
+			prog = nil
+		}
+		if prog != nil && prog.Done {
+			if _, err := os.Stat(dst); err == nil {
+				log.Printf("catalog: %s for %s already downloaded", f.Name, label)
+				fileMap = addFileRole(fileMap, f.Role, safeName)
+				continue
 			}
+			prog = nil
+		}
+		if prog == nil {
+			prog = &db.DownloadProgress{ImageID: id, Name: safeName, URL: f.URL}
+		}
 
-			safeName := filepath.Base(f.Name)
-			if err := downloadFile(filepath.Join(imageDir, safeName), f.URL, onProgress); err != nil {
-				log.Printf("catalog: download %s failed: %v", f.Name, err)
-				db.UpdateImageStatus(database, id, db.ImageStatusError,
-					fmt.Sprintf("Failed to download %s: %v", f.Name, err))
+		pct := int64(0)
+		if prog.BytesTotal > 0 {
+			pct = prog.BytesDone * 100 / prog.BytesTotal
+		}
+		if prog.BytesDone > 0 {
+			log.Printf("catalog: resuming %s for %s at %d bytes", f.Name, label, prog.BytesDone)
+		} else {
+			log.Printf("catalog: downloading %s for %s", f.Name, label)
+		}
+		db.UpdateImageStatus(database, id, db.ImageStatusDownloading,
+			fmt.Sprintf("%d/%d %s %d%%", i+1, len(files), f.Name, pct))
+
+		lastPct := pct
+		var lastSave time.Time
+		onProgress := func(dl, total int64) {
+			prog.BytesDone, prog.BytesTotal = dl, total
+			if time.Since(lastSave) < time.Second {
 				return
 			}
-			downloaded = append(downloaded, safeName)
+			lastSave = time.Now()
+			if err := db.SaveDownloadProgress(database, prog); err != nil {
+				log.Printf("catalog: %v", err)
+			}
+			if total <= 0 {
+				return
+			}
+			if pct := dl * 100 / total; pct != lastPct {
+				lastPct = pct
+				db.UpdateImageStatus(database, id, db.ImageStatusDownloading,
+					fmt.Sprintf("%d/%d %s %d%%", i+1, len(files), f.Name, pct))
+			}
 		}
 
-		db.UpdateImageFiles(database, id, strings.Join(downloaded, ", "))
-		db.UpdateImageStatus(database, id, db.ImageStatusReady, "")
-		log.Printf("catalog: %s ready (%d files)", entry.Name, len(downloaded))
-	}()
+		spanCtx, span := tracing.StartKind(ctx, "catalog.download", tracing.KindClient)
+		span.SetAttr("url.full", f.URL)
+		span.SetAttr("duh.image_id", id)
+		span.SetAttr("duh.file", safeName)
+		if f.Extract != "" {
+			err = downloadAndExtract(spanCtx, dst, f.URL, f.Extract, &prog.Validator, onProgress)
+		} else {
+			err = downloadFile(spanCtx, dst, f.URL, &prog.Validator, onProgress)
+		}
+		var sum string
+		if err == nil {
+			sum, err = FileSHA256(dst)
+		}
+		if err == nil && f.SHA256 != "" && !strings.EqualFold(sum, f.SHA256) {
+			os.Remove(dst)
+			err = jobs.Permanent(fmt.Errorf("checksum mismatch: got sha256 %s, want %s", sum, f.SHA256))
+		}
+		if info, statErr := os.Stat(dst); statErr == nil {
+			span.SetAttr("duh.bytes", info.Size())
+		}
+		span.SetError(err)
+		span.End()
+		if err != nil && ctx.Err() != nil {
+			if err := db.SaveDownloadProgress(database, prog); err != nil {
+				log.Printf("catalog: %v", err)
+			}
+			db.UpdateImageStatus(database, id, db.ImageStatusDownloading,
+				fmt.Sprintf("%d/%d %s interrupted, resumes when duh restarts", i+1, len(files), f.Name))
+			return err
+		}
+		if err != nil {
+			log.Printf("catalog: download %s failed: %v", f.Name, err)
+			db.UpdateImageStatus(database, id, db.ImageStatusError,
+				fmt.Sprintf("Failed to download %s: %v", f.Name, err))
+			return err
+		}
+		source := db.SumSourceReceived
+		if f.SHA256 != "" {
+			source = db.SumSourceMetadata
+		}
+		if err := db.SetImageFileSum(database, id, safeName, sum, source); err != nil {
+			log.Printf("catalog: %v", err)
+		}
+		prog.Done = true
+		if err := db.SaveDownloadProgress(database, prog); err != nil {
+			log.Printf("catalog: %v", err)
+		}
+		fileMap = addFileRole(fileMap, f.Role, safeName)
+	}
 
-	return id, nil
+	names, err := ListFiles(imageDir)
+	if err != nil {
+		log.Printf("catalog: list %s files: %v", label, err)
+	}
+	db.UpdateImageFiles(database, id, strings.Join(names, ", "))
+	db.UpdateImageFileMap(database, id, fileMap)
+	db.UpdateImageStatus(database, id, db.ImageStatusReady, "")
+	if err := db.ClearDownloadProgress(database, id); err != nil {
+		log.Printf("catalog: %v", err)
+	}
+	log.Printf("catalog: %s ready (%d files)", label, len(files))
+	return nil
 }
 
-// validateDownloadURL checks that a URL is safe to fetch (http/https only).
-func validateDownloadURL(rawURL string) error {
+// addFileRole records in an image's file map that name plays role.
+func addFileRole(fileMap db.ImageFiles, role, name string) db.ImageFiles {
+	switch role {
+	case "":
+	case "kernel":
+		fileMap.Kernel = name
+	case "initrd":
+		fileMap.Initrds = append(fileMap.Initrds, name)
+	default:
+		if fileMap.Extra == nil {
+			fileMap.Extra = make(map[string]string)
+		}
+		fileMap.Extra[role] = name
+	}
+	return fileMap
+}
+
+// FailDeadDownloads marks images left downloading with no download job
+// queued or running for them as errored: their job failed, was cancelled,
+// or was lost, so nothing will finish them.
+func FailDeadDownloads(database *sql.DB) error {
+	images, err := db.ListImagesDownloading(database)
+	if err != nil {
+		return err
+	}
+	payloads, err := db.ActiveJobPayloads(database, JobDownload)
+	if err != nil {
+		return err
+	}
+	active := make(map[int64]bool, len(payloads))
+	for _, p := range payloads {
+		var job DownloadJob
+		if json.Unmarshal([]byte(p), &job) == nil {
+			active[job.ImageID] = true
+		}
+	}
+	for _, img := range images {
+		if active[img.ID] {
+			continue
+		}
+		log.Printf("catalog: %s was left downloading with nothing to resume it", img.Name)
+		if err := db.UpdateImageStatus(database, img.ID, db.ImageStatusError,
+			"Download interrupted and can't be resumed; pull the image again"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListFiles returns the names of the files stored in an image directory,
+// skipping hidden and partial files.
+func ListFiles(imageDir string) ([]string, error) {
+	entries, err := os.ReadDir(imageDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") && !strings.HasSuffix(e.Name(), ".part") {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// FileSHA256 returns the hex SHA-256 of a file.
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ValidateDownloadURL checks that a URL can be fetched (http/https only).
+func ValidateDownloadURL(rawURL string) error {
 	u, err := url.Parse(rawURL)
 	if err != nil {
 		return fmt.Errorf("invalid URL: %w", err)
@@ -286,34 +569,110 @@ func validateDownloadURL(rawURL string) error {
 
 type progressFunc func(downloaded, total int64)
 
-func downloadFile(dst, rawURL string, onProgress progressFunc) error {
-	if err := validateDownloadURL(rawURL); err != nil {
+// downloadAndExtract fetches a zip archive and keeps only the named member.
+// The archive is downloaded like any file, so it resumes the same way.
+func downloadAndExtract(ctx context.Context, dst, rawURL, member string, validator *string, onProgress progressFunc) error {
+	archive := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".zip")
+	if err := downloadFile(ctx, archive, rawURL, validator, onProgress); err != nil {
 		return err
 	}
+	defer os.Remove(archive)
+
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return fmt.Errorf("open archive: %w", err)
+	}
+	defer zr.Close()
+	for _, zf := range zr.File {
+		if zf.Name != member {
+			continue
+		}
+		src, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf("open %s in archive: %w", member, err)
+		}
+		defer src.Close()
+		part := dst + ".part"
+		out, err := os.Create(part)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, src); err != nil {
+			out.Close()
+			return fmt.Errorf("extract %s: %w", member, err)
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		return os.Rename(part, dst)
+	}
+	return fmt.Errorf("%s not found in archive", member)
+}
+
+// downloadFile fetches rawURL to dst, by way of dst+".part". If a partial
+// file is there and *validator holds the ETag or Last-Modified it was
+// fetched with, the download continues from its end when the server still
+// has the same file, and starts over otherwise. *validator is set to the
+// response's before any data is written. A client error from the server,
+// such as a 404, is permanent.
+func downloadFile(ctx context.Context, dst, rawURL string, validator *string, onProgress progressFunc) error {
+	if err := ValidateDownloadURL(rawURL); err != nil {
+		return jobs.Permanent(err)
+	}
+
+	part := dst + ".part"
+	var offset int64
+	if info, err := os.Stat(part); err == nil && *validator != "" {
+		offset = info.Size()
+	}
 
 	client := safenet.NewClient(30 * time.Minute)
-	resp, err := client.Get(rawURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", *validator)
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	var f *os.File
+	var total int64
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		start, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != offset {
+			os.Remove(part)
+			return fmt.Errorf("unexpected Content-Range %q from %s", resp.Header.Get("Content-Range"), rawURL)
+		}
+		total = size
+		f, err = os.OpenFile(part, os.O_WRONLY|os.O_APPEND, 0644)
+	case resp.StatusCode == http.StatusOK:
+		offset = 0
+		total = resp.ContentLength
+		f, err = os.Create(part)
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file is no good against what the server has now.
+		os.Remove(part)
+		*validator = ""
+		return downloadFile(ctx, dst, rawURL, validator, onProgress)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return jobs.Permanent(fmt.Errorf("HTTP %d from %s", resp.StatusCode, rawURL))
+	default:
 		return fmt.Errorf("HTTP %d from %s", resp.StatusCode, rawURL)
 	}
-
-	f, err := os.Create(dst)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
+	*validator = responseValidator(resp)
 
-	if onProgress == nil || resp.ContentLength <= 0 {
-		_, err = io.Copy(f, resp.Body)
-		return err
-	}
-
-	var written int64
+	written := offset
 	buf := make([]byte, 32*1024)
 	for {
 		n, readErr := resp.Body.Read(buf)
@@ -322,7 +681,9 @@ func downloadFile(dst, rawURL string, onProgress progressFunc) error {
 				return err
 			}
 			written += int64(n)
-			onProgress(written, resp.ContentLength)
+			if onProgress != nil {
+				onProgress(written, total)
+			}
 		}
 		if readErr == io.EOF {
 			break
@@ -331,5 +692,45 @@ func downloadFile(dst, rawURL string, onProgress progressFunc) error {
 			return readErr
 		}
 	}
-	return nil
+	if total > 0 && written != total {
+		return fmt.Errorf("short download from %s: got %d of %d bytes", rawURL, written, total)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(part, dst)
+}
+
+// responseValidator returns what identifies the version of the file a
+// response carries, for If-Range: a strong ETag, or else Last-Modified.
+// It is empty if the response has neither, and the download can't resume.
+func responseValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// parseContentRange parses a Content-Range header such as
+// "bytes 100-199/200" into the first byte's offset and the full size,
+// which is 0 if the server sent "*".
+func parseContentRange(h string) (start, size int64, ok bool) {
+	rng, full, found := strings.Cut(strings.TrimPrefix(h, "bytes "), "/")
+	if !found {
+		return 0, 0, false
+	}
+	first, _, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if full != "*" {
+		if size, err = strconv.ParseInt(full, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, size, true
 }
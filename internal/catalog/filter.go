@@ -0,0 +1,118 @@
+package catalog
+
+import (
+	"cmp"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Filter picks catalog entries. Empty fields match everything.
+type Filter struct {
+	Q        string // found in the ID, name or description, ignoring case
+	OSFamily string
+	Arch     string
+	BootType string
+	Version  string // a prefix of the version, so 24 matches 24.04 and 24.10
+}
+
+// Empty reports whether f matches every entry.
+func (f Filter) Empty() bool {
+	return f == Filter{}
+}
+
+// Match reports whether e passes f.
+func (f Filter) Match(e Entry) bool {
+	if f.OSFamily != "" && !strings.EqualFold(e.OSFamily, f.OSFamily) {
+		return false
+	}
+	if f.Arch != "" && !strings.EqualFold(e.Arch, f.Arch) {
+		return false
+	}
+	if f.BootType != "" && !strings.EqualFold(e.BootType, f.BootType) {
+		return false
+	}
+	if f.Version != "" && !strings.HasPrefix(strings.ToLower(e.Version), strings.ToLower(strings.TrimSpace(f.Version))) {
+		return false
+	}
+	q := strings.ToLower(strings.TrimSpace(f.Q))
+	return q == "" || strings.Contains(strings.ToLower(e.ID+" "+e.Name+" "+e.Description), q)
+}
+
+// Group is the versions of one OS in the catalog, newest first.
+type Group struct {
+	Name    string
+	Entries []Entry
+}
+
+// Latest is the group's newest version.
+func (g Group) Latest() Entry {
+	return g.Entries[0]
+}
+
+// Older are the group's versions after the newest.
+func (g Group) Older() []Entry {
+	return g.Entries[1:]
+}
+
+var spacesRe = regexp.MustCompile(`\s+`)
+
+// BaseName is the entry's name without its version, "Ubuntu Server" for
+// "Ubuntu 24.04 Server", naming the group its versions share.
+func (e Entry) BaseName() string {
+	name := e.Name
+	if e.Version != "" {
+		name = strings.Replace(name, e.Version, "", 1)
+	}
+	name = strings.TrimSpace(spacesRe.ReplaceAllString(name, " "))
+	if name == "" {
+		return e.Name
+	}
+	return name
+}
+
+// GroupEntries gathers entries into groups by base name and arch, in the
+// order their first entries appear, each newest version first.
+func GroupEntries(entries []Entry) []Group {
+	var groups []Group
+	index := map[string]int{}
+	for _, e := range entries {
+		key := strings.ToLower(e.BaseName()) + "\x00" + e.Arch
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, Group{Name: e.BaseName()})
+		}
+		groups[i].Entries = append(groups[i].Entries, e)
+	}
+	for _, g := range groups {
+		slices.SortStableFunc(g.Entries, func(a, b Entry) int {
+			return CompareVersions(b.Version, a.Version)
+		})
+	}
+	return groups
+}
+
+var versionPartRe = regexp.MustCompile(`\d+|\D+`)
+
+// CompareVersions orders versions such as 22.04 and 24.10 or 9 and 10,
+// comparing runs of digits as numbers and everything else as text.
+func CompareVersions(a, b string) int {
+	pa, pb := versionPartRe.FindAllString(a, -1), versionPartRe.FindAllString(b, -1)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, errA := strconv.Atoi(pa[i])
+		nb, errB := strconv.Atoi(pb[i])
+		var c int
+		if errA == nil && errB == nil {
+			c = cmp.Compare(na, nb)
+		} else {
+			c = strings.Compare(pa[i], pb[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(pa), len(pb))
+}
@@ -0,0 +1,99 @@
+package catalog
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/justinpopa/duh/internal/safenet"
+)
+
+// FilePreview is a file a pull would download. Size is -1 when the server
+// doesn't say.
+type FilePreview struct {
+	File
+	Size int64
+}
+
+// Preview describes what pulling an entry would download.
+type Preview struct {
+	Files   []FilePreview
+	Total   int64 // bytes, of the files whose size is known
+	Unknown int   // files whose size is unknown
+	// Archives is set when a file is a member extracted from a zip, so
+	// the space it takes may differ from the archive's size.
+	Archives bool
+}
+
+// PreviewPull asks the servers of an entry's files how big they are,
+// without downloading them.
+func PreviewPull(ctx context.Context, entry Entry) Preview {
+	client := safenet.NewClient(15 * time.Second)
+	p := Preview{Files: make([]FilePreview, len(entry.Files))}
+	var wg sync.WaitGroup
+	for i, f := range entry.Files {
+		p.Files[i] = FilePreview{File: f, Size: -1}
+		if ValidateDownloadURL(f.URL) != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Files[i].Size = remoteSize(ctx, client, f.URL)
+		}()
+	}
+	wg.Wait()
+	for _, f := range p.Files {
+		if f.Size < 0 {
+			p.Unknown++
+		} else {
+			p.Total += f.Size
+		}
+		if f.Extract != "" {
+			p.Archives = true
+		}
+	}
+	return p
+}
+
+// remoteSize returns the Content-Length a HEAD request reports, falling
+// back to the total in the Content-Range of a one-byte GET for servers
+// that don't answer HEAD. It returns -1 if neither works.
+func remoteSize(ctx context.Context, client *http.Client, url string) int64 {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return -1
+	}
+	if resp, err := client.Do(req); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && resp.ContentLength >= 0 {
+			return resp.ContentLength
+		}
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return -1
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return -1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return -1
+	}
+	_, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
@@ -0,0 +1,75 @@
+package catalog
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// SignatureSuffix is appended to the catalog URL to find its detached
+// signature: the base64 Ed25519 signature of the catalog file's bytes.
+const SignatureSuffix = ".sig"
+
+// ErrBadSignature is returned when a catalog's signature doesn't verify
+// against the configured key.
+var ErrBadSignature = errors.New("catalog signature verification failed")
+
+// ParsePublicKey reads an Ed25519 public key given as a PEM "PUBLIC KEY"
+// block (as written by openssl pkey -pubout) or as the base64 of the 32
+// raw key bytes.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	s = strings.TrimSpace(s)
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse catalog key: %w", err)
+		}
+		key, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("catalog key is %T, not Ed25519", pub)
+		}
+		return key, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("catalog key must be a PEM public key or 32 base64 bytes")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// verify fetches the detached signature for the catalog at catalogURL and
+// checks it against body.
+func verify(catalogURL string, body []byte, key ed25519.PublicKey) error {
+	resp, err := fetchClient.Get(catalogURL + SignatureSuffix)
+	if err != nil {
+		return fmt.Errorf("fetch catalog signature: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("catalog signature returned %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return fmt.Errorf("fetch catalog signature: %w", err)
+	}
+	return VerifyDetached(body, b, key)
+}
+
+// VerifyDetached checks body against a detached signature in the same
+// format as a catalog's: the base64 Ed25519 signature of its bytes.
+func VerifyDetached(body, signature []byte, key ed25519.PublicKey) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("%w: signature is not base64", ErrBadSignature)
+	}
+	if !ed25519.Verify(key, body, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package catalog
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/jobs"
+)
+
+const (
+	alpineNetboot = "https://dl-cdn.alpinelinux.org/alpine/v3.20/releases/x86_64/netboot/"
+	memtestZip    = "https://memtest.org/download/v7.20/mt86plus_7.20.binaries.zip"
+
+	// AlpineCmdline boots the Alpine netboot kernel of the utility images.
+	// What it names is fetched by the Alpine initramfs itself, which may
+	// lack TLS support, so it sticks to plain HTTP.
+	AlpineCmdline = "ip=dhcp alpine_repo=http://dl-cdn.alpinelinux.org/alpine/v3.20/main modloop=http://dl-cdn.alpinelinux.org/alpine/v3.20/releases/x86_64/netboot/modloop-lts"
+)
+
+// DiskWipeID is the catalog ID of the Disk Wipe utility, whose kernel and
+// initramfs also boot the secure erase of systems being decommissioned.
+const DiskWipeID = "duh-disk-wipe"
+
+// Utilities are the built-in utility images pulled on first run. They are
+// booted once on demand and leave the system's assigned image and state
+// alone.
+var Utilities = []Entry{
+	{
+		ID:          "duh-memtest86plus",
+		Name:        "Memtest86+",
+		Description: "Memory tester (BIOS and UEFI)",
+		Version:     "7.20",
+		Arch:        "x86_64",
+		BootType:    "custom",
+		IPXEScript: `#!ipxe
+iseq ${platform} efi && goto efi ||
+kernel {{index .FileURLs "bios"}}
+boot
+:efi
+kernel {{index .FileURLs "efi"}}
+boot
+`,
+		Files: []File{
+			{Name: "memtest64.bin", URL: memtestZip, Extract: "memtest64.bin", Role: "bios"},
+			{Name: "memtest64.efi", URL: memtestZip, Extract: "memtest64.efi", Role: "efi"},
+		},
+		Utility: true,
+	},
+	{
+		ID:          "duh-rescue",
+		Name:        "Rescue Shell",
+		Description: "Alpine Linux in RAM; log in as root on the console",
+		Version:     "3.20",
+		Arch:        "x86_64",
+		BootType:    "linux",
+		Cmdline:     AlpineCmdline,
+		Files: []File{
+			{Name: "vmlinuz-lts", URL: alpineNetboot + "vmlinuz-lts", Role: "kernel"},
+			{Name: "initramfs-lts", URL: alpineNetboot + "initramfs-lts", Role: "initrd"},
+		},
+		Utility: true,
+	},
+	{
+		ID:          DiskWipeID,
+		Name:        "Disk Wipe",
+		Description: "Erases partition tables and signatures at both ends of every disk, then powers off",
+		Version:     "3.20",
+		Arch:        "x86_64",
+		BootType:    "custom",
+		IPXEScript: `#!ipxe
+kernel {{.KernelURL}} ` + AlpineCmdline + ` apkovl={{.ServerURL}}/utilities/disk-wipe.apkovl.tar.gz
+initrd {{.InitrdURL}}
+boot
+`,
+		Files: []File{
+			{Name: "vmlinuz-lts", URL: alpineNetboot + "vmlinuz-lts", Role: "kernel"},
+			{Name: "initramfs-lts", URL: alpineNetboot + "initramfs-lts", Role: "initrd"},
+		},
+		Utility: true,
+	},
+}
+
+// IsUtility reports whether id names one of the built-in Utilities rather
+// than an entry of the configured catalog.
+func IsUtility(id string) bool {
+	for _, u := range Utilities {
+		if u.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// PullUtilities pulls the built-in utility images the first time duh runs.
+// Downloads are queued on q; a failed download shows up as an image in the
+// error state that can be pulled again from the images page.
+func PullUtilities(database *sql.DB, dataDir string, q *jobs.Queue) {
+	if done, _ := db.GetSetting(database, "utilities_pulled"); done == "1" {
+		return
+	}
+	for _, entry := range Utilities {
+		existing, err := db.GetImageByCatalogID(database, entry.ID)
+		if err != nil {
+			log.Printf("catalog: look up utility %s: %v", entry.ID, err)
+			return
+		}
+		if existing != nil {
+			continue
+		}
+		if _, err := Pull(database, dataDir, q, entry, false); err != nil {
+			log.Printf("catalog: pull utility %s: %v", entry.ID, err)
+		}
+	}
+	if err := db.SetSetting(database, "utilities_pulled", "1"); err != nil {
+		log.Printf("catalog: record utilities pulled: %v", err)
+	}
+}
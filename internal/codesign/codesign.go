@@ -0,0 +1,227 @@
+// Package codesign signs boot files for iPXE's imgverify command. It keeps
+// a root certificate, which an iPXE build trusts, and a code-signing
+// certificate issued from it, and produces the detached CMS signatures
+// imgverify checks a downloaded kernel or initrd against.
+package codesign
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// lifetime is how long newly created certificates are valid. iPXE checks
+// validity against the machine's clock, which is often far off, so it is
+// generous.
+const lifetime = 20 * 365 * 24 * time.Hour
+
+// Signer holds the code-signing key and its certificate chain.
+type Signer struct {
+	root    *x509.Certificate
+	rootPEM []byte
+	cert    *x509.Certificate
+	key     *rsa.PrivateKey
+}
+
+// LoadOrCreate loads the signer kept in dir, creating the root and
+// code-signing certificates on first use. iPXE only verifies RSA
+// signatures, so both keys are RSA.
+func LoadOrCreate(dir string) (*Signer, error) {
+	rootPath := filepath.Join(dir, "root.pem")
+	certPath := filepath.Join(dir, "signer.pem")
+	keyPath := filepath.Join(dir, "signer-key.pem")
+
+	rootPEM, err := os.ReadFile(rootPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return create(dir, rootPath, certPath, keyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read code-signing root: %w", err)
+	}
+	root, err := parseCertPEM(rootPEM)
+	if err != nil {
+		return nil, fmt.Errorf("load code-signing root: %w", err)
+	}
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("read code-signing certificate: %w", err)
+	}
+	cert, err := parseCertPEM(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("load code-signing certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read code-signing key: %w", err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("load code-signing key: no PEM block")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("load code-signing key: %w", err)
+	}
+	return &Signer{root: root, rootPEM: rootPEM, cert: cert, key: key}, nil
+}
+
+// create makes a root and a code-signing certificate under it. Only the
+// code-signing key is kept; the root key is discarded once it has signed,
+// so the root can never vouch for anything else.
+func create(dir, rootPath, certPath, keyPath string) (*Signer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create code-signing dir: %w", err)
+	}
+	rootKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("generate root key: %w", err)
+	}
+	now := time.Now()
+	rootTmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "duh boot file signing root"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(lifetime),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTmpl, rootTmpl, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		return nil, fmt.Errorf("create root certificate: %w", err)
+	}
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		return nil, fmt.Errorf("parse root certificate: %w", err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("generate code-signing key: %w", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: "duh boot file signer"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, root, &key.PublicKey, rootKey)
+	if err != nil {
+		return nil, fmt.Errorf("create code-signing certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse code-signing certificate: %w", err)
+	}
+
+	rootPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return nil, fmt.Errorf("write code-signing key: %w", err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, fmt.Errorf("write code-signing certificate: %w", err)
+	}
+	// The root goes last: its presence marks the set as complete.
+	if err := os.WriteFile(rootPath, rootPEM, 0644); err != nil {
+		return nil, fmt.Errorf("write code-signing root: %w", err)
+	}
+	return &Signer{root: root, rootPEM: rootPEM, cert: cert, key: key}, nil
+}
+
+func parseCertPEM(b []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate PEM block")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
+
+// RootPEM returns the root certificate, for an iPXE build to trust
+// (make TRUST=...).
+func (s *Signer) RootPEM() []byte { return s.rootPEM }
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+)
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     signedData `asn1:"explicit,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      []signerInfo `asn1:"set"`
+}
+
+// encapContentInfo carries no content: the signature is detached.
+type encapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+// SignDigest returns a DER CMS signature for a file with the given SHA-256
+// digest, in the form openssl cms -sign -binary -noattr produces. iPXE
+// doesn't support signed attributes, so the signature covers the file's
+// digest directly, and the file never has to be read again to sign it.
+func (s *Signer) SignDigest(sha256 []byte) ([]byte, error) {
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sha256)
+	if err != nil {
+		return nil, fmt.Errorf("sign: %w", err)
+	}
+	sha256Alg := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	certs := append(append([]byte{}, s.cert.Raw...), s.root.Raw...)
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content: signedData{
+			Version:          1,
+			DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Alg},
+			EncapContentInfo: encapContentInfo{EContentType: oidData},
+			Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+			SignerInfos: []signerInfo{{
+				Version:            1,
+				SID:                issuerAndSerial{Issuer: asn1.RawValue{FullBytes: s.cert.RawIssuer}, Serial: s.cert.SerialNumber},
+				DigestAlgorithm:    sha256Alg,
+				SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+				Signature:          sig,
+			}},
+		},
+	})
+}
@@ -2,47 +2,126 @@ package config
 
 import (
 	"flag"
+	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
 	Version       bool
+	MigrateDryRun bool
+	MigrateDownTo int
 	DataDir       string
+	DBKeyFile     string
+	DBKeyCommand  string
+	DBDecrypt     bool
 	TFTPAddr      string
 	HTTPAddr      string
 	HTTPSAddr     string
 	TLSCertFile   string
 	TLSKeyFile    string
-	ACMEDomain    string
+	TLSSANs       string
+	TLSNoRegen    bool
+	ACMEDomains   []string
+	ACMEAdvertise string
 	ACMEEmail     string
 	ACMEStaging   bool
 	HTTPSRedirect bool
 	ServerURL     string
 	CatalogURL    string
+	CatalogKey    string
 	ProxyDHCP     bool
 	DHCPIface     string
+	SignedChain   bool
+	NoUtilities   bool
+	MinFreeMB     int
+
+	MachineCerts     bool
+	MachineCertTTL   time.Duration
+	AgentInterval    time.Duration
+	HeartbeatTimeout time.Duration
+
+	TFTPBlockSize  int
+	TFTPWindowSize int
+	TFTPTimeout    time.Duration
+	TFTPRetries    int
+
+	TFTPWrite         bool
+	TFTPWriteMaxFile  int
+	TFTPWriteMaxTotal int
+
+	ProxmoxURL      string
+	ProxmoxToken    string
+	ProxmoxInsecure bool
+	LibvirtURI      string
+	VMNetBoot       bool
+
+	CacheOf   string
+	CacheName string
 }
 
 func Parse() *Config {
 	c := &Config{}
 
 	flag.BoolVar(&c.Version, "version", false, "print version and exit")
+	flag.BoolVar(&c.MigrateDryRun, "migrate-dry-run", false, "report pending database migrations and exit")
+	flag.IntVar(&c.MigrateDownTo, "migrate-down-to", -1, "revert database migrations down to this schema version and exit")
 	flag.StringVar(&c.DataDir, "data-dir", envOr("DUH_DATA_DIR", "./data"), "data directory")
+	flag.StringVar(&c.DBKeyFile, "db-key-file", envOr("DUH_DB_KEY_FILE", ""), "file holding the key that encrypts secrets in the database (32 bytes as hex or base64); DUH_DB_KEY may hold the key itself")
+	flag.StringVar(&c.DBKeyCommand, "db-key-command", envOr("DUH_DB_KEY_COMMAND", ""), "shell command printing the database key, e.g. a KMS decrypt or Vault read")
+	flag.BoolVar(&c.DBDecrypt, "db-decrypt", false, "store the database's secrets unencrypted again and exit")
 	flag.StringVar(&c.TFTPAddr, "tftp-addr", envOr("DUH_TFTP_ADDR", ":69"), "TFTP listen address")
 	flag.StringVar(&c.HTTPAddr, "http-addr", envOr("DUH_HTTP_ADDR", ":8080"), "HTTP listen address")
 	flag.StringVar(&c.HTTPSAddr, "https-addr", envOr("DUH_HTTPS_ADDR", ":8443"), "HTTPS listen address")
 	flag.StringVar(&c.TLSCertFile, "tls-cert", envOr("DUH_TLS_CERT", ""), "TLS certificate file (auto-generate if empty)")
 	flag.StringVar(&c.TLSKeyFile, "tls-key", envOr("DUH_TLS_KEY", ""), "TLS key file (auto-generate if empty)")
-	flag.StringVar(&c.ACMEDomain, "acme-domain", envOr("DUH_ACME_DOMAIN", ""), "domain for ACME/Let's Encrypt certificate")
+	flag.StringVar(&c.TLSSANs, "tls-sans", envOr("DUH_TLS_SANS", ""), "comma-separated DNS names and IPs to put on the self-signed certificate instead of discovering them")
+	flag.BoolVar(&c.TLSNoRegen, "tls-no-regen", envOr("DUH_TLS_NO_REGEN", "") != "", "keep the self-signed certificate when the server's names or IPs change or it nears expiry")
+	acmeDomains := flag.String("acme-domain", envOr("DUH_ACME_DOMAIN", ""), "comma-separated domains for ACME/Let's Encrypt certificates, wildcards allowed (e.g. duh.example.com,*.pxe.example.com)")
+	flag.StringVar(&c.ACMEAdvertise, "acme-advertise", envOr("DUH_ACME_ADVERTISE", ""), "host name under the ACME domains to advertise as the HTTPS server URL when -server-url is unset")
 	flag.StringVar(&c.ACMEEmail, "acme-email", envOr("DUH_ACME_EMAIL", ""), "email for ACME account registration")
 	flag.BoolVar(&c.ACMEStaging, "acme-staging", envOr("DUH_ACME_STAGING", "") != "", "use Let's Encrypt staging CA")
 	flag.BoolVar(&c.HTTPSRedirect, "https-redirect", envOr("DUH_HTTPS_REDIRECT", "") != "", "redirect HTTP to HTTPS (iPXE clients excluded)")
 	flag.StringVar(&c.ServerURL, "server-url", envOr("DUH_SERVER_URL", ""), "server URL for iPXE scripts (auto-detect if empty)")
 	flag.StringVar(&c.CatalogURL, "catalog-url", envOr("DUH_CATALOG_URL", "https://raw.githubusercontent.com/justinpopa/duh-catalog/main/catalog.json"), "image catalog URL")
+	flag.StringVar(&c.CatalogKey, "catalog-key", envOr("DUH_CATALOG_KEY", ""), "Ed25519 public key (PEM or base64) the catalog's detached signature must verify against")
 	flag.BoolVar(&c.ProxyDHCP, "proxy-dhcp", envOr("DUH_PROXY_DHCP", "") != "", "enable proxy DHCP server for PXE")
 	flag.StringVar(&c.DHCPIface, "dhcp-iface", envOr("DUH_DHCP_IFACE", ""), "network interface for proxy DHCP (auto-detect if empty)")
+	flag.BoolVar(&c.SignedChain, "signed-chain", envOr("DUH_SIGNED_CHAIN", "") != "", "require a proxy DHCP issued token on boot.ipxe requests")
+
+	flag.BoolVar(&c.NoUtilities, "no-utilities", envOr("DUH_NO_UTILITIES", "") != "", "don't pull the built-in utility images (memtest, rescue, disk wipe) on first run")
+	flag.IntVar(&c.MinFreeMB, "min-free-mb", envIntOr("DUH_MIN_FREE_MB", 1024), "free space in MiB the data directory needs for /readyz to report ready")
+
+	flag.BoolVar(&c.MachineCerts, "machine-certs", envOr("DUH_MACHINE_CERTS", "") != "", "run an internal CA that issues systems client certificates for mTLS")
+	flag.DurationVar(&c.MachineCertTTL, "machine-cert-ttl", envDurationOr("DUH_MACHINE_CERT_TTL", 24*time.Hour), "how long machine certificates are valid")
+	flag.DurationVar(&c.AgentInterval, "agent-interval", envDurationOr("DUH_AGENT_INTERVAL", time.Minute), "how often duh-agent sends heartbeats")
+	flag.DurationVar(&c.HeartbeatTimeout, "heartbeat-timeout", envDurationOr("DUH_HEARTBEAT_TIMEOUT", 5*time.Minute), "how long after its last heartbeat a system is shown as down")
+
+	flag.IntVar(&c.TFTPBlockSize, "tftp-blksize", envIntOr("DUH_TFTP_BLKSIZE", 1468), "largest TFTP block size clients may negotiate (512-65456)")
+	flag.IntVar(&c.TFTPWindowSize, "tftp-windowsize", envIntOr("DUH_TFTP_WINDOWSIZE", 1), "TFTP blocks to send before waiting for an ACK (1 disables windowing)")
+	flag.DurationVar(&c.TFTPTimeout, "tftp-timeout", envDurationOr("DUH_TFTP_TIMEOUT", 5*time.Second), "TFTP retransmit timeout")
+	flag.IntVar(&c.TFTPRetries, "tftp-retries", envIntOr("DUH_TFTP_RETRIES", 3), "TFTP retransmits before a transfer is abandoned")
+	flag.BoolVar(&c.TFTPWrite, "tftp-write", envOr("DUH_TFTP_WRITE", "") != "", "accept TFTP uploads from known systems into data/tftp-inbox")
+	flag.IntVar(&c.TFTPWriteMaxFile, "tftp-write-max-file", envIntOr("DUH_TFTP_WRITE_MAX_FILE", 1<<20), "largest TFTP upload in bytes")
+	flag.IntVar(&c.TFTPWriteMaxTotal, "tftp-write-max-total", envIntOr("DUH_TFTP_WRITE_MAX_TOTAL", 16<<20), "most bytes of TFTP uploads kept per system")
+
+	flag.StringVar(&c.ProxmoxURL, "proxmox-url", envOr("DUH_PROXMOX_URL", ""), "Proxmox VE API URL to sync VMs from, e.g. https://pve:8006")
+	flag.StringVar(&c.ProxmoxToken, "proxmox-token", envOr("DUH_PROXMOX_TOKEN", ""), "Proxmox API token as user@realm!tokenid=secret")
+	flag.BoolVar(&c.ProxmoxInsecure, "proxmox-insecure", envOr("DUH_PROXMOX_INSECURE", "") != "", "skip TLS verification of the Proxmox API")
+	flag.StringVar(&c.LibvirtURI, "libvirt-uri", envOr("DUH_LIBVIRT_URI", ""), "libvirt connection URI to sync VMs from via virsh, e.g. qemu:///system")
+	flag.BoolVar(&c.VMNetBoot, "vm-netboot", envOr("DUH_VM_NETBOOT", "") != "", "set synced VMs to boot from the network when queued for reimage")
+
+	flag.StringVar(&c.CacheOf, "cache-of", envOr("DUH_CACHE_OF", ""), "run as a cache node for the duh server at this URL, serving only image files")
+	flag.StringVar(&c.CacheName, "cache-name", envOr("DUH_CACHE_NAME", ""), "name this cache node is registered under on the primary")
 
 	flag.Parse()
+	for _, d := range strings.Split(*acmeDomains, ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+			c.ACMEDomains = append(c.ACMEDomains, d)
+		}
+	}
 	return c
 }
 
@@ -52,3 +131,29 @@ func envOr(key, fallback string) string {
 	}
 	return fallback
 }
+
+func envIntOr(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("config: ignoring %s=%q: not an integer", key, v)
+		return fallback
+	}
+	return n
+}
+
+func envDurationOr(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("config: ignoring %s=%q: not a duration", key, v)
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Agent is what duh last heard from the duh-agent on a system.
+type Agent struct {
+	SystemID  int64
+	Version   string
+	Hostname  string
+	RemoteIP  string
+	UptimeSec int64
+	Inventory string // JSON
+	Health    string // JSON
+	FirstSeen string
+	LastSeen  string
+}
+
+// Agent command statuses. A command is sent once its heartbeat reply has
+// gone out, and done or failed once the agent reports back.
+const (
+	AgentCommandPending = "pending"
+	AgentCommandSent    = "sent"
+	AgentCommandDone    = "done"
+	AgentCommandFailed  = "failed"
+)
+
+// AgentCommand is work queued for a system's agent.
+type AgentCommand struct {
+	ID        int64
+	SystemID  int64
+	Type      string
+	Status    string
+	Message   string
+	CreatedAt string
+	UpdatedAt string
+}
+
+const agentColumns = `system_id, version, hostname, remote_ip, uptime_sec, inventory, health, first_seen, last_seen`
+
+const agentCommandColumns = `id, system_id, type, status, message, created_at, updated_at`
+
+func scanAgentCommand(row interface{ Scan(...any) error }) (*AgentCommand, error) {
+	var c AgentCommand
+	if err := row.Scan(&c.ID, &c.SystemID, &c.Type, &c.Status, &c.Message, &c.CreatedAt, &c.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// RecordAgentHeartbeat stores a heartbeat, registering the agent the first
+// time it checks in.
+func RecordAgentHeartbeat(d *sql.DB, a *Agent) error {
+	_, err := d.Exec(`INSERT INTO agents (system_id, version, hostname, remote_ip, uptime_sec, inventory, health)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(system_id) DO UPDATE SET
+			version = excluded.version, hostname = excluded.hostname, remote_ip = excluded.remote_ip,
+			uptime_sec = excluded.uptime_sec, inventory = excluded.inventory, health = excluded.health,
+			last_seen = datetime('now')`,
+		a.SystemID, a.Version, a.Hostname, a.RemoteIP, a.UptimeSec, a.Inventory, a.Health)
+	if err != nil {
+		return fmt.Errorf("record agent heartbeat: %w", err)
+	}
+	return nil
+}
+
+// GetAgent returns a system's agent, or nil if none has checked in.
+func GetAgent(d *sql.DB, systemID int64) (*Agent, error) {
+	var a Agent
+	err := d.QueryRow(`SELECT `+agentColumns+` FROM agents WHERE system_id = ?`, systemID).Scan(
+		&a.SystemID, &a.Version, &a.Hostname, &a.RemoteIP, &a.UptimeSec, &a.Inventory, &a.Health, &a.FirstSeen, &a.LastSeen)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get agent: %w", err)
+	}
+	return &a, nil
+}
+
+// QueueAgentCommand queues a command for a system's agent and returns its
+// ID. A command of the same type still waiting to be sent is reused.
+func QueueAgentCommand(d *sql.DB, systemID int64, typ string) (int64, error) {
+	var id int64
+	err := d.QueryRow("SELECT id FROM agent_commands WHERE system_id = ? AND type = ? AND status = ?",
+		systemID, typ, AgentCommandPending).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("queue agent command: %w", err)
+	}
+	res, err := d.Exec("INSERT INTO agent_commands (system_id, type) VALUES (?, ?)", systemID, typ)
+	if err != nil {
+		return 0, fmt.Errorf("queue agent command: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+// TakeAgentCommands returns a system's pending commands, oldest first, and
+// marks them sent.
+func TakeAgentCommands(d *sql.DB, systemID int64) ([]AgentCommand, error) {
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("take agent commands: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT `+agentCommandColumns+` FROM agent_commands WHERE system_id = ? AND status = ? ORDER BY id`,
+		systemID, AgentCommandPending)
+	if err != nil {
+		return nil, fmt.Errorf("take agent commands: %w", err)
+	}
+	var cmds []AgentCommand
+	for rows.Next() {
+		c, err := scanAgentCommand(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan agent command: %w", err)
+		}
+		cmds = append(cmds, *c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("take agent commands: %w", err)
+	}
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+	if _, err := tx.Exec("UPDATE agent_commands SET status = ?, updated_at = datetime('now') WHERE system_id = ? AND status = ?",
+		AgentCommandSent, systemID, AgentCommandPending); err != nil {
+		return nil, fmt.Errorf("take agent commands: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit agent commands: %w", err)
+	}
+	for i := range cmds {
+		cmds[i].Status = AgentCommandSent
+	}
+	return cmds, nil
+}
+
+// FinishAgentCommand records a command's outcome as reported by the
+// system's agent. It returns false if the system has no such command.
+func FinishAgentCommand(d *sql.DB, systemID, id int64, ok bool, message string) (bool, error) {
+	status := AgentCommandDone
+	if !ok {
+		status = AgentCommandFailed
+	}
+	res, err := d.Exec("UPDATE agent_commands SET status = ?, message = ?, updated_at = datetime('now') WHERE id = ? AND system_id = ?",
+		status, message, id, systemID)
+	if err != nil {
+		return false, fmt.Errorf("finish agent command: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("finish agent command: %w", err)
+	}
+	return n > 0, nil
+}
+
+// ListAgentCommands returns a system's most recent commands, newest first.
+func ListAgentCommands(d *sql.DB, systemID int64, limit int) ([]AgentCommand, error) {
+	rows, err := d.Query(`SELECT `+agentCommandColumns+` FROM agent_commands WHERE system_id = ? ORDER BY id DESC LIMIT ?`,
+		systemID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list agent commands: %w", err)
+	}
+	defer rows.Close()
+	var cmds []AgentCommand
+	for rows.Next() {
+		c, err := scanAgentCommand(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan agent command: %w", err)
+		}
+		cmds = append(cmds, *c)
+	}
+	return cmds, rows.Err()
+}
@@ -0,0 +1,213 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// ProvisionAttempt records one pass through queued → provisioning → ready
+// or failed. Callbacks must name the system's current attempt so a late
+// callback from an earlier install can't complete a newer one.
+type ProvisionAttempt struct {
+	ID             string
+	SystemID       int64
+	State          string // queued, provisioning, ready, failed, cancelled
+	Phase          string
+	Message        string
+	StartedAt      string
+	ProvisioningAt string // when the system began provisioning; "" if it hasn't, or before this was recorded
+	FinishedAt     string
+	ImageID        *int64 // assigned when the attempt was queued; nil before that was recorded
+	ProfileID      *int64
+}
+
+// WaitTime is how long the attempt was queued before its system began
+// provisioning, or 0 if that isn't known.
+func (a ProvisionAttempt) WaitTime() time.Duration {
+	return between(a.StartedAt, a.ProvisioningAt)
+}
+
+// InstallTime is how long the system took from beginning to provision to
+// finishing, or 0 if that isn't known.
+func (a ProvisionAttempt) InstallTime() time.Duration {
+	return between(a.ProvisioningAt, a.FinishedAt)
+}
+
+// TotalTime is how long the attempt took from being queued to finishing,
+// or 0 if it hasn't finished.
+func (a ProvisionAttempt) TotalTime() time.Duration {
+	return between(a.StartedAt, a.FinishedAt)
+}
+
+func between(from, to string) time.Duration {
+	start, err := time.Parse(time.DateTime, from)
+	if err != nil {
+		return 0
+	}
+	end, err := time.Parse(time.DateTime, to)
+	if err != nil {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+func newAttemptID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// recordAttempt starts a new attempt when a system is queued and otherwise
+// advances the current one.
+func recordAttempt(tx *sql.Tx, systemID int64, current, state string) error {
+	if state == current {
+		return nil
+	}
+	if state == "queued" {
+		id, err := newAttemptID()
+		if err != nil {
+			return fmt.Errorf("new attempt id: %w", err)
+		}
+		if _, err := tx.Exec(`UPDATE systems SET attempt_id = ?, fail_phase = '', fail_message = '' WHERE id = ?`, id, systemID); err != nil {
+			return fmt.Errorf("set attempt: %w", err)
+		}
+		if _, err := tx.Exec(`INSERT INTO provision_attempts (id, system_id, state, image_id, profile_id)
+			SELECT ?, id, 'queued', image_id, profile_id FROM systems WHERE id = ?`, id, systemID); err != nil {
+			return fmt.Errorf("insert attempt: %w", err)
+		}
+		return issueCredential(tx, systemID, id)
+	}
+
+	attemptState := state
+	if current == "queued" && state != "provisioning" {
+		attemptState = "cancelled"
+	}
+	_, err := tx.Exec(`UPDATE provision_attempts
+		SET state = ?,
+			provisioning_at = CASE WHEN ? = 'provisioning' THEN datetime('now') ELSE provisioning_at END,
+			finished_at = CASE WHEN ? = 'provisioning' THEN NULL ELSE datetime('now') END
+		WHERE id = (SELECT attempt_id FROM systems WHERE id = ?) AND finished_at IS NULL`,
+		attemptState, attemptState, attemptState, systemID)
+	if err != nil {
+		return fmt.Errorf("update attempt: %w", err)
+	}
+	return nil
+}
+
+// FailSystemByMAC moves a provisioning system to failed and records the
+// phase and message its installer reported, all in one transaction, so a
+// failed system always has its details.
+func FailSystemByMAC(d *sql.DB, mac, phase, message string) error {
+	mac, err := NormalizeMAC(mac)
+	if err != nil {
+		return err
+	}
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	id, err := transitionSystemStateByMAC(tx, mac, "provisioning", "failed")
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE systems SET fail_phase = ?, fail_message = ? WHERE id = ?`, phase, message, id); err != nil {
+		return fmt.Errorf("set failure: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE provision_attempts SET phase = ?, message = ?
+		WHERE id = (SELECT attempt_id FROM systems WHERE id = ?)`, phase, message, id); err != nil {
+		return fmt.Errorf("set attempt failure: %w", err)
+	}
+	return tx.Commit()
+}
+
+func ListProvisionAttempts(d *sql.DB, systemID int64) ([]ProvisionAttempt, error) {
+	rows, err := d.Query(`SELECT id, system_id, state, phase, message, datetime(started_at), COALESCE(provisioning_at, ''), COALESCE(finished_at, ''), image_id, profile_id
+		FROM provision_attempts WHERE system_id = ? ORDER BY started_at DESC, rowid DESC`, systemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []ProvisionAttempt
+	for rows.Next() {
+		var a ProvisionAttempt
+		if err := rows.Scan(&a.ID, &a.SystemID, &a.State, &a.Phase, &a.Message, &a.StartedAt, &a.ProvisioningAt, &a.FinishedAt, &a.ImageID, &a.ProfileID); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// AttemptRecord is a provision attempt with the system it was for, as
+// listed for reports.
+type AttemptRecord struct {
+	ProvisionAttempt
+	Hostname    string
+	MAC         string
+	Environment string
+	TenantID    int64
+	ImageName   string // "" if the image is unknown or gone
+	ProfileName string
+}
+
+// ListAttemptsBetween returns the attempts started in [from, to), oldest
+// first, including those of deleted systems. Attempts queued before their
+// image and profile were recorded report the system's current ones.
+func ListAttemptsBetween(d *sql.DB, from, to time.Time) ([]AttemptRecord, error) {
+	rows, err := d.Query(`SELECT a.id, a.system_id, a.state, a.phase, a.message, datetime(a.started_at), COALESCE(a.provisioning_at, ''), COALESCE(a.finished_at, ''),
+			COALESCE(a.image_id, s.image_id), COALESCE(a.profile_id, s.profile_id),
+			s.hostname, s.mac, s.environment, s.tenant_id, COALESCE(i.name, ''), COALESCE(p.name, '')
+		FROM provision_attempts a
+		JOIN systems s ON s.id = a.system_id
+		LEFT JOIN images i ON i.id = COALESCE(a.image_id, s.image_id)
+		LEFT JOIN profiles p ON p.id = COALESCE(a.profile_id, s.profile_id)
+		WHERE a.started_at >= ? AND a.started_at < ?
+		ORDER BY a.started_at, a.rowid`,
+		from.UTC().Format(time.DateTime), to.UTC().Format(time.DateTime))
+	if err != nil {
+		return nil, fmt.Errorf("list attempts: %w", err)
+	}
+	defer rows.Close()
+
+	var out []AttemptRecord
+	for rows.Next() {
+		var a AttemptRecord
+		if err := rows.Scan(&a.ID, &a.SystemID, &a.State, &a.Phase, &a.Message, &a.StartedAt, &a.ProvisioningAt, &a.FinishedAt,
+			&a.ImageID, &a.ProfileID, &a.Hostname, &a.MAC, &a.Environment, &a.TenantID, &a.ImageName, &a.ProfileName); err != nil {
+			return nil, fmt.Errorf("scan attempt: %w", err)
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// LastInstallTimes returns, for each system that has one, how long its
+// latest successful attempt took from queued to ready.
+func LastInstallTimes(d *sql.DB) (map[int64]time.Duration, error) {
+	rows, err := d.Query(`SELECT system_id, datetime(started_at), datetime(finished_at) FROM provision_attempts a
+		WHERE state = 'ready' AND finished_at IS NOT NULL
+		AND rowid = (SELECT rowid FROM provision_attempts b WHERE b.system_id = a.system_id AND b.state = 'ready'
+			ORDER BY b.finished_at DESC, b.rowid DESC LIMIT 1)`)
+	if err != nil {
+		return nil, fmt.Errorf("list install times: %w", err)
+	}
+	defer rows.Close()
+	out := map[int64]time.Duration{}
+	for rows.Next() {
+		var a ProvisionAttempt
+		if err := rows.Scan(&a.SystemID, &a.StartedAt, &a.FinishedAt); err != nil {
+			return nil, fmt.Errorf("scan install time: %w", err)
+		}
+		if t := a.TotalTime(); t > 0 {
+			out[a.SystemID] = t
+		}
+	}
+	return out, rows.Err()
+}
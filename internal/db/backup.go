@@ -0,0 +1,156 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Backup writes a consistent snapshot of the database to dst using
+// VACUUM INTO. dst must not already exist.
+func Backup(d *sql.DB, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("backup %s already exists", dst)
+	}
+	if _, err := d.Exec(`VACUUM INTO ?`, dst); err != nil {
+		return fmt.Errorf("vacuum into %s: %w", dst, err)
+	}
+	return nil
+}
+
+// BackupToDir snapshots the database into dir with a timestamped name
+// tagged with label, returning the path written.
+func BackupToDir(d *sql.DB, dir, label string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("create backup dir: %w", err)
+	}
+	name := fmt.Sprintf("duh-%s-%s.db", time.Now().UTC().Format("20060102-150405"), label)
+	path := filepath.Join(dir, name)
+	if err := Backup(d, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// RestoreFile is the name, in the data directory, of a backup staged to
+// replace the database the next time it is opened.
+const RestoreFile = "restore.db"
+
+// CheckBackup opens the backup at path and checks that it is a sound duh
+// database no newer than this version knows how to run.
+func CheckBackup(path string) error {
+	d, err := sql.Open("sqlite", path)
+	if err != nil {
+		return fmt.Errorf("open backup: %w", err)
+	}
+	defer d.Close()
+	var result string
+	if err := d.QueryRow(`PRAGMA quick_check`).Scan(&result); err != nil {
+		return fmt.Errorf("not a database: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("backup is damaged: %s", result)
+	}
+	version, err := SchemaVersion(d)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return errors.New("not a duh database")
+	}
+	if version > LatestSchemaVersion() {
+		return fmt.Errorf("backup is at schema v%d, newer than this duh's v%d", version, LatestSchemaVersion())
+	}
+	check, err := GetSetting(d, settingKeyCheck)
+	if err != nil {
+		return err
+	}
+	if _, err := unseal(check); err != nil {
+		return fmt.Errorf("backup's secrets can't be read: %w", err)
+	}
+	return nil
+}
+
+// applyRestore moves a staged restore into place as dataDir's database,
+// first backing up the database it replaces as pre-restore.
+func applyRestore(dataDir string) error {
+	staged := filepath.Join(dataDir, RestoreFile)
+	if _, err := os.Stat(staged); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	dbPath := filepath.Join(dataDir, "duh.db")
+	if _, err := os.Stat(dbPath); err == nil {
+		current, err := OpenRaw(dataDir)
+		if err != nil {
+			return err
+		}
+		path, err := BackupToDir(current, filepath.Join(dataDir, "backups"), "pre-restore")
+		current.Close()
+		if err != nil {
+			return fmt.Errorf("back up current database: %w", err)
+		}
+		log.Printf("db: backed up current database to %s before restoring", path)
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(staged, dbPath); err != nil {
+		return err
+	}
+	log.Printf("db: restored database from %s", RestoreFile)
+	return nil
+}
+
+// BackupStoreTokenPrefix starts every backup store token.
+const BackupStoreTokenPrefix = "duhbak_"
+
+// settingBackupStoreToken holds the hash of the token other duh servers
+// keep their backups here with; without one the backup store is off.
+const settingBackupStoreToken = "backup_store_token"
+
+// RotateBackupStoreToken issues a new backup store token, replacing any
+// old one. Only its hash is kept, so it is shown once.
+func RotateBackupStoreToken(d *sql.DB) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := BackupStoreTokenPrefix + hex.EncodeToString(b)
+	if err := SetSetting(d, settingBackupStoreToken, hashToken(token)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// DisableBackupStore drops the backup store token. Backups already kept
+// are left in place.
+func DisableBackupStore(d *sql.DB) error {
+	return DeleteSetting(d, settingBackupStoreToken)
+}
+
+// BackupStoreEnabled reports whether a backup store token has been issued.
+func BackupStoreEnabled(d *sql.DB) (bool, error) {
+	hash, err := GetSetting(d, settingBackupStoreToken)
+	return hash != "", err
+}
+
+// CheckBackupStoreToken reports whether token is the backup store token.
+func CheckBackupStoreToken(d *sql.DB, token string) (bool, error) {
+	hash, err := GetSetting(d, settingBackupStoreToken)
+	if err != nil || hash == "" {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(hashToken(token))) == 1, nil
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// CacheNode is a duh instance at a remote site that caches image files
+// from this one. Systems booting from its subnets fetch them from it.
+type CacheNode struct {
+	ID         int64
+	Name       string
+	URL        string
+	Subnets    string // CIDRs it serves, one per line
+	LastSeenAt string
+	CreatedAt  string
+}
+
+func ListCacheNodes(d *sql.DB) ([]CacheNode, error) {
+	rows, err := d.Query(`SELECT id, name, url, subnets, COALESCE(last_seen_at, ''), created_at FROM cache_nodes ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("list cache nodes: %w", err)
+	}
+	defer rows.Close()
+	var nodes []CacheNode
+	for rows.Next() {
+		var n CacheNode
+		if err := rows.Scan(&n.ID, &n.Name, &n.URL, &n.Subnets, &n.LastSeenAt, &n.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan cache node: %w", err)
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
+
+// CreateCacheNode registers a cache node. Names follow the same rules as
+// environment names.
+func CreateCacheNode(d *sql.DB, name, url, subnets string) (int64, error) {
+	name, err := normalizeName("cache node", name)
+	if err != nil {
+		return 0, err
+	}
+	res, err := d.Exec(`INSERT INTO cache_nodes (name, url, subnets) VALUES (?, ?, ?)`, name, url, subnets)
+	if err != nil {
+		return 0, fmt.Errorf("create cache node: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+func DeleteCacheNode(d *sql.DB, id int64) error {
+	if _, err := d.Exec(`DELETE FROM cache_nodes WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("delete cache node: %w", err)
+	}
+	return nil
+}
+
+// TouchCacheNode records that the named cache node fetched from us.
+func TouchCacheNode(d *sql.DB, name string) error {
+	if _, err := d.Exec(`UPDATE cache_nodes SET last_seen_at = datetime('now') WHERE name = ?`, name); err != nil {
+		return fmt.Errorf("touch cache node: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/justinpopa/duh/internal/passwd"
+)
+
+// Credential is the password generated for a system's install. The
+// password itself is kept, encrypted, only until it is revealed once.
+type Credential struct {
+	SystemID     int64
+	AttemptID    string
+	PasswordHash string // SHA-512 crypt, for config templates
+	Revealable   bool   // the password hasn't been revealed yet
+	CreatedAt    string
+	RevealedAt   string // "" until revealed
+}
+
+// issueCredential gives a system a new random password for the attempt
+// it was just queued for, replacing any earlier one.
+func issueCredential(tx *sql.Tx, systemID int64, attemptID string) error {
+	password := passwd.Generate()
+	sealed, err := seal(password)
+	if err != nil {
+		return fmt.Errorf("seal credential: %w", err)
+	}
+	_, err = tx.Exec(`INSERT INTO system_credentials (system_id, attempt_id, password, password_hash) VALUES (?, ?, ?, ?)
+		ON CONFLICT(system_id) DO UPDATE SET attempt_id = excluded.attempt_id, password = excluded.password,
+		password_hash = excluded.password_hash, created_at = datetime('now'), revealed_at = NULL`,
+		systemID, attemptID, sealed, passwd.Hash(password))
+	if err != nil {
+		return fmt.Errorf("issue credential: %w", err)
+	}
+	return nil
+}
+
+// GetCredential returns a system's generated password details, or nil if
+// it hasn't been queued since credentials were added.
+func GetCredential(d *sql.DB, systemID int64) (*Credential, error) {
+	c := Credential{SystemID: systemID}
+	err := d.QueryRow(`SELECT attempt_id, password_hash, password != '', datetime(created_at), COALESCE(datetime(revealed_at), '')
+		FROM system_credentials WHERE system_id = ?`, systemID).
+		Scan(&c.AttemptID, &c.PasswordHash, &c.Revealable, &c.CreatedAt, &c.RevealedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get credential: %w", err)
+	}
+	return &c, nil
+}
+
+// RevealCredential returns a system's generated password and forgets it,
+// so it can be revealed only once. It returns "" if there is none left to
+// reveal.
+func RevealCredential(d *sql.DB, systemID int64) (string, error) {
+	tx, err := d.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var sealed string
+	err = tx.QueryRow(`SELECT password FROM system_credentials WHERE system_id = ? AND password != ''`, systemID).Scan(&sealed)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("reveal credential: %w", err)
+	}
+	password, err := unseal(sealed)
+	if err != nil {
+		return "", fmt.Errorf("reveal credential: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE system_credentials SET password = '', revealed_at = datetime('now') WHERE system_id = ?`, systemID); err != nil {
+		return "", fmt.Errorf("reveal credential: %w", err)
+	}
+	return password, tx.Commit()
+}
@@ -0,0 +1,292 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Secrets kept in the database — integration credentials, session and
+// chain signing keys, webhook and builder secrets, systems' generated
+// passwords, and password-like system and global vars such as BMC
+// credentials — can be encrypted with AES-256-GCM under a key kept outside
+// it, for deployments on shared hosts. Other columns stay plain so the
+// schema and queries are unchanged.
+
+// sealedPrefix starts every encrypted value.
+const sealedPrefix = "enc:v1:"
+
+// sealer encrypts secrets, or is nil to store them as given.
+var sealer cipher.AEAD
+
+// secretSettings are the settings whose values are encrypted.
+var secretSettings = map[string]bool{
+	"session_key":           true,
+	"chain_key":             true,
+	"netbox_token":          true,
+	"boot_hook_secret":      true,
+	"backup_secret":         true,
+	settingBackupStoreToken: true,
+	"secret_store_token":    true,
+}
+
+// varSettings are the settings holding vars as a JSON object, whose
+// password-like values are encrypted as system vars' are.
+var varSettings = map[string]bool{
+	"global_vars": true,
+}
+
+// settingKeyCheck holds a sealed value showing the database's secrets are
+// encrypted, and under which key.
+const settingKeyCheck = "secrets_key_check"
+
+// ErrNoKey is returned opening a database whose secrets are encrypted
+// without a key to decrypt them.
+var ErrNoKey = errors.New("the database's secrets are encrypted; start duh with its key (-db-key-file, -db-key-command or DUH_DB_KEY)")
+
+// ParseKey reads a 256-bit key written as hex or base64, as made by
+// "openssl rand -hex 32".
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if b, err := hex.DecodeString(s); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	return nil, errors.New("database key must be 32 bytes, as 64 hex digits or base64")
+}
+
+// SetKey encrypts secrets under key from now on; nil stores them plain.
+// It must be called before Open.
+func SetKey(key []byte) error {
+	if key == nil {
+		sealer = nil
+		return nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	sealer = aead
+	return nil
+}
+
+// seal encrypts v if a key is set. Empty and already sealed values are
+// returned as they are.
+func seal(v string) (string, error) {
+	if sealer == nil || v == "" || strings.HasPrefix(v, sealedPrefix) {
+		return v, nil
+	}
+	nonce := make([]byte, sealer.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out := sealer.Seal(nonce, nonce, []byte(v), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(out), nil
+}
+
+// unseal decrypts a value seal encrypted. Plain values are returned as
+// they are.
+func unseal(v string) (string, error) {
+	enc, ok := strings.CutPrefix(v, sealedPrefix)
+	if !ok {
+		return v, nil
+	}
+	if sealer == nil {
+		return "", ErrNoKey
+	}
+	b, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil || len(b) < sealer.NonceSize() {
+		return "", errors.New("decrypt secret: malformed value")
+	}
+	n := sealer.NonceSize()
+	plain, err := sealer.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return "", errors.New("decrypt secret: wrong database key")
+	}
+	return string(plain), nil
+}
+
+// secretVar reports whether a system var holds a secret.
+func secretVar(key string) bool {
+	key = strings.ToLower(key)
+	return strings.HasSuffix(key, "password") || strings.HasSuffix(key, "secret") || strings.HasSuffix(key, "token")
+}
+
+// mapVars applies fn to the string values of the secret keys in a JSON
+// object of vars. Vars without secrets, or that aren't an object, are
+// returned as they are.
+func mapVars(vars string, fn func(string) (string, error)) (string, error) {
+	var m map[string]json.RawMessage
+	if json.Unmarshal([]byte(vars), &m) != nil {
+		return vars, nil
+	}
+	changed := false
+	for k, raw := range m {
+		var v string
+		if !secretVar(k) || json.Unmarshal(raw, &v) != nil {
+			continue
+		}
+		out, err := fn(v)
+		if err != nil {
+			return "", fmt.Errorf("var %s: %w", k, err)
+		}
+		if out != v {
+			m[k], _ = json.Marshal(out)
+			changed = true
+		}
+	}
+	if !changed {
+		return vars, nil
+	}
+	b, err := json.Marshal(m)
+	return string(b), err
+}
+
+func sealVars(vars string) (string, error)   { return mapVars(vars, seal) }
+func unsealVars(vars string) (string, error) { return mapVars(vars, unseal) }
+
+// checkKey compares the database's key check with the key set. A database
+// first opened with a key has its existing secrets encrypted.
+func checkKey(d *sql.DB) error {
+	check, err := GetSetting(d, settingKeyCheck)
+	if err != nil {
+		return err
+	}
+	if check == "" {
+		if sealer == nil {
+			return nil
+		}
+		return rewriteSecrets(d, seal, sealVars, true)
+	}
+	if sealer == nil {
+		return ErrNoKey
+	}
+	_, err = unseal(check)
+	return err
+}
+
+// DecryptSecrets stores every secret in the database plain again, so it
+// can be opened without a key or encrypted under a new one. The key it
+// was encrypted under must be set.
+func DecryptSecrets(d *sql.DB) error {
+	check, err := GetSetting(d, settingKeyCheck)
+	if err != nil || check == "" {
+		return err
+	}
+	if _, err := unseal(check); err != nil {
+		return err
+	}
+	return rewriteSecrets(d, unseal, unsealVars, false)
+}
+
+// rewriteSecrets passes every secret in the database through fn, and
+// system vars through fnVars, then sets or clears the key check.
+func rewriteSecrets(d *sql.DB, fn, fnVars func(string) (string, error), encrypted bool) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	keys := make([]any, 0, len(secretSettings))
+	for k := range secretSettings {
+		keys = append(keys, k)
+	}
+	inKeys := "key IN (?" + strings.Repeat(", ?", len(keys)-1) + ")"
+	mergeBefore := func(before string) (string, error) {
+		var snap mergeSnapshot
+		if json.Unmarshal([]byte(before), &snap) != nil {
+			return before, nil
+		}
+		v, err := fnVars(snap.Vars)
+		if err != nil || v == snap.Vars {
+			return before, err
+		}
+		snap.Vars = v
+		b, err := json.Marshal(snap)
+		return string(b), err
+	}
+	columns := []struct {
+		table, column, where string
+		args                 []any
+		fn                   func(string) (string, error)
+	}{
+		{"settings", "value", inKeys, keys, fn},
+		{"settings", "value", "key = 'global_vars'", nil, fnVars},
+		{"webhooks", "secret", "secret != ''", nil, fn},
+		{"images", "builder_secret", "builder_secret != ''", nil, fn},
+		{"system_credentials", "password", "password != ''", nil, fn},
+		{"systems", "vars", "1", nil, fnVars},
+		{"system_merges", "before", "1", nil, mergeBefore},
+	}
+	for _, c := range columns {
+		if err := rewriteColumn(tx, c.table, c.column, c.where, c.args, c.fn); err != nil {
+			return err
+		}
+	}
+
+	if encrypted {
+		check, err := seal("duh")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value`,
+			settingKeyCheck, check)
+		if err != nil {
+			return err
+		}
+	} else if _, err := tx.Exec(`DELETE FROM settings WHERE key = ?`, settingKeyCheck); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func rewriteColumn(tx *sql.Tx, table, column, where string, args []any, fn func(string) (string, error)) error {
+	rows, err := tx.Query(`SELECT rowid, `+column+` FROM `+table+` WHERE `+where, args...)
+	if err != nil {
+		return fmt.Errorf("read %s.%s: %w", table, column, err)
+	}
+	type change struct {
+		rowid int64
+		value string
+	}
+	var changes []change
+	for rows.Next() {
+		var c change
+		var v string
+		if err := rows.Scan(&c.rowid, &v); err != nil {
+			rows.Close()
+			return err
+		}
+		if c.value, err = fn(v); err != nil {
+			rows.Close()
+			return fmt.Errorf("%s.%s row %d: %w", table, column, c.rowid, err)
+		}
+		if c.value != v {
+			changes = append(changes, c)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, c := range changes {
+		if _, err := tx.Exec(`UPDATE `+table+` SET `+column+` = ? WHERE rowid = ?`, c.value, c.rowid); err != nil {
+			return fmt.Errorf("write %s.%s: %w", table, column, err)
+		}
+	}
+	return nil
+}
@@ -3,13 +3,59 @@ package db
 import (
 	"database/sql"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 
 	_ "modernc.org/sqlite"
 )
 
+// Open opens the database in dataDir and applies any pending migrations.
+// If the database already has a schema and migrations are pending, a copy
+// is written to the backups directory first so a failed upgrade can be
+// rolled back by restoring it. A backup staged as RestoreFile replaces the
+// database first. Secrets are encrypted if a key has been set with SetKey,
+// and a database whose secrets are encrypted can't be opened without it.
 func Open(dataDir string) (*sql.DB, error) {
+	if err := applyRestore(dataDir); err != nil {
+		return nil, fmt.Errorf("restore %s: %w", RestoreFile, err)
+	}
+
+	db, err := OpenRaw(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := SchemaVersion(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if current > 0 && current < LatestSchemaVersion() {
+		path, err := BackupToDir(db, filepath.Join(dataDir, "backups"), fmt.Sprintf("pre-v%d", LatestSchemaVersion()))
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("pre-migration backup: %w", err)
+		}
+		log.Printf("db: backed up schema v%d to %s before migrating", current, path)
+	}
+
+	if err := Migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+
+	if err := checkKey(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// OpenRaw opens the database without running migrations. Used by the
+// maintenance flags (--migrate-dry-run, --migrate-down-to).
+func OpenRaw(dataDir string) (*sql.DB, error) {
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return nil, fmt.Errorf("create data dir: %w", err)
 	}
@@ -34,10 +80,5 @@ func Open(dataDir string) (*sql.DB, error) {
 		}
 	}
 
-	if err := Migrate(db); err != nil {
-		db.Close()
-		return nil, fmt.Errorf("migrate: %w", err)
-	}
-
 	return db, nil
 }
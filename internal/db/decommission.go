@@ -0,0 +1,96 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrNotDecommissioning is returned for a wipe report from a system that
+// isn't being decommissioned.
+var ErrNotDecommissioning = errors.New("system is not being decommissioned")
+
+// Wipe certificate statuses.
+const (
+	WipeStatusWiped  = "wiped"
+	WipeStatusFailed = "failed" // some disk wasn't erased
+)
+
+// WipeCertificate records a disk wipe of a system being decommissioned, as
+// its wipe image reported it. It names the system by MAC and hostname as
+// well as ID so it outlives the system.
+type WipeCertificate struct {
+	ID         int64
+	SystemID   int64
+	MAC        string
+	Hostname   string
+	Status     string // WipeStatusWiped or WipeStatusFailed
+	Report     string // JSON, as posted by the wipe image
+	StartedAt  string // when the system entered decommissioning
+	FinishedAt string
+}
+
+const wipeCertificateColumns = `id, system_id, mac, hostname, status, report, COALESCE(started_at, ''), finished_at`
+
+func scanWipeCertificate(row interface{ Scan(...any) error }) (*WipeCertificate, error) {
+	var c WipeCertificate
+	if err := row.Scan(&c.ID, &c.SystemID, &c.MAC, &c.Hostname, &c.Status, &c.Report, &c.StartedAt, &c.FinishedAt); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// RecordWipe stores the wipe report of a system in the decommissioning
+// state. A wipe with status "wiped" moves the system to decommissioned,
+// which revokes its tokens so the report can't be posted twice; after a
+// failed one it stays in decommissioning and is wiped again on its next
+// boot. It returns the certificate.
+func RecordWipe(d *sql.DB, systemID int64, status, report string) (*WipeCertificate, error) {
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var mac, hostname, state, changedAt string
+	err = tx.QueryRow(`SELECT mac, hostname, state, COALESCE(state_changed_at, '') FROM systems WHERE id = ? AND deleted_at IS NULL`, systemID).
+		Scan(&mac, &hostname, &state, &changedAt)
+	if err == sql.ErrNoRows || (err == nil && state != "decommissioning") {
+		return nil, ErrNotDecommissioning
+	}
+	if err != nil {
+		return nil, err
+	}
+	result, err := tx.Exec(`INSERT INTO wipe_certificates (system_id, mac, hostname, status, report, started_at) VALUES (?, ?, ?, ?, ?, NULLIF(?, ''))`,
+		systemID, mac, hostname, status, report, changedAt)
+	if err != nil {
+		return nil, fmt.Errorf("insert wipe certificate: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	if status == WipeStatusWiped {
+		if err := setSystemState(tx, systemID, state, "decommissioned"); err != nil {
+			return nil, err
+		}
+	}
+	cert, err := scanWipeCertificate(tx.QueryRow(`SELECT `+wipeCertificateColumns+` FROM wipe_certificates WHERE id = ?`, id))
+	if err != nil {
+		return nil, fmt.Errorf("read wipe certificate: %w", err)
+	}
+	return cert, tx.Commit()
+}
+
+// LatestWipeCertificate returns a system's most recent wipe certificate, or
+// nil if it has none.
+func LatestWipeCertificate(d *sql.DB, systemID int64) (*WipeCertificate, error) {
+	c, err := scanWipeCertificate(d.QueryRow(`SELECT `+wipeCertificateColumns+` FROM wipe_certificates WHERE system_id = ? ORDER BY id DESC LIMIT 1`, systemID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get wipe certificate: %w", err)
+	}
+	return c, nil
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// DownloadProgress is how far the download of one of an image's files
+// got, so it can resume where it stopped.
+type DownloadProgress struct {
+	ImageID int64
+	Name    string
+	URL     string
+	// Validator is the ETag or Last-Modified of what the partial file was
+	// fetched from; a resumed request only continues that.
+	Validator  string
+	BytesDone  int64
+	BytesTotal int64 // 0 if unknown
+	Done       bool
+	UpdatedAt  string
+}
+
+// GetDownloadProgress returns the progress of an image file's download, or
+// nil if none was recorded.
+func GetDownloadProgress(d *sql.DB, imageID int64, name string) (*DownloadProgress, error) {
+	p := DownloadProgress{ImageID: imageID, Name: name}
+	err := d.QueryRow(`SELECT url, validator, bytes_done, bytes_total, done, updated_at FROM download_progress
+		WHERE image_id = ? AND name = ?`, imageID, name).
+		Scan(&p.URL, &p.Validator, &p.BytesDone, &p.BytesTotal, &p.Done, &p.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get download progress: %w", err)
+	}
+	return &p, nil
+}
+
+// SaveDownloadProgress records the progress of an image file's download.
+func SaveDownloadProgress(d *sql.DB, p *DownloadProgress) error {
+	_, err := d.Exec(`INSERT INTO download_progress (image_id, name, url, validator, bytes_done, bytes_total, done)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(image_id, name) DO UPDATE SET
+			url = excluded.url, validator = excluded.validator, bytes_done = excluded.bytes_done,
+			bytes_total = excluded.bytes_total, done = excluded.done, updated_at = datetime('now')`,
+		p.ImageID, p.Name, p.URL, p.Validator, p.BytesDone, p.BytesTotal, p.Done)
+	if err != nil {
+		return fmt.Errorf("save download progress: %w", err)
+	}
+	return nil
+}
+
+// ClearDownloadProgress forgets the progress of an image's downloads, once
+// they are complete or the image's files are being replaced.
+func ClearDownloadProgress(d *sql.DB, imageID int64) error {
+	if _, err := d.Exec("DELETE FROM download_progress WHERE image_id = ?", imageID); err != nil {
+		return fmt.Errorf("clear download progress: %w", err)
+	}
+	return nil
+}
+
+// ListImagesDownloading returns the images whose status is downloading.
+func ListImagesDownloading(d *sql.DB) ([]Image, error) {
+	return queryImages(d, `SELECT `+imageColumns+` FROM images WHERE status = ? AND deleted_at IS NULL`, ImageStatusDownloading)
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Driver is a driver pack in the drivers library, attached to profiles so
+// their installers can add it for the hardware it supports.
+type Driver struct {
+	ID          int64
+	Name        string
+	OSFamily    string // "" for any
+	HardwareIDs string // one per line, e.g. PCI\VEN_8086&DEV_15F3 or pci:8086:15f3
+	FileName    string
+	Size        int64
+	SHA256      string
+	CreatedAt   string
+}
+
+// IDs returns the driver's hardware IDs, upper-cased.
+func (d Driver) IDs() []string {
+	var ids []string
+	for _, line := range strings.FieldsFunc(d.HardwareIDs, func(r rune) bool { return r == '\n' || r == ',' }) {
+		if id := strings.ToUpper(strings.TrimSpace(line)); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Matches reports whether the driver supports any of a machine's hardware
+// IDs. As with Windows' own matching, a driver ID matches a device ID it is
+// a prefix of, so PCI\VEN_8086&DEV_15F3 covers every subsystem of that
+// device. A driver without hardware IDs matches everything.
+func (d Driver) Matches(hardwareIDs []string) bool {
+	ids := d.IDs()
+	if len(ids) == 0 {
+		return true
+	}
+	for _, hw := range hardwareIDs {
+		hw = strings.ToUpper(strings.TrimSpace(hw))
+		for _, id := range ids {
+			if strings.HasPrefix(hw, id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const driverColumns = `d.id, d.name, d.os_family, d.hardware_ids, d.file_name, d.size, d.sha256, d.created_at`
+
+func queryDrivers(d *sql.DB, query string, args ...any) ([]Driver, error) {
+	rows, err := d.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list drivers: %w", err)
+	}
+	defer rows.Close()
+	var out []Driver
+	for rows.Next() {
+		var dr Driver
+		if err := rows.Scan(&dr.ID, &dr.Name, &dr.OSFamily, &dr.HardwareIDs, &dr.FileName, &dr.Size, &dr.SHA256, &dr.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan driver: %w", err)
+		}
+		out = append(out, dr)
+	}
+	return out, rows.Err()
+}
+
+// ListDrivers returns the whole drivers library by name.
+func ListDrivers(d *sql.DB) ([]Driver, error) {
+	return queryDrivers(d, `SELECT `+driverColumns+` FROM drivers d ORDER BY d.name, d.id`)
+}
+
+// ProfileDrivers returns the drivers attached to a profile.
+func ProfileDrivers(d *sql.DB, profileID int64) ([]Driver, error) {
+	return queryDrivers(d, `SELECT `+driverColumns+` FROM drivers d
+		JOIN profile_drivers pd ON pd.driver_id = d.id
+		WHERE pd.profile_id = ? ORDER BY d.name, d.id`, profileID)
+}
+
+func GetDriver(d *sql.DB, id int64) (*Driver, error) {
+	drivers, err := queryDrivers(d, `SELECT `+driverColumns+` FROM drivers d WHERE d.id = ?`, id)
+	if err != nil || len(drivers) == 0 {
+		return nil, err
+	}
+	return &drivers[0], nil
+}
+
+func CreateDriver(d *sql.DB, name, osFamily, hardwareIDs, fileName string, size int64, sha256 string) (int64, error) {
+	result, err := d.Exec(`INSERT INTO drivers (name, os_family, hardware_ids, file_name, size, sha256) VALUES (?, ?, ?, ?, ?, ?)`,
+		name, osFamily, hardwareIDs, fileName, size, sha256)
+	if err != nil {
+		return 0, fmt.Errorf("create driver: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+// DeleteDriver removes a driver, detaching it from every profile.
+func DeleteDriver(d *sql.DB, id int64) error {
+	_, err := d.Exec(`DELETE FROM drivers WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("delete driver: %w", err)
+	}
+	return nil
+}
+
+// SetProfileDrivers replaces the drivers attached to a profile.
+func SetProfileDrivers(d *sql.DB, profileID int64, driverIDs []int64) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM profile_drivers WHERE profile_id = ?`, profileID); err != nil {
+		return fmt.Errorf("detach drivers: %w", err)
+	}
+	for _, id := range driverIDs {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO profile_drivers (profile_id, driver_id) VALUES (?, ?)`, profileID, id); err != nil {
+			return fmt.Errorf("attach driver %d: %w", id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// DriverProfileCounts returns how many profiles each driver is attached
+// to, by driver ID.
+func DriverProfileCounts(d *sql.DB) (map[int64]int, error) {
+	rows, err := d.Query(`SELECT driver_id, COUNT(*) FROM profile_drivers GROUP BY driver_id`)
+	if err != nil {
+		return nil, fmt.Errorf("count driver profiles: %w", err)
+	}
+	defer rows.Close()
+	out := map[int64]int{}
+	for rows.Next() {
+		var id int64
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, fmt.Errorf("scan driver profiles: %w", err)
+		}
+		out[id] = n
+	}
+	return out, rows.Err()
+}
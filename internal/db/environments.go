@@ -0,0 +1,121 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Environment separates images, profiles and systems, e.g. dev, staging
+// and prod. Anything not in an environment has Environment "".
+type Environment struct {
+	Name        string
+	Description string
+	CreatedAt   string
+}
+
+// nameRe matches environment, tenant and snippet names.
+var nameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// ErrEnvironmentInUse is returned when deleting an environment that still
+// has images, profiles or systems in it.
+var ErrEnvironmentInUse = errors.New("environment is in use")
+
+// NormalizeEnvironment lowercases and checks an environment name.
+func NormalizeEnvironment(name string) (string, error) {
+	return normalizeName("environment", name)
+}
+
+func normalizeName(kind, name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !nameRe.MatchString(name) {
+		return "", fmt.Errorf("invalid %s name %q: use up to 32 lowercase letters, digits, - and _", kind, name)
+	}
+	return name, nil
+}
+
+func ListEnvironments(d *sql.DB) ([]Environment, error) {
+	rows, err := d.Query(`SELECT name, description, created_at FROM environments ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("list environments: %w", err)
+	}
+	defer rows.Close()
+	var envs []Environment
+	for rows.Next() {
+		var e Environment
+		if err := rows.Scan(&e.Name, &e.Description, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan environment: %w", err)
+		}
+		envs = append(envs, e)
+	}
+	return envs, rows.Err()
+}
+
+// EnvironmentExists reports whether name is a defined environment. The
+// empty name, meaning none, always exists.
+func EnvironmentExists(d *sql.DB, name string) (bool, error) {
+	if name == "" {
+		return true, nil
+	}
+	var n int
+	if err := d.QueryRow(`SELECT COUNT(*) FROM environments WHERE name = ?`, name).Scan(&n); err != nil {
+		return false, fmt.Errorf("get environment: %w", err)
+	}
+	return n > 0, nil
+}
+
+func CreateEnvironment(d *sql.DB, name, description string) error {
+	name, err := NormalizeEnvironment(name)
+	if err != nil {
+		return err
+	}
+	if _, err := d.Exec(`INSERT INTO environments (name, description) VALUES (?, ?)`, name, description); err != nil {
+		return fmt.Errorf("create environment: %w", err)
+	}
+	return nil
+}
+
+// DeleteEnvironment removes an environment nothing is in, trashed items
+// included.
+func DeleteEnvironment(d *sql.DB, name string) error {
+	var n int
+	err := d.QueryRow(`SELECT (SELECT COUNT(*) FROM images WHERE environment = ?1)
+		+ (SELECT COUNT(*) FROM profiles WHERE environment = ?1)
+		+ (SELECT COUNT(*) FROM systems WHERE environment = ?1)`, name).Scan(&n)
+	if err != nil {
+		return fmt.Errorf("count environment members: %w", err)
+	}
+	if n > 0 {
+		return ErrEnvironmentInUse
+	}
+	if _, err := d.Exec(`DELETE FROM environments WHERE name = ?`, name); err != nil {
+		return fmt.Errorf("delete environment: %w", err)
+	}
+	return nil
+}
+
+func UpdateSystemEnvironment(d *sql.DB, id int64, env string) error {
+	_, err := d.Exec(`UPDATE systems SET environment = ?, updated_at = datetime('now') WHERE id = ?`, env, id)
+	if err != nil {
+		return fmt.Errorf("update system environment: %w", err)
+	}
+	return nil
+}
+
+func UpdateImageEnvironment(d *sql.DB, id int64, env string) error {
+	_, err := d.Exec(`UPDATE images SET environment = ?, updated_at = datetime('now') WHERE id = ?`, env, id)
+	if err != nil {
+		return fmt.Errorf("update image environment: %w", err)
+	}
+	return nil
+}
+
+func UpdateProfileEnvironment(d *sql.DB, id int64, env string) error {
+	_, err := d.Exec(`UPDATE profiles SET environment = ?, updated_at = datetime('now') WHERE id = ?`, env, id)
+	if err != nil {
+		return fmt.Errorf("update profile environment: %w", err)
+	}
+	return nil
+}
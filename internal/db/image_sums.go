@@ -0,0 +1,69 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Where a recorded image file checksum came from.
+const (
+	SumSourceMetadata = "metadata" // declared by the catalog or whoever supplied the URL
+	SumSourceReceived = "received" // computed when the file arrived
+)
+
+// ImageFileSum is the SHA-256 an image file is expected to have, the
+// baseline a verify compares the stored file against.
+type ImageFileSum struct {
+	Name       string
+	SHA256     string
+	Source     string
+	RecordedAt string
+}
+
+// ImageFileSums returns an image's recorded checksums by file name.
+func ImageFileSums(d *sql.DB, imageID int64) (map[string]ImageFileSum, error) {
+	rows, err := d.Query(`SELECT name, sha256, source, recorded_at FROM image_file_sums WHERE image_id = ?`, imageID)
+	if err != nil {
+		return nil, fmt.Errorf("list image file sums: %w", err)
+	}
+	defer rows.Close()
+	sums := make(map[string]ImageFileSum)
+	for rows.Next() {
+		var s ImageFileSum
+		if err := rows.Scan(&s.Name, &s.SHA256, &s.Source, &s.RecordedAt); err != nil {
+			return nil, fmt.Errorf("scan image file sum: %w", err)
+		}
+		sums[s.Name] = s
+	}
+	return sums, rows.Err()
+}
+
+// SetImageFileSum records the checksum of a file that was just stored,
+// replacing the one of any file it overwrote.
+func SetImageFileSum(d *sql.DB, imageID int64, name, sum, source string) error {
+	_, err := d.Exec(`INSERT INTO image_file_sums (image_id, name, sha256, source) VALUES (?, ?, ?, ?)
+		ON CONFLICT(image_id, name) DO UPDATE SET sha256 = excluded.sha256,
+		source = excluded.source, recorded_at = datetime('now')`,
+		imageID, name, sum, source)
+	if err != nil {
+		return fmt.Errorf("set image file sum: %w", err)
+	}
+	return nil
+}
+
+// DeleteImageFileSum forgets the checksum of a removed file.
+func DeleteImageFileSum(d *sql.DB, imageID int64, name string) error {
+	if _, err := d.Exec(`DELETE FROM image_file_sums WHERE image_id = ? AND name = ?`, imageID, name); err != nil {
+		return fmt.Errorf("delete image file sum: %w", err)
+	}
+	return nil
+}
+
+// DeleteImageFileSums forgets all of an image's checksums, e.g. before
+// its files are pulled again.
+func DeleteImageFileSums(d *sql.DB, imageID int64) error {
+	if _, err := d.Exec(`DELETE FROM image_file_sums WHERE image_id = ?`, imageID); err != nil {
+		return fmt.Errorf("delete image file sums: %w", err)
+	}
+	return nil
+}
@@ -2,29 +2,88 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 )
 
 type Image struct {
-	ID           int64
-	Name         string
-	Description  string
-	BootType     string
-	KernelFile   string
-	InitrdFile   string
-	Cmdline      string
-	IPXEScript   string
-	Status       string // ready, downloading, error
-	StatusDetail string
-	CatalogID    string
-	CatalogHash  string
-	Icon         string
-	IconColor    string
-	CreatedAt    string
-	UpdatedAt    string
-}
-
-const BootTypeLinux = "linux"
+	ID              int64
+	Name            string
+	Description     string
+	BootType        string
+	KernelFile      string
+	InitrdFile      string
+	Cmdline         string
+	IPXEScript      string
+	Status          string // ready, downloading, error
+	StatusDetail    string
+	CatalogID       string
+	CatalogHash     string
+	CatalogOrphaned bool   // pulled from the catalog, which no longer lists it
+	CatalogPolicy   string // how catalog updates are taken: "", auto or pin
+	CatalogLatest   string // hash of the entry when the catalog was last synced
+	Icon            string
+	IconColor       string
+	FileMap         string // JSON ImageFiles; empty means the boot type's default names
+	BootTarget      string // nfs: server:/export[,opts]; iscsi: iPXE SAN URI
+	Utility         bool   // memtest, rescue shell and the like; offered for one-shot boots
+	Arch            string // CPU architecture the image boots on, e.g. amd64 or arm64; "" if unknown
+	BuilderURL      string // external pipeline notified on rebuild
+	BuilderSecret   string `json:"-"`
+	BuildID         string // current or last build
+	BuildStatus     string // "", building, succeeded, failed
+	BuildDetail     string
+	Environment     string // "" if the image is shared by every environment
+	TenantID        int64  // 0 if the image belongs to no tenant and is shared by all
+	DeletedAt       string
+	CreatedAt       string
+	UpdatedAt       string
+}
+
+const (
+	BootTypeLinux = "linux"
+	BootTypeNFS   = "nfs"   // kernel + initrd with the root filesystem on NFS
+	BootTypeISCSI = "iscsi" // sanboot from an iSCSI target, or sanhook + installer
+)
+
+// ImageFiles maps the files stored for an image to the roles the boot script
+// needs, so artifacts don't have to be renamed to the default names.
+type ImageFiles struct {
+	Kernel  string            `json:"kernel,omitempty"`
+	Initrds []string          `json:"initrds,omitempty"`
+	Extra   map[string]string `json:"extra,omitempty"` // role → file name
+}
+
+// FileRoleRootfs is the extra file role for a root filesystem (e.g. a
+// squashfs) that a live installer fetches after the kernel boots.
+const FileRoleRootfs = "rootfs"
+
+// Files decodes the image's file map. A missing or malformed map yields
+// the zero value so callers fall back to default names.
+func (img *Image) Files() ImageFiles {
+	var f ImageFiles
+	if img.FileMap != "" {
+		json.Unmarshal([]byte(img.FileMap), &f)
+	}
+	return f
+}
+
+// Build states for an image with a builder. A build runs beside the
+// image's own status: the previous artifacts stay bootable until a
+// successful build replaces them.
+const (
+	BuildStatusBuilding  = "building"
+	BuildStatusSucceeded = "succeeded"
+	BuildStatusFailed    = "failed"
+)
+
+// Catalog update policies. With the default, manual, a new version of the
+// entry is announced and left for the admin to pull.
+const (
+	CatalogPolicyManual = ""
+	CatalogPolicyAuto   = "auto" // pull new versions as soon as they're seen
+	CatalogPolicyPin    = "pin"  // keep the pulled version and stay quiet
+)
 
 const (
 	ImageStatusReady       = "ready"
@@ -32,20 +91,28 @@ const (
 	ImageStatusError       = "error"
 )
 
-const imageColumns = `id, name, description, boot_type, kernel_file, initrd_file, cmdline, ipxe_script, status, status_detail, catalog_id, catalog_hash, COALESCE(icon, ''), COALESCE(icon_color, ''), created_at, updated_at`
+const imageColumns = `id, name, description, boot_type, kernel_file, initrd_file, cmdline, ipxe_script, status, status_detail, catalog_id, catalog_hash, catalog_orphaned, catalog_policy, catalog_latest_hash, COALESCE(icon, ''), COALESCE(icon_color, ''), file_map, boot_target, utility, arch, builder_url, builder_secret, build_id, build_status, build_detail, environment, tenant_id, COALESCE(deleted_at, ''), created_at, updated_at`
 
 func scanImage(row interface{ Scan(...any) error }) (*Image, error) {
 	var img Image
 	err := row.Scan(&img.ID, &img.Name, &img.Description, &img.BootType,
 		&img.KernelFile, &img.InitrdFile, &img.Cmdline, &img.IPXEScript,
-		&img.Status, &img.StatusDetail, &img.CatalogID, &img.CatalogHash,
-		&img.Icon, &img.IconColor,
+		&img.Status, &img.StatusDetail, &img.CatalogID, &img.CatalogHash, &img.CatalogOrphaned, &img.CatalogPolicy, &img.CatalogLatest,
+		&img.Icon, &img.IconColor, &img.FileMap, &img.BootTarget, &img.Utility, &img.Arch,
+		&img.BuilderURL, &img.BuilderSecret, &img.BuildID, &img.BuildStatus, &img.BuildDetail, &img.Environment, &img.TenantID, &img.DeletedAt,
 		&img.CreatedAt, &img.UpdatedAt)
+	if err == nil {
+		img.BuilderSecret, err = unseal(img.BuilderSecret)
+	}
 	return &img, err
 }
 
 func ListImages(d *sql.DB) ([]Image, error) {
-	rows, err := d.Query(`SELECT ` + imageColumns + ` FROM images ORDER BY id DESC`)
+	return queryImages(d, `SELECT `+imageColumns+` FROM images WHERE deleted_at IS NULL ORDER BY id DESC`)
+}
+
+func queryImages(d *sql.DB, query string, args ...any) ([]Image, error) {
+	rows, err := d.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -63,7 +130,7 @@ func ListImages(d *sql.DB) ([]Image, error) {
 }
 
 func GetImage(d *sql.DB, id int64) (*Image, error) {
-	img, err := scanImage(d.QueryRow(`SELECT `+imageColumns+` FROM images WHERE id = ?`, id))
+	img, err := scanImage(d.QueryRow(`SELECT `+imageColumns+` FROM images WHERE id = ? AND deleted_at IS NULL`, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -74,7 +141,7 @@ func GetImage(d *sql.DB, id int64) (*Image, error) {
 }
 
 func GetImageByCatalogID(d *sql.DB, catalogID string) (*Image, error) {
-	img, err := scanImage(d.QueryRow(`SELECT `+imageColumns+` FROM images WHERE catalog_id = ?`, catalogID))
+	img, err := scanImage(d.QueryRow(`SELECT `+imageColumns+` FROM images WHERE catalog_id = ? AND deleted_at IS NULL`, catalogID))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -101,8 +168,8 @@ func CreateCatalogImage(d *sql.DB, name, description, bootType, cmdline, ipxeScr
 		bootType = BootTypeLinux
 	}
 	result, err := d.Exec(
-		`INSERT INTO images (name, description, boot_type, kernel_file, initrd_file, cmdline, ipxe_script, status, catalog_id, catalog_hash, icon, icon_color) VALUES (?, ?, ?, '', '', ?, ?, 'downloading', ?, ?, ?, ?)`,
-		name, description, bootType, cmdline, ipxeScript, catalogID, catalogHash, icon, iconColor)
+		`INSERT INTO images (name, description, boot_type, kernel_file, initrd_file, cmdline, ipxe_script, status, catalog_id, catalog_hash, catalog_latest_hash, icon, icon_color) VALUES (?, ?, ?, '', '', ?, ?, 'downloading', ?, ?, ?, ?, ?)`,
+		name, description, bootType, cmdline, ipxeScript, catalogID, catalogHash, catalogHash, icon, iconColor)
 	if err != nil {
 		return 0, fmt.Errorf("insert catalog image: %w", err)
 	}
@@ -128,18 +195,136 @@ func UpdateImage(d *sql.DB, id int64, name, description, bootType, cmdline, ipxe
 func ResetCatalogImage(d *sql.DB, id int64, name, description, bootType, cmdline, ipxeScript, catalogHash, icon, iconColor string) error {
 	_, err := d.Exec(`UPDATE images SET name = ?, description = ?, boot_type = ?, cmdline = ?, ipxe_script = ?,
 		kernel_file = '', initrd_file = '', status = 'downloading', status_detail = '',
-		catalog_hash = ?, icon = ?, icon_color = ?, updated_at = datetime('now') WHERE id = ?`,
-		name, description, bootType, cmdline, ipxeScript, catalogHash, icon, iconColor, id)
+		catalog_hash = ?, catalog_latest_hash = ?, catalog_orphaned = 0, icon = ?, icon_color = ?, updated_at = datetime('now') WHERE id = ?`,
+		name, description, bootType, cmdline, ipxeScript, catalogHash, catalogHash, icon, iconColor, id)
 	return err
 }
 
-func UpdateImageIcon(d *sql.DB, id int64, icon, iconColor string) error {
-	_, err := d.Exec(`UPDATE images SET icon = ?, icon_color = ?, updated_at = datetime('now') WHERE id = ?`,
-		icon, iconColor, id)
+func UpdateImageFileMap(d *sql.DB, id int64, files ImageFiles) error {
+	fileMap := ""
+	if files.Kernel != "" || len(files.Initrds) > 0 || len(files.Extra) > 0 {
+		b, err := json.Marshal(files)
+		if err != nil {
+			return err
+		}
+		fileMap = string(b)
+	}
+	_, err := d.Exec(`UPDATE images SET file_map = ?, updated_at = datetime('now') WHERE id = ?`, fileMap, id)
 	return err
 }
 
+func UpdateImageBootTarget(d *sql.DB, id int64, target string) error {
+	_, err := d.Exec(`UPDATE images SET boot_target = ?, updated_at = datetime('now') WHERE id = ?`, target, id)
+	return err
+}
+
+func SetImageUtility(d *sql.DB, id int64, utility bool) error {
+	_, err := d.Exec(`UPDATE images SET utility = ?, updated_at = datetime('now') WHERE id = ?`, utility, id)
+	return err
+}
+
+// SetImageArch records the CPU architecture the image boots on.
+func SetImageArch(d *sql.DB, id int64, arch string) error {
+	_, err := d.Exec(`UPDATE images SET arch = ?, updated_at = datetime('now') WHERE id = ?`, arch, id)
+	if err != nil {
+		return fmt.Errorf("set image arch: %w", err)
+	}
+	return nil
+}
+
+// UpdateImageCatalogMeta refreshes the fields a catalog entry can change
+// without the image being pulled again.
+func UpdateImageCatalogMeta(d *sql.DB, id int64, description, icon, iconColor string) error {
+	_, err := d.Exec(`UPDATE images SET description = ?, icon = ?, icon_color = ?, updated_at = datetime('now') WHERE id = ?`,
+		description, icon, iconColor, id)
+	if err != nil {
+		return fmt.Errorf("update image catalog metadata: %w", err)
+	}
+	return nil
+}
+
+// SetImageCatalogPolicy sets how new versions of the image's catalog entry
+// are taken.
+func SetImageCatalogPolicy(d *sql.DB, id int64, policy string) error {
+	_, err := d.Exec(`UPDATE images SET catalog_policy = ?, updated_at = datetime('now') WHERE id = ?`, policy, id)
+	if err != nil {
+		return fmt.Errorf("set image catalog policy: %w", err)
+	}
+	return nil
+}
+
+// SetImageCatalogLatest records the hash the catalog lists for the
+// image's entry.
+func SetImageCatalogLatest(d *sql.DB, id int64, hash string) error {
+	_, err := d.Exec(`UPDATE images SET catalog_latest_hash = ?, updated_at = datetime('now') WHERE id = ?`, hash, id)
+	if err != nil {
+		return fmt.Errorf("set image catalog latest hash: %w", err)
+	}
+	return nil
+}
+
+// SetImageCatalogOrphaned records whether the catalog still lists the
+// image's entry.
+func SetImageCatalogOrphaned(d *sql.DB, id int64, orphaned bool) error {
+	_, err := d.Exec(`UPDATE images SET catalog_orphaned = ?, updated_at = datetime('now') WHERE id = ?`, orphaned, id)
+	if err != nil {
+		return fmt.Errorf("set image catalog orphaned: %w", err)
+	}
+	return nil
+}
+
+// UpdateImageBuilder sets the pipeline notified when the image is rebuilt.
+func UpdateImageBuilder(d *sql.DB, id int64, url, secret string) error {
+	secret, err := seal(secret)
+	if err != nil {
+		return err
+	}
+	_, err = d.Exec(`UPDATE images SET builder_url = ?, builder_secret = ?, updated_at = datetime('now') WHERE id = ?`, url, secret, id)
+	if err != nil {
+		return fmt.Errorf("update image builder: %w", err)
+	}
+	return nil
+}
+
+// StartImageBuild records a new build. Only the hash of its upload token
+// is stored.
+func StartImageBuild(d *sql.DB, id int64, buildID, tokenHash string) error {
+	_, err := d.Exec(`UPDATE images SET build_id = ?, build_token_hash = ?, build_status = ?, build_detail = '', updated_at = datetime('now') WHERE id = ?`,
+		buildID, tokenHash, BuildStatusBuilding, id)
+	if err != nil {
+		return fmt.Errorf("start image build: %w", err)
+	}
+	return nil
+}
+
+// ImageBuildTokenHash returns the upload token hash of a running build, or
+// "" if buildID isn't the image's running build.
+func ImageBuildTokenHash(d *sql.DB, id int64, buildID string) (string, error) {
+	var hash string
+	err := d.QueryRow(`SELECT build_token_hash FROM images WHERE id = ? AND build_id = ? AND build_status = ? AND deleted_at IS NULL`,
+		id, buildID, BuildStatusBuilding).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("get image build token: %w", err)
+	}
+	return hash, nil
+}
+
+// FinishImageBuild ends a build and revokes its upload token.
+func FinishImageBuild(d *sql.DB, id int64, status, detail string) error {
+	_, err := d.Exec(`UPDATE images SET build_status = ?, build_detail = ?, build_token_hash = '', updated_at = datetime('now') WHERE id = ?`,
+		status, detail, id)
+	if err != nil {
+		return fmt.Errorf("finish image build: %w", err)
+	}
+	return nil
+}
+
+// DeleteImage moves an image to the trash. It stays restorable, files and
+// all, until the trash is purged.
 func DeleteImage(d *sql.DB, id int64) error {
-	_, err := d.Exec(`DELETE FROM images WHERE id = ?`, id)
+	_, err := d.Exec(`UPDATE images SET deleted_at = datetime('now'), updated_at = datetime('now') WHERE id = ? AND deleted_at IS NULL`, id)
 	return err
 }
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// ipHistoryLimit is how many addresses a system's IP history keeps.
+const ipHistoryLimit = 10
+
+// What a system was seen at an address by.
+const (
+	IPSourceBoot      = "boot"      // netbooting
+	IPSourceHeartbeat = "heartbeat" // a heartbeat from its installed host
+)
+
+// IPSighting is an address a system has been seen at.
+type IPSighting struct {
+	IPAddr      string
+	Source      string // what saw it there last
+	FirstSeenAt string
+	LastSeenAt  string
+}
+
+// observeIP makes ip the system's address and notes it in the system's IP
+// history. If the system had a different address, that is kept as its
+// previous one and returned; otherwise observeIP returns "".
+func observeIP(tx *sql.Tx, id int64, ip, source string) (string, error) {
+	if ip == "" {
+		return "", nil
+	}
+	var current string
+	if err := tx.QueryRow(`SELECT ip_addr FROM systems WHERE id = ?`, id).Scan(&current); err != nil {
+		return "", fmt.Errorf("observe ip: %w", err)
+	}
+	var prev string
+	switch {
+	case current == "":
+		if _, err := tx.Exec(`UPDATE systems SET ip_addr = ? WHERE id = ?`, ip, id); err != nil {
+			return "", fmt.Errorf("observe ip: %w", err)
+		}
+	case current != ip:
+		prev = current
+		if _, err := tx.Exec(`UPDATE systems SET ip_addr = ?, prev_ip_addr = ?, ip_changed_at = datetime('now') WHERE id = ?`,
+			ip, prev, id); err != nil {
+			return "", fmt.Errorf("observe ip: %w", err)
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO system_ips (system_id, ip_addr, source) VALUES (?, ?, ?)
+		ON CONFLICT (system_id, ip_addr) DO UPDATE SET source = excluded.source, last_seen_at = datetime('now')`,
+		id, ip, source); err != nil {
+		return "", fmt.Errorf("record ip: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM system_ips WHERE system_id = ? AND ip_addr NOT IN (
+		SELECT ip_addr FROM system_ips WHERE system_id = ? ORDER BY last_seen_at DESC, rowid DESC LIMIT ?)`,
+		id, id, ipHistoryLimit); err != nil {
+		return "", fmt.Errorf("prune ip history: %w", err)
+	}
+	return prev, nil
+}
+
+// ListIPHistory returns the addresses a system has been seen at, most
+// recent first.
+func ListIPHistory(d *sql.DB, systemID int64) ([]IPSighting, error) {
+	rows, err := d.Query(`SELECT ip_addr, source, datetime(first_seen_at), datetime(last_seen_at)
+		FROM system_ips WHERE system_id = ? ORDER BY last_seen_at DESC, rowid DESC`, systemID)
+	if err != nil {
+		return nil, fmt.Errorf("list ip history: %w", err)
+	}
+	defer rows.Close()
+	var history []IPSighting
+	for rows.Next() {
+		var s IPSighting
+		if err := rows.Scan(&s.IPAddr, &s.Source, &s.FirstSeenAt, &s.LastSeenAt); err != nil {
+			return nil, fmt.Errorf("scan ip sighting: %w", err)
+		}
+		history = append(history, s)
+	}
+	return history, rows.Err()
+}
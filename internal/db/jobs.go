@@ -0,0 +1,261 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Job statuses. A queued job runs once its run_after passes; a running job
+// goes back to queued if duh stops before it finishes.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job is background work in the queue.
+type Job struct {
+	ID          int64
+	Type        string
+	Payload     string // JSON
+	Status      string
+	Attempts    int
+	MaxAttempts int
+	LastError   string
+	RunAfter    string
+	CreatedAt   string
+	UpdatedAt   string
+}
+
+const jobColumns = `id, type, payload, status, attempts, max_attempts, last_error, run_after, created_at, updated_at`
+
+func scanJob(row interface{ Scan(...any) error }) (*Job, error) {
+	var j Job
+	if err := row.Scan(&j.ID, &j.Type, &j.Payload, &j.Status, &j.Attempts, &j.MaxAttempts,
+		&j.LastError, &j.RunAfter, &j.CreatedAt, &j.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// EnqueueJob adds a job to the queue and returns its ID.
+func EnqueueJob(d *sql.DB, typ, payload string, maxAttempts int) (int64, error) {
+	res, err := d.Exec("INSERT INTO jobs (type, payload, max_attempts) VALUES (?, ?, ?)", typ, payload, maxAttempts)
+	if err != nil {
+		return 0, fmt.Errorf("enqueue job: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+// EnqueueJobOnce is EnqueueJob, except that a job of the same type and
+// payload still queued or running is reused.
+func EnqueueJobOnce(d *sql.DB, typ, payload string, maxAttempts int) (int64, error) {
+	var id int64
+	err := d.QueryRow("SELECT id FROM jobs WHERE type = ? AND payload = ? AND status IN (?, ?)",
+		typ, payload, JobQueued, JobRunning).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("enqueue job: %w", err)
+	}
+	return EnqueueJob(d, typ, payload, maxAttempts)
+}
+
+// ScheduleJobOnce adds a job due after delay, unless a job of the same
+// type and payload is already queued, whose ID it returns instead. A
+// running one doesn't count, as it may have started before whatever the
+// new job is for.
+func ScheduleJobOnce(d *sql.DB, typ, payload string, maxAttempts int, delay time.Duration) (int64, error) {
+	var id int64
+	err := d.QueryRow("SELECT id FROM jobs WHERE type = ? AND payload = ? AND status = ?",
+		typ, payload, JobQueued).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("schedule job: %w", err)
+	}
+	res, err := d.Exec("INSERT INTO jobs (type, payload, max_attempts, run_after) VALUES (?, ?, ?, datetime('now', ?))",
+		typ, payload, maxAttempts, fmt.Sprintf("+%d seconds", int(delay.Seconds())))
+	if err != nil {
+		return 0, fmt.Errorf("schedule job: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+// ClaimJob marks the queued job that has waited longest as running and
+// returns it, or nil if no job is due.
+func ClaimJob(d *sql.DB) (*Job, error) {
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("claim job: %w", err)
+	}
+	defer tx.Rollback()
+
+	j, err := scanJob(tx.QueryRow(`SELECT `+jobColumns+` FROM jobs
+		WHERE status = ? AND run_after <= datetime('now') ORDER BY run_after, id LIMIT 1`, JobQueued))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("claim job: %w", err)
+	}
+	if _, err := tx.Exec("UPDATE jobs SET status = ?, attempts = attempts + 1, updated_at = datetime('now') WHERE id = ?",
+		JobRunning, j.ID); err != nil {
+		return nil, fmt.Errorf("claim job: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit job claim: %w", err)
+	}
+	j.Status = JobRunning
+	j.Attempts++
+	return j, nil
+}
+
+func setJobStatus(d *sql.DB, id int64, status, lastError string) error {
+	_, err := d.Exec("UPDATE jobs SET status = ?, last_error = ?, updated_at = datetime('now') WHERE id = ?",
+		status, lastError, id)
+	if err != nil {
+		return fmt.Errorf("update job %d: %w", id, err)
+	}
+	return nil
+}
+
+// FinishJob records that a job succeeded.
+func FinishJob(d *sql.DB, id int64) error {
+	return setJobStatus(d, id, JobDone, "")
+}
+
+// FailJob records that a job failed for good.
+func FailJob(d *sql.DB, id int64, lastError string) error {
+	return setJobStatus(d, id, JobFailed, lastError)
+}
+
+// RetryJob puts a job that failed back in the queue, to run again after
+// delay.
+func RetryJob(d *sql.DB, id int64, lastError string, delay time.Duration) error {
+	_, err := d.Exec(`UPDATE jobs SET status = ?, last_error = ?, run_after = datetime('now', ?), updated_at = datetime('now')
+		WHERE id = ?`, JobQueued, lastError, fmt.Sprintf("+%d seconds", int(delay.Seconds())), id)
+	if err != nil {
+		return fmt.Errorf("retry job %d: %w", id, err)
+	}
+	return nil
+}
+
+// RequeueJob puts a job that was interrupted back in the queue, without
+// counting the attempt.
+func RequeueJob(d *sql.DB, id int64) error {
+	_, err := d.Exec("UPDATE jobs SET status = ?, attempts = max(attempts - 1, 0), updated_at = datetime('now') WHERE id = ? AND status = ?",
+		JobQueued, id, JobRunning)
+	if err != nil {
+		return fmt.Errorf("requeue job %d: %w", id, err)
+	}
+	return nil
+}
+
+// RequeueRunningJobs puts jobs left running when duh last stopped back in
+// the queue, and returns how many there were.
+func RequeueRunningJobs(d *sql.DB) (int64, error) {
+	res, err := d.Exec("UPDATE jobs SET status = ?, updated_at = datetime('now') WHERE status = ?", JobQueued, JobRunning)
+	if err != nil {
+		return 0, fmt.Errorf("requeue running jobs: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// RetryJobNow queues a failed or cancelled job to run right away with its
+// attempts reset. It returns false if there is no such job.
+func RetryJobNow(d *sql.DB, id int64) (bool, error) {
+	res, err := d.Exec(`UPDATE jobs SET status = ?, attempts = 0, run_after = datetime('now'), updated_at = datetime('now')
+		WHERE id = ? AND status IN (?, ?)`, JobQueued, id, JobFailed, JobCancelled)
+	if err != nil {
+		return false, fmt.Errorf("retry job %d: %w", id, err)
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// CancelJob takes a queued job out of the queue. It returns false if there
+// is no such job.
+func CancelJob(d *sql.DB, id int64) (bool, error) {
+	res, err := d.Exec("UPDATE jobs SET status = ?, updated_at = datetime('now') WHERE id = ? AND status = ?",
+		JobCancelled, id, JobQueued)
+	if err != nil {
+		return false, fmt.Errorf("cancel job %d: %w", id, err)
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ActiveJobPayloads returns the payloads of the queued and running jobs of
+// a type.
+func ActiveJobPayloads(d *sql.DB, typ string) ([]string, error) {
+	rows, err := d.Query("SELECT payload FROM jobs WHERE type = ? AND status IN (?, ?)", typ, JobQueued, JobRunning)
+	if err != nil {
+		return nil, fmt.Errorf("list active jobs: %w", err)
+	}
+	defer rows.Close()
+	var payloads []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, fmt.Errorf("list active jobs: %w", err)
+		}
+		payloads = append(payloads, p)
+	}
+	return payloads, rows.Err()
+}
+
+// ListJobs returns the most recent jobs, newest first, optionally only
+// those with a status.
+func ListJobs(d *sql.DB, status string, limit int) ([]Job, error) {
+	rows, err := d.Query(`SELECT `+jobColumns+` FROM jobs WHERE ? = '' OR status = ? ORDER BY id DESC LIMIT ?`,
+		status, status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list jobs: %w", err)
+	}
+	defer rows.Close()
+	var jobs []Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan job: %w", err)
+		}
+		jobs = append(jobs, *j)
+	}
+	return jobs, rows.Err()
+}
+
+// CountJobs returns how many jobs there are in each status.
+func CountJobs(d *sql.DB) (map[string]int, error) {
+	rows, err := d.Query("SELECT status, COUNT(*) FROM jobs GROUP BY status")
+	if err != nil {
+		return nil, fmt.Errorf("count jobs: %w", err)
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, fmt.Errorf("count jobs: %w", err)
+		}
+		counts[status] = n
+	}
+	return counts, rows.Err()
+}
+
+// PruneJobs deletes finished, failed and cancelled jobs last updated more
+// than age ago, and returns how many it deleted.
+func PruneJobs(d *sql.DB, age time.Duration) (int64, error) {
+	res, err := d.Exec("DELETE FROM jobs WHERE status IN (?, ?, ?) AND updated_at < datetime('now', ?)",
+		JobDone, JobFailed, JobCancelled, fmt.Sprintf("-%d seconds", int(age.Seconds())))
+	if err != nil {
+		return 0, fmt.Errorf("prune jobs: %w", err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// MachineCert records a client certificate issued to a system by the
+// internal CA, so it can be revoked.
+type MachineCert struct {
+	Serial    string
+	SystemID  int64
+	NotAfter  string
+	Revoked   bool
+	CreatedAt string
+}
+
+const machineCertColumns = `serial, system_id, not_after, revoked, created_at`
+
+func scanMachineCert(row interface{ Scan(...any) error }) (*MachineCert, error) {
+	var c MachineCert
+	if err := row.Scan(&c.Serial, &c.SystemID, &c.NotAfter, &c.Revoked, &c.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func RecordMachineCert(d *sql.DB, serial string, systemID int64, notAfter time.Time) error {
+	_, err := d.Exec("INSERT INTO machine_certs (serial, system_id, not_after) VALUES (?, ?, ?)",
+		serial, systemID, notAfter.UTC().Format(time.DateTime))
+	if err != nil {
+		return fmt.Errorf("record machine cert: %w", err)
+	}
+	return nil
+}
+
+func GetMachineCert(d *sql.DB, serial string) (*MachineCert, error) {
+	c, err := scanMachineCert(d.QueryRow(`SELECT `+machineCertColumns+` FROM machine_certs WHERE serial = ?`, serial))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get machine cert: %w", err)
+	}
+	return c, nil
+}
+
+// ListMachineCerts returns a system's certificates, newest first.
+func ListMachineCerts(d *sql.DB, systemID int64) ([]MachineCert, error) {
+	rows, err := d.Query(`SELECT `+machineCertColumns+` FROM machine_certs WHERE system_id = ? ORDER BY created_at DESC, rowid DESC`, systemID)
+	if err != nil {
+		return nil, fmt.Errorf("list machine certs: %w", err)
+	}
+	defer rows.Close()
+	var certs []MachineCert
+	for rows.Next() {
+		c, err := scanMachineCert(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan machine cert: %w", err)
+		}
+		certs = append(certs, *c)
+	}
+	return certs, rows.Err()
+}
+
+// RevokeMachineCerts revokes every certificate issued to a system and
+// returns how many were still valid.
+func RevokeMachineCerts(d *sql.DB, systemID int64) (int64, error) {
+	res, err := d.Exec("UPDATE machine_certs SET revoked = 1 WHERE system_id = ? AND revoked = 0 AND not_after > datetime('now')", systemID)
+	if err != nil {
+		return 0, fmt.Errorf("revoke machine certs: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// PruneMachineCerts forgets certificates that expired more than a day ago.
+func PruneMachineCerts(d *sql.DB) error {
+	if _, err := d.Exec("DELETE FROM machine_certs WHERE not_after < datetime('now', '-1 day')"); err != nil {
+		return fmt.Errorf("prune machine certs: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrNoMerge is returned by UndoMerge when the system has no merge that
+// can still be undone.
+var ErrNoMerge = errors.New("no merge to undo")
+
+// mergeSnapshot holds the fields of a kept system that a merge may change.
+type mergeSnapshot struct {
+	Hostname    string `json:"hostname"`
+	ImageID     *int64 `json:"image_id"`
+	ProfileID   *int64 `json:"profile_id"`
+	Vars        string `json:"vars"`
+	Tags        string `json:"tags"`
+	Environment string `json:"environment"`
+}
+
+// MergeSystems folds the duplicate system dupID into keepID, for a machine
+// that was registered twice. The kept system keeps its MAC, state and
+// anything it already has set; a missing hostname, image, profile or
+// environment is taken from the duplicate, vars it lacks are added, tags
+// are combined, and the duplicate's provision attempts move over. The
+// duplicate goes to the trash. It returns the merge's ID.
+func MergeSystems(d *sql.DB, keepID, dupID int64) (int64, error) {
+	if keepID == dupID {
+		return 0, errors.New("cannot merge a system into itself")
+	}
+	tx, err := d.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	keep, err := scanSystem(tx.QueryRow(`SELECT `+systemColumns+` FROM systems WHERE id = ? AND deleted_at IS NULL`, keepID))
+	if err != nil {
+		return 0, fmt.Errorf("system %d not found", keepID)
+	}
+	dup, err := scanSystem(tx.QueryRow(`SELECT `+systemColumns+` FROM systems WHERE id = ? AND deleted_at IS NULL`, dupID))
+	if err != nil {
+		return 0, fmt.Errorf("system %d not found", dupID)
+	}
+
+	snap := snapshotOf(keep)
+	if snap.Vars, err = sealVars(snap.Vars); err != nil {
+		return 0, err
+	}
+	before, err := json.Marshal(snap)
+	if err != nil {
+		return 0, err
+	}
+
+	merged := snapshotOf(keep)
+	if merged.Hostname == "" {
+		merged.Hostname = dup.Hostname
+	}
+	if merged.ImageID == nil {
+		merged.ImageID = dup.ImageID
+	}
+	if merged.ProfileID == nil {
+		merged.ProfileID = dup.ProfileID
+	}
+	if merged.Environment == "" {
+		merged.Environment = dup.Environment
+	}
+	merged.Tags = NormalizeTags(keep.Tags + "," + dup.Tags)
+	merged.Vars = mergeVars(keep.Vars, dup.Vars)
+
+	var attempts []string
+	rows, err := tx.Query(`SELECT id FROM provision_attempts WHERE system_id = ?`, dupID)
+	if err != nil {
+		return 0, fmt.Errorf("list attempts: %w", err)
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		attempts = append(attempts, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`UPDATE provision_attempts SET system_id = ? WHERE system_id = ?`, keepID, dupID); err != nil {
+		return 0, fmt.Errorf("move attempts: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE systems SET deleted_at = datetime('now'), updated_at = datetime('now') WHERE id = ?`, dupID); err != nil {
+		return 0, fmt.Errorf("trash duplicate: %w", err)
+	}
+	if err := restoreSnapshot(tx, keepID, merged); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(`INSERT INTO system_merges (system_id, merged_id, before, attempts) VALUES (?, ?, ?, ?)`,
+		keepID, dupID, string(before), strings.Join(attempts, ","))
+	if err != nil {
+		return 0, fmt.Errorf("record merge: %w", err)
+	}
+	id, _ := result.LastInsertId()
+	return id, tx.Commit()
+}
+
+func snapshotOf(sys *System) mergeSnapshot {
+	return mergeSnapshot{
+		Hostname: sys.Hostname, ImageID: sys.ImageID, ProfileID: sys.ProfileID,
+		Vars: sys.Vars, Tags: sys.Tags, Environment: sys.Environment,
+	}
+}
+
+// mergeVars adds the keys of dup's vars that keep lacks. If either isn't a
+// JSON object, keep's vars are left as they are.
+func mergeVars(keep, dup string) string {
+	var k, du map[string]any
+	if json.Unmarshal([]byte(keep), &k) != nil || json.Unmarshal([]byte(dup), &du) != nil {
+		return keep
+	}
+	if k == nil {
+		k = map[string]any{}
+	}
+	for key, v := range du {
+		if _, ok := k[key]; !ok {
+			k[key] = v
+		}
+	}
+	b, err := json.Marshal(k)
+	if err != nil {
+		return keep
+	}
+	return string(b)
+}
+
+// restoreSnapshot sets a system's mergeable fields.
+func restoreSnapshot(tx *sql.Tx, id int64, s mergeSnapshot) error {
+	vars, err := sealVars(s.Vars)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE systems SET hostname = ?, image_id = ?, profile_id = ?, vars = ?, tags = ?, environment = ?,
+		updated_at = datetime('now') WHERE id = ?`,
+		s.Hostname, s.ImageID, s.ProfileID, vars, s.Tags, s.Environment, id)
+	if err != nil {
+		return fmt.Errorf("update merged system: %w", err)
+	}
+	return nil
+}
+
+// UndoMerge reverses the latest merge into keepID if it happened within
+// window: the kept system's fields are put back as they were, the moved
+// provision attempts return, and the duplicate is restored from the trash.
+// It returns the restored duplicate's ID, or ErrNoMerge if there is no
+// such merge or the duplicate has since been purged or restored.
+func UndoMerge(d *sql.DB, keepID int64, window time.Duration) (int64, error) {
+	tx, err := d.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id, dupID int64
+	var before, attempts string
+	err = tx.QueryRow(`SELECT id, merged_id, before, attempts FROM system_merges
+		WHERE system_id = ? AND undone_at IS NULL AND created_at >= datetime('now', ?)
+		ORDER BY id DESC LIMIT 1`, keepID, fmt.Sprintf("-%d seconds", int(window.Seconds()))).
+		Scan(&id, &dupID, &before, &attempts)
+	if err == sql.ErrNoRows {
+		return 0, ErrNoMerge
+	}
+	if err != nil {
+		return 0, fmt.Errorf("find merge: %w", err)
+	}
+	var snap mergeSnapshot
+	if err := json.Unmarshal([]byte(before), &snap); err != nil {
+		return 0, fmt.Errorf("read merge: %w", err)
+	}
+
+	result, err := tx.Exec(`UPDATE systems SET deleted_at = NULL, updated_at = datetime('now') WHERE id = ? AND deleted_at IS NOT NULL`, dupID)
+	if err != nil {
+		return 0, fmt.Errorf("restore duplicate: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, ErrNoMerge
+	}
+	if err := restoreSnapshot(tx, keepID, snap); err != nil {
+		return 0, err
+	}
+	for _, attempt := range strings.Split(attempts, ",") {
+		if attempt == "" {
+			continue
+		}
+		if _, err := tx.Exec(`UPDATE provision_attempts SET system_id = ? WHERE id = ? AND system_id = ?`, dupID, attempt, keepID); err != nil {
+			return 0, fmt.Errorf("move attempts back: %w", err)
+		}
+	}
+	if _, err := tx.Exec(`UPDATE system_merges SET undone_at = datetime('now') WHERE id = ?`, id); err != nil {
+		return 0, fmt.Errorf("record undo: %w", err)
+	}
+	return dupID, tx.Commit()
+}
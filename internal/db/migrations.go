@@ -5,103 +5,743 @@ import (
 	"fmt"
 )
 
-var migrations = []string{
-	`CREATE TABLE IF NOT EXISTS images (
-		id          INTEGER PRIMARY KEY AUTOINCREMENT,
-		name        TEXT NOT NULL,
-		description TEXT NOT NULL DEFAULT '',
-		kernel_file TEXT NOT NULL,
-		initrd_file TEXT NOT NULL,
-		cmdline     TEXT NOT NULL DEFAULT '',
-		created_at  DATETIME NOT NULL DEFAULT (datetime('now')),
-		updated_at  DATETIME NOT NULL DEFAULT (datetime('now'))
-	);
-
-	CREATE TABLE IF NOT EXISTS systems (
-		id         INTEGER PRIMARY KEY AUTOINCREMENT,
-		mac        TEXT NOT NULL UNIQUE,
-		hostname   TEXT NOT NULL DEFAULT '',
-		reimage    INTEGER NOT NULL DEFAULT 0,
-		image_id   INTEGER REFERENCES images(id) ON DELETE SET NULL,
-		created_at DATETIME NOT NULL DEFAULT (datetime('now')),
-		updated_at DATETIME NOT NULL DEFAULT (datetime('now'))
-	);`,
-
-	`ALTER TABLE systems ADD COLUMN ip_addr TEXT NOT NULL DEFAULT '';
-	 ALTER TABLE systems ADD COLUMN last_seen_at DATETIME;`,
-
-	`ALTER TABLE images ADD COLUMN boot_type TEXT NOT NULL DEFAULT 'linux';
-	 ALTER TABLE images ADD COLUMN ipxe_script TEXT NOT NULL DEFAULT '';`,
-
-	`ALTER TABLE images ADD COLUMN status TEXT NOT NULL DEFAULT 'ready';
-	 ALTER TABLE images ADD COLUMN status_detail TEXT NOT NULL DEFAULT '';
-	 ALTER TABLE images ADD COLUMN catalog_id TEXT NOT NULL DEFAULT '';`,
-
-	`CREATE TABLE IF NOT EXISTS profiles (
-		id              INTEGER PRIMARY KEY AUTOINCREMENT,
-		name            TEXT NOT NULL,
-		description     TEXT NOT NULL DEFAULT '',
-		os_family       TEXT NOT NULL DEFAULT 'custom',
-		config_template TEXT NOT NULL DEFAULT '',
-		kernel_params   TEXT NOT NULL DEFAULT '',
-		default_vars    TEXT NOT NULL DEFAULT '{}',
-		created_at      DATETIME NOT NULL DEFAULT (datetime('now')),
-		updated_at      DATETIME NOT NULL DEFAULT (datetime('now'))
-	);
-
-	ALTER TABLE systems ADD COLUMN profile_id INTEGER REFERENCES profiles(id) ON DELETE SET NULL;
-	ALTER TABLE systems ADD COLUMN vars TEXT NOT NULL DEFAULT '{}';`,
-
-	`ALTER TABLE profiles ADD COLUMN overlay_file TEXT NOT NULL DEFAULT '';`,
-
-	`ALTER TABLE images ADD COLUMN catalog_hash TEXT NOT NULL DEFAULT '';`,
-
-	`ALTER TABLE systems ADD COLUMN confirm_reimage INTEGER NOT NULL DEFAULT 1;`,
-
-	`CREATE TABLE IF NOT EXISTS settings (
-		key   TEXT PRIMARY KEY,
-		value TEXT NOT NULL
-	);
-	INSERT OR IGNORE INTO settings (key, value) VALUES ('confirm_reimage', '1');
-	ALTER TABLE systems ADD COLUMN confirm_override INTEGER;`,
-
-	`ALTER TABLE profiles ADD COLUMN var_schema TEXT NOT NULL DEFAULT '';
-	 ALTER TABLE profiles ADD COLUMN catalog_id TEXT NOT NULL DEFAULT '';`,
-
-	`ALTER TABLE systems ADD COLUMN state TEXT NOT NULL DEFAULT 'discovered';
-	 ALTER TABLE systems ADD COLUMN state_changed_at DATETIME;
-
-	 UPDATE systems SET state = 'ready' WHERE reimage = 0 AND hostname != '';
-	 UPDATE systems SET state = 'queued' WHERE reimage = 1;
-	 UPDATE systems SET state = 'discovered' WHERE hostname = '';
-	 UPDATE systems SET state_changed_at = updated_at;
-
-	 CREATE TABLE IF NOT EXISTS webhooks (
-		id         INTEGER PRIMARY KEY AUTOINCREMENT,
-		url        TEXT NOT NULL,
-		secret     TEXT NOT NULL DEFAULT '',
-		events     TEXT NOT NULL DEFAULT '*',
-		enabled    INTEGER NOT NULL DEFAULT 1,
-		created_at DATETIME NOT NULL DEFAULT (datetime('now')),
-		updated_at DATETIME NOT NULL DEFAULT (datetime('now'))
-	 );`,
-
-	`ALTER TABLE images ADD COLUMN icon TEXT NOT NULL DEFAULT '';
-	 ALTER TABLE images ADD COLUMN icon_color TEXT NOT NULL DEFAULT '';`,
+// migration is a single schema change. down must undo up exactly so that
+// MigrateDown can walk a database back to an earlier version.
+type migration struct {
+	name string
+	up   string
+	down string
 }
 
-func Migrate(db *sql.DB) error {
+var migrations = []migration{
+	{
+		name: "create images and systems",
+		up: `CREATE TABLE IF NOT EXISTS images (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			name        TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			kernel_file TEXT NOT NULL,
+			initrd_file TEXT NOT NULL,
+			cmdline     TEXT NOT NULL DEFAULT '',
+			created_at  DATETIME NOT NULL DEFAULT (datetime('now')),
+			updated_at  DATETIME NOT NULL DEFAULT (datetime('now'))
+		);
+
+		CREATE TABLE IF NOT EXISTS systems (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			mac        TEXT NOT NULL UNIQUE,
+			hostname   TEXT NOT NULL DEFAULT '',
+			reimage    INTEGER NOT NULL DEFAULT 0,
+			image_id   INTEGER REFERENCES images(id) ON DELETE SET NULL,
+			created_at DATETIME NOT NULL DEFAULT (datetime('now')),
+			updated_at DATETIME NOT NULL DEFAULT (datetime('now'))
+		);`,
+		down: `DROP TABLE systems;
+		DROP TABLE images;`,
+	},
+	{
+		name: "add system ip_addr and last_seen_at",
+		up: `ALTER TABLE systems ADD COLUMN ip_addr TEXT NOT NULL DEFAULT '';
+		 ALTER TABLE systems ADD COLUMN last_seen_at DATETIME;`,
+		down: `ALTER TABLE systems DROP COLUMN last_seen_at;
+		ALTER TABLE systems DROP COLUMN ip_addr;`,
+	},
+	{
+		name: "add image boot_type and ipxe_script",
+		up: `ALTER TABLE images ADD COLUMN boot_type TEXT NOT NULL DEFAULT 'linux';
+		 ALTER TABLE images ADD COLUMN ipxe_script TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE images DROP COLUMN ipxe_script;
+		ALTER TABLE images DROP COLUMN boot_type;`,
+	},
+	{
+		name: "add image status and catalog_id",
+		up: `ALTER TABLE images ADD COLUMN status TEXT NOT NULL DEFAULT 'ready';
+		 ALTER TABLE images ADD COLUMN status_detail TEXT NOT NULL DEFAULT '';
+		 ALTER TABLE images ADD COLUMN catalog_id TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE images DROP COLUMN catalog_id;
+		ALTER TABLE images DROP COLUMN status_detail;
+		ALTER TABLE images DROP COLUMN status;`,
+	},
+	{
+		name: "create profiles",
+		up: `CREATE TABLE IF NOT EXISTS profiles (
+			id              INTEGER PRIMARY KEY AUTOINCREMENT,
+			name            TEXT NOT NULL,
+			description     TEXT NOT NULL DEFAULT '',
+			os_family       TEXT NOT NULL DEFAULT 'custom',
+			config_template TEXT NOT NULL DEFAULT '',
+			kernel_params   TEXT NOT NULL DEFAULT '',
+			default_vars    TEXT NOT NULL DEFAULT '{}',
+			created_at      DATETIME NOT NULL DEFAULT (datetime('now')),
+			updated_at      DATETIME NOT NULL DEFAULT (datetime('now'))
+		);
+
+		ALTER TABLE systems ADD COLUMN profile_id INTEGER REFERENCES profiles(id) ON DELETE SET NULL;
+		ALTER TABLE systems ADD COLUMN vars TEXT NOT NULL DEFAULT '{}';`,
+		down: `-- profile_id carries a foreign key, which SQLite can't drop in place
+		CREATE TABLE systems_old (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			mac          TEXT NOT NULL UNIQUE,
+			hostname     TEXT NOT NULL DEFAULT '',
+			reimage      INTEGER NOT NULL DEFAULT 0,
+			image_id     INTEGER REFERENCES images(id) ON DELETE SET NULL,
+			created_at   DATETIME NOT NULL DEFAULT (datetime('now')),
+			updated_at   DATETIME NOT NULL DEFAULT (datetime('now')),
+			ip_addr      TEXT NOT NULL DEFAULT '',
+			last_seen_at DATETIME
+		);
+		INSERT INTO systems_old (id, mac, hostname, reimage, image_id, created_at, updated_at, ip_addr, last_seen_at)
+			SELECT id, mac, hostname, reimage, image_id, created_at, updated_at, ip_addr, last_seen_at FROM systems;
+		DROP TABLE systems;
+		ALTER TABLE systems_old RENAME TO systems;
+		DROP TABLE profiles;`,
+	},
+	{
+		name: "add profile overlay_file",
+		up:   `ALTER TABLE profiles ADD COLUMN overlay_file TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE profiles DROP COLUMN overlay_file;`,
+	},
+	{
+		name: "add image catalog_hash",
+		up:   `ALTER TABLE images ADD COLUMN catalog_hash TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE images DROP COLUMN catalog_hash;`,
+	},
+	{
+		name: "add system confirm_reimage",
+		up:   `ALTER TABLE systems ADD COLUMN confirm_reimage INTEGER NOT NULL DEFAULT 1;`,
+		down: `ALTER TABLE systems DROP COLUMN confirm_reimage;`,
+	},
+	{
+		name: "create settings",
+		up: `CREATE TABLE IF NOT EXISTS settings (
+			key   TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		);
+		INSERT OR IGNORE INTO settings (key, value) VALUES ('confirm_reimage', '1');
+		ALTER TABLE systems ADD COLUMN confirm_override INTEGER;`,
+		down: `ALTER TABLE systems DROP COLUMN confirm_override;
+		DROP TABLE settings;`,
+	},
+	{
+		name: "add profile var_schema and catalog_id",
+		up: `ALTER TABLE profiles ADD COLUMN var_schema TEXT NOT NULL DEFAULT '';
+		 ALTER TABLE profiles ADD COLUMN catalog_id TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE profiles DROP COLUMN catalog_id;
+		ALTER TABLE profiles DROP COLUMN var_schema;`,
+	},
+	{
+		name: "add system state and webhooks",
+		up: `ALTER TABLE systems ADD COLUMN state TEXT NOT NULL DEFAULT 'discovered';
+		 ALTER TABLE systems ADD COLUMN state_changed_at DATETIME;
+
+		 UPDATE systems SET state = 'ready' WHERE reimage = 0 AND hostname != '';
+		 UPDATE systems SET state = 'queued' WHERE reimage = 1;
+		 UPDATE systems SET state = 'discovered' WHERE hostname = '';
+		 UPDATE systems SET state_changed_at = updated_at;
+
+		 CREATE TABLE IF NOT EXISTS webhooks (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			url        TEXT NOT NULL,
+			secret     TEXT NOT NULL DEFAULT '',
+			events     TEXT NOT NULL DEFAULT '*',
+			enabled    INTEGER NOT NULL DEFAULT 1,
+			created_at DATETIME NOT NULL DEFAULT (datetime('now')),
+			updated_at DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );`,
+		down: `UPDATE systems SET reimage = CASE WHEN state = 'queued' THEN 1 ELSE 0 END;
+		DROP TABLE webhooks;
+		ALTER TABLE systems DROP COLUMN state_changed_at;
+		ALTER TABLE systems DROP COLUMN state;`,
+	},
+	{
+		name: "add image icon",
+		up: `ALTER TABLE images ADD COLUMN icon TEXT NOT NULL DEFAULT '';
+		 ALTER TABLE images ADD COLUMN icon_color TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE images DROP COLUMN icon_color;
+		ALTER TABLE images DROP COLUMN icon;`,
+	},
+	{
+		name: "add soft delete",
+		up: `ALTER TABLE systems ADD COLUMN deleted_at DATETIME;
+		 ALTER TABLE images ADD COLUMN deleted_at DATETIME;
+		 ALTER TABLE profiles ADD COLUMN deleted_at DATETIME;`,
+		down: `DELETE FROM systems WHERE deleted_at IS NOT NULL;
+		DELETE FROM images WHERE deleted_at IS NOT NULL;
+		DELETE FROM profiles WHERE deleted_at IS NOT NULL;
+		ALTER TABLE profiles DROP COLUMN deleted_at;
+		ALTER TABLE images DROP COLUMN deleted_at;
+		ALTER TABLE systems DROP COLUMN deleted_at;`,
+	},
+	{
+		name: "add system token generation",
+		up:   `ALTER TABLE systems ADD COLUMN token_gen INTEGER NOT NULL DEFAULT 0;`,
+		down: `ALTER TABLE systems DROP COLUMN token_gen;`,
+	},
+	{
+		name: "add provision attempts",
+		up: `ALTER TABLE systems ADD COLUMN attempt_id TEXT NOT NULL DEFAULT '';
+		 CREATE TABLE provision_attempts (
+			id TEXT PRIMARY KEY,
+			system_id INTEGER NOT NULL REFERENCES systems(id) ON DELETE CASCADE,
+			state TEXT NOT NULL,
+			started_at DATETIME NOT NULL DEFAULT (datetime('now')),
+			finished_at DATETIME
+		 );
+		 CREATE INDEX idx_provision_attempts_system ON provision_attempts(system_id);`,
+		down: `DROP TABLE provision_attempts;
+		ALTER TABLE systems DROP COLUMN attempt_id;`,
+	},
+	{
+		name: "add failure details",
+		up: `ALTER TABLE systems ADD COLUMN fail_phase TEXT NOT NULL DEFAULT '';
+		 ALTER TABLE systems ADD COLUMN fail_message TEXT NOT NULL DEFAULT '';
+		 ALTER TABLE provision_attempts ADD COLUMN phase TEXT NOT NULL DEFAULT '';
+		 ALTER TABLE provision_attempts ADD COLUMN message TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE provision_attempts DROP COLUMN message;
+		ALTER TABLE provision_attempts DROP COLUMN phase;
+		ALTER TABLE systems DROP COLUMN fail_message;
+		ALTER TABLE systems DROP COLUMN fail_phase;`,
+	},
+	{
+		name: "add image file map",
+		up:   `ALTER TABLE images ADD COLUMN file_map TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE images DROP COLUMN file_map;`,
+	},
+	{
+		name: "add image boot target",
+		up:   `ALTER TABLE images ADD COLUMN boot_target TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE images DROP COLUMN boot_target;`,
+	},
+	{
+		name: "add utility images and one-shot boots",
+		up: `ALTER TABLE images ADD COLUMN utility INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE systems ADD COLUMN oneshot_image_id INTEGER;
+		ALTER TABLE systems ADD COLUMN oneshot_served_at DATETIME;`,
+		down: `ALTER TABLE systems DROP COLUMN oneshot_served_at;
+		ALTER TABLE systems DROP COLUMN oneshot_image_id;
+		ALTER TABLE images DROP COLUMN utility;`,
+	},
+	{
+		name: "add system ipxe client info",
+		up: `ALTER TABLE systems ADD COLUMN ipxe_platform TEXT NOT NULL DEFAULT '';
+		ALTER TABLE systems ADD COLUMN ipxe_buildarch TEXT NOT NULL DEFAULT '';
+		ALTER TABLE systems ADD COLUMN ipxe_version TEXT NOT NULL DEFAULT '';
+		ALTER TABLE systems ADD COLUMN ipxe_features TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE systems DROP COLUMN ipxe_features;
+		ALTER TABLE systems DROP COLUMN ipxe_version;
+		ALTER TABLE systems DROP COLUMN ipxe_buildarch;
+		ALTER TABLE systems DROP COLUMN ipxe_platform;`,
+	},
+	{
+		name: "add vm links",
+		up: `CREATE TABLE vm_links (
+			system_id INTEGER PRIMARY KEY REFERENCES systems(id) ON DELETE CASCADE,
+			provider  TEXT NOT NULL,
+			vm_id     TEXT NOT NULL,
+			vm_name   TEXT NOT NULL DEFAULT '',
+			synced_at DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );`,
+		down: `DROP TABLE vm_links;`,
+	},
+	{
+		name: "add system tags and netbox links",
+		up: `ALTER TABLE systems ADD COLUMN tags TEXT NOT NULL DEFAULT '';
+		 CREATE TABLE netbox_links (
+			system_id   INTEGER PRIMARY KEY REFERENCES systems(id) ON DELETE CASCADE,
+			device_id   INTEGER NOT NULL,
+			device_name TEXT NOT NULL DEFAULT '',
+			synced_at   DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );`,
+		down: `DROP TABLE netbox_links;
+		ALTER TABLE systems DROP COLUMN tags;`,
+	},
+	{
+		name: "add image builders",
+		up: `ALTER TABLE images ADD COLUMN builder_url TEXT NOT NULL DEFAULT '';
+		ALTER TABLE images ADD COLUMN builder_secret TEXT NOT NULL DEFAULT '';
+		ALTER TABLE images ADD COLUMN build_id TEXT NOT NULL DEFAULT '';
+		ALTER TABLE images ADD COLUMN build_token_hash TEXT NOT NULL DEFAULT '';
+		ALTER TABLE images ADD COLUMN build_status TEXT NOT NULL DEFAULT '';
+		ALTER TABLE images ADD COLUMN build_detail TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE images DROP COLUMN build_detail;
+		ALTER TABLE images DROP COLUMN build_status;
+		ALTER TABLE images DROP COLUMN build_token_hash;
+		ALTER TABLE images DROP COLUMN build_id;
+		ALTER TABLE images DROP COLUMN builder_secret;
+		ALTER TABLE images DROP COLUMN builder_url;`,
+	},
+	{
+		name: "add image file sums",
+		up: `CREATE TABLE image_file_sums (
+			image_id    INTEGER NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+			name        TEXT NOT NULL,
+			sha256      TEXT NOT NULL,
+			source      TEXT NOT NULL DEFAULT '',
+			recorded_at DATETIME NOT NULL DEFAULT (datetime('now')),
+			PRIMARY KEY (image_id, name)
+		 );`,
+		down: `DROP TABLE image_file_sums;`,
+	},
+	{
+		name: "add policy rules",
+		up: `CREATE TABLE policy_rules (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			name       TEXT NOT NULL,
+			expr       TEXT NOT NULL,
+			action     TEXT NOT NULL,
+			image_id   INTEGER REFERENCES images(id) ON DELETE SET NULL,
+			profile_id INTEGER REFERENCES profiles(id) ON DELETE SET NULL,
+			position   INTEGER NOT NULL DEFAULT 0,
+			enabled    INTEGER NOT NULL DEFAULT 1,
+			created_at DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );`,
+		down: `DROP TABLE policy_rules;`,
+	},
+	{
+		name: "add machine certs",
+		up: `CREATE TABLE machine_certs (
+			serial     TEXT PRIMARY KEY,
+			system_id  INTEGER NOT NULL REFERENCES systems(id) ON DELETE CASCADE,
+			not_after  DATETIME NOT NULL,
+			revoked    INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );
+		 CREATE INDEX idx_machine_certs_system ON machine_certs(system_id);`,
+		down: `DROP TABLE machine_certs;`,
+	},
+	{
+		name: "add agents",
+		up: `CREATE TABLE agents (
+			system_id  INTEGER PRIMARY KEY REFERENCES systems(id) ON DELETE CASCADE,
+			version    TEXT NOT NULL DEFAULT '',
+			hostname   TEXT NOT NULL DEFAULT '',
+			remote_ip  TEXT NOT NULL DEFAULT '',
+			uptime_sec INTEGER NOT NULL DEFAULT 0,
+			inventory  TEXT NOT NULL DEFAULT '{}',
+			health     TEXT NOT NULL DEFAULT '{}',
+			first_seen DATETIME NOT NULL DEFAULT (datetime('now')),
+			last_seen  DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );
+		 CREATE TABLE agent_commands (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			system_id  INTEGER NOT NULL REFERENCES systems(id) ON DELETE CASCADE,
+			type       TEXT NOT NULL,
+			status     TEXT NOT NULL DEFAULT 'pending',
+			message    TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL DEFAULT (datetime('now')),
+			updated_at DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );
+		 CREATE INDEX idx_agent_commands_system ON agent_commands(system_id, status);`,
+		down: `DROP TABLE agent_commands;
+		 DROP TABLE agents;`,
+	},
+	{
+		name: "add system heartbeats",
+		up: `ALTER TABLE systems ADD COLUMN heartbeat_at DATETIME;
+		 ALTER TABLE systems ADD COLUMN booted_image_id INTEGER;`,
+		down: `ALTER TABLE systems DROP COLUMN booted_image_id;
+		ALTER TABLE systems DROP COLUMN heartbeat_at;`,
+	},
+	{
+		name: "add environments",
+		up: `CREATE TABLE environments (
+			name        TEXT PRIMARY KEY,
+			description TEXT NOT NULL DEFAULT '',
+			created_at  DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );
+		 ALTER TABLE images ADD COLUMN environment TEXT NOT NULL DEFAULT '';
+		 ALTER TABLE profiles ADD COLUMN environment TEXT NOT NULL DEFAULT '';
+		 ALTER TABLE systems ADD COLUMN environment TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE systems DROP COLUMN environment;
+		ALTER TABLE profiles DROP COLUMN environment;
+		ALTER TABLE images DROP COLUMN environment;
+		DROP TABLE environments;`,
+	},
+	{
+		name: "add tenants",
+		up: `CREATE TABLE tenants (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			name        TEXT NOT NULL UNIQUE,
+			description TEXT NOT NULL DEFAULT '',
+			subnets     TEXT NOT NULL DEFAULT '',
+			created_at  DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );
+		 CREATE TABLE tenant_users (
+			id            INTEGER PRIMARY KEY AUTOINCREMENT,
+			tenant_id     INTEGER NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+			username      TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL,
+			created_at    DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );
+		 CREATE TABLE api_tokens (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			tenant_id    INTEGER NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+			name         TEXT NOT NULL,
+			token_hash   TEXT NOT NULL UNIQUE,
+			last_used_at DATETIME,
+			created_at   DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );
+		 ALTER TABLE images ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 0;
+		 ALTER TABLE profiles ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 0;
+		 ALTER TABLE systems ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 0;`,
+		down: `ALTER TABLE systems DROP COLUMN tenant_id;
+		ALTER TABLE profiles DROP COLUMN tenant_id;
+		ALTER TABLE images DROP COLUMN tenant_id;
+		DROP TABLE api_tokens;
+		DROP TABLE tenant_users;
+		DROP TABLE tenants;`,
+	},
+	{
+		name: "add tenant user theme",
+		up:   `ALTER TABLE tenant_users ADD COLUMN theme TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE tenant_users DROP COLUMN theme;`,
+	},
+	{
+		name: "add attempt image and profile",
+		up: `ALTER TABLE provision_attempts ADD COLUMN image_id INTEGER;
+		 ALTER TABLE provision_attempts ADD COLUMN profile_id INTEGER;
+		 CREATE INDEX idx_provision_attempts_started ON provision_attempts(started_at);`,
+		down: `DROP INDEX idx_provision_attempts_started;
+		ALTER TABLE provision_attempts DROP COLUMN profile_id;
+		ALTER TABLE provision_attempts DROP COLUMN image_id;`,
+	},
+	{
+		name: "add attempt provisioning time",
+		up:   `ALTER TABLE provision_attempts ADD COLUMN provisioning_at DATETIME;`,
+		down: `ALTER TABLE provision_attempts DROP COLUMN provisioning_at;`,
+	},
+	{
+		name: "add cache nodes",
+		up: `CREATE TABLE cache_nodes (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			name         TEXT NOT NULL UNIQUE,
+			url          TEXT NOT NULL,
+			subnets      TEXT NOT NULL DEFAULT '',
+			last_seen_at DATETIME,
+			created_at   DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );`,
+		down: `DROP TABLE cache_nodes;`,
+	},
+	{
+		name: "add image catalog_orphaned",
+		up:   `ALTER TABLE images ADD COLUMN catalog_orphaned INTEGER NOT NULL DEFAULT 0;`,
+		down: `ALTER TABLE images DROP COLUMN catalog_orphaned;`,
+	},
+	{
+		name: "add image catalog policy",
+		up: `ALTER TABLE images ADD COLUMN catalog_policy TEXT NOT NULL DEFAULT '';
+		 ALTER TABLE images ADD COLUMN catalog_latest_hash TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE images DROP COLUMN catalog_latest_hash;
+		ALTER TABLE images DROP COLUMN catalog_policy;`,
+	},
+	{
+		name: "add system merges",
+		up: `CREATE TABLE system_merges (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			system_id  INTEGER NOT NULL REFERENCES systems(id) ON DELETE CASCADE,
+			merged_id  INTEGER NOT NULL REFERENCES systems(id) ON DELETE CASCADE,
+			before     TEXT NOT NULL,
+			attempts   TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL DEFAULT (datetime('now')),
+			undone_at  DATETIME
+		 );
+		 CREATE INDEX idx_system_merges_system ON system_merges(system_id);`,
+		down: `DROP TABLE system_merges;`,
+	},
+	{
+		name: "add transitions",
+		up: `CREATE TABLE transitions (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			from_state TEXT NOT NULL DEFAULT '',
+			to_state   TEXT NOT NULL,
+			action     TEXT NOT NULL,
+			param      TEXT NOT NULL DEFAULT '',
+			enabled    INTEGER NOT NULL DEFAULT 1,
+			created_at DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );
+		 CREATE TABLE system_timers (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			system_id  INTEGER NOT NULL REFERENCES systems(id) ON DELETE CASCADE,
+			state      TEXT NOT NULL,
+			to_state   TEXT NOT NULL,
+			fire_at    DATETIME NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );
+		 CREATE INDEX idx_system_timers_fire ON system_timers(fire_at);`,
+		down: `DROP TABLE system_timers;
+		DROP TABLE transitions;`,
+	},
+	{
+		name: "add drivers",
+		up: `CREATE TABLE drivers (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			name         TEXT NOT NULL,
+			os_family    TEXT NOT NULL DEFAULT '',
+			hardware_ids TEXT NOT NULL DEFAULT '',
+			file_name    TEXT NOT NULL,
+			size         INTEGER NOT NULL DEFAULT 0,
+			sha256       TEXT NOT NULL DEFAULT '',
+			created_at   DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );
+		 CREATE TABLE profile_drivers (
+			profile_id INTEGER NOT NULL REFERENCES profiles(id) ON DELETE CASCADE,
+			driver_id  INTEGER NOT NULL REFERENCES drivers(id) ON DELETE CASCADE,
+			PRIMARY KEY (profile_id, driver_id)
+		 );`,
+		down: `DROP TABLE profile_drivers;
+		DROP TABLE drivers;`,
+	},
+	{
+		name: "add wipe certificates",
+		up: `CREATE TABLE wipe_certificates (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			system_id   INTEGER NOT NULL,
+			mac         TEXT NOT NULL,
+			hostname    TEXT NOT NULL DEFAULT '',
+			status      TEXT NOT NULL,
+			report      TEXT NOT NULL,
+			started_at  DATETIME,
+			finished_at DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );
+		 CREATE INDEX idx_wipe_certificates_system ON wipe_certificates(system_id);`,
+		down: `DROP TABLE wipe_certificates;`,
+	},
+	{
+		name: "add profile storage_layout",
+		up:   `ALTER TABLE profiles ADD COLUMN storage_layout TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE profiles DROP COLUMN storage_layout;`,
+	},
+	{
+		name: "add jobs",
+		up: `CREATE TABLE jobs (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			type         TEXT NOT NULL,
+			payload      TEXT NOT NULL DEFAULT '',
+			status       TEXT NOT NULL DEFAULT 'queued',
+			attempts     INTEGER NOT NULL DEFAULT 0,
+			max_attempts INTEGER NOT NULL DEFAULT 5,
+			last_error   TEXT NOT NULL DEFAULT '',
+			run_after    DATETIME NOT NULL DEFAULT (datetime('now')),
+			created_at   DATETIME NOT NULL DEFAULT (datetime('now')),
+			updated_at   DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );
+		 CREATE INDEX idx_jobs_status ON jobs(status, run_after);`,
+		down: `DROP TABLE jobs;`,
+	},
+	{
+		name: "add download progress",
+		up: `CREATE TABLE download_progress (
+			image_id    INTEGER NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+			name        TEXT NOT NULL,
+			url         TEXT NOT NULL,
+			validator   TEXT NOT NULL DEFAULT '',
+			bytes_done  INTEGER NOT NULL DEFAULT 0,
+			bytes_total INTEGER NOT NULL DEFAULT 0,
+			done        INTEGER NOT NULL DEFAULT 0,
+			updated_at  DATETIME NOT NULL DEFAULT (datetime('now')),
+			PRIMARY KEY (image_id, name)
+		 );`,
+		down: `DROP TABLE download_progress;`,
+	},
+	{
+		name: "add subnets",
+		up: `CREATE TABLE subnets (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			cidr        TEXT NOT NULL UNIQUE,
+			name        TEXT NOT NULL DEFAULT '',
+			description TEXT NOT NULL DEFAULT '',
+			purpose     TEXT NOT NULL DEFAULT '',
+			vlan        INTEGER NOT NULL DEFAULT 0,
+			dhcp        TEXT NOT NULL DEFAULT '',
+			relay       TEXT NOT NULL DEFAULT '',
+			boot        TEXT NOT NULL DEFAULT 'allow',
+			image_id    INTEGER REFERENCES images(id) ON DELETE SET NULL,
+			profile_id  INTEGER REFERENCES profiles(id) ON DELETE SET NULL,
+			created_at  DATETIME NOT NULL DEFAULT (datetime('now')),
+			updated_at  DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );`,
+		down: `DROP TABLE subnets;`,
+	},
+	{
+		name: "add system ip history",
+		up: `CREATE TABLE system_ips (
+			system_id     INTEGER NOT NULL REFERENCES systems(id) ON DELETE CASCADE,
+			ip_addr       TEXT NOT NULL,
+			source        TEXT NOT NULL DEFAULT 'boot',
+			first_seen_at DATETIME NOT NULL DEFAULT (datetime('now')),
+			last_seen_at  DATETIME NOT NULL DEFAULT (datetime('now')),
+			PRIMARY KEY (system_id, ip_addr)
+		 );
+		 INSERT INTO system_ips (system_id, ip_addr, first_seen_at, last_seen_at)
+			SELECT id, ip_addr, COALESCE(last_seen_at, created_at), COALESCE(last_seen_at, created_at)
+			FROM systems WHERE ip_addr != '';
+		 ALTER TABLE systems ADD COLUMN prev_ip_addr TEXT NOT NULL DEFAULT '';
+		 ALTER TABLE systems ADD COLUMN ip_changed_at DATETIME;`,
+		down: `ALTER TABLE systems DROP COLUMN ip_changed_at;
+		 ALTER TABLE systems DROP COLUMN prev_ip_addr;
+		 DROP TABLE system_ips;`,
+	},
+	{
+		name: "add webhook filter",
+		up:   `ALTER TABLE webhooks ADD COLUMN filter TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE webhooks DROP COLUMN filter;`,
+	},
+	{
+		name: "add webhook batching",
+		up: `ALTER TABLE webhooks ADD COLUMN mode TEXT NOT NULL DEFAULT 'immediate';
+		 ALTER TABLE webhooks ADD COLUMN batch_interval INTEGER NOT NULL DEFAULT 0;
+		 CREATE TABLE webhook_pending (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+			event      TEXT NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );
+		 CREATE INDEX idx_webhook_pending ON webhook_pending(webhook_id, id);`,
+		down: `DROP TABLE webhook_pending;
+		 ALTER TABLE webhooks DROP COLUMN batch_interval;
+		 ALTER TABLE webhooks DROP COLUMN mode;`,
+	},
+	{
+		name: "add triggers",
+		up: `CREATE TABLE triggers (
+			id            INTEGER PRIMARY KEY AUTOINCREMENT,
+			name          TEXT NOT NULL UNIQUE,
+			action        TEXT NOT NULL,
+			param         TEXT NOT NULL DEFAULT '',
+			token_hash    TEXT NOT NULL UNIQUE,
+			enabled       INTEGER NOT NULL DEFAULT 1,
+			last_fired_at DATETIME,
+			created_at    DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );`,
+		down: `DROP TABLE triggers;`,
+	},
+	{
+		name: "add schedules",
+		up: `CREATE TABLE schedules (
+			name        TEXT PRIMARY KEY,
+			cron        TEXT NOT NULL,
+			jitter      INTEGER NOT NULL DEFAULT 0,
+			enabled     INTEGER NOT NULL DEFAULT 1,
+			next_run_at DATETIME,
+			last_run_at DATETIME,
+			last_status TEXT NOT NULL DEFAULT '',
+			last_error  TEXT NOT NULL DEFAULT '',
+			last_millis INTEGER NOT NULL DEFAULT 0
+		 );`,
+		down: `DROP TABLE schedules;`,
+	},
+	{
+		name: "add system transfers",
+		up: `CREATE TABLE system_transfers (
+			id         INTEGER PRIMARY KEY,
+			system_id  INTEGER NOT NULL REFERENCES systems(id) ON DELETE CASCADE,
+			file       TEXT NOT NULL,
+			client_ip  TEXT NOT NULL DEFAULT '',
+			bytes      INTEGER NOT NULL DEFAULT 0,
+			size       INTEGER NOT NULL DEFAULT 0,
+			millis     INTEGER NOT NULL DEFAULT 0,
+			error      TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );
+		 CREATE INDEX idx_system_transfers_system ON system_transfers(system_id, id);`,
+		down: `DROP TABLE system_transfers;`,
+	},
+	{
+		name: "add profile secret_paths",
+		up:   `ALTER TABLE profiles ADD COLUMN secret_paths TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE profiles DROP COLUMN secret_paths;`,
+	},
+	{
+		name: "add system credentials",
+		up: `CREATE TABLE system_credentials (
+			system_id     INTEGER PRIMARY KEY REFERENCES systems(id) ON DELETE CASCADE,
+			attempt_id    TEXT NOT NULL DEFAULT '',
+			password      TEXT NOT NULL DEFAULT '',
+			password_hash TEXT NOT NULL,
+			created_at    DATETIME NOT NULL DEFAULT (datetime('now')),
+			revealed_at   DATETIME
+		 );`,
+		down: `DROP TABLE system_credentials;`,
+	},
+	{
+		name: "add system tpm",
+		up: `CREATE TABLE system_tpm (
+			system_id      INTEGER PRIMARY KEY REFERENCES systems(id) ON DELETE CASCADE,
+			ek_fingerprint TEXT NOT NULL,
+			ek_cert        TEXT NOT NULL DEFAULT '',
+			ek_pub         TEXT NOT NULL DEFAULT '',
+			ak_pub         TEXT NOT NULL DEFAULT '',
+			status         TEXT NOT NULL,
+			detail         TEXT NOT NULL DEFAULT '',
+			enrolled_at    DATETIME NOT NULL DEFAULT (datetime('now')),
+			updated_at     DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );`,
+		down: `DROP TABLE system_tpm;`,
+	},
+	{
+		name: "add subnet site",
+		up:   `ALTER TABLE subnets ADD COLUMN site TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE subnets DROP COLUMN site;`,
+	},
+	{
+		name: "add image arch",
+		up:   `ALTER TABLE images ADD COLUMN arch TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE images DROP COLUMN arch;`,
+	},
+	{
+		name: "add snippets",
+		up: `CREATE TABLE snippets (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			name        TEXT NOT NULL UNIQUE,
+			description TEXT NOT NULL DEFAULT '',
+			content     TEXT NOT NULL DEFAULT '',
+			created_at  DATETIME NOT NULL DEFAULT (datetime('now')),
+			updated_at  DATETIME NOT NULL DEFAULT (datetime('now'))
+		 );`,
+		down: `DROP TABLE snippets;`,
+	},
+}
+
+// SchemaVersion returns the highest migration applied to the database.
+func SchemaVersion(db *sql.DB) (int, error) {
 	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
 		version INTEGER NOT NULL
 	)`)
 	if err != nil {
-		return fmt.Errorf("create schema_version: %w", err)
+		return 0, fmt.Errorf("create schema_version: %w", err)
 	}
 
 	var current int
 	row := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version")
 	if err := row.Scan(&current); err != nil {
-		return fmt.Errorf("get schema version: %w", err)
+		return 0, fmt.Errorf("get schema version: %w", err)
+	}
+	return current, nil
+}
+
+// LatestSchemaVersion is the version a fully migrated database reports.
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// PendingMigrations describes the migrations Migrate would apply, one
+// "N: name" line per migration.
+func PendingMigrations(db *sql.DB) ([]string, error) {
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	var pending []string
+	for i := current; i < len(migrations); i++ {
+		pending = append(pending, fmt.Sprintf("%d: %s", i+1, migrations[i].name))
+	}
+	return pending, nil
+}
+
+func Migrate(db *sql.DB) error {
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
 	}
 
 	for i := current; i < len(migrations); i++ {
@@ -109,7 +749,7 @@ func Migrate(db *sql.DB) error {
 		if err != nil {
 			return fmt.Errorf("begin tx for migration %d: %w", i+1, err)
 		}
-		if _, err := tx.Exec(migrations[i]); err != nil {
+		if _, err := tx.Exec(migrations[i].up); err != nil {
 			tx.Rollback()
 			return fmt.Errorf("migration %d: %w", i+1, err)
 		}
@@ -124,3 +764,38 @@ func Migrate(db *sql.DB) error {
 
 	return nil
 }
+
+// MigrateDown reverts migrations newest-first until the database is at the
+// target version. Each step runs in its own transaction.
+func MigrateDown(db *sql.DB, target int) error {
+	if target < 0 || target > len(migrations) {
+		return fmt.Errorf("invalid target version %d (latest is %d)", target, len(migrations))
+	}
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("database version %d is newer than this binary (%d)", current, len(migrations))
+	}
+
+	for i := current; i > target; i-- {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("begin tx for down-migration %d: %w", i, err)
+		}
+		if _, err := tx.Exec(migrations[i-1].down); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("down-migration %d: %w", i, err)
+		}
+		if _, err := tx.Exec("DELETE FROM schema_version WHERE version >= ?", i); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("update schema version %d: %w", i, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("commit down-migration %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// NetBoxLink ties a system to the NetBox device it was synced from.
+type NetBoxLink struct {
+	SystemID   int64
+	DeviceID   int64
+	DeviceName string
+	SyncedAt   string
+}
+
+// GetNetBoxLink returns the NetBox device a system was synced from, or nil.
+func GetNetBoxLink(d *sql.DB, systemID int64) (*NetBoxLink, error) {
+	var l NetBoxLink
+	err := d.QueryRow(`SELECT system_id, device_id, device_name, synced_at FROM netbox_links WHERE system_id = ?`, systemID).
+		Scan(&l.SystemID, &l.DeviceID, &l.DeviceName, &l.SyncedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get netbox link: %w", err)
+	}
+	return &l, nil
+}
+
+// SetNetBoxLink records the device a system was synced from, replacing any
+// earlier link.
+func SetNetBoxLink(d *sql.DB, systemID, deviceID int64, deviceName string) error {
+	_, err := d.Exec(`INSERT INTO netbox_links (system_id, device_id, device_name) VALUES (?, ?, ?)
+		ON CONFLICT(system_id) DO UPDATE SET device_id = excluded.device_id,
+		device_name = excluded.device_name, synced_at = datetime('now')`,
+		systemID, deviceID, deviceName)
+	if err != nil {
+		return fmt.Errorf("set netbox link: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// SetOneshotImage arranges for a system to boot imageID on its next boot
+// only. A nil imageID cancels a pending one-shot boot.
+func SetOneshotImage(d *sql.DB, systemID int64, imageID *int64) error {
+	_, err := d.Exec(`UPDATE systems SET oneshot_image_id = ?, oneshot_served_at = NULL, updated_at = datetime('now') WHERE id = ? AND deleted_at IS NULL`,
+		imageID, systemID)
+	if err != nil {
+		return fmt.Errorf("set one-shot image: %w", err)
+	}
+	return nil
+}
+
+// MarkOneshotServed records that the one-shot image was handed out. The
+// image stays bound to the system's signed URLs until its next boot so the
+// utility can still fetch its files once it is running.
+func MarkOneshotServed(d *sql.DB, systemID int64) error {
+	_, err := d.Exec(`UPDATE systems SET oneshot_served_at = datetime('now') WHERE id = ?`, systemID)
+	if err != nil {
+		return fmt.Errorf("mark one-shot served: %w", err)
+	}
+	return nil
+}
+
+// ListUtilityImages returns the live images flagged as utilities.
+func ListUtilityImages(d *sql.DB) ([]Image, error) {
+	return queryImages(d, `SELECT `+imageColumns+` FROM images WHERE utility = 1 AND deleted_at IS NULL ORDER BY name`)
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// What a policy rule does to the systems its expression matches.
+const (
+	RuleActionAssign = "assign" // give an unassigned system an image and/or profile
+	RuleActionDeny   = "deny"   // refuse to boot a queued system
+)
+
+// PolicyRule is an expression over system facts and what to do with the
+// systems it matches. Rules are tried in position order; the first
+// matching assign rule wins.
+type PolicyRule struct {
+	ID        int64
+	Name      string
+	Expr      string
+	Action    string
+	ImageID   *int64
+	ProfileID *int64
+	Position  int64
+	Enabled   bool
+	CreatedAt string
+}
+
+const policyRuleColumns = `id, name, expr, action, image_id, profile_id, position, enabled, created_at`
+
+func scanPolicyRule(row interface{ Scan(...any) error }) (*PolicyRule, error) {
+	var r PolicyRule
+	err := row.Scan(&r.ID, &r.Name, &r.Expr, &r.Action, &r.ImageID, &r.ProfileID, &r.Position, &r.Enabled, &r.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// ListPolicyRules returns all rules in the order they are tried.
+func ListPolicyRules(d *sql.DB) ([]PolicyRule, error) {
+	rows, err := d.Query(`SELECT ` + policyRuleColumns + ` FROM policy_rules ORDER BY position, id`)
+	if err != nil {
+		return nil, fmt.Errorf("list policy rules: %w", err)
+	}
+	defer rows.Close()
+	var rules []PolicyRule
+	for rows.Next() {
+		r, err := scanPolicyRule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan policy rule: %w", err)
+		}
+		rules = append(rules, *r)
+	}
+	return rules, rows.Err()
+}
+
+func GetPolicyRule(d *sql.DB, id int64) (*PolicyRule, error) {
+	r, err := scanPolicyRule(d.QueryRow(`SELECT `+policyRuleColumns+` FROM policy_rules WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get policy rule: %w", err)
+	}
+	return r, nil
+}
+
+// CreatePolicyRule adds a rule after the existing ones.
+func CreatePolicyRule(d *sql.DB, name, expr, action string, imageID, profileID *int64) (int64, error) {
+	result, err := d.Exec(`INSERT INTO policy_rules (name, expr, action, image_id, profile_id, position)
+		VALUES (?, ?, ?, ?, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM policy_rules))`,
+		name, expr, action, imageID, profileID)
+	if err != nil {
+		return 0, fmt.Errorf("create policy rule: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+func SetPolicyRuleEnabled(d *sql.DB, id int64, enabled bool) error {
+	if _, err := d.Exec(`UPDATE policy_rules SET enabled = ? WHERE id = ?`, enabled, id); err != nil {
+		return fmt.Errorf("update policy rule: %w", err)
+	}
+	return nil
+}
+
+// MovePolicyRuleUp swaps a rule with the one tried before it.
+func MovePolicyRuleUp(d *sql.DB, id int64) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return fmt.Errorf("move policy rule: %w", err)
+	}
+	defer tx.Rollback()
+	var pos int64
+	if err := tx.QueryRow(`SELECT position FROM policy_rules WHERE id = ?`, id).Scan(&pos); err != nil {
+		return fmt.Errorf("move policy rule: %w", err)
+	}
+	var prevID, prevPos int64
+	err = tx.QueryRow(`SELECT id, position FROM policy_rules WHERE position < ? OR (position = ? AND id < ?)
+		ORDER BY position DESC, id DESC LIMIT 1`, pos, pos, id).Scan(&prevID, &prevPos)
+	if err == sql.ErrNoRows {
+		return nil // already first
+	}
+	if err != nil {
+		return fmt.Errorf("move policy rule: %w", err)
+	}
+	if prevPos == pos {
+		prevPos--
+	}
+	if _, err := tx.Exec(`UPDATE policy_rules SET position = ? WHERE id = ?`, pos, prevID); err != nil {
+		return fmt.Errorf("move policy rule: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE policy_rules SET position = ? WHERE id = ?`, prevPos, id); err != nil {
+		return fmt.Errorf("move policy rule: %w", err)
+	}
+	return tx.Commit()
+}
+
+func DeletePolicyRule(d *sql.DB, id int64) error {
+	if _, err := d.Exec(`DELETE FROM policy_rules WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("delete policy rule: %w", err)
+	}
+	return nil
+}
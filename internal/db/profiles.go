@@ -15,24 +15,33 @@ type Profile struct {
 	DefaultVars    string
 	OverlayFile    string
 	VarSchema      string
+	StorageLayout  string // JSON; see profile.ParseLayout
+	SecretPaths    string // secret store paths its templates may read; see profile.ParseSecretPaths
 	CatalogID      string
+	Environment    string // "" if the profile is shared by every environment
+	TenantID       int64  // 0 if the profile belongs to no tenant and is shared by all
+	DeletedAt      string
 	CreatedAt      string
 	UpdatedAt      string
 }
 
-const profileColumns = `id, name, description, os_family, config_template, kernel_params, default_vars, overlay_file, var_schema, catalog_id, created_at, updated_at`
+const profileColumns = `id, name, description, os_family, config_template, kernel_params, default_vars, overlay_file, var_schema, storage_layout, secret_paths, catalog_id, environment, tenant_id, COALESCE(deleted_at, ''), created_at, updated_at`
 
 func scanProfile(row interface{ Scan(...any) error }) (*Profile, error) {
 	var p Profile
 	err := row.Scan(&p.ID, &p.Name, &p.Description, &p.OSFamily,
 		&p.ConfigTemplate, &p.KernelParams, &p.DefaultVars, &p.OverlayFile,
-		&p.VarSchema, &p.CatalogID,
+		&p.VarSchema, &p.StorageLayout, &p.SecretPaths, &p.CatalogID, &p.Environment, &p.TenantID, &p.DeletedAt,
 		&p.CreatedAt, &p.UpdatedAt)
 	return &p, err
 }
 
 func ListProfiles(d *sql.DB) ([]Profile, error) {
-	rows, err := d.Query(`SELECT ` + profileColumns + ` FROM profiles ORDER BY id DESC`)
+	return queryProfiles(d, `SELECT `+profileColumns+` FROM profiles WHERE deleted_at IS NULL ORDER BY id DESC`)
+}
+
+func queryProfiles(d *sql.DB, query string, args ...any) ([]Profile, error) {
+	rows, err := d.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -50,7 +59,7 @@ func ListProfiles(d *sql.DB) ([]Profile, error) {
 }
 
 func GetProfile(d *sql.DB, id int64) (*Profile, error) {
-	p, err := scanProfile(d.QueryRow(`SELECT `+profileColumns+` FROM profiles WHERE id = ?`, id))
+	p, err := scanProfile(d.QueryRow(`SELECT `+profileColumns+` FROM profiles WHERE id = ? AND deleted_at IS NULL`, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -61,7 +70,7 @@ func GetProfile(d *sql.DB, id int64) (*Profile, error) {
 }
 
 func GetProfileByCatalogID(d *sql.DB, catalogID string) (*Profile, error) {
-	p, err := scanProfile(d.QueryRow(`SELECT `+profileColumns+` FROM profiles WHERE catalog_id = ?`, catalogID))
+	p, err := scanProfile(d.QueryRow(`SELECT `+profileColumns+` FROM profiles WHERE catalog_id = ? AND deleted_at IS NULL`, catalogID))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -98,7 +107,28 @@ func UpdateProfile(d *sql.DB, id int64, name, description, osFamily, configTempl
 	return err
 }
 
+// UpdateProfileStorage sets a profile's storage layout, "" for none.
+func UpdateProfileStorage(d *sql.DB, id int64, layout string) error {
+	_, err := d.Exec(`UPDATE profiles SET storage_layout = ?, updated_at = datetime('now') WHERE id = ?`, layout, id)
+	if err != nil {
+		return fmt.Errorf("update profile storage layout: %w", err)
+	}
+	return nil
+}
+
+// UpdateProfileSecretPaths sets the secret store paths a profile's
+// templates may read, "" for none.
+func UpdateProfileSecretPaths(d *sql.DB, id int64, paths string) error {
+	_, err := d.Exec(`UPDATE profiles SET secret_paths = ?, updated_at = datetime('now') WHERE id = ?`, paths, id)
+	if err != nil {
+		return fmt.Errorf("update profile secret paths: %w", err)
+	}
+	return nil
+}
+
+// DeleteProfile moves a profile to the trash. It stays restorable, files and
+// all, until the trash is purged.
 func DeleteProfile(d *sql.DB, id int64) error {
-	_, err := d.Exec(`DELETE FROM profiles WHERE id = ?`, id)
+	_, err := d.Exec(`UPDATE profiles SET deleted_at = datetime('now'), updated_at = datetime('now') WHERE id = ? AND deleted_at IS NULL`, id)
 	return err
 }
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// How a scheduled task's last run went.
+const (
+	ScheduleOK     = "ok"
+	ScheduleFailed = "failed"
+)
+
+// Schedule is when a periodic task runs and how its last run went. Tasks
+// are defined in code; a row holds what has been changed from their
+// defaults and their run history.
+type Schedule struct {
+	Name       string
+	Cron       string
+	Jitter     int // seconds of random delay added to each run
+	Enabled    bool
+	NextRunAt  string
+	LastRunAt  string
+	LastStatus string
+	LastError  string
+	LastMillis int64 // how long the last run took
+}
+
+// ListSchedules returns every stored schedule by task name.
+func ListSchedules(d *sql.DB) (map[string]Schedule, error) {
+	rows, err := d.Query(`SELECT name, cron, jitter, enabled, COALESCE(next_run_at, ''), COALESCE(last_run_at, ''),
+		last_status, last_error, last_millis FROM schedules`)
+	if err != nil {
+		return nil, fmt.Errorf("list schedules: %w", err)
+	}
+	defer rows.Close()
+	out := make(map[string]Schedule)
+	for rows.Next() {
+		var s Schedule
+		if err := rows.Scan(&s.Name, &s.Cron, &s.Jitter, &s.Enabled, &s.NextRunAt, &s.LastRunAt,
+			&s.LastStatus, &s.LastError, &s.LastMillis); err != nil {
+			return nil, fmt.Errorf("scan schedule: %w", err)
+		}
+		out[s.Name] = s
+	}
+	return out, rows.Err()
+}
+
+// EnsureSchedule stores a task's default schedule unless it already has
+// one.
+func EnsureSchedule(d *sql.DB, name, cron string, jitter int, enabled bool) error {
+	_, err := d.Exec(`INSERT INTO schedules (name, cron, jitter, enabled) VALUES (?, ?, ?, ?) ON CONFLICT (name) DO NOTHING`,
+		name, cron, jitter, enabled)
+	if err != nil {
+		return fmt.Errorf("add schedule %s: %w", name, err)
+	}
+	return nil
+}
+
+// UpdateSchedule changes when a task runs. Its next run is worked out
+// afresh.
+func UpdateSchedule(d *sql.DB, name, cron string, jitter int, enabled bool) error {
+	_, err := d.Exec(`UPDATE schedules SET cron = ?, jitter = ?, enabled = ?, next_run_at = NULL WHERE name = ?`,
+		cron, jitter, enabled, name)
+	if err != nil {
+		return fmt.Errorf("update schedule %s: %w", name, err)
+	}
+	return nil
+}
+
+// SetScheduleNextRun records when a task is next due.
+func SetScheduleNextRun(d *sql.DB, name string, at time.Time) error {
+	_, err := d.Exec(`UPDATE schedules SET next_run_at = ? WHERE name = ?`, at.UTC().Format(time.DateTime), name)
+	if err != nil {
+		return fmt.Errorf("schedule %s: %w", name, err)
+	}
+	return nil
+}
+
+// RecordScheduleRun records how a task's run went; errMsg is "" unless
+// status is ScheduleFailed.
+func RecordScheduleRun(d *sql.DB, name, status, errMsg string, took time.Duration) error {
+	_, err := d.Exec(`UPDATE schedules SET last_run_at = datetime('now'), last_status = ?, last_error = ?, last_millis = ?
+		WHERE name = ?`, status, errMsg, took.Milliseconds(), name)
+	if err != nil {
+		return fmt.Errorf("record run of %s: %w", name, err)
+	}
+	return nil
+}
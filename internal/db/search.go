@@ -0,0 +1,43 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// likePattern turns a search term into a LIKE pattern matching it anywhere,
+// with LIKE's own wildcards escaped.
+func likePattern(term string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(term) + "%"
+}
+
+// SearchSystems returns live systems whose hostname or MAC contains term.
+// MACs match with or without separators, so "aabb" finds aa:bb:....
+func SearchSystems(d *sql.DB, term string) ([]System, error) {
+	var mac string // matches nothing when term has no MAC digits
+	if hex := macSepRe.ReplaceAllString(strings.ToLower(term), ""); hex != "" {
+		mac = likePattern(hex)
+	}
+	return querySystems(d, `SELECT `+systemColumns+` FROM systems
+		WHERE deleted_at IS NULL
+		AND (hostname LIKE ? ESCAPE '\' OR REPLACE(mac, ':', '') LIKE ? ESCAPE '\')
+		ORDER BY hostname, id`, likePattern(term), mac)
+}
+
+// SearchImages returns live images whose name or description contains term.
+func SearchImages(d *sql.DB, term string) ([]Image, error) {
+	p := likePattern(term)
+	return queryImages(d, `SELECT `+imageColumns+` FROM images
+		WHERE deleted_at IS NULL AND (name LIKE ? ESCAPE '\' OR description LIKE ? ESCAPE '\')
+		ORDER BY name, id`, p, p)
+}
+
+// SearchProfiles returns live profiles whose name or description contains
+// term.
+func SearchProfiles(d *sql.DB, term string) ([]Profile, error) {
+	p := likePattern(term)
+	return queryProfiles(d, `SELECT `+profileColumns+` FROM profiles
+		WHERE deleted_at IS NULL AND (name LIKE ? ESCAPE '\' OR description LIKE ? ESCAPE '\')
+		ORDER BY name, id`, p, p)
+}
@@ -2,6 +2,8 @@ package db
 
 import (
 	"database/sql"
+	"fmt"
+	"time"
 )
 
 func GetSetting(d *sql.DB, key string) (string, error) {
@@ -10,11 +12,44 @@ func GetSetting(d *sql.DB, key string) (string, error) {
 	if err == sql.ErrNoRows {
 		return "", nil
 	}
-	return value, err
+	switch {
+	case err != nil:
+		return "", err
+	case secretSettings[key]:
+		return unseal(value)
+	case varSettings[key]:
+		return unsealVars(value)
+	}
+	return value, nil
+}
+
+// LookupSetting is GetSetting that also reports whether the key is set,
+// telling a saved empty value apart from one never saved.
+func LookupSetting(d *sql.DB, key string) (string, bool, error) {
+	var value string
+	err := d.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err == nil && secretSettings[key] {
+		value, err = unseal(value)
+	} else if err == nil && varSettings[key] {
+		value, err = unsealVars(value)
+	}
+	return value, err == nil, err
 }
 
 func SetSetting(d *sql.DB, key, value string) error {
-	_, err := d.Exec("INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value", key, value)
+	var err error
+	if secretSettings[key] {
+		value, err = seal(value)
+	} else if varSettings[key] {
+		value, err = sealVars(value)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = d.Exec("INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value", key, value)
 	return err
 }
 
@@ -22,3 +57,12 @@ func DeleteSetting(d *sql.DB, key string) error {
 	_, err := d.Exec("DELETE FROM settings WHERE key = ?", key)
 	return err
 }
+
+// ProbeWrite records the time in the settings table, showing the database
+// accepts writes.
+func ProbeWrite(d *sql.DB) error {
+	if err := SetSetting(d, "ready_probe", time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return fmt.Errorf("probe write: %w", err)
+	}
+	return nil
+}
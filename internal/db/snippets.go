@@ -0,0 +1,92 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Snippet is a named template partial, such as a common network config or
+// user setup, that profiles include with {{template "name" .}}.
+type Snippet struct {
+	ID          int64
+	Name        string
+	Description string
+	Content     string
+	CreatedAt   string
+	UpdatedAt   string
+}
+
+const snippetColumns = `id, name, description, content, created_at, updated_at`
+
+func querySnippets(d *sql.DB, query string, args ...any) ([]Snippet, error) {
+	rows, err := d.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list snippets: %w", err)
+	}
+	defer rows.Close()
+	var out []Snippet
+	for rows.Next() {
+		var sn Snippet
+		if err := rows.Scan(&sn.ID, &sn.Name, &sn.Description, &sn.Content, &sn.CreatedAt, &sn.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("scan snippet: %w", err)
+		}
+		out = append(out, sn)
+	}
+	return out, rows.Err()
+}
+
+// ListSnippets returns the snippets library by name.
+func ListSnippets(d *sql.DB) ([]Snippet, error) {
+	return querySnippets(d, `SELECT `+snippetColumns+` FROM snippets ORDER BY name`)
+}
+
+func GetSnippet(d *sql.DB, id int64) (*Snippet, error) {
+	snippets, err := querySnippets(d, `SELECT `+snippetColumns+` FROM snippets WHERE id = ?`, id)
+	if err != nil || len(snippets) == 0 {
+		return nil, err
+	}
+	return &snippets[0], nil
+}
+
+// SnippetContents returns every snippet's content by name.
+func SnippetContents(d *sql.DB) (map[string]string, error) {
+	snippets, err := ListSnippets(d)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string, len(snippets))
+	for _, sn := range snippets {
+		out[sn.Name] = sn.Content
+	}
+	return out, nil
+}
+
+// CreateSnippet adds a snippet. Its name can't be changed afterwards, as
+// templates include it by name.
+func CreateSnippet(d *sql.DB, name, description, content string) (int64, error) {
+	name, err := normalizeName("snippet", name)
+	if err != nil {
+		return 0, err
+	}
+	res, err := d.Exec(`INSERT INTO snippets (name, description, content) VALUES (?, ?, ?)`, name, description, content)
+	if err != nil {
+		return 0, fmt.Errorf("create snippet: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+func UpdateSnippet(d *sql.DB, id int64, description, content string) error {
+	_, err := d.Exec(`UPDATE snippets SET description = ?, content = ?, updated_at = datetime('now') WHERE id = ?`, description, content, id)
+	if err != nil {
+		return fmt.Errorf("update snippet: %w", err)
+	}
+	return nil
+}
+
+func DeleteSnippet(d *sql.DB, id int64) error {
+	_, err := d.Exec(`DELETE FROM snippets WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("delete snippet: %w", err)
+	}
+	return nil
+}
@@ -5,7 +5,7 @@ import "database/sql"
 type Stats struct {
 	Systems  SystemStats  `json:"systems"`
 	Images   ImageStats   `json:"images"`
-	Profiles int         `json:"profiles"`
+	Profiles int          `json:"profiles"`
 	Webhooks WebhookStats `json:"webhooks"`
 }
 
@@ -16,6 +16,9 @@ type SystemStats struct {
 	Provisioning int `json:"provisioning"`
 	Ready        int `json:"ready"`
 	Failed       int `json:"failed"`
+
+	Decommissioning int `json:"decommissioning"`
+	Decommissioned  int `json:"decommissioned"`
 }
 
 type ImageStats struct {
@@ -33,7 +36,7 @@ type WebhookStats struct {
 func GetStats(d *sql.DB) (*Stats, error) {
 	var s Stats
 
-	rows, err := d.Query(`SELECT state, COUNT(*) FROM systems GROUP BY state`)
+	rows, err := d.Query(`SELECT state, COUNT(*) FROM systems WHERE deleted_at IS NULL GROUP BY state`)
 	if err != nil {
 		return nil, err
 	}
@@ -56,13 +59,17 @@ func GetStats(d *sql.DB) (*Stats, error) {
 			s.Systems.Ready = n
 		case "failed":
 			s.Systems.Failed = n
+		case "decommissioning":
+			s.Systems.Decommissioning = n
+		case "decommissioned":
+			s.Systems.Decommissioned = n
 		}
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
-	rows2, err := d.Query(`SELECT status, COUNT(*) FROM images GROUP BY status`)
+	rows2, err := d.Query(`SELECT status, COUNT(*) FROM images WHERE deleted_at IS NULL GROUP BY status`)
 	if err != nil {
 		return nil, err
 	}
@@ -87,7 +94,7 @@ func GetStats(d *sql.DB) (*Stats, error) {
 		return nil, err
 	}
 
-	if err := d.QueryRow(`SELECT COUNT(*) FROM profiles`).Scan(&s.Profiles); err != nil {
+	if err := d.QueryRow(`SELECT COUNT(*) FROM profiles WHERE deleted_at IS NULL`).Scan(&s.Profiles); err != nil {
 		return nil, err
 	}
 
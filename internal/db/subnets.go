@@ -0,0 +1,186 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Whether a subnet has a DHCP server of its own. Unknown is "".
+const (
+	SubnetDHCPExternal = "external" // another server hands out addresses; duh answers as proxy DHCP
+	SubnetDHCPNone     = "none"     // no DHCP server, so machines there can't netboot
+)
+
+// What a subnet's systems may do when they netboot.
+const (
+	SubnetBootAllow = "allow"
+	SubnetBootDeny  = "deny" // queued systems on the subnet aren't booted
+)
+
+// Subnet is a network systems are placed on by their IP address. It gives
+// them network context: a purpose label to filter and write rules on, the
+// site they are at, and a boot policy with a default image and profile for
+// systems without one.
+type Subnet struct {
+	ID          int64
+	CIDR        string // network address, e.g. 10.20.0.0/16
+	Name        string
+	Description string
+	Purpose     string // label such as provisioning, storage or oob
+	Site        string // location label such as ams or nyc, choosing site-local mirrors
+	VLAN        int    // 0 if untagged or unknown
+	DHCP        string
+	Relay       string // DHCP relay (ip-helper) forwarding the subnet's requests, if any
+	Boot        string
+	ImageID     *int64
+	ProfileID   *int64
+	CreatedAt   string
+	UpdatedAt   string
+}
+
+// Label is the subnet's name, or its CIDR if it has none.
+func (s Subnet) Label() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.CIDR
+}
+
+const subnetColumns = `id, cidr, name, description, purpose, site, vlan, dhcp, relay, boot, image_id, profile_id, created_at, updated_at`
+
+func scanSubnet(row interface{ Scan(...any) error }) (*Subnet, error) {
+	var s Subnet
+	err := row.Scan(&s.ID, &s.CIDR, &s.Name, &s.Description, &s.Purpose, &s.Site, &s.VLAN, &s.DHCP, &s.Relay, &s.Boot,
+		&s.ImageID, &s.ProfileID, &s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// NormalizeSubnet checks a subnet's fields, rewriting its CIDR as the
+// network address and its purpose and site as lowercase labels.
+func NormalizeSubnet(s *Subnet) error {
+	_, ipnet, err := net.ParseCIDR(strings.TrimSpace(s.CIDR))
+	if err != nil {
+		return fmt.Errorf("invalid subnet %q: use CIDR notation, e.g. 10.20.0.0/16", s.CIDR)
+	}
+	s.CIDR = ipnet.String()
+	s.Name = strings.TrimSpace(s.Name)
+	s.Description = strings.TrimSpace(s.Description)
+	s.Purpose = NormalizeTags(s.Purpose)
+	if strings.Contains(s.Purpose, ",") {
+		return fmt.Errorf("a subnet has one purpose")
+	}
+	s.Site = NormalizeTags(s.Site)
+	if strings.Contains(s.Site, ",") {
+		return fmt.Errorf("a subnet is at one site")
+	}
+	if s.VLAN < 0 || s.VLAN > 4094 {
+		return fmt.Errorf("invalid VLAN %d", s.VLAN)
+	}
+	switch s.DHCP {
+	case "", SubnetDHCPExternal, SubnetDHCPNone:
+	default:
+		return fmt.Errorf("invalid DHCP presence %q", s.DHCP)
+	}
+	s.Relay = strings.TrimSpace(s.Relay)
+	if s.Relay != "" && net.ParseIP(s.Relay) == nil {
+		return fmt.Errorf("invalid relay address %q", s.Relay)
+	}
+	switch s.Boot {
+	case "":
+		s.Boot = SubnetBootAllow
+	case SubnetBootAllow, SubnetBootDeny:
+	default:
+		return fmt.Errorf("invalid boot policy %q", s.Boot)
+	}
+	return nil
+}
+
+// ListSubnets returns all subnets in address order.
+func ListSubnets(d *sql.DB) ([]Subnet, error) {
+	rows, err := d.Query(`SELECT ` + subnetColumns + ` FROM subnets ORDER BY cidr`)
+	if err != nil {
+		return nil, fmt.Errorf("list subnets: %w", err)
+	}
+	defer rows.Close()
+	var subnets []Subnet
+	for rows.Next() {
+		s, err := scanSubnet(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan subnet: %w", err)
+		}
+		subnets = append(subnets, *s)
+	}
+	return subnets, rows.Err()
+}
+
+func GetSubnet(d *sql.DB, id int64) (*Subnet, error) {
+	s, err := scanSubnet(d.QueryRow(`SELECT `+subnetColumns+` FROM subnets WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get subnet: %w", err)
+	}
+	return s, nil
+}
+
+// CreateSubnet adds a subnet, normalizing it first.
+func CreateSubnet(d *sql.DB, s *Subnet) (int64, error) {
+	if err := NormalizeSubnet(s); err != nil {
+		return 0, err
+	}
+	res, err := d.Exec(`INSERT INTO subnets (cidr, name, description, purpose, site, vlan, dhcp, relay, boot, image_id, profile_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.CIDR, s.Name, s.Description, s.Purpose, s.Site, s.VLAN, s.DHCP, s.Relay, s.Boot, s.ImageID, s.ProfileID)
+	if err != nil {
+		return 0, fmt.Errorf("create subnet: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+// UpdateSubnet saves a subnet's fields, normalizing them first.
+func UpdateSubnet(d *sql.DB, s *Subnet) error {
+	if err := NormalizeSubnet(s); err != nil {
+		return err
+	}
+	_, err := d.Exec(`UPDATE subnets SET cidr = ?, name = ?, description = ?, purpose = ?, site = ?, vlan = ?, dhcp = ?,
+		relay = ?, boot = ?, image_id = ?, profile_id = ?, updated_at = datetime('now') WHERE id = ?`,
+		s.CIDR, s.Name, s.Description, s.Purpose, s.Site, s.VLAN, s.DHCP, s.Relay, s.Boot, s.ImageID, s.ProfileID, s.ID)
+	if err != nil {
+		return fmt.Errorf("update subnet: %w", err)
+	}
+	return nil
+}
+
+func DeleteSubnet(d *sql.DB, id int64) error {
+	if _, err := d.Exec(`DELETE FROM subnets WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("delete subnet: %w", err)
+	}
+	return nil
+}
+
+// SubnetFor returns the most specific of subnets that contains ip, or nil
+// if none does or ip isn't an address.
+func SubnetFor(subnets []Subnet, ip string) *Subnet {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil
+	}
+	var best *Subnet
+	bestOnes := -1
+	for i := range subnets {
+		_, ipnet, err := net.ParseCIDR(subnets[i].CIDR)
+		if err != nil || !ipnet.Contains(addr) {
+			continue
+		}
+		if ones, _ := ipnet.Mask.Size(); ones > bestOnes {
+			best, bestOnes = &subnets[i], ones
+		}
+	}
+	return best
+}
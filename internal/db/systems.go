@@ -15,16 +15,34 @@ type System struct {
 	ProfileID      *int64
 	Vars           string
 	IPAddr         string
+	PrevIPAddr     string // address the system had before IPAddr; "" if it hasn't moved
+	IPChangedAt    string // when it moved to IPAddr
 	LastSeenAt     string
 	State          string
 	StateChangedAt string
+	DeletedAt      string
+	TokenGen       int64  // bumped to revoke signed URLs issued to the system
+	AttemptID      string // current provision attempt, set each time the system is queued
+	FailPhase      string // installer phase reported with the last failure
+	FailMessage    string
+	OneshotImageID *int64 // served on the next boot only, without touching ImageID or State
+	OneshotServed  string // when the one-shot image was served; cleared on the boot after
+	IPXEPlatform   string // reported by iPXE in the chain URL on the last boot
+	IPXEBuildArch  string
+	IPXEVersion    string
+	IPXEFeatures   string // comma-separated
+	Tags           string // comma-separated, normalized by NormalizeTags
+	HeartbeatAt    string // last heartbeat from the running host
+	BootedImageID  *int64 // image the host last installed or reported running
+	Environment    string // "" if the system isn't in one
+	TenantID       int64  // 0 if the system belongs to no tenant
 	CreatedAt      string
 	UpdatedAt      string
 }
 
 var macSepRe = regexp.MustCompile(`[:\-.]`)
 
-func normalizeMAC(mac string) (string, error) {
+func NormalizeMAC(mac string) (string, error) {
 	mac = strings.ToLower(strings.TrimSpace(mac))
 	hex := macSepRe.ReplaceAllString(mac, "")
 	if len(hex) != 12 {
@@ -39,13 +57,88 @@ func normalizeMAC(mac string) (string, error) {
 		hex[0:2], hex[2:4], hex[4:6], hex[6:8], hex[8:10], hex[10:12]), nil
 }
 
-func ListSystems(d *sql.DB) ([]System, error) {
-	rows, err := d.Query(`
-		SELECT id, mac, hostname, image_id, profile_id, vars,
-		       ip_addr, COALESCE(last_seen_at, ''),
-		       state, COALESCE(state_changed_at, ''),
-		       created_at, updated_at
-		FROM systems ORDER BY id DESC`)
+// NormalizeHostname turns a free-form name (a VM or DCIM device name) into
+// a hostname label: lowercase letters, digits and hyphens, at most 63
+// characters.
+func NormalizeHostname(name string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(name) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+			b.WriteRune(c)
+		default:
+			b.WriteByte('-')
+		}
+	}
+	h := b.String()
+	if len(h) > 63 {
+		h = h[:63]
+	}
+	return strings.Trim(h, "-")
+}
+
+// NormalizeTags lowercases, trims and de-duplicates a comma-separated tag
+// list, keeping the first-seen order. Tags may contain letters, digits and
+// "-_.:/"; spaces become hyphens and anything else is dropped.
+func NormalizeTags(tags string) string {
+	seen := map[string]bool{}
+	var out []string
+	for _, t := range strings.Split(tags, ",") {
+		t = strings.Map(func(c rune) rune {
+			switch {
+			case c >= 'a' && c <= 'z', c >= '0' && c <= '9', strings.ContainsRune("-_.:/", c):
+				return c
+			case c == ' ':
+				return '-'
+			}
+			return -1
+		}, strings.ToLower(strings.TrimSpace(t)))
+		if t != "" && !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+// SplitTags returns the tags in a comma-separated list.
+func SplitTags(tags string) []string {
+	if tags == "" {
+		return nil
+	}
+	return strings.Split(tags, ",")
+}
+
+const systemColumns = `id, mac, hostname, image_id, profile_id, vars,
+	ip_addr, prev_ip_addr, COALESCE(ip_changed_at, ''), COALESCE(last_seen_at, ''),
+	state, COALESCE(state_changed_at, ''),
+	COALESCE(deleted_at, ''), token_gen, attempt_id,
+	fail_phase, fail_message,
+	oneshot_image_id, COALESCE(oneshot_served_at, ''),
+	ipxe_platform, ipxe_buildarch, ipxe_version, ipxe_features,
+	tags, COALESCE(heartbeat_at, ''), booted_image_id, environment, tenant_id,
+	created_at, updated_at`
+
+func scanSystem(row interface{ Scan(...any) error }) (*System, error) {
+	var s System
+	err := row.Scan(&s.ID, &s.MAC, &s.Hostname, &s.ImageID,
+		&s.ProfileID, &s.Vars,
+		&s.IPAddr, &s.PrevIPAddr, &s.IPChangedAt, &s.LastSeenAt,
+		&s.State, &s.StateChangedAt,
+		&s.DeletedAt, &s.TokenGen, &s.AttemptID,
+		&s.FailPhase, &s.FailMessage,
+		&s.OneshotImageID, &s.OneshotServed,
+		&s.IPXEPlatform, &s.IPXEBuildArch, &s.IPXEVersion, &s.IPXEFeatures,
+		&s.Tags, &s.HeartbeatAt, &s.BootedImageID, &s.Environment, &s.TenantID,
+		&s.CreatedAt, &s.UpdatedAt)
+	if err == nil {
+		s.Vars, err = unsealVars(s.Vars)
+	}
+	return &s, err
+}
+
+func querySystems(d *sql.DB, query string, args ...any) ([]System, error) {
+	rows, err := d.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -53,50 +146,117 @@ func ListSystems(d *sql.DB) ([]System, error) {
 
 	var systems []System
 	for rows.Next() {
-		var s System
-		if err := rows.Scan(&s.ID, &s.MAC, &s.Hostname, &s.ImageID,
-			&s.ProfileID, &s.Vars,
-			&s.IPAddr, &s.LastSeenAt,
-			&s.State, &s.StateChangedAt,
-			&s.CreatedAt, &s.UpdatedAt); err != nil {
+		s, err := scanSystem(rows)
+		if err != nil {
 			return nil, err
 		}
-		systems = append(systems, s)
+		systems = append(systems, *s)
 	}
 	return systems, rows.Err()
 }
 
+func ListSystems(d *sql.DB) ([]System, error) {
+	return querySystems(d, `SELECT `+systemColumns+` FROM systems WHERE deleted_at IS NULL ORDER BY id DESC`)
+}
+
+// ListSystemsByImage returns the live systems assigned to an image.
+func ListSystemsByImage(d *sql.DB, imageID int64) ([]System, error) {
+	return querySystems(d, `SELECT `+systemColumns+` FROM systems WHERE image_id = ? AND deleted_at IS NULL ORDER BY id`, imageID)
+}
+
+// ListSystemsByProfile returns the live systems assigned to a profile.
+func ListSystemsByProfile(d *sql.DB, profileID int64) ([]System, error) {
+	return querySystems(d, `SELECT `+systemColumns+` FROM systems WHERE profile_id = ? AND deleted_at IS NULL ORDER BY id`, profileID)
+}
+
+// ReassignSystemsImage moves every live system on one image to another, or
+// unassigns them when to is nil.
+func ReassignSystemsImage(d *sql.DB, from int64, to *int64) (int64, error) {
+	result, err := d.Exec(`UPDATE systems SET image_id = ?, updated_at = datetime('now') WHERE image_id = ? AND deleted_at IS NULL`, to, from)
+	if err != nil {
+		return 0, fmt.Errorf("reassign image: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// ReassignSystemsProfile moves every live system on one profile to another,
+// or unassigns them when to is nil.
+func ReassignSystemsProfile(d *sql.DB, from int64, to *int64) (int64, error) {
+	result, err := d.Exec(`UPDATE systems SET profile_id = ?, updated_at = datetime('now') WHERE profile_id = ? AND deleted_at IS NULL`, to, from)
+	if err != nil {
+		return 0, fmt.Errorf("reassign profile: %w", err)
+	}
+	return result.RowsAffected()
+}
+
 func GetSystemByMAC(d *sql.DB, mac string) (*System, error) {
-	mac, err := normalizeMAC(mac)
+	mac, err := NormalizeMAC(mac)
 	if err != nil {
 		return nil, err
 	}
-	var s System
-	err = d.QueryRow(`
-		SELECT id, mac, hostname, image_id, profile_id, vars,
-		       ip_addr, COALESCE(last_seen_at, ''),
-		       state, COALESCE(state_changed_at, ''),
-		       created_at, updated_at
-		FROM systems WHERE mac = ?`, mac).Scan(
-		&s.ID, &s.MAC, &s.Hostname, &s.ImageID,
-		&s.ProfileID, &s.Vars,
-		&s.IPAddr, &s.LastSeenAt,
-		&s.State, &s.StateChangedAt,
-		&s.CreatedAt, &s.UpdatedAt)
+	s, err := scanSystem(d.QueryRow(`SELECT `+systemColumns+` FROM systems WHERE mac = ? AND deleted_at IS NULL`, mac))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &s, nil
+	return s, nil
+}
+
+// ListSystemsByHostname returns the live systems named hostname, ignoring
+// case.
+func ListSystemsByHostname(d *sql.DB, hostname string) ([]System, error) {
+	return querySystems(d, `SELECT `+systemColumns+` FROM systems WHERE hostname = ? COLLATE NOCASE AND deleted_at IS NULL ORDER BY id`, hostname)
+}
+
+// GetSystemByIP returns the system most recently seen at ip, or nil.
+func GetSystemByIP(d *sql.DB, ip string) (*System, error) {
+	s, err := scanSystem(d.QueryRow(`SELECT `+systemColumns+` FROM systems WHERE ip_addr = ? AND deleted_at IS NULL ORDER BY last_seen_at DESC LIMIT 1`, ip))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get system by ip: %w", err)
+	}
+	return s, nil
+}
+
+// MACInUseError is returned when a MAC address already belongs to another
+// live system.
+type MACInUseError struct {
+	MAC    string
+	System *System // the system that has it
+}
+
+func (e *MACInUseError) Error() string {
+	return fmt.Sprintf("MAC address %s already belongs to system %d", e.MAC, e.System.ID)
+}
+
+// checkMACFree returns a *MACInUseError if a live system other than id has
+// mac.
+func checkMACFree(d *sql.DB, id int64, mac string) error {
+	other, err := GetSystemByMAC(d, mac)
+	if err != nil {
+		return err
+	}
+	if other != nil && other.ID != id {
+		return &MACInUseError{MAC: mac, System: other}
+	}
+	return nil
 }
 
 func CreateSystem(d *sql.DB, mac, hostname string) (*System, error) {
-	mac, err := normalizeMAC(mac)
+	mac, err := NormalizeMAC(mac)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkMACFree(d, 0, mac); err != nil {
+		return nil, err
+	}
+	if err := purgeTrashedMAC(d, mac); err != nil {
+		return nil, err
+	}
 	result, err := d.Exec(`INSERT INTO systems (mac, hostname) VALUES (?, ?)`, mac, hostname)
 	if err != nil {
 		return nil, fmt.Errorf("insert system: %w", err)
@@ -105,89 +265,221 @@ func CreateSystem(d *sql.DB, mac, hostname string) (*System, error) {
 	return &System{ID: id, MAC: mac, Hostname: hostname}, nil
 }
 
+// CloneSystem adds a system with src's image, profile, vars, tags and
+// environment, in tenant tenantID, in one insert so it never exists
+// without them.
+func CloneSystem(d *sql.DB, mac, hostname string, tenantID int64, src *System) (*System, error) {
+	mac, err := NormalizeMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMACFree(d, 0, mac); err != nil {
+		return nil, err
+	}
+	if err := purgeTrashedMAC(d, mac); err != nil {
+		return nil, err
+	}
+	vars := src.Vars
+	if vars == "" {
+		vars = "{}"
+	}
+	if vars, err = sealVars(vars); err != nil {
+		return nil, err
+	}
+	result, err := d.Exec(`INSERT INTO systems (mac, hostname, image_id, profile_id, vars, tags, environment, tenant_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		mac, hostname, src.ImageID, src.ProfileID, vars, NormalizeTags(src.Tags), src.Environment, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("insert system: %w", err)
+	}
+	id, _ := result.LastInsertId()
+	return GetSystemByID(d, id)
+}
+
 func UpdateSystemImage(d *sql.DB, id int64, imageID *int64) error {
 	_, err := d.Exec(`UPDATE systems SET image_id = ?, updated_at = datetime('now') WHERE id = ?`, imageID, id)
 	return err
 }
 
 func UpdateSystemState(d *sql.DB, id int64, state string) error {
-	_, err := d.Exec(`UPDATE systems SET state = ?, state_changed_at = datetime('now'), updated_at = datetime('now') WHERE id = ?`, state, id)
-	return err
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRow(`SELECT state FROM systems WHERE id = ?`, id).Scan(&current)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := setSystemState(tx, id, current, state); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func TransitionSystemStateByMAC(d *sql.DB, mac, expectedState, newState string) error {
-	mac, err := normalizeMAC(mac)
+	mac, err := NormalizeMAC(mac)
 	if err != nil {
 		return err
 	}
-	result, err := d.Exec(`UPDATE systems SET state = ?, state_changed_at = datetime('now'), updated_at = datetime('now') WHERE mac = ? AND state = ?`,
-		newState, mac, expectedState)
+	tx, err := d.Begin()
 	if err != nil {
 		return err
 	}
-	n, _ := result.RowsAffected()
-	if n == 0 {
-		// Check if already in target state (idempotent)
-		var current string
-		err := d.QueryRow(`SELECT state FROM systems WHERE mac = ?`, mac).Scan(&current)
-		if err != nil {
-			return fmt.Errorf("system not found: %s", mac)
-		}
+	defer tx.Rollback()
+	if _, err := transitionSystemStateByMAC(tx, mac, expectedState, newState); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// transitionSystemStateByMAC moves the system with a normalized MAC from
+// expectedState to newState within tx, and returns its ID. A system
+// already in newState is left as it is.
+func transitionSystemStateByMAC(tx *sql.Tx, mac, expectedState, newState string) (int64, error) {
+	var id int64
+	var current string
+	err := tx.QueryRow(`SELECT id, state FROM systems WHERE mac = ? AND deleted_at IS NULL`, mac).Scan(&id, &current)
+	if err != nil {
+		return 0, fmt.Errorf("system not found: %s", mac)
+	}
+	if current != expectedState {
 		if current == newState {
-			return nil // already in target state
+			return id, nil // already in target state
 		}
-		return fmt.Errorf("state transition failed: expected %s, got %s", expectedState, current)
+		return 0, fmt.Errorf("state transition failed: expected %s, got %s", expectedState, current)
 	}
-	return nil
+	return id, setSystemState(tx, id, current, newState)
 }
 
-func TouchSystem(d *sql.DB, mac, ipAddr string) error {
-	mac, err := normalizeMAC(mac)
+// setSystemState moves a system from current to state, keeping its
+// provision attempt record in step. Any change other than entering
+// provisioning, which is when the boot chain's URLs are issued, bumps the
+// token generation and so revokes the system's signed URLs. Finishing a
+// provision records the assigned image as the one the host booted.
+func setSystemState(tx *sql.Tx, id int64, current, state string) error {
+	bump := 0
+	if state != current && state != "provisioning" {
+		bump = 1
+	}
+	_, err := tx.Exec(`UPDATE systems SET state = ?, token_gen = token_gen + ?, state_changed_at = datetime('now'), updated_at = datetime('now') WHERE id = ?`,
+		state, bump, id)
 	if err != nil {
 		return err
 	}
-	_, err = d.Exec(`UPDATE systems SET ip_addr = ?, last_seen_at = datetime('now'), updated_at = datetime('now') WHERE mac = ?`, ipAddr, mac)
-	return err
+	if current == "provisioning" && state == "ready" {
+		if _, err := tx.Exec(`UPDATE systems SET booted_image_id = image_id WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+	return recordAttempt(tx, id, current, state)
 }
 
-func AutoRegister(d *sql.DB, mac, ipAddr string) (*System, bool, error) {
-	mac, err := normalizeMAC(mac)
+// RecordHeartbeat notes that a system's host is up at ipAddr. If the host
+// says which image it runs, that replaces the booted image. It returns the
+// address the system had if the heartbeat moved it, or "".
+func RecordHeartbeat(d *sql.DB, id int64, bootedImageID *int64, ipAddr string) (string, error) {
+	tx, err := d.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`UPDATE systems SET heartbeat_at = datetime('now'), booted_image_id = COALESCE(?, booted_image_id) WHERE id = ?`,
+		bootedImageID, id)
+	if err != nil {
+		return "", fmt.Errorf("record heartbeat: %w", err)
+	}
+	prev, err := observeIP(tx, id, ipAddr, IPSourceHeartbeat)
 	if err != nil {
-		return nil, false, err
+		return "", err
+	}
+	return prev, tx.Commit()
+}
+
+// ImageDrift reports whether the host last booted an image other than
+// the one assigned to it.
+func (s System) ImageDrift() bool {
+	return s.BootedImageID != nil && s.ImageID != nil && *s.BootedImageID != *s.ImageID
+}
+
+// TouchSystem notes that the system with mac was seen netbooting from
+// ipAddr. It returns the address the system had if it moved, or "".
+func TouchSystem(d *sql.DB, mac, ipAddr string) (string, error) {
+	mac, err := NormalizeMAC(mac)
+	if err != nil {
+		return "", err
+	}
+	tx, err := d.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var id int64
+	err = tx.QueryRow(`SELECT id FROM systems WHERE mac = ? AND deleted_at IS NULL`, mac).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("touch system: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE systems SET last_seen_at = datetime('now'), updated_at = datetime('now') WHERE id = ?`, id); err != nil {
+		return "", fmt.Errorf("touch system: %w", err)
+	}
+	prev, err := observeIP(tx, id, ipAddr, IPSourceBoot)
+	if err != nil {
+		return "", err
+	}
+	return prev, tx.Commit()
+}
+
+// AutoRegister creates a system for mac if there is none and notes that it
+// was seen at ipAddr. It reports whether the system is new and, if it was
+// known and has moved, the address it had.
+func AutoRegister(d *sql.DB, mac, ipAddr string) (*System, bool, string, error) {
+	mac, err := NormalizeMAC(mac)
+	if err != nil {
+		return nil, false, "", err
+	}
+	if err := purgeTrashedMAC(d, mac); err != nil {
+		return nil, false, "", err
 	}
 	result, err := d.Exec(`INSERT OR IGNORE INTO systems (mac, ip_addr, last_seen_at) VALUES (?, ?, datetime('now'))`, mac, ipAddr)
 	if err != nil {
-		return nil, false, fmt.Errorf("auto-register: %w", err)
+		return nil, false, "", fmt.Errorf("auto-register: %w", err)
 	}
 	n, _ := result.RowsAffected()
 	isNew := n > 0
-	if !isNew {
-		TouchSystem(d, mac, ipAddr)
+	prevIP, err := TouchSystem(d, mac, ipAddr)
+	if err != nil {
+		return nil, false, "", err
 	}
 	sys, err := GetSystemByMAC(d, mac)
-	return sys, isNew, err
+	return sys, isNew, prevIP, err
 }
 
 func GetSystemByID(d *sql.DB, id int64) (*System, error) {
-	var s System
-	err := d.QueryRow(`
-		SELECT id, mac, hostname, image_id, profile_id, vars,
-		       ip_addr, COALESCE(last_seen_at, ''),
-		       state, COALESCE(state_changed_at, ''),
-		       created_at, updated_at
-		FROM systems WHERE id = ?`, id).Scan(
-		&s.ID, &s.MAC, &s.Hostname, &s.ImageID,
-		&s.ProfileID, &s.Vars,
-		&s.IPAddr, &s.LastSeenAt,
-		&s.State, &s.StateChangedAt,
-		&s.CreatedAt, &s.UpdatedAt)
+	s, err := scanSystem(d.QueryRow(`SELECT `+systemColumns+` FROM systems WHERE id = ? AND deleted_at IS NULL`, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &s, nil
+	return s, nil
+}
+
+// UpdateSystemIPXEClient records the iPXE build a system last booted with.
+func UpdateSystemIPXEClient(d *sql.DB, id int64, platform, buildArch, version, features string) error {
+	_, err := d.Exec(`UPDATE systems SET ipxe_platform = ?, ipxe_buildarch = ?, ipxe_version = ?, ipxe_features = ? WHERE id = ?`,
+		platform, buildArch, version, features, id)
+	if err != nil {
+		return fmt.Errorf("update system ipxe client: %w", err)
+	}
+	return nil
 }
 
 func UpdateSystemProfile(d *sql.DB, id int64, profileID *int64) error {
@@ -199,20 +491,41 @@ func UpdateSystemVars(d *sql.DB, id int64, vars string) error {
 	if vars == "" {
 		vars = "{}"
 	}
-	_, err := d.Exec(`UPDATE systems SET vars = ?, updated_at = datetime('now') WHERE id = ?`, vars, id)
+	vars, err := sealVars(vars)
+	if err != nil {
+		return err
+	}
+	_, err = d.Exec(`UPDATE systems SET vars = ?, updated_at = datetime('now') WHERE id = ?`, vars, id)
 	return err
 }
 
+// UpdateSystemTags replaces a system's tags.
+func UpdateSystemTags(d *sql.DB, id int64, tags string) error {
+	_, err := d.Exec(`UPDATE systems SET tags = ?, updated_at = datetime('now') WHERE id = ?`, NormalizeTags(tags), id)
+	if err != nil {
+		return fmt.Errorf("update system tags: %w", err)
+	}
+	return nil
+}
+
 func UpdateSystemInfo(d *sql.DB, id int64, mac, hostname string) error {
-	mac, err := normalizeMAC(mac)
+	mac, err := NormalizeMAC(mac)
 	if err != nil {
 		return err
 	}
+	if err := checkMACFree(d, id, mac); err != nil {
+		return err
+	}
+	if err := purgeTrashedMAC(d, mac); err != nil {
+		return err
+	}
 	_, err = d.Exec(`UPDATE systems SET mac = ?, hostname = ?, updated_at = datetime('now') WHERE id = ?`, mac, hostname, id)
 	return err
 }
 
+// DeleteSystem moves a system to the trash. It stays restorable until
+// PurgeSystem or the trash retention window removes it for good.
 func DeleteSystem(d *sql.DB, id int64) error {
-	_, err := d.Exec(`DELETE FROM systems WHERE id = ?`, id)
+	_, err := d.Exec(`UPDATE systems SET deleted_at = datetime('now'), updated_at = datetime('now') WHERE id = ? AND deleted_at IS NULL`, id)
 	return err
 }
@@ -0,0 +1,313 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Tenant is a team sharing the server. Its systems, images and profiles
+// are hidden from other tenants; the admin sees everything. Tenant ID 0
+// means none: admin-owned, and for images and profiles, shared by all.
+type Tenant struct {
+	ID          int64
+	Name        string
+	Description string
+	Subnets     string // CIDRs its systems may be answered on, one per line
+	CreatedAt   string
+}
+
+// TenantUser signs in to the web UI as a tenant.
+type TenantUser struct {
+	ID           int64
+	TenantID     int64
+	Username     string
+	PasswordHash string
+	Theme        string
+	CreatedAt    string
+}
+
+// APIToken lets scripts call the API as a tenant. Only a hash of the
+// token is kept.
+type APIToken struct {
+	ID         int64
+	TenantID   int64
+	Name       string
+	LastUsedAt string
+	CreatedAt  string
+}
+
+// APITokenPrefix starts every API token, telling them apart from other
+// bearer credentials.
+const APITokenPrefix = "duh_"
+
+// ErrTenantInUse is returned when deleting a tenant that still owns
+// systems, images or profiles.
+var ErrTenantInUse = errors.New("tenant is in use")
+
+const tenantColumns = `id, name, description, subnets, created_at`
+
+func scanTenant(row interface{ Scan(...any) error }) (*Tenant, error) {
+	var t Tenant
+	err := row.Scan(&t.ID, &t.Name, &t.Description, &t.Subnets, &t.CreatedAt)
+	return &t, err
+}
+
+func ListTenants(d *sql.DB) ([]Tenant, error) {
+	rows, err := d.Query(`SELECT ` + tenantColumns + ` FROM tenants ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("list tenants: %w", err)
+	}
+	defer rows.Close()
+	var tenants []Tenant
+	for rows.Next() {
+		t, err := scanTenant(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan tenant: %w", err)
+		}
+		tenants = append(tenants, *t)
+	}
+	return tenants, rows.Err()
+}
+
+func GetTenant(d *sql.DB, id int64) (*Tenant, error) {
+	t, err := scanTenant(d.QueryRow(`SELECT `+tenantColumns+` FROM tenants WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get tenant: %w", err)
+	}
+	return t, nil
+}
+
+// CreateTenant adds a tenant. Names follow the same rules as environment
+// names.
+func CreateTenant(d *sql.DB, name, description, subnets string) (int64, error) {
+	name, err := normalizeName("tenant", name)
+	if err != nil {
+		return 0, err
+	}
+	res, err := d.Exec(`INSERT INTO tenants (name, description, subnets) VALUES (?, ?, ?)`, name, description, subnets)
+	if err != nil {
+		return 0, fmt.Errorf("create tenant: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+func UpdateTenant(d *sql.DB, id int64, description, subnets string) error {
+	_, err := d.Exec(`UPDATE tenants SET description = ?, subnets = ? WHERE id = ?`, description, subnets, id)
+	if err != nil {
+		return fmt.Errorf("update tenant: %w", err)
+	}
+	return nil
+}
+
+// DeleteTenant removes a tenant that owns nothing, trashed items included,
+// along with its users and tokens.
+func DeleteTenant(d *sql.DB, id int64) error {
+	var n int
+	err := d.QueryRow(`SELECT (SELECT COUNT(*) FROM images WHERE tenant_id = ?1)
+		+ (SELECT COUNT(*) FROM profiles WHERE tenant_id = ?1)
+		+ (SELECT COUNT(*) FROM systems WHERE tenant_id = ?1)`, id).Scan(&n)
+	if err != nil {
+		return fmt.Errorf("count tenant members: %w", err)
+	}
+	if n > 0 {
+		return ErrTenantInUse
+	}
+	if _, err := d.Exec(`DELETE FROM tenants WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("delete tenant: %w", err)
+	}
+	return nil
+}
+
+// TenantOwner returns the tenant that owns a system, image or profile, and
+// whether it exists at all.
+func TenantOwner(d *sql.DB, kind string, id int64) (int64, bool, error) {
+	var table string
+	switch kind {
+	case "system":
+		table = "systems"
+	case "image":
+		table = "images"
+	case "profile":
+		table = "profiles"
+	default:
+		return 0, false, fmt.Errorf("unknown kind %q", kind)
+	}
+	var tenantID int64
+	err := d.QueryRow(`SELECT tenant_id FROM `+table+` WHERE id = ?`, id).Scan(&tenantID)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("get %s tenant: %w", kind, err)
+	}
+	return tenantID, true, nil
+}
+
+func UpdateSystemTenant(d *sql.DB, id, tenantID int64) error {
+	_, err := d.Exec(`UPDATE systems SET tenant_id = ?, updated_at = datetime('now') WHERE id = ?`, tenantID, id)
+	if err != nil {
+		return fmt.Errorf("update system tenant: %w", err)
+	}
+	return nil
+}
+
+func UpdateImageTenant(d *sql.DB, id, tenantID int64) error {
+	_, err := d.Exec(`UPDATE images SET tenant_id = ?, updated_at = datetime('now') WHERE id = ?`, tenantID, id)
+	if err != nil {
+		return fmt.Errorf("update image tenant: %w", err)
+	}
+	return nil
+}
+
+func UpdateProfileTenant(d *sql.DB, id, tenantID int64) error {
+	_, err := d.Exec(`UPDATE profiles SET tenant_id = ?, updated_at = datetime('now') WHERE id = ?`, tenantID, id)
+	if err != nil {
+		return fmt.Errorf("update profile tenant: %w", err)
+	}
+	return nil
+}
+
+const tenantUserColumns = `id, tenant_id, username, password_hash, theme, created_at`
+
+func scanTenantUser(row interface{ Scan(...any) error }) (*TenantUser, error) {
+	var u TenantUser
+	err := row.Scan(&u.ID, &u.TenantID, &u.Username, &u.PasswordHash, &u.Theme, &u.CreatedAt)
+	return &u, err
+}
+
+// ListTenantUsers returns every tenant's users.
+func ListTenantUsers(d *sql.DB) ([]TenantUser, error) {
+	rows, err := d.Query(`SELECT ` + tenantUserColumns + ` FROM tenant_users ORDER BY username`)
+	if err != nil {
+		return nil, fmt.Errorf("list tenant users: %w", err)
+	}
+	defer rows.Close()
+	var users []TenantUser
+	for rows.Next() {
+		u, err := scanTenantUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan tenant user: %w", err)
+		}
+		users = append(users, *u)
+	}
+	return users, rows.Err()
+}
+
+func GetTenantUser(d *sql.DB, id int64) (*TenantUser, error) {
+	u, err := scanTenantUser(d.QueryRow(`SELECT `+tenantUserColumns+` FROM tenant_users WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get tenant user: %w", err)
+	}
+	return u, nil
+}
+
+func GetTenantUserByName(d *sql.DB, username string) (*TenantUser, error) {
+	u, err := scanTenantUser(d.QueryRow(`SELECT `+tenantUserColumns+` FROM tenant_users WHERE username = ?`, username))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get tenant user: %w", err)
+	}
+	return u, nil
+}
+
+// CreateTenantUser adds a user to a tenant. "admin" is reserved for the
+// admin password.
+func CreateTenantUser(d *sql.DB, tenantID int64, username, passwordHash string) error {
+	username, err := normalizeName("user", username)
+	if err != nil {
+		return err
+	}
+	if username == "admin" {
+		return errors.New("the admin username is reserved")
+	}
+	_, err = d.Exec(`INSERT INTO tenant_users (tenant_id, username, password_hash) VALUES (?, ?, ?)`, tenantID, username, passwordHash)
+	if err != nil {
+		return fmt.Errorf("create tenant user: %w", err)
+	}
+	return nil
+}
+
+func UpdateTenantUserTheme(d *sql.DB, id int64, theme string) error {
+	if _, err := d.Exec(`UPDATE tenant_users SET theme = ? WHERE id = ?`, theme, id); err != nil {
+		return fmt.Errorf("update tenant user theme: %w", err)
+	}
+	return nil
+}
+
+func DeleteTenantUser(d *sql.DB, id int64) error {
+	if _, err := d.Exec(`DELETE FROM tenant_users WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("delete tenant user: %w", err)
+	}
+	return nil
+}
+
+// ListAPITokens returns every tenant's tokens.
+func ListAPITokens(d *sql.DB) ([]APIToken, error) {
+	rows, err := d.Query(`SELECT id, tenant_id, name, COALESCE(last_used_at, ''), created_at FROM api_tokens ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("list api tokens: %w", err)
+	}
+	defer rows.Close()
+	var tokens []APIToken
+	for rows.Next() {
+		var t APIToken
+		if err := rows.Scan(&t.ID, &t.TenantID, &t.Name, &t.LastUsedAt, &t.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan api token: %w", err)
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// CreateAPIToken issues a token for a tenant. The token itself is only
+// returned here.
+func CreateAPIToken(d *sql.DB, tenantID int64, name string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := APITokenPrefix + hex.EncodeToString(b)
+	_, err := d.Exec(`INSERT INTO api_tokens (tenant_id, name, token_hash) VALUES (?, ?, ?)`, tenantID, name, hashToken(token))
+	if err != nil {
+		return "", fmt.Errorf("create api token: %w", err)
+	}
+	return token, nil
+}
+
+// TenantForToken returns the tenant a token was issued to, or nil if it
+// isn't a valid token, and notes that it was used.
+func TenantForToken(d *sql.DB, token string) (*Tenant, error) {
+	var tenantID int64
+	err := d.QueryRow(`UPDATE api_tokens SET last_used_at = datetime('now') WHERE token_hash = ? RETURNING tenant_id`, hashToken(token)).Scan(&tenantID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get api token: %w", err)
+	}
+	return GetTenant(d, tenantID)
+}
+
+func DeleteAPIToken(d *sql.DB, id int64) error {
+	if _, err := d.Exec(`DELETE FROM api_tokens WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("delete api token: %w", err)
+	}
+	return nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// TPM attestation states.
+const (
+	TPMVerified   = "verified"   // the EK certificate chains to a trusted manufacturer CA
+	TPMApproved   = "approved"   // an admin vouched for the EK
+	TPMUnverified = "unverified" // enrolled, with no certificate or no CAs to check it against
+	TPMFailed     = "failed"     // the EK certificate didn't verify
+	TPMMismatch   = "mismatch"   // a later enrollment presented a different EK
+)
+
+// TPMEnrollment is the TPM a system enrolled with during early boot. The
+// first EK a system presents is pinned until an admin forgets it.
+type TPMEnrollment struct {
+	SystemID      int64
+	EKFingerprint string // hex SHA-256 of the EK's PKIX public key
+	EKCert        string // PEM, "" if none was sent
+	EKPub         string // PEM
+	AKPub         string // as sent
+	Status        string
+	Detail        string // why it isn't verified, if it isn't
+	EnrolledAt    string
+	UpdatedAt     string
+}
+
+// Attested reports whether the system's TPM passed attestation.
+func (t *TPMEnrollment) Attested() bool {
+	return t != nil && (t.Status == TPMVerified || t.Status == TPMApproved)
+}
+
+// GetTPMEnrollment returns a system's TPM enrollment, or nil if it has
+// none.
+func GetTPMEnrollment(d *sql.DB, systemID int64) (*TPMEnrollment, error) {
+	t := TPMEnrollment{SystemID: systemID}
+	err := d.QueryRow(`SELECT ek_fingerprint, ek_cert, ek_pub, ak_pub, status, detail, datetime(enrolled_at), datetime(updated_at)
+		FROM system_tpm WHERE system_id = ?`, systemID).
+		Scan(&t.EKFingerprint, &t.EKCert, &t.EKPub, &t.AKPub, &t.Status, &t.Detail, &t.EnrolledAt, &t.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get tpm enrollment: %w", err)
+	}
+	return &t, nil
+}
+
+// SaveTPMEnrollment records a system's TPM, replacing its keys and status.
+func SaveTPMEnrollment(d *sql.DB, t *TPMEnrollment) error {
+	_, err := d.Exec(`INSERT INTO system_tpm (system_id, ek_fingerprint, ek_cert, ek_pub, ak_pub, status, detail)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(system_id) DO UPDATE SET ek_fingerprint = excluded.ek_fingerprint, ek_cert = excluded.ek_cert,
+		ek_pub = excluded.ek_pub, ak_pub = excluded.ak_pub, status = excluded.status, detail = excluded.detail,
+		updated_at = datetime('now')`,
+		t.SystemID, t.EKFingerprint, t.EKCert, t.EKPub, t.AKPub, t.Status, t.Detail)
+	if err != nil {
+		return fmt.Errorf("save tpm enrollment: %w", err)
+	}
+	return nil
+}
+
+// SetTPMStatus changes the attestation status of a system's TPM, leaving
+// its keys as they are.
+func SetTPMStatus(d *sql.DB, systemID int64, status, detail string) error {
+	_, err := d.Exec(`UPDATE system_tpm SET status = ?, detail = ?, updated_at = datetime('now') WHERE system_id = ?`,
+		status, detail, systemID)
+	if err != nil {
+		return fmt.Errorf("set tpm status: %w", err)
+	}
+	return nil
+}
+
+// DeleteTPMEnrollment forgets a system's TPM, so its next enrollment is
+// pinned afresh, as after a motherboard swap.
+func DeleteTPMEnrollment(d *sql.DB, systemID int64) error {
+	if _, err := d.Exec(`DELETE FROM system_tpm WHERE system_id = ?`, systemID); err != nil {
+		return fmt.Errorf("delete tpm enrollment: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// transferHistoryLimit is how many file fetches a system's transfer
+// history keeps.
+const transferHistoryLimit = 50
+
+// Transfer is one fetch of an image file by a booting system.
+type Transfer struct {
+	ID        int64
+	File      string
+	ClientIP  string
+	Bytes     int64 // sent
+	Size      int64 // the response should have carried
+	Millis    int64
+	Error     string // why it stopped short, or "" if it finished
+	CreatedAt string
+}
+
+// RecordTransfer notes a fetch in a system's transfer history.
+func RecordTransfer(d *sql.DB, systemID int64, t *Transfer) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return fmt.Errorf("record transfer: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT INTO system_transfers (system_id, file, client_ip, bytes, size, millis, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		systemID, t.File, t.ClientIP, t.Bytes, t.Size, t.Millis, t.Error); err != nil {
+		return fmt.Errorf("record transfer: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM system_transfers WHERE system_id = ? AND id NOT IN (
+		SELECT id FROM system_transfers WHERE system_id = ? ORDER BY id DESC LIMIT ?)`,
+		systemID, systemID, transferHistoryLimit); err != nil {
+		return fmt.Errorf("prune transfer history: %w", err)
+	}
+	return tx.Commit()
+}
+
+// ListTransfers returns a system's recent file fetches, newest first.
+func ListTransfers(d *sql.DB, systemID int64) ([]Transfer, error) {
+	rows, err := d.Query(`SELECT id, file, client_ip, bytes, size, millis, error, datetime(created_at)
+		FROM system_transfers WHERE system_id = ? ORDER BY id DESC`, systemID)
+	if err != nil {
+		return nil, fmt.Errorf("list transfers: %w", err)
+	}
+	defer rows.Close()
+	var transfers []Transfer
+	for rows.Next() {
+		var t Transfer
+		if err := rows.Scan(&t.ID, &t.File, &t.ClientIP, &t.Bytes, &t.Size, &t.Millis, &t.Error, &t.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan transfer: %w", err)
+		}
+		transfers = append(transfers, t)
+	}
+	return transfers, rows.Err()
+}
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// What a transition does when a system changes state.
+const (
+	TransitionActionWebhook = "webhook" // send the state event to one webhook; param is its ID
+	TransitionActionWake    = "wake"    // send a Wake-on-LAN packet; param is an optional broadcast address
+	TransitionActionRedfish = "redfish" // PXE boot through the system's BMC; param is the reset type
+	TransitionActionTimer   = "timer"   // param "<duration> <state>": move on if still in the state then
+	TransitionActionOneshot = "oneshot" // boot an image once; param is its ID
+)
+
+// Transition is an action run when a system enters ToState, from FromState
+// or, when that is empty, from any state.
+type Transition struct {
+	ID        int64
+	FromState string
+	ToState   string
+	Action    string
+	Param     string
+	Enabled   bool
+	CreatedAt string
+}
+
+const transitionColumns = `id, from_state, to_state, action, param, enabled, created_at`
+
+func queryTransitions(d *sql.DB, query string, args ...any) ([]Transition, error) {
+	rows, err := d.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list transitions: %w", err)
+	}
+	defer rows.Close()
+	var out []Transition
+	for rows.Next() {
+		var t Transition
+		if err := rows.Scan(&t.ID, &t.FromState, &t.ToState, &t.Action, &t.Param, &t.Enabled, &t.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan transition: %w", err)
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// ListTransitions returns every transition in the order they run.
+func ListTransitions(d *sql.DB) ([]Transition, error) {
+	return queryTransitions(d, `SELECT `+transitionColumns+` FROM transitions ORDER BY to_state, id`)
+}
+
+// TransitionsFor returns the enabled transitions for a move from one state
+// to another. from is empty when the previous state isn't known, as for a
+// newly discovered system, and then only matches any-state transitions.
+func TransitionsFor(d *sql.DB, from, to string) ([]Transition, error) {
+	return queryTransitions(d, `SELECT `+transitionColumns+` FROM transitions
+		WHERE enabled = 1 AND to_state = ? AND from_state IN ('', ?) ORDER BY id`, to, from)
+}
+
+func CreateTransition(d *sql.DB, from, to, action, param string) (int64, error) {
+	result, err := d.Exec(`INSERT INTO transitions (from_state, to_state, action, param) VALUES (?, ?, ?, ?)`,
+		from, to, action, param)
+	if err != nil {
+		return 0, fmt.Errorf("create transition: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+// ToggleTransition turns a transition on or off.
+func ToggleTransition(d *sql.DB, id int64) error {
+	_, err := d.Exec(`UPDATE transitions SET enabled = 1 - enabled WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("toggle transition: %w", err)
+	}
+	return nil
+}
+
+func DeleteTransition(d *sql.DB, id int64) error {
+	_, err := d.Exec(`DELETE FROM transitions WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("delete transition: %w", err)
+	}
+	return nil
+}
+
+// SystemTimer moves a system from State to ToState at FireAt, unless it
+// has left State in the meantime.
+type SystemTimer struct {
+	ID       int64
+	SystemID int64
+	MAC      string
+	State    string
+	ToState  string
+}
+
+// StartSystemTimer sets a timer for a system now in state.
+func StartSystemTimer(d *sql.DB, systemID int64, state, toState string, after time.Duration) error {
+	_, err := d.Exec(`INSERT INTO system_timers (system_id, state, to_state, fire_at) VALUES (?, ?, ?, datetime('now', ?))`,
+		systemID, state, toState, fmt.Sprintf("+%d seconds", int(after.Seconds())))
+	if err != nil {
+		return fmt.Errorf("start timer: %w", err)
+	}
+	return nil
+}
+
+// TakeDueTimers removes and returns the timers that are due. Timers whose
+// system has since left the state, or left and come back, are dropped.
+func TakeDueTimers(d *sql.DB) ([]SystemTimer, error) {
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM system_timers WHERE id IN (
+		SELECT t.id FROM system_timers t JOIN systems s ON s.id = t.system_id
+		WHERE s.deleted_at IS NOT NULL OR s.state != t.state OR s.state_changed_at > t.created_at)`)
+	if err != nil {
+		return nil, fmt.Errorf("drop stale timers: %w", err)
+	}
+	rows, err := tx.Query(`SELECT t.id, t.system_id, s.mac, t.state, t.to_state
+		FROM system_timers t JOIN systems s ON s.id = t.system_id
+		WHERE t.fire_at <= datetime('now') ORDER BY t.fire_at`)
+	if err != nil {
+		return nil, fmt.Errorf("list due timers: %w", err)
+	}
+	var due []SystemTimer
+	for rows.Next() {
+		var t SystemTimer
+		if err := rows.Scan(&t.ID, &t.SystemID, &t.MAC, &t.State, &t.ToState); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan timer: %w", err)
+		}
+		due = append(due, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, t := range due {
+		if _, err := tx.Exec(`DELETE FROM system_timers WHERE id = ?`, t.ID); err != nil {
+			return nil, fmt.Errorf("remove timer: %w", err)
+		}
+	}
+	return due, tx.Commit()
+}
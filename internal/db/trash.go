@@ -0,0 +1,103 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// DefaultTrashRetentionDays is how long soft-deleted rows are kept when the
+// trash_retention_days setting is unset.
+const DefaultTrashRetentionDays = 30
+
+// purgeTrashedMAC permanently removes a trashed system holding mac so the
+// address can be registered again.
+func purgeTrashedMAC(d *sql.DB, mac string) error {
+	_, err := d.Exec(`DELETE FROM systems WHERE mac = ? AND deleted_at IS NOT NULL`, mac)
+	if err != nil {
+		return fmt.Errorf("purge trashed system: %w", err)
+	}
+	return nil
+}
+
+func ListTrashedSystems(d *sql.DB) ([]System, error) {
+	return querySystems(d, `SELECT `+systemColumns+` FROM systems WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC`)
+}
+
+func ListTrashedImages(d *sql.DB) ([]Image, error) {
+	return queryImages(d, `SELECT `+imageColumns+` FROM images WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC`)
+}
+
+func ListTrashedProfiles(d *sql.DB) ([]Profile, error) {
+	return queryProfiles(d, `SELECT `+profileColumns+` FROM profiles WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC`)
+}
+
+// trashTables maps the kinds accepted by RestoreTrashed and PurgeTrashed to
+// their tables.
+var trashTables = map[string]string{
+	"system":  "systems",
+	"image":   "images",
+	"profile": "profiles",
+}
+
+// RestoreTrashed brings a trashed system, image or profile back. It returns
+// false if no trashed row matched.
+func RestoreTrashed(d *sql.DB, kind string, id int64) (bool, error) {
+	table, ok := trashTables[kind]
+	if !ok {
+		return false, fmt.Errorf("unknown trash kind %q", kind)
+	}
+	result, err := d.Exec(`UPDATE `+table+` SET deleted_at = NULL, updated_at = datetime('now') WHERE id = ? AND deleted_at IS NOT NULL`, id)
+	if err != nil {
+		return false, fmt.Errorf("restore %s: %w", kind, err)
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// PurgeTrashed permanently deletes a trashed row. Callers are responsible
+// for removing any files that belonged to it.
+func PurgeTrashed(d *sql.DB, kind string, id int64) (bool, error) {
+	table, ok := trashTables[kind]
+	if !ok {
+		return false, fmt.Errorf("unknown trash kind %q", kind)
+	}
+	result, err := d.Exec(`DELETE FROM `+table+` WHERE id = ? AND deleted_at IS NOT NULL`, id)
+	if err != nil {
+		return false, fmt.Errorf("purge %s: %w", kind, err)
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// PurgeImage permanently deletes an image whether or not it is trashed.
+func PurgeImage(d *sql.DB, id int64) error {
+	_, err := d.Exec(`DELETE FROM images WHERE id = ?`, id)
+	return err
+}
+
+// ExpiredTrash lists the IDs of each kind that were trashed more than
+// retentionDays ago.
+func ExpiredTrash(d *sql.DB, retentionDays int) (map[string][]int64, error) {
+	cutoff := fmt.Sprintf("-%d days", retentionDays)
+	expired := make(map[string][]int64)
+	for kind, table := range trashTables {
+		rows, err := d.Query(`SELECT id FROM `+table+` WHERE deleted_at IS NOT NULL AND deleted_at < datetime('now', ?)`, cutoff)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			expired[kind] = append(expired[kind], id)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return expired, nil
+}
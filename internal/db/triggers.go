@@ -0,0 +1,140 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+)
+
+// What an inbound trigger does when it is called.
+const (
+	TriggerActionQueue   = "queue"   // queue the systems tagged with param for provisioning
+	TriggerActionCatalog = "catalog" // refresh pulled images from the catalog
+	TriggerActionSync    = "sync"    // run an inventory sync; param is "netbox" or "vms"
+)
+
+// TriggerTokenPrefix starts every trigger token, telling them apart from
+// API tokens.
+const TriggerTokenPrefix = "duhtrg_"
+
+// Trigger is an action an external system runs by calling
+// /api/v1/triggers/{Name} with the trigger's token. Only a hash of the
+// token is kept.
+type Trigger struct {
+	ID          int64
+	Name        string
+	Action      string
+	Param       string
+	Enabled     bool
+	LastFiredAt string
+	CreatedAt   string
+}
+
+const triggerColumns = `id, name, action, param, enabled, COALESCE(last_fired_at, ''), created_at`
+
+func scanTrigger(row interface{ Scan(...any) error }) (*Trigger, error) {
+	var t Trigger
+	if err := row.Scan(&t.ID, &t.Name, &t.Action, &t.Param, &t.Enabled, &t.LastFiredAt, &t.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ListTriggers returns every trigger by name.
+func ListTriggers(d *sql.DB) ([]Trigger, error) {
+	rows, err := d.Query(`SELECT ` + triggerColumns + ` FROM triggers ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("list triggers: %w", err)
+	}
+	defer rows.Close()
+	var out []Trigger
+	for rows.Next() {
+		t, err := scanTrigger(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan trigger: %w", err)
+		}
+		out = append(out, *t)
+	}
+	return out, rows.Err()
+}
+
+// GetTrigger returns a trigger, or nil if there is none with that ID.
+func GetTrigger(d *sql.DB, id int64) (*Trigger, error) {
+	t, err := scanTrigger(d.QueryRow(`SELECT `+triggerColumns+` FROM triggers WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get trigger: %w", err)
+	}
+	return t, nil
+}
+
+// CreateTrigger adds an enabled trigger and issues its token, which is
+// only returned here.
+func CreateTrigger(d *sql.DB, name, action, param string) (string, error) {
+	name, err := normalizeName("trigger", name)
+	if err != nil {
+		return "", err
+	}
+	token, err := newTriggerToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = d.Exec(`INSERT INTO triggers (name, action, param, token_hash) VALUES (?, ?, ?, ?)`,
+		name, action, param, hashToken(token))
+	if err != nil {
+		return "", fmt.Errorf("create trigger: %w", err)
+	}
+	return token, nil
+}
+
+// RotateTriggerToken issues a trigger a new token, revoking its old one.
+func RotateTriggerToken(d *sql.DB, id int64) (string, error) {
+	token, err := newTriggerToken()
+	if err != nil {
+		return "", err
+	}
+	if _, err := d.Exec(`UPDATE triggers SET token_hash = ? WHERE id = ?`, hashToken(token), id); err != nil {
+		return "", fmt.Errorf("rotate trigger token: %w", err)
+	}
+	return token, nil
+}
+
+// TriggerForToken returns the enabled trigger with the given name if token
+// is its token, or nil otherwise, and notes that it fired.
+func TriggerForToken(d *sql.DB, name, token string) (*Trigger, error) {
+	t, err := scanTrigger(d.QueryRow(`UPDATE triggers SET last_fired_at = datetime('now')
+		WHERE name = ? AND token_hash = ? AND enabled = 1 RETURNING `+triggerColumns, name, hashToken(token)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get trigger: %w", err)
+	}
+	return t, nil
+}
+
+// ToggleTrigger turns a trigger on or off.
+func ToggleTrigger(d *sql.DB, id int64) error {
+	if _, err := d.Exec(`UPDATE triggers SET enabled = 1 - enabled WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("toggle trigger: %w", err)
+	}
+	return nil
+}
+
+func DeleteTrigger(d *sql.DB, id int64) error {
+	if _, err := d.Exec(`DELETE FROM triggers WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("delete trigger: %w", err)
+	}
+	return nil
+}
+
+func newTriggerToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return TriggerTokenPrefix + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Usage counts the successful provisions made with an image or profile.
+type Usage struct {
+	Provisions int    `json:"provisions"`
+	LastUsed   string `json:"last_used"` // when the latest one finished; "" if never
+}
+
+// UsedSince reports whether the latest provision finished within d.
+func (u Usage) UsedSince(d time.Duration) bool {
+	last, err := time.Parse(time.DateTime, u.LastUsed)
+	return err == nil && time.Since(last) < d
+}
+
+// usageBy counts successful attempts grouped by column, which must be
+// image_id or profile_id.
+func usageBy(d *sql.DB, column string) (map[int64]Usage, error) {
+	rows, err := d.Query(`SELECT ` + column + `, COUNT(*), COALESCE(strftime('%Y-%m-%d %H:%M:%S', MAX(finished_at)), '')
+		FROM provision_attempts WHERE state = 'ready' AND ` + column + ` IS NOT NULL GROUP BY ` + column)
+	if err != nil {
+		return nil, fmt.Errorf("count usage: %w", err)
+	}
+	defer rows.Close()
+	out := map[int64]Usage{}
+	for rows.Next() {
+		var id int64
+		var u Usage
+		if err := rows.Scan(&id, &u.Provisions, &u.LastUsed); err != nil {
+			return nil, fmt.Errorf("scan usage: %w", err)
+		}
+		out[id] = u
+	}
+	return out, rows.Err()
+}
+
+// ImageUsage returns the usage of every image that has been provisioned.
+func ImageUsage(d *sql.DB) (map[int64]Usage, error) {
+	return usageBy(d, "image_id")
+}
+
+// ProfileUsage returns the usage of every profile that has been
+// provisioned.
+func ProfileUsage(d *sql.DB) (map[int64]Usage, error) {
+	return usageBy(d, "profile_id")
+}
+
+// GetImageUsage returns one image's usage.
+func GetImageUsage(d *sql.DB, id int64) (Usage, error) {
+	return usageOf(d, "image_id", id)
+}
+
+// GetProfileUsage returns one profile's usage.
+func GetProfileUsage(d *sql.DB, id int64) (Usage, error) {
+	return usageOf(d, "profile_id", id)
+}
+
+func usageOf(d *sql.DB, column string, id int64) (Usage, error) {
+	var u Usage
+	err := d.QueryRow(`SELECT COUNT(*), COALESCE(strftime('%Y-%m-%d %H:%M:%S', MAX(finished_at)), '')
+		FROM provision_attempts WHERE state = 'ready' AND `+column+` = ?`, id).Scan(&u.Provisions, &u.LastUsed)
+	if err != nil {
+		return u, fmt.Errorf("count usage: %w", err)
+	}
+	return u, nil
+}
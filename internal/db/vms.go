@@ -0,0 +1,41 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// VMLink ties a system to the virtual machine it was synced from.
+type VMLink struct {
+	SystemID int64
+	Provider string // "proxmox" or "libvirt"
+	VMID     string
+	VMName   string
+	SyncedAt string
+}
+
+// GetVMLink returns the VM a system was synced from, or nil.
+func GetVMLink(d *sql.DB, systemID int64) (*VMLink, error) {
+	var l VMLink
+	err := d.QueryRow(`SELECT system_id, provider, vm_id, vm_name, synced_at FROM vm_links WHERE system_id = ?`, systemID).
+		Scan(&l.SystemID, &l.Provider, &l.VMID, &l.VMName, &l.SyncedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get vm link: %w", err)
+	}
+	return &l, nil
+}
+
+// SetVMLink records the VM a system was synced from, replacing any earlier link.
+func SetVMLink(d *sql.DB, systemID int64, provider, vmID, vmName string) error {
+	_, err := d.Exec(`INSERT INTO vm_links (system_id, provider, vm_id, vm_name) VALUES (?, ?, ?, ?)
+		ON CONFLICT(system_id) DO UPDATE SET provider = excluded.provider, vm_id = excluded.vm_id,
+		vm_name = excluded.vm_name, synced_at = datetime('now')`,
+		systemID, provider, vmID, vmName)
+	if err != nil {
+		return fmt.Errorf("set vm link: %w", err)
+	}
+	return nil
+}
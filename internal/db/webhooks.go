@@ -1,19 +1,46 @@
 package db
 
-import "database/sql"
+import (
+	"database/sql"
+	"fmt"
+)
+
+// How a webhook's events are delivered.
+const (
+	WebhookImmediate = "immediate" // each event as it happens
+	WebhookBatch     = "batch"     // events collected for BatchInterval and sent together
+	WebhookDigest    = "digest"    // events collected for a day and sent together
+)
 
 type Webhook struct {
-	ID        int64
-	URL       string
-	Secret    string
-	Events    string
-	Enabled   bool
-	CreatedAt string
-	UpdatedAt string
+	ID            int64
+	URL           string
+	Secret        string
+	Events        string
+	Filter        string // expression events must also match; "" matches all
+	Mode          string
+	BatchInterval int // seconds, for WebhookBatch
+	Enabled       bool
+	CreatedAt     string
+	UpdatedAt     string
 }
 
-func ListWebhooks(d *sql.DB) ([]Webhook, error) {
-	rows, err := d.Query(`SELECT id, url, secret, events, enabled, created_at, updated_at FROM webhooks ORDER BY id DESC`)
+const webhookColumns = `id, url, secret, events, filter, mode, batch_interval, enabled, created_at, updated_at`
+
+func scanWebhook(row interface{ Scan(...any) error }) (*Webhook, error) {
+	var w Webhook
+	err := row.Scan(&w.ID, &w.URL, &w.Secret, &w.Events, &w.Filter, &w.Mode, &w.BatchInterval, &w.Enabled, &w.CreatedAt, &w.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if w.Secret, err = unseal(w.Secret); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func queryWebhooks(d *sql.DB, query string) ([]Webhook, error) {
+	rows, err := d.Query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -21,43 +48,79 @@ func ListWebhooks(d *sql.DB) ([]Webhook, error) {
 
 	var webhooks []Webhook
 	for rows.Next() {
-		var w Webhook
-		if err := rows.Scan(&w.ID, &w.URL, &w.Secret, &w.Events, &w.Enabled, &w.CreatedAt, &w.UpdatedAt); err != nil {
+		w, err := scanWebhook(rows)
+		if err != nil {
 			return nil, err
 		}
-		webhooks = append(webhooks, w)
+		webhooks = append(webhooks, *w)
 	}
 	return webhooks, rows.Err()
 }
 
+func ListWebhooks(d *sql.DB) ([]Webhook, error) {
+	return queryWebhooks(d, `SELECT `+webhookColumns+` FROM webhooks ORDER BY id DESC`)
+}
+
 func GetWebhook(d *sql.DB, id int64) (*Webhook, error) {
-	var w Webhook
-	err := d.QueryRow(`SELECT id, url, secret, events, enabled, created_at, updated_at FROM webhooks WHERE id = ?`, id).
-		Scan(&w.ID, &w.URL, &w.Secret, &w.Events, &w.Enabled, &w.CreatedAt, &w.UpdatedAt)
+	w, err := scanWebhook(d.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE id = ?`, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &w, nil
+	return w, nil
 }
 
-func CreateWebhook(d *sql.DB, url, secret, events string) (int64, error) {
-	result, err := d.Exec(`INSERT INTO webhooks (url, secret, events) VALUES (?, ?, ?)`, url, secret, events)
+// NormalizeWebhookMode checks a webhook's delivery mode, defaulting it to
+// immediate. Batches need an interval of at least a second; other modes
+// don't keep one.
+func NormalizeWebhookMode(w *Webhook) error {
+	switch w.Mode {
+	case "":
+		w.Mode = WebhookImmediate
+		w.BatchInterval = 0
+	case WebhookImmediate, WebhookDigest:
+		w.BatchInterval = 0
+	case WebhookBatch:
+		if w.BatchInterval < 1 {
+			return fmt.Errorf("a batched webhook needs an interval of at least one second")
+		}
+	default:
+		return fmt.Errorf("invalid delivery mode %q", w.Mode)
+	}
+	return nil
+}
+
+// CreateWebhook adds a webhook, enabled.
+func CreateWebhook(d *sql.DB, w *Webhook) (int64, error) {
+	if err := NormalizeWebhookMode(w); err != nil {
+		return 0, err
+	}
+	secret, err := seal(w.Secret)
+	if err != nil {
+		return 0, err
+	}
+	result, err := d.Exec(`INSERT INTO webhooks (url, secret, events, filter, mode, batch_interval) VALUES (?, ?, ?, ?, ?, ?)`,
+		w.URL, secret, w.Events, w.Filter, w.Mode, w.BatchInterval)
 	if err != nil {
 		return 0, err
 	}
 	return result.LastInsertId()
 }
 
-func UpdateWebhook(d *sql.DB, id int64, url, secret, events string, enabled bool) error {
-	enabledVal := 0
-	if enabled {
-		enabledVal = 1
+// UpdateWebhook saves a webhook's fields.
+func UpdateWebhook(d *sql.DB, w *Webhook) error {
+	if err := NormalizeWebhookMode(w); err != nil {
+		return err
+	}
+	secret, err := seal(w.Secret)
+	if err != nil {
+		return err
 	}
-	_, err := d.Exec(`UPDATE webhooks SET url = ?, secret = ?, events = ?, enabled = ?, updated_at = datetime('now') WHERE id = ?`,
-		url, secret, events, enabledVal, id)
+	_, err = d.Exec(`UPDATE webhooks SET url = ?, secret = ?, events = ?, filter = ?, mode = ?, batch_interval = ?, enabled = ?,
+		updated_at = datetime('now') WHERE id = ?`,
+		w.URL, secret, w.Events, w.Filter, w.Mode, w.BatchInterval, w.Enabled, w.ID)
 	return err
 }
 
@@ -67,19 +130,69 @@ func DeleteWebhook(d *sql.DB, id int64) error {
 }
 
 func ListEnabledWebhooks(d *sql.DB) ([]Webhook, error) {
-	rows, err := d.Query(`SELECT id, url, secret, events, enabled, created_at, updated_at FROM webhooks WHERE enabled = 1 ORDER BY id`)
+	return queryWebhooks(d, `SELECT `+webhookColumns+` FROM webhooks WHERE enabled = 1 ORDER BY id`)
+}
+
+// PendingEvent is an event held for a batched or digest webhook until its
+// batch is sent.
+type PendingEvent struct {
+	ID        int64
+	Event     string // JSON
+	CreatedAt string
+}
+
+// AddPendingEvent holds an event, as JSON, for a webhook's next batch.
+func AddPendingEvent(d *sql.DB, webhookID int64, event string) error {
+	if _, err := d.Exec(`INSERT INTO webhook_pending (webhook_id, event) VALUES (?, ?)`, webhookID, event); err != nil {
+		return fmt.Errorf("hold webhook event: %w", err)
+	}
+	return nil
+}
+
+// ListPendingEvents returns up to limit of a webhook's held events, oldest
+// first.
+func ListPendingEvents(d *sql.DB, webhookID int64, limit int) ([]PendingEvent, error) {
+	rows, err := d.Query(`SELECT id, event, created_at FROM webhook_pending WHERE webhook_id = ? ORDER BY id LIMIT ?`,
+		webhookID, limit)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("list held webhook events: %w", err)
 	}
 	defer rows.Close()
+	var events []PendingEvent
+	for rows.Next() {
+		var e PendingEvent
+		if err := rows.Scan(&e.ID, &e.Event, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan held webhook event: %w", err)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
 
-	var webhooks []Webhook
+// DeletePendingEvents drops a webhook's held events up to and including
+// upToID, once they have been sent.
+func DeletePendingEvents(d *sql.DB, webhookID, upToID int64) error {
+	if _, err := d.Exec(`DELETE FROM webhook_pending WHERE webhook_id = ? AND id <= ?`, webhookID, upToID); err != nil {
+		return fmt.Errorf("delete held webhook events: %w", err)
+	}
+	return nil
+}
+
+// CountPendingEvents returns how many events each webhook holds.
+func CountPendingEvents(d *sql.DB) (map[int64]int, error) {
+	rows, err := d.Query(`SELECT webhook_id, COUNT(*) FROM webhook_pending GROUP BY webhook_id`)
+	if err != nil {
+		return nil, fmt.Errorf("count held webhook events: %w", err)
+	}
+	defer rows.Close()
+	counts := map[int64]int{}
 	for rows.Next() {
-		var w Webhook
-		if err := rows.Scan(&w.ID, &w.URL, &w.Secret, &w.Events, &w.Enabled, &w.CreatedAt, &w.UpdatedAt); err != nil {
-			return nil, err
+		var id int64
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, fmt.Errorf("scan held webhook events: %w", err)
 		}
-		webhooks = append(webhooks, w)
+		counts[id] = n
 	}
-	return webhooks, rows.Err()
+	return counts, rows.Err()
 }
@@ -0,0 +1,436 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+)
+
+// A system's console comes from one of two sources: its BMC's
+// serial-over-LAN, through ipmitool, or duh-agent on the host, which
+// streams a console command it was configured with. Either way, what it
+// prints is relayed to every browser watching over a WebSocket, and typed
+// input, when console_input is on, goes back the other way.
+
+// Console sources.
+const (
+	consoleSOL   = "sol"
+	consoleAgent = "agent"
+)
+
+// consoleBacklog is how much recent output a viewer who joins late sees.
+const consoleBacklog = 64 << 10
+
+// consoleLinger is how long a source is kept running after the last viewer
+// leaves, so reloading the page doesn't restart it.
+const consoleLinger = 30 * time.Second
+
+type consoleHub struct {
+	mu       sync.Mutex
+	sessions map[int64]*consoleSession
+}
+
+// consoleSession is one system's console, shared by everyone watching it.
+type consoleSession struct {
+	kind    string // consoleSOL or consoleAgent
+	backlog []byte
+	viewers map[chan consoleFrame]bool
+	input   chan []byte
+	stop    func() // stops the running source; nil until one attaches
+	linger  *time.Timer
+}
+
+// consoleFrame is a WebSocket message for viewers: console output as
+// binary, status as JSON text.
+type consoleFrame struct {
+	op   byte
+	data []byte
+}
+
+func statusFrame(status, message string) consoleFrame {
+	b, _ := json.Marshal(map[string]string{"status": status, "message": message})
+	return consoleFrame{op: wsText, data: b}
+}
+
+// join adds a viewer to sys's session, creating it for kind if there
+// isn't one. It returns the viewer's channel, primed with the backlog, and
+// whether the session was new and so needs its source started.
+func (h *consoleHub) join(sysID int64, kind string) (*consoleSession, chan consoleFrame, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessions == nil {
+		h.sessions = make(map[int64]*consoleSession)
+	}
+	cs := h.sessions[sysID]
+	created := cs == nil
+	if created {
+		cs = &consoleSession{kind: kind, viewers: map[chan consoleFrame]bool{}, input: make(chan []byte, 16)}
+		h.sessions[sysID] = cs
+	}
+	if cs.linger != nil {
+		cs.linger.Stop()
+		cs.linger = nil
+	}
+	ch := make(chan consoleFrame, 64)
+	if len(cs.backlog) > 0 {
+		ch <- consoleFrame{op: wsBinary, data: append([]byte(nil), cs.backlog...)}
+	}
+	cs.viewers[ch] = true
+	return cs, ch, created
+}
+
+// leave removes a viewer. The session ends consoleLinger after its last
+// viewer leaves.
+func (h *consoleHub) leave(sysID int64, cs *consoleSession, ch chan consoleFrame) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(cs.viewers, ch)
+	if len(cs.viewers) > 0 || h.sessions[sysID] != cs {
+		return
+	}
+	cs.linger = time.AfterFunc(consoleLinger, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if len(cs.viewers) > 0 || h.sessions[sysID] != cs {
+			return
+		}
+		delete(h.sessions, sysID)
+		if cs.stop != nil {
+			cs.stop()
+		}
+	})
+}
+
+// sendLocked passes a frame to every viewer, dropping any who can't keep up.
+// Output is also kept in the backlog. The caller holds h.mu.
+func (h *consoleHub) sendLocked(cs *consoleSession, f consoleFrame) {
+	if f.op == wsBinary {
+		cs.backlog = append(cs.backlog, f.data...)
+		if n := len(cs.backlog) - consoleBacklog; n > 0 {
+			cs.backlog = append(cs.backlog[:0], cs.backlog[n:]...)
+		}
+	}
+	for ch := range cs.viewers {
+		select {
+		case ch <- f:
+		default:
+			delete(cs.viewers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (h *consoleHub) send(cs *consoleSession, f consoleFrame) {
+	h.mu.Lock()
+	h.sendLocked(cs, f)
+	h.mu.Unlock()
+}
+
+// attach makes stop the way to end sys's running source. It fails when
+// nobody is waiting for a console of that kind or one is already attached.
+func (h *consoleHub) attach(sysID int64, kind string, stop func()) (*consoleSession, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cs := h.sessions[sysID]
+	if cs == nil || cs.kind != kind {
+		return nil, errors.New("no one is watching this console")
+	}
+	if cs.stop != nil {
+		return nil, errors.New("the console is already attached")
+	}
+	cs.stop = stop
+	h.sendLocked(cs, statusFrame("connected", "Connected to the "+consoleSourceName(kind)+"."))
+	return cs, nil
+}
+
+// detach records that a session's source ended, and ends the session so
+// the next viewer starts a new one.
+func (h *consoleHub) detach(sysID int64, cs *consoleSession, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessions[sysID] == cs {
+		delete(h.sessions, sysID)
+	}
+	h.sendLocked(cs, statusFrame("closed", reason))
+	for ch := range cs.viewers {
+		delete(cs.viewers, ch)
+		close(ch)
+	}
+}
+
+// waiting reports whether a viewer is waiting for sys's agent to attach
+// its console.
+func (h *consoleHub) waiting(sysID int64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cs := h.sessions[sysID]
+	return cs != nil && cs.kind == consoleAgent && cs.stop == nil && len(cs.viewers) > 0
+}
+
+func consoleSourceName(kind string) string {
+	if kind == consoleSOL {
+		return "BMC's serial-over-LAN"
+	}
+	return "host's duh-agent"
+}
+
+// solTarget is where a system's serial-over-LAN is reached.
+type solTarget struct {
+	Host, User, Password string
+}
+
+// solTargetFor reads sys's BMC from its ipmi_host, ipmi_user and
+// ipmi_password vars, falling back to the host and credentials of its
+// Redfish vars. ok is false when sys has no BMC or ipmitool isn't
+// installed.
+func solTargetFor(sys *db.System) (t solTarget, ok bool) {
+	vars := map[string]any{}
+	json.Unmarshal([]byte(sys.Vars), &vars)
+	str := func(keys ...string) string {
+		for _, k := range keys {
+			if v, _ := vars[k].(string); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	t.Host = str("ipmi_host")
+	if t.Host == "" {
+		if u, err := url.Parse(str("redfish_url")); err == nil {
+			t.Host = u.Hostname()
+		}
+	}
+	t.User = str("ipmi_user", "redfish_user")
+	t.Password = str("ipmi_password", "redfish_password")
+	if t.Host == "" {
+		return t, false
+	}
+	if _, err := exec.LookPath("ipmitool"); err != nil {
+		return t, false
+	}
+	return t, true
+}
+
+// runSOL relays a system's serial-over-LAN until the session is stopped or
+// ipmitool exits. The password is passed in the environment, not on the
+// command line other users can read.
+func (s *Server) runSOL(sysID int64, t solTarget) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs, err := s.consoles.attach(sysID, consoleSOL, cancel)
+	if err != nil {
+		return
+	}
+	args := []string{"-I", "lanplus", "-H", t.Host, "-U", t.User, "-E", "sol"}
+	env := append(os.Environ(), "IPMI_PASSWORD="+t.Password)
+
+	// A session left open elsewhere would keep this one out.
+	deactivate := exec.CommandContext(ctx, "ipmitool", append(args, "deactivate")...)
+	deactivate.Env = env
+	deactivate.Run()
+
+	cmd := exec.CommandContext(ctx, "ipmitool", append(args, "activate")...)
+	cmd.Env = env
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		s.consoles.detach(sysID, cs, err.Error())
+		return
+	}
+	cmd.Stdout = consoleWriter{s, cs}
+	cmd.Stderr = consoleWriter{s, cs}
+	if err := cmd.Start(); err != nil {
+		s.consoles.detach(sysID, cs, "ipmitool: "+err.Error())
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case in := <-cs.input:
+				stdin.Write(in)
+			}
+		}
+	}()
+	reason := "The serial-over-LAN session ended."
+	if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+		reason = "ipmitool: " + err.Error()
+		log.Printf("http: console of system %d: %v", sysID, err)
+	}
+	s.consoles.detach(sysID, cs, reason)
+}
+
+// consoleWriter passes output to a session's viewers.
+type consoleWriter struct {
+	s  *Server
+	cs *consoleSession
+}
+
+func (w consoleWriter) Write(p []byte) (int, error) {
+	w.s.consoles.send(w.cs, consoleFrame{op: wsBinary, data: append([]byte(nil), p...)})
+	return len(p), nil
+}
+
+// handleConsoleSocket relays a system's console to the browser over a
+// WebSocket. The BMC's serial-over-LAN is used when the system has one and
+// ipmitool is installed; otherwise the system's agent is asked on its next
+// heartbeat to attach its console.
+func (s *Server) handleConsoleSocket(w http.ResponseWriter, r *http.Request) {
+	sys, ok := s.pathSystem(w, r)
+	if !ok {
+		return
+	}
+	sol, haveSOL := solTargetFor(sys)
+	kind := consoleSOL
+	if !haveSOL {
+		a, err := db.GetAgent(s.DB, sys.ID)
+		if err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if a == nil {
+			http.Error(w, "The system has no BMC vars for serial-over-LAN, or ipmitool isn't installed, and no agent", http.StatusNotFound)
+			return
+		}
+		kind = consoleAgent
+	}
+
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		log.Printf("http: console of system %d: %v", sys.ID, err)
+		return
+	}
+	defer ws.Close()
+
+	cs, frames, created := s.consoles.join(sys.ID, kind)
+	defer s.consoles.leave(sys.ID, cs, frames)
+	input := s.SettingBool("console_input")
+	hello, _ := json.Marshal(map[string]any{"status": "open", "source": kind, "input": input})
+	ws.writeMessage(wsText, hello)
+	if created {
+		if kind == consoleSOL {
+			go s.runSOL(sys.ID, sol)
+		} else {
+			s.consoles.send(cs, statusFrame("waiting", "Waiting for the agent's next heartbeat."))
+		}
+	}
+
+	// Read input until the browser goes away.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			op, data, err := ws.readMessage()
+			if err != nil {
+				return
+			}
+			if op != wsText || !input {
+				continue
+			}
+			select {
+			case cs.input <- data:
+			default: // the source isn't reading; drop it
+			}
+		}
+	}()
+	for {
+		select {
+		case <-gone:
+			return
+		case f, ok := <-frames:
+			if !ok {
+				ws.writeMessage(wsClose, nil)
+				return
+			}
+			if err := ws.writeMessage(f.op, f.data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleAgentConsole is the agent's end of a console: the request body is
+// the console's output and the response streams input back, both for as
+// long as someone is watching.
+func (s *Server) handleAgentConsole(w http.ResponseWriter, r *http.Request) {
+	sys := s.machineFromCert(r)
+	if sys == nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	rc := http.NewResponseController(w)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	// Stopping the session also unblocks the read of the agent's output.
+	stop := func() {
+		cancel()
+		rc.SetReadDeadline(time.Now())
+	}
+	cs, err := s.consoles.attach(sys.ID, consoleAgent, stop)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err := rc.EnableFullDuplex(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("http: console of system %d: %v", sys.ID, err)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case in := <-cs.input:
+				if _, err := w.Write(in); err != nil {
+					stop()
+					return
+				}
+				rc.Flush()
+			}
+		}
+	}()
+	reason := "The agent closed the console."
+	if _, err := io.Copy(consoleWriter{s, cs}, r.Body); err != nil && ctx.Err() == nil {
+		reason = fmt.Sprintf("The agent's console broke off: %v", err)
+	}
+	cancel()
+	wg.Wait()
+	s.consoles.detach(sys.ID, cs, reason)
+}
+
+// handleConsolePage shows a system's console.
+func (s *Server) handleConsolePage(w http.ResponseWriter, r *http.Request) {
+	sys, ok := s.pathSystem(w, r)
+	if !ok {
+		return
+	}
+	hash, _ := s.getAuthState()
+	data := map[string]any{
+		"System":      sys,
+		"Input":       s.SettingBool("console_input"),
+		"AuthEnabled": hash != "",
+	}
+	s.addTenantData(r, data)
+	s.addThemeData(r, data)
+	if err := s.Templates.ExecuteTemplate(w, "system_console", data); err != nil {
+		log.Printf("http: render system_console: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+)
+
+// dependent is the API view of a system that references an image or profile.
+type dependent struct {
+	ID       int64  `json:"id"`
+	MAC      string `json:"mac"`
+	Hostname string `json:"hostname"`
+	State    string `json:"state"`
+}
+
+func toDependents(systems []db.System) []dependent {
+	deps := make([]dependent, 0, len(systems))
+	for _, sys := range systems {
+		deps = append(deps, dependent{ID: sys.ID, MAC: sys.MAC, Hostname: sys.Hostname, State: sys.State})
+	}
+	return deps
+}
+
+// An image or profile is in heavy or recent use, and worth a warning
+// before it is deleted, when it has been provisioned at least
+// heavyUseProvisions times or within recentUseWindow.
+const (
+	heavyUseProvisions = 10
+	recentUseWindow    = 7 * 24 * time.Hour
+)
+
+// usageWarning explains why deleting something with usage u deserves a
+// second thought, or returns "" if it doesn't.
+func usageWarning(u db.Usage) string {
+	switch {
+	case u.UsedSince(recentUseWindow):
+		return fmt.Sprintf("It was last provisioned %s ago, %d times in all.", timeSince(u.LastUsed), u.Provisions)
+	case u.Provisions >= heavyUseProvisions:
+		return fmt.Sprintf("It has been provisioned %d times, last %s ago.", u.Provisions, timeSince(u.LastUsed))
+	}
+	return ""
+}
+
+// writeDependents reports the systems the caller can see and, if given,
+// the usage of what they depend on.
+func writeDependents(w http.ResponseWriter, r *http.Request, status int, systems []db.System, usage *db.Usage) {
+	systems = slices.DeleteFunc(systems, func(sys db.System) bool { return !visibleTo(r, sys.TenantID, false) })
+	out := map[string]any{
+		"systems": toDependents(systems),
+	}
+	if usage != nil {
+		out["usage"] = usage
+		out["warning"] = usageWarning(*usage)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(out)
+}
+
+// reassignTarget parses the reassign_to form value sent with a delete. ok is
+// false when the caller did not ask for reassignment; a zero ID unassigns.
+func reassignTarget(r *http.Request) (target *int64, ok bool, err error) {
+	v := r.FormValue("reassign_to")
+	if v == "" {
+		return nil, false, nil
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, false, err
+	}
+	if id == 0 {
+		return nil, true, nil
+	}
+	return &id, true, nil
+}
@@ -0,0 +1,205 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+)
+
+const (
+	// dnsCheckInterval is how often systems are checked for DNS records
+	// that need looking up.
+	dnsCheckInterval = time.Minute
+	// dnsMaxAge is how long a lookup is trusted before it is redone.
+	dnsMaxAge = 15 * time.Minute
+	// dnsLookupTimeout bounds the lookups for one system.
+	dnsLookupTimeout = 5 * time.Second
+	// dnsLookupWorkers is how many systems are looked up at once.
+	dnsLookupWorkers = 8
+)
+
+// dnsRecord is what DNS said about a system's address and hostname.
+type dnsRecord struct {
+	IP        string   // address that was looked up
+	Hostname  string   // hostname that was looked up
+	Reverse   []string // PTR names for IP, without the trailing dot
+	Forward   []string // addresses Hostname resolves to
+	Err       string   // a lookup failure other than a missing record
+	CheckedAt time.Time
+}
+
+// Mismatch says how DNS disagrees with the system's hostname and address,
+// or is "" if it agrees or couldn't be asked.
+func (r *dnsRecord) Mismatch() string {
+	if r.Err != "" {
+		return ""
+	}
+	var problems []string
+	switch {
+	case len(r.Reverse) == 0:
+		problems = append(problems, "no PTR record for "+r.IP)
+	case !slices.ContainsFunc(r.Reverse, func(name string) bool { return dnsNameMatches(name, r.Hostname) }):
+		problems = append(problems, r.IP+" points back to "+strings.Join(r.Reverse, ", "))
+	}
+	switch {
+	case len(r.Forward) == 0:
+		problems = append(problems, r.Hostname+" doesn't resolve")
+	case !slices.Contains(r.Forward, r.IP):
+		problems = append(problems, r.Hostname+" resolves to "+strings.Join(r.Forward, ", "))
+	}
+	return strings.Join(problems, "; ")
+}
+
+// dnsNameMatches reports whether a DNS name is hostname, either in full or
+// as its first label when hostname is unqualified.
+func dnsNameMatches(name, hostname string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if strings.EqualFold(name, hostname) {
+		return true
+	}
+	label, _, _ := strings.Cut(name, ".")
+	return !strings.Contains(hostname, ".") && strings.EqualFold(label, hostname)
+}
+
+// dnsCache holds the latest DNS lookup for each system, refreshed by
+// RunDNSChecks.
+type dnsCache struct {
+	mu      sync.Mutex
+	records map[int64]*dnsRecord
+}
+
+func (c *dnsCache) get(id int64) *dnsRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.records[id]
+}
+
+func (c *dnsCache) put(id int64, r *dnsRecord) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.records == nil {
+		c.records = make(map[int64]*dnsRecord)
+	}
+	c.records[id] = r
+}
+
+// keep drops the records of systems not in ids.
+func (c *dnsCache) keep(ids map[int64]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := range c.records {
+		if !ids[id] {
+			delete(c.records, id)
+		}
+	}
+}
+
+// dnsFor returns the DNS lookup for sys's current hostname and address,
+// or nil if DNS checks are off, sys lacks either, or it hasn't been looked
+// up since they changed.
+func (s *Server) dnsFor(sys db.System) *dnsRecord {
+	if !s.SettingBool("dns_check") || sys.Hostname == "" || sys.IPAddr == "" {
+		return nil
+	}
+	r := s.dns.get(sys.ID)
+	if r == nil || r.IP != sys.IPAddr || r.Hostname != sys.Hostname {
+		return nil
+	}
+	return r
+}
+
+// RunDNSChecks looks up the forward and reverse DNS of each system with a
+// hostname and address while the dns_check setting is on, redoing a lookup
+// when either changes or it is older than dnsMaxAge.
+func (s *Server) RunDNSChecks(ctx context.Context) error {
+	ticker := time.NewTicker(dnsCheckInterval)
+	defer ticker.Stop()
+	for {
+		if s.SettingBool("dns_check") {
+			s.checkDNS(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) checkDNS(ctx context.Context) {
+	systems, err := db.ListSystems(s.DB)
+	if err != nil {
+		log.Printf("dns: %v", err)
+		return
+	}
+	ids := make(map[int64]bool, len(systems))
+	var due []db.System
+	for _, sys := range systems {
+		ids[sys.ID] = true
+		if sys.Hostname == "" || sys.IPAddr == "" {
+			continue
+		}
+		r := s.dns.get(sys.ID)
+		if r == nil || r.IP != sys.IPAddr || r.Hostname != sys.Hostname || time.Since(r.CheckedAt) > dnsMaxAge {
+			due = append(due, sys)
+		}
+	}
+	s.dns.keep(ids)
+
+	work := make(chan db.System)
+	var wg sync.WaitGroup
+	for range min(dnsLookupWorkers, len(due)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sys := range work {
+				s.dns.put(sys.ID, lookupDNS(ctx, sys.Hostname, sys.IPAddr))
+			}
+		}()
+	}
+	for _, sys := range due {
+		select {
+		case work <- sys:
+		case <-ctx.Done():
+		}
+	}
+	close(work)
+	wg.Wait()
+}
+
+// lookupDNS resolves ip's PTR names and hostname's addresses. A name or
+// address DNS doesn't know comes back with none.
+func lookupDNS(ctx context.Context, hostname, ip string) *dnsRecord {
+	ctx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+	defer cancel()
+	r := &dnsRecord{IP: ip, Hostname: hostname, CheckedAt: time.Now()}
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if dnsFailed(err) {
+		r.Err = err.Error()
+		return r
+	}
+	for _, name := range names {
+		r.Reverse = append(r.Reverse, strings.TrimSuffix(name, "."))
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, hostname)
+	if dnsFailed(err) {
+		r.Err = err.Error()
+		return r
+	}
+	r.Forward = addrs
+	return r
+}
+
+// dnsFailed reports whether err is a failure to ask DNS, rather than DNS
+// answering that there is no such record.
+func dnsFailed(err error) bool {
+	var dnsErr *net.DNSError
+	return err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound)
+}
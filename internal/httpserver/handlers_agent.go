@@ -0,0 +1,241 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/justinpopa/duh/internal/agent"
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/profile"
+)
+
+// handleAgentHeartbeat records a duh-agent check-in and hands it any
+// queued commands. The agent is identified by its machine certificate.
+func (s *Server) handleAgentHeartbeat(w http.ResponseWriter, r *http.Request) {
+	sys := s.machineFromCert(r)
+	if sys == nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var hb agent.Heartbeat
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 256<<10)).Decode(&hb); err != nil {
+		http.Error(w, "Invalid heartbeat", http.StatusBadRequest)
+		return
+	}
+	inv, _ := json.Marshal(hb.Inventory)
+	health, _ := json.Marshal(hb.Health)
+	err := db.RecordAgentHeartbeat(s.DB, &db.Agent{
+		SystemID:  sys.ID,
+		Version:   hb.Version,
+		Hostname:  hb.Hostname,
+		RemoteIP:  clientAddr(r),
+		UptimeSec: hb.UptimeSec,
+		Inventory: string(inv),
+		Health:    string(health),
+	})
+	if err != nil {
+		log.Printf("http: agent heartbeat from %s: %v", sys.MAC, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	prevIP, err := db.RecordHeartbeat(s.DB, sys.ID, nil, clientAddr(r))
+	if err != nil {
+		log.Printf("http: agent heartbeat from %s: %v", sys.MAC, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if prevIP != "" {
+		sys.IPAddr = clientAddr(r)
+		s.fireIPChanged(sys, prevIP)
+	}
+
+	cfg, err := s.agentConfig(sys)
+	if err != nil {
+		log.Printf("http: agent config for %s: %v", sys.MAC, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	cmds, err := db.TakeAgentCommands(s.DB, sys.ID)
+	if err != nil {
+		log.Printf("http: agent commands for %s: %v", sys.MAC, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	reply := agent.HeartbeatReply{
+		IntervalSec: int(s.settingDuration("agent_interval").Seconds()),
+		ConfigHash:  configHash(cfg),
+		Console:     s.consoles.waiting(sys.ID),
+	}
+	for _, c := range cmds {
+		log.Printf("agent: sending %s command %d to %s", c.Type, c.ID, sys.MAC)
+		reply.Commands = append(reply.Commands, agent.Command{ID: c.ID, Type: c.Type})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+// handleAgentConfig serves the follow-up configuration for the system
+// presenting the certificate.
+func (s *Server) handleAgentConfig(w http.ResponseWriter, r *http.Request) {
+	sys := s.machineFromCert(r)
+	if sys == nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	cfg, err := s.agentConfig(sys)
+	if err != nil {
+		log.Printf("http: agent config for %s: %v", sys.MAC, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cfg)
+}
+
+// handleAgentCommandResult records how a command went.
+func (s *Server) handleAgentCommandResult(w http.ResponseWriter, r *http.Request) {
+	sys := s.machineFromCert(r)
+	if sys == nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	var res agent.CommandResult
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&res); err != nil {
+		http.Error(w, "Invalid result", http.StatusBadRequest)
+		return
+	}
+	found, err := db.FinishAgentCommand(s.DB, sys.ID, id, res.OK, res.Message)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Command not found", http.StatusNotFound)
+		return
+	}
+	if res.OK {
+		log.Printf("agent: %s finished command %d", sys.MAC, id)
+	} else {
+		log.Printf("agent: %s failed command %d: %s", sys.MAC, id, res.Message)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// handleGetSystemAgent shows what a system's agent last reported and its
+// recent commands.
+func (s *Server) handleGetSystemAgent(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	a, err := db.GetAgent(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if a == nil {
+		http.Error(w, "No agent has checked in for this system", http.StatusNotFound)
+		return
+	}
+	cmds, err := db.ListAgentCommands(s.DB, id, 20)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	out := make([]map[string]any, len(cmds))
+	for i, c := range cmds {
+		out[i] = map[string]any{
+			"id":         c.ID,
+			"type":       c.Type,
+			"status":     c.Status,
+			"message":    c.Message,
+			"created_at": c.CreatedAt,
+			"updated_at": c.UpdatedAt,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"version":    a.Version,
+		"hostname":   a.Hostname,
+		"remote_ip":  a.RemoteIP,
+		"uptime_sec": a.UptimeSec,
+		"inventory":  json.RawMessage(a.Inventory),
+		"health":     json.RawMessage(a.Health),
+		"first_seen": a.FirstSeen,
+		"last_seen":  a.LastSeen,
+		"commands":   out,
+	})
+}
+
+// agentConfig is the configuration duh holds for sys: its profile's
+// default vars merged with its own, and its tags.
+func (s *Server) agentConfig(sys *db.System) (*agent.Config, error) {
+	var defaultVars string
+	if sys.ProfileID != nil {
+		prof, err := db.GetProfile(s.DB, *sys.ProfileID)
+		if err != nil {
+			return nil, err
+		}
+		if prof != nil {
+			defaultVars = prof.DefaultVars
+		}
+	}
+	vars, err := profile.BuildVars(s.globalVars(), defaultVars, sys.Vars)
+	if err != nil {
+		return nil, err
+	}
+	tags := db.SplitTags(sys.Tags)
+	if tags == nil {
+		tags = []string{}
+	}
+	return &agent.Config{
+		SystemID:  sys.ID,
+		Hostname:  sys.Hostname,
+		State:     sys.State,
+		ImageID:   sys.ImageID,
+		ProfileID: sys.ProfileID,
+		Tags:      tags,
+		Vars:      vars,
+	}, nil
+}
+
+// configHash lets the agent tell whether its configuration changed
+// without fetching it every heartbeat.
+func configHash(cfg *agent.Config) string {
+	b, _ := json.Marshal(cfg)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// queueAgentReimage asks sys's agent, if it has one, to reboot the host
+// into the reinstall sys was just queued for.
+func (s *Server) queueAgentReimage(sys *db.System) {
+	a, err := db.GetAgent(s.DB, sys.ID)
+	if err != nil {
+		log.Printf("http: %v", err)
+		return
+	}
+	if a == nil {
+		return
+	}
+	id, err := db.QueueAgentCommand(s.DB, sys.ID, agent.CommandReimage)
+	if err != nil {
+		log.Printf("http: %v", err)
+		return
+	}
+	log.Printf("agent: queued reimage command %d for %s", id, sys.MAC)
+}
@@ -2,10 +2,16 @@ package httpserver
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/listing"
 )
 
 func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
@@ -17,15 +23,38 @@ func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"status": "error"})
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{
+	resp := map[string]any{
 		"status": "healthy",
 		"stats":  stats,
-	})
+	}
+	if cert, err := s.certificateInfo(time.Now()); err != nil {
+		log.Printf("http: healthz: %v", err)
+	} else if cert != nil {
+		resp["certificate"] = cert
+		if warning := cert.Warning(); warning != "" {
+			resp["warnings"] = []string{warning}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
 func (s *Server) handleCallback(w http.ResponseWriter, r *http.Request) {
-	if !s.validateToken(r) {
+	bound, ok := s.validateToken(r, tokenPurposeCallback)
+	if !ok {
+		// A machine certificate stands in for the signed token.
+		if bound = s.machineFromCert(r); bound != nil {
+			ok = true
+		}
+	}
+	if !ok && s.finishedCallback(r) {
+		// Finishing revoked the token the installer still holds, so its
+		// retries of the callback that did it are let through as a no-op.
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+		return
+	}
+	if !ok {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -35,18 +64,207 @@ func (s *Server) handleCallback(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "MAC address required", http.StatusBadRequest)
 		return
 	}
-
-	if err := db.TransitionSystemStateByMAC(s.DB, mac, "provisioning", "ready"); err != nil {
-		log.Printf("http: callback state transition: %v", err)
+	sys, err := db.GetSystemByMAC(s.DB, mac)
+	if err != nil {
+		log.Printf("http: callback system lookup: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	if sys == nil {
+		http.Error(w, "System not found", http.StatusNotFound)
+		return
+	}
+	if bound != nil && sys.ID != bound.ID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// A callback from an earlier attempt (e.g. an install that finished
+	// after the system was re-queued) must not complete the current one.
+	if attempt := r.URL.Query().Get("attempt"); attempt != sys.AttemptID {
+		log.Printf("http: callback for %s: stale attempt %q (current %q)", sys.MAC, attempt, sys.AttemptID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"status": "stale_attempt"})
+		return
+	}
 
-	sys, _ := db.GetSystemByMAC(s.DB, mac)
-	if sys != nil {
-		s.fireSystemEvent(sys, "ready")
+	payload, err := parseCallbackPayload(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Installers may retry; a repeat callback for a finished attempt is a
+	// no-op.
+	switch payload.Status {
+	case "", "success":
+		if sys.State != "ready" {
+			if err := db.TransitionSystemStateByMAC(s.DB, sys.MAC, "provisioning", "ready"); err != nil {
+				log.Printf("http: callback state transition: %v", err)
+				http.Error(w, "Conflict", http.StatusConflict)
+				return
+			}
+			s.fireSystemEvent(sys, "ready")
+		}
+	case "failure":
+		if sys.State != "failed" {
+			if err := db.FailSystemByMAC(s.DB, sys.MAC, payload.Phase, payload.Message); err != nil {
+				log.Printf("http: callback state transition: %v", err)
+				http.Error(w, "Conflict", http.StatusConflict)
+				return
+			}
+			log.Printf("http: %s reported failure in phase %q: %s", sys.MAC, payload.Phase, payload.Message)
+			sys.FailPhase, sys.FailMessage = payload.Phase, payload.Message
+			s.fireSystemEvent(sys, "failed")
+		}
+	default:
+		http.Error(w, "status must be success or failure", http.StatusBadRequest)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
+
+// callbackPayload is the optional body of a provisioning callback. An empty
+// body means success.
+type callbackPayload struct {
+	Status  string `json:"status"` // success or failure
+	Phase   string `json:"phase"`
+	Message string `json:"message"`
+}
+
+const maxCallbackMessage = 4096
+
+// parseCallbackPayload reads a callback body as JSON or as form values.
+func parseCallbackPayload(w http.ResponseWriter, r *http.Request) (callbackPayload, error) {
+	var p callbackPayload
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil && err != io.EOF {
+			return p, fmt.Errorf("invalid JSON body: %v", err)
+		}
+	} else {
+		p.Status = r.FormValue("status")
+		p.Phase = r.FormValue("phase")
+		p.Message = r.FormValue("message")
+	}
+	p.Status = strings.ToLower(strings.TrimSpace(p.Status))
+	if p.Status == "failed" || p.Status == "error" {
+		p.Status = "failure"
+	}
+	p.Phase = strings.TrimSpace(p.Phase)
+	if len(p.Message) > maxCallbackMessage {
+		p.Message = p.Message[:maxCallbackMessage]
+	}
+	return p, nil
+}
+
+func (s *Server) handleSystemAttempts(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	attempts, err := db.ListProvisionAttempts(s.DB, id)
+	if err != nil {
+		log.Printf("http: list attempts: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	rows := make([]map[string]any, 0, len(attempts))
+	for _, a := range attempts {
+		rows = append(rows, map[string]any{
+			"id":              a.ID,
+			"state":           a.State,
+			"phase":           a.Phase,
+			"message":         a.Message,
+			"started_at":      a.StartedAt,
+			"provisioning_at": a.ProvisioningAt,
+			"finished_at":     a.FinishedAt,
+			"wait_seconds":    int(a.WaitTime().Seconds()),
+			"install_seconds": int(a.InstallTime().Seconds()),
+			"total_seconds":   int(a.TotalTime().Seconds()),
+		})
+	}
+	page, ok := listPage(w, r, rows, listing.Spec{Sort: "-started_at", Key: []string{"id"}})
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"attempts": page.Rows, "next_cursor": page.Next})
+}
+
+// handleSystemIPs lists the addresses a system has been seen at, most
+// recent first.
+func (s *Server) handleSystemIPs(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	history, err := db.ListIPHistory(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	rows := make([]map[string]any, 0, len(history))
+	for _, h := range history {
+		rows = append(rows, map[string]any{
+			"ip_addr":       h.IPAddr,
+			"source":        h.Source,
+			"first_seen_at": h.FirstSeenAt,
+			"last_seen_at":  h.LastSeenAt,
+		})
+	}
+	page, ok := listPage(w, r, rows, listing.Spec{Sort: "-last_seen_at", Key: []string{"ip_addr"}})
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"ips": page.Rows, "next_cursor": page.Next})
+}
+
+// handleBootAck is fetched by the boot script once every file has been
+// loaded, immediately before iPXE hands off to the kernel.
+func (s *Server) handleBootAck(w http.ResponseWriter, r *http.Request) {
+	bound, ok := s.validateToken(r, tokenPurposeAck)
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	sys, err := db.GetSystemByMAC(s.DB, r.PathValue("mac"))
+	if err != nil {
+		log.Printf("http: boot ack system lookup: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if sys == nil {
+		http.Error(w, "System not found", http.StatusNotFound)
+		return
+	}
+	if bound != nil && bound.ID != sys.ID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.URL.Query().Get("attempt") != sys.AttemptID {
+		http.Error(w, "Stale attempt", http.StatusConflict)
+		return
+	}
+
+	if sys.State == "queued" {
+		if err := db.TransitionSystemStateByMAC(s.DB, sys.MAC, "queued", "provisioning"); err != nil {
+			log.Printf("http: boot ack state transition: %v", err)
+			http.Error(w, "Conflict", http.StatusConflict)
+			return
+		}
+		s.fireSystemEvent(sys, "provisioning")
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
@@ -1,9 +1,11 @@
 package httpserver
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/justinpopa/duh/internal/db"
 	"golang.org/x/crypto/bcrypt"
@@ -14,14 +16,17 @@ func (s *Server) handleLoginPage(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
+	next := loginNext(r.URL.Query().Get("next"))
 	_, key := s.getAuthState()
-	if s.validateSession(r, key) {
-		http.Redirect(w, r, "/", http.StatusFound)
+	if _, ok := s.validateSession(r, key); ok {
+		http.Redirect(w, r, next, http.StatusFound)
 		return
 	}
 	data := map[string]any{
 		"Error": r.URL.Query().Get("error"),
+		"Next":  next,
 	}
+	s.addThemeData(r, data)
 	if err := s.Templates.ExecuteTemplate(w, "login", data); err != nil {
 		log.Printf("http: render login: %v", err)
 	}
@@ -33,9 +38,26 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
+	next := loginNext(r.FormValue("next"))
+	failed := "/login?" + url.Values{"error": {"invalid"}, "next": {next}}.Encode()
 	password := r.FormValue("password")
+	// Tenant users sign in by name; no name, or "admin", is the admin.
+	var userID int64
+	if username := strings.ToLower(strings.TrimSpace(r.FormValue("username"))); username != "" && username != "admin" {
+		u, err := db.GetTenantUserByName(s.DB, username)
+		if err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if u == nil {
+			http.Redirect(w, r, failed, http.StatusFound)
+			return
+		}
+		hash, userID = u.PasswordHash, u.ID
+	}
 	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
-		http.Redirect(w, r, "/login?error=invalid", http.StatusFound)
+		http.Redirect(w, r, failed, http.StatusFound)
 		return
 	}
 	key, err := s.ensureSigningKey()
@@ -44,8 +66,17 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	s.createSession(w, key)
-	http.Redirect(w, r, "/", http.StatusFound)
+	s.createSession(w, key, userID)
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// loginNext returns where to go after signing in: next if it is a path on
+// this server, else the dashboard.
+func loginNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
 }
 
 func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
@@ -70,26 +101,31 @@ func (s *Server) handleSetPassword(w http.ResponseWriter, r *http.Request) {
 		setupRedirect(w, r, "Passwords do not match.", "error")
 		return
 	}
-	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		log.Printf("http: bcrypt hash: %v", err)
+	if err := s.setAdminPassword(w, password); err != nil {
+		log.Printf("http: %v", err)
 		setupRedirect(w, r, "Internal error.", "error")
 		return
 	}
+	setupRedirect(w, r, "Password set successfully.", "success")
+}
+
+// setAdminPassword saves the first admin password and signs the browser
+// in, so setting it doesn't lock the admin out.
+func (s *Server) setAdminPassword(w http.ResponseWriter, password string) error {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("bcrypt hash: %w", err)
+	}
 	if err := db.SetSetting(s.DB, "password_hash", string(hashed)); err != nil {
-		log.Printf("http: set password_hash: %v", err)
-		setupRedirect(w, r, "Internal error.", "error")
-		return
+		return fmt.Errorf("set password_hash: %w", err)
 	}
 	s.resetAuthCache()
 	key, err := s.ensureSigningKey()
 	if err != nil {
-		log.Printf("http: ensure signing key: %v", err)
-		setupRedirect(w, r, "Internal error.", "error")
-		return
+		return fmt.Errorf("ensure signing key: %w", err)
 	}
-	s.createSession(w, key)
-	setupRedirect(w, r, "Password set successfully.", "success")
+	s.createSession(w, key, 0)
+	return nil
 }
 
 func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
@@ -135,7 +171,7 @@ func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
 		setupRedirect(w, r, "Internal error.", "error")
 		return
 	}
-	s.createSession(w, key)
+	s.createSession(w, key, 0)
 	setupRedirect(w, r, "Password changed. All other sessions have been invalidated.", "success")
 }
 
@@ -0,0 +1,580 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/justinpopa/duh/internal/backup"
+	"github.com/justinpopa/duh/internal/db"
+)
+
+// Settings holding the remote backup target and how many backups to keep.
+const (
+	settingBackupTarget     = "backup_target"
+	settingBackupURL        = "backup_url"
+	settingBackupBucket     = "backup_bucket"
+	settingBackupRegion     = "backup_region"
+	settingBackupPrefix     = "backup_prefix"
+	settingBackupAccessKey  = "backup_access_key"
+	settingBackupSecret     = "backup_secret"
+	settingBackupKeepDaily  = "backup_keep_daily"
+	settingBackupKeepWeekly = "backup_keep_weekly"
+)
+
+// Scheduled backups kept by default: one a day for a week and one a week
+// for a month.
+const (
+	defaultBackupKeepDaily  = 7
+	defaultBackupKeepWeekly = 4
+)
+
+// backupStoreDir is where, in the data directory, backups other duh
+// servers send here are kept.
+const backupStoreDir = "backup-store"
+
+// maxStoredBackup is the largest backup another server may send.
+const maxStoredBackup = 16 << 30 // 16 GB
+
+// remoteListTimeout bounds listing the remote target for the Setup page.
+const remoteListTimeout = 15 * time.Second
+
+type backupForm struct {
+	Target     string
+	URL        string
+	Bucket     string
+	Region     string
+	Prefix     string
+	AccessKey  string
+	HasSecret  bool
+	KeepDaily  int
+	KeepWeekly int
+}
+
+// backupFile is a backup listed on the Setup page.
+type backupFile struct {
+	Name  string
+	Size  int64
+	Taken string // as a database timestamp, for timeSince
+}
+
+func backupFiles(objs []backup.Object) []backupFile {
+	files := make([]backupFile, 0, len(objs))
+	for _, o := range objs {
+		f := backupFile{Name: o.Name, Size: o.Size}
+		if t, ok := backup.Taken(o.Name); ok {
+			f.Taken = t.Format(time.DateTime)
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+func (s *Server) backupForm() (backupForm, error) {
+	f := backupForm{KeepDaily: defaultBackupKeepDaily, KeepWeekly: defaultBackupKeepWeekly}
+	fields := map[string]*string{
+		settingBackupTarget:    &f.Target,
+		settingBackupURL:       &f.URL,
+		settingBackupBucket:    &f.Bucket,
+		settingBackupRegion:    &f.Region,
+		settingBackupPrefix:    &f.Prefix,
+		settingBackupAccessKey: &f.AccessKey,
+	}
+	for key, val := range fields {
+		var err error
+		if *val, err = db.GetSetting(s.DB, key); err != nil {
+			return f, err
+		}
+	}
+	secret, err := db.GetSetting(s.DB, settingBackupSecret)
+	if err != nil {
+		return f, err
+	}
+	f.HasSecret = secret != ""
+	for key, val := range map[string]*int{settingBackupKeepDaily: &f.KeepDaily, settingBackupKeepWeekly: &f.KeepWeekly} {
+		raw, err := db.GetSetting(s.DB, key)
+		if err != nil {
+			return f, err
+		}
+		if n, err := strconv.Atoi(raw); err == nil && n >= 0 {
+			*val = n
+		}
+	}
+	return f, nil
+}
+
+// backupTarget returns the configured remote backup target, or nil if
+// there is none.
+func (s *Server) backupTarget() (backup.Target, error) {
+	f, err := s.backupForm()
+	if err != nil || f.Target == "" {
+		return nil, err
+	}
+	secret, err := db.GetSetting(s.DB, settingBackupSecret)
+	if err != nil {
+		return nil, err
+	}
+	return backup.New(backup.Config{
+		Kind:      f.Target,
+		URL:       f.URL,
+		Bucket:    f.Bucket,
+		Region:    f.Region,
+		Prefix:    f.Prefix,
+		AccessKey: f.AccessKey,
+		Secret:    secret,
+	})
+}
+
+// backupDatabase snapshots the database for the backup scheduled task and
+// uploads it to the remote target, if one is set. Scheduled backups, here
+// and on the target, are then thinned to the newest of each of the last
+// days and weeks the retention settings ask for. Backups taken before
+// migrations and restores are left alone.
+func (s *Server) backupDatabase(ctx context.Context) error {
+	f, err := s.backupForm()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(s.DataDir, "backups")
+	path, err := db.BackupToDir(s.DB, dir, "scheduled")
+	if err != nil {
+		return err
+	}
+	log.Printf("scheduler: backed up database to %s", path)
+	local, err := filepath.Glob(filepath.Join(dir, "duh-*-scheduled.db"))
+	if err != nil {
+		return err
+	}
+	for i, p := range local {
+		local[i] = filepath.Base(p)
+	}
+	for _, name := range backup.Expired(local, f.KeepDaily, f.KeepWeekly) {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	target, err := s.backupTarget()
+	if err != nil || target == nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(path)
+	if err := target.Put(ctx, name, file, info.Size()); err != nil {
+		return fmt.Errorf("%s target: %w", f.Target, err)
+	}
+	log.Printf("scheduler: uploaded %s to %s target", name, f.Target)
+	objs, err := target.List(ctx)
+	if err != nil {
+		return fmt.Errorf("%s target: %w", f.Target, err)
+	}
+	var remote []string
+	for _, o := range objs {
+		if strings.HasSuffix(o.Name, "-scheduled.db") {
+			remote = append(remote, o.Name)
+		}
+	}
+	for _, name := range backup.Expired(remote, f.KeepDaily, f.KeepWeekly) {
+		if err := target.Delete(ctx, name); err != nil {
+			return fmt.Errorf("%s target: %w", f.Target, err)
+		}
+	}
+	return nil
+}
+
+// localBackups lists the backups in the data directory, newest first.
+func (s *Server) localBackups() ([]backupFile, error) {
+	entries, err := os.ReadDir(filepath.Join(s.DataDir, "backups"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var objs []backup.Object
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !backup.ValidName(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		objs = append(objs, backup.Object{Name: e.Name(), Size: info.Size()})
+	}
+	slices.SortFunc(objs, func(a, b backup.Object) int { return strings.Compare(b.Name, a.Name) })
+	return backupFiles(objs), nil
+}
+
+// stagedRestore returns when a restore was staged, or "" if none is.
+func (s *Server) stagedRestore() string {
+	info, err := os.Stat(filepath.Join(s.DataDir, db.RestoreFile))
+	if err != nil {
+		return ""
+	}
+	return info.ModTime().UTC().Format(time.DateTime)
+}
+
+func (s *Server) backupData() (map[string]any, error) {
+	f, err := s.backupForm()
+	if err != nil {
+		return nil, err
+	}
+	local, err := s.localBackups()
+	if err != nil {
+		return nil, err
+	}
+	store, err := db.BackupStoreEnabled(s.DB)
+	if err != nil {
+		return nil, err
+	}
+	var last db.Schedule
+	if schedules, err := db.ListSchedules(s.DB); err != nil {
+		return nil, err
+	} else if sch, ok := schedules["backup"]; ok {
+		last = sch
+	}
+	return map[string]any{
+		"Backup":        f,
+		"BackupLast":    last,
+		"LocalBackups":  local,
+		"StoreEnabled":  store,
+		"StagedRestore": s.stagedRestore(),
+	}, nil
+}
+
+func (s *Server) renderBackups(w http.ResponseWriter, extra map[string]any) {
+	data, err := s.backupData()
+	if err != nil {
+		log.Printf("http: get backup settings: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+	if err := s.Templates.ExecuteTemplate(w, "backup_settings", data); err != nil {
+		log.Printf("http: render backup_settings: %v", err)
+	}
+}
+
+func (s *Server) handleSetBackups(w http.ResponseWriter, r *http.Request) {
+	kind := r.FormValue("target")
+	values := map[string]string{
+		settingBackupTarget:    kind,
+		settingBackupURL:       strings.TrimSpace(r.FormValue("url")),
+		settingBackupBucket:    strings.TrimSpace(r.FormValue("bucket")),
+		settingBackupRegion:    strings.TrimSpace(r.FormValue("region")),
+		settingBackupPrefix:    strings.TrimSpace(r.FormValue("prefix")),
+		settingBackupAccessKey: strings.TrimSpace(r.FormValue("access_key")),
+	}
+	for key, field := range map[string]string{settingBackupKeepDaily: "keep_daily", settingBackupKeepWeekly: "keep_weekly"} {
+		n, err := strconv.Atoi(strings.TrimSpace(r.FormValue(field)))
+		if err != nil || n < 0 {
+			http.Error(w, "Backups to keep must be a number", http.StatusBadRequest)
+			return
+		}
+		values[key] = strconv.Itoa(n)
+	}
+	// A blank secret keeps the saved one; clearing the target drops it too.
+	secret := strings.TrimSpace(r.FormValue("secret"))
+	if secret != "" || kind == "" {
+		values[settingBackupSecret] = secret
+	}
+	if kind != "" {
+		if secret == "" {
+			saved, err := db.GetSetting(s.DB, settingBackupSecret)
+			if err != nil {
+				log.Printf("http: get backup secret: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			secret = saved
+		}
+		if _, err := backup.New(backup.Config{
+			Kind:      kind,
+			URL:       values[settingBackupURL],
+			Bucket:    values[settingBackupBucket],
+			Region:    values[settingBackupRegion],
+			Prefix:    values[settingBackupPrefix],
+			AccessKey: values[settingBackupAccessKey],
+			Secret:    secret,
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for key, val := range values {
+		var err error
+		if val == "" {
+			err = db.DeleteSetting(s.DB, key)
+		} else {
+			err = db.SetSetting(s.DB, key, val)
+		}
+		if err != nil {
+			log.Printf("http: set %s: %v", key, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	s.renderBackups(w, map[string]any{"Saved": true})
+}
+
+// handleRemoteBackups lists the backups on the remote target, loaded
+// separately so a slow target doesn't hold up the Setup page.
+func (s *Server) handleRemoteBackups(w http.ResponseWriter, r *http.Request) {
+	data := map[string]any{}
+	target, err := s.backupTarget()
+	if err != nil {
+		data["Error"] = err.Error()
+	} else if target != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), remoteListTimeout)
+		defer cancel()
+		if objs, err := target.List(ctx); err != nil {
+			data["Error"] = err.Error()
+		} else {
+			data["RemoteBackups"] = backupFiles(objs)
+		}
+	}
+	if err := s.Templates.ExecuteTemplate(w, "remote_backups", data); err != nil {
+		log.Printf("http: render remote_backups: %v", err)
+	}
+}
+
+// handleStageRestore stages a local or remote backup to replace the
+// database when duh next starts. The backup is checked first, so a
+// damaged or too-new one is refused now rather than at startup.
+func (s *Server) handleStageRestore(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if !backup.ValidName(name) {
+		http.Error(w, "Invalid backup name", http.StatusBadRequest)
+		return
+	}
+	var src io.ReadCloser
+	switch r.FormValue("from") {
+	case "local":
+		f, err := os.Open(filepath.Join(s.DataDir, "backups", name))
+		if err != nil {
+			http.Error(w, "No such backup", http.StatusNotFound)
+			return
+		}
+		src = f
+	case "remote":
+		target, err := s.backupTarget()
+		if err != nil || target == nil {
+			http.Error(w, "No remote backup target is configured", http.StatusBadRequest)
+			return
+		}
+		if src, err = target.Get(r.Context(), name); err != nil {
+			http.Error(w, "Failed to download backup: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	default:
+		http.Error(w, "Unknown backup location", http.StatusBadRequest)
+		return
+	}
+	defer src.Close()
+
+	staged := filepath.Join(s.DataDir, db.RestoreFile)
+	tmp, err := os.CreateTemp(s.DataDir, db.RestoreFile+".*")
+	if err != nil {
+		log.Printf("http: stage restore: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("http: stage restore: %v", err)
+		http.Error(w, "Failed to copy backup: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := db.CheckBackup(tmp.Name()); err != nil {
+		http.Error(w, "Can't restore "+name+": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := os.Rename(tmp.Name(), staged); err != nil {
+		log.Printf("http: stage restore: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("http: staged %s backup %s for restore on restart", r.FormValue("from"), name)
+	s.renderBackups(w, nil)
+}
+
+func (s *Server) handleCancelRestore(w http.ResponseWriter, r *http.Request) {
+	if err := os.Remove(filepath.Join(s.DataDir, db.RestoreFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("http: cancel restore: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderBackups(w, nil)
+}
+
+func (s *Server) handleRotateBackupStoreToken(w http.ResponseWriter, r *http.Request) {
+	token, err := db.RotateBackupStoreToken(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderBackups(w, map[string]any{"NewStoreToken": token})
+}
+
+func (s *Server) handleDisableBackupStore(w http.ResponseWriter, r *http.Request) {
+	if err := db.DisableBackupStore(s.DB); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderBackups(w, nil)
+}
+
+// backupStoreAuth lets through requests bearing the backup store token,
+// for other duh servers keeping their backups here.
+func (s *Server) backupStoreAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !strings.HasPrefix(token, db.BackupStoreTokenPrefix) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ok, err := db.CheckBackupStoreToken(s.DB, token)
+		if err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// storedBackupPath returns where the backup store keeps the backup named
+// in the request, or "" after refusing a name that isn't a backup's.
+func (s *Server) storedBackupPath(w http.ResponseWriter, r *http.Request) string {
+	name := r.PathValue("name")
+	if !backup.ValidName(name) {
+		http.Error(w, "Invalid backup name", http.StatusBadRequest)
+		return ""
+	}
+	return filepath.Join(s.DataDir, backupStoreDir, name)
+}
+
+func (s *Server) handleListStoredBackups(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(filepath.Join(s.DataDir, backupStoreDir))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	objs := []backup.Object{}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !backup.ValidName(e.Name()) {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			objs = append(objs, backup.Object{Name: e.Name(), Size: info.Size()})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(objs)
+}
+
+func (s *Server) handlePutStoredBackup(w http.ResponseWriter, r *http.Request) {
+	path := s.storedBackupPath(w, r)
+	if path == "" {
+		return
+	}
+	const maxBackup = 8 << 30 // 8 GB, as for browser uploads
+	// A backup stored again under its name replaces the old copy.
+	var freed int64
+	if info, err := os.Stat(path); err == nil {
+		freed = info.Size()
+	}
+	if refuseOverQuota(w, s.checkQuota(areaBackups, max(r.ContentLength, 0), freed)) {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBackup)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		log.Printf("http: store backup: %v", err)
+		http.Error(w, "Failed to store backup", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("http: stored backup %s from %s", filepath.Base(path), clientAddr(r))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) handleGetStoredBackup(w http.ResponseWriter, r *http.Request) {
+	path := s.storedBackupPath(w, r)
+	if path == "" {
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	http.ServeFile(w, r, path)
+}
+
+func (s *Server) handleDeleteStoredBackup(w http.ResponseWriter, r *http.Request) {
+	path := s.storedBackupPath(w, r)
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,45 @@
+package httpserver
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// imageRateLimits returns the configured image download caps in bytes per
+// second.
+func (s *Server) imageRateLimits() (global, perClient float64) {
+	return s.settingRate("image_rate_limit"), s.settingRate("image_client_rate_limit")
+}
+
+func (s *Server) bandwidthSnapshot() bandwidthSnapshot {
+	snap := s.bandwidth.snapshot()
+	snap.Limit, snap.ClientCap = s.imageRateLimits()
+	return snap
+}
+
+// handleBandwidth renders the live image serving panel on the dashboard.
+func (s *Server) handleBandwidth(w http.ResponseWriter, r *http.Request) {
+	if err := s.Templates.ExecuteTemplate(w, "bandwidth", s.bandwidthSnapshot()); err != nil {
+		log.Printf("http: render bandwidth: %v", err)
+	}
+}
+
+// writeBandwidthMetrics exports image download counters.
+func (s *Server) writeBandwidthMetrics(w io.Writer) {
+	snap := s.bandwidthSnapshot()
+	fmt.Fprintln(w, "# HELP duh_image_sent_bytes_total Bytes of image files sent over HTTP.")
+	fmt.Fprintln(w, "# TYPE duh_image_sent_bytes_total counter")
+	fmt.Fprintf(w, "duh_image_sent_bytes_total %d\n", snap.Bytes)
+	fmt.Fprintln(w, "# HELP duh_image_downloads_total Finished image file downloads.")
+	fmt.Fprintln(w, "# TYPE duh_image_downloads_total counter")
+	fmt.Fprintf(w, "duh_image_downloads_total %d\n", snap.Served)
+	fmt.Fprintln(w, "# HELP duh_image_downloads_active Image file downloads in progress.")
+	fmt.Fprintln(w, "# TYPE duh_image_downloads_active gauge")
+	fmt.Fprintf(w, "duh_image_downloads_active %d\n", snap.Downloads)
+	fmt.Fprintln(w, "# HELP duh_image_rate_limit_bytes Cap on image downloads in bytes per second, by scope; 0 is unlimited.")
+	fmt.Fprintln(w, "# TYPE duh_image_rate_limit_bytes gauge")
+	fmt.Fprintf(w, "duh_image_rate_limit_bytes{scope=\"global\"} %g\n", snap.Limit)
+	fmt.Fprintf(w, "duh_image_rate_limit_bytes{scope=\"client\"} %g\n", snap.ClientCap)
+}
@@ -1,84 +1,348 @@
 package httpserver
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/justinpopa/duh/internal/db"
 	"github.com/justinpopa/duh/internal/ipxe"
 	"github.com/justinpopa/duh/internal/profile"
-	"github.com/justinpopa/duh/internal/tftpserver"
+	"github.com/justinpopa/duh/internal/tracing"
 )
 
+// Boot decision actions.
+const (
+	bootActionBoot    = "boot"
+	bootActionOneshot = "oneshot"
+	bootActionWipe    = "wipe"
+	bootActionExit    = "exit"
+)
+
+// bootDecision is what /boot.ipxe decides for a request: the script and
+// the data it was rendered from. Clients get the script; tooling can ask
+// for the whole decision as JSON.
+type bootDecision struct {
+	MAC          string            `json:"mac"`
+	SystemID     int64             `json:"system_id,omitempty"`
+	Hostname     string            `json:"hostname,omitempty"`
+	State        string            `json:"state,omitempty"`
+	Action       string            `json:"action"`
+	Reason       string            `json:"reason,omitempty"` // why the client exits
+	Image        *bootImage        `json:"image,omitempty"`
+	ProfileID    *int64            `json:"profile_id,omitempty"`
+	Client       ipxe.Client       `json:"client"`
+	ServerURL    string            `json:"server_url,omitempty"`
+	Cmdline      string            `json:"cmdline,omitempty"`
+	KernelURL    string            `json:"kernel_url,omitempty"`
+	InitrdURLs   []string          `json:"initrd_urls,omitempty"`
+	FileURLs     map[string]string `json:"file_urls,omitempty"`
+	OverlayURLs  []string          `json:"overlay_urls,omitempty"`
+	ConfigURL    string            `json:"config_url,omitempty"`
+	CallbackURL  string            `json:"callback_url,omitempty"`
+	AckURL       string            `json:"ack_url,omitempty"`
+	Confirm      bool              `json:"confirm,omitempty"`
+	StateOnServe string            `json:"state_on_serve,omitempty"` // set when serving the script changes state
+	Policy       string            `json:"policy,omitempty"`         // what policy rules did
+	Hook         string            `json:"hook,omitempty"`           // what the boot decision hook did
+	Script       string            `json:"script"`
+}
+
+type bootImage struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	BootType string `json:"boot_type"`
+}
+
+// exitDecision is a decision to send the client on to its next boot device.
+// sys is nil for a client duh doesn't know.
+func (s *Server) exitDecision(mac string, sys *db.System, reason string) *bootDecision {
+	d := &bootDecision{MAC: mac, Action: bootActionExit, Reason: reason}
+	if sys != nil {
+		d.SystemID, d.Hostname, d.State = sys.ID, sys.Hostname, sys.State
+	}
+	d.Script = s.exitScript(mac, sys, reason)
+	return d
+}
+
+// exitVars are the fields the exit_message setting can use.
+type exitVars struct {
+	MAC      string
+	Hostname string
+	State    string
+	Reason   string
+}
+
+// exitScript renders the exit script the exit_message, exit_wait and
+// exit_ping_url settings describe. With none of them set it is the bare
+// ExitScript.
+func (s *Server) exitScript(mac string, sys *db.System, reason string) string {
+	vars := exitVars{MAC: mac, Reason: reason}
+	if sys != nil {
+		vars.Hostname, vars.State = sys.Hostname, sys.State
+	}
+	var p ipxe.ExitParams
+	if msg := s.Setting("exit_message"); msg != "" {
+		var buf strings.Builder
+		t, err := template.New("exit").Parse(msg)
+		if err == nil {
+			err = t.Execute(&buf, vars)
+		}
+		if err != nil {
+			log.Printf("http: render exit message: %v", err)
+		}
+		p.Message = strings.TrimSpace(buf.String())
+		wait, _ := strconv.Atoi(s.Setting("exit_wait"))
+		p.Wait = time.Duration(wait) * time.Second
+	}
+	if ping := s.Setting("exit_ping_url"); ping != "" {
+		if u, err := url.Parse(ping); err == nil {
+			q := u.Query()
+			q.Set("mac", mac)
+			q.Set("reason", reason)
+			u.RawQuery = q.Encode()
+			p.PingURL = u.String()
+		}
+	}
+	return ipxe.RenderExitScript(p)
+}
+
+// wantsBootJSON reports whether a boot.ipxe request asked for the decision
+// as JSON rather than as a script.
+func wantsBootJSON(r *http.Request) bool {
+	if r.URL.Query().Get("debug") == "1" {
+		return true
+	}
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, _ := strings.Cut(v, ";")
+		if strings.EqualFold(strings.TrimSpace(mt), "application/json") {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Server) handleBootScript(w http.ResponseWriter, r *http.Request) {
+	if wantsBootJSON(r) {
+		// The decision holds signed URLs, so only signed-in users see it.
+		s.auth(s.handleBootDebug)(w, r)
+		return
+	}
+
 	mac := r.URL.Query().Get("mac")
 	if mac == "" {
 		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte(ipxe.ExitScript()))
+		w.Write([]byte(s.exitScript(mac, nil, "no MAC address in the request")))
 		return
 	}
 
 	clientIP := clientAddr(r)
+	ctx := r.Context()
+	tracing.FromContext(ctx).SetAttr("duh.mac", mac)
+
+	// In signed-chain mode only clients that were handed a token by proxy
+	// DHCP may register or change state.
+	if s.SettingBool("signed_chain") && !s.validChainToken(mac, r.URL.Query().Get("chain")) {
+		log.Printf("http: boot.ipxe from %s for %s: missing or invalid chain token", clientIP, mac)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(s.exitScript(mac, nil, "missing or invalid chain token")))
+		return
+	}
 
 	// Auto-register: creates if unknown, touches last_seen if known
-	sys, isNew, err := db.AutoRegister(s.DB, mac, clientIP)
+	_, span := tracing.Start(ctx, "boot.register")
+	sys, isNew, prevIP, err := db.AutoRegister(s.DB, mac, clientIP)
+	span.SetError(err)
+	span.End()
 	if err != nil {
 		log.Printf("http: boot auto-register: %v", err)
 		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte(ipxe.ExitScript()))
+		w.Write([]byte(s.exitScript(mac, nil, "registration failed")))
 		return
 	}
 
 	if isNew && sys != nil {
 		s.fireSystemEvent(sys, "discovered")
 	}
+	if prevIP != "" && sys != nil {
+		s.fireIPChanged(sys, prevIP)
+	}
 
-	if sys == nil || sys.State != "queued" || sys.ImageID == nil || sys.Hostname == "" {
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte(ipxe.ExitScript()))
+	var client ipxe.Client
+	if sys != nil {
+		client = s.ipxeClient(r, sys)
+	}
+
+	if sys != nil && sys.OneshotImageID != nil {
+		if sys.OneshotServed == "" {
+			s.serveOneshot(w, r, sys, client)
+			return
+		}
+		// This is the boot after the one-shot; carry on as usual.
+		if err := db.SetOneshotImage(s.DB, sys.ID, nil); err != nil {
+			log.Printf("http: %v", err)
+		}
+		sys.OneshotImageID = nil
+	}
+
+	if sys != nil {
+		_, span := tracing.Start(ctx, "boot.policy")
+		note, denied := s.applyPolicy(sys, client, clientIP, true)
+		span.SetAttr("duh.denied", denied)
+		span.End()
+		if denied {
+			log.Printf("http: boot.ipxe for %s: %s", mac, note)
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(s.exitScript(mac, sys, note)))
+			return
+		}
+	}
+	if sys != nil && sys.State == "queued" {
+		hctx, span := tracing.Start(ctx, "boot.hook")
+		note, denied := s.consultBootHook(r.WithContext(hctx), sys, client, true)
+		span.SetAttr("duh.denied", denied)
+		span.End()
+		if denied {
+			log.Printf("http: boot.ipxe for %s: %s", mac, note)
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(s.exitScript(mac, sys, note)))
+			return
+		}
+	}
+
+	_, span = tracing.Start(ctx, "boot.render")
+	d, err := s.decideBoot(r, mac, sys, client)
+	if d != nil {
+		span.SetAttr("duh.action", d.Action)
+		if d.Image != nil {
+			span.SetAttr("duh.image_id", d.Image.ID)
+		}
+	}
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		log.Printf("http: render boot script: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	img, err := db.GetImage(s.DB, *sys.ImageID)
-	if err != nil || img == nil {
-		log.Printf("http: boot image lookup: %v", err)
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte(ipxe.ExitScript()))
+	// The script fetches AckURL right before booting and that moves the
+	// system to provisioning, so merely fetching boot.ipxe changes nothing.
+	// Custom scripts that don't ack keep the old transition-on-serve.
+	if d.StateOnServe != "" {
+		if err := db.UpdateSystemState(s.DB, sys.ID, d.StateOnServe); err != nil {
+			log.Printf("http: boot state transition: %v", err)
+		} else {
+			s.fireSystemEvent(sys, d.StateOnServe)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(d.Script))
+}
+
+// handleBootDebug answers boot.ipxe with the decision a client with the
+// given MAC would get, as JSON. Unlike a real boot it registers nothing,
+// records nothing and changes no state.
+func (s *Server) handleBootDebug(w http.ResponseWriter, r *http.Request) {
+	d, err := s.previewBoot(r)
+	if err != nil {
+		log.Printf("http: boot debug: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
 
-	serverURL := s.ServerURL
-	if serverURL == "" {
-		serverURL = "http://" + r.Host
+func (s *Server) previewBoot(r *http.Request) (*bootDecision, error) {
+	mac := r.URL.Query().Get("mac")
+	if mac == "" {
+		return s.exitDecision(mac, nil, "no MAC address in the request"), nil
+	}
+	sys, err := db.GetSystemByMAC(s.DB, mac)
+	if err != nil {
+		return nil, err
+	}
+	if sys == nil {
+		return s.exitDecision(mac, nil, "unknown system; a real boot would register it"), nil
+	}
+	client, _ := reportedClient(r, sys)
+	if sys.OneshotImageID != nil && sys.OneshotServed == "" {
+		return s.decideOneshot(r, sys, client)
+	}
+	policyNote, denied := s.applyPolicy(sys, client, "", false)
+	if denied {
+		d := s.exitDecision(mac, sys, policyNote)
+		d.Client, d.Policy = client, policyNote
+		return d, nil
+	}
+	var hookNote string
+	if sys.State == "queued" {
+		if hookNote, denied = s.consultBootHook(r, sys, client, false); denied {
+			d := s.exitDecision(mac, sys, hookNote)
+			d.Client, d.Policy, d.Hook = client, policyNote, hookNote
+			return d, nil
+		}
 	}
+	d, err := s.decideBoot(r, mac, sys, client)
+	if d != nil {
+		d.Policy, d.Hook = policyNote, hookNote
+	}
+	return d, err
+}
 
-	// Helper to build and sign an image file URL
-	imageFileURL := func(filename string) string {
-		return s.signURL(fmt.Sprintf("%s/images/%d/file/%s", serverURL, img.ID, filename))
+// decideBoot renders the script for a system that isn't on a one-shot
+// boot. It has no side effects; a state to move to when the script is
+// served is returned in StateOnServe.
+func (s *Server) decideBoot(r *http.Request, mac string, sys *db.System, client ipxe.Client) (*bootDecision, error) {
+	if sys == nil {
+		return s.exitDecision(mac, nil, "unknown system"), nil
+	}
+	exit := func(reason string) (*bootDecision, error) {
+		d := s.exitDecision(mac, sys, reason)
+		d.Client = client
+		return d, nil
+	}
+	switch {
+	case sys.State == "decommissioning":
+		return s.decideDecommission(r, sys, client)
+	case sys.State != "queued":
+		return exit("system is not queued")
+	case sys.ImageID == nil:
+		return exit("no image assigned")
+	case sys.Hostname == "":
+		return exit("no hostname set")
+	}
+
+	img, err := db.GetImage(s.DB, *sys.ImageID)
+	if err != nil || img == nil {
+		log.Printf("http: boot image lookup: %v", err)
+		return exit("image not found")
 	}
 
-	// Build kernel URL and extra file URLs based on boot type
-	var kernelURL, initrdURL string
-	var extraFileURLs ipxe.ExtraFileURLs
+	serverURL := s.bootServerURL(r, client)
+	params := s.imageScriptParams(serverURL, sys, img)
+	params.Client = client
+	fileURLs := params.FileURLs
 
-	switch img.BootType {
-	case "wimboot":
-		kernelURL = imageFileURL("wimboot")
-		extraFileURLs.BCD = imageFileURL("BCD")
-		extraFileURLs.BootSDI = imageFileURL("boot.sdi")
-		extraFileURLs.BootWIM = imageFileURL("boot.wim")
-	case "esxi":
-		kernelURL = imageFileURL("mboot.efi")
-		extraFileURLs.BootCfg = imageFileURL("boot.cfg")
-	case "iso":
-		kernelURL = imageFileURL("memdisk")
-		extraFileURLs.BootISO = imageFileURL("boot.iso")
-	default: // linux
-		kernelURL = imageFileURL("vmlinuz")
-		initrdURL = imageFileURL("initrd.img")
+	d := &bootDecision{
+		MAC:       mac,
+		SystemID:  sys.ID,
+		Hostname:  sys.Hostname,
+		State:     sys.State,
+		Action:    bootActionBoot,
+		Image:     &bootImage{ID: img.ID, Name: img.Name, BootType: img.BootType},
+		ProfileID: sys.ProfileID,
+		Client:    client,
+		ServerURL: serverURL,
 	}
 
 	cmdline := img.Cmdline
@@ -92,24 +356,38 @@ func (s *Server) handleBootScript(w http.ResponseWriter, r *http.Request) {
 			log.Printf("http: boot profile lookup: %v", err)
 			// Graceful degradation: continue with original cmdline
 		} else if prof != nil && prof.KernelParams != "" {
-			vars, err := profile.BuildVars(prof.DefaultVars, sys.Vars)
+			vars, err := profile.BuildVars(s.globalVars(), prof.DefaultVars, sys.Vars)
 			if err != nil {
 				log.Printf("http: boot build vars: %v", err)
 			} else {
-				configURL := s.signURL(fmt.Sprintf("%s/config/%d", serverURL, sys.ID))
-				callbackURL := s.signURL(fmt.Sprintf("%s/api/v1/systems/%s/callback", serverURL, sys.MAC))
+				d.ConfigURL = s.signURL(tokenPurposeConfig, sys, fmt.Sprintf("%s/config/%d", serverURL, sys.ID))
+				d.CallbackURL = s.callbackURL(serverURL, sys)
 				tv := profile.TemplateVars{
-					MAC:         sys.MAC,
-					Hostname:    sys.Hostname,
-					IP:          sys.IPAddr,
-					SystemID:    sys.ID,
-					ImageID:     *sys.ImageID,
-					ServerURL:   serverURL,
-					ConfigURL:   configURL,
-					CallbackURL: callbackURL,
-					Vars:        vars,
+					MAC:          sys.MAC,
+					Hostname:     sys.Hostname,
+					IP:           sys.IPAddr,
+					Site:         s.siteFor(sys.IPAddr),
+					SystemID:     sys.ID,
+					ImageID:      *sys.ImageID,
+					ServerURL:    serverURL,
+					ConfigURL:    d.ConfigURL,
+					CallbackURL:  d.CallbackURL,
+					HeartbeatURL: s.heartbeatURL(serverURL, sys),
+					TPMURL:       s.tpmURL(serverURL, sys),
+					AttemptID:    sys.AttemptID,
+					FileURLs:     fileURLs,
+					RootfsURL:    fileURLs[db.FileRoleRootfs],
+					ChecksumsURL: params.ChecksumsURL,
+					TorrentURLs:  s.imageTorrentURLs(serverURL, sys, img),
+					DriversURL:   s.driversURL(serverURL, sys),
+					Vars:         vars,
+					PasswordHash: s.systemPasswordHash(sys),
+				}
+				snippets, err := s.snippets()
+				if err != nil {
+					log.Printf("http: boot snippets: %v", err)
 				}
-				rendered, err := profile.RenderKernelParams(prof.KernelParams, tv)
+				rendered, err := profile.RenderKernelParams(prof.KernelParams, snippets, tv)
 				if err != nil {
 					log.Printf("http: boot render kernel_params: %v", err)
 				} else if rendered != "" {
@@ -121,64 +399,142 @@ func (s *Server) handleBootScript(w http.ResponseWriter, r *http.Request) {
 
 	var overlayURLs []string
 	if prof != nil && prof.OverlayFile != "" {
-		overlayURLs = append(overlayURLs, s.signURL(fmt.Sprintf("%s/profiles/%d/overlay/%s", serverURL, prof.ID, prof.OverlayFile)))
+		overlayURLs = append(overlayURLs, s.signURL(tokenPurposeOverlay, sys, fmt.Sprintf("%s/profiles/%d/overlay/%s", serverURL, prof.ID, prof.OverlayFile)))
 	}
 
-	params := ipxe.ScriptParams{
-		KernelURL:     kernelURL,
-		InitrdURL:     initrdURL,
-		Cmdline:       cmdline,
-		MAC:           sys.MAC,
-		Hostname:      sys.Hostname,
-		OverlayURLs:   overlayURLs,
-		ExtraFileURLs: extraFileURLs,
+	params.Cmdline = hypervisorCmdline(cmdline, prof)
+	params.OverlayURLs = overlayURLs
+	params.AckURL = s.signURL(tokenPurposeAck, sys, fmt.Sprintf("%s/api/v1/systems/%s/boot-ack?attempt=%s", serverURL, sys.MAC, sys.AttemptID))
+
+	if err := s.renderDecision(d, sys, img, params); err != nil {
+		return nil, err
+	}
+	if !ipxe.UsesAck(img.BootType, img.IPXEScript) {
+		d.StateOnServe = "provisioning"
 	}
+	return d, nil
+}
 
+// renderDecision renders an image's script into d, wrapped in the
+// reimage confirmation if that is turned on.
+func (s *Server) renderDecision(d *bootDecision, sys *db.System, img *db.Image, params ipxe.ScriptParams) error {
 	script, err := ipxe.RenderBootScript(img.BootType, params, img.IPXEScript)
 	if err != nil {
-		log.Printf("http: render boot script: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		return err
 	}
-
 	globalConfirm, _ := db.GetSetting(s.DB, "confirm_reimage")
 	if globalConfirm == "1" {
 		script = ipxe.WrapWithConfirmation(script, sys.Hostname, sys.MAC)
+		d.Confirm = true
 	}
-
-	// Transition to provisioning state
-	if err := db.UpdateSystemState(s.DB, sys.ID, "provisioning"); err != nil {
-		log.Printf("http: boot state transition: %v", err)
-	} else {
-		s.fireSystemEvent(sys, "provisioning")
+	d.Script = script
+	d.Cmdline = params.Cmdline
+	d.KernelURL = params.KernelURL
+	d.InitrdURLs = params.InitrdURLs
+	d.FileURLs = params.FileURLs
+	d.OverlayURLs = params.OverlayURLs
+	if ipxe.UsesAck(img.BootType, img.IPXEScript) {
+		d.AckURL = params.AckURL
 	}
-
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(script))
+	return nil
 }
 
 func (s *Server) handleServeIPXE(w http.ResponseWriter, r *http.Request) {
-	serveIPXEBinary(w, "ipxe.efi", "application/efi")
+	s.serveBootBinary(w, "ipxe.efi")
 }
 
 func (s *Server) handleServeIPXEArm64(w http.ResponseWriter, r *http.Request) {
-	serveIPXEBinary(w, "ipxe-arm64.efi", "application/efi")
+	s.serveBootBinary(w, "ipxe-arm64.efi")
 }
 
 func (s *Server) handleServeUndionly(w http.ResponseWriter, r *http.Request) {
-	serveIPXEBinary(w, "undionly.kpxe", "application/octet-stream")
+	s.serveBootBinary(w, "undionly.kpxe")
 }
 
-func serveIPXEBinary(w http.ResponseWriter, name, contentType string) {
-	data, err := tftpserver.GetIPXEBinary(name)
+// handleServeBootBinary serves any boot binary for UEFI HTTP boot, which
+// proxy DHCP points at /ipxe/<boot file>.
+func (s *Server) handleServeBootBinary(w http.ResponseWriter, r *http.Request) {
+	s.serveBootBinary(w, r.PathValue("name"))
+}
+
+func (s *Server) serveBootBinary(w http.ResponseWriter, name string) {
+	data, err := s.Binaries.Read(name)
 	if err != nil {
 		http.Error(w, "iPXE binary not found", http.StatusNotFound)
 		return
 	}
+	contentType := "application/octet-stream"
+	if strings.HasSuffix(name, ".efi") {
+		contentType = "application/efi"
+	}
 	w.Header().Set("Content-Type", contentType)
 	w.Write(data)
 }
 
+// ipxeClient reads the iPXE build details proxy DHCP adds to the chain URL
+// and records them on the system. A chain URL without them, e.g. from a
+// DHCP server configured by hand, falls back to what the system last
+// reported.
+func (s *Server) ipxeClient(r *http.Request, sys *db.System) ipxe.Client {
+	client, reported := reportedClient(r, sys)
+	if !reported {
+		return client
+	}
+	features := strings.Join(client.Features, ",")
+	if client.Platform != sys.IPXEPlatform || client.BuildArch != sys.IPXEBuildArch ||
+		client.Version != sys.IPXEVersion || features != sys.IPXEFeatures {
+		if err := db.UpdateSystemIPXEClient(s.DB, sys.ID, client.Platform, client.BuildArch, client.Version, features); err != nil {
+			log.Printf("http: %v", err)
+		}
+	}
+	return client
+}
+
+// reportedClient is the iPXE build in the chain URL, or the one the system
+// last reported if the URL has none. reported is false in the latter case.
+func reportedClient(r *http.Request, sys *db.System) (client ipxe.Client, reported bool) {
+	q := r.URL.Query()
+	client = ipxe.Client{
+		Platform:  q.Get("platform"),
+		BuildArch: q.Get("buildarch"),
+		Version:   q.Get("version"),
+		Features:  ipxe.ParseFeatures(q.Get("features")),
+	}
+	if client.Platform == "" && client.BuildArch == "" && client.Version == "" {
+		return ipxe.Client{
+			Platform:  sys.IPXEPlatform,
+			BuildArch: sys.IPXEBuildArch,
+			Version:   sys.IPXEVersion,
+			Features:  ipxe.ParseFeatures(sys.IPXEFeatures),
+		}, false
+	}
+	return client, true
+}
+
+// bootServerURL is the base URL for a boot script's downloads. iPXE builds
+// without HTTPS would fail every https:// fetch, so they are pointed at the
+// plain HTTP listener instead.
+func (s *Server) bootServerURL(r *http.Request, client ipxe.Client) string {
+	serverURL := s.serverURL()
+	if serverURL == "" {
+		return "http://" + r.Host
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Scheme != "https" || client.Supports("https") {
+		return serverURL
+	}
+	host := u.Hostname()
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if _, port, err := net.SplitHostPort(s.HTTPAddr); err == nil && port != "80" {
+		host += ":" + port
+	}
+	u.Scheme = "http"
+	u.Host = host
+	return strings.TrimSuffix(u.String(), "/")
+}
+
 func clientAddr(r *http.Request) string {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
@@ -186,3 +542,9 @@ func clientAddr(r *http.Request) string {
 	}
 	return host
 }
+
+// callbackURL builds the signed completion callback for a system's current
+// provision attempt.
+func (s *Server) callbackURL(serverURL string, sys *db.System) string {
+	return s.signURL(tokenPurposeCallback, sys, fmt.Sprintf("%s/api/v1/systems/%s/callback?attempt=%s", serverURL, sys.MAC, sys.AttemptID))
+}
@@ -0,0 +1,245 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/ipxe"
+	"github.com/justinpopa/duh/internal/webhook"
+)
+
+// Settings holding the boot decision hook.
+const (
+	settingBootHookURL        = "boot_hook_url"
+	settingBootHookSecret     = "boot_hook_secret"
+	settingBootHookFailClosed = "boot_hook_fail_closed"
+)
+
+// bootHookTimeout bounds how long a booting client waits on the hook.
+const bootHookTimeout = 5 * time.Second
+
+type bootHookForm struct {
+	URL        string
+	HasSecret  bool
+	FailClosed bool
+}
+
+// bootHookReply is what the hook may answer. Every field is optional; an
+// empty reply boots the system as configured.
+type bootHookReply struct {
+	Deny      bool              `json:"deny"`
+	Reason    string            `json:"reason"`
+	ImageID   *int64            `json:"image_id"`
+	ProfileID *int64            `json:"profile_id"` // 0 removes the profile
+	Vars      map[string]string `json:"vars"`       // merged over the system's vars
+}
+
+func (s *Server) bootHookForm() (bootHookForm, error) {
+	var f bootHookForm
+	var err error
+	if f.URL, err = db.GetSetting(s.DB, settingBootHookURL); err != nil {
+		return f, err
+	}
+	secret, err := db.GetSetting(s.DB, settingBootHookSecret)
+	if err != nil {
+		return f, err
+	}
+	f.HasSecret = secret != ""
+	failClosed, err := db.GetSetting(s.DB, settingBootHookFailClosed)
+	f.FailClosed = failClosed == "1"
+	return f, err
+}
+
+func (s *Server) renderBootHook(w http.ResponseWriter, saved bool) {
+	f, err := s.bootHookForm()
+	if err != nil {
+		log.Printf("http: get boot hook settings: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]any{
+		"BootHook": f,
+		"Saved":    saved,
+	}
+	if err := s.Templates.ExecuteTemplate(w, "boot_hook_settings", data); err != nil {
+		log.Printf("http: render boot_hook_settings: %v", err)
+	}
+}
+
+func (s *Server) handleSetBootHook(w http.ResponseWriter, r *http.Request) {
+	rawURL := strings.TrimSpace(r.FormValue("url"))
+	secret := strings.TrimSpace(r.FormValue("secret"))
+	if rawURL != "" {
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, "Boot hook URL must be an http or https URL", http.StatusBadRequest)
+			return
+		}
+	}
+
+	values := map[string]string{
+		settingBootHookURL:        rawURL,
+		settingBootHookFailClosed: "",
+	}
+	if r.FormValue("fail_closed") == "1" {
+		values[settingBootHookFailClosed] = "1"
+	}
+	// A blank secret keeps the saved one; clearing the URL drops it too.
+	if secret != "" || rawURL == "" {
+		values[settingBootHookSecret] = secret
+	}
+	for key, val := range values {
+		var err error
+		if val == "" {
+			err = db.DeleteSetting(s.DB, key)
+		} else {
+			err = db.SetSetting(s.DB, key, val)
+		}
+		if err != nil {
+			log.Printf("http: set %s: %v", key, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	s.renderBootHook(w, true)
+}
+
+// consultBootHook asks the boot decision hook, if one is configured, about
+// a queued system before its script is rendered, and applies the image,
+// profile and vars it answers with to sys. With persist set they are also
+// saved, so the config and callbacks the installer fetches later agree
+// with the script. It returns a note on what the hook did, and whether it
+// denied the boot.
+func (s *Server) consultBootHook(r *http.Request, sys *db.System, client ipxe.Client, persist bool) (string, bool) {
+	f, err := s.bootHookForm()
+	if err != nil {
+		log.Printf("http: get boot hook settings: %v", err)
+		return "", false
+	}
+	if f.URL == "" {
+		return "", false
+	}
+	secret, _ := db.GetSetting(s.DB, settingBootHookSecret)
+
+	reply, err := s.callBootHook(f.URL, secret, r, sys, client)
+	if err == nil {
+		err = s.checkBootHookReply(reply)
+	}
+	if err != nil {
+		log.Printf("http: boot hook for %s: %v", sys.MAC, err)
+		if f.FailClosed {
+			return "hook failed: " + err.Error(), true
+		}
+		return "hook failed, booting as configured: " + err.Error(), false
+	}
+	if reply.Deny {
+		reason := reply.Reason
+		if reason == "" {
+			reason = "no reason given"
+		}
+		return "denied by hook: " + reason, true
+	}
+
+	var changed []string
+	if reply.ImageID != nil {
+		sys.ImageID = reply.ImageID
+		changed = append(changed, fmt.Sprintf("image %d", *reply.ImageID))
+		if persist {
+			if err := db.UpdateSystemImage(s.DB, sys.ID, sys.ImageID); err != nil {
+				log.Printf("http: %v", err)
+			}
+		}
+	}
+	if reply.ProfileID != nil {
+		sys.ProfileID = reply.ProfileID
+		if *reply.ProfileID == 0 {
+			sys.ProfileID = nil
+		}
+		changed = append(changed, fmt.Sprintf("profile %d", *reply.ProfileID))
+		if persist {
+			if err := db.UpdateSystemProfile(s.DB, sys.ID, sys.ProfileID); err != nil {
+				log.Printf("http: %v", err)
+			}
+		}
+	}
+	if len(reply.Vars) > 0 {
+		vars := map[string]string{}
+		if sys.Vars != "" {
+			json.Unmarshal([]byte(sys.Vars), &vars)
+		}
+		for k, v := range reply.Vars {
+			vars[k] = v
+		}
+		b, _ := json.Marshal(vars)
+		sys.Vars = string(b)
+		changed = append(changed, "vars")
+		if persist {
+			if err := db.UpdateSystemVars(s.DB, sys.ID, sys.Vars); err != nil {
+				log.Printf("http: %v", err)
+			}
+		}
+	}
+	if len(changed) == 0 {
+		return "hook made no changes", false
+	}
+	note := "hook set " + strings.Join(changed, ", ")
+	if persist {
+		log.Printf("http: boot hook for %s: %s", sys.MAC, note)
+	}
+	return note, false
+}
+
+func (s *Server) callBootHook(hookURL, secret string, r *http.Request, sys *db.System, client ipxe.Client) (bootHookReply, error) {
+	var reply bootHookReply
+	vars := map[string]string{}
+	if sys.Vars != "" {
+		json.Unmarshal([]byte(sys.Vars), &vars)
+	}
+	err := webhook.Call(r.Context(), hookURL, secret, webhook.Event{
+		Type: "boot.decide",
+		Data: map[string]any{
+			"id":         sys.ID,
+			"mac":        sys.MAC,
+			"hostname":   sys.Hostname,
+			"ip":         clientAddr(r),
+			"state":      sys.State,
+			"image_id":   sys.ImageID,
+			"profile_id": sys.ProfileID,
+			"vars":       vars,
+			"tags":       db.SplitTags(sys.Tags),
+			"attempt_id": sys.AttemptID,
+			"client":     client,
+		},
+	}, bootHookTimeout, &reply)
+	return reply, err
+}
+
+// checkBootHookReply makes sure the image and profile a hook picked exist
+// and can boot.
+func (s *Server) checkBootHookReply(reply bootHookReply) error {
+	if reply.ImageID != nil {
+		img, err := db.GetImage(s.DB, *reply.ImageID)
+		if err != nil {
+			return err
+		}
+		if img == nil || img.Status != db.ImageStatusReady {
+			return fmt.Errorf("image %d is not ready", *reply.ImageID)
+		}
+	}
+	if reply.ProfileID != nil && *reply.ProfileID != 0 {
+		prof, err := db.GetProfile(s.DB, *reply.ProfileID)
+		if err != nil {
+			return err
+		}
+		if prof == nil {
+			return fmt.Errorf("profile %d not found", *reply.ProfileID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package httpserver
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/proxydhcp"
+	"github.com/justinpopa/duh/internal/tftpserver"
+)
+
+// BootFileFor returns the boot file override configured for an
+// architecture, or "" to use the default. The proxy DHCP server calls it for
+// every PXE request.
+func (s *Server) BootFileFor(arch string) string {
+	f, err := db.GetSetting(s.DB, "bootfile_"+arch)
+	if err != nil {
+		log.Printf("http: get boot file for %s: %v", arch, err)
+		return ""
+	}
+	return f
+}
+
+type bootFileRow struct {
+	Arch      string
+	Default   string
+	Override  string
+	Effective string
+	Available bool
+}
+
+func (s *Server) renderBootFiles(w http.ResponseWriter) {
+	data, err := s.bootFilesData()
+	if err != nil {
+		log.Printf("http: list boot binaries: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.Templates.ExecuteTemplate(w, "boot_files", data); err != nil {
+		log.Printf("http: render boot_files: %v", err)
+	}
+}
+
+func (s *Server) bootFilesData() (map[string]any, error) {
+	bins, err := s.Binaries.List()
+	if err != nil {
+		return nil, err
+	}
+	available := make(map[string]bool, len(bins))
+	for _, b := range bins {
+		available[b.Name] = true
+	}
+	rows := make([]bootFileRow, 0, len(proxydhcp.Arches))
+	for _, arch := range proxydhcp.Arches {
+		row := bootFileRow{
+			Arch:     arch,
+			Default:  proxydhcp.DefaultBootFiles[arch],
+			Override: s.BootFileFor(arch),
+		}
+		row.Effective = row.Default
+		if row.Override != "" {
+			row.Effective = row.Override
+		}
+		row.Available = available[row.Effective]
+		rows = append(rows, row)
+	}
+	bundles, err := s.Binaries.Bundles()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"BootFiles":       rows,
+		"Binaries":        bins,
+		"Bundles":         bundles,
+		"ActiveBundle":    s.Binaries.ActiveBundle(),
+		"EmbeddedVersion": tftpserver.EmbeddedVersion(),
+		"BundleKeySet":    s.bundleKey() != nil,
+		"BundleDrop":      filepath.Join(s.DataDir, bundleDropName),
+	}, nil
+}
+
+func (s *Server) handleUploadBinary(w http.ResponseWriter, r *http.Request) {
+	const maxBinary = 64 << 20 // 64 MB
+	form, err := s.streamMultipart(w, r, maxBinary)
+	if err != nil {
+		http.Error(w, "Upload too large or failed to parse form", http.StatusBadRequest)
+		return
+	}
+	defer form.Close()
+	upload, ok := form.File("file")
+	if !ok {
+		http.Error(w, "File is required", http.StatusBadRequest)
+		return
+	}
+	f, err := os.Open(upload.Path)
+	if err != nil {
+		log.Printf("http: open boot binary upload: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	name := strings.TrimSpace(form.Values.Get("name"))
+	if name == "" {
+		name = upload.Name
+	}
+	if err := s.Binaries.Save(name, f); err != nil {
+		if errors.Is(err, tftpserver.ErrInvalidName) {
+			http.Error(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+		log.Printf("http: save boot binary %s: %v", name, err)
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("http: uploaded boot binary %s", name)
+	s.renderBootFiles(w)
+}
+
+func (s *Server) handleDeleteBinary(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := s.Binaries.Remove(name); err != nil {
+		if errors.Is(err, tftpserver.ErrInvalidName) {
+			http.Error(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+		log.Printf("http: remove boot binary %s: %v", name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderBootFiles(w)
+}
+
+// handleSetBootFiles saves the per-architecture overrides, one form field
+// per arch. A blank field restores the default.
+func (s *Server) handleSetBootFiles(w http.ResponseWriter, r *http.Request) {
+	for _, arch := range proxydhcp.Arches {
+		name := strings.TrimSpace(r.FormValue(arch))
+		key := "bootfile_" + arch
+		var err error
+		switch {
+		case name == "" || name == proxydhcp.DefaultBootFiles[arch]:
+			err = db.DeleteSetting(s.DB, key)
+		case name != filepath.Base(name) || strings.HasPrefix(name, "."):
+			http.Error(w, "Invalid boot file name for "+arch, http.StatusBadRequest)
+			return
+		default:
+			err = db.SetSetting(s.DB, key, name)
+		}
+		if err != nil {
+			log.Printf("http: set boot file for %s: %v", arch, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	s.renderBootFiles(w)
+}
@@ -0,0 +1,242 @@
+package httpserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/catalog"
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/webhook"
+)
+
+// validateBuilderURL accepts an empty URL (no builder) or an http(s) URL.
+func validateBuilderURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("builder URL must be an http or https URL")
+	}
+	return raw, nil
+}
+
+// buildDir stages a build's uploads until the pipeline reports success.
+// It sits outside the image directory so half-finished artifacts are
+// never served.
+func (s *Server) buildDir(imageID int64, buildID string) string {
+	return filepath.Join(s.DataDir, "builds", fmt.Sprintf("%d-%s", imageID, buildID))
+}
+
+// handleRebuildImage starts a build: it issues an upload token and posts
+// an image.rebuild event to the image's builder, which is expected to run
+// its pipeline, PUT the artifacts and then call the complete URL.
+func (s *Server) handleRebuildImage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	img, err := db.GetImage(s.DB, id)
+	if err != nil {
+		log.Printf("http: get image: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if img == nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	if img.BuilderURL == "" {
+		http.Error(w, "Image has no builder", http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("http: build token: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	buildID, token := hex.EncodeToString(b[:8]), hex.EncodeToString(b[8:])
+	sum := sha256.Sum256([]byte(token))
+	if img.BuildStatus == db.BuildStatusBuilding {
+		os.RemoveAll(s.buildDir(id, img.BuildID))
+	}
+	if err := db.StartImageBuild(s.DB, id, buildID, hex.EncodeToString(sum[:])); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	base := s.serverURL()
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	buildURL := fmt.Sprintf("%s/api/v1/images/%d/builds/%s", strings.TrimSuffix(base, "/"), id, buildID)
+	err = webhook.Deliver(img.BuilderURL, img.BuilderSecret, webhook.Event{
+		Type: "image.rebuild",
+		Data: map[string]any{
+			"image_id":     id,
+			"name":         img.Name,
+			"boot_type":    img.BootType,
+			"build_id":     buildID,
+			"token":        token,
+			"upload_url":   buildURL + "/files/{name}",
+			"complete_url": buildURL + "/complete",
+		},
+	})
+	if err != nil {
+		log.Printf("http: trigger build for image %d: %v", id, err)
+		if err := db.FinishImageBuild(s.DB, id, db.BuildStatusFailed, "Builder unreachable: "+err.Error()); err != nil {
+			log.Printf("http: %v", err)
+		}
+	}
+	s.renderImageRow(w, id)
+}
+
+// buildAuth checks the bearer token of a running build.
+func (s *Server) buildAuth(w http.ResponseWriter, r *http.Request) (int64, string, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return 0, "", false
+	}
+	buildID := r.PathValue("build")
+	hash, err := db.ImageBuildTokenHash(s.DB, id, buildID)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return 0, "", false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	sum := sha256.Sum256([]byte(token))
+	if hash == "" || !ok || subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(hash)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return 0, "", false
+	}
+	return id, buildID, true
+}
+
+// handleBuildUpload stores one artifact of a running build.
+func (s *Server) handleBuildUpload(w http.ResponseWriter, r *http.Request) {
+	id, buildID, ok := s.buildAuth(w, r)
+	if !ok {
+		return
+	}
+	name := r.PathValue("name")
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+	const maxUpload = 8 << 30 // 8 GB, as for browser uploads
+	if refuseOverQuota(w, s.checkQuota(areaImages, max(r.ContentLength, 0), 0)) {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
+	dir := s.buildDir(id, buildID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("http: create build dir: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := saveFile(filepath.Join(dir, name), r.Body); err != nil {
+		log.Printf("http: save build file %s: %v", name, err)
+		http.Error(w, "Failed to save file", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleBuildComplete ends a build. On success the staged artifacts
+// replace the image's files of the same name; other files are kept.
+func (s *Server) handleBuildComplete(w http.ResponseWriter, r *http.Request) {
+	id, buildID, ok := s.buildAuth(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Status != db.BuildStatusSucceeded && req.Status != db.BuildStatusFailed {
+		http.Error(w, `status must be "succeeded" or "failed"`, http.StatusBadRequest)
+		return
+	}
+	dir := s.buildDir(id, buildID)
+	defer os.RemoveAll(dir)
+
+	if req.Status == db.BuildStatusSucceeded {
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) == 0 {
+			http.Error(w, "No files were uploaded", http.StatusBadRequest)
+			return
+		}
+		imageDir := filepath.Join(s.DataDir, "images", strconv.FormatInt(id, 10))
+		if err := os.MkdirAll(imageDir, 0755); err != nil {
+			log.Printf("http: create image dir: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		for _, e := range entries {
+			dst := filepath.Join(imageDir, e.Name())
+			if err := os.Rename(filepath.Join(dir, e.Name()), dst); err != nil {
+				log.Printf("http: install build file %s: %v", e.Name(), err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if err := s.recordFileSum(id, dst); err != nil {
+				log.Printf("http: %v", err)
+			}
+		}
+		if err := s.refreshImageFileList(id, imageDir); err != nil {
+			log.Printf("http: %v", err)
+		}
+	}
+	if err := db.FinishImageBuild(s.DB, id, req.Status, req.Message); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	s.Webhook.Fire(webhook.Event{
+		Type: "image.build." + req.Status,
+		Data: map[string]any{
+			"image_id": id,
+			"build_id": buildID,
+			"message":  req.Message,
+		},
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// refreshImageFileList updates the file names shown for an image after
+// a build or upload added files to it.
+func (s *Server) refreshImageFileList(id int64, imageDir string) error {
+	names, err := catalog.ListFiles(imageDir)
+	if err != nil {
+		return err
+	}
+	return db.UpdateImageFiles(s.DB, id, strings.Join(names, ", "))
+}
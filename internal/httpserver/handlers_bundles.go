@@ -0,0 +1,155 @@
+package httpserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/justinpopa/duh/internal/catalog"
+	"github.com/justinpopa/duh/internal/tftpserver"
+)
+
+// bundleDropName is the bundle duh installs from the data directory, with
+// its signature next to it as bundleDropName + catalog.SignatureSuffix.
+const bundleDropName = "ipxe-bundle.tar.gz"
+
+// maxBundle caps an uploaded iPXE bundle.
+const maxBundle = 256 << 20
+
+// errBundleKey is returned when a bundle arrives before a key to check it
+// with is set.
+var errBundleKey = errors.New("set the iPXE bundle signing key under Server settings first")
+
+// installBundle checks a bundle's signature, installs it and makes it the
+// active one.
+func (s *Server) installBundle(bundle, signature []byte) (string, error) {
+	key := s.bundleKey()
+	if key == nil {
+		return "", errBundleKey
+	}
+	if err := catalog.VerifyDetached(bundle, signature, key); err != nil {
+		return "", err
+	}
+	version, err := s.Binaries.InstallBundle(bytes.NewReader(bundle))
+	if err != nil {
+		return "", err
+	}
+	if err := s.Binaries.ActivateBundle(version); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// InstallDroppedBundle installs the bundle left in the data directory, if
+// there is one, and removes it once installed. A bundle that fails to
+// install stays put so the problem can be looked into.
+func (s *Server) InstallDroppedBundle() (string, error) {
+	path := filepath.Join(s.DataDir, bundleDropName)
+	bundle, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	signature, err := os.ReadFile(path + catalog.SignatureSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("%s has no %s signature next to it", bundleDropName, catalog.SignatureSuffix)
+	}
+	if err != nil {
+		return "", err
+	}
+	version, err := s.installBundle(bundle, signature)
+	if err != nil {
+		return "", err
+	}
+	os.Remove(path)
+	os.Remove(path + catalog.SignatureSuffix)
+	log.Printf("http: installed iPXE bundle %s from %s", version, path)
+	return version, nil
+}
+
+// bundleError writes the response for a bundle that failed to install.
+func bundleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, catalog.ErrBadSignature):
+		http.Error(w, "The bundle's signature doesn't verify against the iPXE bundle signing key", http.StatusBadRequest)
+	case errors.Is(err, errBundleKey), errors.Is(err, tftpserver.ErrBadBundle):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "No "+bundleDropName+" in the data directory", http.StatusNotFound)
+	default:
+		log.Printf("http: install iPXE bundle: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handleUploadBundle(w http.ResponseWriter, r *http.Request) {
+	form, err := s.streamMultipart(w, r, maxBundle)
+	if err != nil {
+		http.Error(w, "Upload too large or failed to parse form", http.StatusBadRequest)
+		return
+	}
+	defer form.Close()
+	upload, ok := form.File("bundle")
+	if !ok {
+		http.Error(w, "Bundle is required", http.StatusBadRequest)
+		return
+	}
+	sigUpload, ok := form.File("signature")
+	if !ok {
+		http.Error(w, "Signature is required", http.StatusBadRequest)
+		return
+	}
+	bundle, err := os.ReadFile(upload.Path)
+	if err != nil {
+		bundleError(w, err)
+		return
+	}
+	signature, err := os.ReadFile(sigUpload.Path)
+	if err != nil {
+		bundleError(w, err)
+		return
+	}
+	version, err := s.installBundle(bundle, signature)
+	if err != nil {
+		bundleError(w, err)
+		return
+	}
+	log.Printf("http: installed iPXE bundle %s", version)
+	s.renderBootFiles(w)
+}
+
+func (s *Server) handleInstallDroppedBundle(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.InstallDroppedBundle(); err != nil {
+		bundleError(w, err)
+		return
+	}
+	s.renderBootFiles(w)
+}
+
+// handleActivateBundle switches to an installed bundle, or back to the
+// embedded binaries when version is empty. This is how an update is
+// rolled back.
+func (s *Server) handleActivateBundle(w http.ResponseWriter, r *http.Request) {
+	version := r.FormValue("version")
+	if err := s.Binaries.ActivateBundle(version); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if version == "" {
+		version = "the built-in binaries"
+	}
+	log.Printf("http: iPXE binaries switched to %s", version)
+	s.renderBootFiles(w)
+}
+
+func (s *Server) handleDeleteBundle(w http.ResponseWriter, r *http.Request) {
+	if err := s.Binaries.RemoveBundle(r.PathValue("version")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.renderBootFiles(w)
+}
@@ -0,0 +1,150 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/cache"
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/listing"
+	"github.com/justinpopa/duh/internal/proxydhcp"
+)
+
+// cacheNodeFor returns the cache node whose subnets most closely contain
+// ip, or nil when none do.
+func (s *Server) cacheNodeFor(ip string) *db.CacheNode {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil
+	}
+	nodes, err := db.ListCacheNodes(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+		return nil
+	}
+	var best *db.CacheNode
+	bestBits := -1
+	for i, n := range nodes {
+		nets, err := proxydhcp.ParseSubnets(n.Subnets)
+		if err != nil {
+			// Saved subnets are validated; see handleCreateCacheNode.
+			log.Printf("http: cache node %s subnets: %v", n.Name, err)
+			continue
+		}
+		for _, subnet := range nets {
+			if bits, _ := subnet.Mask.Size(); subnet.Contains(addr) && bits > bestBits {
+				best, bestBits = &nodes[i], bits
+			}
+		}
+	}
+	return best
+}
+
+// fileServerURL is where sys fetches image files from: its site's cache
+// node if it has one, otherwise serverURL.
+func (s *Server) fileServerURL(serverURL string, sys *db.System) string {
+	if n := s.cacheNodeFor(sys.IPAddr); n != nil {
+		return n.URL
+	}
+	return serverURL
+}
+
+// noteCacheNode records a fetch by a cache node, which names itself in a
+// header.
+func (s *Server) noteCacheNode(r *http.Request) {
+	name := r.Header.Get(cache.NodeHeader)
+	if name == "" {
+		return
+	}
+	if err := db.TouchCacheNode(s.DB, name); err != nil {
+		log.Printf("http: %v", err)
+	}
+}
+
+func (s *Server) renderCacheNodes(w http.ResponseWriter) {
+	nodes, err := db.ListCacheNodes(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.Templates.ExecuteTemplate(w, "cache_node_settings", map[string]any{"CacheNodes": nodes}); err != nil {
+		log.Printf("http: render cache_node_settings: %v", err)
+	}
+}
+
+// cacheNodeForm checks a cache node's URL and subnets.
+func cacheNodeForm(rawURL, subnets string) (string, string, error) {
+	rawURL = strings.TrimRight(strings.TrimSpace(rawURL), "/")
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+		return "", "", fmt.Errorf("URL must be an http or https URL with no path, such as http://cache.branch:8080")
+	}
+	nets, err := proxydhcp.ParseSubnets(subnets)
+	if err != nil {
+		return "", "", err
+	}
+	if len(nets) == 0 {
+		return "", "", fmt.Errorf("give at least one subnet the node serves")
+	}
+	return rawURL, strings.TrimSpace(subnets), nil
+}
+
+func (s *Server) handleCreateCacheNode(w http.ResponseWriter, r *http.Request) {
+	u, subnets, err := cacheNodeForm(r.FormValue("url"), r.FormValue("subnets"))
+	if err == nil {
+		_, err = db.CreateCacheNode(s.DB, r.FormValue("name"), u, subnets)
+	}
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Failed to add cache node: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.renderCacheNodes(w)
+}
+
+func (s *Server) handleDeleteCacheNode(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if err := db.DeleteCacheNode(s.DB, id); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderCacheNodes(w)
+}
+
+func (s *Server) handleAPICacheNodes(w http.ResponseWriter, r *http.Request) {
+	nodes, err := db.ListCacheNodes(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	rows := make([]map[string]any, len(nodes))
+	for i, n := range nodes {
+		rows[i] = map[string]any{
+			"id":           n.ID,
+			"name":         n.Name,
+			"url":          n.URL,
+			"subnets":      n.Subnets,
+			"last_seen_at": n.LastSeenAt,
+			"created_at":   n.CreatedAt,
+		}
+	}
+	page, ok := listPage(w, r, rows, listing.Spec{Sort: "name", Key: []string{"id"}})
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"cache_nodes": page.Rows, "next_cursor": page.Next})
+}
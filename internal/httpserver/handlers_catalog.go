@@ -1,44 +1,326 @@
 package httpserver
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/justinpopa/duh/internal/catalog"
 	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/webhook"
 )
 
-func (s *Server) handleCatalogPull(w http.ResponseWriter, r *http.Request) {
-	catalogID := r.FormValue("catalog_id")
+// catalogEntry fetches the catalog and finds an entry in it, writing the
+// error response if it can't.
+func (s *Server) catalogEntry(w http.ResponseWriter, catalogID string) (*catalog.Entry, bool) {
 	if catalogID == "" {
 		http.Error(w, "catalog_id required", http.StatusBadRequest)
-		return
+		return nil, false
 	}
 
-	cat, err := catalog.Fetch(s.CatalogURL)
+	cat, err := catalog.Fetch(s.catalogURL(), s.catalogKey())
+	if errors.Is(err, catalog.ErrBadSignature) {
+		log.Printf("http: catalog pull: %v", err)
+		http.Error(w, "Catalog signature verification failed; refusing to pull", http.StatusBadGateway)
+		return nil, false
+	}
 	if err != nil {
 		http.Error(w, "Failed to fetch catalog", http.StatusInternalServerError)
-		return
+		return nil, false
 	}
 
-	var entry *catalog.Entry
 	for i := range cat.Entries {
 		if cat.Entries[i].ID == catalogID {
-			entry = &cat.Entries[i]
-			break
+			return &cat.Entries[i], true
 		}
 	}
-	if entry == nil {
-		http.Error(w, "Entry not found", http.StatusNotFound)
+	http.Error(w, "Entry not found", http.StatusNotFound)
+	return nil, false
+}
+
+func (s *Server) handleCatalogPull(w http.ResponseWriter, r *http.Request) {
+	entry, ok := s.catalogEntry(w, r.FormValue("catalog_id"))
+	if !ok {
 		return
 	}
 
 	force := r.FormValue("force") == "true"
-	imageID, err := catalog.Pull(s.DB, s.DataDir, *entry, force)
+	imageID, err := s.pullCatalogEntry(*entry, force)
+	if errors.Is(err, errQuota) {
+		http.Error(w, "Not pulled: "+err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		if err.Error() == "already pulled" || err.Error() == "already downloading" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		log.Printf("http: catalog pull: %v", err)
+		http.Error(w, "Failed to pull image", http.StatusInternalServerError)
+		return
+	}
+
+	s.renderImageRow(w, imageID)
+}
+
+// catalogFilter reads a catalog filter from a request's q, os_family,
+// arch, boot_type and version values.
+func catalogFilter(r *http.Request) catalog.Filter {
+	return catalog.Filter{
+		Q:        r.FormValue("q"),
+		OSFamily: r.FormValue("os_family"),
+		Arch:     r.FormValue("arch"),
+		BootType: r.FormValue("boot_type"),
+		Version:  r.FormValue("version"),
+	}
+}
+
+// handleCatalogPullMany pulls several catalog entries at once: those
+// named by catalog_id, or every entry matching the filter in the q,
+// os_family, arch, boot_type and version values. Their downloads are queued as jobs like single pulls. Entries
+// already pulled or over the image quota are skipped and said why.
+func (s *Server) handleCatalogPullMany(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	ids := r.Form["catalog_id"]
+	filter := catalogFilter(r)
+	if len(ids) == 0 && filter.Empty() {
+		http.Error(w, "catalog_id or a filter (q, os_family, arch, boot_type, version) is required", http.StatusBadRequest)
+		return
+	}
+	cat, err := catalog.Fetch(s.catalogURL(), s.catalogKey())
+	if errors.Is(err, catalog.ErrBadSignature) {
+		log.Printf("http: catalog pull: %v", err)
+		http.Error(w, "Catalog signature verification failed; refusing to pull", http.StatusBadGateway)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch catalog", http.StatusInternalServerError)
+		return
+	}
+
+	var entries []catalog.Entry
+	if len(ids) > 0 {
+		byID := make(map[string]catalog.Entry, len(cat.Entries))
+		for _, e := range cat.Entries {
+			byID[e.ID] = e
+		}
+		for _, id := range ids {
+			e, ok := byID[id]
+			if !ok {
+				http.Error(w, "Entry not found: "+id, http.StatusNotFound)
+				return
+			}
+			entries = append(entries, e)
+		}
+	} else {
+		for _, e := range cat.Entries {
+			if filter.Match(e) {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	pulled := []map[string]any{}
+	skipped := []map[string]any{}
+	var pending int64
+	for _, e := range entries {
+		imageID, size, err := s.pullCatalogEntryAfter(e, false, pending)
+		switch {
+		case err == nil:
+			pending += size
+			pulled = append(pulled, map[string]any{"catalog_id": e.ID, "image_id": imageID})
+		case errors.Is(err, errQuota), err.Error() == "already pulled", err.Error() == "already downloading":
+			skipped = append(skipped, map[string]any{"catalog_id": e.ID, "reason": err.Error()})
+		default:
+			log.Printf("http: catalog pull %s: %v", e.ID, err)
+			skipped = append(skipped, map[string]any{"catalog_id": e.ID, "reason": "failed to pull image"})
+		}
+	}
+	if len(pulled) > 0 {
+		log.Printf("http: pulling %d catalog entries for %s", len(pulled), clientAddr(r))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"pulled": pulled, "skipped": skipped})
+}
+
+// catalogData loads the Images page's catalog section: the entries that
+// pass the filter in r, grouped by OS with their versions newest first,
+// and the choices the filter offers. Groups with entries not yet pulled
+// come first.
+func (s *Server) catalogData(r *http.Request) map[string]any {
+	var entries []catalog.Entry
+	var fetchErr string
+	cat, err := catalog.Fetch(s.catalogURL(), s.catalogKey())
+	if err != nil {
+		log.Printf("http: fetch catalog: %v", err)
+		fetchErr = err.Error()
+	} else {
+		entries = cat.Entries
+	}
+	images, err := db.ListImages(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+	}
+	pulled := make(map[string]*db.Image)
+	for i := range images {
+		if images[i].CatalogID != "" {
+			pulled[images[i].CatalogID] = &images[i]
+		}
+	}
+
+	var families, arches, bootTypes []string
+	add := func(list []string, v string) []string {
+		if v != "" && !slices.Contains(list, v) {
+			list = append(list, v)
+		}
+		return list
+	}
+	filter := catalogFilter(r)
+	var shown []catalog.Entry
+	for _, e := range entries {
+		families, arches, bootTypes = add(families, e.OSFamily), add(arches, e.Arch), add(bootTypes, e.BootType)
+		if filter.Match(e) {
+			shown = append(shown, e)
+		}
+	}
+	slices.Sort(families)
+	slices.Sort(arches)
+	slices.Sort(bootTypes)
+	slices.SortStableFunc(shown, func(a, b catalog.Entry) int {
+		_, aPulled := pulled[a.ID]
+		_, bPulled := pulled[b.ID]
+		switch {
+		case !aPulled && bPulled:
+			return -1
+		case aPulled && !bPulled:
+			return 1
+		}
+		return 0
+	})
+	return map[string]any{
+		"CatalogEntries":   entries,
+		"CatalogGroups":    catalog.GroupEntries(shown),
+		"CatalogPulled":    pulled,
+		"CatalogFetchErr":  fetchErr,
+		"CatalogFilter":    filter,
+		"CatalogFamilies":  families,
+		"CatalogArches":    arches,
+		"CatalogBootTypes": bootTypes,
+	}
+}
+
+// handleCatalogEntries renders the catalog list alone, for the Images
+// page's catalog filter.
+func (s *Server) handleCatalogEntries(w http.ResponseWriter, r *http.Request) {
+	if err := s.Templates.ExecuteTemplate(w, "catalog_list", s.catalogData(r)); err != nil {
+		log.Printf("http: render catalog_list: %v", err)
+	}
+}
+
+// handleCatalogPreview shows what pulling a catalog entry would download
+// and whether there is room for it, without pulling anything.
+func (s *Server) handleCatalogPreview(w http.ResponseWriter, r *http.Request) {
+	entry, ok := s.catalogEntry(w, r.FormValue("catalog_id"))
+	if !ok {
+		return
+	}
+	force := r.FormValue("force") == "true"
+	freed, _, err := s.pullSpace(*entry, force)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	preview := catalog.PreviewPull(r.Context(), *entry)
+	usage, err := s.usageOf(lookupDataArea(areaImages))
+	if err != nil {
+		log.Printf("http: %v", err)
+	}
+	used := usage.Used
+	free, err := freeSpace(s.DataDir)
+	if err != nil {
+		free = -1
+	}
+	data := map[string]any{
+		"Entry":   entry,
+		"Preview": preview,
+		"Used":    used,
+		"After":   used - freed + preview.Total,
+		"Free":    free,
+		"Quota":   usage.Quota,
+		"NoRoom":  free >= 0 && preview.Total-freed > free,
+	}
+	if err := s.checkQuota(areaImages, preview.Total, freed); errors.Is(err, errQuota) {
+		data["Blocked"] = err.Error()
+	}
+	if err := s.Templates.ExecuteTemplate(w, "catalog_preview", data); err != nil {
+		log.Printf("http: render catalog preview: %v", err)
+	}
+}
+
+// pullSpace reports whether pulling entry would download anything and, if
+// it would replace an image already pulled from it, how many bytes that
+// image's files take now.
+func (s *Server) pullSpace(entry catalog.Entry, force bool) (freed int64, downloads bool, err error) {
+	existing, err := db.GetImageByCatalogID(s.DB, entry.ID)
+	if err != nil {
+		return 0, false, err
+	}
+	if existing == nil {
+		return 0, true, nil
+	}
+	switch existing.Status {
+	case db.ImageStatusDownloading:
+		return 0, false, nil
+	case db.ImageStatusReady:
+		if !force {
+			return 0, false, nil
+		}
+	}
+	freed, err = dirSize(s.imageDir(existing.ID))
+	return freed, true, err
+}
+
+// pullCatalogEntry pulls a catalog image, creating a profile from the
+// entry's config template the first time. The download continues in the
+// background. With an image quota set, the pull is refused if the files
+// would go over it.
+func (s *Server) pullCatalogEntry(entry catalog.Entry, force bool) (int64, error) {
+	imageID, _, err := s.pullCatalogEntryAfter(entry, force, 0)
+	return imageID, err
+}
+
+// pullCatalogEntryAfter is pullCatalogEntry for a pull queued behind
+// others whose downloads, pending bytes in all, haven't landed yet and so
+// aren't on disk for the quota to see. It returns how many bytes the pull
+// is expected to download, when there is a quota to work it out for.
+func (s *Server) pullCatalogEntryAfter(entry catalog.Entry, force bool, pending int64) (int64, int64, error) {
+	var size int64
+	if s.settingSize("image_quota") > 0 {
+		freed, downloads, err := s.pullSpace(entry, force)
+		if err != nil {
+			return 0, 0, err
+		}
+		if downloads {
+			size = catalog.PreviewPull(context.Background(), entry).Total
+			if err := s.checkQuota(areaImages, pending+size, freed); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	imageID, err := catalog.Pull(s.DB, s.DataDir, s.Jobs, entry, force)
 
 	// Auto-create profile if the entry has config template / kernel params
 	if err == nil || (err != nil && err.Error() == "already pulled") {
-		pd := catalog.ProfileDataFromEntry(*entry)
+		pd := catalog.ProfileDataFromEntry(entry)
 		if pd != nil {
 			existing, lookupErr := db.GetProfileByCatalogID(s.DB, entry.ID)
 			if lookupErr == nil && existing == nil {
@@ -52,16 +334,137 @@ func (s *Server) handleCatalogPull(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
+	return imageID, size, err
+}
+
+// settingCatalogETag records the catalog URL and ETag of the last sync,
+// so an unchanged catalog isn't downloaded and compared again.
+const settingCatalogETag = "catalog_sync_etag"
 
+// syncCatalog copies the icon, icon color and description of each pulled
+// image's catalog entry onto the image, and flags images whose entry the
+// catalog no longer lists. Newly orphaned images are logged and sent as an
+// image.orphaned event. New versions of an entry are taken according to
+// the image's catalog policy; see syncCatalogVersion. It runs as the
+// catalog_sync scheduled task.
+func (s *Server) syncCatalog(context.Context) error {
+	catalogURL := s.catalogURL()
+	if catalogURL == "" {
+		return nil
+	}
+	var etag string
+	if mark, _ := db.GetSetting(s.DB, settingCatalogETag); mark != "" {
+		if u, e, ok := strings.Cut(mark, " "); ok && u == catalogURL {
+			etag = e
+		}
+	}
+	cat, newETag, err := catalog.FetchIfChanged(catalogURL, etag, s.catalogKey())
 	if err != nil {
-		if err.Error() == "already pulled" || err.Error() == "already downloading" {
-			w.WriteHeader(http.StatusNoContent)
+		return fmt.Errorf("fetch catalog: %w", err)
+	}
+	if cat == nil {
+		return nil
+	}
+
+	entries := make(map[string]catalog.Entry, len(cat.Entries))
+	for _, e := range cat.Entries {
+		entries[e.ID] = e
+	}
+	images, err := db.ListImages(s.DB)
+	if err != nil {
+		return err
+	}
+	for i := range images {
+		img := &images[i]
+		if img.CatalogID == "" || catalog.IsUtility(img.CatalogID) {
+			continue
+		}
+		entry, listed := entries[img.CatalogID]
+		if listed && catalog.MetaChanged(entry, img) {
+			if err := db.UpdateImageCatalogMeta(s.DB, img.ID, entry.Description, entry.Icon, entry.IconColor); err != nil {
+				log.Printf("catalog: sync: %v", err)
+			}
+		}
+		// Images pulled before arches were recorded learn theirs here.
+		if listed && img.Arch == "" && entry.Arch != "" {
+			if err := db.SetImageArch(s.DB, img.ID, entry.Arch); err != nil {
+				log.Printf("catalog: sync: %v", err)
+			}
+		}
+		if listed {
+			s.syncCatalogVersion(img, entry)
+		}
+		if listed != img.CatalogOrphaned {
+			continue
+		}
+		if err := db.SetImageCatalogOrphaned(s.DB, img.ID, !listed); err != nil {
+			log.Printf("catalog: sync: %v", err)
+			continue
+		}
+		if listed {
+			log.Printf("catalog: %s is listed again (image %d)", img.CatalogID, img.ID)
+			continue
+		}
+		log.Printf("catalog: %s was removed from the catalog; image %d (%s) is orphaned", img.CatalogID, img.ID, img.Name)
+		s.Webhook.Fire(webhook.Event{
+			Type: "image.orphaned",
+			Data: map[string]any{
+				"image_id":   img.ID,
+				"name":       img.Name,
+				"catalog_id": img.CatalogID,
+			},
+		})
+	}
+
+	mark := ""
+	if newETag != "" {
+		mark = catalogURL + " " + newETag
+	}
+	return db.SetSetting(s.DB, settingCatalogETag, mark)
+}
+
+// syncCatalogVersion acts on a catalog entry whose content differs from
+// the version pulled into img. A pinned image is left alone. With the auto
+// policy the new version is pulled in place and an image.updated event is
+// sent; otherwise an image.update_available event is sent, once per
+// version.
+func (s *Server) syncCatalogVersion(img *db.Image, entry catalog.Entry) {
+	hash := entry.Hash()
+	if hash == img.CatalogHash || img.CatalogPolicy == db.CatalogPolicyPin {
+		return
+	}
+	data := map[string]any{
+		"image_id":   img.ID,
+		"name":       img.Name,
+		"catalog_id": img.CatalogID,
+		"version":    entry.Version,
+	}
+	if img.CatalogPolicy == db.CatalogPolicyAuto && img.Status == db.ImageStatusReady {
+		if _, err := s.pullCatalogEntry(entry, true); err != nil {
+			log.Printf("catalog: auto-pull %s: %v", img.CatalogID, err)
 			return
 		}
-		log.Printf("http: catalog pull: %v", err)
-		http.Error(w, "Failed to pull image", http.StatusInternalServerError)
+		log.Printf("catalog: pulling %s %s into image %d", img.CatalogID, entry.Version, img.ID)
+		s.Webhook.Fire(webhook.Event{Type: "image.updated", Data: data})
+		return
+	}
+	if hash == img.CatalogLatest {
+		return
+	}
+	if err := db.SetImageCatalogLatest(s.DB, img.ID, hash); err != nil {
+		log.Printf("catalog: sync: %v", err)
 		return
 	}
+	log.Printf("catalog: %s %s is available for image %d (%s)", img.CatalogID, entry.Version, img.ID, img.Name)
+	s.Webhook.Fire(webhook.Event{Type: "image.update_available", Data: data})
+}
 
-	s.renderImageRow(w, imageID)
+// validCatalogPolicy reports whether p is one of the db.CatalogPolicy
+// values.
+func validCatalogPolicy(p string) bool {
+	switch p {
+	case db.CatalogPolicyManual, db.CatalogPolicyAuto, db.CatalogPolicyPin:
+		return true
+	}
+	return false
 }
@@ -0,0 +1,182 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/webhook"
+)
+
+// settingCertNotified records the last expiry notice sent, as the
+// certificate's NotAfter and the threshold crossed, so each is sent once.
+const settingCertNotified = "cert_expiry_notified"
+
+// certNoticeDays are the days before expiry at which a
+// certificate.expiring event is sent.
+var certNoticeDays = []int{30, 14, 7, 3, 1}
+
+// Certificate states.
+const (
+	certOK          = "ok"
+	certExpiring    = "expiring"
+	certExpired     = "expired"
+	certNotYetValid = "not_yet_valid"
+)
+
+// certInfo describes the certificate HTTPS is serving.
+type certInfo struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	DaysLeft  int       `json:"days_left"`
+	State     string    `json:"state"`
+}
+
+// Warning is a sentence for the UI when the certificate needs attention,
+// or "" when it doesn't.
+func (c *certInfo) Warning() string {
+	switch c.State {
+	case certExpired:
+		return fmt.Sprintf("The HTTPS certificate expired on %s. Clients that verify it can no longer connect.", c.NotAfter.Format("2006-01-02"))
+	case certNotYetValid:
+		return fmt.Sprintf("The HTTPS certificate is not valid until %s. Check this server's clock.", c.NotBefore.Format("2006-01-02 15:04 MST"))
+	case certExpiring:
+		return fmt.Sprintf("The HTTPS certificate expires on %s, in %d day%s.", c.NotAfter.Format("2006-01-02"), c.DaysLeft, plural(c.DaysLeft))
+	}
+	return ""
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
+
+// certificateInfo returns the certificate HTTPS is serving. It is nil with
+// a nil error while HTTPS is disabled or still starting.
+func (s *Server) certificateInfo(now time.Time) (*certInfo, error) {
+	s.health.mu.Lock()
+	cfg, name, tlsErr, done := s.health.tlsConfig, s.health.tlsName, s.health.tlsErr, s.health.tlsDone
+	s.health.mu.Unlock()
+	if !done || tlsErr != "" || cfg == nil {
+		return nil, nil
+	}
+	leaf, err := leafCertificate(cfg, name)
+	if err != nil {
+		return nil, err
+	}
+	c := &certInfo{
+		Subject:   leaf.Subject.CommonName,
+		Issuer:    leaf.Issuer.CommonName,
+		DNSNames:  leaf.DNSNames,
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+		DaysLeft:  int(leaf.NotAfter.Sub(now).Hours() / 24),
+		State:     certOK,
+	}
+	switch {
+	case now.Before(leaf.NotBefore):
+		c.State = certNotYetValid
+	case now.After(leaf.NotAfter):
+		c.State = certExpired
+	case leaf.NotAfter.Sub(now) < certWarnWithin:
+		c.State = certExpiring
+	}
+	return c, nil
+}
+
+// handleRegenerateCert replaces the self-signed certificate with a new one
+// for the current (or pinned) SANs, and returns it.
+func (s *Server) handleRegenerateCert(w http.ResponseWriter, r *http.Request) {
+	s.health.mu.Lock()
+	regen := s.health.regenCert
+	s.health.mu.Unlock()
+	if regen == nil {
+		http.Error(w, "HTTPS is not using a self-signed certificate", http.StatusConflict)
+		return
+	}
+	if err := regen(); err != nil {
+		log.Printf("http: regenerate certificate: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	cert, err := s.certificateInfo(time.Now())
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cert)
+}
+
+// checkCertificates sends a certificate.expiring event as the HTTPS
+// certificate passes each of certNoticeDays and certificate.expired once
+// it has expired, for the cert_check scheduled task. It also forgets
+// machine certificates that have long expired.
+func (s *Server) checkCertificates(context.Context) error {
+	s.checkCertExpiry(time.Now())
+	return db.PruneMachineCerts(s.DB)
+}
+
+func (s *Server) checkCertExpiry(now time.Time) {
+	c, err := s.certificateInfo(now)
+	if err != nil {
+		log.Printf("tls: %v", err)
+		return
+	}
+	if c == nil {
+		return
+	}
+	threshold := -1
+	if c.State == certExpired {
+		threshold = 0
+	} else {
+		for _, days := range certNoticeDays {
+			if c.DaysLeft < days {
+				threshold = days
+			}
+		}
+	}
+	if threshold < 0 {
+		return
+	}
+	mark := strconv.FormatInt(c.NotAfter.Unix(), 10) + "/" + strconv.Itoa(threshold)
+	last, err := db.GetSetting(s.DB, settingCertNotified)
+	if err != nil {
+		log.Printf("tls: %v", err)
+		return
+	}
+	if last == mark {
+		return
+	}
+	if err := db.SetSetting(s.DB, settingCertNotified, mark); err != nil {
+		log.Printf("tls: %v", err)
+		return
+	}
+
+	eventType := "certificate.expiring"
+	if c.State == certExpired {
+		eventType = "certificate.expired"
+	}
+	log.Printf("tls: %s", c.Warning())
+	s.Webhook.Fire(webhook.Event{
+		Type: eventType,
+		Data: map[string]any{
+			"subject":   c.Subject,
+			"issuer":    c.Issuer,
+			"dns_names": c.DNSNames,
+			"not_after": c.NotAfter.UTC().Format(time.RFC3339),
+			"days_left": c.DaysLeft,
+		},
+	})
+}
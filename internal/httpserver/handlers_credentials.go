@@ -0,0 +1,73 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/justinpopa/duh/internal/db"
+)
+
+// systemPasswordHash is the hash of the password generated when sys was
+// last queued, or "" if it has none.
+func (s *Server) systemPasswordHash(sys *db.System) string {
+	c, err := db.GetCredential(s.DB, sys.ID)
+	if err != nil {
+		log.Printf("http: %v", err)
+	}
+	if c == nil {
+		return ""
+	}
+	return c.PasswordHash
+}
+
+// handleSystemCredential says whether a system's generated password can
+// still be revealed.
+func (s *Server) handleSystemCredential(w http.ResponseWriter, r *http.Request) {
+	sys, ok := s.pathSystem(w, r)
+	if !ok {
+		return
+	}
+	c, err := db.GetCredential(s.DB, sys.ID)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	out := map[string]any{"generated": c != nil}
+	if c != nil {
+		out["attempt_id"] = c.AttemptID
+		out["created_at"] = c.CreatedAt
+		out["revealable"] = c.Revealable && sys.State == "ready"
+		out["revealed_at"] = c.RevealedAt
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// handleRevealCredential returns a provisioned system's generated password
+// once; duh forgets it as it does.
+func (s *Server) handleRevealCredential(w http.ResponseWriter, r *http.Request) {
+	sys, ok := s.pathSystem(w, r)
+	if !ok {
+		return
+	}
+	if sys.State != "ready" {
+		http.Error(w, "The password can be revealed once the system is provisioned", http.StatusConflict)
+		return
+	}
+	password, err := db.RevealCredential(s.DB, sys.ID)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if password == "" {
+		http.Error(w, "The password has already been revealed", http.StatusConflict)
+		return
+	}
+	log.Printf("http: revealed the generated password of system %d to %s", sys.ID, clientAddr(r))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"password": password})
+}
@@ -0,0 +1,379 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/justinpopa/duh/internal/catalog"
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/ipxe"
+	"github.com/justinpopa/duh/internal/pdf"
+)
+
+// secureEraseScript runs from Alpine's local service on a system being
+// decommissioned. Each disk gets the strongest erase it supports: an NVMe
+// format with user data erase, then a secure discard, then overwriting it
+// with zeros. The script reads back both ends of each disk to check they
+// are blank, posts a report of every disk to the URL in /etc/duh-wipe.url
+// and powers off.
+const secureEraseScript = `#!/bin/sh
+url=$(cat /etc/duh-wipe.url)
+echo "duh: installing erase tools"
+repo=$(grep -m1 '/main$' /etc/apk/repositories)
+[ -n "$repo" ] && echo "${repo%/main}/community" >> /etc/apk/repositories
+apk update >/dev/null 2>&1
+apk add nvme-cli util-linux >/dev/null 2>&1
+
+now() { date -u +%Y-%m-%dT%H:%M:%SZ; }
+clean() { tr -d '"\\' | tr -s ' \t\n' ' ' | sed 's/^ //; s/ $//'; }
+blank() { cmp -n 16777216 - /dev/zero >/dev/null 2>&1; }
+
+disks=
+for dev in /sys/block/*; do
+	name=${dev##*/}
+	case "$name" in
+	loop*|ram*|sr*|fd*|zram*|dm-*|md*|nbd*) continue ;;
+	esac
+	sectors=$(cat "$dev/size")
+	[ "$sectors" -gt 0 ] || continue
+	disk=/dev/$name
+	model=$(lsblk -dno MODEL "$disk" 2>/dev/null | clean)
+	serial=$(lsblk -dno SERIAL "$disk" 2>/dev/null | clean)
+	size=$((sectors * 512))
+	started=$(now)
+	echo "duh: erasing $disk ($model $serial)"
+	method=
+	case "$name" in
+	nvme*) nvme format "$disk" --ses=1 --force >/dev/null 2>&1 && method=nvme-format ;;
+	esac
+	[ -z "$method" ] && blkdiscard --secure "$disk" >/dev/null 2>&1 && method=secure-discard
+	[ -z "$method" ] && blkdiscard --zeroout "$disk" >/dev/null 2>&1 && method=zero-fill
+	result=erased
+	verified=false
+	if [ -z "$method" ]; then
+		result=failed
+		method=none
+	else
+		tail=$((sectors / 2048 - 16))
+		[ "$tail" -lt 0 ] && tail=0
+		if dd if="$disk" bs=1M count=16 2>/dev/null | blank &&
+			dd if="$disk" bs=1M skip="$tail" count=16 2>/dev/null | blank; then
+			verified=true
+		fi
+	fi
+	echo "duh: $disk $result ($method)"
+	entry=$(printf '{"device":"%s","model":"%s","serial":"%s","size_bytes":%s,"method":"%s","verified":%s,"result":"%s","started_at":"%s","finished_at":"%s"}' \
+		"$disk" "$model" "$serial" "$size" "$method" "$verified" "$result" "$started" "$(now)")
+	disks="${disks:+$disks,}$entry"
+done
+sync
+
+echo "duh: sending wipe report"
+report="{\"disks\":[$disks]}"
+i=0
+until wget -q -O /dev/null --header 'Content-Type: application/json' --post-data "$report" "$url"; do
+	i=$((i + 1))
+	if [ "$i" -ge 30 ]; then
+		echo "duh: could not send the wipe report"
+		break
+	fi
+	sleep 10
+done
+echo "duh: powering off"
+sleep 5
+poweroff
+`
+
+// maxWipeReport caps a posted wipe report.
+const maxWipeReport = 1 << 20
+
+// wipeDisk is one disk in a wipe report.
+type wipeDisk struct {
+	Device     string `json:"device"`
+	Model      string `json:"model"`
+	Serial     string `json:"serial"`
+	SizeBytes  int64  `json:"size_bytes"`
+	Method     string `json:"method"`
+	Verified   bool   `json:"verified"`
+	Result     string `json:"result"` // "erased" or "failed"
+	StartedAt  string `json:"started_at"`
+	FinishedAt string `json:"finished_at"`
+}
+
+// wipeReport is what the secure erase script posts once it is done.
+type wipeReport struct {
+	Disks []wipeDisk `json:"disks"`
+}
+
+// status is the certificate status of a report: wiped only if there were
+// disks and every one was erased.
+func (rep wipeReport) status() string {
+	if len(rep.Disks) == 0 {
+		return db.WipeStatusFailed
+	}
+	for _, d := range rep.Disks {
+		if d.Result != "erased" {
+			return db.WipeStatusFailed
+		}
+	}
+	return db.WipeStatusWiped
+}
+
+// wipeImage returns the Disk Wipe utility image, or nil if it hasn't been
+// pulled.
+func (s *Server) wipeImage() (*db.Image, error) {
+	return db.GetImageByCatalogID(s.DB, catalog.DiskWipeID)
+}
+
+// wipeReportURL is where a decommissioning system's wipe image posts its
+// report.
+func (s *Server) wipeReportURL(serverURL string, sys *db.System) string {
+	u := fmt.Sprintf("%s/api/v1/systems/%s/wipe", serverURL, sys.MAC)
+	if tok := s.wipeToken(sys); tok != "" {
+		u += "?tok=" + tok
+	}
+	return u
+}
+
+// decideDecommission boots a decommissioning system into the secure erase:
+// the Disk Wipe utility's kernel and initramfs with an apkovl made for the
+// system.
+func (s *Server) decideDecommission(r *http.Request, sys *db.System, client ipxe.Client) (*bootDecision, error) {
+	img, err := s.wipeImage()
+	if err != nil || img == nil || img.Status != db.ImageStatusReady {
+		log.Printf("http: disk wipe image for %s unavailable: %v", sys.MAC, err)
+		d := s.exitDecision(sys.MAC, sys, "disk wipe image unavailable")
+		d.Client = client
+		return d, nil
+	}
+
+	serverURL := s.bootServerURL(r, client)
+	params := s.imageScriptParams(serverURL, sys, img)
+	params.Client = client
+	params.Cmdline = catalog.AlpineCmdline + " apkovl=" +
+		s.signURL(tokenPurposeWipe, sys, fmt.Sprintf("%s/decommission/%d/wipe.apkovl.tar.gz", serverURL, sys.ID))
+	d := &bootDecision{
+		MAC:       sys.MAC,
+		SystemID:  sys.ID,
+		Hostname:  sys.Hostname,
+		State:     sys.State,
+		Action:    bootActionWipe,
+		Image:     &bootImage{ID: img.ID, Name: img.Name, BootType: img.BootType},
+		Client:    client,
+		ServerURL: serverURL,
+	}
+	// The utility's own script boots the shared apkovl; boot its files as
+	// a plain Linux image instead.
+	wipe := *img
+	wipe.BootType, wipe.IPXEScript = "linux", ""
+	if err := s.renderDecision(d, sys, &wipe, params); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// handleWipeOverlay serves the apkovl that erases a decommissioning
+// system's disks and reports back.
+func (s *Server) handleWipeOverlay(w http.ResponseWriter, r *http.Request) {
+	bound, ok := s.validateToken(r, tokenPurposeWipe)
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if bound != nil && bound.ID != id {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	sys, err := db.GetSystemByID(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if sys == nil || sys.State != "decommissioning" {
+		http.Error(w, "System is not being decommissioned", http.StatusNotFound)
+		return
+	}
+	serverURL := s.serverURL()
+	if serverURL == "" {
+		serverURL = "http://" + r.Host
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	err = writeApkovl(w, "duh-wipe", []apkovlFile{
+		{"etc/duh-wipe.url", 0600, s.wipeReportURL(serverURL, sys) + "\n"},
+		{"etc/local.d/duh-wipe.start", 0755, secureEraseScript},
+	})
+	if err != nil {
+		log.Printf("http: write wipe overlay: %v", err)
+	}
+}
+
+// handleWipeReport records the report of a finished wipe as the system's
+// wipe certificate. A clean wipe archives the system as decommissioned.
+func (s *Server) handleWipeReport(w http.ResponseWriter, r *http.Request) {
+	sys, err := db.GetSystemByMAC(s.DB, r.PathValue("mac"))
+	if err != nil {
+		log.Printf("http: wipe report system lookup: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if sys == nil {
+		http.Error(w, "System not found", http.StatusNotFound)
+		return
+	}
+	if !s.validWipeToken(r, sys) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var rep wipeReport
+	r.Body = http.MaxBytesReader(w, r.Body, maxWipeReport)
+	if err := json.NewDecoder(r.Body).Decode(&rep); err != nil {
+		http.Error(w, "Invalid wipe report", http.StatusBadRequest)
+		return
+	}
+	report, err := json.Marshal(rep)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	cert, err := db.RecordWipe(s.DB, sys.ID, rep.status(), string(report))
+	if errors.Is(err, db.ErrNotDecommissioning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("http: record wipe: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("http: wipe of %s (%s): %s, %d disks", sys.Hostname, sys.MAC, cert.Status, len(rep.Disks))
+	if cert.Status == db.WipeStatusWiped {
+		s.fireSystemEvent(sys, "decommissioned")
+	} else {
+		s.Webhook.Fire(systemEvent(sys, "wipe_failed"))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"status": cert.Status, "certificate": cert.ID})
+}
+
+// systemWipeCertificate looks up the latest wipe certificate of the system
+// in the request path, writing an error response if there is none.
+func (s *Server) systemWipeCertificate(w http.ResponseWriter, r *http.Request) (*db.WipeCertificate, wipeReport, bool) {
+	var rep wipeReport
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return nil, rep, false
+	}
+	cert, err := db.LatestWipeCertificate(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, rep, false
+	}
+	if cert == nil {
+		http.Error(w, "No wipe certificate", http.StatusNotFound)
+		return nil, rep, false
+	}
+	if err := json.Unmarshal([]byte(cert.Report), &rep); err != nil {
+		log.Printf("http: wipe certificate %d: %v", cert.ID, err)
+	}
+	return cert, rep, true
+}
+
+// handleWipeCertificate returns a system's latest wipe certificate as JSON.
+func (s *Server) handleWipeCertificate(w http.ResponseWriter, r *http.Request) {
+	cert, rep, ok := s.systemWipeCertificate(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":          cert.ID,
+		"system_id":   cert.SystemID,
+		"mac":         cert.MAC,
+		"hostname":    cert.Hostname,
+		"status":      cert.Status,
+		"started_at":  cert.StartedAt,
+		"finished_at": cert.FinishedAt,
+		"disks":       rep.Disks,
+		"sha256":      reportDigest(cert),
+	})
+}
+
+// reportDigest fingerprints a certificate's report as stored, so a copy
+// can be checked against duh's record.
+func reportDigest(cert *db.WipeCertificate) string {
+	sum := sha256.Sum256([]byte(cert.Report))
+	return hex.EncodeToString(sum[:])
+}
+
+// handleWipeCertificatePDF renders a system's latest wipe certificate as a
+// PDF for asset disposal records.
+func (s *Server) handleWipeCertificatePDF(w http.ResponseWriter, r *http.Request) {
+	cert, rep, ok := s.systemWipeCertificate(w, r)
+	if !ok {
+		return
+	}
+	doc := pdf.New()
+	doc.Line(18, true, "Disk wipe certificate")
+	doc.Line(10, false, fmt.Sprintf("Certificate %d, issued %s UTC", cert.ID, cert.FinishedAt))
+	doc.Space(10)
+
+	result := "All disks erased"
+	if cert.Status != db.WipeStatusWiped {
+		result = "Incomplete: not every disk was erased"
+	}
+	hostname := cert.Hostname
+	if hostname == "" {
+		hostname = "(none)"
+	}
+	for _, kv := range [][2]string{
+		{"Hostname", hostname},
+		{"MAC address", cert.MAC},
+		{"System ID", strconv.FormatInt(cert.SystemID, 10)},
+		{"Decommissioned", cert.StartedAt + " UTC"},
+		{"Wipe reported", cert.FinishedAt + " UTC"},
+		{"Result", result},
+	} {
+		doc.Row(10, false, []float64{0, 160}, kv[:])
+	}
+
+	doc.Space(12)
+	doc.Line(13, true, "Disks")
+	cols := []float64{0, 70, 200, 300, 360, 430}
+	doc.Row(9, true, cols, []string{"Device", "Model", "Serial", "Size", "Method", "Result"})
+	for _, d := range rep.Disks {
+		res := d.Result
+		if d.Verified {
+			res += ", verified blank"
+		}
+		doc.Row(9, false, cols, []string{d.Device, d.Model, d.Serial, fileSize(d.SizeBytes), d.Method, res})
+		doc.Row(8, false, []float64{70}, []string{fmt.Sprintf("%s to %s", d.StartedAt, d.FinishedAt)})
+	}
+	if len(rep.Disks) == 0 {
+		doc.Line(9, false, "No disks were found.")
+	}
+
+	doc.Space(12)
+	doc.Line(8, false, "Report SHA-256: "+reportDigest(cert))
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="wipe-certificate-%d.pdf"`, cert.ID))
+	w.Write(doc.Bytes())
+}
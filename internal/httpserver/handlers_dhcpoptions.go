@@ -0,0 +1,64 @@
+package httpserver
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/proxydhcp"
+)
+
+// DHCPOptions returns the extra options configured for proxy DHCP replies.
+// The proxy DHCP server calls it for every reply.
+func (s *Server) DHCPOptions() []proxydhcp.Option {
+	text, err := db.GetSetting(s.DB, "dhcp_options")
+	if err != nil {
+		log.Printf("http: get dhcp options: %v", err)
+		return nil
+	}
+	opts, err := proxydhcp.ParseOptions(text)
+	if err != nil {
+		// Saved options are validated, so this only happens if the
+		// setting was edited by hand.
+		log.Printf("http: dhcp options: %v", err)
+		return nil
+	}
+	return opts
+}
+
+func (s *Server) renderDHCPOptions(w http.ResponseWriter, saved bool) {
+	text, err := db.GetSetting(s.DB, "dhcp_options")
+	if err != nil {
+		log.Printf("http: get dhcp options: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]any{
+		"DHCPOptions": text,
+		"Saved":       saved,
+	}
+	if err := s.Templates.ExecuteTemplate(w, "dhcp_options", data); err != nil {
+		log.Printf("http: render dhcp_options: %v", err)
+	}
+}
+
+func (s *Server) handleSetDHCPOptions(w http.ResponseWriter, r *http.Request) {
+	text := strings.TrimSpace(strings.ReplaceAll(r.FormValue("options"), "\r\n", "\n"))
+	if _, err := proxydhcp.ParseOptions(text); err != nil {
+		http.Error(w, "Invalid DHCP options: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var err error
+	if text == "" {
+		err = db.DeleteSetting(s.DB, "dhcp_options")
+	} else {
+		err = db.SetSetting(s.DB, "dhcp_options", text)
+	}
+	if err != nil {
+		log.Printf("http: set dhcp options: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderDHCPOptions(w, true)
+}
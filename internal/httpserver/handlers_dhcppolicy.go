@@ -0,0 +1,130 @@
+package httpserver
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/proxydhcp"
+)
+
+// Settings holding the proxy DHCP client policy.
+const (
+	settingPXEKnownOnly   = "pxe_known_only"
+	settingPXEMACPrefixes = "pxe_mac_prefixes"
+	settingPXESubnets     = "pxe_subnets"
+	settingPXEIgnoreMACs  = "pxe_ignore_macs"
+)
+
+type dhcpPolicyForm struct {
+	KnownOnly   bool
+	MACPrefixes string
+	Subnets     string
+	IgnoreMACs  string
+}
+
+func (s *Server) dhcpPolicyForm() (dhcpPolicyForm, error) {
+	var f dhcpPolicyForm
+	var knownOnly string
+	for _, v := range []struct {
+		key string
+		dst *string
+	}{
+		{settingPXEKnownOnly, &knownOnly},
+		{settingPXEMACPrefixes, &f.MACPrefixes},
+		{settingPXESubnets, &f.Subnets},
+		{settingPXEIgnoreMACs, &f.IgnoreMACs},
+	} {
+		val, err := db.GetSetting(s.DB, v.key)
+		if err != nil {
+			return f, err
+		}
+		*v.dst = val
+	}
+	f.KnownOnly = knownOnly == "1"
+	return f, nil
+}
+
+// DHCPPolicy returns the policy deciding which clients proxy DHCP answers.
+// The proxy DHCP server calls it for every request.
+func (s *Server) DHCPPolicy() proxydhcp.Policy {
+	f, err := s.dhcpPolicyForm()
+	if err != nil {
+		log.Printf("http: get dhcp policy: %v", err)
+		return proxydhcp.Policy{}
+	}
+	p, err := proxydhcp.ParsePolicy(f.KnownOnly, f.MACPrefixes, f.Subnets, f.IgnoreMACs)
+	if err != nil {
+		// Saved policies are validated, so this only happens if a
+		// setting was edited by hand.
+		log.Printf("http: dhcp policy: %v", err)
+		return proxydhcp.Policy{}
+	}
+	return p
+}
+
+// KnownSystem reports whether mac belongs to a registered system.
+func (s *Server) KnownSystem(mac string) bool {
+	sys, err := db.GetSystemByMAC(s.DB, mac)
+	if err != nil {
+		log.Printf("http: get system by mac: %v", err)
+		return false
+	}
+	return sys != nil
+}
+
+func (s *Server) renderDHCPPolicy(w http.ResponseWriter, saved bool) {
+	f, err := s.dhcpPolicyForm()
+	if err != nil {
+		log.Printf("http: get dhcp policy: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]any{
+		"DHCPPolicy": f,
+		"Saved":      saved,
+	}
+	if err := s.Templates.ExecuteTemplate(w, "dhcp_policy", data); err != nil {
+		log.Printf("http: render dhcp_policy: %v", err)
+	}
+}
+
+func (s *Server) handleSetDHCPPolicy(w http.ResponseWriter, r *http.Request) {
+	clean := func(name string) string {
+		return strings.TrimSpace(strings.ReplaceAll(r.FormValue(name), "\r\n", "\n"))
+	}
+	f := dhcpPolicyForm{
+		KnownOnly:   r.FormValue("known_only") == "on",
+		MACPrefixes: clean("mac_prefixes"),
+		Subnets:     clean("subnets"),
+		IgnoreMACs:  clean("ignore_macs"),
+	}
+	if _, err := proxydhcp.ParsePolicy(f.KnownOnly, f.MACPrefixes, f.Subnets, f.IgnoreMACs); err != nil {
+		http.Error(w, "Invalid policy: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	knownOnly := ""
+	if f.KnownOnly {
+		knownOnly = "1"
+	}
+	for key, val := range map[string]string{
+		settingPXEKnownOnly:   knownOnly,
+		settingPXEMACPrefixes: f.MACPrefixes,
+		settingPXESubnets:     f.Subnets,
+		settingPXEIgnoreMACs:  f.IgnoreMACs,
+	} {
+		var err error
+		if val == "" {
+			err = db.DeleteSetting(s.DB, key)
+		} else {
+			err = db.SetSetting(s.DB, key, val)
+		}
+		if err != nil {
+			log.Printf("http: set %s: %v", key, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	s.renderDHCPPolicy(w, true)
+}
@@ -0,0 +1,239 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/tftpserver"
+)
+
+// handleMetrics serves counters in the Prometheus text format. Like
+// /healthz it is public so a scraper needs no credentials.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	if stats, err := db.GetStats(s.DB); err != nil {
+		log.Printf("http: metrics: %v", err)
+	} else {
+		fmt.Fprintln(w, "# HELP duh_systems Systems by state.")
+		fmt.Fprintln(w, "# TYPE duh_systems gauge")
+		for _, st := range []struct {
+			state string
+			n     int
+		}{
+			{"discovered", stats.Systems.Discovered},
+			{"queued", stats.Systems.Queued},
+			{"provisioning", stats.Systems.Provisioning},
+			{"ready", stats.Systems.Ready},
+			{"failed", stats.Systems.Failed},
+			{"decommissioning", stats.Systems.Decommissioning},
+			{"decommissioned", stats.Systems.Decommissioned},
+		} {
+			fmt.Fprintf(w, "duh_systems{state=%q} %d\n", st.state, st.n)
+		}
+	}
+
+	s.writeProvisionMetrics(w)
+	s.writeBandwidthMetrics(w)
+
+	if cert, err := s.certificateInfo(time.Now()); err != nil {
+		log.Printf("http: metrics: %v", err)
+	} else if cert != nil {
+		fmt.Fprintln(w, "# HELP duh_tls_certificate_expiry_timestamp_seconds When the HTTPS certificate expires.")
+		fmt.Fprintln(w, "# TYPE duh_tls_certificate_expiry_timestamp_seconds gauge")
+		fmt.Fprintf(w, "duh_tls_certificate_expiry_timestamp_seconds %d\n", cert.NotAfter.Unix())
+	}
+
+	snap := s.TFTPStats.Snapshot()
+	fmt.Fprintln(w, "# HELP duh_tftp_transfers_total TFTP transfers by result.")
+	fmt.Fprintln(w, "# TYPE duh_tftp_transfers_total counter")
+	fmt.Fprintf(w, "duh_tftp_transfers_total{result=\"success\"} %d\n", snap.Succeeded)
+	fmt.Fprintf(w, "duh_tftp_transfers_total{result=\"failure\"} %d\n", snap.Failed)
+	fmt.Fprintln(w, "# HELP duh_tftp_sent_bytes_total Bytes sent by completed TFTP transfers.")
+	fmt.Fprintln(w, "# TYPE duh_tftp_sent_bytes_total counter")
+	fmt.Fprintf(w, "duh_tftp_sent_bytes_total %d\n", snap.Bytes)
+	fmt.Fprintln(w, "# HELP duh_tftp_retransmits_total TFTP datagrams sent but not acknowledged.")
+	fmt.Fprintln(w, "# TYPE duh_tftp_retransmits_total counter")
+	fmt.Fprintf(w, "duh_tftp_retransmits_total %d\n", snap.Retransmits)
+	fmt.Fprintln(w, "# HELP duh_tftp_transfer_seconds Time spent on TFTP transfers.")
+	fmt.Fprintln(w, "# TYPE duh_tftp_transfer_seconds summary")
+	fmt.Fprintf(w, "duh_tftp_transfer_seconds_sum %g\n", snap.Seconds)
+	fmt.Fprintf(w, "duh_tftp_transfer_seconds_count %d\n", snap.Succeeded+snap.Failed)
+}
+
+// provisionBuckets are the histogram bounds, in seconds, for provision
+// phase durations.
+var provisionBuckets = []float64{30, 60, 120, 300, 600, 900, 1200, 1800, 2700, 3600, 7200}
+
+// writeProvisionMetrics exports how long successful provision attempts
+// took in each phase, and how many missed the time objective.
+func (s *Server) writeProvisionMetrics(w io.Writer) {
+	attempts, err := db.ListAttemptsBetween(s.DB, time.Time{}, time.Now().Add(24*time.Hour))
+	if err != nil {
+		log.Printf("http: metrics: %v", err)
+		return
+	}
+	results := map[string]int{}
+	phases := []struct {
+		name string
+		of   func(db.ProvisionAttempt) time.Duration
+		ds   []float64
+	}{
+		{name: "wait", of: db.ProvisionAttempt.WaitTime},
+		{name: "install", of: db.ProvisionAttempt.InstallTime},
+		{name: "total", of: db.ProvisionAttempt.TotalTime},
+	}
+	slo := s.settingDuration("provision_slo")
+	overSLO := 0
+	for _, a := range attempts {
+		if a.FinishedAt == "" {
+			continue
+		}
+		results[a.State]++
+		if a.State != "ready" {
+			continue
+		}
+		for i := range phases {
+			if d := phases[i].of(a.ProvisionAttempt); d > 0 {
+				phases[i].ds = append(phases[i].ds, d.Seconds())
+			}
+		}
+		if d := a.TotalTime(); slo > 0 && d > slo {
+			overSLO++
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP duh_provision_attempts_total Finished provision attempts by result.")
+	fmt.Fprintln(w, "# TYPE duh_provision_attempts_total counter")
+	for _, result := range []string{"ready", "failed", "cancelled"} {
+		fmt.Fprintf(w, "duh_provision_attempts_total{result=%q} %d\n", result, results[result])
+	}
+	fmt.Fprintln(w, "# HELP duh_provision_duration_seconds Time successful provision attempts spent queued (wait), installing (install) and in all (total).")
+	fmt.Fprintln(w, "# TYPE duh_provision_duration_seconds histogram")
+	for _, ph := range phases {
+		var sum float64
+		for _, d := range ph.ds {
+			sum += d
+		}
+		for _, le := range provisionBuckets {
+			n := 0
+			for _, d := range ph.ds {
+				if d <= le {
+					n++
+				}
+			}
+			fmt.Fprintf(w, "duh_provision_duration_seconds_bucket{phase=%q,le=\"%g\"} %d\n", ph.name, le, n)
+		}
+		fmt.Fprintf(w, "duh_provision_duration_seconds_bucket{phase=%q,le=\"+Inf\"} %d\n", ph.name, len(ph.ds))
+		fmt.Fprintf(w, "duh_provision_duration_seconds_sum{phase=%q} %g\n", ph.name, sum)
+		fmt.Fprintf(w, "duh_provision_duration_seconds_count{phase=%q} %d\n", ph.name, len(ph.ds))
+	}
+	fmt.Fprintln(w, "# HELP duh_provision_slo_seconds The provision time objective, from queued to ready.")
+	fmt.Fprintln(w, "# TYPE duh_provision_slo_seconds gauge")
+	fmt.Fprintf(w, "duh_provision_slo_seconds %g\n", slo.Seconds())
+	fmt.Fprintln(w, "# HELP duh_provision_over_slo Successful provision attempts that took longer than the objective.")
+	fmt.Fprintln(w, "# TYPE duh_provision_over_slo gauge")
+	fmt.Fprintf(w, "duh_provision_over_slo %d\n", overSLO)
+}
+
+func (s *Server) handleDiagnosticsPage(w http.ResponseWriter, r *http.Request) {
+	var inbox []tftpserver.InboxFile
+	if s.Inbox != nil {
+		var err error
+		inbox, err = s.Inbox.List()
+		if err != nil {
+			log.Printf("http: list tftp inbox: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	cert, certErr := s.certificateInfo(time.Now())
+	s.health.mu.Lock()
+	canRegen := s.health.regenCert != nil
+	s.health.mu.Unlock()
+	hash, _ := s.getAuthState()
+	data := map[string]any{
+		"Certificate":  cert,
+		"CanRegenCert": canRegen,
+		"TFTPAddr":     s.TFTPAddr,
+		"TFTPOptions":  s.TFTPOptions.WithDefaults(),
+		"TFTP":         s.TFTPStats.Snapshot(),
+		"InboxEnabled": s.Inbox != nil,
+		"Inbox":        inbox,
+		"AuthEnabled":  hash != "",
+	}
+	if certErr != nil {
+		data["CertificateError"] = certErr.Error()
+	}
+	s.addThemeData(r, data)
+	if err := s.Templates.ExecuteTemplate(w, "diagnostics", data); err != nil {
+		log.Printf("http: render diagnostics: %v", err)
+	}
+}
+
+// MACForIP returns the MAC of the system last seen at ip, or "". The TFTP
+// inbox uses it to file uploads under the sending system.
+func (s *Server) MACForIP(ip net.IP) string {
+	sys, err := db.GetSystemByIP(s.DB, ip.String())
+	if err != nil {
+		log.Printf("http: %v", err)
+		return ""
+	}
+	if sys == nil {
+		return ""
+	}
+	return sys.MAC
+}
+
+func (s *Server) handleInboxFile(w http.ResponseWriter, r *http.Request) {
+	if s.Inbox == nil {
+		http.NotFound(w, r)
+		return
+	}
+	mac, name := r.PathValue("mac"), r.PathValue("name")
+	f, err := s.Inbox.Open(mac, name)
+	if err != nil {
+		if errors.Is(err, tftpserver.ErrInvalidName) || errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("http: open tftp inbox file: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		log.Printf("http: stat tftp inbox file: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// Uploads come from clients; never let a browser render them.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+func (s *Server) handleDeleteInboxFile(w http.ResponseWriter, r *http.Request) {
+	if s.Inbox == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := s.Inbox.Remove(r.PathValue("mac"), r.PathValue("name")); err != nil {
+		if errors.Is(err, tftpserver.ErrInvalidName) {
+			http.Error(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+		log.Printf("http: remove tftp inbox file: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
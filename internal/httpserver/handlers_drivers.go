@@ -0,0 +1,299 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/db"
+)
+
+// driverOSFamilies are the installers a driver can be limited to.
+var driverOSFamilies = []string{"windows", "linux"}
+
+func (s *Server) driverDir(id int64) string {
+	return filepath.Join(s.DataDir, "drivers", strconv.FormatInt(id, 10))
+}
+
+// driversURL is the signed URL of sys's driver manifest.
+func (s *Server) driversURL(serverURL string, sys *db.System) string {
+	return s.signURL(tokenPurposeDriver, sys, fmt.Sprintf("%s/config/%d/drivers", serverURL, sys.ID))
+}
+
+// driverEntry is one driver in a manifest.
+type driverEntry struct {
+	ID          int64    `json:"id"`
+	Name        string   `json:"name"`
+	OSFamily    string   `json:"os_family,omitempty"`
+	HardwareIDs []string `json:"hardware_ids"`
+	File        string   `json:"file"`
+	Size        int64    `json:"size"`
+	SHA256      string   `json:"sha256"`
+	URL         string   `json:"url"`
+}
+
+// handleDriverManifest lists the drivers of a system's profile for its
+// installer. With hwid parameters, repeated or comma-separated, only
+// drivers for that hardware are listed, so WinPE or a Linux installer can
+// pass what it found on the bus. format=text gives "<sha256> <file> <url>"
+// lines for shell scripts.
+func (s *Server) handleDriverManifest(w http.ResponseWriter, r *http.Request) {
+	bound, ok := s.validateToken(r, tokenPurposeDriver)
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if bound != nil && bound.ID != id {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	sys, err := db.GetSystemByID(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if sys == nil {
+		http.Error(w, "System not found", http.StatusNotFound)
+		return
+	}
+	if sys.ProfileID == nil {
+		http.Error(w, "No profile assigned", http.StatusNotFound)
+		return
+	}
+	drivers, err := db.ProfileDrivers(s.DB, *sys.ProfileID)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	var hwids []string
+	for _, v := range r.URL.Query()["hwid"] {
+		hwids = append(hwids, strings.Split(v, ",")...)
+	}
+	serverURL := s.serverURL()
+	if serverURL == "" {
+		serverURL = "http://" + r.Host
+	}
+	entries := []driverEntry{}
+	for _, d := range drivers {
+		if len(hwids) > 0 && !d.Matches(hwids) {
+			continue
+		}
+		entries = append(entries, driverEntry{
+			ID:          d.ID,
+			Name:        d.Name,
+			OSFamily:    d.OSFamily,
+			HardwareIDs: d.IDs(),
+			File:        d.FileName,
+			Size:        d.Size,
+			SHA256:      d.SHA256,
+			URL:         s.signURL(tokenPurposeDriver, sys, fmt.Sprintf("%s/drivers/%d/file/%s", serverURL, d.ID, d.FileName)),
+		})
+	}
+
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s %s %s\n", e.SHA256, e.File, e.URL)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"drivers": entries})
+}
+
+// handleServeDriverFile serves a driver pack to a system whose profile
+// has it attached.
+func (s *Server) handleServeDriverFile(w http.ResponseWriter, r *http.Request) {
+	bound, ok := s.validateToken(r, tokenPurposeDriver)
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	d, err := db.GetDriver(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if d == nil || d.FileName != r.PathValue("name") {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if bound != nil {
+		if bound.ProfileID == nil {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		attached, err := db.ProfileDrivers(s.DB, *bound.ProfileID)
+		if err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !slices.ContainsFunc(attached, func(a db.Driver) bool { return a.ID == id }) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	http.ServeFile(w, r, filepath.Join(s.driverDir(id), d.FileName))
+}
+
+// driversData adds the drivers library to page data.
+func (s *Server) driversData(data map[string]any) error {
+	drivers, err := db.ListDrivers(s.DB)
+	if err != nil {
+		return err
+	}
+	counts, err := db.DriverProfileCounts(s.DB)
+	if err != nil {
+		return err
+	}
+	data["Drivers"] = drivers
+	data["DriverProfiles"] = counts
+	data["DriverOSFamilies"] = driverOSFamilies
+	return nil
+}
+
+func (s *Server) renderDriversList(w http.ResponseWriter) {
+	data := map[string]any{}
+	if err := s.driversData(data); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.Templates.ExecuteTemplate(w, "drivers_list", data); err != nil {
+		log.Printf("http: render drivers list: %v", err)
+	}
+}
+
+func (s *Server) handleCreateDriver(w http.ResponseWriter, r *http.Request) {
+	const maxUpload = 4 << 30 // 4 GB
+	form, err := s.streamMultipart(w, r, maxUpload)
+	if err != nil {
+		http.Error(w, "Upload too large or failed to parse form", http.StatusBadRequest)
+		return
+	}
+	defer form.Close()
+
+	name := strings.TrimSpace(form.Values.Get("name"))
+	if name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	osFamily := form.Values.Get("os_family")
+	if osFamily != "" && !slices.Contains(driverOSFamilies, osFamily) {
+		http.Error(w, "Invalid OS family", http.StatusBadRequest)
+		return
+	}
+	file, ok := form.File("file")
+	if !ok {
+		http.Error(w, "Driver file is required", http.StatusBadRequest)
+		return
+	}
+	if strings.HasPrefix(file.Name, ".") {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+	if refuseOverQuota(w, s.checkQuota(areaProfiles, file.Size, 0)) {
+		return
+	}
+	hardwareIDs := strings.Join(db.Driver{HardwareIDs: form.Values.Get("hardware_ids")}.IDs(), "\n")
+
+	id, err := db.CreateDriver(s.DB, name, osFamily, hardwareIDs, file.Name, file.Size, file.SHA256)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	dir := s.driverDir(id)
+	err = os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = s.install(file, filepath.Join(dir, file.Name))
+	}
+	if err != nil {
+		log.Printf("http: save driver file: %v", err)
+		db.DeleteDriver(s.DB, id)
+		http.Error(w, "Failed to save driver file", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("http: added driver %s (%s)", name, file.Name)
+	s.renderDriversList(w)
+}
+
+func (s *Server) handleDeleteDriver(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if err := db.DeleteDriver(s.DB, id); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := os.RemoveAll(s.driverDir(id)); err != nil {
+		log.Printf("http: remove driver files: %v", err)
+	}
+	s.renderDriversList(w)
+}
+
+// saveProfileDrivers attaches the drivers checked in a profile form. Forms
+// without the drivers section leave the profile's drivers alone.
+func (s *Server) saveProfileDrivers(profileID int64, values map[string][]string) error {
+	if _, ok := values["drivers_shown"]; !ok {
+		return nil
+	}
+	drivers, err := db.ListDrivers(s.DB)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for _, v := range values["driver_ids"] {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err == nil && slices.ContainsFunc(drivers, func(d db.Driver) bool { return d.ID == id }) {
+			ids = append(ids, id)
+		}
+	}
+	return db.SetProfileDrivers(s.DB, profileID, ids)
+}
+
+// profileDriversData adds the drivers library and those attached to a
+// profile, by ID, to the profile editor's data.
+func (s *Server) profileDriversData(data map[string]any, profileID int64) error {
+	drivers, err := db.ListDrivers(s.DB)
+	if err != nil {
+		return err
+	}
+	attached := map[int64]bool{}
+	if profileID != 0 {
+		list, err := db.ProfileDrivers(s.DB, profileID)
+		if err != nil {
+			return err
+		}
+		for _, d := range list {
+			attached[d.ID] = true
+		}
+	}
+	data["Drivers"] = drivers
+	data["AttachedDrivers"] = attached
+	return nil
+}
@@ -0,0 +1,204 @@
+package httpserver
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/justinpopa/duh/internal/bootmedia"
+	"github.com/justinpopa/duh/internal/ipxe"
+)
+
+// buildScript builds iPXE with the embedded script. It runs on the user's
+// machine, since duh can't compile iPXE itself.
+const buildScript = `#!/bin/sh
+# Builds iPXE with duh's embedded chain script.
+# Needs git, make, gcc, perl and liblzma headers; ISO images also need
+# genisoimage (or xorriso) and syslinux.
+set -e
+cd "$(dirname "$0")"
+kit=$(pwd)
+
+[ -d ipxe ] || git clone --depth 1 https://github.com/ipxe/ipxe.git
+cd ipxe/src
+
+# HTTPS downloads are off in a default build.
+printf '#define DOWNLOAD_PROTO_HTTPS\n#define IMAGE_TRUST_CMD\n' > config/local/general.h
+
+trust=
+[ -f "$kit/ca.pem" ] && trust="$kit/ca.pem"
+if [ -f "$kit/codesign.pem" ]; then
+	# Naming any root drops iPXE's own, which public HTTPS certificates
+	# chain to, so keep it alongside the boot file signing root.
+	if [ -z "$trust" ]; then
+		[ -f "$kit/ipxe-root.pem" ] || curl -fsSL -o "$kit/ipxe-root.pem" https://ipxe.org/_media/certs/ca.crt
+		trust="$kit/ipxe-root.pem"
+	fi
+	trust="$trust,$kit/codesign.pem"
+fi
+[ -n "$trust" ] && trust="TRUST=$trust"
+
+targets=${*:-bin/ipxe.usb bin/ipxe.iso bin-x86_64-efi/ipxe.efi bin-x86_64-efi/ipxe.usb}
+make -j"$(nproc 2>/dev/null || echo 2)" $targets EMBED="$kit/embed.ipxe" $trust
+
+echo
+for t in $targets; do echo "built ipxe/src/$t"; done
+echo "Write a .usb image to a stick with: dd if=ipxe/src/bin/ipxe.usb of=/dev/sdX bs=1M"
+`
+
+// embedParams reads the script options from the query string.
+func (s *Server) embedParams(r *http.Request) ipxe.EmbedParams {
+	q := r.URL.Query()
+	serverURL := s.serverURL()
+	if serverURL == "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if _, port, err := net.SplitHostPort(s.HTTPAddr); err == nil && port != "80" {
+			host = net.JoinHostPort(host, port)
+		}
+		serverURL = "http://" + host
+	}
+	return ipxe.EmbedParams{
+		ServerURL: serverURL,
+		Interface: strings.TrimSpace(q.Get("iface")),
+		IP:        strings.TrimSpace(q.Get("ip")),
+		Netmask:   strings.TrimSpace(q.Get("netmask")),
+		Gateway:   strings.TrimSpace(q.Get("gateway")),
+		DNS:       strings.TrimSpace(q.Get("dns")),
+	}
+}
+
+// handleEmbedScript serves a chain script to embed when building iPXE.
+func (s *Server) handleEmbedScript(w http.ResponseWriter, r *http.Request) {
+	script, err := ipxe.EmbedScript(s.embedParams(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Disposition", `attachment; filename="embed.ipxe"`)
+	w.Write([]byte(script))
+}
+
+// handleBuildKit serves a tarball with the embedded script, this server's
+// certificate when iPXE needs it to trust HTTPS, and a script that builds
+// iPXE USB, ISO and EFI images from them.
+func (s *Server) handleBuildKit(w http.ResponseWriter, r *http.Request) {
+	params := s.embedParams(r)
+	script, err := ipxe.EmbedScript(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	type kitFile struct {
+		name string
+		mode int64
+		body []byte
+	}
+	files := []kitFile{
+		{"duh-ipxe/embed.ipxe", 0644, []byte(script)},
+		{"duh-ipxe/build.sh", 0755, []byte(buildScript)},
+	}
+	// Public CAs are trusted through iPXE's own cross-signing, but a
+	// self-signed or private certificate has to be built in.
+	if strings.HasPrefix(params.ServerURL, "https://") && s.TrustCertFile != "" && r.URL.Query().Get("trust") != "0" {
+		cert, err := os.ReadFile(s.TrustCertFile)
+		if err != nil {
+			log.Printf("http: read trust certificate: %v", err)
+		} else {
+			files = append(files, kitFile{"duh-ipxe/ca.pem", 0644, cert})
+		}
+	}
+
+	// imgverify needs the boot file signing root.
+	if s.SettingBool("imgverify") {
+		signer, err := s.codeSigner()
+		if err != nil {
+			log.Printf("http: code signing: %v", err)
+		} else {
+			files = append(files, kitFile{"duh-ipxe/codesign.pem", 0644, signer.RootPEM()})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="duh-ipxe.tar.gz"`)
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "duh-ipxe/", Mode: 0755, ModTime: now})
+	for _, f := range files {
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: f.name, Mode: f.mode, Size: int64(len(f.body)), ModTime: now})
+		tw.Write(f.body)
+	}
+	if err := tw.Close(); err != nil {
+		log.Printf("http: write build kit: %v", err)
+		return
+	}
+	gz.Close()
+}
+
+// handleBootMedia serves a UEFI boot image, USB (.img) or ISO (.iso),
+// holding duh's iPXE builds and the chain script as autoexec.ipxe, which
+// iPXE runs from the volume it was loaded from. BIOS machines need an
+// image built from the build kit instead.
+func (s *Server) handleBootMedia(w http.ResponseWriter, r *http.Request) {
+	params := s.embedParams(r)
+	if strings.HasPrefix(params.ServerURL, "https://") && s.TrustCertFile != "" {
+		// The stock builds can't verify a self-signed or private
+		// certificate, so use the plain HTTP listener.
+		params.ServerURL = s.bootServerURL(r, ipxe.Client{Features: []string{"http"}})
+	}
+	script, err := ipxe.EmbedScript(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	files := []bootmedia.File{
+		{Path: "autoexec.ipxe", Data: []byte(script)},
+		{Path: "EFI/BOOT/autoexec.ipxe", Data: []byte(script)},
+	}
+	for _, b := range []struct{ name, path string }{
+		{"ipxe.efi", "EFI/BOOT/BOOTX64.EFI"},
+		{"ipxe-arm64.efi", "EFI/BOOT/BOOTAA64.EFI"},
+	} {
+		data, err := s.Binaries.Read(b.name)
+		if err != nil {
+			log.Printf("http: boot media: skipping %s: %v", b.name, err)
+			continue
+		}
+		files = append(files, bootmedia.File{Path: b.path, Data: data})
+	}
+	if len(files) == 2 {
+		http.Error(w, "No UEFI iPXE binaries available", http.StatusInternalServerError)
+		return
+	}
+
+	var img []byte
+	name := r.PathValue("name")
+	switch name {
+	case "duh-boot.iso":
+		img, err = bootmedia.ISOImage(files, "DUH_BOOT")
+	case "duh-boot.img":
+		img, err = bootmedia.USBImage(files)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("http: build boot media: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Write(img)
+}
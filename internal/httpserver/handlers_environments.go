@@ -0,0 +1,166 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/listing"
+)
+
+// scopeCookie holds the environment the UI is scoped to. The page header
+// sets it from the browser; no cookie means every environment.
+const scopeCookie = "duh_env"
+
+// envScope returns the environment the request's UI is scoped to, or ""
+// for all of them.
+func (s *Server) envScope(r *http.Request) string {
+	c, err := r.Cookie(scopeCookie)
+	if err != nil || c.Value == "" {
+		return ""
+	}
+	ok, err := db.EnvironmentExists(s.DB, c.Value)
+	if err != nil {
+		log.Printf("http: %v", err)
+		return ""
+	}
+	if !ok {
+		return ""
+	}
+	return c.Value
+}
+
+// addScopeData adds what the environment switcher in a page header needs.
+func (s *Server) addScopeData(r *http.Request, data map[string]any) {
+	envs, err := db.ListEnvironments(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+	}
+	data["Environments"] = envs
+	data["Scope"] = s.envScope(r)
+}
+
+// inScope reports whether an item in env shows under scope. Items in no
+// environment are shared, so they show everywhere unless strict.
+func inScope(scope, env string, strict bool) bool {
+	return scope == "" || env == scope || (!strict && env == "")
+}
+
+// formEnvironment reads and checks an environment chosen in a form. The
+// empty value means none.
+func (s *Server) formEnvironment(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	ok, err := db.EnvironmentExists(s.DB, value)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("unknown environment %q", value)
+	}
+	return value, nil
+}
+
+// environmentConflict describes why sys shouldn't be provisioned as
+// configured: its image or profile belongs to another environment. It
+// returns "" if there is no conflict.
+func (s *Server) environmentConflict(sys *db.System) (string, error) {
+	if sys.Environment == "" {
+		return "", nil
+	}
+	var conflicts []string
+	if sys.ImageID != nil {
+		img, err := db.GetImage(s.DB, *sys.ImageID)
+		if err != nil {
+			return "", err
+		}
+		if img != nil && img.Environment != "" && img.Environment != sys.Environment {
+			conflicts = append(conflicts, fmt.Sprintf("image %s is in %s", img.Name, img.Environment))
+		}
+	}
+	if sys.ProfileID != nil {
+		prof, err := db.GetProfile(s.DB, *sys.ProfileID)
+		if err != nil {
+			return "", err
+		}
+		if prof != nil && prof.Environment != "" && prof.Environment != sys.Environment {
+			conflicts = append(conflicts, fmt.Sprintf("profile %s is in %s", prof.Name, prof.Environment))
+		}
+	}
+	if len(conflicts) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("%s is in %s, but %s", systemLabel(sys), sys.Environment, strings.Join(conflicts, " and ")), nil
+}
+
+func systemLabel(sys *db.System) string {
+	if sys.Hostname != "" {
+		return sys.Hostname
+	}
+	return sys.MAC
+}
+
+func (s *Server) renderEnvironments(w http.ResponseWriter) {
+	envs, err := db.ListEnvironments(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.Templates.ExecuteTemplate(w, "environment_settings", map[string]any{"Environments": envs}); err != nil {
+		log.Printf("http: render environment_settings: %v", err)
+	}
+}
+
+func (s *Server) handleCreateEnvironment(w http.ResponseWriter, r *http.Request) {
+	err := db.CreateEnvironment(s.DB, r.FormValue("name"), strings.TrimSpace(r.FormValue("description")))
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Failed to create environment: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.renderEnvironments(w)
+}
+
+func (s *Server) handleDeleteEnvironment(w http.ResponseWriter, r *http.Request) {
+	err := db.DeleteEnvironment(s.DB, r.PathValue("name"))
+	if errors.Is(err, db.ErrEnvironmentInUse) {
+		http.Error(w, "Move its images, profiles and systems out of the environment first", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderEnvironments(w)
+}
+
+func (s *Server) handleAPIEnvironments(w http.ResponseWriter, r *http.Request) {
+	envs, err := db.ListEnvironments(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	rows := make([]map[string]any, len(envs))
+	for i, e := range envs {
+		rows[i] = map[string]any{
+			"name":        e.Name,
+			"description": e.Description,
+			"created_at":  e.CreatedAt,
+		}
+	}
+	page, ok := listPage(w, r, rows, listing.Spec{Sort: "name", Key: []string{"name"}})
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"environments": page.Rows, "next_cursor": page.Next})
+}
@@ -0,0 +1,112 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/db"
+)
+
+// settingGlobalVars holds the site-wide vars, as a JSON object, that every
+// system gets beneath its profile's default vars and its own.
+const settingGlobalVars = "global_vars"
+
+// globalVars returns the global vars as a JSON object, or "" if there are
+// none.
+func (s *Server) globalVars() string {
+	v, err := db.GetSetting(s.DB, settingGlobalVars)
+	if err != nil {
+		log.Printf("http: get global vars: %v", err)
+	}
+	return v
+}
+
+// normalizeVars checks vars is a JSON object of strings and returns it
+// compacted with its keys sorted, or "" if it is empty.
+func normalizeVars(vars string) (string, error) {
+	if strings.TrimSpace(vars) == "" {
+		return "", nil
+	}
+	var m map[string]string
+	if err := json.Unmarshal([]byte(vars), &m); err != nil {
+		return "", errors.New("vars must be a JSON object of strings")
+	}
+	if len(m) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(m)
+	return string(b), err
+}
+
+func (s *Server) setGlobalVars(vars string) error {
+	if vars == "" {
+		return db.DeleteSetting(s.DB, settingGlobalVars)
+	}
+	return db.SetSetting(s.DB, settingGlobalVars, vars)
+}
+
+// globalVarsForm returns the global vars indented for editing.
+func (s *Server) globalVarsForm() string {
+	v := s.globalVars()
+	if v == "" {
+		return "{}"
+	}
+	var m map[string]string
+	json.Unmarshal([]byte(v), &m)
+	b, _ := json.MarshalIndent(m, "", "  ")
+	return string(b)
+}
+
+func (s *Server) renderGlobalVars(w http.ResponseWriter, saved bool) {
+	data := map[string]any{
+		"GlobalVars": s.globalVarsForm(),
+		"Saved":      saved,
+	}
+	if err := s.Templates.ExecuteTemplate(w, "global_vars_settings", data); err != nil {
+		log.Printf("http: render global_vars_settings: %v", err)
+	}
+}
+
+func (s *Server) handleSetGlobalVars(w http.ResponseWriter, r *http.Request) {
+	vars, err := normalizeVars(r.FormValue("vars"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.setGlobalVars(vars); err != nil {
+		log.Printf("http: set global vars: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderGlobalVars(w, true)
+}
+
+// handleAPIGlobalVars returns the global vars, or with PUT replaces them
+// with the JSON object sent.
+func (s *Server) handleAPIGlobalVars(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read body", http.StatusBadRequest)
+			return
+		}
+		vars, err := normalizeVars(string(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.setGlobalVars(vars); err != nil {
+			log.Printf("http: set global vars: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	vars := map[string]string{}
+	json.Unmarshal([]byte(s.globalVars()), &vars)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vars)
+}
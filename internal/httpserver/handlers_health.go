@@ -0,0 +1,273 @@
+package httpserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+)
+
+// Listener names reported by /readyz.
+const (
+	ListenerTFTP      = "tftp"
+	ListenerProxyDHCP = "proxy_dhcp"
+)
+
+// certWarnWithin is how close to expiry the certificate check starts
+// warning. A warning doesn't make duh unready.
+const certWarnWithin = 14 * 24 * time.Hour
+
+// Check results.
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+	checkSkip = "skip"
+)
+
+// healthState is what main reports about the servers running beside the
+// HTTP one, for /readyz.
+type healthState struct {
+	mu        sync.Mutex
+	listeners map[string]listenerState
+
+	tlsConfig *tls.Config
+	tlsName   string // server name to look the certificate up by
+	tlsErr    string
+	tlsDone   bool
+	regenCert func() error // nil unless the certificate is self-signed
+}
+
+type listenerState struct {
+	up     bool
+	err    string
+	detail string
+	since  time.Time
+}
+
+// SetListener records that the named listener is up, or has failed with
+// err. detail describes where it listens.
+func (s *Server) SetListener(name, detail string, err error) {
+	st := listenerState{up: err == nil, detail: detail, since: time.Now()}
+	if err != nil {
+		st.err = err.Error()
+	}
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	if s.health.listeners == nil {
+		s.health.listeners = make(map[string]listenerState)
+	}
+	s.health.listeners[name] = st
+}
+
+// SetTLS records the HTTPS server's TLS config, or why HTTPS is disabled.
+// serverName picks the certificate when it is chosen per connection, as
+// with ACME.
+func (s *Server) SetTLS(cfg *tls.Config, serverName string, err error) {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	s.health.tlsConfig = cfg
+	s.health.tlsName = serverName
+	s.health.tlsErr = ""
+	if err != nil {
+		s.health.tlsErr = err.Error()
+	}
+	s.health.tlsDone = true
+}
+
+// SetCertRegenerator records how to replace the self-signed certificate,
+// for the regenerate endpoint.
+func (s *Server) SetCertRegenerator(fn func() error) {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	s.health.regenCert = fn
+}
+
+// healthCheck is one dependency's result in a /readyz response.
+type healthCheck struct {
+	Name   string         `json:"name"`
+	Status string         `json:"status"`
+	Detail string         `json:"detail,omitempty"`
+	Data   map[string]any `json:"data,omitempty"`
+}
+
+// handleLivez reports that the process is up and serving HTTP. It checks
+// nothing else, so an orchestrator only restarts duh when it has hung.
+func (s *Server) handleLivez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "alive"})
+}
+
+// handleReadyz checks everything duh needs to provision machines and
+// answers 503 if any check fails, listing each check either way.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := []healthCheck{
+		s.checkDatabase(),
+		s.checkFreeSpace(),
+		s.checkDiskQuotas(),
+		s.checkListener(ListenerTFTP, true),
+		s.checkListener(ListenerProxyDHCP, s.ProxyDHCP),
+		s.checkCertificate(time.Now()),
+	}
+	status, code := "ready", http.StatusOK
+	for _, c := range checks {
+		if c.Status == checkFail {
+			status, code = "not_ready", http.StatusServiceUnavailable
+			log.Printf("http: readyz: %s: %s", c.Name, c.Detail)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+func (s *Server) checkDatabase() healthCheck {
+	c := healthCheck{Name: "database"}
+	start := time.Now()
+	if err := db.ProbeWrite(s.DB); err != nil {
+		c.Status, c.Detail = checkFail, err.Error()
+		return c
+	}
+	c.Status = checkOK
+	c.Data = map[string]any{"write_ms": time.Since(start).Milliseconds()}
+	return c
+}
+
+func (s *Server) checkFreeSpace() healthCheck {
+	c := healthCheck{Name: "data_dir"}
+	free, err := freeSpace(s.DataDir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		c.Status, c.Detail = checkSkip, "free space is not reported on this platform"
+		return c
+	}
+	if err != nil {
+		c.Status, c.Detail = checkFail, err.Error()
+		return c
+	}
+	c.Data = map[string]any{"free_bytes": free, "min_free_bytes": s.MinFreeBytes}
+	if free < s.MinFreeBytes {
+		c.Status = checkFail
+		c.Detail = fmt.Sprintf("%d MiB free in %s, below the %d MiB minimum", free>>20, s.DataDir, s.MinFreeBytes>>20)
+		return c
+	}
+	c.Status = checkOK
+	return c
+}
+
+// checkDiskQuotas reports each data area's usage. An area over its quota
+// is a warning: what is there still serves, only new writes are refused.
+func (s *Server) checkDiskQuotas() healthCheck {
+	c := healthCheck{Name: "disk_quotas"}
+	usage, err := s.diskUsage()
+	if err != nil {
+		c.Status, c.Detail = checkFail, err.Error()
+		return c
+	}
+	c.Status = checkOK
+	c.Data = map[string]any{}
+	var over []string
+	for _, u := range usage {
+		c.Data[u.Name] = map[string]int64{"used_bytes": u.Used, "quota_bytes": u.Quota}
+		if u.Over() {
+			over = append(over, fmt.Sprintf("%s uses %s of %s", u.Name, fileSize(u.Used), fileSize(u.Quota)))
+		}
+	}
+	if len(over) > 0 {
+		c.Status, c.Detail = checkWarn, "over quota: "+strings.Join(over, "; ")
+	}
+	return c
+}
+
+func (s *Server) checkListener(name string, enabled bool) healthCheck {
+	c := healthCheck{Name: name}
+	if !enabled {
+		c.Status, c.Detail = checkSkip, "disabled"
+		return c
+	}
+	s.health.mu.Lock()
+	st, ok := s.health.listeners[name]
+	s.health.mu.Unlock()
+	switch {
+	case !ok:
+		c.Status, c.Detail = checkFail, "not listening yet"
+	case !st.up:
+		c.Status, c.Detail = checkFail, st.err
+	default:
+		c.Status, c.Detail = checkOK, st.detail
+		c.Data = map[string]any{"since": st.since.UTC().Format(time.RFC3339)}
+	}
+	return c
+}
+
+func (s *Server) checkCertificate(now time.Time) healthCheck {
+	c := healthCheck{Name: "certificate"}
+	s.health.mu.Lock()
+	tlsErr, done := s.health.tlsErr, s.health.tlsDone
+	s.health.mu.Unlock()
+	switch {
+	case !done:
+		c.Status, c.Detail = checkFail, "certificate not loaded yet"
+		return c
+	case tlsErr != "":
+		// HTTPS is optional; duh keeps serving plain HTTP without it.
+		c.Status, c.Detail = checkWarn, "HTTPS disabled: "+tlsErr
+		return c
+	}
+	cert, err := s.certificateInfo(now)
+	if err != nil {
+		c.Status, c.Detail = checkFail, err.Error()
+		return c
+	}
+	c.Data = map[string]any{
+		"subject":    cert.Subject,
+		"not_before": cert.NotBefore.UTC().Format(time.RFC3339),
+		"not_after":  cert.NotAfter.UTC().Format(time.RFC3339),
+		"days_left":  cert.DaysLeft,
+	}
+	switch cert.State {
+	case certExpired, certNotYetValid:
+		c.Status, c.Detail = checkFail, cert.Warning()
+	case certExpiring:
+		c.Status, c.Detail = checkWarn, cert.Warning()
+	default:
+		c.Status = checkOK
+	}
+	return c
+}
+
+// leafCertificate returns the certificate cfg serves for serverName.
+func leafCertificate(cfg *tls.Config, serverName string) (*x509.Certificate, error) {
+	var cert *tls.Certificate
+	switch {
+	case len(cfg.Certificates) > 0:
+		cert = &cfg.Certificates[0]
+	case cfg.GetCertificate != nil:
+		var err error
+		if cert, err = cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName}); err != nil {
+			return nil, fmt.Errorf("get certificate: %w", err)
+		}
+	}
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil, errors.New("no certificate configured")
+	}
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate: %w", err)
+	}
+	return leaf, nil
+}
@@ -0,0 +1,110 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+)
+
+// Liveness states shown on the dashboard.
+const (
+	livenessUp   = "up"
+	livenessDown = "down"
+)
+
+// handleHeartbeat records that an installed host is up. Hosts without
+// duh-agent can post here from a timer using {{.HeartbeatURL}}; a
+// machine certificate works in place of its token. The host may say which
+// image it runs as image_id, in a JSON body or as a form value.
+func (s *Server) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	sys, err := db.GetSystemByMAC(s.DB, r.PathValue("mac"))
+	if err != nil {
+		log.Printf("http: heartbeat system lookup: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if sys == nil {
+		http.Error(w, "System not found", http.StatusNotFound)
+		return
+	}
+	if bound := s.machineFromCert(r); bound == nil || bound.ID != sys.ID {
+		if !s.validHeartbeatToken(r, sys) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	imageID, err := parseHeartbeatImage(w, r)
+	if err != nil {
+		http.Error(w, "Invalid image_id", http.StatusBadRequest)
+		return
+	}
+	if imageID != nil {
+		img, err := db.GetImage(s.DB, *imageID)
+		if err != nil {
+			log.Printf("http: heartbeat image lookup: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if img == nil {
+			http.Error(w, "Image not found", http.StatusBadRequest)
+			return
+		}
+	}
+	prevIP, err := db.RecordHeartbeat(s.DB, sys.ID, imageID, clientAddr(r))
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if prevIP != "" {
+		sys.IPAddr = clientAddr(r)
+		s.fireIPChanged(sys, prevIP)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// parseHeartbeatImage reads the optional image_id from a heartbeat.
+func parseHeartbeatImage(w http.ResponseWriter, r *http.Request) (*int64, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/json" {
+		var body struct {
+			ImageID *int64 `json:"image_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		return body.ImageID, nil
+	}
+	v := r.FormValue("image_id")
+	if v == "" {
+		return nil, nil
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// liveness is "up" if sys's host sent a heartbeat within the timeout,
+// "down" if it has stopped, and "" if it never sent one.
+func (s *Server) liveness(sys db.System) string {
+	if sys.HeartbeatAt == "" {
+		return ""
+	}
+	t, err := time.Parse(time.DateTime, sys.HeartbeatAt)
+	if err != nil {
+		return ""
+	}
+	if time.Since(t) > s.settingDuration("heartbeat_timeout") {
+		return livenessDown
+	}
+	return livenessUp
+}
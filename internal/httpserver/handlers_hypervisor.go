@@ -0,0 +1,221 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/profile"
+)
+
+// proxmoxAutoInstallArg starts the automated installer of a Proxmox VE ISO
+// prepared with proxmox-auto-install-assistant.
+const proxmoxAutoInstallArg = "proxmox-start-auto-installer"
+
+// hypervisorCmdline adds the kernel arguments a hypervisor installer
+// needs to find its answer file to a boot's cmdline. ESXi's come from its
+// boot.cfg instead; see handleESXiBootCfg.
+func hypervisorCmdline(cmdline string, prof *db.Profile) string {
+	if prof != nil && prof.OSFamily == "proxmox" && !strings.Contains(cmdline, proxmoxAutoInstallArg) {
+		return strings.TrimSpace(cmdline + " " + proxmoxAutoInstallArg)
+	}
+	return cmdline
+}
+
+// esxiBootCfgURL is the signed URL of an ESXi image's boot.cfg rewritten
+// for sys.
+func (s *Server) esxiBootCfgURL(serverURL string, sys *db.System, img *db.Image) string {
+	return s.signURL(tokenPurposeImage, sys, fmt.Sprintf("%s/images/%d/esxi/%d/boot.cfg", serverURL, img.ID, sys.ID))
+}
+
+// rewriteESXiBootCfg points an ESXi boot.cfg's kernel and modules at the
+// URLs fileURL gives for them, as an ISO's boot.cfg names them relative to
+// its prefix, and drops cdromBoot, which would have the installer look for
+// its media on a CD. With a kickstart URL, ks= is added to the kernel
+// options.
+func rewriteESXiBootCfg(cfg string, fileURL func(name string) string, ksURL string) string {
+	var b strings.Builder
+	sawOpts := false
+	for _, line := range strings.Split(strings.TrimRight(cfg, "\n"), "\n") {
+		key, value, _ := strings.Cut(strings.TrimRight(line, "\r"), "=")
+		switch strings.TrimSpace(key) {
+		case "prefix":
+			continue
+		case "kernel":
+			line = "kernel=" + fileURL(path.Base(strings.TrimSpace(value)))
+		case "modules":
+			var mods []string
+			for _, m := range strings.Split(value, "---") {
+				if m = strings.TrimSpace(m); m != "" {
+					mods = append(mods, fileURL(path.Base(m)))
+				}
+			}
+			line = "modules=" + strings.Join(mods, " --- ")
+		case "kernelopt":
+			sawOpts = true
+			var opts []string
+			for _, o := range strings.Fields(value) {
+				if o != "cdromBoot" && !strings.HasPrefix(o, "ks=") {
+					opts = append(opts, o)
+				}
+			}
+			if ksURL != "" {
+				opts = append(opts, "ks="+ksURL)
+			}
+			line = "kernelopt=" + strings.Join(opts, " ")
+		}
+		b.WriteString(line + "\n")
+	}
+	if !sawOpts && ksURL != "" {
+		b.WriteString("kernelopt=runweasel ks=" + ksURL + "\n")
+	}
+	return b.String()
+}
+
+// handleESXiBootCfg serves an ESXi image's boot.cfg for a system, with
+// signed URLs for every module and, when the system is installing with an
+// ESXi profile, the URL of its kickstart.
+func (s *Server) handleESXiBootCfg(w http.ResponseWriter, r *http.Request) {
+	bound, ok := s.validateToken(r, tokenPurposeImage)
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	imgID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	sysID, err := strconv.ParseInt(r.PathValue("system"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if bound != nil && (bound.ID != sysID || !s.imageBound(bound, imgID)) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	sys, err := db.GetSystemByID(s.DB, sysID)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	img, err := db.GetImage(s.DB, imgID)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if sys == nil || img == nil || img.BootType != "esxi" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	cfg, err := os.ReadFile(filepath.Join(s.imageDir(img.ID), filepath.Base(resolveImageFiles(img).Extra["boot.cfg"])))
+	if err != nil {
+		log.Printf("http: read boot.cfg of image %d: %v", img.ID, err)
+		http.Error(w, "boot.cfg not found", http.StatusNotFound)
+		return
+	}
+
+	serverURL := s.serverURL()
+	if serverURL == "" {
+		serverURL = "http://" + r.Host
+	}
+	base := s.fileServerURL(serverURL, sys)
+	fileURL := func(name string) string {
+		return s.signURL(tokenPurposeImage, sys, fmt.Sprintf("%s/images/%d/file/%s", base, img.ID, name))
+	}
+	// Only the install the system is queued for gets the kickstart, not a
+	// one-shot boot of some other ESXi image.
+	var ksURL string
+	if sys.ProfileID != nil && sys.ImageID != nil && *sys.ImageID == img.ID {
+		prof, err := db.GetProfile(s.DB, *sys.ProfileID)
+		if err != nil {
+			log.Printf("http: %v", err)
+		} else if prof != nil && prof.OSFamily == "esxi" {
+			ksURL = s.signURL(tokenPurposeConfig, sys, fmt.Sprintf("%s/config/%d", serverURL, sys.ID))
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, rewriteESXiBootCfg(string(cfg), fileURL, ksURL))
+}
+
+// proxmoxSysInfo is the part of what the Proxmox VE auto-installer posts
+// to its answer URL that duh uses.
+type proxmoxSysInfo struct {
+	NetworkInterfaces []struct {
+		Link string `json:"link"`
+		MAC  string `json:"mac"`
+	} `json:"network_interfaces"`
+}
+
+// handleProxmoxAnswer serves a Proxmox VE answer file. An ISO prepared with
+// --fetch-from http has one answer URL for every machine, so there's no
+// signed token: the installer posts its system information, and the
+// answer is rendered from the profile of the system one of its network
+// interfaces belongs to. Only a system duh booted into its install, from
+// the same address, gets an answer.
+func (s *Server) handleProxmoxAnswer(w http.ResponseWriter, r *http.Request) {
+	var info proxmoxSysInfo
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&info); err != nil {
+		http.Error(w, "Invalid system information", http.StatusBadRequest)
+		return
+	}
+	var sys *db.System
+	for _, nic := range info.NetworkInterfaces {
+		mac, err := db.NormalizeMAC(nic.MAC)
+		if err != nil {
+			continue
+		}
+		found, err := db.GetSystemByMAC(s.DB, mac)
+		if err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if found != nil {
+			sys = found
+			break
+		}
+	}
+	if sys == nil {
+		http.Error(w, "Unknown system", http.StatusNotFound)
+		return
+	}
+	if sys.State != "provisioning" || (sys.IPAddr != "" && sys.IPAddr != clientAddr(r)) {
+		log.Printf("http: refused Proxmox answer for %s from %s", sys.MAC, clientAddr(r))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if sys.ProfileID == nil {
+		http.Error(w, "No profile assigned", http.StatusNotFound)
+		return
+	}
+	prof, err := db.GetProfile(s.DB, *sys.ProfileID)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if prof == nil || prof.OSFamily != "proxmox" {
+		http.Error(w, "No Proxmox profile assigned", http.StatusNotFound)
+		return
+	}
+	config, err := s.renderSystemConfig(r, sys, prof)
+	if err != nil {
+		log.Printf("http: config for system %d: %v", sys.ID, err)
+		http.Error(w, "Config error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", profile.FormatFor(prof.OSFamily).ContentType)
+	io.WriteString(w, config)
+}
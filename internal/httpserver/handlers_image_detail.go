@@ -0,0 +1,302 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/justinpopa/duh/internal/catalog"
+	"github.com/justinpopa/duh/internal/db"
+)
+
+// Outcomes of verifying an image file against its recorded checksum.
+const (
+	verifyOK       = "ok"
+	verifyMismatch = "mismatch"
+	verifyRecorded = "recorded" // no baseline yet; the current hash became it
+	verifyMissing  = "missing"
+)
+
+// imageFile is one row of an image's file browser: a stored file, or a
+// file the image refers to that isn't stored.
+type imageFile struct {
+	Name     string    `json:"name"`
+	Roles    []string  `json:"roles,omitempty"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modified"`
+	Missing  bool      `json:"missing,omitempty"`
+	Expected string    `json:"expected_sha256,omitempty"`
+	Source   string    `json:"source,omitempty"`
+	SHA256   string    `json:"sha256,omitempty"` // computed by a verify
+	Result   string    `json:"result,omitempty"`
+}
+
+func (s *Server) imageDir(id int64) string {
+	return filepath.Join(s.DataDir, "images", strconv.FormatInt(id, 10))
+}
+
+// recordFileSum hashes a stored file and records the hash as its
+// baseline.
+func (s *Server) recordFileSum(imageID int64, path string) error {
+	sum, err := catalog.FileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil {
+		s.checksums.put(path, info, sum)
+	}
+	return db.SetImageFileSum(s.DB, imageID, filepath.Base(path), sum, db.SumSourceReceived)
+}
+
+// imageFiles lists an image's files with their roles and recorded
+// checksums. With verify set, every stored file is hashed again, skipping
+// the checksum cache, and compared to its baseline; a file without one
+// gets its current hash recorded.
+func (s *Server) imageFiles(img *db.Image, verify bool) ([]imageFile, error) {
+	dir := s.imageDir(img.ID)
+	names, err := catalog.ListFiles(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sums, err := db.ImageFileSums(s.DB, img.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := map[string][]string{}
+	files := resolveImageFiles(img)
+	if img.BootType == "custom" {
+		// A custom script names its own files; the defaults don't apply.
+		files = img.Files()
+	}
+	if files.Kernel != "" {
+		roles[files.Kernel] = append(roles[files.Kernel], "kernel")
+	}
+	for _, name := range files.Initrds {
+		roles[name] = append(roles[name], "initrd")
+	}
+	for role, name := range files.Extra {
+		roles[name] = append(roles[name], role)
+	}
+
+	byName := map[string]*imageFile{}
+	var out []*imageFile
+	add := func(name string) *imageFile {
+		if f := byName[name]; f != nil {
+			return f
+		}
+		f := &imageFile{Name: name, Missing: true}
+		byName[name] = f
+		out = append(out, f)
+		return f
+	}
+	for _, name := range names {
+		f := add(name)
+		f.Missing = false
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			f.Size = info.Size()
+			f.ModTime = info.ModTime()
+		}
+	}
+	for name, r := range roles {
+		sort.Strings(r)
+		add(name).Roles = r
+	}
+	for name, sum := range sums {
+		f := add(name)
+		f.Expected = sum.SHA256
+		f.Source = sum.Source
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+
+	result := make([]imageFile, 0, len(out))
+	for _, f := range out {
+		if verify {
+			s.verifyImageFile(img.ID, f)
+		}
+		result = append(result, *f)
+	}
+	return result, nil
+}
+
+func (s *Server) verifyImageFile(imageID int64, f *imageFile) {
+	if f.Missing {
+		f.Result = verifyMissing
+		return
+	}
+	path := filepath.Join(s.imageDir(imageID), f.Name)
+	sum, err := catalog.FileSHA256(path)
+	if err != nil {
+		log.Printf("http: verify %s: %v", path, err)
+		f.Result = verifyMissing
+		return
+	}
+	if info, err := os.Stat(path); err == nil {
+		s.checksums.put(path, info, sum)
+	}
+	f.SHA256 = sum
+	switch {
+	case f.Expected == "":
+		if err := db.SetImageFileSum(s.DB, imageID, f.Name, sum, db.SumSourceReceived); err != nil {
+			log.Printf("http: %v", err)
+		}
+		f.Expected, f.Source, f.Result = sum, db.SumSourceReceived, verifyRecorded
+	case strings.EqualFold(sum, f.Expected):
+		f.Result = verifyOK
+	default:
+		f.Result = verifyMismatch
+	}
+}
+
+// imageFromPath loads the image named by the {id} path value.
+func (s *Server) imageFromPath(w http.ResponseWriter, r *http.Request) (*db.Image, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return nil, false
+	}
+	img, err := db.GetImage(s.DB, id)
+	if err != nil {
+		log.Printf("http: get image: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if img == nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return nil, false
+	}
+	return img, true
+}
+
+func (s *Server) handleImageDetail(w http.ResponseWriter, r *http.Request) {
+	img, ok := s.imageFromPath(w, r)
+	if !ok {
+		return
+	}
+	files, err := s.imageFiles(img, false)
+	if err != nil {
+		log.Printf("http: list image files: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	hash, _ := s.getAuthState()
+	data := map[string]any{
+		"Image":       img,
+		"Files":       files,
+		"AuthEnabled": hash != "",
+	}
+	s.addTenantData(r, data)
+	s.addThemeData(r, data)
+	if err := s.Templates.ExecuteTemplate(w, "image_detail", data); err != nil {
+		log.Printf("http: render image detail: %v", err)
+	}
+}
+
+func (s *Server) renderImageFiles(w http.ResponseWriter, img *db.Image, verify bool) {
+	files, err := s.imageFiles(img, verify)
+	if err != nil {
+		log.Printf("http: list image files: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]any{
+		"Image": img,
+		"Files": files,
+	}
+	if err := s.Templates.ExecuteTemplate(w, "image_files", data); err != nil {
+		log.Printf("http: render image files: %v", err)
+	}
+}
+
+func (s *Server) handleImageFiles(w http.ResponseWriter, r *http.Request) {
+	img, ok := s.imageFromPath(w, r)
+	if !ok {
+		return
+	}
+	s.renderImageFiles(w, img, false)
+}
+
+func (s *Server) handleVerifyImage(w http.ResponseWriter, r *http.Request) {
+	img, ok := s.imageFromPath(w, r)
+	if !ok {
+		return
+	}
+	s.renderImageFiles(w, img, true)
+}
+
+func (s *Server) handleAPIVerifyImage(w http.ResponseWriter, r *http.Request) {
+	img, ok := s.imageFromPath(w, r)
+	if !ok {
+		return
+	}
+	files, err := s.imageFiles(img, true)
+	if err != nil {
+		log.Printf("http: verify image: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	good := true
+	for _, f := range files {
+		if f.Result == verifyMismatch || f.Result == verifyMissing {
+			good = false
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"ok": good, "files": files})
+}
+
+// handleDeleteImageFile removes one stored file. Role mappings that name
+// it are kept, so the file browser shows it as missing until it is
+// replaced or the mapping is changed.
+func (s *Server) handleDeleteImageFile(w http.ResponseWriter, r *http.Request) {
+	img, ok := s.imageFromPath(w, r)
+	if !ok {
+		return
+	}
+	name := r.PathValue("name")
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+	if img.Status == db.ImageStatusDownloading {
+		http.Error(w, "Image is downloading", http.StatusConflict)
+		return
+	}
+	dir := s.imageDir(img.ID)
+	if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+		log.Printf("http: delete image file: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := db.DeleteImageFileSum(s.DB, img.ID, name); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.refreshImageFileList(img.ID, dir); err != nil && !os.IsNotExist(err) {
+		log.Printf("http: %v", err)
+	}
+	log.Printf("http: deleted %s from image %d", name, img.ID)
+	s.renderImageFiles(w, img, false)
+}
+
+// fileSize formats a byte count for the file browser.
+func fileSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
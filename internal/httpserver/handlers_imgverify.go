@@ -0,0 +1,125 @@
+package httpserver
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/justinpopa/duh/internal/codesign"
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/ipxe"
+)
+
+// codeSigner loads the boot file signing key on first use.
+type codeSigner struct {
+	mu     sync.Mutex
+	signer *codesign.Signer
+}
+
+func (s *Server) codeSigner() (*codesign.Signer, error) {
+	s.signing.mu.Lock()
+	defer s.signing.mu.Unlock()
+	if s.signing.signer == nil {
+		signer, err := codesign.LoadOrCreate(filepath.Join(s.DataDir, "codesign"))
+		if err != nil {
+			return nil, err
+		}
+		s.signing.signer = signer
+	}
+	return s.signing.signer, nil
+}
+
+// addSignatureURLs signs a signature URL for the kernel, each initrd and
+// each extra file of img when the imgverify setting is on, so boot scripts
+// can check them with imgverify.
+func (s *Server) addSignatureURLs(params *ipxe.ScriptParams, serverURL string, sys *db.System, img *db.Image) {
+	if !s.SettingBool("imgverify") {
+		return
+	}
+	sigURL := func(name string) string {
+		return s.signURL(tokenPurposeImage, sys, fmt.Sprintf("%s/images/%d/sig/%s", serverURL, img.ID, name))
+	}
+	files := resolveImageFiles(img)
+	if files.Kernel != "" {
+		params.KernelSigURL = sigURL(files.Kernel)
+	}
+	params.InitrdSigURLs = nil
+	for _, name := range files.Initrds {
+		params.InitrdSigURLs = append(params.InitrdSigURLs, sigURL(name))
+	}
+	params.FileSigURLs = make(map[string]string, len(files.Extra))
+	for role, name := range files.Extra {
+		params.FileSigURLs[role] = sigURL(name)
+	}
+}
+
+// handleImageSignature serves the detached CMS signature of an image file
+// for iPXE's imgverify.
+func (s *Server) handleImageSignature(w http.ResponseWriter, r *http.Request) {
+	if !s.SettingBool("imgverify") {
+		http.NotFound(w, r)
+		return
+	}
+	bound, ok := s.validateToken(r, tokenPurposeImage)
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if bound != nil && !s.imageBound(bound, id) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	name := filepath.Base(r.PathValue("name"))
+	if name == "." || name == ".." {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	path := filepath.Join(s.DataDir, "images", fmt.Sprintf("%d", id), name)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("http: stat %s: %v", name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	sum, err := s.checksums.sha256(path, info)
+	if err != nil {
+		log.Printf("http: checksum %s: %v", name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	digest, err := hex.DecodeString(sum)
+	if err != nil {
+		log.Printf("http: checksum %s: %v", name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	signer, err := s.codeSigner()
+	if err != nil {
+		log.Printf("http: code signing: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	sig, err := signer.SignDigest(digest)
+	if err != nil {
+		log.Printf("http: sign %s: %v", name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkcs7-signature")
+	w.Write(sig)
+}
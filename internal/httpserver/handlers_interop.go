@@ -0,0 +1,153 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/interop"
+)
+
+// maxImportSize caps the export files an import reads.
+const maxImportSize = 32 << 20
+
+// foremanAPIError is a failure to read from the Foreman API, as opposed to
+// a bad request.
+type foremanAPIError struct{ err error }
+
+func (e *foremanAPIError) Error() string { return e.err.Error() }
+
+// readImport reads the inventory an import request carries: Cobbler or
+// Foreman export files in the files field or, for Foreman, the URL and
+// credentials of its API. Its errors are the request's fault, except a
+// foremanAPIError.
+func (s *Server) readImport(r *http.Request) (*interop.Inventory, error) {
+	source := r.PathValue("source")
+	if source != "cobbler" && source != "foreman" {
+		return nil, fmt.Errorf("unknown import source %q", source)
+	}
+	if err := r.ParseMultipartForm(maxImportSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return nil, fmt.Errorf("read form: %w", err)
+	}
+
+	if rawURL := strings.TrimSpace(r.FormValue("url")); source == "foreman" && rawURL != "" {
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("Foreman URL must be an http or https URL")
+		}
+		c := interop.NewForemanClient(rawURL, strings.TrimSpace(r.FormValue("user")), r.FormValue("token"))
+		inv, err := c.Inventory(r.Context())
+		if err != nil {
+			return nil, &foremanAPIError{err}
+		}
+		return inv, nil
+	}
+
+	if r.MultipartForm == nil || len(r.MultipartForm.File["files"]) == 0 {
+		if source == "foreman" {
+			return nil, errors.New("choose export files or give the Foreman URL")
+		}
+		return nil, errors.New("choose export files")
+	}
+	inv := &interop.Inventory{Source: source}
+	for _, fh := range r.MultipartForm.File["files"] {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		var part *interop.Inventory
+		if source == "cobbler" {
+			part, err = interop.ParseCobbler(f)
+		} else {
+			part, err = interop.ParseForeman(f)
+		}
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fh.Filename, err)
+		}
+		inv.Groups = append(inv.Groups, part.Groups...)
+		inv.Hosts = append(inv.Hosts, part.Hosts...)
+	}
+	return inv, nil
+}
+
+// runImport reads and imports the inventory an import request carries,
+// announcing the systems it created. It writes the error response itself
+// and returns false if the request can't be imported. A Foreman that can't
+// be reached is reported in the results, like a NetBox sync.
+func (s *Server) runImport(w http.ResponseWriter, r *http.Request) ([]syncSummary, bool) {
+	inv, err := s.readImport(r)
+	var apiErr *foremanAPIError
+	if errors.As(err, &apiErr) {
+		log.Printf("http: foreman import: %v", apiErr.err)
+		return []syncSummary{{Source: "foreman", Errors: []string{apiErr.err.Error()}}}, true
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	res, err := interop.Import(s.DB, inv)
+	if err != nil {
+		log.Printf("http: %s import: %v", inv.Source, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, false
+	}
+	for i := range res.Created {
+		s.fireSystemEvent(&res.Created[i], "discovered")
+	}
+	for _, e := range res.Errors {
+		log.Printf("http: %s import: %s", inv.Source, e)
+	}
+	return []syncSummary{
+		{Source: inv.Source + " profiles", Created: res.Profiles, Skipped: res.ProfilesExisting},
+		{Source: inv.Source + " systems", Created: len(res.Created), Updated: res.Updated, Skipped: res.Skipped, Errors: res.Errors},
+	}, true
+}
+
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	results, ok := s.runImport(w, r)
+	if !ok {
+		return
+	}
+	data := map[string]any{"Results": results}
+	if err := s.Templates.ExecuteTemplate(w, "sync_result", data); err != nil {
+		log.Printf("http: render sync result: %v", err)
+	}
+}
+
+func (s *Server) handleAPIImport(w http.ResponseWriter, r *http.Request) {
+	results, ok := s.runImport(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"results": results})
+}
+
+// handleExport downloads a script that recreates duh's profiles and
+// systems in Cobbler or Foreman.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	export := interop.ExportCobbler
+	switch r.PathValue("target") {
+	case "cobbler":
+	case "foreman":
+		export = interop.ExportForeman
+	default:
+		http.Error(w, "Unknown export target", http.StatusNotFound)
+		return
+	}
+	var buf bytes.Buffer
+	if err := export(&buf, s.DB); err != nil {
+		log.Printf("http: %s export: %v", r.PathValue("target"), err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/x-shellscript; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="duh-%s.sh"`, r.PathValue("target")))
+	buf.WriteTo(w)
+}
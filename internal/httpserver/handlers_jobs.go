@@ -0,0 +1,146 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/justinpopa/duh/internal/catalog"
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/listing"
+)
+
+// jobStatuses are the statuses the Jobs page filters on, in its order.
+var jobStatuses = []string{db.JobQueued, db.JobRunning, db.JobFailed, db.JobDone, db.JobCancelled}
+
+// jobsData loads the jobs the Jobs page shows: the latest 200, or those
+// with the status in ?status.
+func (s *Server) jobsData(r *http.Request) (map[string]any, error) {
+	status := r.URL.Query().Get("status")
+	if !slices.Contains(jobStatuses, status) {
+		status = ""
+	}
+	list, err := db.ListJobs(s.DB, status, 200)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := db.CountJobs(s.DB)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"Jobs":     list,
+		"Counts":   counts,
+		"Status":   status,
+		"Statuses": jobStatuses,
+	}, nil
+}
+
+func (s *Server) handleJobsPage(w http.ResponseWriter, r *http.Request) {
+	data, err := s.jobsData(r)
+	if err != nil {
+		log.Printf("http: list jobs: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	hash, _ := s.getAuthState()
+	data["AuthEnabled"] = hash != ""
+	s.addThemeData(r, data)
+	if err := s.Templates.ExecuteTemplate(w, "jobs", data); err != nil {
+		log.Printf("http: render jobs: %v", err)
+	}
+}
+
+// handleJobsTable renders the jobs table alone, for the page's polling.
+func (s *Server) handleJobsTable(w http.ResponseWriter, r *http.Request) {
+	data, err := s.jobsData(r)
+	if err != nil {
+		log.Printf("http: list jobs: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.Templates.ExecuteTemplate(w, "jobs_table", data); err != nil {
+		log.Printf("http: render jobs_table: %v", err)
+	}
+}
+
+// handleRetryJob runs a failed or cancelled job again, with its attempts
+// reset.
+func (s *Server) handleRetryJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	ok, err := db.RetryJobNow(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Only failed or cancelled jobs can be retried", http.StatusConflict)
+		return
+	}
+	s.Jobs.Wake()
+	s.handleJobsTable(w, r)
+}
+
+// handleCancelJob takes a queued job out of the queue. A running job can't
+// be cancelled.
+func (s *Server) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	ok, err := db.CancelJob(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Only queued jobs can be cancelled", http.StatusConflict)
+		return
+	}
+	// A cancelled download leaves its image with nothing to finish it.
+	if err := catalog.FailDeadDownloads(s.DB); err != nil {
+		log.Printf("http: %v", err)
+	}
+	s.handleJobsTable(w, r)
+}
+
+// handleAPIJobs lists jobs as JSON, filtered like the Jobs page.
+func (s *Server) handleAPIJobs(w http.ResponseWriter, r *http.Request) {
+	data, err := s.jobsData(r)
+	if err != nil {
+		log.Printf("http: list jobs: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	list := data["Jobs"].([]db.Job)
+	rows := make([]map[string]any, len(list))
+	for i, j := range list {
+		rows[i] = map[string]any{
+			"id":           j.ID,
+			"type":         j.Type,
+			"payload":      json.RawMessage(j.Payload),
+			"status":       j.Status,
+			"attempts":     j.Attempts,
+			"max_attempts": j.MaxAttempts,
+			"last_error":   j.LastError,
+			"run_after":    j.RunAfter,
+			"created_at":   j.CreatedAt,
+			"updated_at":   j.UpdatedAt,
+		}
+	}
+	page, ok := listPage(w, r, rows, listing.Spec{Sort: "-id", Key: []string{"id"}})
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page.Rows)
+}
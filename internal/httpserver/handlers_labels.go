@@ -0,0 +1,166 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/qr"
+)
+
+// consoleVar is the system variable holding a link to the machine's
+// console, such as its BMC's web UI. The mobile page links to it.
+const consoleVar = "console_url"
+
+// systemPageURL is what a system's label encodes: its mobile status page.
+func (s *Server) systemPageURL(r *http.Request, id int64) string {
+	base := s.serverURL()
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return fmt.Sprintf("%s/m/systems/%d", base, id)
+}
+
+// pathSystem loads the system named by the {id} path value, writing the
+// error response if there is none.
+func (s *Server) pathSystem(w http.ResponseWriter, r *http.Request) (*db.System, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return nil, false
+	}
+	sys, err := db.GetSystemByID(s.DB, id)
+	if err != nil {
+		log.Printf("http: get system: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if sys == nil {
+		http.Error(w, "System not found", http.StatusNotFound)
+		return nil, false
+	}
+	return sys, true
+}
+
+// handleMobileSystem is the compact status page a scanned label opens.
+func (s *Server) handleMobileSystem(w http.ResponseWriter, r *http.Request) {
+	sys, ok := s.pathSystem(w, r)
+	if !ok {
+		return
+	}
+	data := map[string]any{"System": sys}
+	if sys.ImageID != nil {
+		img, err := db.GetImage(s.DB, *sys.ImageID)
+		if err != nil {
+			log.Printf("http: get image: %v", err)
+		} else if img != nil {
+			data["ImageName"] = img.Name
+		}
+	}
+	if sys.ProfileID != nil {
+		p, err := db.GetProfile(s.DB, *sys.ProfileID)
+		if err != nil {
+			log.Printf("http: get profile: %v", err)
+		} else if p != nil {
+			data["ProfileName"] = p.Name
+		}
+	}
+	var vars map[string]any
+	if err := json.Unmarshal([]byte(sys.Vars), &vars); err == nil {
+		if console, ok := vars[consoleVar].(string); ok && console != "" {
+			data["ConsoleURL"] = console
+		}
+	}
+	vm, err := db.GetVMLink(s.DB, sys.ID)
+	if err != nil {
+		log.Printf("http: get vm link: %v", err)
+	}
+	data["VM"] = vm
+	attempts, err := db.ListProvisionAttempts(s.DB, sys.ID)
+	if err != nil {
+		log.Printf("http: list attempts: %v", err)
+	}
+	data["Attempts"] = attempts[:min(len(attempts), 5)]
+	transfers, err := db.ListTransfers(s.DB, sys.ID)
+	if err != nil {
+		log.Printf("http: list transfers: %v", err)
+	}
+	if len(transfers) > 0 {
+		data["Transfers"] = s.summarizeTransfers(transfers)
+	}
+	s.addThemeData(r, data)
+	if err := s.Templates.ExecuteTemplate(w, "mobile_system", data); err != nil {
+		log.Printf("http: render mobile_system: %v", err)
+	}
+}
+
+// handleSystemQR serves a QR code linking to the system's mobile page.
+func (s *Server) handleSystemQR(w http.ResponseWriter, r *http.Request) {
+	sys, ok := s.pathSystem(w, r)
+	if !ok {
+		return
+	}
+	code, err := qr.Encode(s.systemPageURL(r, sys.ID))
+	if err != nil {
+		log.Printf("http: encode qr: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, code.SVG(4))
+}
+
+type printLabel struct {
+	System db.System
+	URL    string
+	QR     template.HTML
+}
+
+// handleLabelsPage is a printable sheet of labels, one per system given by
+// id, or for every system in scope when none are.
+func (s *Server) handleLabelsPage(w http.ResponseWriter, r *http.Request) {
+	systems, err := db.ListSystems(s.DB)
+	if err != nil {
+		log.Printf("http: list systems: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	ids := r.URL.Query()["id"]
+	scope := s.envScope(r)
+	systems = slices.DeleteFunc(systems, func(sys db.System) bool {
+		if !visibleTo(r, sys.TenantID, false) {
+			return true
+		}
+		if len(ids) > 0 {
+			return !slices.Contains(ids, strconv.FormatInt(sys.ID, 10))
+		}
+		return !inScope(scope, sys.Environment, true)
+	})
+	labels := make([]printLabel, 0, len(systems))
+	for _, sys := range systems {
+		u := s.systemPageURL(r, sys.ID)
+		code, err := qr.Encode(u)
+		if err != nil {
+			log.Printf("http: encode qr: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		// The SVG is built from module coordinates only.
+		labels = append(labels, printLabel{System: sys, URL: u, QR: template.HTML(code.SVG(3))})
+	}
+	data := map[string]any{"Labels": labels}
+	s.addThemeData(r, data)
+	if err := s.Templates.ExecuteTemplate(w, "labels", data); err != nil {
+		log.Printf("http: render labels: %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package httpserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/justinpopa/duh/internal/listing"
+)
+
+// listPage pages the rows of an API list by the listing parameters in r's
+// query. Past the last row of a page it sets a Link header to the next
+// one, for lists whose body has no room for next_cursor. A bad query is
+// answered with a 400 and ok false.
+func listPage(w http.ResponseWriter, r *http.Request, rows []map[string]any, spec listing.Spec) (page listing.Page, ok bool) {
+	q, err := listing.Parse(r.URL.Query(), spec)
+	if err == nil {
+		page, err = q.Apply(rows)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return page, false
+	}
+	if page.Next != "" {
+		next := *r.URL
+		v := next.Query()
+		v.Set("cursor", page.Next)
+		next.RawQuery = v.Encode()
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+	}
+	return page, true
+}
@@ -0,0 +1,152 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/listing"
+	"github.com/justinpopa/duh/internal/profile"
+)
+
+// issueMachineCert issues sys a client certificate from the internal CA
+// and records it for revocation.
+func (s *Server) issueMachineCert(sys *db.System) (certPEM, keyPEM string, notAfter time.Time, err error) {
+	issued, err := s.CA.Issue(sys.ID, sys.MAC, s.MachineCertTTL)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	if err := db.RecordMachineCert(s.DB, issued.Serial, sys.ID, issued.NotAfter); err != nil {
+		return "", "", time.Time{}, err
+	}
+	log.Printf("pki: issued certificate %s to %s, valid until %s", issued.Serial, sys.MAC, issued.NotAfter.UTC().Format(time.RFC3339))
+	return issued.CertPEM, issued.KeyPEM, issued.NotAfter, nil
+}
+
+// machineIdentity is the Identity config templates see for sys, or nil
+// when machine certificates are off.
+func (s *Server) machineIdentity(sys *db.System) *profile.Identity {
+	if s.CA == nil {
+		return nil
+	}
+	return profile.NewIdentity(string(s.CA.CertPEM()), func() (string, string, error) {
+		certPEM, keyPEM, _, err := s.issueMachineCert(sys)
+		return certPEM, keyPEM, err
+	})
+}
+
+// machineFromCert returns the system a request's TLS client certificate
+// identifies, or nil if there is none or it isn't valid: not issued by
+// the CA, revoked, or naming a system that is gone or has a new MAC.
+func (s *Server) machineFromCert(r *http.Request) *db.System {
+	if s.CA == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	id, err := s.CA.Verify(r.TLS.PeerCertificates[0])
+	if err != nil {
+		log.Printf("http: client certificate from %s: %v", clientAddr(r), err)
+		return nil
+	}
+	rec, err := db.GetMachineCert(s.DB, id.Serial)
+	if err != nil {
+		log.Printf("http: %v", err)
+		return nil
+	}
+	if rec == nil || rec.Revoked || rec.SystemID != id.SystemID {
+		log.Printf("http: client certificate %s from %s is unknown or revoked", id.Serial, clientAddr(r))
+		return nil
+	}
+	sys, err := db.GetSystemByID(s.DB, id.SystemID)
+	if err != nil {
+		log.Printf("http: %v", err)
+		return nil
+	}
+	if sys == nil || sys.MAC != id.MAC {
+		return nil
+	}
+	return sys
+}
+
+func (s *Server) handleServeCACert(w http.ResponseWriter, r *http.Request) {
+	if s.CA == nil {
+		http.Error(w, "Machine certificates are not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(s.CA.CertPEM())
+}
+
+// handleRenewMachineCert issues a fresh certificate to a system that
+// presents its current one, so long-running hosts can keep an identity
+// without re-provisioning.
+func (s *Server) handleRenewMachineCert(w http.ResponseWriter, r *http.Request) {
+	sys := s.machineFromCert(r)
+	if sys == nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	certPEM, keyPEM, notAfter, err := s.issueMachineCert(sys)
+	if err != nil {
+		log.Printf("http: renew certificate for %s: %v", sys.MAC, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"cert":      certPEM,
+		"key":       keyPEM,
+		"ca":        string(s.CA.CertPEM()),
+		"not_after": notAfter.UTC().Format(time.RFC3339),
+	})
+}
+
+func (s *Server) handleListMachineCerts(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	certs, err := db.ListMachineCerts(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	rows := make([]map[string]any, len(certs))
+	for i, c := range certs {
+		rows[i] = map[string]any{
+			"serial":     c.Serial,
+			"not_after":  c.NotAfter,
+			"revoked":    c.Revoked,
+			"created_at": c.CreatedAt,
+		}
+	}
+	page, ok := listPage(w, r, rows, listing.Spec{Sort: "-created_at", Key: []string{"serial"}})
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"certs": page.Rows, "next_cursor": page.Next})
+}
+
+func (s *Server) handleRevokeMachineCerts(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	n, err := db.RevokeMachineCerts(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if n > 0 {
+		log.Printf("pki: revoked %d certificate(s) of system %d", n, id)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"revoked": n})
+}
@@ -0,0 +1,84 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/webhook"
+)
+
+// mergeUndoWindow is how long after a merge it can be undone.
+const mergeUndoWindow = 10 * time.Minute
+
+// handleMergeSystem folds the system given as from into this one and
+// returns this system's row. The duplicate goes to the trash; the merge
+// can be undone for mergeUndoWindow, until X-Merge-Undo-Until.
+func (s *Server) handleMergeSystem(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	fromID, err := strconv.ParseInt(r.FormValue("from"), 10, 64)
+	if err != nil {
+		http.Error(w, "Choose a system to merge", http.StatusBadRequest)
+		return
+	}
+	dup, err := db.GetSystemByID(s.DB, fromID)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if dup == nil || !visibleTo(r, dup.TenantID, false) {
+		http.Error(w, "System not found", http.StatusNotFound)
+		return
+	}
+	if _, err := db.MergeSystems(s.DB, id, fromID); err != nil {
+		log.Printf("http: merge system %d into %d: %v", fromID, id, err)
+		http.Error(w, "Failed to merge: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if sys, err := db.GetSystemByID(s.DB, id); err == nil && sys != nil {
+		s.Webhook.Fire(webhook.Event{
+			Type: "system.merged",
+			Data: map[string]any{
+				"id":              sys.ID,
+				"mac":             sys.MAC,
+				"hostname":        sys.Hostname,
+				"merged_id":       dup.ID,
+				"merged_mac":      dup.MAC,
+				"merged_hostname": dup.Hostname,
+			},
+		})
+	}
+	w.Header().Set("X-Merge-Undo-Until", time.Now().Add(mergeUndoWindow).UTC().Format(time.RFC3339))
+	s.renderSystemRow(w, id)
+}
+
+// handleUndoMerge reverses the latest merge into a system, restoring the
+// duplicate, if it is still within mergeUndoWindow.
+func (s *Server) handleUndoMerge(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	dupID, err := db.UndoMerge(s.DB, id, mergeUndoWindow)
+	if errors.Is(err, db.ErrNoMerge) {
+		http.Error(w, fmt.Sprintf("Nothing to undo: a merge can be undone for %d minutes, while the merged system is still in the trash", int(mergeUndoWindow.Minutes())), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("http: undo merge into %d: %v", id, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("http: undid merge of system %d into %d", dupID, id)
+	w.WriteHeader(http.StatusOK)
+}
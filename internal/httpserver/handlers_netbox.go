@@ -0,0 +1,197 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/netbox"
+)
+
+// Settings holding the NetBox connection.
+const (
+	settingNetBoxURL        = "netbox_url"
+	settingNetBoxToken      = "netbox_token"
+	settingNetBoxStateField = "netbox_state_field"
+)
+
+type netBoxForm struct {
+	URL        string
+	HasToken   bool
+	StateField string
+}
+
+// netBoxClient returns a client for the configured NetBox, or nil if none
+// is configured.
+func (s *Server) netBoxClient() (*netbox.Client, string, error) {
+	u, err := db.GetSetting(s.DB, settingNetBoxURL)
+	if err != nil || u == "" {
+		return nil, "", err
+	}
+	token, err := db.GetSetting(s.DB, settingNetBoxToken)
+	if err != nil {
+		return nil, "", err
+	}
+	field, err := db.GetSetting(s.DB, settingNetBoxStateField)
+	if err != nil {
+		return nil, "", err
+	}
+	return netbox.New(u, token), field, nil
+}
+
+func (s *Server) netBoxForm() (netBoxForm, error) {
+	var f netBoxForm
+	var err error
+	if f.URL, err = db.GetSetting(s.DB, settingNetBoxURL); err != nil {
+		return f, err
+	}
+	token, err := db.GetSetting(s.DB, settingNetBoxToken)
+	if err != nil {
+		return f, err
+	}
+	f.HasToken = token != ""
+	f.StateField, err = db.GetSetting(s.DB, settingNetBoxStateField)
+	return f, err
+}
+
+func (s *Server) renderNetBox(w http.ResponseWriter, saved bool) {
+	f, err := s.netBoxForm()
+	if err != nil {
+		log.Printf("http: get netbox settings: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]any{
+		"NetBox": f,
+		"Saved":  saved,
+	}
+	if err := s.Templates.ExecuteTemplate(w, "netbox_settings", data); err != nil {
+		log.Printf("http: render netbox_settings: %v", err)
+	}
+}
+
+func (s *Server) handleSetNetBox(w http.ResponseWriter, r *http.Request) {
+	rawURL := strings.TrimSpace(r.FormValue("url"))
+	token := strings.TrimSpace(r.FormValue("token"))
+	field := strings.TrimSpace(r.FormValue("state_field"))
+	if rawURL != "" {
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, "NetBox URL must be an http or https URL", http.StatusBadRequest)
+			return
+		}
+	}
+
+	values := map[string]string{
+		settingNetBoxURL:        rawURL,
+		settingNetBoxStateField: field,
+	}
+	// A blank token keeps the saved one; clearing the URL drops it too.
+	if token != "" || rawURL == "" {
+		values[settingNetBoxToken] = token
+	}
+	for key, val := range values {
+		var err error
+		if val == "" {
+			err = db.DeleteSetting(s.DB, key)
+		} else {
+			err = db.SetSetting(s.DB, key, val)
+		}
+		if err != nil {
+			log.Printf("http: set %s: %v", key, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	s.renderNetBox(w, true)
+}
+
+// syncNetBox imports NetBox devices and announces the systems it created.
+func (s *Server) syncNetBox(ctx context.Context) ([]syncSummary, error) {
+	c, _, err := s.netBoxClient()
+	if err != nil || c == nil {
+		return nil, err
+	}
+	res, err := netbox.Sync(ctx, s.DB, c)
+	if err != nil {
+		log.Printf("http: netbox sync: %v", err)
+		return []syncSummary{{Source: "netbox", Errors: []string{err.Error()}}}, nil
+	}
+	for i := range res.Created {
+		s.fireSystemEvent(&res.Created[i], "discovered")
+	}
+	for _, e := range res.Errors {
+		log.Printf("http: netbox sync: %s", e)
+	}
+	return []syncSummary{{
+		Source:  "netbox",
+		Created: len(res.Created),
+		Updated: res.Updated,
+		Errors:  res.Errors,
+	}}, nil
+}
+
+func (s *Server) handleNetBoxSync(w http.ResponseWriter, r *http.Request) {
+	results, err := s.syncNetBox(r.Context())
+	if err != nil {
+		log.Printf("http: get netbox settings: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if results == nil {
+		http.Error(w, "NetBox is not configured", http.StatusBadRequest)
+		return
+	}
+	data := map[string]any{"Results": results}
+	if err := s.Templates.ExecuteTemplate(w, "sync_result", data); err != nil {
+		log.Printf("http: render sync result: %v", err)
+	}
+}
+
+func (s *Server) handleAPINetBoxSync(w http.ResponseWriter, r *http.Request) {
+	results, err := s.syncNetBox(r.Context())
+	if err != nil {
+		log.Printf("http: get netbox settings: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if results == nil {
+		http.Error(w, "NetBox is not configured", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"results": results})
+}
+
+// netBoxWriteBack copies a synced system's new state to its device's
+// custom field, when a field is configured.
+func (s *Server) netBoxWriteBack(sys *db.System, state string) {
+	c, field, err := s.netBoxClient()
+	if err != nil {
+		log.Printf("http: get netbox settings: %v", err)
+		return
+	}
+	if c == nil || field == "" {
+		return
+	}
+	link, err := db.GetNetBoxLink(s.DB, sys.ID)
+	if err != nil {
+		log.Printf("http: %v", err)
+		return
+	}
+	if link == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := c.SetCustomField(ctx, link.DeviceID, field, state); err != nil {
+			log.Printf("http: netbox write-back for %s: %v", link.DeviceName, err)
+		}
+	}()
+}
@@ -0,0 +1,183 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/ipxe"
+)
+
+// serveOneshot serves the system's one-shot image. Nothing about the system
+// changes beyond recording that the image was served, so on the boot after
+// it the system boots as it would have before.
+//
+// One-shot boots use the image's own cmdline only. Profiles, the boot ack
+// and callbacks belong to provisioning and are left out.
+func (s *Server) serveOneshot(w http.ResponseWriter, r *http.Request, sys *db.System, client ipxe.Client) {
+	d, err := s.decideOneshot(r, sys, client)
+	if err != nil {
+		log.Printf("http: render one-shot boot script: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	if d.Action == bootActionExit {
+		db.SetOneshotImage(s.DB, sys.ID, nil)
+		w.Write([]byte(d.Script))
+		return
+	}
+
+	if err := db.MarkOneshotServed(s.DB, sys.ID); err != nil {
+		log.Printf("http: %v", err)
+	}
+	log.Printf("http: serving one-shot image %q to %s", d.Image.Name, sys.MAC)
+	w.Write([]byte(d.Script))
+}
+
+// decideOneshot renders a system's pending one-shot boot without marking
+// it served.
+func (s *Server) decideOneshot(r *http.Request, sys *db.System, client ipxe.Client) (*bootDecision, error) {
+	img, err := db.GetImage(s.DB, *sys.OneshotImageID)
+	if err != nil || img == nil || img.Status != db.ImageStatusReady {
+		log.Printf("http: one-shot image %d for %s unavailable: %v", *sys.OneshotImageID, sys.MAC, err)
+		d := s.exitDecision(sys.MAC, sys, "one-shot image unavailable")
+		d.Client = client
+		return d, nil
+	}
+
+	serverURL := s.bootServerURL(r, client)
+	params := s.imageScriptParams(serverURL, sys, img)
+	params.Client = client
+	d := &bootDecision{
+		MAC:       sys.MAC,
+		SystemID:  sys.ID,
+		Hostname:  sys.Hostname,
+		State:     sys.State,
+		Action:    bootActionOneshot,
+		Image:     &bootImage{ID: img.ID, Name: img.Name, BootType: img.BootType},
+		Client:    client,
+		ServerURL: serverURL,
+	}
+	if err := s.renderDecision(d, sys, img, params); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// setOneshot validates imageID and schedules it as the system's next boot.
+// An image for another architecture than the system's is refused unless
+// override is set. On failure it returns the HTTP status and message to
+// report.
+func (s *Server) setOneshot(r *http.Request, systemID, imageID int64, override bool) (int, string) {
+	sys, err := db.GetSystemByID(s.DB, systemID)
+	if err != nil {
+		log.Printf("http: get system: %v", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+	if sys == nil {
+		return http.StatusNotFound, "System not found"
+	}
+	img, err := db.GetImage(s.DB, imageID)
+	if err != nil {
+		log.Printf("http: get image: %v", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+	if img == nil || !visibleTo(r, img.TenantID, true) {
+		return http.StatusBadRequest, "Image not found"
+	}
+	if img.Status != db.ImageStatusReady {
+		return http.StatusConflict, "Image is not ready"
+	}
+	if msg := archConflict(sys, img); msg != "" && !override {
+		return http.StatusConflict, msg
+	}
+	if err := db.SetOneshotImage(s.DB, systemID, &imageID); err != nil {
+		log.Printf("http: %v", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+	return http.StatusOK, ""
+}
+
+func (s *Server) handleSetOneshot(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	imageID, err := strconv.ParseInt(r.FormValue("image_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid image ID", http.StatusBadRequest)
+		return
+	}
+	if status, msg := s.setOneshot(r, id, imageID, r.FormValue("override") == "true"); status != http.StatusOK {
+		http.Error(w, msg, status)
+		return
+	}
+	s.renderSystemRow(w, id)
+}
+
+func (s *Server) handleClearOneshot(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if err := db.SetOneshotImage(s.DB, id, nil); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderSystemRow(w, id)
+}
+
+// handleAPIOneshot reads (GET), schedules (PUT, body {"image_id": N}, with
+// "override": true to boot an image for another architecture) or cancels
+// (DELETE) a system's one-shot boot, and reports the result.
+func (s *Server) handleAPIOneshot(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var body struct {
+			ImageID  int64 `json:"image_id"`
+			Override bool  `json:"override"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil || body.ImageID == 0 {
+			http.Error(w, "image_id required", http.StatusBadRequest)
+			return
+		}
+		if status, msg := s.setOneshot(r, id, body.ImageID, body.Override); status != http.StatusOK {
+			http.Error(w, msg, status)
+			return
+		}
+	case http.MethodDelete:
+		if err := db.SetOneshotImage(s.DB, id, nil); err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	sys, err := db.GetSystemByID(s.DB, id)
+	if err != nil {
+		log.Printf("http: get system: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if sys == nil {
+		http.Error(w, "System not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"image_id":  sys.OneshotImageID,
+		"served_at": sys.OneshotServed,
+	})
+}
@@ -0,0 +1,429 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/ipxe"
+	"github.com/justinpopa/duh/internal/policy"
+)
+
+// factNames are the facts rule expressions can use; systemFacts fills
+// them in.
+var factNames = []string{
+	"mac", "hostname", "ip", "state", "tags", "vars",
+	"arch", "platform", "ipxe_version", "features",
+	"image_id", "profile_id", "subnet", "subnet_purpose", "site",
+}
+
+// systemFacts describes a system to rule expressions. client is the iPXE
+// build it is booting with, or the one it last reported, and subnet the
+// subnet its IP is on, if any.
+func systemFacts(sys *db.System, client ipxe.Client, ip string, subnet *db.Subnet) map[string]any {
+	vars := map[string]string{}
+	if sys.Vars != "" {
+		json.Unmarshal([]byte(sys.Vars), &vars)
+	}
+	var imageID, profileID any
+	if sys.ImageID != nil {
+		imageID = *sys.ImageID
+	}
+	if sys.ProfileID != nil {
+		profileID = *sys.ProfileID
+	}
+	if ip == "" {
+		ip = sys.IPAddr
+	}
+	var subnetName, purpose, site string
+	if subnet != nil {
+		subnetName, purpose, site = subnet.Label(), subnet.Purpose, subnet.Site
+	}
+	return map[string]any{
+		"mac":            sys.MAC,
+		"hostname":       sys.Hostname,
+		"ip":             ip,
+		"state":          sys.State,
+		"tags":           db.SplitTags(sys.Tags),
+		"vars":           vars,
+		"arch":           client.BuildArch,
+		"platform":       client.Platform,
+		"ipxe_version":   client.Version,
+		"features":       client.Features,
+		"image_id":       imageID,
+		"profile_id":     profileID,
+		"subnet":         subnetName,
+		"subnet_purpose": purpose,
+		"site":           site,
+	}
+}
+
+func compileRule(expr string) (*policy.Program, error) {
+	return policy.Compile(expr, factNames)
+}
+
+// applyPolicy runs the enabled rules against a booting system. The first
+// matching assign rule fills in an image or profile the system lacks, and
+// any matching deny rule stops a queued system from booting. The boot
+// policy of the system's subnet comes before the rules when it denies, and
+// after them when it fills in a default image or profile. With persist
+// set, assignments are saved. It returns a note on what the rules did, and
+// whether the boot is denied.
+func (s *Server) applyPolicy(sys *db.System, client ipxe.Client, ip string, persist bool) (string, bool) {
+	if ip == "" {
+		ip = sys.IPAddr
+	}
+	subnet := s.subnetFor(ip)
+	if subnet != nil && subnet.Boot == db.SubnetBootDeny && sys.State == "queued" {
+		return fmt.Sprintf("denied by subnet %s", subnet.Label()), true
+	}
+	rules, err := db.ListPolicyRules(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+		return "", false
+	}
+	facts := systemFacts(sys, client, ip, subnet)
+	var notes []string
+	assigned := false
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		if rule.Action == db.RuleActionAssign && (assigned || (sys.ImageID != nil && sys.ProfileID != nil)) {
+			continue
+		}
+		if rule.Action == db.RuleActionDeny && sys.State != "queued" {
+			continue
+		}
+		ok, err := s.matchRule(rule, facts)
+		if err != nil {
+			log.Printf("http: rule %q for %s: %v", rule.Name, sys.MAC, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if rule.Action == db.RuleActionDeny {
+			return fmt.Sprintf("denied by rule %q", rule.Name), true
+		}
+
+		assigned = true
+		if note := s.assignDefaults(sys, rule.ImageID, rule.ProfileID, fmt.Sprintf("rule %q", rule.Name), persist); note != "" {
+			notes = append(notes, note)
+		}
+	}
+	if subnet != nil {
+		if note := s.assignDefaults(sys, subnet.ImageID, subnet.ProfileID, "subnet "+subnet.Label(), persist); note != "" {
+			notes = append(notes, note)
+		}
+	}
+	return strings.Join(notes, "; "), false
+}
+
+// assignDefaults gives sys the image and profile it lacks from those of a
+// rule or subnet, named by source. With persist set, they are saved. It
+// returns a note on what it set, or "".
+func (s *Server) assignDefaults(sys *db.System, imageID, profileID *int64, source string, persist bool) string {
+	var set []string
+	if sys.ImageID == nil && imageID != nil {
+		sys.ImageID = imageID
+		set = append(set, fmt.Sprintf("image %d", *imageID))
+		if persist {
+			if err := db.UpdateSystemImage(s.DB, sys.ID, sys.ImageID); err != nil {
+				log.Printf("http: %v", err)
+			}
+		}
+	}
+	if sys.ProfileID == nil && profileID != nil {
+		sys.ProfileID = profileID
+		set = append(set, fmt.Sprintf("profile %d", *profileID))
+		if persist {
+			if err := db.UpdateSystemProfile(s.DB, sys.ID, sys.ProfileID); err != nil {
+				log.Printf("http: %v", err)
+			}
+		}
+	}
+	if len(set) == 0 {
+		return ""
+	}
+	note := fmt.Sprintf("%s set %s", source, strings.Join(set, ", "))
+	if persist {
+		log.Printf("http: %s: %s", sys.MAC, note)
+	}
+	return note
+}
+
+func (s *Server) matchRule(rule db.PolicyRule, facts map[string]any) (bool, error) {
+	prog, err := compileRule(rule.Expr)
+	if err != nil {
+		return false, err
+	}
+	return prog.Match(facts)
+}
+
+// ruleView is a rule with the names of what it assigns, for display.
+type ruleView struct {
+	db.PolicyRule
+	ImageName   string
+	ProfileName string
+}
+
+func (s *Server) rulesData() (map[string]any, error) {
+	rules, err := db.ListPolicyRules(s.DB)
+	if err != nil {
+		return nil, err
+	}
+	images, err := db.ListImages(s.DB)
+	if err != nil {
+		return nil, fmt.Errorf("list images: %w", err)
+	}
+	profiles, err := db.ListProfiles(s.DB)
+	if err != nil {
+		return nil, fmt.Errorf("list profiles: %w", err)
+	}
+	imageNames := map[int64]string{}
+	for _, img := range images {
+		imageNames[img.ID] = img.Name
+	}
+	profileNames := map[int64]string{}
+	for _, p := range profiles {
+		profileNames[p.ID] = p.Name
+	}
+	views := make([]ruleView, len(rules))
+	for i, r := range rules {
+		views[i] = ruleView{PolicyRule: r}
+		if r.ImageID != nil {
+			views[i].ImageName = imageNames[*r.ImageID]
+		}
+		if r.ProfileID != nil {
+			views[i].ProfileName = profileNames[*r.ProfileID]
+		}
+	}
+	data := map[string]any{
+		"Rules":     views,
+		"Images":    images,
+		"Profiles":  profiles,
+		"Facts":     factNames,
+		"Functions": policy.FunctionNames(),
+	}
+	if err := s.transitionsData(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *Server) handleRulesPage(w http.ResponseWriter, r *http.Request) {
+	data, err := s.rulesData()
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	hash, _ := s.getAuthState()
+	data["AuthEnabled"] = hash != ""
+	s.addThemeData(r, data)
+	if err := s.Templates.ExecuteTemplate(w, "rules", data); err != nil {
+		log.Printf("http: render rules: %v", err)
+	}
+}
+
+func (s *Server) renderRulesList(w http.ResponseWriter) {
+	data, err := s.rulesData()
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.Templates.ExecuteTemplate(w, "rules_list", data); err != nil {
+		log.Printf("http: render rules list: %v", err)
+	}
+}
+
+// optionalID parses an optional ID form field; blank means none.
+func optionalID(v string) (*int64, error) {
+	if v == "" {
+		return nil, nil
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+func (s *Server) handleCreateRule(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	expr := strings.TrimSpace(r.FormValue("expr"))
+	action := r.FormValue("action")
+	if name == "" || expr == "" {
+		http.Error(w, "Name and expression are required", http.StatusBadRequest)
+		return
+	}
+	if _, err := compileRule(expr); err != nil {
+		http.Error(w, "Invalid expression: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	imageID, err := optionalID(r.FormValue("image_id"))
+	if err != nil {
+		http.Error(w, "Invalid image ID", http.StatusBadRequest)
+		return
+	}
+	profileID, err := optionalID(r.FormValue("profile_id"))
+	if err != nil {
+		http.Error(w, "Invalid profile ID", http.StatusBadRequest)
+		return
+	}
+	switch action {
+	case db.RuleActionAssign:
+		if imageID == nil && profileID == nil {
+			http.Error(w, "An assign rule needs an image or a profile", http.StatusBadRequest)
+			return
+		}
+	case db.RuleActionDeny:
+		imageID, profileID = nil, nil
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+	if _, err := db.CreatePolicyRule(s.DB, name, expr, action, imageID, profileID); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderRulesList(w)
+}
+
+func (s *Server) handleToggleRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	rule, err := db.GetPolicyRule(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if rule == nil {
+		http.Error(w, "Rule not found", http.StatusNotFound)
+		return
+	}
+	if err := db.SetPolicyRuleEnabled(s.DB, id, !rule.Enabled); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderRulesList(w)
+}
+
+func (s *Server) handleMoveRuleUp(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if err := db.MovePolicyRuleUp(s.DB, id); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderRulesList(w)
+}
+
+func (s *Server) handleDeleteRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if err := db.DeletePolicyRule(s.DB, id); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderRulesList(w)
+}
+
+// ruleTestResult is one system's outcome in a test evaluation.
+type ruleTestResult struct {
+	System db.System
+	Match  bool
+	Error  string
+	Facts  string // JSON, shown when testing a single system
+}
+
+// handleTestRule evaluates an expression without saving it: against one
+// system when a MAC is given, otherwise against every system.
+func (s *Server) handleTestRule(w http.ResponseWriter, r *http.Request) {
+	data := map[string]any{}
+	render := func() {
+		if err := s.Templates.ExecuteTemplate(w, "rule_test_result", data); err != nil {
+			log.Printf("http: render rule test: %v", err)
+		}
+	}
+	prog, err := compileRule(strings.TrimSpace(r.FormValue("expr")))
+	if err != nil {
+		data["Error"] = err.Error()
+		render()
+		return
+	}
+
+	var systems []db.System
+	if mac := strings.TrimSpace(r.FormValue("mac")); mac != "" {
+		norm, err := db.NormalizeMAC(mac)
+		if err != nil {
+			data["Error"] = err.Error()
+			render()
+			return
+		}
+		sys, err := db.GetSystemByMAC(s.DB, norm)
+		if err != nil {
+			log.Printf("http: get system: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if sys == nil {
+			data["Error"] = "No system with MAC " + norm
+			render()
+			return
+		}
+		systems = []db.System{*sys}
+	} else if systems, err = db.ListSystems(s.DB); err != nil {
+		log.Printf("http: list systems: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	subnets, err := db.ListSubnets(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+	}
+	var results []ruleTestResult
+	matches := 0
+	for i := range systems {
+		sys := &systems[i]
+		client, _ := reportedClient(r, sys)
+		facts := systemFacts(sys, client, "", db.SubnetFor(subnets, sys.IPAddr))
+		res := ruleTestResult{System: *sys}
+		if res.Match, err = prog.Match(facts); err != nil {
+			res.Error = err.Error()
+		}
+		if res.Match {
+			matches++
+		}
+		if len(systems) == 1 {
+			b, _ := json.MarshalIndent(facts, "", "  ")
+			res.Facts = string(b)
+		}
+		results = append(results, res)
+	}
+	data["Results"] = results
+	data["Matches"] = matches
+	data["Total"] = len(systems)
+	render()
+}
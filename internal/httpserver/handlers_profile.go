@@ -1,15 +1,22 @@
 package httpserver
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/passwd"
 	"github.com/justinpopa/duh/internal/profile"
+	"github.com/justinpopa/duh/internal/tracing"
 )
 
 func (s *Server) handleProfilesPage(w http.ResponseWriter, r *http.Request) {
@@ -21,21 +28,48 @@ func (s *Server) handleProfilesPage(w http.ResponseWriter, r *http.Request) {
 	}
 	profHash, _ := s.getAuthState()
 	data := map[string]any{
-		"Profiles":    profiles,
 		"AuthEnabled": profHash != "",
 	}
+	s.addScopeData(r, data)
+	s.addTenantData(r, data)
+	scope := data["Scope"].(string)
+	data["Profiles"] = slices.DeleteFunc(profiles, func(p db.Profile) bool {
+		return !inScope(scope, p.Environment, false) || !visibleTo(r, p.TenantID, true)
+	})
+	usage, err := db.ProfileUsage(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+	}
+	data["Usage"] = usage
+	if err := s.driversData(data); err != nil {
+		log.Printf("http: %v", err)
+	}
+	if err := s.snippetsData(data); err != nil {
+		log.Printf("http: %v", err)
+	}
+	s.addThemeData(r, data)
 	if err := s.Templates.ExecuteTemplate(w, "profiles", data); err != nil {
 		log.Printf("http: render profiles: %v", err)
 	}
 }
 
 func (s *Server) handleProfileEditorNew(w http.ResponseWriter, r *http.Request) {
+	envs, err := db.ListEnvironments(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+	}
 	profHash, _ := s.getAuthState()
 	data := map[string]any{
-		"Profile":     &db.Profile{DefaultVars: "{}", OSFamily: "custom"},
-		"IsNew":       true,
-		"AuthEnabled": profHash != "",
+		"Profile":      &db.Profile{DefaultVars: "{}", OSFamily: "custom", Environment: s.envScope(r)},
+		"IsNew":        true,
+		"AuthEnabled":  profHash != "",
+		"Environments": envs,
 	}
+	if err := s.profileDriversData(data, 0); err != nil {
+		log.Printf("http: %v", err)
+	}
+	s.addTenantData(r, data)
+	s.addThemeData(r, data)
 	if err := s.Templates.ExecuteTemplate(w, "profile_editor", data); err != nil {
 		log.Printf("http: render profile editor (new): %v", err)
 	}
@@ -59,12 +93,32 @@ func (s *Server) handleProfileEditor(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	profiles, err := db.ListProfiles(s.DB)
+	if err != nil {
+		log.Printf("http: list profiles: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	envs, err := db.ListEnvironments(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+	}
+
+	profiles = slices.DeleteFunc(profiles, func(p db.Profile) bool { return !visibleTo(r, p.TenantID, true) })
+
 	profHash, _ := s.getAuthState()
 	data := map[string]any{
-		"Profile":     p,
-		"IsNew":       false,
-		"AuthEnabled": profHash != "",
+		"Profile":      p,
+		"Profiles":     profiles,
+		"IsNew":        false,
+		"AuthEnabled":  profHash != "",
+		"Environments": envs,
 	}
+	if err := s.profileDriversData(data, id); err != nil {
+		log.Printf("http: %v", err)
+	}
+	s.addTenantData(r, data)
+	s.addThemeData(r, data)
 	if err := s.Templates.ExecuteTemplate(w, "profile_editor", data); err != nil {
 		log.Printf("http: render profile editor: %v", err)
 	}
@@ -72,29 +126,66 @@ func (s *Server) handleProfileEditor(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleCreateProfile(w http.ResponseWriter, r *http.Request) {
 	const maxUpload = 1 << 30 // 1 GB
-	r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
-	if err := r.ParseMultipartForm(maxUpload); err != nil {
+	form, err := s.streamMultipart(w, r, maxUpload)
+	if err != nil {
 		http.Error(w, "Upload too large or failed to parse form", http.StatusBadRequest)
 		return
 	}
+	defer form.Close()
 
-	name := r.FormValue("name")
+	name := form.Values.Get("name")
 	if name == "" {
 		http.Error(w, "Name is required", http.StatusBadRequest)
 		return
 	}
-	description := r.FormValue("description")
-	osFamily := r.FormValue("os_family")
-	configTemplate := r.FormValue("config_template")
-	kernelParams := r.FormValue("kernel_params")
-	defaultVars := r.FormValue("default_vars")
-	varSchema := r.FormValue("var_schema")
+	description := form.Values.Get("description")
+	osFamily := form.Values.Get("os_family")
+	configTemplate := form.Values.Get("config_template")
+	kernelParams := form.Values.Get("kernel_params")
+	defaultVars := form.Values.Get("default_vars")
+	varSchema := form.Values.Get("var_schema")
+	storageLayout := form.Values.Get("storage_layout")
+	if _, err := profile.ParseLayout(storageLayout); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	secretPaths := strings.TrimSpace(form.Values.Get("secret_paths"))
+	if _, err := profile.ParseSecretPaths(secretPaths); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	snippets, err := s.snippets()
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := checkIncludes(configTemplate, kernelParams, snippets); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkConfigFormat(osFamily, configTemplate, s.globalVars(), defaultVars, storageLayout, snippets); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	environment, err := s.formEnvironment(form.Values.Get("environment"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tenantID, err := s.formTenant(r, form.Values.Get("tenant_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	var overlayFileName string
-	file, header, err := r.FormFile("overlay_file")
-	if err == nil {
-		defer file.Close()
-		overlayFileName = filepath.Base(header.Filename)
+	overlay, hasOverlay := form.File("overlay_file")
+	if hasOverlay {
+		overlayFileName = overlay.Name
+		if refuseOverQuota(w, s.checkQuota(areaProfiles, overlay.Size, 0)) {
+			return
+		}
 	}
 
 	id, err := db.CreateProfile(s.DB, name, description, osFamily, configTemplate, kernelParams, defaultVars, overlayFileName, varSchema, "")
@@ -103,6 +194,28 @@ func (s *Server) handleCreateProfile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to create profile: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := db.UpdateProfileEnvironment(s.DB, id, environment); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := db.UpdateProfileStorage(s.DB, id, storageLayout); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := db.UpdateProfileSecretPaths(s.DB, id, secretPaths); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if tenantID != 0 {
+		if err := db.UpdateProfileTenant(s.DB, id, tenantID); err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
 
 	if overlayFileName != "" {
 		profileDir := filepath.Join(s.DataDir, "profiles", fmt.Sprintf("%d", id))
@@ -111,12 +224,17 @@ func (s *Server) handleCreateProfile(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed to save overlay file", http.StatusInternalServerError)
 			return
 		}
-		if err := saveFile(filepath.Join(profileDir, overlayFileName), file); err != nil {
+		if err := s.install(overlay, filepath.Join(profileDir, overlayFileName)); err != nil {
 			log.Printf("http: save overlay file: %v", err)
 			http.Error(w, "Failed to save overlay file", http.StatusInternalServerError)
 			return
 		}
 	}
+	if err := s.saveProfileDrivers(id, form.Values); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 
 	http.Redirect(w, r, fmt.Sprintf("/profiles/%d", id), http.StatusSeeOther)
 }
@@ -129,23 +247,53 @@ func (s *Server) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	const maxUpload = 1 << 30 // 1 GB
-	r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
-	if err := r.ParseMultipartForm(maxUpload); err != nil {
+	form, err := s.streamMultipart(w, r, maxUpload)
+	if err != nil {
 		http.Error(w, "Upload too large or failed to parse form", http.StatusBadRequest)
 		return
 	}
+	defer form.Close()
 
-	name := r.FormValue("name")
+	name := form.Values.Get("name")
 	if name == "" {
 		http.Error(w, "Name is required", http.StatusBadRequest)
 		return
 	}
-	description := r.FormValue("description")
-	osFamily := r.FormValue("os_family")
-	configTemplate := r.FormValue("config_template")
-	kernelParams := r.FormValue("kernel_params")
-	defaultVars := r.FormValue("default_vars")
-	varSchema := r.FormValue("var_schema")
+	description := form.Values.Get("description")
+	osFamily := form.Values.Get("os_family")
+	configTemplate := form.Values.Get("config_template")
+	kernelParams := form.Values.Get("kernel_params")
+	defaultVars := form.Values.Get("default_vars")
+	varSchema := form.Values.Get("var_schema")
+	storageLayout := form.Values.Get("storage_layout")
+	if _, err := profile.ParseLayout(storageLayout); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	secretPaths := strings.TrimSpace(form.Values.Get("secret_paths"))
+	if _, err := profile.ParseSecretPaths(secretPaths); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	snippets, err := s.snippets()
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := checkIncludes(configTemplate, kernelParams, snippets); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkConfigFormat(osFamily, configTemplate, s.globalVars(), defaultVars, storageLayout, snippets); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	environment, err := s.formEnvironment(form.Values.Get("environment"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	existing, err := db.GetProfile(s.DB, id)
 	if err != nil || existing == nil {
@@ -158,7 +306,7 @@ func (s *Server) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
 	profileDir := filepath.Join(s.DataDir, "profiles", fmt.Sprintf("%d", id))
 
 	// Handle overlay removal
-	if r.FormValue("remove_overlay") == "true" {
+	if form.Values.Get("remove_overlay") == "true" {
 		if overlayFileName != "" {
 			os.RemoveAll(profileDir)
 		}
@@ -166,20 +314,25 @@ func (s *Server) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Handle new overlay upload (replaces existing)
-	file, header, err := r.FormFile("overlay_file")
-	if err == nil {
-		defer file.Close()
+	if overlay, ok := form.File("overlay_file"); ok {
+		freed, err := dirSize(profileDir)
+		if err != nil {
+			log.Printf("http: %v", err)
+		}
+		if refuseOverQuota(w, s.checkQuota(areaProfiles, overlay.Size, freed)) {
+			return
+		}
 		// Remove old overlay dir if it exists
 		if existing.OverlayFile != "" {
 			os.RemoveAll(profileDir)
 		}
-		overlayFileName = filepath.Base(header.Filename)
+		overlayFileName = overlay.Name
 		if err := os.MkdirAll(profileDir, 0755); err != nil {
 			log.Printf("http: create profile dir: %v", err)
 			http.Error(w, "Failed to save overlay file", http.StatusInternalServerError)
 			return
 		}
-		if err := saveFile(filepath.Join(profileDir, overlayFileName), file); err != nil {
+		if err := s.install(overlay, filepath.Join(profileDir, overlayFileName)); err != nil {
 			log.Printf("http: save overlay file: %v", err)
 			http.Error(w, "Failed to save overlay file", http.StatusInternalServerError)
 			return
@@ -191,6 +344,38 @@ func (s *Server) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	if err := db.UpdateProfileEnvironment(s.DB, id, environment); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := db.UpdateProfileStorage(s.DB, id, storageLayout); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := db.UpdateProfileSecretPaths(s.DB, id, secretPaths); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.saveProfileDrivers(id, form.Values); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if _, ok := form.Values["tenant_id"]; ok && requestTenant(r) == nil {
+		tenantID, err := s.formTenant(r, form.Values.Get("tenant_id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := db.UpdateProfileTenant(s.DB, id, tenantID); err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
 
 	http.Redirect(w, r, "/profiles", http.StatusSeeOther)
 }
@@ -202,18 +387,240 @@ func (s *Server) handleDeleteProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	deps, err := db.ListSystemsByProfile(s.DB, id)
+	if err != nil {
+		log.Printf("http: list profile dependents: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if len(deps) > 0 {
+		target, reassign, err := reassignTarget(r)
+		if err != nil || (target != nil && *target == id) {
+			http.Error(w, "Invalid reassignment target", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case reassign:
+			if target != nil {
+				p, err := db.GetProfile(s.DB, *target)
+				if err != nil || p == nil || !visibleTo(r, p.TenantID, true) {
+					http.Error(w, "Invalid reassignment target", http.StatusBadRequest)
+					return
+				}
+			}
+			if _, err := db.ReassignSystemsProfile(s.DB, id, target); err != nil {
+				log.Printf("http: reassign profile: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		case r.FormValue("confirm") != "1":
+			writeDependents(w, r, http.StatusConflict, deps, nil)
+			return
+		}
+	}
+
 	if err := db.DeleteProfile(s.DB, id); err != nil {
 		log.Printf("http: delete profile: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	profileDir := filepath.Join(s.DataDir, "profiles", fmt.Sprintf("%d", id))
-	os.RemoveAll(profileDir)
 	w.WriteHeader(http.StatusOK)
 }
 
+func (s *Server) handleProfileDependents(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	deps, err := db.ListSystemsByProfile(s.DB, id)
+	if err != nil {
+		log.Printf("http: list profile dependents: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	usage, err := db.GetProfileUsage(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeDependents(w, r, http.StatusOK, deps, &usage)
+}
+
+// sampleConfig renders a config template for a made-up system with the
+// profile's default vars.
+func sampleConfig(osFamily, configTemplate, globalVars, defaultVars, storageLayout string, snippets profile.Snippets) (string, error) {
+	vars, err := profile.BuildVars(globalVars, defaultVars, "")
+	if err != nil {
+		return "", err
+	}
+	storage, err := profile.NewStorage(storageLayout, osFamily)
+	if err != nil {
+		return "", err
+	}
+	return profile.RenderConfigTemplate(configTemplate, snippets, profile.TemplateVars{
+		MAC:          "00:00:00:00:00:00",
+		Hostname:     "example",
+		IP:           "192.0.2.1",
+		ServerURL:    "http://duh.invalid",
+		Vars:         vars,
+		PasswordHash: passwd.Hash("example"),
+		Storage:      storage,
+	})
+}
+
+// checkConfigFormat checks the sample config of an OS family with a
+// format, such as Ignition, converting it first where the format does.
+// Templates that only render for a real system (with a machine
+// certificate, say) aren't checked until they're served.
+func checkConfigFormat(osFamily, configTemplate, globalVars, defaultVars, storageLayout string, snippets profile.Snippets) error {
+	format := profile.FormatFor(osFamily)
+	if (format.Convert == nil && format.Validate == nil) || strings.TrimSpace(configTemplate) == "" {
+		return nil
+	}
+	rendered, err := sampleConfig(osFamily, configTemplate, globalVars, defaultVars, storageLayout, snippets)
+	if err != nil {
+		return nil
+	}
+	_, err = format.Prepare(rendered)
+	return err
+}
+
+// handleCheckProfileConfig renders the profile editor's config template for
+// a made-up system and shows the result as it would be served, or what's
+// wrong with it.
+func (s *Server) handleCheckProfileConfig(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	osFamily := r.FormValue("os_family")
+	data := map[string]any{}
+	snippets, err := s.snippets()
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	rendered, err := sampleConfig(osFamily, r.FormValue("config_template"), s.globalVars(), r.FormValue("default_vars"), r.FormValue("storage_layout"), snippets)
+	if err == nil {
+		rendered, err = profile.FormatFor(osFamily).Prepare(rendered)
+	}
+	if err != nil {
+		data["Error"] = err.Error()
+	} else {
+		data["Config"] = rendered
+		data["ContentType"] = profile.FormatFor(osFamily).ContentType
+	}
+	if err := s.Templates.ExecuteTemplate(w, "profile_config_check", data); err != nil {
+		log.Printf("http: render config check: %v", err)
+	}
+}
+
+// templateVar is a var key a profile's templates can use, and where it
+// comes from: "global", "default", "schema" or "system".
+type templateVar struct {
+	Key    string `json:"key"`
+	Source string `json:"source"`
+}
+
+// profileVarKeys lists the var keys a profile's systems can have: the
+// global vars, the profile's default vars and var schema, and the vars of
+// the systems assigned it. p may be nil for the global vars alone.
+func profileVarKeys(globalVars string, p *db.Profile, systems []db.System) []templateVar {
+	seen := map[string]bool{}
+	keys := []templateVar{}
+	add := func(key, source string) {
+		if key != "" && !seen[key] {
+			seen[key] = true
+			keys = append(keys, templateVar{Key: key, Source: source})
+		}
+	}
+	var global map[string]any
+	json.Unmarshal([]byte(globalVars), &global)
+	for _, k := range slices.Sorted(maps.Keys(global)) {
+		add(k, "global")
+	}
+	if p == nil {
+		return keys
+	}
+	var defaults map[string]any
+	json.Unmarshal([]byte(p.DefaultVars), &defaults)
+	for _, k := range slices.Sorted(maps.Keys(defaults)) {
+		add(k, "default")
+	}
+	var schema []struct {
+		Key string `json:"key"`
+	}
+	json.Unmarshal([]byte(p.VarSchema), &schema)
+	for _, def := range schema {
+		add(def.Key, "schema")
+	}
+	var fromSystems []string
+	for _, sys := range systems {
+		var vars map[string]any
+		json.Unmarshal([]byte(sys.Vars), &vars)
+		for k := range vars {
+			fromSystems = append(fromSystems, k)
+		}
+	}
+	slices.Sort(fromSystems)
+	for _, k := range fromSystems {
+		add(k, "system")
+	}
+	return keys
+}
+
+// handleTemplateVars lists the fields config templates and kernel
+// parameters can use, the snippets they can include, and the global var
+// keys and, given ?profile=, those the profile's systems can have, for the
+// profile editor's autocomplete and checks.
+func (s *Server) handleTemplateVars(w http.ResponseWriter, r *http.Request) {
+	var p *db.Profile
+	var systems []db.System
+	if v := r.URL.Query().Get("profile"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid profile ID", http.StatusBadRequest)
+			return
+		}
+		if p, err = db.GetProfile(s.DB, id); err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if p == nil || !visibleTo(r, p.TenantID, true) {
+			http.Error(w, "Profile not found", http.StatusNotFound)
+			return
+		}
+		if systems, err = db.ListSystemsByProfile(s.DB, id); err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	snippets, err := db.ListSnippets(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	names := []string{}
+	for _, sn := range snippets {
+		names = append(names, sn.Name)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"fields":   profile.TemplateFields(),
+		"vars":     profileVarKeys(s.globalVars(), p, systems),
+		"snippets": names,
+	})
+}
+
 func (s *Server) handleServeConfig(w http.ResponseWriter, r *http.Request) {
-	if !s.validateToken(r) {
+	bound, ok := s.validateToken(r, tokenPurposeConfig)
+	if !ok {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -223,6 +630,10 @@ func (s *Server) handleServeConfig(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid ID", http.StatusBadRequest)
 		return
 	}
+	if bound != nil && bound.ID != id {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 
 	sys, err := db.GetSystemByID(s.DB, id)
 	if err != nil {
@@ -250,48 +661,104 @@ func (s *Server) handleServeConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	serverURL := s.ServerURL
+	config, err := s.renderSystemConfig(r, sys, prof)
+	if errors.Is(err, errNotAttested) {
+		log.Printf("http: config for system %d: %v", sys.ID, err)
+		http.Error(w, "Config error: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("http: config for system %d: %v", sys.ID, err)
+		http.Error(w, "Config error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", profile.FormatFor(prof.OSFamily).ContentType)
+	w.Write([]byte(config))
+}
+
+// renderSystemConfig renders a system's config from its profile, converted
+// and checked for the profile's OS family.
+func (s *Server) renderSystemConfig(r *http.Request, sys *db.System, prof *db.Profile) (string, error) {
+	serverURL := s.serverURL()
 	if serverURL == "" {
 		serverURL = "http://" + r.Host
 	}
 
-	vars, err := profile.BuildVars(prof.DefaultVars, sys.Vars)
+	vars, err := profile.BuildVars(s.globalVars(), prof.DefaultVars, sys.Vars)
 	if err != nil {
-		log.Printf("http: config build vars: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		return "", err
 	}
 
 	var imageID int64
+	var fileURLs map[string]string
+	var checksumsURL string
+	var torrentURLs map[string]string
 	if sys.ImageID != nil {
 		imageID = *sys.ImageID
+		if img, err := db.GetImage(s.DB, imageID); err == nil && img != nil {
+			_, _, fileURLs = s.imageFileURLs(serverURL, sys, img)
+			checksumsURL = s.imageChecksumsURL(serverURL, sys, img)
+			torrentURLs = s.imageTorrentURLs(serverURL, sys, img)
+		}
 	}
 
-	tv := profile.TemplateVars{
-		MAC:         sys.MAC,
-		Hostname:    sys.Hostname,
-		IP:          sys.IPAddr,
-		SystemID:    sys.ID,
-		ImageID:     imageID,
-		ServerURL:   serverURL,
-		ConfigURL:   s.signURL(fmt.Sprintf("%s/config/%d", serverURL, sys.ID)),
-		CallbackURL: s.signURL(fmt.Sprintf("%s/api/v1/systems/%s/callback", serverURL, sys.MAC)),
-		Vars:        vars,
+	storage, err := profile.NewStorage(prof.StorageLayout, prof.OSFamily)
+	if err != nil {
+		return "", err
 	}
-
-	rendered, err := profile.RenderConfigTemplate(prof.ConfigTemplate, tv)
+	secrets, err := s.profileSecrets(r.Context(), prof)
 	if err != nil {
-		log.Printf("http: config render: %v", err)
-		http.Error(w, "Template render error: "+err.Error(), http.StatusInternalServerError)
-		return
+		return "", err
 	}
+	secrets, identity := s.attestedSecrets(sys, secrets, s.machineIdentity(sys))
 
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(rendered))
+	site := s.siteFor(sys.IPAddr)
+	mirrors := s.mirrorURLs(serverURL, site)
+	tv := profile.TemplateVars{
+		MAC:          sys.MAC,
+		Hostname:     sys.Hostname,
+		IP:           sys.IPAddr,
+		Site:         site,
+		SystemID:     sys.ID,
+		ImageID:      imageID,
+		ServerURL:    serverURL,
+		ConfigURL:    s.signURL(tokenPurposeConfig, sys, fmt.Sprintf("%s/config/%d", serverURL, sys.ID)),
+		CallbackURL:  s.callbackURL(serverURL, sys),
+		HeartbeatURL: s.heartbeatURL(serverURL, sys),
+		TPMURL:       s.tpmURL(serverURL, sys),
+		AttemptID:    sys.AttemptID,
+		FileURLs:     fileURLs,
+		RootfsURL:    fileURLs[db.FileRoleRootfs],
+		ChecksumsURL: checksumsURL,
+		TorrentURLs:  torrentURLs,
+		DriversURL:   s.driversURL(serverURL, sys),
+		MirrorURL:    mirrors[prof.OSFamily],
+		Mirrors:      mirrors,
+		Vars:         vars,
+		PasswordHash: s.systemPasswordHash(sys),
+		Identity:     identity,
+		Storage:      storage,
+		Secrets:      secrets,
+	}
+
+	snippets, err := s.snippets()
+	if err != nil {
+		return "", err
+	}
+	_, span := tracing.Start(r.Context(), "profile.render_config")
+	span.SetAttr("duh.profile_id", prof.ID)
+	rendered, err := profile.RenderConfigTemplate(prof.ConfigTemplate, snippets, tv)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		return "", err
+	}
+	return profile.FormatFor(prof.OSFamily).Prepare(rendered)
 }
 
 func (s *Server) handleServeOverlayFile(w http.ResponseWriter, r *http.Request) {
-	if !s.validateToken(r) {
+	bound, ok := s.validateToken(r, tokenPurposeOverlay)
+	if !ok {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -301,6 +768,10 @@ func (s *Server) handleServeOverlayFile(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Invalid ID", http.StatusBadRequest)
 		return
 	}
+	if bound != nil && (bound.ProfileID == nil || *bound.ProfileID != idNum) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 	name := r.PathValue("name")
 
 	name = filepath.Base(name)
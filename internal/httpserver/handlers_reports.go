@@ -0,0 +1,550 @@
+package httpserver
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/pdf"
+)
+
+// reportGroup counts the attempts made with one image or profile.
+type reportGroup struct {
+	Name          string
+	Attempts      int
+	Succeeded     int
+	Failed        int
+	MedianInstall time.Duration // of successful attempts
+	installs      []time.Duration
+}
+
+// durationStats summarizes how long a phase of successful attempts took.
+type durationStats struct {
+	Count              int
+	P50, P90, P95, Max time.Duration
+}
+
+// newDurationStats computes nearest-rank percentiles of ds, which it
+// sorts.
+func newDurationStats(ds []time.Duration) durationStats {
+	if len(ds) == 0 {
+		return durationStats{}
+	}
+	slices.Sort(ds)
+	rank := func(p int) time.Duration {
+		i := (p*len(ds)+99)/100 - 1
+		return ds[max(i, 0)].Round(time.Second)
+	}
+	return durationStats{Count: len(ds), P50: rank(50), P90: rank(90), P95: rank(95), Max: ds[len(ds)-1].Round(time.Second)}
+}
+
+// provisionReport summarizes the provision attempts started in a period.
+type provisionReport struct {
+	From, To     time.Time // To is exclusive
+	Attempts     []db.AttemptRecord
+	Succeeded    int
+	Failed       int
+	Cancelled    int
+	Open         int // still queued or provisioning
+	Systems      int // systems with at least one successful attempt
+	MeanDuration time.Duration
+	Wait         durationStats // queued to provisioning
+	Install      durationStats // provisioning to ready
+	Total        durationStats // queued to ready
+	SLO          time.Duration
+	WithinSLO    int // successful attempts that took no longer than SLO
+	ByImage      []reportGroup
+	ByProfile    []reportGroup
+	Days         []reportDay // one per day of the period
+}
+
+// reportDay counts the attempts queued on one day.
+type reportDay struct {
+	Date      time.Time
+	Attempts  int
+	Succeeded int
+	Failed    int
+	Level     int // 0 for none, up to 4 for as busy as the busiest day
+}
+
+// Tone colours a day in the calendar: danger when at least half of the
+// finished attempts failed, warning when some did.
+func (d reportDay) Tone() string {
+	switch {
+	case d.Failed > 0 && d.Failed*2 >= d.Succeeded+d.Failed:
+		return "danger"
+	case d.Failed > 0:
+		return "warning"
+	}
+	return "success"
+}
+
+// Opacity is the Bootstrap background opacity class for the day's level.
+func (d reportDay) Opacity() int {
+	return d.Level * 25
+}
+
+// Calendar lays the days out in weeks from Monday, for a grid filled a
+// column at a time. Days outside the period are nil.
+func (p *provisionReport) Calendar() []*reportDay {
+	if len(p.Days) == 0 {
+		return nil
+	}
+	lead := (int(p.Days[0].Date.Weekday()) + 6) % 7
+	out := make([]*reportDay, lead, lead+len(p.Days)+6)
+	for i := range p.Days {
+		out = append(out, &p.Days[i])
+	}
+	for len(out)%7 != 0 {
+		out = append(out, nil)
+	}
+	return out
+}
+
+// SLORate is the percentage of timed successful attempts that met the
+// objective, or -1 if there were none.
+func (p *provisionReport) SLORate() float64 {
+	if p.Total.Count == 0 {
+		return -1
+	}
+	return float64(p.WithinSLO) * 100 / float64(p.Total.Count)
+}
+
+// SuccessRate is the percentage of finished attempts that succeeded, or
+// -1 if none finished.
+func (p *provisionReport) SuccessRate() float64 {
+	done := p.Succeeded + p.Failed
+	if done == 0 {
+		return -1
+	}
+	return float64(p.Succeeded) * 100 / float64(done)
+}
+
+// Failures returns the failed attempts.
+func (p *provisionReport) Failures() []db.AttemptRecord {
+	var out []db.AttemptRecord
+	for _, a := range p.Attempts {
+		if a.State == "failed" {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// Period describes the report's dates, the last one inclusive.
+func (p *provisionReport) Period() string {
+	return p.From.Format(time.DateOnly) + " to " + p.To.AddDate(0, 0, -1).Format(time.DateOnly)
+}
+
+// reportPeriod reads the from and to dates (YYYY-MM-DD, both inclusive)
+// of a report request. It defaults to the last 30 days.
+func reportPeriod(r *http.Request) (from, to time.Time, err error) {
+	to = time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid to date %q", v)
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+	from = to.AddDate(0, 0, -30)
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid from date %q", v)
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from must not be after to")
+	}
+	return from, to, nil
+}
+
+// buildReport gathers the attempts the caller can see in the period, in
+// the environment they have scoped the UI to.
+func (s *Server) buildReport(r *http.Request, from, to time.Time) (*provisionReport, error) {
+	attempts, err := db.ListAttemptsBetween(s.DB, from, to)
+	if err != nil {
+		return nil, err
+	}
+	scope := s.envScope(r)
+	attempts = slices.DeleteFunc(attempts, func(a db.AttemptRecord) bool {
+		return !visibleTo(r, a.TenantID, false) || !inScope(scope, a.Environment, true)
+	})
+
+	p := &provisionReport{From: from, To: to, Attempts: attempts, SLO: s.settingDuration("provision_slo")}
+	images := map[string]*reportGroup{}
+	profiles := map[string]*reportGroup{}
+	count := func(groups map[string]*reportGroup, name string, a db.AttemptRecord) {
+		if name == "" {
+			name = "(none)"
+		}
+		g := groups[name]
+		if g == nil {
+			g = &reportGroup{Name: name}
+			groups[name] = g
+		}
+		g.Attempts++
+		switch a.State {
+		case "ready":
+			g.Succeeded++
+			if d := a.InstallTime(); d > 0 {
+				g.installs = append(g.installs, d)
+			}
+		case "failed":
+			g.Failed++
+		}
+	}
+	imaged := map[int64]bool{}
+	var waits, installs, totals []time.Duration
+	var sum time.Duration
+	for _, a := range attempts {
+		switch a.State {
+		case "ready":
+			p.Succeeded++
+			imaged[a.SystemID] = true
+			if d := a.WaitTime(); d > 0 {
+				waits = append(waits, d)
+			}
+			if d := a.InstallTime(); d > 0 {
+				installs = append(installs, d)
+			}
+			if d := a.TotalTime(); d > 0 {
+				totals = append(totals, d)
+				sum += d
+				if p.SLO <= 0 || d <= p.SLO {
+					p.WithinSLO++
+				}
+			}
+		case "failed":
+			p.Failed++
+		case "cancelled":
+			p.Cancelled++
+		default:
+			p.Open++
+		}
+		count(images, a.ImageName, a)
+		count(profiles, a.ProfileName, a)
+	}
+	p.Systems = len(imaged)
+	p.Days = reportDays(from, to, attempts)
+	if len(totals) > 0 {
+		p.MeanDuration = (sum / time.Duration(len(totals))).Round(time.Second)
+	}
+	p.Wait = newDurationStats(waits)
+	p.Install = newDurationStats(installs)
+	p.Total = newDurationStats(totals)
+	p.ByImage = sortedGroups(images)
+	p.ByProfile = sortedGroups(profiles)
+	return p, nil
+}
+
+// reportDays counts attempts per day from their queued date.
+func reportDays(from, to time.Time, attempts []db.AttemptRecord) []reportDay {
+	var days []reportDay
+	index := map[string]int{}
+	for d := from; d.Before(to); d = d.AddDate(0, 0, 1) {
+		index[d.Format(time.DateOnly)] = len(days)
+		days = append(days, reportDay{Date: d})
+	}
+	busiest := 0
+	for _, a := range attempts {
+		if len(a.StartedAt) < len(time.DateOnly) {
+			continue
+		}
+		i, ok := index[a.StartedAt[:len(time.DateOnly)]]
+		if !ok {
+			continue
+		}
+		day := &days[i]
+		day.Attempts++
+		switch a.State {
+		case "ready":
+			day.Succeeded++
+		case "failed":
+			day.Failed++
+		}
+		busiest = max(busiest, day.Attempts)
+	}
+	for i := range days {
+		if days[i].Attempts > 0 {
+			days[i].Level = (days[i].Attempts*4 + busiest - 1) / busiest
+		}
+	}
+	return days
+}
+
+// sortedGroups orders groups by failures, then attempts, then name.
+func sortedGroups(groups map[string]*reportGroup) []reportGroup {
+	out := make([]reportGroup, 0, len(groups))
+	for _, g := range groups {
+		g.MedianInstall = newDurationStats(g.installs).P50
+		out = append(out, *g)
+	}
+	slices.SortFunc(out, func(a, b reportGroup) int {
+		if a.Failed != b.Failed {
+			return b.Failed - a.Failed
+		}
+		if a.Attempts != b.Attempts {
+			return b.Attempts - a.Attempts
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return out
+}
+
+// requestReport builds the report a request asks for, writing the error
+// response if it can't.
+func (s *Server) requestReport(w http.ResponseWriter, r *http.Request) (*provisionReport, bool) {
+	from, to, err := reportPeriod(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	p, err := s.buildReport(r, from, to)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return p, true
+}
+
+func (s *Server) handleReportsPage(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.requestReport(w, r)
+	if !ok {
+		return
+	}
+	hash, _ := s.getAuthState()
+	today := time.Now().UTC()
+	data := map[string]any{
+		"Report":      p,
+		"From":        p.From.Format(time.DateOnly),
+		"To":          p.To.AddDate(0, 0, -1).Format(time.DateOnly),
+		"YearFrom":    today.AddDate(-1, 0, 1).Format(time.DateOnly),
+		"Today":       today.Format(time.DateOnly),
+		"AuthEnabled": hash != "",
+	}
+	s.addScopeData(r, data)
+	s.addTenantData(r, data)
+	s.addThemeData(r, data)
+	if err := s.Templates.ExecuteTemplate(w, "reports", data); err != nil {
+		log.Printf("http: render reports: %v", err)
+	}
+}
+
+// reportFilename names a downloaded report after its period.
+func reportFilename(p *provisionReport, ext string) string {
+	return fmt.Sprintf("provisioning-%s-%s.%s", p.From.Format("20060102"), p.To.AddDate(0, 0, -1).Format("20060102"), ext)
+}
+
+// handleReportCSV exports the period's attempts, one per row.
+func (s *Server) handleReportCSV(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.requestReport(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+reportFilename(p, "csv")+`"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"attempt", "system_id", "hostname", "mac", "environment", "image", "profile",
+		"state", "started_at", "provisioning_at", "finished_at", "wait_seconds", "install_seconds", "duration_seconds", "phase", "message"})
+	seconds := func(d time.Duration) string {
+		if d <= 0 {
+			return ""
+		}
+		return strconv.Itoa(int(d.Seconds()))
+	}
+	for _, a := range p.Attempts {
+		cw.Write([]string{a.ID, strconv.FormatInt(a.SystemID, 10), a.Hostname, a.MAC, a.Environment, a.ImageName, a.ProfileName,
+			a.State, a.StartedAt, a.ProvisioningAt, a.FinishedAt, seconds(a.WaitTime()), seconds(a.InstallTime()), seconds(a.TotalTime()), a.Phase, a.Message})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("http: write report csv: %v", err)
+	}
+}
+
+// handleReportPDF renders the summary, breakdowns and failures as a PDF.
+func (s *Server) handleReportPDF(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.requestReport(w, r)
+	if !ok {
+		return
+	}
+	doc := pdf.New()
+	doc.Line(18, true, "Provisioning report")
+	doc.Line(10, false, p.Period()+" (UTC)")
+	doc.Space(10)
+
+	rate, sloRate := "n/a", "n/a"
+	if sr := p.SuccessRate(); sr >= 0 {
+		rate = fmt.Sprintf("%.1f%%", sr)
+	}
+	if sr := p.SLORate(); sr >= 0 {
+		sloRate = fmt.Sprintf("%.1f%% within %s", sr, p.SLO)
+	}
+	summary := [][2]string{
+		{"Attempts", strconv.Itoa(len(p.Attempts))},
+		{"Systems imaged", strconv.Itoa(p.Systems)},
+		{"Succeeded", strconv.Itoa(p.Succeeded)},
+		{"Failed", strconv.Itoa(p.Failed)},
+		{"Cancelled", strconv.Itoa(p.Cancelled)},
+		{"In progress", strconv.Itoa(p.Open)},
+		{"Success rate", rate},
+		{"Mean provision duration", reportDuration(p.MeanDuration)},
+		{"Time objective", sloRate},
+	}
+	for _, kv := range summary {
+		doc.Row(10, false, []float64{0, 160}, kv[:])
+	}
+
+	doc.Space(12)
+	doc.Line(13, true, "Durations of successful attempts")
+	dcols := []float64{0, 160, 230, 300, 370, 440}
+	doc.Row(9, true, dcols, []string{"Phase", "Count", "p50", "p90", "p95", "Max"})
+	for _, row := range []struct {
+		name  string
+		stats durationStats
+	}{{"Queued to provisioning", p.Wait}, {"Provisioning to ready", p.Install}, {"Queued to ready", p.Total}} {
+		st := row.stats
+		doc.Row(9, false, dcols, []string{row.name, strconv.Itoa(st.Count),
+			reportDuration(st.P50), reportDuration(st.P90), reportDuration(st.P95), reportDuration(st.Max)})
+	}
+
+	cols := []float64{0, 240, 300, 360, 415}
+	for _, section := range []struct {
+		title  string
+		groups []reportGroup
+	}{{"By image", p.ByImage}, {"By profile", p.ByProfile}} {
+		doc.Space(12)
+		doc.Line(13, true, section.title)
+		doc.Row(9, true, cols, []string{"Name", "Attempts", "Succeeded", "Failed", "Median install"})
+		for _, g := range section.groups {
+			doc.Row(9, false, cols, []string{truncate(g.Name, 44), strconv.Itoa(g.Attempts), strconv.Itoa(g.Succeeded), strconv.Itoa(g.Failed),
+				reportDuration(g.MedianInstall)})
+		}
+	}
+
+	if failures := p.Failures(); len(failures) > 0 {
+		doc.Space(12)
+		doc.Line(13, true, "Failures")
+		fcols := []float64{0, 95, 195, 295}
+		doc.Row(9, true, fcols, []string{"Started", "System", "Image", "Phase / message"})
+		for _, a := range failures {
+			detail := a.Phase
+			if a.Message != "" {
+				if detail != "" {
+					detail += ": "
+				}
+				detail += a.Message
+			}
+			doc.Row(9, false, fcols, []string{a.StartedAt, truncate(cmp.Or(a.Hostname, a.MAC), 18), truncate(a.ImageName, 18), truncate(detail, 50)})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+reportFilename(p, "pdf")+`"`)
+	w.Write(doc.Bytes())
+}
+
+// handleAPIReport returns the report as JSON.
+func (s *Server) handleAPIReport(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.requestReport(w, r)
+	if !ok {
+		return
+	}
+	groups := func(gs []reportGroup) []map[string]any {
+		out := make([]map[string]any, len(gs))
+		for i, g := range gs {
+			out[i] = map[string]any{"name": g.Name, "attempts": g.Attempts, "succeeded": g.Succeeded, "failed": g.Failed,
+				"median_install_seconds": int(g.MedianInstall.Seconds())}
+		}
+		return out
+	}
+	stats := func(st durationStats) map[string]any {
+		return map[string]any{
+			"count":       st.Count,
+			"p50_seconds": int(st.P50.Seconds()),
+			"p90_seconds": int(st.P90.Seconds()),
+			"p95_seconds": int(st.P95.Seconds()),
+			"max_seconds": int(st.Max.Seconds()),
+		}
+	}
+	failures := make([]map[string]any, 0)
+	for _, a := range p.Failures() {
+		failures = append(failures, map[string]any{
+			"attempt":    a.ID,
+			"system_id":  a.SystemID,
+			"hostname":   a.Hostname,
+			"image":      a.ImageName,
+			"profile":    a.ProfileName,
+			"phase":      a.Phase,
+			"message":    a.Message,
+			"started_at": a.StartedAt,
+		})
+	}
+	days := make([]map[string]any, len(p.Days))
+	for i, d := range p.Days {
+		days[i] = map[string]any{
+			"date":      d.Date.Format(time.DateOnly),
+			"attempts":  d.Attempts,
+			"succeeded": d.Succeeded,
+			"failed":    d.Failed,
+		}
+	}
+	out := map[string]any{
+		"from":                  p.From.Format(time.DateOnly),
+		"to":                    p.To.AddDate(0, 0, -1).Format(time.DateOnly),
+		"attempts":              len(p.Attempts),
+		"systems_imaged":        p.Systems,
+		"succeeded":             p.Succeeded,
+		"failed":                p.Failed,
+		"cancelled":             p.Cancelled,
+		"in_progress":           p.Open,
+		"mean_duration_seconds": int(p.MeanDuration.Seconds()),
+		"durations": map[string]any{
+			"wait":    stats(p.Wait),
+			"install": stats(p.Install),
+			"total":   stats(p.Total),
+		},
+		"slo_seconds": int(p.SLO.Seconds()),
+		"within_slo":  p.WithinSLO,
+		"by_image":    groups(p.ByImage),
+		"by_profile":  groups(p.ByProfile),
+		"failures":    failures,
+		"days":        days,
+	}
+	if sr := p.SuccessRate(); sr >= 0 {
+		out["success_rate"] = sr
+	}
+	if sr := p.SLORate(); sr >= 0 {
+		out["slo_rate"] = sr
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// reportDuration formats d for a report, "n/a" if it isn't known.
+func reportDuration(d time.Duration) string {
+	if d <= 0 {
+		return "n/a"
+	}
+	return d.String()
+}
+
+// truncate shortens s to n characters, marking the cut.
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
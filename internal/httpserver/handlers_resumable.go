@@ -0,0 +1,480 @@
+package httpserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/justinpopa/duh/internal/catalog"
+	"github.com/justinpopa/duh/internal/db"
+)
+
+// Resumable uploads add one file to an image in chunks: the client creates
+// an upload, then PATCHes the body from its current offset until the size
+// is reached. A dropped connection keeps what arrived, so the client asks
+// for the offset and continues from there.
+
+// uploadExpiry is how long an unfinished upload is kept.
+const uploadExpiry = 7 * 24 * time.Hour
+
+var (
+	uploadIDRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	sha256Re   = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+)
+
+type resumableUpload struct {
+	ImageID int64     `json:"image_id"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// uploadLocks keeps two requests from appending to one upload at once.
+type uploadLocks struct {
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+func (l *uploadLocks) acquire(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.busy[id] {
+		return false
+	}
+	if l.busy == nil {
+		l.busy = make(map[string]bool)
+	}
+	l.busy[id] = true
+	return true
+}
+
+func (l *uploadLocks) release(id string) {
+	l.mu.Lock()
+	delete(l.busy, id)
+	l.mu.Unlock()
+}
+
+func (s *Server) uploadPath(id, ext string) string {
+	return filepath.Join(s.DataDir, "uploads", id+ext)
+}
+
+func (s *Server) loadUpload(id string) (*resumableUpload, int64, error) {
+	raw, err := os.ReadFile(s.uploadPath(id, ".json"))
+	if err != nil {
+		return nil, 0, err
+	}
+	var u resumableUpload
+	if err := json.Unmarshal(raw, &u); err != nil {
+		return nil, 0, fmt.Errorf("decode upload %s: %w", id, err)
+	}
+	fi, err := os.Stat(s.uploadPath(id, ".part"))
+	if err != nil {
+		return nil, 0, err
+	}
+	return &u, fi.Size(), nil
+}
+
+func (s *Server) removeUpload(id string) {
+	os.Remove(s.uploadPath(id, ".part"))
+	os.Remove(s.uploadPath(id, ".json"))
+}
+
+// pruneUploads drops uploads that were abandoned for longer than
+// uploadExpiry.
+func (s *Server) pruneUploads() {
+	entries, err := os.ReadDir(filepath.Join(s.DataDir, "uploads"))
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "form-") {
+			// A streamed form left behind by a crash.
+			if fi, err := e.Info(); err == nil && time.Since(fi.ModTime()) > 24*time.Hour {
+				os.RemoveAll(filepath.Join(s.DataDir, "uploads", e.Name()))
+			}
+			continue
+		}
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		// The part file's mtime moves with every chunk.
+		fi, err := os.Stat(s.uploadPath(id, ".part"))
+		if err != nil || time.Since(fi.ModTime()) > uploadExpiry {
+			s.removeUpload(id)
+		}
+	}
+}
+
+// writeUploadStatus reports an upload's offset as a header, so a HEAD
+// request is enough, and as JSON.
+func writeUploadStatus(w http.ResponseWriter, status int, id string, u *resumableUpload, offset int64) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Size, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":     id,
+		"name":   u.Name,
+		"size":   u.Size,
+		"offset": offset,
+	})
+}
+
+// handleCreateUpload starts a resumable upload of one file for an image.
+// An unfinished upload of the same file and size is resumed instead, so a
+// reloaded page picks up where it left off.
+func (s *Server) handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	imageID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Name   string `json:"name"`
+		Size   int64  `json:"size"`
+		SHA256 string `json:"sha256"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Name != filepath.Base(req.Name) || req.Name == "" || strings.HasPrefix(req.Name, ".") {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+	if req.Size < 0 {
+		http.Error(w, "Invalid size", http.StatusBadRequest)
+		return
+	}
+	if req.SHA256 != "" && !sha256Re.MatchString(req.SHA256) {
+		http.Error(w, "sha256 must be 64 hex digits", http.StatusBadRequest)
+		return
+	}
+	img, err := db.GetImage(s.DB, imageID)
+	if err != nil {
+		log.Printf("http: get image: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if img == nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	s.pruneUploads()
+	dir := filepath.Join(s.DataDir, "uploads")
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, e := range entries {
+			id, ok := strings.CutSuffix(e.Name(), ".json")
+			if !ok {
+				continue
+			}
+			u, offset, err := s.loadUpload(id)
+			if err == nil && u.ImageID == imageID && u.Name == req.Name && u.Size == req.Size && strings.EqualFold(u.SHA256, req.SHA256) {
+				writeUploadStatus(w, http.StatusOK, id, u, offset)
+				return
+			}
+		}
+	}
+
+	if refuseOverQuota(w, s.checkQuota(areaImages, req.Size, 0)) {
+		return
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("http: upload id: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(b)
+	u := &resumableUpload{
+		ImageID: imageID,
+		Name:    req.Name,
+		Size:    req.Size,
+		SHA256:  strings.ToLower(req.SHA256),
+		Created: time.Now().UTC(),
+	}
+	raw, err := json.Marshal(u)
+	if err != nil {
+		log.Printf("http: encode upload: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("http: create uploads dir: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := os.WriteFile(s.uploadPath(id, ".part"), nil, 0644); err != nil {
+		log.Printf("http: create upload: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := os.WriteFile(s.uploadPath(id, ".json"), raw, 0644); err != nil {
+		s.removeUpload(id)
+		log.Printf("http: create upload: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/uploads/"+id)
+	if u.Size == 0 {
+		s.finishUpload(w, id, u)
+		return
+	}
+	writeUploadStatus(w, http.StatusCreated, id, u, 0)
+}
+
+// uploadFromPath loads the upload named in the request path.
+func (s *Server) uploadFromPath(w http.ResponseWriter, r *http.Request) (string, *resumableUpload, int64, bool) {
+	id := r.PathValue("upload")
+	if !uploadIDRe.MatchString(id) {
+		http.Error(w, "Invalid upload ID", http.StatusBadRequest)
+		return "", nil, 0, false
+	}
+	u, offset, err := s.loadUpload(id)
+	if os.IsNotExist(err) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return "", nil, 0, false
+	}
+	if err != nil {
+		log.Printf("http: load upload: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return "", nil, 0, false
+	}
+	return id, u, offset, true
+}
+
+// handleUploadStatus reports how much of an upload has arrived.
+func (s *Server) handleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	id, u, offset, ok := s.uploadFromPath(w, r)
+	if !ok {
+		return
+	}
+	writeUploadStatus(w, http.StatusOK, id, u, offset)
+}
+
+// handleUploadChunk appends a chunk at the Upload-Offset header's
+// position. The last chunk completes the upload.
+func (s *Server) handleUploadChunk(w http.ResponseWriter, r *http.Request) {
+	id, u, offset, ok := s.uploadFromPath(w, r)
+	if !ok {
+		return
+	}
+	if !s.uploads.acquire(id) {
+		http.Error(w, "Another chunk is being written", http.StatusConflict)
+		return
+	}
+	defer s.uploads.release(id)
+
+	// Re-read the offset now that no other chunk can move it.
+	fi, err := os.Stat(s.uploadPath(id, ".part"))
+	if err != nil {
+		log.Printf("http: stat upload: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	offset = fi.Size()
+	want, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Offset header is required", http.StatusBadRequest)
+		return
+	}
+	if want != offset {
+		writeUploadStatus(w, http.StatusConflict, id, u, offset)
+		return
+	}
+
+	f, err := os.OpenFile(s.uploadPath(id, ".part"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		log.Printf("http: open upload: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// Whatever arrives before a dropped connection is kept; the client
+	// resumes from the new offset.
+	n, err := io.Copy(f, io.LimitReader(r.Body, u.Size-offset))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	offset += n
+	if err != nil {
+		log.Printf("http: upload %s chunk: %v", u.Name, err)
+		writeUploadStatus(w, http.StatusBadRequest, id, u, offset)
+		return
+	}
+	if offset < u.Size {
+		writeUploadStatus(w, http.StatusOK, id, u, offset)
+		return
+	}
+	s.finishUpload(w, id, u)
+}
+
+// finishUpload checks a complete upload's digest and moves it into the
+// image's directory.
+func (s *Server) finishUpload(w http.ResponseWriter, id string, u *resumableUpload) {
+	part := s.uploadPath(id, ".part")
+	f, err := os.Open(part)
+	if err != nil {
+		log.Printf("http: open upload: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		log.Printf("http: hash upload: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if u.SHA256 != "" && sum != u.SHA256 {
+		s.removeUpload(id)
+		http.Error(w, fmt.Sprintf("Checksum mismatch: got sha256 %s, want %s", sum, u.SHA256), http.StatusUnprocessableEntity)
+		return
+	}
+
+	imageDir := filepath.Join(s.DataDir, "images", strconv.FormatInt(u.ImageID, 10))
+	if err := os.MkdirAll(imageDir, 0755); err != nil {
+		log.Printf("http: create image dir: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.install(stagedFile{Name: u.Name, Path: part, Size: u.Size, SHA256: sum}, filepath.Join(imageDir, u.Name)); err != nil {
+		log.Printf("http: install upload %s: %v", u.Name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	os.Remove(s.uploadPath(id, ".json"))
+	source := db.SumSourceReceived
+	if u.SHA256 != "" {
+		source = db.SumSourceMetadata
+	}
+	if err := db.SetImageFileSum(s.DB, u.ImageID, u.Name, sum, source); err != nil {
+		log.Printf("http: %v", err)
+	}
+	if err := s.refreshImageFileList(u.ImageID, imageDir); err != nil {
+		log.Printf("http: %v", err)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Size, 10))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":       id,
+		"name":     u.Name,
+		"size":     u.Size,
+		"offset":   u.Size,
+		"complete": true,
+		"sha256":   sum,
+	})
+}
+
+func (s *Server) handleDeleteUpload(w http.ResponseWriter, r *http.Request) {
+	id, _, _, ok := s.uploadFromPath(w, r)
+	if !ok {
+		return
+	}
+	if !s.uploads.acquire(id) {
+		http.Error(w, "Another chunk is being written", http.StatusConflict)
+		return
+	}
+	defer s.uploads.release(id)
+	s.removeUpload(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkRemoteFile validates a file to be downloaded into an image. A
+// missing name is taken from the URL's last path element.
+func checkRemoteFile(f *catalog.File) error {
+	if err := catalog.ValidateDownloadURL(f.URL); err != nil {
+		return err
+	}
+	if f.Name == "" {
+		if u, err := url.Parse(f.URL); err == nil {
+			f.Name = path.Base(u.Path)
+		}
+	}
+	if f.Name != filepath.Base(f.Name) || f.Name == "" || f.Name == "/" || strings.HasPrefix(f.Name, ".") {
+		return fmt.Errorf("invalid file name %q for %s", f.Name, f.URL)
+	}
+	if f.SHA256 != "" && !sha256Re.MatchString(f.SHA256) {
+		return fmt.Errorf("sha256 for %s must be 64 hex digits", f.Name)
+	}
+	return nil
+}
+
+// handleFetchImageFile has the server download a file into an image
+// instead of the browser uploading it. It runs in the background like a
+// catalog pull; the image's status shows progress.
+func (s *Server) handleFetchImageFile(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	var req catalog.File
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := checkRemoteFile(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkTenantURL(r, req.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	img, err := db.GetImage(s.DB, id)
+	if err != nil {
+		log.Printf("http: get image: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if img == nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	if img.Status == db.ImageStatusDownloading {
+		http.Error(w, "Image is already downloading", http.StatusConflict)
+		return
+	}
+	// The file's size isn't known until it arrives, so this only refuses
+	// once the quota is used up.
+	if refuseOverQuota(w, s.checkQuota(areaImages, 0, 0)) {
+		return
+	}
+
+	// Mark the image busy before returning so a second fetch is refused.
+	if err := db.UpdateImageStatus(s.DB, id, db.ImageStatusDownloading, "1/1 "+req.Name+" 0%"); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := catalog.QueueDownload(s.Jobs, id, img.Name, []catalog.File{req}); err != nil {
+		log.Printf("http: %v", err)
+		db.UpdateImageStatus(s.DB, id, db.ImageStatusError, err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": db.ImageStatusDownloading, "name": req.Name})
+}
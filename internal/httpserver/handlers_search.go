@@ -0,0 +1,106 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/db"
+)
+
+// searchLimit caps the results of each kind the quick search returns.
+const searchLimit = 8
+
+type searchResult struct {
+	Kind   string `json:"kind"` // system, image or profile
+	ID     int64  `json:"id"`
+	Label  string `json:"label"`
+	Detail string `json:"detail"`
+	URL    string `json:"url"`
+}
+
+// handleSearch serves the command palette: systems by hostname or MAC,
+// images and profiles by name, limited to what the caller can see in the
+// current environment scope.
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	results := []searchResult{}
+	if q == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"results": results})
+		return
+	}
+	scope := s.envScope(r)
+
+	systems, err := db.SearchSystems(s.DB, q)
+	if err != nil {
+		log.Printf("http: search systems: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	n := 0
+	for _, sys := range systems {
+		if n == searchLimit {
+			break
+		}
+		if !inScope(scope, sys.Environment, true) || !visibleTo(r, sys.TenantID, false) {
+			continue
+		}
+		label := sys.Hostname
+		if label == "" {
+			label = sys.MAC
+		}
+		results = append(results, searchResult{
+			Kind: "system", ID: sys.ID, Label: label, Detail: sys.MAC + " · " + sys.State,
+			URL: fmt.Sprintf("/#system-%d", sys.ID),
+		})
+		n++
+	}
+
+	images, err := db.SearchImages(s.DB, q)
+	if err != nil {
+		log.Printf("http: search images: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	n = 0
+	for _, img := range images {
+		if n == searchLimit {
+			break
+		}
+		if !inScope(scope, img.Environment, false) || !visibleTo(r, img.TenantID, true) {
+			continue
+		}
+		results = append(results, searchResult{
+			Kind: "image", ID: img.ID, Label: img.Name, Detail: img.BootType,
+			URL: fmt.Sprintf("/images/%d", img.ID),
+		})
+		n++
+	}
+
+	profiles, err := db.SearchProfiles(s.DB, q)
+	if err != nil {
+		log.Printf("http: search profiles: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	n = 0
+	for _, p := range profiles {
+		if n == searchLimit {
+			break
+		}
+		if !inScope(scope, p.Environment, false) || !visibleTo(r, p.TenantID, true) {
+			continue
+		}
+		results = append(results, searchResult{
+			Kind: "profile", ID: p.ID, Label: p.Name, Detail: p.OSFamily,
+			URL: fmt.Sprintf("/profiles/%d", p.ID),
+		})
+		n++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"results": results})
+}
@@ -0,0 +1,134 @@
+package httpserver
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/profile"
+	"github.com/justinpopa/duh/internal/secretstore"
+)
+
+// Settings holding the external secret store's connection.
+const (
+	settingSecretStoreKind  = "secret_store_kind"
+	settingSecretStoreURL   = "secret_store_url"
+	settingSecretStoreToken = "secret_store_token"
+)
+
+type secretStoreForm struct {
+	Kind     string
+	URL      string
+	HasToken bool
+}
+
+// secretStoreClient returns a client for the configured secret store, or
+// nil if none is configured.
+func (s *Server) secretStoreClient() (*secretstore.Client, error) {
+	u, err := db.GetSetting(s.DB, settingSecretStoreURL)
+	if err != nil || u == "" {
+		return nil, err
+	}
+	kind, err := db.GetSetting(s.DB, settingSecretStoreKind)
+	if err != nil {
+		return nil, err
+	}
+	token, err := db.GetSetting(s.DB, settingSecretStoreToken)
+	if err != nil {
+		return nil, err
+	}
+	return secretstore.New(kind, u, token), nil
+}
+
+// profileSecrets is the Secrets a profile's config template sees: the
+// configured store, limited to the profile's secret paths, or nil if no
+// store is configured.
+func (s *Server) profileSecrets(ctx context.Context, prof *db.Profile) (*profile.Secrets, error) {
+	c, err := s.secretStoreClient()
+	if err != nil || c == nil {
+		return nil, err
+	}
+	paths, err := profile.ParseSecretPaths(prof.SecretPaths)
+	if err != nil {
+		return nil, err
+	}
+	return profile.NewSecrets(paths, func(path string) (map[string]string, error) {
+		return c.Get(ctx, path)
+	}), nil
+}
+
+func (s *Server) secretStoreForm() (secretStoreForm, error) {
+	var f secretStoreForm
+	var err error
+	if f.Kind, err = db.GetSetting(s.DB, settingSecretStoreKind); err != nil {
+		return f, err
+	}
+	if f.URL, err = db.GetSetting(s.DB, settingSecretStoreURL); err != nil {
+		return f, err
+	}
+	token, err := db.GetSetting(s.DB, settingSecretStoreToken)
+	f.HasToken = token != ""
+	return f, err
+}
+
+func (s *Server) renderSecretStore(w http.ResponseWriter, saved bool) {
+	f, err := s.secretStoreForm()
+	if err != nil {
+		log.Printf("http: get secret store settings: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]any{
+		"SecretStore": f,
+		"Saved":       saved,
+	}
+	if err := s.Templates.ExecuteTemplate(w, "secret_store_settings", data); err != nil {
+		log.Printf("http: render secret_store_settings: %v", err)
+	}
+}
+
+func (s *Server) handleSetSecretStore(w http.ResponseWriter, r *http.Request) {
+	kind := r.FormValue("kind")
+	rawURL := strings.TrimSpace(r.FormValue("url"))
+	token := strings.TrimSpace(r.FormValue("token"))
+	if kind != secretstore.KindVault && kind != secretstore.KindHTTP {
+		http.Error(w, "Secret store must be vault or http", http.StatusBadRequest)
+		return
+	}
+	if rawURL != "" {
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, "Secret store URL must be an http or https URL", http.StatusBadRequest)
+			return
+		}
+	}
+
+	values := map[string]string{
+		settingSecretStoreKind: kind,
+		settingSecretStoreURL:  rawURL,
+	}
+	// A blank token keeps the saved one; clearing the URL drops it too.
+	if token != "" || rawURL == "" {
+		values[settingSecretStoreToken] = token
+	}
+	if rawURL == "" {
+		values[settingSecretStoreKind] = ""
+	}
+	for key, val := range values {
+		var err error
+		if val == "" {
+			err = db.DeleteSetting(s.DB, key)
+		} else {
+			err = db.SetSetting(s.DB, key, val)
+		}
+		if err != nil {
+			log.Printf("http: set %s: %v", key, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	s.renderSecretStore(w, true)
+}
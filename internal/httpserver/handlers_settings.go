@@ -0,0 +1,431 @@
+package httpserver
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/justinpopa/duh/internal/catalog"
+	"github.com/justinpopa/duh/internal/db"
+)
+
+// runtimeSetting is an option kept in the settings table. Flags and
+// environment variables only seed it on first start; after that the saved
+// value wins and is changed from the setup page or the settings API.
+type runtimeSetting struct {
+	Key     string
+	Label   string
+	Help    string
+	Kind    string // "text", "url", "bool", "duration", "seconds", "rate", "size", "key", "template", "mirrors", "site_mirrors", "tls_version" or "ciphers"
+	Restart bool   // read once at startup
+}
+
+var runtimeSettings = []runtimeSetting{
+	{Key: "server_url", Label: "Server URL", Kind: "url",
+		Help: "Base URL iPXE scripts and installers fetch from. Worked out from each request when empty."},
+	{Key: "catalog_url", Label: "Catalog URL", Kind: "url",
+		Help: "Image catalog offered on the images page. Empty hides the catalog."},
+	{Key: "catalog_key", Label: "Catalog signing key", Kind: "key",
+		Help: "Ed25519 public key, base64 or PEM. When set, the catalog is only used if its detached signature at the catalog URL plus .sig verifies."},
+	{Key: "https_redirect", Label: "Redirect browsers to HTTPS", Kind: "bool",
+		Help: "iPXE clients and the boot chain stay on HTTP."},
+	{Key: "http_boot_only", Label: "Serve only the boot chain over HTTP", Kind: "bool",
+		Help: "Refuse everything else on the HTTP port, the API included, apart from browsers being redirected to HTTPS. iPXE, installers, the agent and health probes are still served."},
+	{Key: "tls_min_version", Label: "Minimum TLS version", Kind: "tls_version",
+		Help: "1.2 or 1.3. iPXE's HTTPS only speaks TLS 1.2, so 1.3 keeps it on HTTP."},
+	{Key: "tls_ciphers", Label: "TLS 1.2 cipher suites", Kind: "ciphers",
+		Help: "Suites allowed, by Go name, e.g. TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384. Empty allows Go's secure defaults. TLS 1.3 suites aren't configurable."},
+	{Key: "hsts", Label: "Send HSTS header", Kind: "bool",
+		Help: "Tell browsers to only ever reach this server over HTTPS, for a year."},
+	{Key: "hsts_preload", Label: "HSTS preload", Kind: "bool",
+		Help: "Ask for a two-year HSTS covering subdomains, with preload, as hstspreload.org requires. Hard to undo once listed."},
+	{Key: "signed_chain", Label: "Require signed chain tokens", Kind: "bool",
+		Help: "boot.ipxe rejects clients without a token from the proxy DHCP server."},
+	{Key: "vm_netboot", Label: "Network boot VMs on reimage", Kind: "bool",
+		Help: "Queueing a synced system also moves its VM to network boot."},
+	{Key: "unique_hostnames", Label: "Require unique hostnames", Kind: "bool",
+		Help: "Refuse to give a system a hostname another system has. Otherwise the Systems page warns and asks first."},
+	{Key: "agent_interval", Label: "Agent heartbeat interval", Kind: "duration",
+		Help: "How often duh-agent is told to send heartbeats."},
+	{Key: "heartbeat_timeout", Label: "Heartbeat timeout", Kind: "duration",
+		Help: "How long after its last heartbeat a host is shown as down."},
+	{Key: "provision_slo", Label: "Provision time objective", Kind: "duration",
+		Help: "Reports and metrics count attempts that take longer from queued to ready."},
+	{Key: "image_rate_limit", Label: "Image bandwidth limit", Kind: "rate",
+		Help: "Cap on all image downloads together, in bits per second such as 500M or 1G. Empty is unlimited."},
+	{Key: "image_client_rate_limit", Label: "Per-client image bandwidth limit", Kind: "rate",
+		Help: "Cap on the image downloads of any one client address. Empty is unlimited."},
+	{Key: "slow_client_rate", Label: "Slow client threshold", Kind: "rate",
+		Help: "Systems whose recent image downloads average less than this, such as 10M, are flagged as slow. Empty never flags them."},
+	{Key: "image_quota", Label: "Image disk quota", Kind: "size",
+		Help: "Most space images, uploads and build artifacts may take up, such as 200G or 2T. Pulls and uploads that would go over it are refused. Empty is unlimited."},
+	{Key: "profile_quota", Label: "Profile overlay disk quota", Kind: "size",
+		Help: "Most space profile overlays and driver packs may take up. Uploads that would go over it are refused. Empty is unlimited."},
+	{Key: "log_quota", Label: "Log disk quota", Kind: "size",
+		Help: "Most space crash logs and other files uploaded over TFTP may take up. Uploads stop at it. Empty is unlimited."},
+	{Key: "backup_quota", Label: "Backup disk quota", Kind: "size",
+		Help: "Most space database backups may take up. The oldest are removed at startup to stay under it, always keeping the newest. Empty is unlimited."},
+	{Key: "package_quota", Label: "Package cache disk quota", Kind: "size",
+		Help: "Most space the package mirror cache may take up. Past it, packages are passed through from upstream without being cached. Empty is unlimited."},
+	{Key: "package_mirrors", Label: "Package mirrors", Kind: "mirrors",
+		Help: "Upstream repositories cached for installers at /mirror/<name>, as name=URL pairs separated by spaces, e.g. debian=http://deb.debian.org/debian rhel=https://dl.rockylinux.org/pub/rocky. A mirror named after a profile's OS family is its {{.MirrorURL}}. Empty turns the mirror off."},
+	{Key: "site_mirrors", Label: "Site mirrors", Kind: "site_mirrors",
+		Help: "Repositories local to a site, as site/name=URL pairs separated by spaces, e.g. ams/debian=http://mirror.ams.example/debian. Systems on a subnet at that site get them as {{.Mirrors}} and {{.MirrorURL}} in place of duh's own mirror of the same name."},
+	{Key: "package_offline", Label: "Serve packages from cache only", Kind: "bool",
+		Help: "Never fetch from the upstreams, for air-gapped sites with a package cache copied into the data directory."},
+	{Key: "dns_check", Label: "Check systems' DNS", Kind: "bool",
+		Help: "Look up the reverse DNS of each system's IP and the addresses of its hostname in the background, and flag systems whose records don't match, e.g. stale ones after a reimage."},
+	{Key: "console_input", Label: "Console input", Kind: "bool",
+		Help: "Let the console page type into systems' serial-over-LAN and agent consoles. Otherwise consoles are view-only."},
+	{Key: "torrent", Label: "Torrent distribution", Kind: "bool",
+		Help: "Offer installers a torrent of each image file, with this server as tracker and web seed, through {{.TorrentURLs}} in profiles."},
+	{Key: "imgverify", Label: "Verify boot files in iPXE", Kind: "bool",
+		Help: "Boot scripts check kernels and initrds with imgverify before booting. Needs an iPXE built from the build kit, which trusts duh's signing root."},
+	{Key: "ipxe_bundle_key", Label: "iPXE bundle signing key", Kind: "key",
+		Help: "Ed25519 public key, base64 or PEM, that iPXE update bundles must be signed with. Bundles can't be installed until it is set."},
+	{Key: "exit_message", Label: "Message for machines not booted", Kind: "template",
+		Help: "Shown on the console of a machine duh won't boot, e.g. Waiting for provisioning: {{.Reason}}. May use .MAC, .Hostname, .State and .Reason. Empty shows nothing."},
+	{Key: "exit_wait", Label: "Message display time", Kind: "seconds",
+		Help: "Seconds the message stays up before the machine moves on to its next boot device."},
+	{Key: "exit_ping_url", Label: "Exit phone-home URL", Kind: "url",
+		Help: "Fetched by a machine duh won't boot, with mac and reason added to the query, before it moves on."},
+	{Key: "proxy_dhcp", Label: "Proxy DHCP", Kind: "bool", Restart: true,
+		Help: "Answer PXE clients alongside the existing DHCP server."},
+	{Key: "dhcp_iface", Label: "Proxy DHCP interface", Kind: "text", Restart: true,
+		Help: "Detected from the default route when empty."},
+}
+
+func lookupRuntimeSetting(key string) (runtimeSetting, bool) {
+	for _, rs := range runtimeSettings {
+		if rs.Key == key {
+			return rs, true
+		}
+	}
+	return runtimeSetting{}, false
+}
+
+// normalize checks a value for the setting and returns it in the form it
+// is saved in.
+func (rs runtimeSetting) normalize(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	switch rs.Kind {
+	case "url":
+		if v == "" {
+			return "", nil
+		}
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", fmt.Errorf("%s must be an http or https URL", rs.Label)
+		}
+		return strings.TrimRight(v, "/"), nil
+	case "bool":
+		if v == "" {
+			return "false", nil
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return "", fmt.Errorf("%s must be true or false", rs.Label)
+		}
+		return strconv.FormatBool(b), nil
+	case "duration":
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return "", fmt.Errorf("%s must be a positive duration such as 30s or 5m", rs.Label)
+		}
+		return d.String(), nil
+	case "key":
+		if v == "" {
+			return "", nil
+		}
+		key, err := catalog.ParsePublicKey(v)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", rs.Label, err)
+		}
+		return base64.StdEncoding.EncodeToString(key), nil
+	case "seconds":
+		if v == "" {
+			return "0", nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("%s must be a whole number of seconds", rs.Label)
+		}
+		return strconv.Itoa(n), nil
+	case "template":
+		if _, err := template.New(rs.Key).Parse(v); err != nil {
+			return "", fmt.Errorf("%s: %v", rs.Label, err)
+		}
+		return v, nil
+	case "rate":
+		if _, err := parseRate(v); err != nil {
+			return "", fmt.Errorf("%s must be a rate in bits per second such as 100M or 1G", rs.Label)
+		}
+		if v == "0" {
+			return "", nil
+		}
+		return strings.ToUpper(v), nil
+	case "mirrors":
+		mirrors, err := parseMirrors(v)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", rs.Label, err)
+		}
+		pairs := make([]string, len(mirrors))
+		for i, m := range mirrors {
+			pairs[i] = m.Name + "=" + m.Upstream
+		}
+		return strings.Join(pairs, " "), nil
+	case "site_mirrors":
+		mirrors, err := parseSiteMirrors(v)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", rs.Label, err)
+		}
+		pairs := make([]string, len(mirrors))
+		for i, m := range mirrors {
+			pairs[i] = m.Site + "/" + m.Name + "=" + m.Upstream
+		}
+		return strings.Join(pairs, " "), nil
+	case "tls_version":
+		if v == "" {
+			return "1.2", nil
+		}
+		if v != "1.2" && v != "1.3" {
+			return "", fmt.Errorf("%s must be 1.2 or 1.3", rs.Label)
+		}
+		return v, nil
+	case "ciphers":
+		ids, err := parseCipherSuites(v)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", rs.Label, err)
+		}
+		names := make([]string, len(ids))
+		for i, id := range ids {
+			names[i] = tls.CipherSuiteName(id)
+		}
+		return strings.Join(names, ","), nil
+	case "size":
+		if _, err := parseSize(v); err != nil {
+			return "", fmt.Errorf("%s must be a size such as 500M, 200G or 2T", rs.Label)
+		}
+		if v == "0" {
+			return "", nil
+		}
+		return strings.ToUpper(v), nil
+	}
+	return v, nil
+}
+
+// LoadSettings seeds the settings table with defaults, normally taken from
+// flags, for options that were never saved, then loads the saved values.
+// Options marked Restart keep their saved value for this run.
+func (s *Server) LoadSettings(defaults map[string]string) error {
+	s.settingsMu.Lock()
+	defer s.settingsMu.Unlock()
+	for k, v := range defaults {
+		s.settings[k] = v
+	}
+	for _, rs := range runtimeSettings {
+		saved, ok, err := db.LookupSetting(s.DB, "runtime_"+rs.Key)
+		if err != nil {
+			return fmt.Errorf("get %s: %w", rs.Key, err)
+		}
+		def, _ := rs.normalize(s.settings[rs.Key])
+		if !ok {
+			if err := db.SetSetting(s.DB, "runtime_"+rs.Key, def); err != nil {
+				return fmt.Errorf("seed %s: %w", rs.Key, err)
+			}
+			s.settings[rs.Key] = def
+			continue
+		}
+		if saved != def {
+			log.Printf("settings: using saved %s %q; flags and environment only set the initial value", rs.Key, saved)
+		}
+		s.settings[rs.Key] = saved
+	}
+	return nil
+}
+
+// Setting returns the value in effect for a runtime setting.
+func (s *Server) Setting(key string) string {
+	s.settingsMu.RLock()
+	defer s.settingsMu.RUnlock()
+	return s.settings[key]
+}
+
+// SettingBool returns a boolean runtime setting.
+func (s *Server) SettingBool(key string) bool {
+	b, _ := strconv.ParseBool(s.Setting(key))
+	return b
+}
+
+func (s *Server) settingDuration(key string) time.Duration {
+	d, _ := time.ParseDuration(s.Setting(key))
+	return d
+}
+
+// settingRate returns a rate setting in bytes per second, zero when
+// unlimited.
+func (s *Server) settingRate(key string) float64 {
+	r, _ := parseRate(s.Setting(key))
+	return r
+}
+
+func (s *Server) serverURL() string  { return s.Setting("server_url") }
+func (s *Server) catalogURL() string { return s.Setting("catalog_url") }
+
+// catalogKey returns the key catalogs must be signed with, or nil if
+// signatures aren't checked.
+func (s *Server) catalogKey() ed25519.PublicKey {
+	key, _ := catalog.ParsePublicKey(s.Setting("catalog_key"))
+	return key
+}
+
+// bundleKey returns the key iPXE update bundles must be signed with, or
+// nil if none is set.
+func (s *Server) bundleKey() ed25519.PublicKey {
+	key, _ := catalog.ParsePublicKey(s.Setting("ipxe_bundle_key"))
+	return key
+}
+
+// HTTPSRedirect reports whether browsers are sent to HTTPS.
+func (s *Server) HTTPSRedirect() bool { return s.SettingBool("https_redirect") }
+
+// saveSettings validates and saves runtime settings, applying those that
+// don't need a restart. Nothing is saved if any value is invalid.
+func (s *Server) saveSettings(values map[string]string) error {
+	clean := make(map[string]string, len(values))
+	for k, v := range values {
+		rs, ok := lookupRuntimeSetting(k)
+		if !ok {
+			return fmt.Errorf("unknown setting %q", k)
+		}
+		v, err := rs.normalize(v)
+		if err != nil {
+			return err
+		}
+		clean[k] = v
+	}
+	s.settingsMu.Lock()
+	defer s.settingsMu.Unlock()
+	for k, v := range clean {
+		if err := db.SetSetting(s.DB, "runtime_"+k, v); err != nil {
+			return fmt.Errorf("set %s: %w", k, err)
+		}
+		if rs, _ := lookupRuntimeSetting(k); !rs.Restart {
+			s.settings[k] = v
+		}
+	}
+	return nil
+}
+
+// settingView is a runtime setting as shown on the setup page and by the
+// API. Value is the saved value; Pending is set when it differs from the
+// one in effect until a restart.
+type settingView struct {
+	runtimeSetting
+	Value   string
+	Pending bool
+}
+
+func (s *Server) settingViews() ([]settingView, error) {
+	views := make([]settingView, len(runtimeSettings))
+	for i, rs := range runtimeSettings {
+		saved, err := db.GetSetting(s.DB, "runtime_"+rs.Key)
+		if err != nil {
+			return nil, fmt.Errorf("get %s: %w", rs.Key, err)
+		}
+		views[i] = settingView{runtimeSetting: rs, Value: saved}
+		if rs.Restart {
+			views[i].Pending = saved != s.Setting(rs.Key)
+		}
+	}
+	return views, nil
+}
+
+func (s *Server) renderSettings(w http.ResponseWriter, saved bool) {
+	views, err := s.settingViews()
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]any{
+		"Settings": views,
+		"Saved":    saved,
+	}
+	if err := s.Templates.ExecuteTemplate(w, "runtime_settings", data); err != nil {
+		log.Printf("http: render runtime_settings: %v", err)
+	}
+}
+
+func (s *Server) handleSetSettings(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	// The form posts every setting; unchecked boxes are simply absent.
+	values := make(map[string]string, len(runtimeSettings))
+	for _, rs := range runtimeSettings {
+		values[rs.Key] = r.PostForm.Get(rs.Key)
+	}
+	if err := s.saveSettings(values); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.renderSettings(w, true)
+}
+
+func (s *Server) writeSettingsJSON(w http.ResponseWriter) {
+	views, err := s.settingViews()
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	out := make([]map[string]any, len(views))
+	for i, v := range views {
+		out[i] = map[string]any{
+			"key":     v.Key,
+			"value":   v.Value,
+			"kind":    v.Kind,
+			"restart": v.Restart,
+			"pending": v.Pending,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"settings": out})
+}
+
+func (s *Server) handleAPISettings(w http.ResponseWriter, r *http.Request) {
+	s.writeSettingsJSON(w)
+}
+
+// handleAPIUpdateSettings takes a JSON object of the settings to change,
+// e.g. {"server_url": "https://duh.example.com", "signed_chain": true}.
+func (s *Server) handleAPIUpdateSettings(w http.ResponseWriter, r *http.Request) {
+	var body map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	values := make(map[string]string, len(body))
+	for k, v := range body {
+		if v == nil {
+			v = ""
+		}
+		values[k] = fmt.Sprint(v)
+	}
+	if err := s.saveSettings(values); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.writeSettingsJSON(w)
+}
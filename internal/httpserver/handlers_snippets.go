@@ -0,0 +1,182 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/listing"
+	"github.com/justinpopa/duh/internal/profile"
+)
+
+// snippets returns the snippets library for rendering templates.
+func (s *Server) snippets() (profile.Snippets, error) {
+	return db.SnippetContents(s.DB)
+}
+
+// checkIncludes refuses a profile whose config template or kernel
+// parameters include a snippet the library doesn't have.
+func checkIncludes(configTemplate, kernelParams string, snippets profile.Snippets) error {
+	if err := profile.CheckIncludes(configTemplate, snippets); err != nil {
+		return err
+	}
+	return profile.CheckIncludes(kernelParams, snippets)
+}
+
+// snippetUsers maps each snippet's name to the profiles whose templates
+// include it, directly or through another snippet.
+func snippetUsers(profiles []db.Profile, snippets profile.Snippets) map[string][]string {
+	users := map[string][]string{}
+	for _, p := range profiles {
+		used := append(profile.UsedSnippets(p.ConfigTemplate, snippets), profile.UsedSnippets(p.KernelParams, snippets)...)
+		slices.Sort(used)
+		for _, name := range slices.Compact(used) {
+			users[name] = append(users[name], p.Name)
+		}
+	}
+	return users
+}
+
+// snippetsData adds the snippets library to page data.
+func (s *Server) snippetsData(data map[string]any) error {
+	list, err := db.ListSnippets(s.DB)
+	if err != nil {
+		return err
+	}
+	profiles, err := db.ListProfiles(s.DB)
+	if err != nil {
+		return err
+	}
+	snippets := make(profile.Snippets, len(list))
+	for _, sn := range list {
+		snippets[sn.Name] = sn.Content
+	}
+	data["Snippets"] = list
+	data["SnippetProfiles"] = snippetUsers(profiles, snippets)
+	return nil
+}
+
+func (s *Server) renderSnippetsList(w http.ResponseWriter) {
+	data := map[string]any{}
+	if err := s.snippetsData(data); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.Templates.ExecuteTemplate(w, "snippets_list", data); err != nil {
+		log.Printf("http: render snippets list: %v", err)
+	}
+}
+
+func (s *Server) handleCreateSnippet(w http.ResponseWriter, r *http.Request) {
+	name := strings.ToLower(strings.TrimSpace(r.FormValue("name")))
+	content := r.FormValue("content")
+	if err := profile.CheckSnippet(name, content); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := db.CreateSnippet(s.DB, name, strings.TrimSpace(r.FormValue("description")), content); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Failed to create snippet: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.renderSnippetsList(w)
+}
+
+func (s *Server) handleUpdateSnippet(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	sn, err := db.GetSnippet(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if sn == nil {
+		http.Error(w, "Snippet not found", http.StatusNotFound)
+		return
+	}
+	content := r.FormValue("content")
+	if err := profile.CheckSnippet(sn.Name, content); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := db.UpdateSnippet(s.DB, id, strings.TrimSpace(r.FormValue("description")), content); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderSnippetsList(w)
+}
+
+// handleDeleteSnippet deletes a snippet no profile includes. One still in
+// use would break their configs, so it is refused with 409 naming them.
+func (s *Server) handleDeleteSnippet(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	sn, err := db.GetSnippet(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if sn == nil {
+		http.Error(w, "Snippet not found", http.StatusNotFound)
+		return
+	}
+	data := map[string]any{}
+	if err := s.snippetsData(data); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if users := data["SnippetProfiles"].(map[string][]string)[sn.Name]; len(users) > 0 {
+		http.Error(w, sn.Name+" is included by "+strings.Join(users, ", "), http.StatusConflict)
+		return
+	}
+	if err := db.DeleteSnippet(s.DB, id); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderSnippetsList(w)
+}
+
+func (s *Server) handleAPISnippets(w http.ResponseWriter, r *http.Request) {
+	data := map[string]any{}
+	if err := s.snippetsData(data); err != nil {
+		log.Printf("http: list snippets: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	list := data["Snippets"].([]db.Snippet)
+	users := data["SnippetProfiles"].(map[string][]string)
+	rows := make([]map[string]any, len(list))
+	for i, sn := range list {
+		rows[i] = map[string]any{
+			"id":          sn.ID,
+			"name":        sn.Name,
+			"description": sn.Description,
+			"content":     sn.Content,
+			"profiles":    append([]string{}, users[sn.Name]...),
+			"created_at":  sn.CreatedAt,
+			"updated_at":  sn.UpdatedAt,
+		}
+	}
+	page, ok := listPage(w, r, rows, listing.Spec{Sort: "name", Key: []string{"id"}})
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"snippets": page.Rows, "next_cursor": page.Next})
+}
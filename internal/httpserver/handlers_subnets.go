@@ -0,0 +1,279 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/listing"
+)
+
+// subnetPurposes are offered as purpose labels on the Networks page; any
+// other label can be typed in.
+var subnetPurposes = []string{"provisioning", "management", "oob", "storage", "public"}
+
+// subnetFor returns the subnet ip is on, or nil.
+func (s *Server) subnetFor(ip string) *db.Subnet {
+	if ip == "" {
+		return nil
+	}
+	subnets, err := db.ListSubnets(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+		return nil
+	}
+	return db.SubnetFor(subnets, ip)
+}
+
+// siteFor is the site of the subnet ip is on, or "".
+func (s *Server) siteFor(ip string) string {
+	if sub := s.subnetFor(ip); sub != nil {
+		return sub.Site
+	}
+	return ""
+}
+
+// subnetName is the label of the subnet ip is on for templates, or "".
+func (s *Server) subnetName(ip string) string {
+	if sub := s.subnetFor(ip); sub != nil {
+		return sub.Label()
+	}
+	return ""
+}
+
+// subnetView is a subnet with the names of its defaults and how many
+// systems are on it, for display.
+type subnetView struct {
+	db.Subnet
+	ImageName   string
+	ProfileName string
+	Systems     int
+}
+
+func (s *Server) subnetsData() (map[string]any, error) {
+	subnets, err := db.ListSubnets(s.DB)
+	if err != nil {
+		return nil, err
+	}
+	systems, err := db.ListSystems(s.DB)
+	if err != nil {
+		return nil, err
+	}
+	images, err := db.ListImages(s.DB)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := db.ListProfiles(s.DB)
+	if err != nil {
+		return nil, err
+	}
+	imageNames := map[int64]string{}
+	for _, img := range images {
+		imageNames[img.ID] = img.Name
+	}
+	profileNames := map[int64]string{}
+	for _, p := range profiles {
+		profileNames[p.ID] = p.Name
+	}
+	counts := map[int64]int{}
+	unplaced := 0
+	for _, sys := range systems {
+		if sub := db.SubnetFor(subnets, sys.IPAddr); sub != nil {
+			counts[sub.ID]++
+		} else {
+			unplaced++
+		}
+	}
+	views := make([]subnetView, len(subnets))
+	var sites []string
+	for i, sub := range subnets {
+		if sub.Site != "" && !slices.Contains(sites, sub.Site) {
+			sites = append(sites, sub.Site)
+		}
+		views[i] = subnetView{Subnet: sub, Systems: counts[sub.ID]}
+		if sub.ImageID != nil {
+			views[i].ImageName = imageNames[*sub.ImageID]
+		}
+		if sub.ProfileID != nil {
+			views[i].ProfileName = profileNames[*sub.ProfileID]
+		}
+	}
+	return map[string]any{
+		"Subnets":  views,
+		"Unplaced": unplaced,
+		"Images":   images,
+		"Profiles": profiles,
+		"Purposes": subnetPurposes,
+		"Sites":    sites,
+	}, nil
+}
+
+func (s *Server) handleNetworksPage(w http.ResponseWriter, r *http.Request) {
+	data, err := s.subnetsData()
+	if err != nil {
+		log.Printf("http: list subnets: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	hash, _ := s.getAuthState()
+	data["AuthEnabled"] = hash != ""
+	s.addThemeData(r, data)
+	if err := s.Templates.ExecuteTemplate(w, "networks", data); err != nil {
+		log.Printf("http: render networks: %v", err)
+	}
+}
+
+func (s *Server) renderSubnetsList(w http.ResponseWriter) {
+	data, err := s.subnetsData()
+	if err != nil {
+		log.Printf("http: list subnets: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.Templates.ExecuteTemplate(w, "subnets_list", data); err != nil {
+		log.Printf("http: render subnets_list: %v", err)
+	}
+}
+
+// subnetFromForm reads a subnet's fields from a form. Their values are
+// checked when the subnet is saved.
+func subnetFromForm(r *http.Request) (*db.Subnet, error) {
+	sub := &db.Subnet{
+		CIDR:        r.FormValue("cidr"),
+		Name:        r.FormValue("name"),
+		Description: r.FormValue("description"),
+		Purpose:     r.FormValue("purpose"),
+		Site:        r.FormValue("site"),
+		DHCP:        r.FormValue("dhcp"),
+		Relay:       r.FormValue("relay"),
+		Boot:        r.FormValue("boot"),
+	}
+	if v := strings.TrimSpace(r.FormValue("vlan")); v != "" {
+		vlan, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		sub.VLAN = vlan
+	}
+	var err error
+	if sub.ImageID, err = optionalID(r.FormValue("image_id")); err != nil {
+		return nil, err
+	}
+	if sub.ProfileID, err = optionalID(r.FormValue("profile_id")); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (s *Server) handleCreateSubnet(w http.ResponseWriter, r *http.Request) {
+	sub, err := subnetFromForm(r)
+	if err != nil {
+		http.Error(w, "Invalid subnet: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := db.CreateSubnet(s.DB, sub); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Failed to create subnet: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.renderSubnetsList(w)
+}
+
+func (s *Server) handleUpdateSubnet(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	existing, err := db.GetSubnet(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if existing == nil {
+		http.Error(w, "Subnet not found", http.StatusNotFound)
+		return
+	}
+	sub, err := subnetFromForm(r)
+	if err != nil {
+		http.Error(w, "Invalid subnet: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	sub.ID = id
+	if err := db.UpdateSubnet(s.DB, sub); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Failed to save subnet: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.renderSubnetsList(w)
+}
+
+func (s *Server) handleDeleteSubnet(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if err := db.DeleteSubnet(s.DB, id); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderSubnetsList(w)
+}
+
+func (s *Server) handleAPISubnets(w http.ResponseWriter, r *http.Request) {
+	data, err := s.subnetsData()
+	if err != nil {
+		log.Printf("http: list subnets: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	views := data["Subnets"].([]subnetView)
+	rows := make([]map[string]any, len(views))
+	for i, v := range views {
+		rows[i] = map[string]any{
+			"id":          v.ID,
+			"cidr":        v.CIDR,
+			"name":        v.Name,
+			"description": v.Description,
+			"purpose":     v.Purpose,
+			"site":        v.Site,
+			"vlan":        v.VLAN,
+			"dhcp":        v.DHCP,
+			"relay":       v.Relay,
+			"boot":        v.Boot,
+			"image_id":    v.ImageID,
+			"profile_id":  v.ProfileID,
+			"systems":     v.Systems,
+		}
+	}
+	page, ok := listPage(w, r, rows, listing.Spec{Sort: "cidr", Key: []string{"id"}})
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"subnets": page.Rows, "next_cursor": page.Next, "unplaced": data["Unplaced"]})
+}
+
+// filterBySubnet keeps the systems on the subnet named by a Systems page
+// subnet filter: a subnet ID, or "none" for systems on no subnet. An empty
+// filter keeps them all.
+func filterBySubnet(systems []db.System, subnets []db.Subnet, filter string) []db.System {
+	if filter == "" {
+		return systems
+	}
+	var out []db.System
+	for _, sys := range systems {
+		sub := db.SubnetFor(subnets, sys.IPAddr)
+		if (filter == "none" && sub == nil) || (sub != nil && strconv.FormatInt(sub.ID, 10) == filter) {
+			out = append(out, sys)
+		}
+	}
+	return out
+}
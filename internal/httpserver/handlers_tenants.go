@@ -0,0 +1,408 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/proxydhcp"
+	"github.com/justinpopa/duh/internal/safenet"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type tenantKey struct{}
+
+func withTenant(r *http.Request, t *db.Tenant) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tenantKey{}, t))
+}
+
+// requestTenant returns the tenant a request is made as, or nil for the
+// admin.
+func requestTenant(r *http.Request) *db.Tenant {
+	t, _ := r.Context().Value(tenantKey{}).(*db.Tenant)
+	return t
+}
+
+// requestTenantID returns the ID of the tenant a request is made as, or 0
+// for the admin.
+func requestTenantID(r *http.Request) int64 {
+	if t := requestTenant(r); t != nil {
+		return t.ID
+	}
+	return 0
+}
+
+func (s *Server) userTenant(userID int64) (*db.Tenant, error) {
+	u, err := db.GetTenantUser(s.DB, userID)
+	if err != nil || u == nil {
+		return nil, err
+	}
+	return db.GetTenant(s.DB, u.TenantID)
+}
+
+// checkTenantURL refuses a URL a tenant gives the server to fetch or call
+// if it points at a loopback, link-local or private address, so tenants
+// can't use the server to reach its own network.
+func checkTenantURL(r *http.Request, rawURL string) error {
+	if requestTenant(r) == nil || rawURL == "" {
+		return nil
+	}
+	return safenet.CheckURL(r.Context(), rawURL)
+}
+
+// adminOnly refuses tenant users and tokens.
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requestTenant(r) != nil {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// tenantOwned lets tenants use a route only on the system, image or
+// profile it names by {id} if it is theirs. Shared images and profiles can
+// be read but not changed. Any other {id} is refused, unless its handler
+// checks it itself.
+func (s *Server) tenantOwned(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := requestTenant(r)
+		_, route, _ := strings.Cut(r.Pattern, " ")
+		if t == nil || !strings.Contains(route, "{id}") {
+			next(w, r)
+			return
+		}
+		var kind string
+		switch {
+		case strings.Contains(route, "/systems/{id}"):
+			kind = "system"
+		case strings.Contains(route, "/images/{id}"):
+			kind = "image"
+		case strings.Contains(route, "/profiles/{id}"):
+			kind = "profile"
+		case route == "/upload-progress/{id}":
+			// handleUploadProgress checks the upload is the tenant's.
+			next(w, r)
+			return
+		default:
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		owner, found, err := db.TenantOwner(s.DB, kind, id)
+		if err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		shared := kind != "system" && owner == 0
+		if !found || (owner != t.ID && !shared) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		if owner != t.ID && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Shared "+kind+"s can only be changed by the admin", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// visibleTo reports whether something owned by tenant owner shows to the
+// caller. Shared images and profiles, owned by no tenant, show to all.
+func visibleTo(r *http.Request, owner int64, shared bool) bool {
+	t := requestTenant(r)
+	return t == nil || owner == t.ID || (shared && owner == 0)
+}
+
+// canUse reports whether the caller may point a system at an image or
+// profile.
+func (s *Server) canUse(r *http.Request, kind string, id int64) (bool, error) {
+	if requestTenant(r) == nil {
+		return true, nil
+	}
+	owner, found, err := db.TenantOwner(s.DB, kind, id)
+	if err != nil || !found {
+		return false, err
+	}
+	return visibleTo(r, owner, true), nil
+}
+
+// formTenant returns the tenant something the caller creates belongs to.
+// Tenants always create in their own; the admin picks one by ID, "" or 0
+// meaning none.
+func (s *Server) formTenant(r *http.Request, value string) (int64, error) {
+	if t := requestTenant(r); t != nil {
+		return t.ID, nil
+	}
+	value = strings.TrimSpace(value)
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid tenant %q", value)
+	}
+	t, err := db.GetTenant(s.DB, id)
+	if err != nil {
+		return 0, err
+	}
+	if t == nil {
+		return 0, fmt.Errorf("unknown tenant %d", id)
+	}
+	return id, nil
+}
+
+// addTenantData adds the caller's tenant name, "" for the admin, and for
+// the admin, the tenants to choose from.
+func (s *Server) addTenantData(r *http.Request, data map[string]any) {
+	if t := requestTenant(r); t != nil {
+		data["Tenant"] = t.Name
+		return
+	}
+	tenants, err := db.ListTenants(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+	}
+	data["Tenants"] = tenants
+}
+
+// tenantName is the name of a tenant for templates, or "" for none.
+func (s *Server) tenantName(id int64) string {
+	if id == 0 {
+		return ""
+	}
+	t, err := db.GetTenant(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		return ""
+	}
+	if t == nil {
+		return ""
+	}
+	return t.Name
+}
+
+// TenantSubnets returns the subnets the proxy DHCP server may answer mac
+// on: those of the tenant its system belongs to, if the tenant set any.
+func (s *Server) TenantSubnets(mac string) []*net.IPNet {
+	sys, err := db.GetSystemByMAC(s.DB, mac)
+	if err != nil {
+		log.Printf("http: get system by mac: %v", err)
+		return nil
+	}
+	if sys == nil || sys.TenantID == 0 {
+		return nil
+	}
+	t, err := db.GetTenant(s.DB, sys.TenantID)
+	if err != nil {
+		log.Printf("http: %v", err)
+		return nil
+	}
+	if t == nil {
+		return nil
+	}
+	nets, err := proxydhcp.ParseSubnets(t.Subnets)
+	if err != nil {
+		// Saved subnets are validated; see DHCPPolicy.
+		log.Printf("http: tenant %s subnets: %v", t.Name, err)
+		return nil
+	}
+	return nets
+}
+
+type tenantView struct {
+	db.Tenant
+	Users  []db.TenantUser
+	Tokens []db.APIToken
+}
+
+func (s *Server) tenantSettings() ([]db.Tenant, []db.TenantUser, []db.APIToken, error) {
+	tenants, err := db.ListTenants(s.DB)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	users, err := db.ListTenantUsers(s.DB)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	tokens, err := db.ListAPITokens(s.DB)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return tenants, users, tokens, nil
+}
+
+// renderTenants renders the tenant settings card. newToken, if set, is a
+// token just issued, shown this once.
+func (s *Server) renderTenants(w http.ResponseWriter, newToken string) {
+	tenants, users, tokens, err := s.tenantSettings()
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.Templates.ExecuteTemplate(w, "tenant_settings", map[string]any{
+		"Tenants":     tenantViews(tenants, users, tokens),
+		"NewToken":    newToken,
+		"AuthEnabled": s.authEnabled(),
+	}); err != nil {
+		log.Printf("http: render tenant_settings: %v", err)
+	}
+}
+
+func tenantViews(tenants []db.Tenant, users []db.TenantUser, tokens []db.APIToken) []tenantView {
+	views := make([]tenantView, len(tenants))
+	byID := make(map[int64]*tenantView, len(tenants))
+	for i, t := range tenants {
+		views[i].Tenant = t
+		byID[t.ID] = &views[i]
+	}
+	for _, u := range users {
+		if v := byID[u.TenantID]; v != nil {
+			v.Users = append(v.Users, u)
+		}
+	}
+	for _, tok := range tokens {
+		if v := byID[tok.TenantID]; v != nil {
+			v.Tokens = append(v.Tokens, tok)
+		}
+	}
+	return views
+}
+
+func (s *Server) handleCreateTenant(w http.ResponseWriter, r *http.Request) {
+	subnets := strings.TrimSpace(r.FormValue("subnets"))
+	if _, err := proxydhcp.ParseSubnets(subnets); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := db.CreateTenant(s.DB, r.FormValue("name"), strings.TrimSpace(r.FormValue("description")), subnets); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Failed to create tenant: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.renderTenants(w, "")
+}
+
+func (s *Server) handleUpdateTenant(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	subnets := strings.TrimSpace(r.FormValue("subnets"))
+	if _, err := proxydhcp.ParseSubnets(subnets); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := db.UpdateTenant(s.DB, id, strings.TrimSpace(r.FormValue("description")), subnets); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderTenants(w, "")
+}
+
+func (s *Server) handleDeleteTenant(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	err = db.DeleteTenant(s.DB, id)
+	if errors.Is(err, db.ErrTenantInUse) {
+		http.Error(w, "Move or delete the tenant's systems, images and profiles first", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderTenants(w, "")
+}
+
+func (s *Server) handleCreateTenantUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	password := r.FormValue("password")
+	if password == "" {
+		http.Error(w, "Password cannot be empty", http.StatusBadRequest)
+		return
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("http: bcrypt hash: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := db.CreateTenantUser(s.DB, id, r.FormValue("username"), string(hashed)); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Failed to add user: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.renderTenants(w, "")
+}
+
+func (s *Server) handleDeleteTenantUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if err := db.DeleteTenantUser(s.DB, id); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderTenants(w, "")
+}
+
+func (s *Server) handleCreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	token, err := db.CreateAPIToken(s.DB, id, name)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Failed to create token: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.renderTenants(w, token)
+}
+
+func (s *Server) handleDeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if err := db.DeleteAPIToken(s.DB, id); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderTenants(w, "")
+}
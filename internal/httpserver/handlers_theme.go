@@ -0,0 +1,91 @@
+package httpserver
+
+import (
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/justinpopa/duh/internal/db"
+)
+
+// themes are the looks the UI offers. "system" follows the browser's
+// light or dark preference.
+var themes = []string{"system", "light", "dark", "high-contrast"}
+
+// themeCookieName remembers the theme in browsers with no signed-in user,
+// and on the login page.
+const themeCookieName = "duh_theme"
+
+// settingAdminTheme holds the admin's theme; tenant users keep theirs on
+// their user.
+const settingAdminTheme = "admin_theme"
+
+// requestTheme returns the theme for the caller: the signed-in user's
+// saved choice, else the browser's cookie, else "system".
+func (s *Server) requestTheme(r *http.Request) string {
+	theme := ""
+	if hash, key := s.getAuthState(); hash != "" {
+		if userID, ok := s.validateSession(r, key); ok {
+			var err error
+			if userID == 0 {
+				theme, err = db.GetSetting(s.DB, settingAdminTheme)
+			} else if u, uerr := db.GetTenantUser(s.DB, userID); uerr != nil {
+				err = uerr
+			} else if u != nil {
+				theme = u.Theme
+			}
+			if err != nil {
+				log.Printf("http: get theme: %v", err)
+			}
+		}
+	}
+	if theme == "" {
+		if c, err := r.Cookie(themeCookieName); err == nil {
+			theme = c.Value
+		}
+	}
+	if !slices.Contains(themes, theme) {
+		theme = "system"
+	}
+	return theme
+}
+
+// addThemeData adds the theme the page layout renders with.
+func (s *Server) addThemeData(r *http.Request, data map[string]any) {
+	data["Theme"] = s.requestTheme(r)
+	data["Themes"] = themes
+}
+
+// handleSetTheme saves the caller's theme: on their user when signed in,
+// and in a cookie so the login page matches.
+func (s *Server) handleSetTheme(w http.ResponseWriter, r *http.Request) {
+	theme := r.FormValue("theme")
+	if !slices.Contains(themes, theme) {
+		http.Error(w, "Unknown theme", http.StatusBadRequest)
+		return
+	}
+	if hash, key := s.getAuthState(); hash != "" {
+		if userID, ok := s.validateSession(r, key); ok {
+			var err error
+			if userID == 0 {
+				err = db.SetSetting(s.DB, settingAdminTheme, theme)
+			} else {
+				err = db.UpdateTenantUserTheme(s.DB, userID, theme)
+			}
+			if err != nil {
+				log.Printf("http: set theme: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     themeCookieName,
+		Value:    theme,
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,147 @@
+package httpserver
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/torrent"
+)
+
+// torrentCache remembers hashed torrents until the file's size or mtime
+// changes, like checksumCache. Hashing a large rootfs takes a while, so
+// concurrent requests for the same file wait for one hash.
+type torrentCache struct {
+	mu      sync.Mutex
+	infos   map[string]cachedTorrent
+	hashing map[string]*sync.WaitGroup
+}
+
+type cachedTorrent struct {
+	size    int64
+	modTime time.Time
+	info    *torrent.Info
+}
+
+func (c *torrentCache) info(path string, st fs.FileInfo) (*torrent.Info, error) {
+	for {
+		c.mu.Lock()
+		cached, ok := c.infos[path]
+		if ok && cached.size == st.Size() && cached.modTime.Equal(st.ModTime()) {
+			c.mu.Unlock()
+			return cached.info, nil
+		}
+		if wg := c.hashing[path]; wg != nil {
+			c.mu.Unlock()
+			wg.Wait()
+			continue
+		}
+		if c.hashing == nil {
+			c.infos = make(map[string]cachedTorrent)
+			c.hashing = make(map[string]*sync.WaitGroup)
+		}
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		c.hashing[path] = wg
+		c.mu.Unlock()
+
+		info, err := torrent.HashFile(path, filepath.Base(path))
+		c.mu.Lock()
+		if err == nil {
+			c.infos[path] = cachedTorrent{size: st.Size(), modTime: st.ModTime(), info: info}
+		}
+		delete(c.hashing, path)
+		c.mu.Unlock()
+		wg.Done()
+		return info, err
+	}
+}
+
+// imageTorrentURLs signs a metafile URL for each of an image's extra files,
+// keyed by role like FileURLs. It is nil unless torrent distribution is on.
+func (s *Server) imageTorrentURLs(serverURL string, sys *db.System, img *db.Image) map[string]string {
+	if !s.SettingBool("torrent") {
+		return nil
+	}
+	files := resolveImageFiles(img)
+	urls := make(map[string]string, len(files.Extra))
+	for role, name := range files.Extra {
+		urls[role] = s.signURL(tokenPurposeImage, sys, fmt.Sprintf("%s/images/%d/torrent/%s", serverURL, img.ID, name))
+	}
+	return urls
+}
+
+// handleImageTorrent serves a metafile for an image file. duh's own file
+// URL, signed for the same system, is its web seed.
+func (s *Server) handleImageTorrent(w http.ResponseWriter, r *http.Request) {
+	if !s.SettingBool("torrent") {
+		http.NotFound(w, r)
+		return
+	}
+	bound, ok := s.validateToken(r, tokenPurposeImage)
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if bound != nil && !s.imageBound(bound, id) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	name := filepath.Base(r.PathValue("name"))
+	if name == "." || name == ".." {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	path := filepath.Join(s.DataDir, "images", fmt.Sprintf("%d", id), name)
+	st, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("http: stat %s: %v", name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	info, err := s.torrents.info(path, st)
+	if err != nil {
+		log.Printf("http: hash torrent %s: %v", name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.tracker.Allow(info.Hash())
+
+	serverURL := s.serverURL()
+	if serverURL == "" {
+		serverURL = "http://" + r.Host
+	}
+	seed := fmt.Sprintf("%s/images/%d/file/%s", serverURL, id, name)
+	if bound != nil {
+		seed = s.signURL(tokenPurposeImage, bound, fmt.Sprintf("%s/images/%d/file/%s", s.fileServerURL(serverURL, bound), id, name))
+	}
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".torrent"))
+	w.Write(torrent.Metafile(info, serverURL+"/announce", []string{seed}))
+}
+
+// handleAnnounce is the tracker for the metafiles above.
+func (s *Server) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	if !s.SettingBool("torrent") {
+		http.NotFound(w, r)
+		return
+	}
+	s.tracker.ServeHTTP(w, r)
+}
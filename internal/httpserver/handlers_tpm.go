@@ -0,0 +1,303 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/attest"
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/profile"
+)
+
+// Settings for TPM attestation.
+const (
+	settingTPMRoots    = "tpm_ek_roots"            // PEM manufacturer CAs EK certificates are checked against
+	settingTPMRequired = "tpm_require_attestation" // "1" to withhold secrets from systems that haven't passed
+)
+
+// maxTPMEnrollment bounds an enrollment's body; EK certificates are a few
+// KiB.
+const maxTPMEnrollment = 64 << 10
+
+// errNotAttested wraps why a system is refused secrets while attestation
+// is required.
+var errNotAttested = errors.New("TPM attestation required")
+
+type tpmForm struct {
+	Roots     string
+	RootCount int
+	Required  bool
+}
+
+func (s *Server) tpmForm() (tpmForm, error) {
+	var f tpmForm
+	var err error
+	if f.Roots, err = db.GetSetting(s.DB, settingTPMRoots); err != nil {
+		return f, err
+	}
+	if _, f.RootCount, err = attest.ParseRoots(f.Roots); err != nil {
+		return f, err
+	}
+	required, err := db.GetSetting(s.DB, settingTPMRequired)
+	f.Required = required == "1"
+	return f, err
+}
+
+func (s *Server) renderTPM(w http.ResponseWriter, saved bool) {
+	f, err := s.tpmForm()
+	if err != nil {
+		log.Printf("http: get tpm settings: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]any{
+		"TPM":   f,
+		"Saved": saved,
+	}
+	if err := s.Templates.ExecuteTemplate(w, "tpm_settings", data); err != nil {
+		log.Printf("http: render tpm_settings: %v", err)
+	}
+}
+
+func (s *Server) handleSetTPM(w http.ResponseWriter, r *http.Request) {
+	roots := strings.TrimSpace(r.FormValue("roots"))
+	if _, _, err := attest.ParseRoots(roots); err != nil {
+		http.Error(w, "EK CA certificates: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	values := map[string]string{
+		settingTPMRoots:    roots,
+		settingTPMRequired: "",
+	}
+	if r.FormValue("required") == "1" {
+		values[settingTPMRequired] = "1"
+	}
+	for key, val := range values {
+		var err error
+		if val == "" {
+			err = db.DeleteSetting(s.DB, key)
+		} else {
+			err = db.SetSetting(s.DB, key, val)
+		}
+		if err != nil {
+			log.Printf("http: set %s: %v", key, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	s.renderTPM(w, true)
+}
+
+func (s *Server) tpmURL(serverURL string, sys *db.System) string {
+	return s.signURL(tokenPurposeTPM, sys, fmt.Sprintf("%s/api/v1/systems/%s/tpm", serverURL, sys.MAC))
+}
+
+// checkTPM checks the EK a system enrolled with: its certificate, if it
+// sent one, against the configured manufacturer CAs.
+func (s *Server) checkTPM(systemID int64, ek *attest.EK, akPub string) *db.TPMEnrollment {
+	t := &db.TPMEnrollment{
+		SystemID:      systemID,
+		EKFingerprint: ek.Fingerprint,
+		EKCert:        ek.CertPEM(),
+		EKPub:         ek.PublicPEM(),
+		AKPub:         strings.TrimSpace(akPub),
+		Status:        db.TPMUnverified,
+	}
+	if ek.Cert == nil {
+		t.Detail = "no EK certificate was sent"
+		return t
+	}
+	roots, _ := db.GetSetting(s.DB, settingTPMRoots)
+	pool, n, err := attest.ParseRoots(roots)
+	switch {
+	case err != nil:
+		t.Detail = "EK CA certificates: " + err.Error()
+	case n == 0:
+		t.Detail = "no EK CA certificates are configured"
+	default:
+		if err := attest.VerifyEK(ek.Cert, pool); err != nil {
+			t.Status, t.Detail = db.TPMFailed, err.Error()
+		} else {
+			t.Status = db.TPMVerified
+		}
+	}
+	return t
+}
+
+// handleTPMEnroll takes the TPM keys a system posts during early boot,
+// from {{.TPMURL}}: a JSON object with ek_cert and/or ek_pub, and ak_pub.
+// The first EK a system presents is pinned; a different one later marks
+// the system as mismatched until an admin forgets the enrollment.
+func (s *Server) handleTPMEnroll(w http.ResponseWriter, r *http.Request) {
+	bound, ok := s.validateToken(r, tokenPurposeTPM)
+	if !ok {
+		// A machine certificate stands in for the signed token.
+		if bound = s.machineFromCert(r); bound != nil {
+			ok = true
+		}
+	}
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	sys, err := db.GetSystemByMAC(s.DB, r.PathValue("mac"))
+	if err != nil {
+		log.Printf("http: tpm enroll system lookup: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if sys == nil {
+		http.Error(w, "System not found", http.StatusNotFound)
+		return
+	}
+	if bound != nil && sys.ID != bound.ID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		EKCert string `json:"ek_cert"`
+		EKPub  string `json:"ek_pub"`
+		AKPub  string `json:"ak_pub"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTPMEnrollment)).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	ek, err := attest.ParseEK(body.EKCert, body.EKPub)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prev, err := db.GetTPMEnrollment(s.DB, sys.ID)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if prev != nil && (prev.EKFingerprint != ek.Fingerprint || prev.Status == db.TPMMismatch) {
+		if prev.Status != db.TPMMismatch {
+			detail := "enrolled again with a different EK, " + ek.Fingerprint
+			if err := db.SetTPMStatus(s.DB, sys.ID, db.TPMMismatch, detail); err != nil {
+				log.Printf("http: %v", err)
+			}
+			log.Printf("http: tpm enroll for system %d from %s: %s", sys.ID, clientAddr(r), detail)
+		}
+		http.Error(w, "This system's TPM doesn't match the one it enrolled with", http.StatusConflict)
+		return
+	}
+	t := s.checkTPM(sys.ID, ek, body.AKPub)
+	if prev != nil && prev.Status == db.TPMApproved && t.Status != db.TPMVerified {
+		t.Status, t.Detail = db.TPMApproved, ""
+	}
+	if err := db.SaveTPMEnrollment(s.DB, t); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": t.Status, "detail": t.Detail})
+}
+
+// attestationError is why sys may not be given secrets, or nil if it may:
+// while attestation is required, its TPM must have passed it.
+func (s *Server) attestationError(sys *db.System) error {
+	required, err := db.GetSetting(s.DB, settingTPMRequired)
+	if err != nil {
+		return err
+	}
+	if required != "1" {
+		return nil
+	}
+	t, err := db.GetTPMEnrollment(s.DB, sys.ID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case t == nil:
+		return fmt.Errorf("%w: the system hasn't enrolled its TPM", errNotAttested)
+	case !t.Attested():
+		return fmt.Errorf("%w: the system's TPM is %s", errNotAttested, t.Status)
+	}
+	return nil
+}
+
+// attestedSecrets withholds secrets and the machine certificate from a
+// system whose TPM hasn't passed attestation while it is required, so
+// configs that use them aren't served.
+func (s *Server) attestedSecrets(sys *db.System, secrets *profile.Secrets, identity *profile.Identity) (*profile.Secrets, *profile.Identity) {
+	err := s.attestationError(sys)
+	if err == nil {
+		return secrets, identity
+	}
+	if secrets != nil {
+		secrets = profile.DeniedSecrets(err)
+	}
+	if identity != nil {
+		identity = profile.NewIdentity(string(s.CA.CertPEM()), func() (string, string, error) {
+			return "", "", err
+		})
+	}
+	return secrets, identity
+}
+
+func tpmJSON(t *db.TPMEnrollment) map[string]any {
+	if t == nil {
+		return map[string]any{"enrolled": false}
+	}
+	return map[string]any{
+		"enrolled":       true,
+		"status":         t.Status,
+		"attested":       t.Attested(),
+		"detail":         t.Detail,
+		"ek_fingerprint": t.EKFingerprint,
+		"ek_cert":        t.EKCert,
+		"ek_pub":         t.EKPub,
+		"ak_pub":         t.AKPub,
+		"enrolled_at":    t.EnrolledAt,
+		"updated_at":     t.UpdatedAt,
+	}
+}
+
+// handleSystemTPM returns the TPM a system enrolled with and whether it
+// passed attestation. POST approves it; DELETE forgets it, so the next
+// enrollment is pinned afresh.
+func (s *Server) handleSystemTPM(w http.ResponseWriter, r *http.Request) {
+	sys, ok := s.pathSystem(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		t, gerr := db.GetTPMEnrollment(s.DB, sys.ID)
+		if gerr == nil && t == nil {
+			http.Error(w, "The system hasn't enrolled a TPM", http.StatusConflict)
+			return
+		}
+		err = gerr
+		if err == nil {
+			err = db.SetTPMStatus(s.DB, sys.ID, db.TPMApproved, "")
+		}
+	case http.MethodDelete:
+		err = db.DeleteTPMEnrollment(s.DB, sys.ID)
+	}
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	t, err := db.GetTPMEnrollment(s.DB, sys.ID)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tpmJSON(t))
+}
@@ -0,0 +1,325 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/power"
+	"github.com/justinpopa/duh/internal/webhook"
+)
+
+// systemStates are the states a system moves through.
+var systemStates = []string{"discovered", "queued", "provisioning", "ready", "failed", "decommissioning", "decommissioned"}
+
+// transitionTimerInterval is how often due transition timers are checked.
+const transitionTimerInterval = 30 * time.Second
+
+// parseTimerParam reads a timer transition's "<duration> <state>".
+func parseTimerParam(param string) (time.Duration, string, error) {
+	durStr, state, ok := strings.Cut(strings.TrimSpace(param), " ")
+	if !ok {
+		return 0, "", fmt.Errorf("a timer needs a duration and a state, e.g. 2h failed")
+	}
+	d, err := time.ParseDuration(durStr)
+	if err != nil || d <= 0 {
+		return 0, "", fmt.Errorf("invalid timer duration %q", durStr)
+	}
+	state = strings.TrimSpace(state)
+	if !slices.Contains(systemStates, state) || strings.HasPrefix(state, "decommission") || state == "provisioning" {
+		return 0, "", fmt.Errorf("a timer can move a system to discovered, queued, ready or failed, not %q", state)
+	}
+	return d, state, nil
+}
+
+// checkTransition validates a transition from the form and returns its
+// param cleaned up.
+func (s *Server) checkTransition(from, to, action, param string) (string, error) {
+	if from != "" && !slices.Contains(systemStates, from) {
+		return "", fmt.Errorf("unknown state %q", from)
+	}
+	if !slices.Contains(systemStates, to) {
+		return "", fmt.Errorf("unknown state %q", to)
+	}
+	param = strings.TrimSpace(param)
+	switch action {
+	case db.TransitionActionWebhook:
+		id, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("choose a webhook")
+		}
+		wh, err := db.GetWebhook(s.DB, id)
+		if err != nil {
+			return "", err
+		}
+		if wh == nil {
+			return "", fmt.Errorf("webhook %d not found", id)
+		}
+	case db.TransitionActionWake:
+		if param != "" {
+			if _, err := power.WakeAddr(param); err != nil {
+				return "", err
+			}
+		}
+	case db.TransitionActionRedfish:
+		if param != "" && !slices.Contains(power.ResetTypes, param) {
+			return "", fmt.Errorf("reset type must be one of %s, or empty", strings.Join(power.ResetTypes, ", "))
+		}
+	case db.TransitionActionTimer:
+		d, state, err := parseTimerParam(param)
+		if err != nil {
+			return "", err
+		}
+		if state == to {
+			return "", fmt.Errorf("a timer on entering %s must move the system somewhere else", to)
+		}
+		param = d.String() + " " + state
+	case db.TransitionActionOneshot:
+		id, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("choose an image")
+		}
+		img, err := db.GetImage(s.DB, id)
+		if err != nil {
+			return "", err
+		}
+		if img == nil {
+			return "", fmt.Errorf("image %d not found", id)
+		}
+	default:
+		return "", fmt.Errorf("invalid action")
+	}
+	return param, nil
+}
+
+// runTransitions starts the actions configured for a system entering state
+// to. sys.State is the state it left.
+func (s *Server) runTransitions(sys *db.System, to string) {
+	from := sys.State
+	if from == to {
+		from = ""
+	}
+	transitions, err := db.TransitionsFor(s.DB, from, to)
+	if err != nil {
+		log.Printf("http: %v", err)
+		return
+	}
+	if len(transitions) == 0 {
+		return
+	}
+	snapshot := *sys
+	go func() {
+		for _, t := range transitions {
+			if err := s.runTransition(t, &snapshot, to); err != nil {
+				log.Printf("http: transition %d (%s) for %s: %v", t.ID, t.Action, snapshot.MAC, err)
+			}
+		}
+	}()
+}
+
+func (s *Server) runTransition(t db.Transition, sys *db.System, to string) error {
+	switch t.Action {
+	case db.TransitionActionWebhook:
+		id, _ := strconv.ParseInt(t.Param, 10, 64)
+		wh, err := db.GetWebhook(s.DB, id)
+		if err != nil {
+			return err
+		}
+		if wh == nil {
+			return fmt.Errorf("webhook %d is gone", id)
+		}
+		return webhook.Deliver(wh.URL, wh.Secret, systemEvent(sys, to))
+	case db.TransitionActionWake:
+		return power.Wake(sys.MAC, t.Param)
+	case db.TransitionActionRedfish:
+		vars := map[string]any{}
+		json.Unmarshal([]byte(sys.Vars), &vars)
+		str := func(key string) string {
+			v, _ := vars[key].(string)
+			return v
+		}
+		if str("redfish_url") == "" {
+			return fmt.Errorf("the system has no redfish_url var")
+		}
+		insecure := str("redfish_insecure") == "true" || vars["redfish_insecure"] == true
+		bmc := power.NewBMC(str("redfish_url"), str("redfish_user"), str("redfish_password"), insecure)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		return bmc.PXEBoot(ctx, t.Param)
+	case db.TransitionActionTimer:
+		d, state, err := parseTimerParam(t.Param)
+		if err != nil {
+			return err
+		}
+		return db.StartSystemTimer(s.DB, sys.ID, to, state, d)
+	case db.TransitionActionOneshot:
+		id, err := strconv.ParseInt(t.Param, 10, 64)
+		if err != nil {
+			return err
+		}
+		return db.SetOneshotImage(s.DB, sys.ID, &id)
+	}
+	return fmt.Errorf("unknown action %q", t.Action)
+}
+
+// RunTransitionTimers moves systems on when a transition timer runs out
+// while they are still in the state that started it.
+func (s *Server) RunTransitionTimers(ctx context.Context) error {
+	ticker := time.NewTicker(transitionTimerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			s.fireTransitionTimers()
+		}
+	}
+}
+
+func (s *Server) fireTransitionTimers() {
+	due, err := db.TakeDueTimers(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+		return
+	}
+	for _, t := range due {
+		if t.State == "provisioning" && t.ToState == "failed" {
+			err = db.FailSystemByMAC(s.DB, t.MAC, "timeout", "still provisioning when the transition timer ran out")
+		} else {
+			err = db.TransitionSystemStateByMAC(s.DB, t.MAC, t.State, t.ToState)
+		}
+		if err != nil {
+			log.Printf("http: transition timer for %s: %v", t.MAC, err)
+			continue
+		}
+		log.Printf("http: transition timer moved %s from %s to %s", t.MAC, t.State, t.ToState)
+		sys, err := db.GetSystemByID(s.DB, t.SystemID)
+		if err != nil || sys == nil {
+			continue
+		}
+		sys.State = t.State
+		s.fireSystemEvent(sys, t.ToState)
+	}
+}
+
+// transitionView is a transition with its parameter described, for
+// display.
+type transitionView struct {
+	db.Transition
+	Detail string
+}
+
+// transitionsData adds the transitions and what their forms need to the
+// rules page data.
+func (s *Server) transitionsData(data map[string]any) error {
+	transitions, err := db.ListTransitions(s.DB)
+	if err != nil {
+		return err
+	}
+	webhooks, err := db.ListWebhooks(s.DB)
+	if err != nil {
+		return fmt.Errorf("list webhooks: %w", err)
+	}
+	webhookURLs := map[string]string{}
+	for _, wh := range webhooks {
+		webhookURLs[strconv.FormatInt(wh.ID, 10)] = wh.URL
+	}
+	imageNames := map[string]string{}
+	if images, ok := data["Images"].([]db.Image); ok {
+		for _, img := range images {
+			imageNames[strconv.FormatInt(img.ID, 10)] = img.Name
+		}
+	}
+	views := make([]transitionView, len(transitions))
+	for i, t := range transitions {
+		views[i] = transitionView{Transition: t}
+		switch t.Action {
+		case db.TransitionActionWebhook:
+			views[i].Detail = "send to " + or(webhookURLs[t.Param], "(deleted webhook)")
+		case db.TransitionActionWake:
+			views[i].Detail = "Wake-on-LAN to " + or(t.Param, power.DefaultWakeAddr)
+		case db.TransitionActionRedfish:
+			views[i].Detail = "Redfish PXE boot, " + or(t.Param, "on or restart")
+		case db.TransitionActionTimer:
+			d, state, _ := parseTimerParam(t.Param)
+			views[i].Detail = fmt.Sprintf("move to %s if still %s after %s", state, t.ToState, d)
+		case db.TransitionActionOneshot:
+			views[i].Detail = "boot once " + or(imageNames[t.Param], "(deleted image)")
+		}
+	}
+	data["Transitions"] = views
+	data["Webhooks"] = webhooks
+	data["States"] = systemStates
+	data["ResetTypes"] = power.ResetTypes
+	return nil
+}
+
+func or(s, fallback string) string {
+	if s == "" {
+		return fallback
+	}
+	return s
+}
+
+func (s *Server) renderTransitionsList(w http.ResponseWriter) {
+	data, err := s.rulesData()
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.Templates.ExecuteTemplate(w, "transitions_list", data); err != nil {
+		log.Printf("http: render transitions list: %v", err)
+	}
+}
+
+func (s *Server) handleCreateTransition(w http.ResponseWriter, r *http.Request) {
+	from, to, action := r.FormValue("from_state"), r.FormValue("to_state"), r.FormValue("action")
+	param, err := s.checkTransition(from, to, action, r.FormValue("param_"+action))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := db.CreateTransition(s.DB, from, to, action, param); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderTransitionsList(w)
+}
+
+func (s *Server) handleToggleTransition(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if err := db.ToggleTransition(s.DB, id); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderTransitionsList(w)
+}
+
+func (s *Server) handleDeleteTransition(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if err := db.DeleteTransition(s.DB, id); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderTransitionsList(w)
+}
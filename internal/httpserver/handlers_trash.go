@@ -0,0 +1,153 @@
+package httpserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/justinpopa/duh/internal/db"
+)
+
+func (s *Server) handleTrashPage(w http.ResponseWriter, r *http.Request) {
+	systems, err := db.ListTrashedSystems(s.DB)
+	if err != nil {
+		log.Printf("http: list trashed systems: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	images, err := db.ListTrashedImages(s.DB)
+	if err != nil {
+		log.Printf("http: list trashed images: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	profiles, err := db.ListTrashedProfiles(s.DB)
+	if err != nil {
+		log.Printf("http: list trashed profiles: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	hash, _ := s.getAuthState()
+	data := map[string]any{
+		"Systems":       systems,
+		"Images":        images,
+		"Profiles":      profiles,
+		"RetentionDays": s.trashRetentionDays(),
+		"AuthEnabled":   hash != "",
+	}
+	s.addThemeData(r, data)
+	if err := s.Templates.ExecuteTemplate(w, "trash", data); err != nil {
+		log.Printf("http: render trash: %v", err)
+	}
+}
+
+func (s *Server) handleRestoreTrash(w http.ResponseWriter, r *http.Request) {
+	kind := r.PathValue("kind")
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	ok, err := db.RestoreTrashed(s.DB, kind, id)
+	if err != nil {
+		log.Printf("http: restore %s: %v", kind, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handlePurgeTrash(w http.ResponseWriter, r *http.Request) {
+	kind := r.PathValue("kind")
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	ok, err := s.purgeTrashed(kind, id)
+	if err != nil {
+		log.Printf("http: purge %s: %v", kind, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleSetTrashRetention(w http.ResponseWriter, r *http.Request) {
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil || days < 1 {
+		http.Error(w, "Retention must be at least 1 day", http.StatusBadRequest)
+		return
+	}
+	if err := db.SetSetting(s.DB, "trash_retention_days", strconv.Itoa(days)); err != nil {
+		log.Printf("http: set trash retention: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) trashRetentionDays() int {
+	val, _ := db.GetSetting(s.DB, "trash_retention_days")
+	days, err := strconv.Atoi(val)
+	if err != nil || days < 1 {
+		return db.DefaultTrashRetentionDays
+	}
+	return days
+}
+
+// purgeTrashed permanently deletes a trashed row along with any files it
+// kept on disk.
+func (s *Server) purgeTrashed(kind string, id int64) (bool, error) {
+	ok, err := db.PurgeTrashed(s.DB, kind, id)
+	if err != nil || !ok {
+		return ok, err
+	}
+	switch kind {
+	case "image":
+		os.RemoveAll(filepath.Join(s.DataDir, "images", fmt.Sprintf("%d", id)))
+	case "profile":
+		os.RemoveAll(filepath.Join(s.DataDir, "profiles", fmt.Sprintf("%d", id)))
+	}
+	return true, nil
+}
+
+// purgeExpiredTrash purges trash older than the retention window, for
+// the trash_purge scheduled task. Items that fail to purge are tried again
+// on its next run.
+func (s *Server) purgeExpiredTrash(ctx context.Context) error {
+	expired, err := db.ExpiredTrash(s.DB, s.trashRetentionDays())
+	if err != nil {
+		return fmt.Errorf("list expired trash: %w", err)
+	}
+	var failed int
+	for kind, ids := range expired {
+		for _, id := range ids {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if _, err := s.purgeTrashed(kind, id); err != nil {
+				log.Printf("trash: purge %s %d: %v", kind, id, err)
+				failed++
+				continue
+			}
+			log.Printf("trash: purged %s %d", kind, id)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d items could not be purged", failed)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/jobs"
+)
+
+// jobTrigger is the job type that runs an inbound trigger's action; its
+// payload is a triggerJob.
+const jobTrigger = "trigger.run"
+
+// triggerJob is the payload of a jobTrigger job.
+type triggerJob struct {
+	TriggerID int64 `json:"trigger_id"`
+}
+
+// Inventory syncs a sync trigger can run.
+const (
+	triggerSyncNetBox = "netbox"
+	triggerSyncVMs    = "vms"
+)
+
+// checkTrigger validates a new trigger, returning its param normalized.
+func checkTrigger(action, param string) (string, error) {
+	param = strings.TrimSpace(param)
+	switch action {
+	case db.TriggerActionQueue:
+		tag := db.NormalizeTags(param)
+		if tag == "" || strings.Contains(tag, ",") {
+			return "", errors.New("a queue trigger needs one tag naming the systems to queue")
+		}
+		return tag, nil
+	case db.TriggerActionCatalog:
+		return "", nil
+	case db.TriggerActionSync:
+		if param != triggerSyncNetBox && param != triggerSyncVMs {
+			return "", fmt.Errorf("a sync trigger runs %q or %q", triggerSyncNetBox, triggerSyncVMs)
+		}
+		return param, nil
+	}
+	return "", fmt.Errorf("unknown action %q", action)
+}
+
+// handleFireTrigger lets an external system run a trigger by name, with
+// its token as a bearer token or, for senders that can't set headers, the
+// token query parameter. The action runs as a job, whose ID is returned.
+func (s *Server) handleFireTrigger(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	if !strings.HasPrefix(token, db.TriggerTokenPrefix) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	t, err := db.TriggerForToken(s.DB, r.PathValue("name"), token)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if t == nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	id, err := s.Jobs.EnqueueOnce(jobTrigger, triggerJob{TriggerID: t.ID})
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("http: trigger %s fired from %s", t.Name, clientAddr(r))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{"trigger": t.Name, "action": t.Action, "job_id": id})
+}
+
+// runTrigger runs a jobTrigger job.
+func (s *Server) runTrigger(ctx context.Context, payload []byte) error {
+	var job triggerJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return jobs.Permanent(err)
+	}
+	t, err := db.GetTrigger(s.DB, job.TriggerID)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		// Deleted since it fired.
+		return nil
+	}
+	switch t.Action {
+	case db.TriggerActionQueue:
+		n, err := s.queueTagged(t.Param)
+		log.Printf("trigger: %s queued %d systems tagged %s", t.Name, n, t.Param)
+		return err
+	case db.TriggerActionCatalog:
+		if s.catalogURL() == "" {
+			return jobs.Permanent(errors.New("no catalog is configured"))
+		}
+		return s.syncCatalog(ctx)
+	case db.TriggerActionSync:
+		var results []syncSummary
+		switch t.Param {
+		case triggerSyncNetBox:
+			results, err = s.syncNetBox(ctx)
+			if err != nil {
+				return err
+			}
+			if results == nil {
+				return jobs.Permanent(errors.New("NetBox is not configured"))
+			}
+		case triggerSyncVMs:
+			if len(s.VMProviders) == 0 {
+				return jobs.Permanent(errors.New("no VM providers configured"))
+			}
+			results = s.syncVMs(ctx)
+		}
+		// A sync is redone whole, so errors syncing some devices aren't
+		// worth retrying; the Jobs page shows them.
+		var errs []string
+		for _, res := range results {
+			log.Printf("trigger: %s synced %s: %d created, %d updated, %d skipped",
+				t.Name, res.Source, res.Created, res.Updated, res.Skipped)
+			for _, e := range res.Errors {
+				errs = append(errs, res.Source+": "+e)
+			}
+		}
+		if len(errs) > 0 {
+			return jobs.Permanent(errors.New(strings.Join(errs, "; ")))
+		}
+		return nil
+	}
+	return jobs.Permanent(fmt.Errorf("unknown action %q", t.Action))
+}
+
+// queueTagged queues every system tagged tag that is discovered, ready or
+// failed and has an image and hostname, as the Queue and Reimage buttons
+// would. Systems whose image or profile is in another environment are
+// skipped. It returns how many were queued.
+func (s *Server) queueTagged(tag string) (int, error) {
+	systems, err := db.ListSystems(s.DB)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for i := range systems {
+		sys := &systems[i]
+		if !slices.Contains(db.SplitTags(sys.Tags), tag) {
+			continue
+		}
+		if sys.State != "discovered" && sys.State != "ready" && sys.State != "failed" {
+			continue
+		}
+		if sys.ImageID == nil || sys.Hostname == "" {
+			log.Printf("trigger: not queuing %s: no image or hostname", systemLabel(sys))
+			continue
+		}
+		conflict, err := s.environmentConflict(sys)
+		if err != nil {
+			return n, err
+		}
+		if conflict != "" {
+			log.Printf("trigger: not queuing %s: %s", systemLabel(sys), conflict)
+			continue
+		}
+		if err := db.UpdateSystemState(s.DB, sys.ID, "queued"); err != nil {
+			return n, err
+		}
+		n++
+		if updated, err := db.GetSystemByID(s.DB, sys.ID); err == nil && updated != nil {
+			updated.State = sys.State
+			sys = updated
+		}
+		s.fireSystemEvent(sys, "queued")
+		if s.SettingBool("vm_netboot") {
+			s.vmNetworkBoot(sys)
+		}
+		if sys.State == "ready" {
+			s.queueAgentReimage(sys)
+		}
+	}
+	return n, nil
+}
+
+func (s *Server) renderTriggers(w http.ResponseWriter, newToken string) {
+	triggers, err := db.ListTriggers(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]any{"Triggers": triggers, "NewToken": newToken}
+	if err := s.Templates.ExecuteTemplate(w, "triggers", data); err != nil {
+		log.Printf("http: render triggers: %v", err)
+	}
+}
+
+func (s *Server) handleCreateTrigger(w http.ResponseWriter, r *http.Request) {
+	action := r.FormValue("action")
+	param, err := checkTrigger(action, r.FormValue("param"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, err := db.CreateTrigger(s.DB, r.FormValue("name"), action, param)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Failed to create trigger: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.renderTriggers(w, token)
+}
+
+func (s *Server) handleRotateTriggerToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	token, err := db.RotateTriggerToken(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderTriggers(w, token)
+}
+
+func (s *Server) handleToggleTrigger(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if err := db.ToggleTrigger(s.DB, id); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderTriggers(w, "")
+}
+
+func (s *Server) handleDeleteTrigger(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if err := db.DeleteTrigger(s.DB, id); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderTriggers(w, "")
+}
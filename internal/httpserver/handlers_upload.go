@@ -11,36 +11,63 @@ import (
 	"strings"
 	"time"
 
+	"github.com/justinpopa/duh/internal/catalog"
 	"github.com/justinpopa/duh/internal/db"
 )
 
 func (s *Server) handleUploadImage(w http.ResponseWriter, r *http.Request) {
 	const maxUpload = 8 << 30 // 8 GB
-	r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
-	if err := r.ParseMultipartForm(maxUpload); err != nil {
+	form, err := s.streamMultipart(w, r, maxUpload)
+	if err != nil {
 		http.Error(w, "Upload too large or failed to parse form", http.StatusBadRequest)
 		return
 	}
+	defer form.Close()
 
-	name := r.FormValue("name")
+	name := form.Values.Get("name")
 	if name == "" {
 		http.Error(w, "Name is required", http.StatusBadRequest)
 		return
 	}
-	description := r.FormValue("description")
-	bootType := r.FormValue("boot_type")
+	description := form.Values.Get("description")
+	bootType := form.Values.Get("boot_type")
 	if bootType == "" {
 		bootType = db.BootTypeLinux
 	}
-	cmdline := r.FormValue("cmdline")
-	ipxeScript := r.FormValue("ipxe_script")
+	cmdline := form.Values.Get("cmdline")
+	ipxeScript := form.Values.Get("ipxe_script")
+	bootTarget, err := validateBootTarget(bootType, form.Values.Get("boot_target"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	remote, err := parseRemoteFiles(form.Values.Get("urls"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, f := range remote {
+		if err := checkTenantURL(r, f.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	tenantID, err := s.formTenant(r, form.Values.Get("tenant_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The staged files already count against the image quota.
+	if refuseOverQuota(w, s.checkQuota(areaImages, 0, 0)) {
+		return
+	}
 
 	// Collect uploaded filenames for metadata
 	var fileNames []string
-	if r.MultipartForm != nil && r.MultipartForm.File != nil {
-		for _, headers := range r.MultipartForm.File["files"] {
-			fileNames = append(fileNames, headers.Filename)
-		}
+	for _, f := range form.Files["files"] {
+		fileNames = append(fileNames, f.Name)
 	}
 
 	id, err := db.CreateImage(s.DB, name, description, bootType,
@@ -50,6 +77,20 @@ func (s *Server) handleUploadImage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to create image", http.StatusInternalServerError)
 		return
 	}
+	if bootTarget != "" {
+		if err := db.UpdateImageBootTarget(s.DB, id, bootTarget); err != nil {
+			log.Printf("http: update image boot target: %v", err)
+			http.Error(w, "Failed to create image", http.StatusInternalServerError)
+			return
+		}
+	}
+	if tenantID != 0 {
+		if err := db.UpdateImageTenant(s.DB, id, tenantID); err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Failed to create image", http.StatusInternalServerError)
+			return
+		}
+	}
 
 	imageDir := filepath.Join(s.DataDir, "images", fmt.Sprintf("%d", id))
 	if err := os.MkdirAll(imageDir, 0755); err != nil {
@@ -58,30 +99,63 @@ func (s *Server) handleUploadImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Save all uploaded files with their original names
-	if r.MultipartForm != nil && r.MultipartForm.File != nil {
-		for _, header := range r.MultipartForm.File["files"] {
-			f, err := header.Open()
-			if err != nil {
-				log.Printf("http: open uploaded file %s: %v", header.Filename, err)
-				http.Error(w, "Failed to read uploaded file", http.StatusInternalServerError)
-				return
-			}
-			// Sanitize: use only the base name, no path traversal
-			safeName := filepath.Base(header.Filename)
-			if err := saveFile(filepath.Join(imageDir, safeName), f); err != nil {
-				f.Close()
-				log.Printf("http: save file %s: %v", safeName, err)
-				http.Error(w, "Failed to save file", http.StatusInternalServerError)
-				return
-			}
-			f.Close()
+	// Move the uploaded files in under their original names
+	for _, f := range form.Files["files"] {
+		if err := s.install(f, filepath.Join(imageDir, f.Name)); err != nil {
+			log.Printf("http: save file %s: %v", f.Name, err)
+			http.Error(w, "Failed to save file", http.StatusInternalServerError)
+			return
+		}
+		if err := db.SetImageFileSum(s.DB, id, f.Name, f.SHA256, db.SumSourceReceived); err != nil {
+			log.Printf("http: %v", err)
+		}
+	}
+
+	// Remote files download in the background; the row polls until the
+	// image is ready.
+	if len(remote) > 0 {
+		if err := db.UpdateImageStatus(s.DB, id, db.ImageStatusDownloading,
+			fmt.Sprintf("1/%d %s 0%%", len(remote), remote[0].Name)); err != nil {
+			log.Printf("http: %v", err)
+		}
+		if err := catalog.QueueDownload(s.Jobs, id, name, remote); err != nil {
+			log.Printf("http: %v", err)
+			db.UpdateImageStatus(s.DB, id, db.ImageStatusError, err.Error())
 		}
 	}
 
 	s.renderImageRow(w, id)
 }
 
+// parseRemoteFiles reads the create form's remote files, one per line as
+// "URL [sha256]". Blank lines and lines starting with # are skipped.
+func parseRemoteFiles(text string) ([]catalog.File, error) {
+	var files []catalog.File
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("remote files must be \"URL [sha256]\", got %q", strings.TrimSpace(line))
+		}
+		f := catalog.File{URL: fields[0]}
+		if len(fields) == 2 {
+			f.SHA256 = fields[1]
+		}
+		if err := checkRemoteFile(&f); err != nil {
+			return nil, err
+		}
+		for _, prev := range files {
+			if prev.Name == f.Name {
+				return nil, fmt.Errorf("two remote files are named %s", f.Name)
+			}
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
 func (s *Server) handleUpdateImage(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
 	if err != nil {
@@ -100,11 +174,103 @@ func (s *Server) handleUpdateImage(w http.ResponseWriter, r *http.Request) {
 	}
 	cmdline := r.FormValue("cmdline")
 	ipxeScript := r.FormValue("ipxe_script")
+	files, err := parseFileMapForm(r.FormValue("map_kernel"), r.FormValue("map_initrds"),
+		r.FormValue("map_rootfs"), r.FormValue("map_extra"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bootTarget, err := validateBootTarget(bootType, r.FormValue("boot_target"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	builderURL, err := validateBuilderURL(r.FormValue("builder_url"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkTenantURL(r, builderURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err := db.UpdateImage(s.DB, id, name, description, bootType, cmdline, ipxeScript); err != nil {
 		log.Printf("http: update image: %v", err)
 		http.Error(w, "Failed to update image", http.StatusInternalServerError)
 		return
 	}
+	if err := db.UpdateImageFileMap(s.DB, id, files); err != nil {
+		log.Printf("http: update image file map: %v", err)
+		http.Error(w, "Failed to update image", http.StatusInternalServerError)
+		return
+	}
+	if err := db.UpdateImageBootTarget(s.DB, id, bootTarget); err != nil {
+		log.Printf("http: update image boot target: %v", err)
+		http.Error(w, "Failed to update image", http.StatusInternalServerError)
+		return
+	}
+	if _, ok := r.Form["builder_url"]; ok {
+		// A blank secret keeps the saved one unless the builder is removed.
+		secret := r.FormValue("builder_secret")
+		if secret == "" && builderURL != "" {
+			if img, err := db.GetImage(s.DB, id); err == nil && img != nil {
+				secret = img.BuilderSecret
+			}
+		}
+		if err := db.UpdateImageBuilder(s.DB, id, builderURL, secret); err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Failed to update image", http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, ok := r.Form["environment"]; ok {
+		env, err := s.formEnvironment(r.FormValue("environment"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := db.UpdateImageEnvironment(s.DB, id, env); err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Failed to update image", http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, ok := r.Form["arch"]; ok {
+		if err := db.SetImageArch(s.DB, id, strings.ToLower(strings.TrimSpace(r.FormValue("arch")))); err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Failed to update image", http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, ok := r.Form["catalog_policy"]; ok {
+		policy := r.FormValue("catalog_policy")
+		if !validCatalogPolicy(policy) {
+			http.Error(w, "Invalid catalog policy", http.StatusBadRequest)
+			return
+		}
+		if err := db.SetImageCatalogPolicy(s.DB, id, policy); err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Failed to update image", http.StatusInternalServerError)
+			return
+		}
+		// Have the next sync compare versions even if the catalog is
+		// unchanged, so a switch to auto picks up a pending update.
+		if err := db.SetSetting(s.DB, settingCatalogETag, ""); err != nil {
+			log.Printf("http: %v", err)
+		}
+	}
+	if _, ok := r.Form["tenant_id"]; ok && requestTenant(r) == nil {
+		tenantID, err := s.formTenant(r, r.FormValue("tenant_id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := db.UpdateImageTenant(s.DB, id, tenantID); err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Failed to update image", http.StatusInternalServerError)
+			return
+		}
+	}
 	s.renderImageRow(w, id)
 }
 
@@ -119,17 +285,11 @@ func (s *Server) renderImageRow(w http.ResponseWriter, id int64) {
 		http.Error(w, "Image not found", http.StatusNotFound)
 		return
 	}
-	// Mark stale downloads as errors (e.g. server crashed mid-pull)
-	if img.Status == db.ImageStatusDownloading {
-		if updated, err := time.Parse("2006-01-02 15:04:05", img.UpdatedAt); err == nil {
-			if time.Since(updated) > 35*time.Minute {
-				db.UpdateImageStatus(s.DB, id, db.ImageStatusError, "Download timed out")
-				img.Status = db.ImageStatusError
-				img.StatusDetail = "Download timed out"
-			}
-		}
+	usage, err := db.GetImageUsage(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
 	}
-	data := map[string]any{"Image": img}
+	data := map[string]any{"Image": img, "Usage": usage}
 	if err := s.Templates.ExecuteTemplate(w, "image_row", data); err != nil {
 		log.Printf("http: render image row: %v", err)
 	}
@@ -151,18 +311,72 @@ func (s *Server) handleDeleteImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	deps, err := db.ListSystemsByImage(s.DB, id)
+	if err != nil {
+		log.Printf("http: list image dependents: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if len(deps) > 0 {
+		target, reassign, err := reassignTarget(r)
+		if err != nil || (target != nil && *target == id) {
+			http.Error(w, "Invalid reassignment target", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case reassign:
+			if target != nil {
+				img, err := db.GetImage(s.DB, *target)
+				if err != nil || img == nil || !visibleTo(r, img.TenantID, true) {
+					http.Error(w, "Invalid reassignment target", http.StatusBadRequest)
+					return
+				}
+			}
+			if _, err := db.ReassignSystemsImage(s.DB, id, target); err != nil {
+				log.Printf("http: reassign image: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		case r.FormValue("confirm") != "1":
+			// Refuse until the caller reassigns or explicitly accepts
+			// that these systems will have no bootable image.
+			writeDependents(w, r, http.StatusConflict, deps, nil)
+			return
+		}
+	}
+
 	if err := db.DeleteImage(s.DB, id); err != nil {
 		log.Printf("http: delete image: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	imageDir := filepath.Join(s.DataDir, "images", fmt.Sprintf("%d", id))
-	os.RemoveAll(imageDir)
 	w.WriteHeader(http.StatusOK)
 }
 
+func (s *Server) handleImageDependents(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	deps, err := db.ListSystemsByImage(s.DB, id)
+	if err != nil {
+		log.Printf("http: list image dependents: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	usage, err := db.GetImageUsage(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeDependents(w, r, http.StatusOK, deps, &usage)
+}
+
 func (s *Server) handleServeImageFile(w http.ResponseWriter, r *http.Request) {
-	if !s.validateToken(r) {
+	bound, ok := s.validateToken(r, tokenPurposeImage)
+	if !ok {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -172,6 +386,10 @@ func (s *Server) handleServeImageFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid ID", http.StatusBadRequest)
 		return
 	}
+	if bound != nil && !s.imageBound(bound, idNum) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 	name := r.PathValue("name")
 
 	// Prevent path traversal
@@ -182,7 +400,13 @@ func (s *Server) handleServeImageFile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	path := filepath.Join(s.DataDir, "images", fmt.Sprintf("%d", idNum), name)
-	http.ServeFile(w, r, path)
+	s.noteCacheNode(r)
+	tw, done := s.bandwidth.start(w, r, clientAddr(r), s.imageRateLimits)
+	defer done()
+	xw := &transferWriter{ResponseWriter: tw, status: http.StatusOK}
+	start := time.Now()
+	http.ServeFile(xw, r, path)
+	s.recordTransfer(r, bound, name, xw, time.Since(start))
 }
 
 func saveFile(dst string, src io.Reader) error {
@@ -0,0 +1,82 @@
+package httpserver
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// diskWipeScript runs from Alpine's local service. It clears the first and
+// last 16 MiB of every disk, which removes partition tables (including the
+// GPT backup), RAID and LVM metadata and filesystem signatures, then powers
+// off. Data beyond those regions is not overwritten.
+const diskWipeScript = `#!/bin/sh
+echo "duh: wiping disks"
+for dev in /sys/block/*; do
+	name=${dev##*/}
+	case "$name" in
+	loop*|ram*|sr*|fd*|zram*|dm-*|md*) continue ;;
+	esac
+	sectors=$(cat "$dev/size")
+	[ "$sectors" -gt 0 ] || continue
+	echo "duh: wiping /dev/$name"
+	dd if=/dev/zero of="/dev/$name" bs=1M count=16 conv=fsync 2>/dev/null
+	tail=$((sectors / 2048 - 16))
+	if [ "$tail" -gt 0 ]; then
+		dd if=/dev/zero of="/dev/$name" bs=1M seek="$tail" count=16 conv=fsync 2>/dev/null
+	fi
+done
+sync
+echo "duh: wipe complete, powering off"
+sleep 5
+poweroff
+`
+
+// handleDiskWipeOverlay serves the Alpine apkovl the Disk Wipe utility boots
+// with. It holds nothing system-specific, so it needs no token.
+func (s *Server) handleDiskWipeOverlay(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/gzip")
+	err := writeApkovl(w, "duh-wipe", []apkovlFile{
+		{"etc/local.d/duh-wipe.start", 0755, diskWipeScript},
+	})
+	if err != nil {
+		log.Printf("http: write disk wipe overlay: %v", err)
+	}
+}
+
+// apkovlFile is a file in an Alpine apkovl.
+type apkovlFile struct {
+	name string
+	mode int64
+	body string
+}
+
+// writeApkovl writes an Alpine apkovl that sets the hostname and runs the
+// local service, so scripts in etc/local.d start once Alpine is up. Files
+// go under etc/, etc/apk/ or etc/local.d/.
+func writeApkovl(w io.Writer, hostname string, files []apkovlFile) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+
+	files = append([]apkovlFile{
+		{"etc/hostname", 0644, hostname + "\n"},
+		{"etc/apk/world", 0644, "alpine-base\n"},
+	}, files...)
+	for _, dir := range []string{"etc/", "etc/apk/", "etc/local.d/", "etc/runlevels/", "etc/runlevels/default/"} {
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0755, ModTime: now})
+	}
+	for _, f := range files {
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: f.name, Mode: f.mode, Size: int64(len(f.body)), ModTime: now})
+		tw.Write([]byte(f.body))
+	}
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "etc/runlevels/default/local", Linkname: "/etc/init.d/local", Mode: 0777, ModTime: now})
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,98 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/vmsync"
+)
+
+// syncSummary reports one source of an inventory sync (a hypervisor or
+// NetBox) to the UI and API.
+type syncSummary struct {
+	Source  string   `json:"source"`
+	Created int      `json:"created"`
+	Updated int      `json:"updated"`
+	Skipped int      `json:"skipped"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// syncVMs runs every configured provider and announces the systems it
+// created. A provider that can't be reached is reported, not fatal.
+func (s *Server) syncVMs(ctx context.Context) []syncSummary {
+	var out []syncSummary
+	for _, p := range s.VMProviders {
+		res, err := vmsync.Sync(ctx, s.DB, p)
+		if err != nil {
+			log.Printf("http: vm sync: %v", err)
+			out = append(out, syncSummary{Source: p.Name(), Errors: []string{err.Error()}})
+			continue
+		}
+		for i := range res.Created {
+			s.fireSystemEvent(&res.Created[i], "discovered")
+		}
+		for _, e := range res.Errors {
+			log.Printf("http: vm sync %s: %s", res.Provider, e)
+		}
+		out = append(out, syncSummary{
+			Source:  res.Provider,
+			Created: len(res.Created),
+			Updated: res.Updated,
+			Skipped: res.Skipped,
+			Errors:  res.Errors,
+		})
+	}
+	return out
+}
+
+func (s *Server) handleVMSync(w http.ResponseWriter, r *http.Request) {
+	if len(s.VMProviders) == 0 {
+		http.Error(w, "No VM providers configured", http.StatusBadRequest)
+		return
+	}
+	data := map[string]any{"Results": s.syncVMs(r.Context())}
+	if err := s.Templates.ExecuteTemplate(w, "sync_result", data); err != nil {
+		log.Printf("http: render sync result: %v", err)
+	}
+}
+
+func (s *Server) handleAPIVMSync(w http.ResponseWriter, r *http.Request) {
+	if len(s.VMProviders) == 0 {
+		http.Error(w, "No VM providers configured", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"results": s.syncVMs(r.Context())})
+}
+
+// vmNetworkBoot moves a queued system's VM to network boot, so the next
+// power cycle reaches duh instead of the installed disk.
+func (s *Server) vmNetworkBoot(sys *db.System) {
+	link, err := db.GetVMLink(s.DB, sys.ID)
+	if err != nil {
+		log.Printf("http: %v", err)
+		return
+	}
+	if link == nil {
+		return
+	}
+	for _, p := range s.VMProviders {
+		if p.Name() != link.Provider {
+			continue
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := p.NetworkBoot(ctx, link.VMID, sys.MAC); err != nil {
+				log.Printf("http: set network boot for %s vm %s: %v", link.Provider, link.VMName, err)
+				return
+			}
+			log.Printf("http: %s vm %s set to network boot", link.Provider, link.VMName)
+		}()
+		return
+	}
+}
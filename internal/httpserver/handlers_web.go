@@ -1,20 +1,34 @@
 package httpserver
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
-	"sort"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/justinpopa/duh/internal/catalog"
 	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/ipxe"
 	"github.com/justinpopa/duh/internal/proxydhcp"
 	"github.com/justinpopa/duh/internal/webhook"
 )
 
 func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if requestTenant(r) == nil {
+		pending, err := s.wizardPending()
+		if err != nil {
+			log.Printf("http: %v", err)
+		}
+		if pending {
+			http.Redirect(w, r, "/wizard", http.StatusFound)
+			return
+		}
+	}
 	systems, err := db.ListSystems(s.DB)
 	if err != nil {
 		log.Printf("http: list systems: %v", err)
@@ -41,15 +55,47 @@ func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
 	for _, p := range profiles {
 		profileNames[p.ID] = p.Name
 	}
+	installTimes, err := db.LastInstallTimes(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+	}
 	hash, _ := s.getAuthState()
 	data := map[string]any{
-		"Systems":      systems,
-		"Images":       images,
-		"Profiles":     profiles,
 		"ImageNames":   imageNames,
 		"ProfileNames": profileNames,
+		"InstallTimes": installTimes,
 		"AuthEnabled":  hash != "",
 	}
+	s.addScopeData(r, data)
+	s.addTenantData(r, data)
+	scope := data["Scope"].(string)
+	systems = slices.DeleteFunc(systems, func(sys db.System) bool {
+		return !inScope(scope, sys.Environment, true) || !visibleTo(r, sys.TenantID, false)
+	})
+	if requestTenant(r) == nil {
+		subnets, err := db.ListSubnets(s.DB)
+		if err != nil {
+			log.Printf("http: %v", err)
+		}
+		filter := r.URL.Query().Get("subnet")
+		systems = filterBySubnet(systems, subnets, filter)
+		data["Subnets"] = subnets
+		data["SubnetFilter"] = filter
+	}
+	data["Systems"] = systems
+	data["Images"] = slices.DeleteFunc(images, func(img db.Image) bool {
+		return !inScope(scope, img.Environment, false) || !visibleTo(r, img.TenantID, true)
+	})
+	data["Profiles"] = slices.DeleteFunc(profiles, func(p db.Profile) bool {
+		return !inScope(scope, p.Environment, false) || !visibleTo(r, p.TenantID, true)
+	})
+	if cert, _ := s.certificateInfo(time.Now()); cert != nil {
+		data["CertWarning"] = cert.Warning()
+	}
+	if requestTenant(r) == nil {
+		data["Bandwidth"] = s.bandwidthSnapshot()
+	}
+	s.addThemeData(r, data)
 	if err := s.Templates.ExecuteTemplate(w, "dashboard", data); err != nil {
 		log.Printf("http: render dashboard: %v", err)
 	}
@@ -65,39 +111,27 @@ func (s *Server) handleImagesPage(w http.ResponseWriter, r *http.Request) {
 
 	imgHash, _ := s.getAuthState()
 	data := map[string]any{
-		"Images":      images,
 		"AuthEnabled": imgHash != "",
 	}
+	s.addScopeData(r, data)
+	s.addTenantData(r, data)
+	scope := data["Scope"].(string)
+	images = slices.DeleteFunc(images, func(img db.Image) bool {
+		return !inScope(scope, img.Environment, false) || !visibleTo(r, img.TenantID, true)
+	})
+	data["Images"] = images
+	usage, err := db.ImageUsage(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+	}
+	data["Usage"] = usage
 
-	// Merge catalog data if configured
-	if s.CatalogURL != "" {
-		var entries []catalog.Entry
-		var fetchErr string
-		cat, err := catalog.Fetch(s.CatalogURL)
-		if err != nil {
-			log.Printf("http: fetch catalog: %v", err)
-			fetchErr = err.Error()
-		} else {
-			entries = cat.Entries
-		}
-		pulled := make(map[string]*db.Image)
-		for i := range images {
-			if images[i].CatalogID != "" {
-				pulled[images[i].CatalogID] = &images[i]
-			}
-		}
-
-		// Sort: unpulled first, then pulled
-		sort.SliceStable(entries, func(i, j int) bool {
-			_, iPulled := pulled[entries[i].ID]
-			_, jPulled := pulled[entries[j].ID]
-			return !iPulled && jPulled
-		})
-		data["CatalogEntries"] = entries
-		data["CatalogPulled"] = pulled
-		data["CatalogFetchErr"] = fetchErr
+	// Merge catalog data if configured. Pulling from it is for the admin.
+	if s.catalogURL() != "" && requestTenant(r) == nil {
+		maps.Copy(data, s.catalogData(r))
 	}
 
+	s.addThemeData(r, data)
 	if err := s.Templates.ExecuteTemplate(w, "images", data); err != nil {
 		log.Printf("http: render images: %v", err)
 	}
@@ -110,13 +144,61 @@ func (s *Server) handleCreateSystem(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "MAC address is required", http.StatusBadRequest)
 		return
 	}
-	sys, err := db.CreateSystem(s.DB, mac, hostname)
+	tenantID, err := s.formTenant(r, r.FormValue("tenant_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var src *db.System
+	if v := r.FormValue("clone_from"); v != "" {
+		srcID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid system to clone", http.StatusBadRequest)
+			return
+		}
+		src, err = db.GetSystemByID(s.DB, srcID)
+		if err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if src == nil || !visibleTo(r, src.TenantID, false) {
+			http.Error(w, "System to clone not found", http.StatusBadRequest)
+			return
+		}
+	}
+	if s.systemConflict(w, r, 0, mac, hostname) {
+		return
+	}
+	var sys *db.System
+	if src != nil {
+		sys, err = db.CloneSystem(s.DB, mac, hostname, tenantID, src)
+	} else {
+		sys, err = db.CreateSystem(s.DB, mac, hostname)
+	}
+	var inUse *db.MACInUseError
+	if errors.As(err, &inUse) {
+		writeSystemConflict(w, macConflict(r, inUse))
+		return
+	}
 	if err != nil {
 		log.Printf("http: create system: %v", err)
 		http.Error(w, "Failed to create system", http.StatusBadRequest)
 		return
 	}
+	if tenantID != 0 && src == nil {
+		if err := db.UpdateSystemTenant(s.DB, sys.ID, tenantID); err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		sys.TenantID = tenantID
+	}
 	s.fireSystemEvent(sys, "discovered")
+	if src != nil {
+		s.renderSystemRow(w, sys.ID)
+		return
+	}
 	data := map[string]any{
 		"System":       sys,
 		"ImageNames":   map[int64]string{},
@@ -127,6 +209,129 @@ func (s *Server) handleCreateSystem(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// systemConflictBody is returned with 409 when a system's MAC or hostname
+// is already taken. It names the other system when the caller can see it,
+// so the Systems page can offer to open it.
+type systemConflictBody struct {
+	Error       string `json:"error"`
+	SystemID    int64  `json:"system_id,omitempty"`
+	Overridable bool   `json:"overridable"` // resending with override=true saves anyway
+}
+
+func writeSystemConflict(w http.ResponseWriter, c systemConflictBody) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(c)
+}
+
+func macConflict(r *http.Request, e *db.MACInUseError) systemConflictBody {
+	if !visibleTo(r, e.System.TenantID, false) {
+		return systemConflictBody{Error: fmt.Sprintf("MAC address %s is already in use", e.MAC)}
+	}
+	return systemConflictBody{
+		Error:    fmt.Sprintf("MAC address %s already belongs to %s", e.MAC, systemLabel(e.System)),
+		SystemID: e.System.ID,
+	}
+}
+
+// systemConflict checks that no other system (id is the one being saved, 0
+// for a new one) has mac, or a newly given hostname among the systems the
+// caller can see. A duplicate hostname only warns: the request may be resent with
+// override=true, unless the unique_hostnames setting is on. It writes the
+// 409 and returns true on a conflict.
+func (s *Server) systemConflict(w http.ResponseWriter, r *http.Request, id int64, mac, hostname string) bool {
+	if norm, err := db.NormalizeMAC(mac); err == nil {
+		other, err := db.GetSystemByMAC(s.DB, norm)
+		if err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return true
+		}
+		if other != nil && other.ID != id {
+			writeSystemConflict(w, macConflict(r, &db.MACInUseError{MAC: norm, System: other}))
+			return true
+		}
+	}
+
+	unique := s.SettingBool("unique_hostnames")
+	if hostname == "" || (!unique && r.FormValue("override") == "true") {
+		return false
+	}
+	if id != 0 {
+		// Keeping a hostname it already had is no new conflict.
+		cur, err := db.GetSystemByID(s.DB, id)
+		if err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return true
+		}
+		if cur != nil && strings.EqualFold(cur.Hostname, hostname) {
+			return false
+		}
+	}
+	others, err := db.ListSystemsByHostname(s.DB, hostname)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return true
+	}
+	for _, other := range others {
+		if other.ID == id || !visibleTo(r, other.TenantID, false) {
+			continue
+		}
+		writeSystemConflict(w, systemConflictBody{
+			Error:       fmt.Sprintf("Hostname %s is already used by the system with MAC %s", hostname, other.MAC),
+			SystemID:    other.ID,
+			Overridable: !unique,
+		})
+		return true
+	}
+	return false
+}
+
+// archConflict says why img won't boot on sys, whose iPXE reported another
+// architecture than the image is for, or is "" if nothing says it won't.
+func archConflict(sys *db.System, img *db.Image) string {
+	if !ipxe.ArchMismatch(sys.IPXEBuildArch, img.Arch) {
+		return ""
+	}
+	return fmt.Sprintf("%s is for %s, but %s netboots as %s", img.Name, img.Arch, systemLabel(sys), sys.IPXEBuildArch)
+}
+
+// imageArchConflict refuses with 409 giving system id an image for another
+// architecture, unless the request says override=true. Keeping the image
+// it already has is no new conflict. It reports whether it wrote a
+// response.
+func (s *Server) imageArchConflict(w http.ResponseWriter, r *http.Request, id int64) bool {
+	imageID, err := optionalID(r.FormValue("image_id"))
+	if err != nil || imageID == nil || *imageID == 0 || r.FormValue("override") == "true" {
+		return false
+	}
+	sys, err := db.GetSystemByID(s.DB, id)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return true
+	}
+	if sys == nil || (sys.ImageID != nil && *sys.ImageID == *imageID) {
+		return false
+	}
+	img, err := db.GetImage(s.DB, *imageID)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return true
+	}
+	if img == nil || !visibleTo(r, img.TenantID, true) {
+		return false // refused as not found when the image is saved
+	}
+	if msg := archConflict(sys, img); msg != "" {
+		writeSystemConflict(w, systemConflictBody{Error: msg, Overridable: true})
+		return true
+	}
+	return false
+}
+
 func (s *Server) handleUpdateSystem(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
 	if err != nil {
@@ -136,7 +341,16 @@ func (s *Server) handleUpdateSystem(w http.ResponseWriter, r *http.Request) {
 	mac := r.FormValue("mac")
 	hostname := r.FormValue("hostname")
 	vars := r.FormValue("vars")
-	if err := db.UpdateSystemInfo(s.DB, id, mac, hostname); err != nil {
+	if s.systemConflict(w, r, id, mac, hostname) || s.imageArchConflict(w, r, id) {
+		return
+	}
+	err = db.UpdateSystemInfo(s.DB, id, mac, hostname)
+	var inUse *db.MACInUseError
+	if errors.As(err, &inUse) {
+		writeSystemConflict(w, macConflict(r, inUse))
+		return
+	}
+	if err != nil {
 		log.Printf("http: update system info: %v", err)
 		http.Error(w, "Failed to update system", http.StatusBadRequest)
 		return
@@ -146,6 +360,37 @@ func (s *Server) handleUpdateSystem(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	if _, ok := r.Form["tags"]; ok {
+		if err := db.UpdateSystemTags(s.DB, id, r.FormValue("tags")); err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, ok := r.Form["environment"]; ok {
+		env, err := s.formEnvironment(r.FormValue("environment"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := db.UpdateSystemEnvironment(s.DB, id, env); err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, ok := r.Form["tenant_id"]; ok && requestTenant(r) == nil {
+		tenantID, err := s.formTenant(r, r.FormValue("tenant_id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := db.UpdateSystemTenant(s.DB, id, tenantID); err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
 	// Update image assignment
 	imageIDStr := r.FormValue("image_id")
 	var imageID *int64
@@ -155,6 +400,18 @@ func (s *Server) handleUpdateSystem(w http.ResponseWriter, r *http.Request) {
 			imageID = &v
 		}
 	}
+	if imageID != nil {
+		ok, err := s.canUse(r, "image", *imageID)
+		if err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Image not found", http.StatusBadRequest)
+			return
+		}
+	}
 	if err := db.UpdateSystemImage(s.DB, id, imageID); err != nil {
 		log.Printf("http: update system image: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -169,6 +426,18 @@ func (s *Server) handleUpdateSystem(w http.ResponseWriter, r *http.Request) {
 			profileID = &v
 		}
 	}
+	if profileID != nil {
+		ok, err := s.canUse(r, "profile", *profileID)
+		if err != nil {
+			log.Printf("http: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Profile not found", http.StatusBadRequest)
+			return
+		}
+	}
 	if err := db.UpdateSystemProfile(s.DB, id, profileID); err != nil {
 		log.Printf("http: update system profile: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -218,8 +487,8 @@ func (s *Server) handleSystemStateAction(w http.ResponseWriter, r *http.Request)
 		}
 		newState = "queued"
 	case "cancel":
-		if sys.State != "queued" {
-			http.Error(w, "Can only cancel from queued state", http.StatusBadRequest)
+		if sys.State != "queued" && sys.State != "decommissioning" {
+			http.Error(w, "Can only cancel from queued or decommissioning state", http.StatusBadRequest)
 			return
 		}
 		if sys.Hostname != "" {
@@ -245,18 +514,68 @@ func (s *Server) handleSystemStateAction(w http.ResponseWriter, r *http.Request)
 			return
 		}
 		newState = "queued"
+	case "decommission":
+		if sys.State == "provisioning" || strings.HasPrefix(sys.State, "decommission") {
+			http.Error(w, fmt.Sprintf("Cannot decommission from state %s", sys.State), http.StatusBadRequest)
+			return
+		}
+		img, err := s.wipeImage()
+		if err != nil {
+			log.Printf("http: state action %s: %v", action, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if img == nil || img.Status != db.ImageStatusReady {
+			http.Error(w, "The Disk Wipe utility image must be ready before decommissioning", http.StatusConflict)
+			return
+		}
+		// A pending one-shot boot would be served ahead of the wipe.
+		if sys.OneshotImageID != nil {
+			if err := db.SetOneshotImage(s.DB, id, nil); err != nil {
+				log.Printf("http: state action %s: %v", action, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
+		newState = "decommissioning"
 	default:
 		http.Error(w, "Unknown action", http.StatusBadRequest)
 		return
 	}
 
+	if newState == "queued" {
+		conflict, err := s.environmentConflict(sys)
+		if err != nil {
+			log.Printf("http: state action %s: %v", action, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if conflict != "" {
+			if r.FormValue("override") != "true" {
+				http.Error(w, conflict, http.StatusConflict)
+				return
+			}
+			log.Printf("http: queuing %s despite environment mismatch: %s", sys.MAC, conflict)
+		}
+	}
+
 	if err := db.UpdateSystemState(s.DB, id, newState); err != nil {
 		log.Printf("http: state action %s: %v", action, err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
+	if updated, err := db.GetSystemByID(s.DB, id); err == nil && updated != nil {
+		updated.State = sys.State
+		sys = updated
+	}
 	s.fireSystemEvent(sys, newState)
+	if (newState == "queued" || newState == "decommissioning") && s.SettingBool("vm_netboot") {
+		s.vmNetworkBoot(sys)
+	}
+	if action == "reimage" {
+		s.queueAgentReimage(sys)
+	}
 	s.renderSystemRow(w, id)
 }
 
@@ -309,10 +628,15 @@ func (s *Server) renderSystemRow(w http.ResponseWriter, id int64) {
 	for _, p := range profiles {
 		profileNames[p.ID] = p.Name
 	}
+	installTimes, err := db.LastInstallTimes(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+	}
 	data := map[string]any{
 		"System":       sys,
 		"ImageNames":   imageNames,
 		"ProfileNames": profileNames,
+		"InstallTimes": installTimes,
 	}
 	if err := s.Templates.ExecuteTemplate(w, "system_row", data); err != nil {
 		log.Printf("http: render system row: %v", err)
@@ -339,7 +663,7 @@ func (s *Server) handleSetupPage(w http.ResponseWriter, r *http.Request) {
 		httpPort = s.HTTPAddr[i+1:]
 	}
 
-	serverURL := s.ServerURL
+	serverURL := s.serverURL()
 	if serverURL == "" {
 		serverURL = fmt.Sprintf("http://%s:%s", serverIP, httpPort)
 	}
@@ -347,31 +671,116 @@ func (s *Server) handleSetupPage(w http.ResponseWriter, r *http.Request) {
 	setupHash, _ := s.getAuthState()
 	globalConfirm, _ := db.GetSetting(s.DB, "confirm_reimage")
 	data := map[string]any{
-		"ServerIP":       serverIP,
-		"TFTPPort":       tftpPort,
-		"HTTPPort":       httpPort,
-		"ServerURL":      serverURL,
-		"ProxyDHCP":      s.ProxyDHCP,
-		"AuthEnabled":    setupHash != "",
-		"HasPassword":    setupHash != "",
-		"ConfirmGlobal":  globalConfirm == "1",
-		"Error":          r.URL.Query().Get("error"),
-		"Success":        r.URL.Query().Get("success"),
+		"ServerIP":      serverIP,
+		"TFTPPort":      tftpPort,
+		"HTTPPort":      httpPort,
+		"ServerURL":     serverURL,
+		"ProxyDHCP":     s.ProxyDHCP,
+		"AuthEnabled":   setupHash != "",
+		"HasPassword":   setupHash != "",
+		"ConfirmGlobal": globalConfirm == "1",
+		"VMProviders":   s.VMProviders,
+		"VMNetBoot":     s.SettingBool("vm_netboot"),
+		"Error":         r.URL.Query().Get("error"),
+		"Success":       r.URL.Query().Get("success"),
+	}
+	bootFiles, err := s.bootFilesData()
+	if err != nil {
+		log.Printf("http: list boot binaries: %v", err)
+	}
+	for k, v := range bootFiles {
+		data[k] = v
+	}
+	if data["DHCPOptions"], err = db.GetSetting(s.DB, "dhcp_options"); err != nil {
+		log.Printf("http: get dhcp options: %v", err)
+	}
+	if data["DHCPPolicy"], err = s.dhcpPolicyForm(); err != nil {
+		log.Printf("http: get dhcp policy: %v", err)
+	}
+	if data["Settings"], err = s.settingViews(); err != nil {
+		log.Printf("http: %v", err)
+	}
+	if data["DiskUsage"], err = s.diskUsage(); err != nil {
+		log.Printf("http: %v", err)
 	}
+	if data["NetBox"], err = s.netBoxForm(); err != nil {
+		log.Printf("http: get netbox settings: %v", err)
+	}
+	if data["BootHook"], err = s.bootHookForm(); err != nil {
+		log.Printf("http: get boot hook settings: %v", err)
+	}
+	data["GlobalVars"] = s.globalVarsForm()
+	if data["SecretStore"], err = s.secretStoreForm(); err != nil {
+		log.Printf("http: get secret store settings: %v", err)
+	}
+	if data["TPM"], err = s.tpmForm(); err != nil {
+		log.Printf("http: get tpm settings: %v", err)
+	}
+	if data["Environments"], err = db.ListEnvironments(s.DB); err != nil {
+		log.Printf("http: %v", err)
+	}
+	if data["CacheNodes"], err = db.ListCacheNodes(s.DB); err != nil {
+		log.Printf("http: %v", err)
+	}
+	if data["Schedules"], err = s.scheduleViews(); err != nil {
+		log.Printf("http: %v", err)
+	}
+	if backups, err := s.backupData(); err != nil {
+		log.Printf("http: get backup settings: %v", err)
+	} else {
+		for k, v := range backups {
+			data[k] = v
+		}
+	}
+	if tenants, users, tokens, err := s.tenantSettings(); err != nil {
+		log.Printf("http: %v", err)
+	} else {
+		data["Tenants"] = tenantViews(tenants, users, tokens)
+	}
+	s.addThemeData(r, data)
 	if err := s.Templates.ExecuteTemplate(w, "setup", data); err != nil {
 		log.Printf("http: render setup: %v", err)
 	}
 }
 
-func (s *Server) fireSystemEvent(sys *db.System, state string) {
-	s.Webhook.Fire(webhook.Event{
+// systemEvent is the webhook event for a system entering state.
+func systemEvent(sys *db.System, state string) webhook.Event {
+	data := map[string]any{
+		"id":       sys.ID,
+		"mac":      sys.MAC,
+		"hostname": sys.Hostname,
+		"ip_addr":  sys.IPAddr,
+		"state":    state,
+		"attempt":  sys.AttemptID,
+		"tags":     db.SplitTags(sys.Tags),
+	}
+	if sys.Environment != "" {
+		data["environment"] = sys.Environment
+	}
+	if state == "failed" && sys.FailMessage != "" {
+		data["phase"] = sys.FailPhase
+		data["message"] = sys.FailMessage
+	}
+	return webhook.Event{
 		Type: "system." + state,
-		Data: map[string]any{
-			"id":       sys.ID,
-			"mac":      sys.MAC,
-			"hostname": sys.Hostname,
-			"ip_addr":  sys.IPAddr,
-			"state":    state,
-		},
-	})
+		Data: data,
+	}
+}
+
+// fireIPChanged announces that sys was seen at a new address, having been
+// at prevIP.
+func (s *Server) fireIPChanged(sys *db.System, prevIP string) {
+	log.Printf("http: %s (%s) moved from %s to %s", sys.Hostname, sys.MAC, prevIP, sys.IPAddr)
+	ev := systemEvent(sys, "ip_changed")
+	ev.Data["state"] = sys.State
+	ev.Data["previous_ip_addr"] = prevIP
+	s.Webhook.Fire(ev)
+}
+
+// fireSystemEvent announces a system entering state and runs its
+// transitions. sys.State is still the state it left.
+func (s *Server) fireSystemEvent(sys *db.System, state string) {
+	s.Webhook.Fire(systemEvent(sys, state))
+	s.netBoxWriteBack(sys, state)
+	s.runTransitions(sys, state)
 }
@@ -1,12 +1,15 @@
 package httpserver
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
 	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/listing"
 	"github.com/justinpopa/duh/internal/webhook"
 )
 
@@ -17,41 +20,129 @@ func (s *Server) handleWebhooksPage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	pending, err := db.CountPendingEvents(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	triggers, err := db.ListTriggers(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 	hash, _ := s.getAuthState()
 	data := map[string]any{
 		"Webhooks":    webhooks,
+		"Pending":     pending,
+		"Triggers":    triggers,
 		"AuthEnabled": hash != "",
 	}
+	s.addThemeData(r, data)
 	if err := s.Templates.ExecuteTemplate(w, "webhooks", data); err != nil {
 		log.Printf("http: render webhooks: %v", err)
 	}
 }
 
 func (s *Server) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
-	url := strings.TrimSpace(r.FormValue("url"))
-	secret := r.FormValue("secret")
-	events := r.FormValue("events")
-	if url == "" {
+	wh := &db.Webhook{
+		URL:    strings.TrimSpace(r.FormValue("url")),
+		Secret: r.FormValue("secret"),
+		Events: r.FormValue("events"),
+	}
+	if wh.URL == "" {
 		http.Error(w, "URL is required", http.StatusBadRequest)
 		return
 	}
-	if events == "" {
-		events = "*"
+	if wh.Events == "" {
+		wh.Events = "*"
+	}
+	if err := readWebhookDelivery(r, wh); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	id, err := db.CreateWebhook(s.DB, url, secret, events)
+	id, err := db.CreateWebhook(s.DB, wh)
 	if err != nil {
 		log.Printf("http: create webhook: %v", err)
 		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
 		return
 	}
-	wh, err := db.GetWebhook(s.DB, id)
+	wh, err = db.GetWebhook(s.DB, id)
 	if err != nil || wh == nil {
 		log.Printf("http: get created webhook: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	data := map[string]any{"Webhook": wh}
+	s.renderWebhookRow(w, wh)
+}
+
+// readWebhookDelivery sets wh's filter and delivery mode from a form,
+// rejecting a filter that doesn't compile or a mode without what it needs.
+func readWebhookDelivery(r *http.Request, wh *db.Webhook) error {
+	wh.Filter = strings.TrimSpace(r.FormValue("filter"))
+	if wh.Filter != "" {
+		if _, err := webhook.CompileFilter(wh.Filter); err != nil {
+			return fmt.Errorf("invalid filter: %v", err)
+		}
+	}
+	wh.Mode = r.FormValue("mode")
+	wh.BatchInterval = 0
+	if v := strings.TrimSpace(r.FormValue("batch_interval")); v != "" && wh.Mode == db.WebhookBatch {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid batch interval %q", v)
+		}
+		wh.BatchInterval = n
+	}
+	return db.NormalizeWebhookMode(wh)
+}
+
+// handleAPIWebhooks lists webhooks without their secrets.
+func (s *Server) handleAPIWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := db.ListWebhooks(s.DB)
+	if err != nil {
+		log.Printf("http: list webhooks: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	pending, err := db.CountPendingEvents(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	rows := make([]map[string]any, len(webhooks))
+	for i, wh := range webhooks {
+		rows[i] = map[string]any{
+			"id":             wh.ID,
+			"url":            wh.URL,
+			"events":         db.SplitTags(wh.Events),
+			"filter":         wh.Filter,
+			"mode":           wh.Mode,
+			"batch_interval": wh.BatchInterval,
+			"enabled":        wh.Enabled,
+			"pending":        pending[wh.ID],
+			"created_at":     wh.CreatedAt,
+			"updated_at":     wh.UpdatedAt,
+		}
+	}
+	page, ok := listPage(w, r, rows, listing.Spec{Sort: "-id", Key: []string{"id"}})
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"webhooks": page.Rows, "next_cursor": page.Next})
+}
+
+// renderWebhookRow renders wh's row with the count of events it holds.
+func (s *Server) renderWebhookRow(w http.ResponseWriter, wh *db.Webhook) {
+	pending, err := db.CountPendingEvents(s.DB)
+	if err != nil {
+		log.Printf("http: %v", err)
+	}
+	data := map[string]any{"Webhook": wh, "Pending": pending[wh.ID]}
 	if err := s.Templates.ExecuteTemplate(w, "webhook_row", data); err != nil {
 		log.Printf("http: render webhook row: %v", err)
 	}
@@ -107,14 +198,38 @@ func (s *Server) handleToggleWebhook(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Webhook not found", http.StatusNotFound)
 		return
 	}
-	if err := db.UpdateWebhook(s.DB, id, wh.URL, wh.Secret, wh.Events, !wh.Enabled); err != nil {
+	wh.Enabled = !wh.Enabled
+	if err := db.UpdateWebhook(s.DB, wh); err != nil {
 		log.Printf("http: toggle webhook: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	wh.Enabled = !wh.Enabled
-	data := map[string]any{"Webhook": wh}
-	if err := s.Templates.ExecuteTemplate(w, "webhook_row", data); err != nil {
-		log.Printf("http: render webhook row: %v", err)
+	s.renderWebhookRow(w, wh)
+}
+
+// handleUpdateWebhook changes which events are sent to a webhook and how:
+// its filter, and whether they go out as they happen, in batches or as a
+// daily digest. Events already held go out with the next batch whatever the
+// new mode.
+func (s *Server) handleUpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	wh, err := db.GetWebhook(s.DB, id)
+	if err != nil || wh == nil {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err := readWebhookDelivery(r, wh); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := db.UpdateWebhook(s.DB, wh); err != nil {
+		log.Printf("http: update webhook: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
+	s.renderWebhookRow(w, wh)
 }
@@ -0,0 +1,401 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/justinpopa/duh/internal/catalog"
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/proxydhcp"
+)
+
+// Settings holding the first-run wizard's progress.
+const (
+	settingWizardStep    = "wizard_step"
+	settingWizardDone    = "wizard_done"
+	settingWizardTLSMode = "wizard_tls_mode"
+)
+
+// wizardSteps are the first-run steps in order.
+var wizardSteps = []struct {
+	Name  string
+	Title string
+}{
+	{"password", "Admin password"},
+	{"storage", "Data directory"},
+	{"network", "Network interface"},
+	{"dhcp", "DHCP test"},
+	{"tls", "HTTPS"},
+	{"image", "Starter image"},
+}
+
+func wizardStepIndex(name string) int {
+	for i, st := range wizardSteps {
+		if st.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// wizardPending reports whether the dashboard should send the admin to
+// the wizard: it hasn't been finished or skipped, and either it was
+// started or this is a fresh install with no password and no systems.
+func (s *Server) wizardPending() (bool, error) {
+	done, err := db.GetSetting(s.DB, settingWizardDone)
+	if err != nil || done == "1" {
+		return false, err
+	}
+	step, err := db.GetSetting(s.DB, settingWizardStep)
+	if err != nil || step != "" {
+		return step != "", err
+	}
+	if s.authEnabled() {
+		return false, nil
+	}
+	systems, err := db.ListSystems(s.DB)
+	return len(systems) == 0, err
+}
+
+// wizardInterface is a network interface offered on the network step.
+type wizardInterface struct {
+	Name string
+	IP   string
+}
+
+func wizardInterfaces() []wizardInterface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var out []wizardInterface
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ip, err := proxydhcp.InterfaceIP(iface.Name)
+		if err != nil {
+			continue
+		}
+		out = append(out, wizardInterface{Name: iface.Name, IP: ip.String()})
+	}
+	return out
+}
+
+// wizardServerIP is the address machines will reach duh on: the chosen
+// proxy DHCP interface's, or else the detected one's.
+func (s *Server) wizardServerIP() string {
+	if iface := s.Setting("dhcp_iface"); iface != "" {
+		if ip, err := proxydhcp.InterfaceIP(iface); err == nil {
+			return ip.String()
+		}
+	}
+	if _, ip, err := proxydhcp.DetectInterface(); err == nil {
+		return ip.String()
+	}
+	return "SERVER_IP"
+}
+
+func addrPort(addr, fallback string) string {
+	if _, p, err := net.SplitHostPort(addr); err == nil && p != "" {
+		return p
+	}
+	return fallback
+}
+
+func (s *Server) handleWizard(w http.ResponseWriter, r *http.Request) {
+	step := r.URL.Query().Get("step")
+	if wizardStepIndex(step) < 0 {
+		saved, err := db.GetSetting(s.DB, settingWizardStep)
+		if err != nil {
+			log.Printf("http: get wizard step: %v", err)
+		}
+		step = saved
+	}
+	if wizardStepIndex(step) < 0 {
+		step = wizardSteps[0].Name
+	}
+	if err := db.SetSetting(s.DB, settingWizardStep, step); err != nil {
+		log.Printf("http: set wizard step: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]any{
+		"Steps":   wizardSteps,
+		"Step":    step,
+		"Index":   wizardStepIndex(step),
+		"Error":   r.URL.Query().Get("error"),
+		"Success": r.URL.Query().Get("success"),
+	}
+	if i := wizardStepIndex(step); i > 0 {
+		data["Prev"] = wizardSteps[i-1].Name
+	}
+	switch step {
+	case "password":
+		data["HasPassword"] = s.authEnabled()
+	case "storage":
+		dir, err := filepath.Abs(s.DataDir)
+		if err != nil {
+			dir = s.DataDir
+		}
+		data["DataDir"] = dir
+		if free, err := freeSpace(s.DataDir); err == nil {
+			data["FreeBytes"] = free
+		}
+		imagesDir := filepath.Join(s.DataDir, "images")
+		if target, err := os.Readlink(imagesDir); err == nil {
+			data["ImagesPath"] = target
+			if free, err := freeSpace(target); err == nil {
+				data["ImagesFreeBytes"] = free
+			}
+		}
+	case "network":
+		data["Interfaces"] = wizardInterfaces()
+		detected, _, err := proxydhcp.DetectInterface()
+		if err != nil {
+			data["DetectError"] = err.Error()
+		}
+		data["Detected"] = detected
+		data["Iface"] = s.Setting("dhcp_iface")
+		saved, err := db.GetSetting(s.DB, "runtime_proxy_dhcp")
+		if err != nil {
+			log.Printf("http: get proxy dhcp setting: %v", err)
+		}
+		data["ProxyDHCP"] = saved == "true"
+	case "tls":
+		mode, err := db.GetSetting(s.DB, settingWizardTLSMode)
+		if err != nil {
+			log.Printf("http: get wizard tls mode: %v", err)
+		}
+		if mode == "" {
+			mode = "http"
+			if strings.HasPrefix(s.serverURL(), "https://") {
+				mode = "https"
+			}
+		}
+		data["TLSMode"] = mode
+		data["Certificate"] = s.checkCertificate(time.Now())
+		data["HTTPSRedirect"] = s.HTTPSRedirect()
+		ip := s.wizardServerIP()
+		data["HTTPURL"] = fmt.Sprintf("http://%s:%s", ip, addrPort(s.HTTPAddr, "8080"))
+		data["HTTPSURL"] = fmt.Sprintf("https://%s:%s", ip, addrPort(s.HTTPSAddr, "8443"))
+	case "image":
+		images, err := db.ListImages(s.DB)
+		if err != nil {
+			log.Printf("http: list images: %v", err)
+		}
+		pulled := make(map[string]bool, len(images))
+		for _, img := range images {
+			if img.CatalogID != "" {
+				pulled[img.CatalogID] = true
+			}
+		}
+		data["Pulled"] = pulled
+		if catalogURL := s.catalogURL(); catalogURL == "" {
+			data["CatalogError"] = "No catalog URL is set."
+		} else if cat, err := catalog.Fetch(catalogURL, s.catalogKey()); err != nil {
+			data["CatalogError"] = err.Error()
+		} else {
+			var entries []catalog.Entry
+			for _, e := range cat.Entries {
+				if !e.Utility {
+					entries = append(entries, e)
+				}
+			}
+			data["Entries"] = entries
+		}
+	}
+	s.addThemeData(r, data)
+	if err := s.Templates.ExecuteTemplate(w, "wizard", data); err != nil {
+		log.Printf("http: render wizard: %v", err)
+	}
+}
+
+func wizardRedirect(w http.ResponseWriter, r *http.Request, step, msg, msgType string) {
+	v := url.Values{"step": {step}}
+	if msg != "" {
+		v.Set(msgType, msg)
+	}
+	http.Redirect(w, r, "/wizard?"+v.Encode(), http.StatusFound)
+}
+
+// wizardNext moves the wizard past step, or finishes it after the last.
+func (s *Server) wizardNext(w http.ResponseWriter, r *http.Request, step string) {
+	i := wizardStepIndex(step)
+	if i+1 >= len(wizardSteps) {
+		s.finishWizard(w, r)
+		return
+	}
+	next := wizardSteps[i+1].Name
+	if err := db.SetSetting(s.DB, settingWizardStep, next); err != nil {
+		log.Printf("http: set wizard step: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	wizardRedirect(w, r, next, "", "")
+}
+
+func (s *Server) finishWizard(w http.ResponseWriter, r *http.Request) {
+	if err := db.SetSetting(s.DB, settingWizardDone, "1"); err != nil {
+		log.Printf("http: set wizard done: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := db.DeleteSetting(s.DB, settingWizardStep); err != nil {
+		log.Printf("http: clear wizard step: %v", err)
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// handleWizardStep saves one step. A "skip" field moves on without
+// saving anything.
+func (s *Server) handleWizardStep(w http.ResponseWriter, r *http.Request) {
+	step := r.PathValue("step")
+	if wizardStepIndex(step) < 0 {
+		http.Error(w, "Unknown step", http.StatusNotFound)
+		return
+	}
+	if r.FormValue("skip") != "" {
+		s.wizardNext(w, r, step)
+		return
+	}
+
+	switch step {
+	case "password":
+		if s.authEnabled() {
+			break
+		}
+		password := r.FormValue("password")
+		if password == "" {
+			wizardRedirect(w, r, step, "Password cannot be empty.", "error")
+			return
+		}
+		if password != r.FormValue("confirm") {
+			wizardRedirect(w, r, step, "Passwords do not match.", "error")
+			return
+		}
+		if err := s.setAdminPassword(w, password); err != nil {
+			log.Printf("http: %v", err)
+			wizardRedirect(w, r, step, "Internal error.", "error")
+			return
+		}
+	case "storage":
+		if r.FormValue("layout") == "separate" {
+			if err := s.linkImagesDir(strings.TrimSpace(r.FormValue("images_path"))); err != nil {
+				wizardRedirect(w, r, step, "Can't store images there: "+err.Error()+".", "error")
+				return
+			}
+		}
+	case "network":
+		iface := strings.TrimSpace(r.FormValue("iface"))
+		if iface != "" && !slices.ContainsFunc(wizardInterfaces(), func(i wizardInterface) bool { return i.Name == iface }) {
+			wizardRedirect(w, r, step, fmt.Sprintf("Interface %s has no IPv4 address.", iface), "error")
+			return
+		}
+		err := s.saveSettings(map[string]string{
+			"dhcp_iface": iface,
+			"proxy_dhcp": r.FormValue("proxy_dhcp"),
+		})
+		if err != nil {
+			wizardRedirect(w, r, step, err.Error(), "error")
+			return
+		}
+	case "tls":
+		mode := r.FormValue("mode")
+		values := map[string]string{"https_redirect": "false"}
+		switch mode {
+		case "http":
+			values["server_url"] = r.FormValue("http_url")
+		case "https":
+			values["server_url"] = r.FormValue("https_url")
+			values["https_redirect"] = r.FormValue("https_redirect")
+		case "acme":
+			// ACME needs -acme-domain and a restart; nothing to save yet.
+			values = nil
+		default:
+			wizardRedirect(w, r, step, "Pick how machines and browsers reach duh.", "error")
+			return
+		}
+		if err := s.saveSettings(values); err != nil {
+			wizardRedirect(w, r, step, err.Error(), "error")
+			return
+		}
+		if err := db.SetSetting(s.DB, settingWizardTLSMode, mode); err != nil {
+			log.Printf("http: set wizard tls mode: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	case "image":
+		id := r.FormValue("catalog_id")
+		if id == "" {
+			break
+		}
+		cat, err := catalog.Fetch(s.catalogURL(), s.catalogKey())
+		if err != nil {
+			wizardRedirect(w, r, step, err.Error(), "error")
+			return
+		}
+		i := slices.IndexFunc(cat.Entries, func(e catalog.Entry) bool { return e.ID == id })
+		if i < 0 {
+			wizardRedirect(w, r, step, "That image is no longer in the catalog.", "error")
+			return
+		}
+		if _, err := s.pullCatalogEntry(cat.Entries[i], false); err != nil &&
+			err.Error() != "already pulled" && err.Error() != "already downloading" {
+			log.Printf("http: catalog pull: %v", err)
+			wizardRedirect(w, r, step, "Failed to pull image.", "error")
+			return
+		}
+	}
+	s.wizardNext(w, r, step)
+}
+
+// handleWizardSkip leaves the wizard for good; everything it sets can be
+// changed on the setup page.
+func (s *Server) handleWizardSkip(w http.ResponseWriter, r *http.Request) {
+	s.finishWizard(w, r)
+}
+
+// linkImagesDir moves image storage out of the data directory by making
+// data/images a symlink to path. Only an empty images directory is
+// replaced, so existing images are never left behind.
+func (s *Server) linkImagesDir(path string) error {
+	if !filepath.IsAbs(path) {
+		return errors.New("the path must be absolute")
+	}
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return fmt.Errorf("create %s: %v", path, err)
+	}
+	imagesDir := filepath.Join(s.DataDir, "images")
+	if target, err := os.Readlink(imagesDir); err == nil {
+		if target == path {
+			return nil
+		}
+		return fmt.Errorf("images are already stored in %s", target)
+	}
+	entries, err := os.ReadDir(imagesDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read %s: %v", imagesDir, err)
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%s already holds images; move them first", imagesDir)
+	}
+	if err := os.Remove(imagesDir); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove %s: %v", imagesDir, err)
+	}
+	if err := os.Symlink(path, imagesDir); err != nil {
+		return fmt.Errorf("link %s: %v", imagesDir, err)
+	}
+	log.Printf("http: images now stored in %s", path)
+	return nil
+}
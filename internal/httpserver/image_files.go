@@ -0,0 +1,311 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/ipxe"
+)
+
+// defaultImageFiles returns the file names each boot type expects when an
+// image doesn't map its own.
+func defaultImageFiles(bootType string) db.ImageFiles {
+	switch bootType {
+	case "wimboot":
+		return db.ImageFiles{Kernel: "wimboot", Extra: map[string]string{
+			"BCD": "BCD", "boot.sdi": "boot.sdi", "boot.wim": "boot.wim",
+		}}
+	case "esxi":
+		return db.ImageFiles{Kernel: "mboot.efi", Extra: map[string]string{"boot.cfg": "boot.cfg"}}
+	case "iso":
+		return db.ImageFiles{Kernel: "memdisk", Extra: map[string]string{"boot.iso": "boot.iso"}}
+	case db.BootTypeISCSI:
+		// Plain sanboot needs no files; mapping a kernel switches to
+		// sanhook + installer.
+		return db.ImageFiles{}
+	default: // linux, nfs
+		return db.ImageFiles{Kernel: "vmlinuz", Initrds: []string{"initrd.img"}}
+	}
+}
+
+// resolveImageFiles overlays an image's file map on its boot type defaults.
+func resolveImageFiles(img *db.Image) db.ImageFiles {
+	files := defaultImageFiles(img.BootType)
+	custom := img.Files()
+	if custom.Kernel != "" {
+		files.Kernel = custom.Kernel
+	}
+	if len(custom.Initrds) > 0 {
+		files.Initrds = custom.Initrds
+	}
+	if len(custom.Extra) > 0 {
+		extra := make(map[string]string, len(files.Extra)+len(custom.Extra))
+		for role, name := range files.Extra {
+			extra[role] = name
+		}
+		for role, name := range custom.Extra {
+			extra[role] = name
+		}
+		files.Extra = extra
+	}
+	return files
+}
+
+// imageFileURLs signs a URL for every file an image boots with, on behalf of
+// sys. They point at the cache node for sys's site when there is one.
+func (s *Server) imageFileURLs(serverURL string, sys *db.System, img *db.Image) (kernel string, initrds []string, extra map[string]string) {
+	base := s.fileServerURL(serverURL, sys)
+	fileURL := func(name string) string {
+		return s.signURL(tokenPurposeImage, sys, fmt.Sprintf("%s/images/%d/file/%s", base, img.ID, name))
+	}
+	files := resolveImageFiles(img)
+	if files.Kernel != "" {
+		kernel = fileURL(files.Kernel)
+	}
+	for _, name := range files.Initrds {
+		initrds = append(initrds, fileURL(name))
+	}
+	extra = make(map[string]string, len(files.Extra))
+	for role, name := range files.Extra {
+		extra[role] = fileURL(name)
+	}
+	return kernel, initrds, extra
+}
+
+// imageScriptParams fills in the boot script parameters that depend only on
+// the image and the system booting it.
+func (s *Server) imageScriptParams(serverURL string, sys *db.System, img *db.Image) ipxe.ScriptParams {
+	kernelURL, initrdURLs, fileURLs := s.imageFileURLs(serverURL, sys, img)
+	var initrdURL string
+	if len(initrdURLs) > 0 {
+		initrdURL = initrdURLs[0]
+	}
+	params := ipxe.ScriptParams{
+		ServerURL:  serverURL,
+		ImageID:    img.ID,
+		KernelURL:  kernelURL,
+		InitrdURL:  initrdURL,
+		InitrdURLs: initrdURLs,
+		Cmdline:    img.Cmdline,
+		MAC:        sys.MAC,
+		Hostname:   sys.Hostname,
+		ExtraFileURLs: ipxe.ExtraFileURLs{
+			BCD:     fileURLs["BCD"],
+			BootSDI: fileURLs["boot.sdi"],
+			BootWIM: fileURLs["boot.wim"],
+			BootCfg: fileURLs["boot.cfg"],
+			BootISO: fileURLs["boot.iso"],
+		},
+		FileURLs:     fileURLs,
+		RootfsURL:    fileURLs[db.FileRoleRootfs],
+		ChecksumsURL: s.imageChecksumsURL(serverURL, sys, img),
+		Target:       img.BootTarget,
+	}
+	if img.BootType == "esxi" && params.ExtraFileURLs.BootCfg != "" {
+		params.ExtraFileURLs.BootCfg = s.esxiBootCfgURL(serverURL, sys, img)
+	}
+	s.addSignatureURLs(&params, serverURL, sys, img)
+	return params
+}
+
+// parseFileMapForm reads the file mapping fields from the image edit form:
+// map_kernel, map_initrds (comma or whitespace separated), map_rootfs, and
+// map_extra (one role=file per line).
+func parseFileMapForm(kernel, initrds, rootfs, extra string) (db.ImageFiles, error) {
+	var files db.ImageFiles
+	checkName := func(name string) error {
+		if name != filepath.Base(name) || name == "." || name == ".." {
+			return fmt.Errorf("invalid file name %q", name)
+		}
+		return nil
+	}
+
+	files.Kernel = strings.TrimSpace(kernel)
+	if files.Kernel != "" {
+		if err := checkName(files.Kernel); err != nil {
+			return files, err
+		}
+	}
+	for _, name := range strings.FieldsFunc(initrds, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\t' }) {
+		if err := checkName(name); err != nil {
+			return files, err
+		}
+		files.Initrds = append(files.Initrds, name)
+	}
+	for _, line := range strings.Split(extra, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		role, name, ok := strings.Cut(line, "=")
+		role, name = strings.TrimSpace(role), strings.TrimSpace(name)
+		if !ok || role == "" || name == "" {
+			return files, fmt.Errorf("extra files must be role=file, got %q", line)
+		}
+		if err := checkName(name); err != nil {
+			return files, err
+		}
+		if files.Extra == nil {
+			files.Extra = make(map[string]string)
+		}
+		files.Extra[role] = name
+	}
+	if rootfs = strings.TrimSpace(rootfs); rootfs != "" {
+		if err := checkName(rootfs); err != nil {
+			return files, err
+		}
+		if files.Extra == nil {
+			files.Extra = make(map[string]string)
+		}
+		files.Extra[db.FileRoleRootfs] = rootfs
+	}
+	return files, nil
+}
+
+// validateBootTarget checks the boot target form field against the boot
+// type. Other boot types ignore the target, so it is cleared for them.
+func validateBootTarget(bootType, target string) (string, error) {
+	target = strings.TrimSpace(target)
+	switch bootType {
+	case db.BootTypeNFS:
+		if target == "" {
+			return "", fmt.Errorf("NFS images need a boot target (server:/export)")
+		}
+		if server, path, ok := strings.Cut(target, ":"); !ok || server == "" || !strings.HasPrefix(path, "/") {
+			return "", fmt.Errorf("NFS boot target must be server:/export, got %q", target)
+		}
+	case db.BootTypeISCSI:
+		if target == "" {
+			return "", fmt.Errorf("iSCSI images need a boot target (iscsi:server::::iqn)")
+		}
+		if !strings.HasPrefix(target, "iscsi:") {
+			return "", fmt.Errorf("iSCSI boot target must start with iscsi:, got %q", target)
+		}
+	default:
+		return "", nil
+	}
+	return target, nil
+}
+
+// imageChecksumsURL signs the SHA256SUMS manifest URL for an image.
+func (s *Server) imageChecksumsURL(serverURL string, sys *db.System, img *db.Image) string {
+	return s.signURL(tokenPurposeImage, sys, fmt.Sprintf("%s/images/%d/SHA256SUMS", serverURL, img.ID))
+}
+
+// checksumCache remembers file hashes until the file's size or mtime
+// changes, so serving a manifest doesn't rehash multi-gigabyte rootfs
+// images on every boot.
+type checksumCache struct {
+	mu   sync.Mutex
+	sums map[string]cachedChecksum
+}
+
+type cachedChecksum struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// put records a checksum computed elsewhere, e.g. while a file was
+// uploaded.
+func (c *checksumCache) put(path string, info fs.FileInfo, sum string) {
+	c.mu.Lock()
+	if c.sums == nil {
+		c.sums = make(map[string]cachedChecksum)
+	}
+	c.sums[path] = cachedChecksum{size: info.Size(), modTime: info.ModTime(), sum: sum}
+	c.mu.Unlock()
+}
+
+func (c *checksumCache) sha256(path string, info fs.FileInfo) (string, error) {
+	c.mu.Lock()
+	cached, ok := c.sums[path]
+	c.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.sum, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	c.mu.Lock()
+	if c.sums == nil {
+		c.sums = make(map[string]cachedChecksum)
+	}
+	c.sums[path] = cachedChecksum{size: info.Size(), modTime: info.ModTime(), sum: sum}
+	c.mu.Unlock()
+	return sum, nil
+}
+
+// handleImageChecksums serves a sha256sum-compatible manifest of every file
+// stored for an image, so installers can verify what they fetched.
+func (s *Server) handleImageChecksums(w http.ResponseWriter, r *http.Request) {
+	bound, ok := s.validateToken(r, tokenPurposeImage)
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if bound != nil && !s.imageBound(bound, id) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	imageDir := filepath.Join(s.DataDir, "images", fmt.Sprintf("%d", id))
+	entries, err := os.ReadDir(imageDir)
+	if os.IsNotExist(err) {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("http: read image dir: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	var buf strings.Builder
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		sum, err := s.checksums.sha256(filepath.Join(imageDir, e.Name()), info)
+		if err != nil {
+			log.Printf("http: checksum %s: %v", e.Name(), err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(&buf, "%s  %s\n", sum, e.Name())
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, buf.String())
+}
@@ -0,0 +1,130 @@
+package httpserver
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// Every server duh runs waits a bounded time for request headers and
+// closes idle keep-alive connections, so a client can't hold one open by
+// trickling bytes. Past the headers, each route gets a body limit and
+// deadlines from routeLimits.
+const (
+	readHeaderTimeout = 10 * time.Second
+	idleTimeout       = 2 * time.Minute
+	maxHeaderBytes    = 64 << 10
+)
+
+// Limits for routes not in routeLimits, which take small forms or JSON
+// and answer promptly.
+const (
+	defaultMaxBody      = 1 << 20
+	defaultReadTimeout  = 30 * time.Second
+	defaultWriteTimeout = 5 * time.Minute
+)
+
+// uploadIdleTimeout is how long an upload may go without sending
+// anything before it is dropped.
+const uploadIdleTimeout = time.Minute
+
+// NewHTTPServer returns a server for addr with duh's header and
+// connection limits.
+func NewHTTPServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+}
+
+type routeLimit struct {
+	body   int64 // largest request body; 0 leaves it to the handler
+	upload bool  // a large body, which only has to keep arriving
+	stream bool  // a large or long-lived response, with no deadline
+}
+
+// routeLimits are the routes that don't fit the defaults, by pattern.
+var routeLimits = map[string]routeLimit{
+	// Files machines boot from, and other large downloads
+	"GET /images/{id}/file/{name}":              {stream: true},
+	"GET /profiles/{id}/overlay/{name}":         {stream: true},
+	"GET /mirror/{name}/{path...}":              {stream: true},
+	"GET /drivers/{id}/file/{name}":             {stream: true},
+	"GET /utilities/disk-wipe.apkovl.tar.gz":    {stream: true},
+	"GET /decommission/{id}/wipe.apkovl.tar.gz": {stream: true},
+	"GET /api/v1/ipxe/build-kit.tar.gz":         {stream: true},
+	"GET /api/v1/ipxe/media/{name}":             {stream: true},
+	"GET /tftp-inbox/{mac}/{name}":              {stream: true},
+	"GET /api/v1/backup-store/{name}":           {stream: true},
+
+	// Uploads, each capped by its handler
+	"PUT /api/v1/images/{id}/builds/{build}/files/{name}": {upload: true},
+	"POST /images/upload":             {upload: true},
+	"PATCH /api/v1/uploads/{upload}":  {upload: true},
+	"POST /binaries":                  {upload: true},
+	"POST /binaries/bundles":          {upload: true},
+	"POST /drivers":                   {upload: true},
+	"POST /profiles":                  {upload: true},
+	"POST /profiles/{id}":             {upload: true},
+	"PUT /api/v1/backup-store/{name}": {body: maxStoredBackup, upload: true},
+	"POST /import/{source}":           {body: maxImportSize, upload: true},
+	"POST /api/v1/import/{source}":    {body: maxImportSize, upload: true},
+
+	// Event streams, consoles, and restores downloading a remote backup
+	"GET /upload-progress/{id}":    {stream: true},
+	"GET /systems/{id}/console/ws": {stream: true},
+	"POST /api/v1/agent/console":   {stream: true},
+	"POST /backups/restore":        {body: defaultMaxBody, stream: true},
+}
+
+// limitMiddleware applies the body limit and deadlines of the route mux
+// would send each request to.
+func limitMiddleware(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		lim, ok := routeLimits[pattern]
+		if !ok {
+			lim = routeLimit{body: defaultMaxBody}
+		}
+		rc := http.NewResponseController(w)
+
+		// The connection's deadlines outlive the request, so every
+		// request sets its own.
+		if lim.stream || lim.upload {
+			rc.SetWriteDeadline(time.Time{})
+		} else {
+			rc.SetWriteDeadline(time.Now().Add(defaultWriteTimeout))
+		}
+		if r.Body != http.NoBody && !lim.stream {
+			start := time.Now()
+			deadline := func() time.Time { return start.Add(defaultReadTimeout) }
+			if lim.upload {
+				deadline = func() time.Time { return time.Now().Add(uploadIdleTimeout) }
+			}
+			r.Body = &deadlineBody{ReadCloser: r.Body, rc: rc, deadline: deadline}
+		}
+		if lim.body > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, lim.body)
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// deadlineBody holds each read of a request body to a deadline. It is
+// cleared between reads: a deadline left on the connection would cancel
+// the request once the handler has stopped reading.
+type deadlineBody struct {
+	io.ReadCloser
+	rc       *http.ResponseController
+	deadline func() time.Time
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	b.rc.SetReadDeadline(b.deadline())
+	n, err := b.ReadCloser.Read(p)
+	b.rc.SetReadDeadline(time.Time{})
+	return n, err
+}
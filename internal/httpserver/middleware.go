@@ -13,6 +13,9 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/tracing"
 )
 
 type responseWriter struct {
@@ -25,6 +28,12 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer, e.g.
+// to flush server-sent events.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -34,6 +43,40 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// TracingMiddleware records a server span for each request, named after
+// the route it matched, when tracing is enabled.
+func TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tracing.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, span := tracing.StartServer(r, r.Method)
+		defer span.End()
+		r = r.WithContext(ctx)
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		// The mux fills in the pattern on the request it was handed.
+		route := r.Pattern
+		if _, path, ok := strings.Cut(route, " "); ok {
+			route = path
+		}
+		if route != "" {
+			span.SetName(r.Method + " " + route)
+			span.SetAttr("http.route", route)
+		}
+		span.SetAttr("http.request.method", r.Method)
+		span.SetAttr("url.path", r.URL.Path)
+		span.SetAttr("client.address", clientAddr(r))
+		span.SetAttr("user_agent.original", r.UserAgent())
+		span.SetAttr("http.response.status_code", rw.status)
+		if rw.status >= 500 {
+			span.Fail(http.StatusText(rw.status))
+		}
+	})
+}
+
 func RecoveryMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -51,27 +94,25 @@ const (
 	sessionMaxAge     = 30 * 24 * 60 * 60 // 30 days in seconds
 )
 
-// HTTPSRedirectMiddleware redirects browser HTTP requests to HTTPS.
-// The entire boot/provisioning chain is excluded: iPXE clients (by User-Agent)
-// and machine-to-machine paths (configs, images, API callbacks, iPXE binaries).
-func HTTPSRedirectMiddleware(httpsPort string, next http.Handler) http.Handler {
+// HTTPPolicyMiddleware applies the HTTP listener's policy, read on each
+// request so the settings can change without a restart. While bootOnly
+// returns true only the boot chain is served over HTTP; while redirect
+// returns true browsers are sent to HTTPS. iPXE clients (by User-Agent) and
+// boot-chain paths are always served, and API clients, which don't follow
+// redirects, are served unless bootOnly is on.
+func HTTPPolicyMiddleware(httpsPort string, redirect, bootOnly func() bool, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Skip redirect for iPXE clients
-		if strings.Contains(r.UserAgent(), "iPXE") {
+		p := r.URL.Path
+		if strings.Contains(r.UserAgent(), "iPXE") || bootChainPath(p) {
 			next.ServeHTTP(w, r)
 			return
 		}
-
-		// Skip redirect for boot-chain paths (hit by installers, not browsers)
-		p := r.URL.Path
-		if strings.HasPrefix(p, "/api/") ||
-			strings.HasPrefix(p, "/config/") ||
-			strings.HasPrefix(p, "/images/") ||
-			strings.HasPrefix(p, "/profiles/") && strings.Contains(p, "/overlay/") ||
-			p == "/boot.ipxe" ||
-			p == "/ipxe.efi" ||
-			p == "/ipxe-arm64.efi" ||
-			p == "/undionly.kpxe" {
+		noRedirect := !redirect() || strings.HasPrefix(p, "/api/")
+		switch {
+		case bootOnly() && noRedirect:
+			http.Error(w, "Only the boot chain is served over HTTP; use HTTPS", http.StatusForbidden)
+			return
+		case noRedirect:
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -90,17 +131,77 @@ func HTTPSRedirectMiddleware(httpsPort string, next http.Handler) http.Handler {
 	})
 }
 
+// bootChainPath reports whether p is fetched by machines being provisioned
+// — iPXE, installers and the duh agent — or by health probes, rather than
+// by browsers.
+func bootChainPath(p string) bool {
+	switch p {
+	case "/boot.ipxe", "/ipxe.efi", "/ipxe-arm64.efi", "/undionly.kpxe", "/announce", "/pki/ca.pem",
+		"/utilities/disk-wipe.apkovl.tar.gz", "/healthz", "/livez", "/readyz":
+		return true
+	}
+	for _, prefix := range []string{"/ipxe/", "/config/", "/mirror/", "/answer/", "/api/v1/agent/"} {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	seg := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	switch {
+	case len(seg) >= 3 && seg[0] == "images":
+		return seg[2] == "file" || seg[2] == "SHA256SUMS" || seg[2] == "torrent" || seg[2] == "sig" || seg[2] == "esxi"
+	case len(seg) == 4 && seg[0] == "profiles":
+		return seg[2] == "overlay"
+	case len(seg) == 4 && seg[0] == "drivers":
+		return seg[2] == "file"
+	case len(seg) == 3 && seg[0] == "decommission":
+		return seg[2] == "wipe.apkovl.tar.gz"
+	case len(seg) == 5 && seg[0] == "api" && seg[1] == "v1" && seg[2] == "systems":
+		// Keyed by MAC, called from the machine itself.
+		return seg[4] == "callback" || seg[4] == "heartbeat" || seg[4] == "wipe" || seg[4] == "boot-ack"
+	}
+	return false
+}
+
 // AuthMiddleware wraps a handler to require authentication when a password is set.
+// Tenant users and API tokens are let through with their tenant on the
+// request; see requestTenant.
 func (s *Server) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && strings.HasPrefix(token, db.APITokenPrefix) {
+			t, err := db.TenantForToken(s.DB, token)
+			if err != nil {
+				log.Printf("http: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if t == nil {
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+			next(w, withTenant(r, t))
+			return
+		}
 		hash, key := s.getAuthState()
 		if hash == "" {
 			next(w, r)
 			return
 		}
-		if s.validateSession(r, key) {
-			next(w, r)
-			return
+		if userID, ok := s.validateSession(r, key); ok {
+			if userID == 0 {
+				next(w, r)
+				return
+			}
+			t, err := s.userTenant(userID)
+			if err != nil {
+				log.Printf("http: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			// A deleted user's session is no longer valid.
+			if t != nil {
+				next(w, withTenant(r, t))
+				return
+			}
 		}
 		// Not authenticated
 		if r.Header.Get("HX-Request") == "true" {
@@ -108,14 +209,24 @@ func (s *Server) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		http.Redirect(w, r, "/login", http.StatusFound)
+		// Come back to the page after signing in, e.g. one opened from a
+		// scanned label.
+		target := "/login"
+		if r.Method == http.MethodGet && r.URL.Path != "/" {
+			target += "?" + url.Values{"next": {r.URL.RequestURI()}}.Encode()
+		}
+		http.Redirect(w, r, target, http.StatusFound)
 	}
 }
 
-// createSession creates a signed session cookie value.
-func (s *Server) createSession(w http.ResponseWriter, key []byte) {
+// createSession creates a signed session cookie value. userID is the
+// tenant user signing in, or 0 for the admin.
+func (s *Server) createSession(w http.ResponseWriter, key []byte, userID int64) {
 	expiry := time.Now().Add(time.Duration(sessionMaxAge) * time.Second).Unix()
 	payload := fmt.Sprintf("%d", expiry)
+	if userID != 0 {
+		payload += fmt.Sprintf(":%d", userID)
+	}
 	mac := hmac.New(sha256.New, key)
 	mac.Write([]byte(payload))
 	sig := mac.Sum(nil)
@@ -130,38 +241,49 @@ func (s *Server) createSession(w http.ResponseWriter, key []byte) {
 	})
 }
 
-// validateSession checks if the request has a valid session cookie.
-func (s *Server) validateSession(r *http.Request, key []byte) bool {
+// validateSession checks if the request has a valid session cookie, and
+// returns the tenant user it is for, or 0 for the admin.
+func (s *Server) validateSession(r *http.Request, key []byte) (int64, bool) {
 	if len(key) == 0 {
-		return false
+		return 0, false
 	}
 	cookie, err := r.Cookie(sessionCookieName)
 	if err != nil {
-		return false
+		return 0, false
 	}
 	raw, err := base64.RawURLEncoding.DecodeString(cookie.Value)
 	if err != nil {
-		return false
+		return 0, false
 	}
 	parts := strings.SplitN(string(raw), "|", 2)
 	if len(parts) != 2 {
-		return false
+		return 0, false
 	}
-	expiryStr, sigB64 := parts[0], parts[1]
+	payload, sigB64 := parts[0], parts[1]
+	expiryStr, userStr, hasUser := strings.Cut(payload, ":")
 	expiry, err := strconv.ParseInt(expiryStr, 10, 64)
 	if err != nil {
-		return false
+		return 0, false
 	}
 	if time.Now().Unix() > expiry {
-		return false
+		return 0, false
+	}
+	var userID int64
+	if hasUser {
+		if userID, err = strconv.ParseInt(userStr, 10, 64); err != nil {
+			return 0, false
+		}
 	}
 	sig, err := base64.RawURLEncoding.DecodeString(sigB64)
 	if err != nil {
-		return false
+		return 0, false
 	}
 	mac := hmac.New(sha256.New, key)
-	mac.Write([]byte(expiryStr))
-	return hmac.Equal(mac.Sum(nil), sig)
+	mac.Write([]byte(payload))
+	if !hmac.Equal(mac.Sum(nil), sig) {
+		return 0, false
+	}
+	return userID, true
 }
 
 // clearSession removes the session cookie.
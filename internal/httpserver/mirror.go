@@ -0,0 +1,286 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+	"golang.org/x/sync/singleflight"
+)
+
+// packageMirror is an upstream package repository duh caches for
+// installers, at /mirror/<Name>/.
+type packageMirror struct {
+	Name     string
+	Upstream string
+}
+
+var mirrorNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// parseMirrors reads the package_mirrors setting: name=URL pairs separated
+// by spaces or commas.
+func parseMirrors(v string) ([]packageMirror, error) {
+	var mirrors []packageMirror
+	seen := map[string]bool{}
+	for _, pair := range strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' || r == '\n' }) {
+		name, upstream, ok := strings.Cut(pair, "=")
+		if !ok || !mirrorNameRe.MatchString(name) {
+			return nil, fmt.Errorf("%q is not name=URL", pair)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("mirror %s is given twice", name)
+		}
+		u, err := url.Parse(upstream)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("mirror %s: %q is not an http or https URL", name, upstream)
+		}
+		seen[name] = true
+		mirrors = append(mirrors, packageMirror{Name: name, Upstream: strings.TrimRight(upstream, "/")})
+	}
+	return mirrors, nil
+}
+
+// packageMirrors returns the configured mirrors.
+func (s *Server) packageMirrors() []packageMirror {
+	mirrors, err := parseMirrors(s.Setting("package_mirrors"))
+	if err != nil {
+		log.Printf("http: package_mirrors: %v", err)
+	}
+	return mirrors
+}
+
+// siteMirror is a repository local to a site, used instead of duh's own
+// mirror of the same name by systems on the site's subnets.
+type siteMirror struct {
+	Site string
+	packageMirror
+}
+
+// parseSiteMirrors reads the site_mirrors setting: site/name=URL pairs
+// separated by spaces or commas. The name is after the key's last slash,
+// so sites can contain slashes.
+func parseSiteMirrors(v string) ([]siteMirror, error) {
+	var mirrors []siteMirror
+	seen := map[string]bool{}
+	for _, pair := range strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' || r == '\n' }) {
+		key, upstream, _ := strings.Cut(pair, "=")
+		i := strings.LastIndex(key, "/")
+		if i < 0 {
+			return nil, fmt.Errorf("%q is not site/name=URL", pair)
+		}
+		site := db.NormalizeTags(key[:i])
+		if site == "" || strings.Contains(site, ",") {
+			return nil, fmt.Errorf("%q is not site/name=URL", pair)
+		}
+		m, err := parseMirrors(key[i+1:] + "=" + upstream)
+		if err != nil || len(m) != 1 {
+			return nil, fmt.Errorf("%q is not site/name=URL", pair)
+		}
+		if seen[site+"/"+m[0].Name] {
+			return nil, fmt.Errorf("mirror %s/%s is given twice", site, m[0].Name)
+		}
+		seen[site+"/"+m[0].Name] = true
+		mirrors = append(mirrors, siteMirror{Site: site, packageMirror: m[0]})
+	}
+	return mirrors, nil
+}
+
+// mirrorURLs maps each mirror's name to its URL for a system at site, for
+// config templates: the site's own repository if it has one, otherwise
+// duh's mirror on this server.
+func (s *Server) mirrorURLs(serverURL, site string) map[string]string {
+	urls := map[string]string{}
+	for _, m := range s.packageMirrors() {
+		urls[m.Name] = serverURL + "/mirror/" + m.Name
+	}
+	if site == "" {
+		return urls
+	}
+	local, err := parseSiteMirrors(s.Setting("site_mirrors"))
+	if err != nil {
+		log.Printf("http: site_mirrors: %v", err)
+	}
+	for _, m := range local {
+		if m.Site == site {
+			urls[m.Name] = m.Upstream
+		}
+	}
+	return urls
+}
+
+// mirrorMetadataTTL is how long repository metadata is served from the
+// cache before duh asks the upstream whether it changed.
+const mirrorMetadataTTL = 5 * time.Minute
+
+// mirrorClient fetches from upstreams, through the environment's proxy if
+// there is one. Packages can be large, so only the wait for headers is
+// limited.
+var mirrorClient = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	ResponseHeaderTimeout: 30 * time.Second,
+}}
+
+// immutablePackageFile reports whether a repository path names a file
+// that never changes once published: packages, and metadata addressed by
+// its hash. Everything else, such as Release files and repomd.xml, is
+// metadata that is revalidated.
+func immutablePackageFile(p string) bool {
+	switch path.Ext(p) {
+	case ".deb", ".udeb", ".ddeb", ".rpm", ".drpm", ".apk":
+		return true
+	}
+	if strings.Contains(p, "/by-hash/") {
+		return true
+	}
+	// repodata files are named <sha256>-primary.xml.gz and the like.
+	dir, file := path.Split(p)
+	if strings.HasSuffix(dir, "repodata/") {
+		hash, _, ok := strings.Cut(file, "-")
+		return ok && len(hash) >= 32 && strings.Trim(hash, "0123456789abcdef") == ""
+	}
+	return false
+}
+
+// mirrorFetches makes concurrent requests for the same file share one
+// upstream fetch.
+var mirrorFetches singleflight.Group
+
+// handleMirror serves a file from a package mirror, from the cache when it
+// can: packages once fetched, metadata for mirrorMetadataTTL and after
+// that whenever the upstream can't be reached. With package_offline on the
+// upstream is never asked, for air-gapped sites whose cache was copied in.
+// Installers fetch without tokens, as they would from any mirror; only
+// configured upstreams are fetched from.
+func (s *Server) handleMirror(w http.ResponseWriter, r *http.Request) {
+	var mirror *packageMirror
+	for _, m := range s.packageMirrors() {
+		if m.Name == r.PathValue("name") {
+			mirror = &m
+			break
+		}
+	}
+	if mirror == nil {
+		http.Error(w, "Unknown mirror", http.StatusNotFound)
+		return
+	}
+	rel := path.Clean("/" + r.PathValue("path"))
+	if rel == "/" || strings.HasSuffix(r.PathValue("path"), "/") {
+		http.Error(w, "Directory listings are not served", http.StatusNotFound)
+		return
+	}
+	cached := filepath.Join(s.DataDir, "package-cache", mirror.Name, filepath.FromSlash(rel))
+
+	info, statErr := os.Stat(cached)
+	fresh := statErr == nil && (immutablePackageFile(rel) || time.Since(info.ModTime()) < mirrorMetadataTTL)
+	if !fresh && !s.SettingBool("package_offline") {
+		_, err, _ := mirrorFetches.Do(cached, func() (any, error) {
+			return nil, s.fetchMirrorFile(mirror, rel, cached)
+		})
+		switch {
+		case errors.Is(err, errQuota):
+			// Not cached, so pass the file straight through.
+			log.Printf("http: mirror %s%s: %v", mirror.Name, rel, err)
+			s.proxyMirrorFile(w, r, mirror, rel)
+			return
+		case errors.Is(err, fs.ErrNotExist):
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		case err != nil && statErr == nil:
+			log.Printf("http: mirror %s%s: %v; serving the cached copy", mirror.Name, rel, err)
+		case err != nil:
+			log.Printf("http: mirror %s%s: %v", mirror.Name, rel, err)
+			http.Error(w, "Upstream fetch failed", http.StatusBadGateway)
+			return
+		}
+	}
+	tw, done := s.bandwidth.start(w, r, clientAddr(r), s.imageRateLimits)
+	defer done()
+	http.ServeFile(tw, r, cached)
+}
+
+// fetchMirrorFile brings the cached copy of a mirror file up to date,
+// asking the upstream only for a newer one than the cache has. A file the
+// upstream doesn't have is fs.ErrNotExist.
+func (s *Server) fetchMirrorFile(m *packageMirror, rel, cached string) error {
+	req, err := http.NewRequest(http.MethodGet, m.Upstream+rel, nil)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(cached); err == nil {
+		req.Header.Set("If-Modified-Since", info.ModTime().UTC().Format(http.TimeFormat))
+	}
+	resp, err := mirrorClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		now := time.Now()
+		return os.Chtimes(cached, now, now)
+	case resp.StatusCode == http.StatusNotFound:
+		return fs.ErrNotExist
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	if err := s.checkQuota(areaPackages, max(resp.ContentLength, 0), 0); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cached), ".fetch-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return fmt.Errorf("upstream sent %d of %d bytes", n, resp.ContentLength)
+	}
+	return os.Rename(tmp.Name(), cached)
+}
+
+// proxyMirrorFile passes a file from the upstream to the client without
+// caching it.
+func (s *Server) proxyMirrorFile(w http.ResponseWriter, r *http.Request, m *packageMirror, rel string) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, m.Upstream+rel, nil)
+	if err != nil {
+		http.Error(w, "Upstream fetch failed", http.StatusBadGateway)
+		return
+	}
+	resp, err := mirrorClient.Do(req)
+	if err != nil {
+		log.Printf("http: mirror %s%s: %v", m.Name, rel, err)
+		http.Error(w, "Upstream fetch failed", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for _, h := range []string{"Content-Type", "Content-Length", "Last-Modified"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	tw, done := s.bandwidth.start(w, r, clientAddr(r), s.imageRateLimits)
+	defer done()
+	io.Copy(tw, resp.Body)
+}
@@ -0,0 +1,357 @@
+package httpserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// maxFormValues caps the non-file fields of a streamed form, which are
+// held in memory.
+const maxFormValues = 10 << 20
+
+// streamedForm is a multipart form whose files were written to a staging
+// directory as they arrived, rather than buffered by ParseMultipartForm
+// and copied again. The staging directory sits under the data directory
+// so files can be renamed into place.
+type streamedForm struct {
+	Values url.Values
+	Files  map[string][]stagedFile // by form field
+	dir    string
+}
+
+type stagedFile struct {
+	Name   string // base name from the client
+	Path   string
+	Size   int64
+	SHA256 string
+}
+
+// File returns the first file sent for a field.
+func (f *streamedForm) File(field string) (stagedFile, bool) {
+	files := f.Files[field]
+	if len(files) == 0 {
+		return stagedFile{}, false
+	}
+	return files[0], true
+}
+
+// Close removes files that were not installed.
+func (f *streamedForm) Close() {
+	os.RemoveAll(f.dir)
+}
+
+// streamMultipart reads a multipart request part by part. With a progress
+// query parameter, per-file progress is published for handleUploadProgress.
+func (s *Server) streamMultipart(w http.ResponseWriter, r *http.Request, maxSize int64) (*streamedForm, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	form := &streamedForm{
+		Values: url.Values{},
+		Files:  map[string][]stagedFile{},
+		dir:    filepath.Join(s.DataDir, "uploads", "form-"+hex.EncodeToString(b)),
+	}
+	if err := os.MkdirAll(form.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	tracker := s.progress.start(r.URL.Query().Get("progress"), requestTenantID(r), r.ContentLength)
+	defer tracker.finish()
+
+	var valueBytes int64
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			form.Close()
+			return nil, err
+		}
+		field := part.FormName()
+		if field == "" {
+			part.Close()
+			continue
+		}
+		if part.FileName() == "" {
+			v, err := io.ReadAll(io.LimitReader(part, maxFormValues-valueBytes+1))
+			part.Close()
+			if err != nil {
+				form.Close()
+				return nil, err
+			}
+			if valueBytes += int64(len(v)); valueBytes > maxFormValues {
+				form.Close()
+				return nil, errors.New("form values too large")
+			}
+			form.Values.Add(field, string(v))
+			continue
+		}
+
+		name := filepath.Base(part.FileName())
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			form.Close()
+			return nil, fmt.Errorf("invalid file name %q", part.FileName())
+		}
+		sf, err := form.stage(name, part, tracker)
+		part.Close()
+		if err != nil {
+			form.Close()
+			return nil, err
+		}
+		form.Files[field] = append(form.Files[field], sf)
+	}
+	return form, nil
+}
+
+// stage copies one file part to the staging directory, hashing it on the
+// way.
+func (f *streamedForm) stage(name string, src io.Reader, tracker *progressTracker) (stagedFile, error) {
+	out, err := os.CreateTemp(f.dir, "part-*")
+	if err != nil {
+		return stagedFile{}, err
+	}
+	h := sha256.New()
+	cw := &countingWriter{h: h, onWrite: func(n int64) { tracker.file(name, n, "") }}
+	n, err := io.Copy(out, io.TeeReader(src, cw))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return stagedFile{}, fmt.Errorf("receive %s: %w", name, err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	tracker.file(name, n, sum)
+	return stagedFile{Name: name, Path: out.Name(), Size: n, SHA256: sum}, nil
+}
+
+// install moves a staged file to dst and remembers its checksum, so the
+// SHA256SUMS manifest doesn't read it again.
+func (s *Server) install(sf stagedFile, dst string) error {
+	if err := os.Rename(sf.Path, dst); err != nil {
+		return err
+	}
+	if info, err := os.Stat(dst); err == nil {
+		s.checksums.put(dst, info, sf.SHA256)
+	}
+	return nil
+}
+
+type countingWriter struct {
+	h       hash.Hash
+	n       int64
+	onWrite func(total int64)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.h.Write(p)
+	c.n += int64(len(p))
+	c.onWrite(c.n)
+	return len(p), nil
+}
+
+// uploadEvent is one progress update sent to the browser.
+type uploadEvent struct {
+	File     string `json:"file,omitempty"`
+	Bytes    int64  `json:"bytes"`
+	Total    int64  `json:"total,omitempty"` // whole request, when known
+	SHA256   string `json:"sha256,omitempty"`
+	Complete bool   `json:"complete,omitempty"`
+}
+
+var progressIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+
+// progressHub holds the latest progress of uploads that asked for it, for
+// handleUploadProgress to stream as server-sent events.
+type progressHub struct {
+	mu      sync.Mutex
+	streams map[string]*progressStream
+}
+
+type progressStream struct {
+	tenant   int64 // the tenant that asked for it first, 0 for the admin
+	started  bool  // an upload reports to it
+	watchers int
+	last     uploadEvent
+	changed  chan struct{} // closed and replaced on every update
+}
+
+// stream returns id's stream, creating it for tenant if there is none, or
+// nil if it belongs to another tenant.
+func (h *progressHub) stream(id string, tenant int64) *progressStream {
+	if h.streams == nil {
+		h.streams = make(map[string]*progressStream)
+	}
+	st := h.streams[id]
+	if st == nil {
+		st = &progressStream{tenant: tenant, changed: make(chan struct{})}
+		h.streams[id] = st
+		// Drop it eventually even if the upload never arrives.
+		time.AfterFunc(6*time.Hour, func() { h.remove(id, st) })
+	}
+	if st.tenant != tenant {
+		return nil
+	}
+	return st
+}
+
+func (h *progressHub) remove(id string, st *progressStream) {
+	h.mu.Lock()
+	if h.streams[id] == st {
+		delete(h.streams, id)
+	}
+	h.mu.Unlock()
+}
+
+func (h *progressHub) publish(st *progressStream, ev uploadEvent) {
+	h.mu.Lock()
+	st.last = ev
+	close(st.changed)
+	st.changed = make(chan struct{})
+	h.mu.Unlock()
+}
+
+// watch returns id's stream for tenant to follow, or nil if it belongs
+// to another tenant. Each watch is ended with unwatch.
+func (h *progressHub) watch(id string, tenant int64) *progressStream {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := h.stream(id, tenant)
+	if st != nil {
+		st.watchers++
+	}
+	return st
+}
+
+// unwatch ends a watch. A stream no upload reports to is dropped when its
+// last watcher leaves, so IDs nothing uploads to don't pile up.
+func (h *progressHub) unwatch(id string, st *progressStream) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st.watchers--
+	if st.watchers == 0 && !st.started && h.streams[id] == st {
+		delete(h.streams, id)
+	}
+}
+
+// next returns the latest event and a channel closed by the one after.
+func (h *progressHub) next(st *progressStream) (uploadEvent, <-chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return st.last, st.changed
+}
+
+// start returns a tracker for one request by tenant, or nil when the
+// request has no valid progress ID or the ID is another tenant's.
+func (h *progressHub) start(id string, tenant, total int64) *progressTracker {
+	if !progressIDRe.MatchString(id) {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := h.stream(id, tenant)
+	if st == nil {
+		return nil
+	}
+	st.started = true
+	return &progressTracker{hub: h, id: id, st: st, total: total}
+}
+
+// progressTracker publishes one request's progress, at most a few times
+// a second. A nil tracker does nothing.
+type progressTracker struct {
+	hub   *progressHub
+	id    string
+	st    *progressStream
+	total int64
+	last  time.Time
+}
+
+func (t *progressTracker) file(name string, n int64, sum string) {
+	if t == nil || (sum == "" && time.Since(t.last) < 250*time.Millisecond) {
+		return
+	}
+	t.last = time.Now()
+	t.hub.publish(t.st, uploadEvent{File: name, Bytes: n, Total: t.total, SHA256: sum})
+}
+
+func (t *progressTracker) finish() {
+	if t == nil {
+		return
+	}
+	t.hub.publish(t.st, uploadEvent{Complete: true})
+	time.AfterFunc(time.Minute, func() { t.hub.remove(t.id, t.st) })
+}
+
+// handleUploadProgress streams an upload's progress as server-sent events
+// until it completes. The page picks the ID and passes it to the upload
+// as ?progress=, so it can subscribe before the upload starts. Only the
+// tenant that uploads, or first subscribes, can follow it.
+func (s *Server) handleUploadProgress(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !progressIDRe.MatchString(id) {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	st := s.progress.watch(id, requestTenantID(r))
+	if st == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	defer s.progress.unwatch(id, st)
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Printf("http: upload progress: %v", err)
+		return
+	}
+
+	var sent uploadEvent
+	for {
+		ev, changed := s.progress.next(st)
+		if ev != sent {
+			sent = ev
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Printf("http: encode upload progress: %v", err)
+				return
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			rc.Flush()
+			if ev.Complete {
+				return
+			}
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		case <-time.After(30 * time.Second):
+			// Keep proxies from closing an idle stream.
+			fmt.Fprint(w, ": ping\n\n")
+			rc.Flush()
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package httpserver
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// errQuota is wrapped by the errors of writes a disk quota refuses.
+var errQuota = errors.New("disk quota exceeded")
+
+// Data directory areas with a disk quota.
+const (
+	areaImages   = "images"
+	areaProfiles = "profiles"
+	areaLogs     = "logs"
+	areaBackups  = "backups"
+	areaPackages = "packages"
+)
+
+// dataArea is a part of the data directory with its own quota, kept in the
+// runtime setting QuotaKey.
+type dataArea struct {
+	Name     string
+	Label    string
+	Dirs     []string // under the data directory
+	QuotaKey string
+}
+
+var dataAreas = []dataArea{
+	{Name: areaImages, Label: "Images", Dirs: []string{"images", "uploads", "builds"}, QuotaKey: "image_quota"},
+	{Name: areaProfiles, Label: "Profile overlays and drivers", Dirs: []string{"profiles", "drivers"}, QuotaKey: "profile_quota"},
+	{Name: areaLogs, Label: "TFTP uploads and logs", Dirs: []string{"tftp-inbox"}, QuotaKey: "log_quota"},
+	{Name: areaBackups, Label: "Database backups", Dirs: []string{"backups", backupStoreDir}, QuotaKey: "backup_quota"},
+	{Name: areaPackages, Label: "Package mirror cache", Dirs: []string{"package-cache"}, QuotaKey: "package_quota"},
+}
+
+func lookupDataArea(name string) dataArea {
+	for _, a := range dataAreas {
+		if a.Name == name {
+			return a
+		}
+	}
+	panic("unknown data area " + name)
+}
+
+// parseSize reads a size such as 500M, 200G or 2T, in binary units. Empty
+// or 0 is zero, meaning unlimited.
+func parseSize(v string) (int64, error) {
+	v = strings.TrimSpace(v)
+	if v == "" || v == "0" {
+		return 0, nil
+	}
+	shift := 0
+	switch strings.ToUpper(v[len(v)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	case "T":
+		shift = 40
+	}
+	if shift != 0 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	return int64(n * float64(int64(1)<<shift)), nil
+}
+
+// settingSize returns a size setting in bytes, zero when unlimited.
+func (s *Server) settingSize(key string) int64 {
+	n, _ := parseSize(s.Setting(key))
+	return n
+}
+
+// dirSize adds up the sizes of the regular files under dir. A missing
+// directory is empty.
+func dirSize(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
+// areaUsage is how much of its quota a data area uses. Quota is zero when
+// unlimited.
+type areaUsage struct {
+	dataArea
+	Used  int64
+	Quota int64
+}
+
+// Over reports whether the area is past its quota.
+func (u areaUsage) Over() bool { return u.Quota > 0 && u.Used > u.Quota }
+
+// Percent is how much of the quota is used, capped at 100.
+func (u areaUsage) Percent() int {
+	if u.Quota <= 0 {
+		return 0
+	}
+	return int(min(u.Used*100/u.Quota, 100))
+}
+
+func (s *Server) usageOf(a dataArea) (areaUsage, error) {
+	u := areaUsage{dataArea: a, Quota: s.settingSize(a.QuotaKey)}
+	for _, dir := range a.Dirs {
+		n, err := dirSize(filepath.Join(s.DataDir, dir))
+		if err != nil {
+			return u, err
+		}
+		u.Used += n
+	}
+	return u, nil
+}
+
+// diskUsage measures every data area.
+func (s *Server) diskUsage() ([]areaUsage, error) {
+	out := make([]areaUsage, 0, len(dataAreas))
+	for _, a := range dataAreas {
+		u, err := s.usageOf(a)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, nil
+}
+
+// checkQuota returns an error wrapping errQuota if adding need bytes to an
+// area, after freeing freed bytes, would take it over its quota. With need
+// unknown, pass zero: the write is then only refused once the area is
+// full.
+func (s *Server) checkQuota(area string, need, freed int64) error {
+	a := lookupDataArea(area)
+	if s.settingSize(a.QuotaKey) <= 0 {
+		return nil
+	}
+	u, err := s.usageOf(a)
+	if err != nil {
+		return err
+	}
+	after := u.Used - freed + need
+	if after > u.Quota || (need == 0 && u.Used >= u.Quota) {
+		return fmt.Errorf("%w: %s would take %s of the %s quota", errQuota, strings.ToLower(a.Label), fileSize(after), fileSize(u.Quota))
+	}
+	return nil
+}
+
+// QuotaRoom returns how many more bytes an area may take, or -1 if it has
+// no quota.
+func (s *Server) QuotaRoom(area string) int64 {
+	a := lookupDataArea(area)
+	if s.settingSize(a.QuotaKey) <= 0 {
+		return -1
+	}
+	u, err := s.usageOf(a)
+	if err != nil {
+		log.Printf("http: %v", err)
+		return 0
+	}
+	return max(u.Quota-u.Used, 0)
+}
+
+// refuseOverQuota writes the response for a failed quota check and
+// reports whether it did, that is whether err is not nil.
+func refuseOverQuota(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, errQuota) {
+		http.Error(w, "Not saved: "+err.Error(), http.StatusInsufficientStorage)
+		return true
+	}
+	log.Printf("http: quota check: %v", err)
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	return true
+}
+
+// EnforceBackupQuota deletes the oldest database backups until the rest
+// fit the backup quota. The newest backup is always kept.
+func (s *Server) EnforceBackupQuota() {
+	quota := s.settingSize("backup_quota")
+	if quota <= 0 {
+		return
+	}
+	dir := filepath.Join(s.DataDir, "backups")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("http: backup quota: %v", err)
+		}
+		return
+	}
+	type backup struct {
+		name string
+		size int64
+		mod  int64
+	}
+	var backups []backup
+	var total int64
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{e.Name(), info.Size(), info.ModTime().UnixNano()})
+		total += info.Size()
+	}
+	slices.SortFunc(backups, func(a, b backup) int { return cmp.Compare(a.mod, b.mod) })
+	for i := 0; total > quota && i < len(backups)-1; i++ {
+		if err := os.Remove(filepath.Join(dir, backups[i].name)); err != nil {
+			log.Printf("http: backup quota: %v", err)
+			continue
+		}
+		total -= backups[i].size
+		log.Printf("http: removed backup %s to stay within the %s backup quota", backups[i].name, fileSize(quota))
+	}
+}
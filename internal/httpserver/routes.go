@@ -4,8 +4,15 @@ import (
 	"net/http"
 )
 
+// auth requires the admin.
 func (s *Server) auth(h http.HandlerFunc) http.HandlerFunc {
-	return s.AuthMiddleware(h)
+	return s.AuthMiddleware(adminOnly(h))
+}
+
+// tenantAuth lets tenant users and tokens in too, limited to their own
+// systems, images and profiles.
+func (s *Server) tenantAuth(h http.HandlerFunc) http.HandlerFunc {
+	return s.AuthMiddleware(s.tenantOwned(h))
 }
 
 func (s *Server) registerRoutes(mux *http.ServeMux) {
@@ -14,8 +21,11 @@ func (s *Server) registerRoutes(mux *http.ServeMux) {
 	// Static files
 	mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServerFS(s.StaticFS)))
 
-	// Health check
+	// Health checks
 	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /livez", s.handleLivez)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
 
 	// Auth pages
 	mux.HandleFunc("GET /login", s.handleLoginPage)
@@ -27,46 +37,232 @@ func (s *Server) registerRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("GET /ipxe.efi", s.handleServeIPXE)
 	mux.HandleFunc("GET /ipxe-arm64.efi", s.handleServeIPXEArm64)
 	mux.HandleFunc("GET /undionly.kpxe", s.handleServeUndionly)
+	mux.HandleFunc("GET /ipxe/{name}", s.handleServeBootBinary)
 
 	// Image/config/overlay file serving (used by booting machines)
 	mux.HandleFunc("GET /images/{id}/file/{name}", s.handleServeImageFile)
+	mux.HandleFunc("GET /images/{id}/SHA256SUMS", s.handleImageChecksums)
+	mux.HandleFunc("GET /images/{id}/torrent/{name}", s.handleImageTorrent)
+	mux.HandleFunc("GET /images/{id}/sig/{name}", s.handleImageSignature)
+	mux.HandleFunc("GET /announce", s.handleAnnounce)
 	mux.HandleFunc("GET /config/{id}", s.handleServeConfig)
 	mux.HandleFunc("GET /profiles/{id}/overlay/{name}", s.handleServeOverlayFile)
+	mux.HandleFunc("GET /config/{id}/drivers", s.handleDriverManifest)
+	mux.HandleFunc("GET /images/{id}/esxi/{system}/boot.cfg", s.handleESXiBootCfg)
+	mux.HandleFunc("POST /answer/proxmox", s.handleProxmoxAnswer)
+	mux.HandleFunc("GET /mirror/{name}/{path...}", s.handleMirror)
+	mux.HandleFunc("GET /drivers/{id}/file/{name}", s.handleServeDriverFile)
+	mux.HandleFunc("GET /utilities/disk-wipe.apkovl.tar.gz", s.handleDiskWipeOverlay)
+	mux.HandleFunc("GET /decommission/{id}/wipe.apkovl.tar.gz", s.handleWipeOverlay)
+
+	// Build pipeline uploads (bearer token issued per build)
+	mux.HandleFunc("PUT /api/v1/images/{id}/builds/{build}/files/{name}", s.handleBuildUpload)
+	mux.HandleFunc("POST /api/v1/images/{id}/builds/{build}/complete", s.handleBuildComplete)
 
 	// API callbacks
 	mux.HandleFunc("POST /api/v1/systems/{mac}/callback", s.handleCallback)
+	mux.HandleFunc("POST /api/v1/systems/{mac}/heartbeat", s.handleHeartbeat)
+	mux.HandleFunc("POST /api/v1/systems/{mac}/tpm", s.handleTPMEnroll)
+	mux.HandleFunc("POST /api/v1/systems/{mac}/wipe", s.handleWipeReport)
+
+	// Inbound triggers (per-trigger token checked by the handler)
+	mux.HandleFunc("POST /api/v1/triggers/{name}", s.handleFireTrigger)
+
+	// Backup store for other duh servers (store token)
+	mux.HandleFunc("GET /api/v1/backup-store", s.backupStoreAuth(s.handleListStoredBackups))
+	mux.HandleFunc("PUT /api/v1/backup-store/{name}", s.backupStoreAuth(s.handlePutStoredBackup))
+	mux.HandleFunc("GET /api/v1/backup-store/{name}", s.backupStoreAuth(s.handleGetStoredBackup))
+	mux.HandleFunc("DELETE /api/v1/backup-store/{name}", s.backupStoreAuth(s.handleDeleteStoredBackup))
+
+	// Machine identity (client certificate checked by the handler)
+	mux.HandleFunc("GET /pki/ca.pem", s.handleServeCACert)
+	mux.HandleFunc("POST /api/v1/machine/cert", s.handleRenewMachineCert)
+	mux.HandleFunc("POST /api/v1/agent/heartbeat", s.handleAgentHeartbeat)
+	mux.HandleFunc("GET /api/v1/agent/config", s.handleAgentConfig)
+	mux.HandleFunc("POST /api/v1/agent/commands/{id}", s.handleAgentCommandResult)
+	mux.HandleFunc("POST /api/v1/agent/console", s.handleAgentConsole)
+	mux.HandleFunc("GET /api/v1/systems/{mac}/boot-ack", s.handleBootAck)
 
 	// --- Protected (auth required) ---
 
 	// Web UI pages
-	mux.HandleFunc("GET /{$}", s.auth(s.handleDashboard))
-	mux.HandleFunc("GET /images", s.auth(s.handleImagesPage))
-	mux.HandleFunc("GET /profiles", s.auth(s.handleProfilesPage))
+	mux.HandleFunc("GET /{$}", s.tenantAuth(s.handleDashboard))
+	mux.HandleFunc("GET /bandwidth", s.auth(s.handleBandwidth))
+	mux.HandleFunc("GET /images", s.tenantAuth(s.handleImagesPage))
+	mux.HandleFunc("GET /profiles", s.tenantAuth(s.handleProfilesPage))
 	mux.HandleFunc("GET /setup", s.auth(s.handleSetupPage))
+	mux.HandleFunc("GET /wizard", s.auth(s.handleWizard))
+	mux.HandleFunc("POST /wizard/skip", s.auth(s.handleWizardSkip))
+	mux.HandleFunc("POST /wizard/{step}", s.auth(s.handleWizardStep))
+	mux.HandleFunc("PUT /theme", s.AuthMiddleware(s.handleSetTheme))
+	mux.HandleFunc("GET /diagnostics", s.auth(s.handleDiagnosticsPage))
+	mux.HandleFunc("GET /reports", s.tenantAuth(s.handleReportsPage))
+	mux.HandleFunc("GET /reports/provisioning.csv", s.tenantAuth(s.handleReportCSV))
+	mux.HandleFunc("GET /reports/provisioning.pdf", s.tenantAuth(s.handleReportPDF))
+	mux.HandleFunc("GET /api/v1/reports/provisioning", s.tenantAuth(s.handleAPIReport))
+	mux.HandleFunc("GET /api/v1/search", s.tenantAuth(s.handleSearch))
+	mux.HandleFunc("GET /tftp-inbox/{mac}/{name}", s.auth(s.handleInboxFile))
+	mux.HandleFunc("DELETE /tftp-inbox/{mac}/{name}", s.auth(s.handleDeleteInboxFile))
 	mux.HandleFunc("POST /dhcp/test", s.auth(s.handleDHCPTest))
 
 	// System CRUD (htmx)
-	mux.HandleFunc("POST /systems", s.auth(s.handleCreateSystem))
-	mux.HandleFunc("PUT /systems/{id}", s.auth(s.handleUpdateSystem))
-	mux.HandleFunc("DELETE /systems/{id}", s.auth(s.handleDeleteSystem))
-	mux.HandleFunc("PUT /systems/{id}/state", s.auth(s.handleSystemStateAction))
+	mux.HandleFunc("POST /systems", s.tenantAuth(s.handleCreateSystem))
+	mux.HandleFunc("PUT /systems/{id}", s.tenantAuth(s.handleUpdateSystem))
+	mux.HandleFunc("DELETE /systems/{id}", s.tenantAuth(s.handleDeleteSystem))
+	mux.HandleFunc("PUT /systems/{id}/state", s.tenantAuth(s.handleSystemStateAction))
+	mux.HandleFunc("POST /systems/{id}/merge", s.tenantAuth(s.handleMergeSystem))
+	mux.HandleFunc("DELETE /systems/{id}/merge", s.tenantAuth(s.handleUndoMerge))
+	mux.HandleFunc("GET /systems/{id}/qr.svg", s.tenantAuth(s.handleSystemQR))
+	mux.HandleFunc("GET /systems/{id}/wipe-certificate.pdf", s.tenantAuth(s.handleWipeCertificatePDF))
+	mux.HandleFunc("GET /systems/labels", s.tenantAuth(s.handleLabelsPage))
+	mux.HandleFunc("GET /m/systems/{id}", s.tenantAuth(s.handleMobileSystem))
+	mux.HandleFunc("GET /api/v1/systems/{id}/attempts", s.tenantAuth(s.handleSystemAttempts))
+	mux.HandleFunc("GET /api/v1/systems/{id}/ips", s.tenantAuth(s.handleSystemIPs))
+	mux.HandleFunc("GET /api/v1/systems/{id}/transfers", s.tenantAuth(s.handleSystemTransfers))
+	mux.HandleFunc("GET /api/v1/systems/{id}/credential", s.tenantAuth(s.handleSystemCredential))
+	mux.HandleFunc("POST /api/v1/systems/{id}/credential/reveal", s.tenantAuth(s.handleRevealCredential))
+	mux.HandleFunc("GET /api/v1/systems/{id}/tpm", s.tenantAuth(s.handleSystemTPM))
+	mux.HandleFunc("POST /api/v1/systems/{id}/tpm/approve", s.auth(s.handleSystemTPM))
+	mux.HandleFunc("DELETE /api/v1/systems/{id}/tpm", s.auth(s.handleSystemTPM))
+	mux.HandleFunc("GET /api/v1/systems/{id}/wipe-certificate", s.tenantAuth(s.handleWipeCertificate))
+	mux.HandleFunc("GET /api/v1/systems/{id}/certs", s.tenantAuth(s.handleListMachineCerts))
+	mux.HandleFunc("DELETE /api/v1/systems/{id}/certs", s.tenantAuth(s.handleRevokeMachineCerts))
+	mux.HandleFunc("GET /api/v1/systems/{id}/agent", s.tenantAuth(s.handleGetSystemAgent))
+	mux.HandleFunc("GET /systems/{id}/console", s.tenantAuth(s.handleConsolePage))
+	mux.HandleFunc("GET /systems/{id}/console/ws", s.tenantAuth(s.handleConsoleSocket))
+	mux.HandleFunc("POST /systems/{id}/oneshot", s.tenantAuth(s.handleSetOneshot))
+	mux.HandleFunc("DELETE /systems/{id}/oneshot", s.tenantAuth(s.handleClearOneshot))
+	mux.HandleFunc("GET /api/v1/systems/{id}/boot-once", s.tenantAuth(s.handleAPIOneshot))
+	mux.HandleFunc("PUT /api/v1/systems/{id}/boot-once", s.tenantAuth(s.handleAPIOneshot))
+	mux.HandleFunc("DELETE /api/v1/systems/{id}/boot-once", s.tenantAuth(s.handleAPIOneshot))
 	mux.HandleFunc("PUT /settings/confirm-reimage", s.auth(s.handleToggleConfirmGlobal))
+	mux.HandleFunc("POST /binaries", s.auth(s.handleUploadBinary))
+	mux.HandleFunc("DELETE /binaries/{name}", s.auth(s.handleDeleteBinary))
+	mux.HandleFunc("POST /binaries/bundles", s.auth(s.handleUploadBundle))
+	mux.HandleFunc("POST /binaries/bundles/dropped", s.auth(s.handleInstallDroppedBundle))
+	mux.HandleFunc("PUT /binaries/bundles/active", s.auth(s.handleActivateBundle))
+	mux.HandleFunc("DELETE /binaries/bundles/{version}", s.auth(s.handleDeleteBundle))
+	mux.HandleFunc("PUT /settings/bootfiles", s.auth(s.handleSetBootFiles))
+	mux.HandleFunc("PUT /settings/dhcp-options", s.auth(s.handleSetDHCPOptions))
+	mux.HandleFunc("PUT /settings/dhcp-policy", s.auth(s.handleSetDHCPPolicy))
+	mux.HandleFunc("GET /api/v1/ipxe/embed.ipxe", s.auth(s.handleEmbedScript))
+	mux.HandleFunc("GET /api/v1/ipxe/build-kit.tar.gz", s.auth(s.handleBuildKit))
+	mux.HandleFunc("GET /api/v1/ipxe/media/{name}", s.auth(s.handleBootMedia))
+	mux.HandleFunc("POST /vms/sync", s.auth(s.handleVMSync))
+	mux.HandleFunc("POST /api/v1/vms/sync", s.auth(s.handleAPIVMSync))
+	mux.HandleFunc("POST /api/v1/tls/regenerate", s.auth(s.handleRegenerateCert))
+	mux.HandleFunc("PUT /settings/runtime", s.auth(s.handleSetSettings))
+	mux.HandleFunc("GET /api/v1/settings", s.auth(s.handleAPISettings))
+	mux.HandleFunc("PUT /api/v1/settings", s.auth(s.handleAPIUpdateSettings))
+	mux.HandleFunc("PUT /settings/netbox", s.auth(s.handleSetNetBox))
+	mux.HandleFunc("PUT /settings/boot-hook", s.auth(s.handleSetBootHook))
+	mux.HandleFunc("PUT /settings/global-vars", s.auth(s.handleSetGlobalVars))
+	mux.HandleFunc("GET /api/v1/global-vars", s.auth(s.handleAPIGlobalVars))
+	mux.HandleFunc("PUT /api/v1/global-vars", s.auth(s.handleAPIGlobalVars))
+	mux.HandleFunc("PUT /settings/secret-store", s.auth(s.handleSetSecretStore))
+	mux.HandleFunc("PUT /settings/tpm", s.auth(s.handleSetTPM))
+	mux.HandleFunc("POST /netbox/sync", s.auth(s.handleNetBoxSync))
+	mux.HandleFunc("POST /api/v1/netbox/sync", s.auth(s.handleAPINetBoxSync))
+	mux.HandleFunc("POST /import/{source}", s.auth(s.handleImport))
+	mux.HandleFunc("POST /api/v1/import/{source}", s.auth(s.handleAPIImport))
+	mux.HandleFunc("GET /export/{target}", s.auth(s.handleExport))
 
 	// Image CRUD
-	mux.HandleFunc("POST /images/upload", s.auth(s.handleUploadImage))
-	mux.HandleFunc("GET /images/{id}/row", s.auth(s.handleImageRow))
-	mux.HandleFunc("PUT /images/{id}", s.auth(s.handleUpdateImage))
-	mux.HandleFunc("DELETE /images/{id}", s.auth(s.handleDeleteImage))
+	mux.HandleFunc("POST /images/upload", s.tenantAuth(s.handleUploadImage))
+	mux.HandleFunc("GET /images/{id}/row", s.tenantAuth(s.handleImageRow))
+	mux.HandleFunc("GET /images/{id}", s.tenantAuth(s.handleImageDetail))
+	mux.HandleFunc("GET /images/{id}/files", s.tenantAuth(s.handleImageFiles))
+	mux.HandleFunc("DELETE /images/{id}/files/{name}", s.tenantAuth(s.handleDeleteImageFile))
+	mux.HandleFunc("POST /images/{id}/verify", s.tenantAuth(s.handleVerifyImage))
+	mux.HandleFunc("POST /api/v1/images/{id}/verify", s.tenantAuth(s.handleAPIVerifyImage))
+	mux.HandleFunc("PUT /images/{id}", s.tenantAuth(s.handleUpdateImage))
+	mux.HandleFunc("DELETE /images/{id}", s.tenantAuth(s.handleDeleteImage))
+	mux.HandleFunc("POST /images/{id}/rebuild", s.tenantAuth(s.handleRebuildImage))
+	mux.HandleFunc("GET /api/v1/images/{id}/dependents", s.tenantAuth(s.handleImageDependents))
+	mux.HandleFunc("POST /api/v1/images/{id}/uploads", s.auth(s.handleCreateUpload))
+	mux.HandleFunc("GET /api/v1/uploads/{upload}", s.auth(s.handleUploadStatus))
+	mux.HandleFunc("PATCH /api/v1/uploads/{upload}", s.auth(s.handleUploadChunk))
+	mux.HandleFunc("DELETE /api/v1/uploads/{upload}", s.auth(s.handleDeleteUpload))
+	mux.HandleFunc("GET /upload-progress/{id}", s.tenantAuth(s.handleUploadProgress))
+	mux.HandleFunc("POST /api/v1/images/{id}/files/fetch", s.tenantAuth(s.handleFetchImageFile))
 
 	// Profile CRUD
-	mux.HandleFunc("GET /profiles/new", s.auth(s.handleProfileEditorNew))
-	mux.HandleFunc("GET /profiles/{id}", s.auth(s.handleProfileEditor))
-	mux.HandleFunc("POST /profiles", s.auth(s.handleCreateProfile))
-	mux.HandleFunc("POST /profiles/{id}", s.auth(s.handleUpdateProfile))
-	mux.HandleFunc("DELETE /profiles/{id}", s.auth(s.handleDeleteProfile))
+	mux.HandleFunc("GET /profiles/new", s.tenantAuth(s.handleProfileEditorNew))
+	mux.HandleFunc("GET /profiles/{id}", s.tenantAuth(s.handleProfileEditor))
+	mux.HandleFunc("POST /profiles", s.tenantAuth(s.handleCreateProfile))
+	mux.HandleFunc("POST /profiles/{id}", s.tenantAuth(s.handleUpdateProfile))
+	mux.HandleFunc("POST /profiles/config-check", s.tenantAuth(s.handleCheckProfileConfig))
+	mux.HandleFunc("DELETE /profiles/{id}", s.tenantAuth(s.handleDeleteProfile))
+	mux.HandleFunc("POST /drivers", s.auth(s.handleCreateDriver))
+	mux.HandleFunc("DELETE /drivers/{id}", s.auth(s.handleDeleteDriver))
+	mux.HandleFunc("POST /snippets", s.auth(s.handleCreateSnippet))
+	mux.HandleFunc("PUT /snippets/{id}", s.auth(s.handleUpdateSnippet))
+	mux.HandleFunc("DELETE /snippets/{id}", s.auth(s.handleDeleteSnippet))
+	mux.HandleFunc("GET /api/v1/snippets", s.auth(s.handleAPISnippets))
+	mux.HandleFunc("GET /api/v1/profiles/{id}/dependents", s.tenantAuth(s.handleProfileDependents))
+	mux.HandleFunc("GET /api/v1/template-vars", s.tenantAuth(s.handleTemplateVars))
 
 	// Catalog
 	mux.HandleFunc("POST /catalog/pull", s.auth(s.handleCatalogPull))
+	mux.HandleFunc("GET /catalog/preview", s.auth(s.handleCatalogPreview))
+	mux.HandleFunc("GET /catalog/entries", s.auth(s.handleCatalogEntries))
+	mux.HandleFunc("POST /api/v1/catalog/pull", s.auth(s.handleCatalogPullMany))
+
+	// Trash
+	mux.HandleFunc("GET /trash", s.auth(s.handleTrashPage))
+	mux.HandleFunc("POST /trash/{kind}/{id}/restore", s.auth(s.handleRestoreTrash))
+	mux.HandleFunc("DELETE /trash/{kind}/{id}", s.auth(s.handlePurgeTrash))
+	mux.HandleFunc("PUT /settings/trash-retention", s.auth(s.handleSetTrashRetention))
+
+	// Jobs
+	mux.HandleFunc("GET /jobs", s.auth(s.handleJobsPage))
+	mux.HandleFunc("GET /jobs/table", s.auth(s.handleJobsTable))
+	mux.HandleFunc("POST /jobs/{id}/retry", s.auth(s.handleRetryJob))
+	mux.HandleFunc("DELETE /jobs/{id}", s.auth(s.handleCancelJob))
+	mux.HandleFunc("GET /api/v1/jobs", s.auth(s.handleAPIJobs))
+
+	// Policy rules
+	mux.HandleFunc("GET /rules", s.auth(s.handleRulesPage))
+	mux.HandleFunc("POST /rules", s.auth(s.handleCreateRule))
+	mux.HandleFunc("POST /rules/test", s.auth(s.handleTestRule))
+	mux.HandleFunc("PUT /rules/{id}/toggle", s.auth(s.handleToggleRule))
+	mux.HandleFunc("POST /rules/{id}/up", s.auth(s.handleMoveRuleUp))
+	mux.HandleFunc("DELETE /rules/{id}", s.auth(s.handleDeleteRule))
+	mux.HandleFunc("POST /transitions", s.auth(s.handleCreateTransition))
+	mux.HandleFunc("PUT /transitions/{id}/toggle", s.auth(s.handleToggleTransition))
+	mux.HandleFunc("DELETE /transitions/{id}", s.auth(s.handleDeleteTransition))
+
+	// Networks
+	mux.HandleFunc("GET /networks", s.auth(s.handleNetworksPage))
+	mux.HandleFunc("POST /subnets", s.auth(s.handleCreateSubnet))
+	mux.HandleFunc("PUT /subnets/{id}", s.auth(s.handleUpdateSubnet))
+	mux.HandleFunc("DELETE /subnets/{id}", s.auth(s.handleDeleteSubnet))
+	mux.HandleFunc("GET /api/v1/subnets", s.auth(s.handleAPISubnets))
+
+	// Environments
+	mux.HandleFunc("POST /environments", s.auth(s.handleCreateEnvironment))
+	mux.HandleFunc("DELETE /environments/{name}", s.auth(s.handleDeleteEnvironment))
+	mux.HandleFunc("GET /api/v1/environments", s.tenantAuth(s.handleAPIEnvironments))
+	mux.HandleFunc("POST /cache-nodes", s.auth(s.handleCreateCacheNode))
+	mux.HandleFunc("DELETE /cache-nodes/{id}", s.auth(s.handleDeleteCacheNode))
+	mux.HandleFunc("GET /api/v1/cache-nodes", s.auth(s.handleAPICacheNodes))
+
+	// Tenants
+	mux.HandleFunc("POST /tenants", s.auth(s.handleCreateTenant))
+	mux.HandleFunc("PUT /tenants/{id}", s.auth(s.handleUpdateTenant))
+	mux.HandleFunc("DELETE /tenants/{id}", s.auth(s.handleDeleteTenant))
+	mux.HandleFunc("POST /tenants/{id}/users", s.auth(s.handleCreateTenantUser))
+	mux.HandleFunc("DELETE /tenant-users/{id}", s.auth(s.handleDeleteTenantUser))
+	mux.HandleFunc("POST /tenants/{id}/tokens", s.auth(s.handleCreateAPIToken))
+	mux.HandleFunc("DELETE /api-tokens/{id}", s.auth(s.handleDeleteAPIToken))
+	mux.HandleFunc("PUT /schedules/{name}", s.auth(s.handleUpdateSchedule))
+	mux.HandleFunc("POST /schedules/{name}/run", s.auth(s.handleRunSchedule))
+	mux.HandleFunc("PUT /settings/backups", s.auth(s.handleSetBackups))
+	mux.HandleFunc("GET /backups/remote", s.auth(s.handleRemoteBackups))
+	mux.HandleFunc("POST /backups/restore", s.auth(s.handleStageRestore))
+	mux.HandleFunc("DELETE /backups/restore", s.auth(s.handleCancelRestore))
+	mux.HandleFunc("POST /settings/backups/store-token", s.auth(s.handleRotateBackupStoreToken))
+	mux.HandleFunc("DELETE /settings/backups/store-token", s.auth(s.handleDisableBackupStore))
 
 	// Webhooks
 	mux.HandleFunc("GET /webhooks", s.auth(s.handleWebhooksPage))
@@ -74,6 +270,12 @@ func (s *Server) registerRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("DELETE /webhooks/{id}", s.auth(s.handleDeleteWebhook))
 	mux.HandleFunc("POST /webhooks/{id}/test", s.auth(s.handleTestWebhook))
 	mux.HandleFunc("PUT /webhooks/{id}/toggle", s.auth(s.handleToggleWebhook))
+	mux.HandleFunc("PUT /webhooks/{id}", s.auth(s.handleUpdateWebhook))
+	mux.HandleFunc("GET /api/v1/webhooks", s.auth(s.handleAPIWebhooks))
+	mux.HandleFunc("POST /triggers", s.auth(s.handleCreateTrigger))
+	mux.HandleFunc("POST /triggers/{id}/token", s.auth(s.handleRotateTriggerToken))
+	mux.HandleFunc("PUT /triggers/{id}/toggle", s.auth(s.handleToggleTrigger))
+	mux.HandleFunc("DELETE /triggers/{id}", s.auth(s.handleDeleteTrigger))
 
 	// Password management
 	mux.HandleFunc("POST /auth/set-password", s.auth(s.handleSetPassword))
@@ -0,0 +1,261 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/justinpopa/duh/internal/cron"
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/jobs"
+	"github.com/justinpopa/duh/internal/webhook"
+)
+
+// schedulerInterval is how often the scheduler looks for due tasks.
+const schedulerInterval = 30 * time.Second
+
+// jobSchedule is the job type that runs a scheduled task; its payload is a
+// scheduleJob.
+const jobSchedule = "schedule.run"
+
+// scheduleJob is the payload of a jobSchedule job.
+type scheduleJob struct {
+	Task string `json:"task"`
+}
+
+// scheduledTask is periodic work run by the scheduler. Cron, Jitter and
+// Enabled are its schedule until changed on the Setup page.
+type scheduledTask struct {
+	Name    string
+	Label   string
+	Help    string
+	Cron    string
+	Jitter  time.Duration
+	Enabled bool
+	run     func(s *Server, ctx context.Context) error
+}
+
+var scheduledTasks = []scheduledTask{
+	{
+		Name: "catalog_sync", Label: "Catalog refresh",
+		Help: "Updates pulled images' descriptions and icons from the catalog, flags images it no longer lists, and takes new versions as each image's catalog policy says.",
+		Cron: "0 * * * *", Jitter: 10 * time.Minute, Enabled: true,
+		run: (*Server).syncCatalog,
+	},
+	{
+		Name: "trash_purge", Label: "Trash janitor",
+		Help: "Purges trash older than the retention window.",
+		Cron: "30 * * * *", Jitter: 5 * time.Minute, Enabled: true,
+		run: (*Server).purgeExpiredTrash,
+	},
+	{
+		Name: "cert_check", Label: "Certificate check",
+		Help: "Sends certificate expiry notices and forgets machine certificates that have long expired.",
+		Cron: "15 * * * *", Enabled: true,
+		run: (*Server).checkCertificates,
+	},
+	{
+		Name: "backup", Label: "Database backup",
+		Help: "Snapshots the database into backups/ in the data directory and uploads it to the remote backup target, keeping the daily and weekly backups set under Backups.",
+		Cron: "0 3 * * *", Jitter: 30 * time.Minute, Enabled: true,
+		run: (*Server).backupDatabase,
+	},
+}
+
+func lookupScheduledTask(name string) (scheduledTask, bool) {
+	i := slices.IndexFunc(scheduledTasks, func(t scheduledTask) bool { return t.Name == name })
+	if i < 0 {
+		return scheduledTask{}, false
+	}
+	return scheduledTasks[i], true
+}
+
+// RunScheduler queues each enabled scheduled task as a job when its cron
+// expression, plus a random delay of up to its jitter, comes due, until ctx
+// is cancelled. A task that came due while duh was down runs once on
+// start.
+func (s *Server) RunScheduler(ctx context.Context) error {
+	for _, t := range scheduledTasks {
+		if err := db.EnsureSchedule(s.DB, t.Name, t.Cron, int(t.Jitter.Seconds()), t.Enabled); err != nil {
+			return err
+		}
+	}
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+	for {
+		s.queueDueTasks(time.Now())
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) queueDueTasks(now time.Time) {
+	schedules, err := db.ListSchedules(s.DB)
+	if err != nil {
+		log.Printf("scheduler: %v", err)
+		return
+	}
+	for _, t := range scheduledTasks {
+		sch, ok := schedules[t.Name]
+		if !ok || !sch.Enabled {
+			continue
+		}
+		if next, ok := parseDBTime(sch.NextRunAt); ok {
+			if next.After(now) {
+				continue
+			}
+			if _, err := s.Jobs.EnqueueOnce(jobSchedule, scheduleJob{Task: t.Name}); err != nil {
+				log.Printf("scheduler: queue %s: %v", t.Name, err)
+				continue
+			}
+		}
+		if err := s.scheduleNext(sch, now); err != nil {
+			log.Printf("scheduler: %v", err)
+		}
+	}
+}
+
+// scheduleNext records when sch next runs after now.
+func (s *Server) scheduleNext(sch db.Schedule, now time.Time) error {
+	c, err := cron.Parse(sch.Cron)
+	if err != nil {
+		return fmt.Errorf("%s: %w", sch.Name, err)
+	}
+	next := c.Next(now)
+	if next.IsZero() {
+		return fmt.Errorf("%s: %q never comes due", sch.Name, sch.Cron)
+	}
+	if sch.Jitter > 0 {
+		next = next.Add(rand.N(time.Duration(sch.Jitter) * time.Second))
+	}
+	return db.SetScheduleNextRun(s.DB, sch.Name, next)
+}
+
+// runScheduled runs a jobSchedule job and records how it went. A failed
+// run is sent as a schedule.failed event and isn't retried: the task's
+// next scheduled run is its retry.
+func (s *Server) runScheduled(ctx context.Context, payload []byte) error {
+	var job scheduleJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return jobs.Permanent(err)
+	}
+	t, ok := lookupScheduledTask(job.Task)
+	if !ok {
+		return jobs.Permanent(fmt.Errorf("unknown scheduled task %q", job.Task))
+	}
+	start := time.Now()
+	err := t.run(s, ctx)
+	if ctx.Err() != nil {
+		// Interrupted by shutdown; the queue runs it again on start.
+		return err
+	}
+	status, msg := db.ScheduleOK, ""
+	if err != nil {
+		status, msg = db.ScheduleFailed, err.Error()
+		log.Printf("scheduler: %s failed: %v", t.Name, err)
+		s.Webhook.Fire(webhook.Event{
+			Type: "schedule.failed",
+			Data: map[string]any{
+				"task":  t.Name,
+				"label": t.Label,
+				"error": msg,
+			},
+		})
+	}
+	if rerr := db.RecordScheduleRun(s.DB, t.Name, status, msg, time.Since(start)); rerr != nil {
+		log.Printf("scheduler: %v", rerr)
+	}
+	return jobs.Permanent(err)
+}
+
+// scheduleView is a scheduled task with its schedule, for the Setup page.
+type scheduleView struct {
+	Task     scheduledTask
+	Schedule db.Schedule
+}
+
+func (s *Server) scheduleViews() ([]scheduleView, error) {
+	schedules, err := db.ListSchedules(s.DB)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]scheduleView, len(scheduledTasks))
+	for i, t := range scheduledTasks {
+		sch, ok := schedules[t.Name]
+		if !ok {
+			// Not stored until the scheduler first starts.
+			sch = db.Schedule{Name: t.Name, Cron: t.Cron, Jitter: int(t.Jitter.Seconds()), Enabled: t.Enabled}
+		}
+		views[i] = scheduleView{t, sch}
+	}
+	return views, nil
+}
+
+func (s *Server) renderSchedules(w http.ResponseWriter) {
+	views, err := s.scheduleViews()
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.Templates.ExecuteTemplate(w, "schedule_settings", map[string]any{"Schedules": views}); err != nil {
+		log.Printf("http: render schedule_settings: %v", err)
+	}
+}
+
+// handleUpdateSchedule changes when a scheduled task runs.
+func (s *Server) handleUpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	t, ok := lookupScheduledTask(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "Unknown task", http.StatusNotFound)
+		return
+	}
+	expr := strings.TrimSpace(r.FormValue("cron"))
+	if _, err := cron.Parse(expr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jitter, err := strconv.Atoi(strings.TrimSpace(r.FormValue("jitter")))
+	if err != nil || jitter < 0 {
+		http.Error(w, "Jitter must be a number of seconds", http.StatusBadRequest)
+		return
+	}
+	enabled := r.FormValue("enabled") == "true"
+	if err := db.EnsureSchedule(s.DB, t.Name, t.Cron, int(t.Jitter.Seconds()), t.Enabled); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := db.UpdateSchedule(s.DB, t.Name, expr, jitter, enabled); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderSchedules(w)
+}
+
+// handleRunSchedule queues a scheduled task to run now, leaving its
+// schedule as it was.
+func (s *Server) handleRunSchedule(w http.ResponseWriter, r *http.Request) {
+	t, ok := lookupScheduledTask(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "Unknown task", http.StatusNotFound)
+		return
+	}
+	if _, err := s.Jobs.EnqueueOnce(jobSchedule, scheduleJob{Task: t.Name}); err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.renderSchedules(w)
+}
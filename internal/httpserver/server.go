@@ -11,24 +11,78 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/justinpopa/duh/internal/catalog"
 	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/ipxe"
+	"github.com/justinpopa/duh/internal/jobs"
+	"github.com/justinpopa/duh/internal/pki"
+	"github.com/justinpopa/duh/internal/tftpserver"
+	"github.com/justinpopa/duh/internal/torrent"
+	"github.com/justinpopa/duh/internal/vmsync"
 	"github.com/justinpopa/duh/internal/webhook"
 )
 
 type Server struct {
-	DB         *sql.DB
-	DataDir    string
-	ServerURL  string
-	CatalogURL string
-	TFTPAddr   string
-	HTTPAddr   string
-	ProxyDHCP  bool
-	Templates  *template.Template
-	StaticFS   fs.FS
-	Webhook    *webhook.Dispatcher
+	DB        *sql.DB
+	DataDir   string
+	TFTPAddr  string
+	HTTPAddr  string
+	HTTPSAddr string
+	ProxyDHCP bool // whether the proxy DHCP server was started
+	Templates *template.Template
+	StaticFS  fs.FS
+	Webhook   *webhook.Dispatcher
+	Jobs      *jobs.Queue
+	Binaries  *tftpserver.Binaries
+	TFTPStats *tftpserver.Stats
+	Inbox     *tftpserver.Inbox // nil unless TFTP uploads are enabled
+
+	// TFTPOptions is shown on the diagnostics page; main passes the same
+	// values to the TFTP server.
+	TFTPOptions tftpserver.Options
+
+	// TrustCertFile is the certificate an iPXE build must trust to fetch
+	// from this server over HTTPS, or "" if public CAs cover it.
+	TrustCertFile string
+
+	// VMProviders are the hypervisors systems can be synced from. With
+	// the vm_netboot setting on, queueing a synced system also moves its
+	// VM to network boot.
+	VMProviders []vmsync.Provider
+
+	// MinFreeBytes is the free space the data directory needs for /readyz
+	// to report ready.
+	MinFreeBytes int64
+
+	// CA issues systems client certificates when set. They are offered to
+	// config templates as .Identity, accepted in place of signed tokens on
+	// callbacks, and renewed for the systems holding them.
+	CA             *pki.CA
+	MachineCertTTL time.Duration
+
+	health healthState
+
+	// settings holds the runtime settings in effect; see LoadSettings.
+	settingsMu sync.RWMutex
+	settings   map[string]string
+
+	chainKeyMu sync.Mutex
+	chainKey   []byte
+
+	checksums checksumCache
+	uploads   uploadLocks
+	progress  progressHub
+	consoles  consoleHub
+	dns       dnsCache
+	bandwidth bandwidth
+	torrents  torrentCache
+	signing   codeSigner
+	tracker   torrent.Tracker
 
 	authMu       sync.RWMutex
 	passwordHash string
@@ -37,6 +91,28 @@ type Server struct {
 }
 
 func New(database *sql.DB, dataDir, serverURL, catalogURL, tftpAddr, httpAddr string, proxyDHCP bool, tmplFS fs.FS, staticFS fs.FS) (*Server, error) {
+	queue := jobs.New(database)
+	s := &Server{
+		DB:        database,
+		DataDir:   dataDir,
+		TFTPAddr:  tftpAddr,
+		HTTPAddr:  httpAddr,
+		ProxyDHCP: proxyDHCP,
+		StaticFS:  staticFS,
+		Webhook:   webhook.NewDispatcher(database, queue),
+		Jobs:      queue,
+		Binaries:  &tftpserver.Binaries{Dir: filepath.Join(dataDir, "ipxe"), BundleDir: filepath.Join(dataDir, "ipxe-bundles")},
+		TFTPStats: tftpserver.NewStats(),
+		settings: map[string]string{
+			"server_url":        serverURL,
+			"catalog_url":       catalogURL,
+			"proxy_dhcp":        strconv.FormatBool(proxyDHCP),
+			"agent_interval":    time.Minute.String(),
+			"heartbeat_timeout": (5 * time.Minute).String(),
+			"provision_slo":     (30 * time.Minute).String(),
+			"slow_client_rate":  "10M",
+		},
+	}
 	funcMap := template.FuncMap{
 		"deref": func(p *int64) int64 {
 			if p == nil {
@@ -44,6 +120,9 @@ func New(database *sql.DB, dataDir, serverURL, catalogURL, tftpAddr, httpAddr st
 			}
 			return *p
 		},
+		"splitTags": db.SplitTags,
+		"fileSize":  fileSize,
+		"rate":      formatRate,
 		"jsonAttr": func(v any) string {
 			b, _ := json.Marshal(v)
 			return string(b)
@@ -57,51 +136,78 @@ func New(database *sql.DB, dataDir, serverURL, catalogURL, tftpAddr, httpAddr st
 			}
 			return m
 		},
-		"timeSince": func(t string) string {
-			if t == "" {
-				return ""
-			}
-			parsed, err := time.Parse("2006-01-02 15:04:05", t)
-			if err != nil {
-				return ""
-			}
-			d := time.Since(parsed)
-			switch {
-			case d < time.Minute:
-				return fmt.Sprintf("%ds", int(d.Seconds()))
-			case d < time.Hour:
-				return fmt.Sprintf("%dm", int(d.Minutes()))
-			case d < 24*time.Hour:
-				return fmt.Sprintf("%dh", int(d.Hours()))
-			default:
-				return fmt.Sprintf("%dd", int(math.Floor(d.Hours()/24)))
-			}
-		},
+		"timeSince":  timeSince,
+		"timeUntil":  timeUntil,
+		"liveness":   s.liveness,
+		"tenantName": s.tenantName,
+		"subnetName": s.subnetName,
+		"dns":        s.dnsFor,
+		"archFamily": ipxe.ArchFamily,
 	}
 
+	queue.Handle(catalog.JobDownload, catalog.DownloadHandler(database, dataDir))
+	queue.Handle(jobTrigger, s.runTrigger)
+	queue.Handle(jobSchedule, s.runScheduled)
+
 	tmpl, err := template.New("").Funcs(funcMap).ParseFS(tmplFS, "*.html")
 	if err != nil {
 		return nil, err
 	}
+	s.Templates = tmpl
+	return s, nil
+}
+
+// parseDBTime reads a database timestamp.
+func parseDBTime(t string) (time.Time, bool) {
+	if t == "" {
+		return time.Time{}, false
+	}
+	parsed, err := time.Parse("2006-01-02 15:04:05", t)
+	if err != nil {
+		// Columns declared NOT NULL DATETIME scan as RFC 3339.
+		if parsed, err = time.Parse(time.RFC3339, t); err != nil {
+			return time.Time{}, false
+		}
+	}
+	return parsed, true
+}
+
+// timeSince formats how long ago a database timestamp was, e.g. "5m".
+func timeSince(t string) string {
+	parsed, ok := parseDBTime(t)
+	if !ok {
+		return ""
+	}
+	return formatAge(time.Since(parsed))
+}
 
-	return &Server{
-		DB:         database,
-		DataDir:    dataDir,
-		ServerURL:  serverURL,
-		CatalogURL: catalogURL,
-		TFTPAddr:   tftpAddr,
-		HTTPAddr:   httpAddr,
-		ProxyDHCP:  proxyDHCP,
-		Templates:  tmpl,
-		StaticFS:   staticFS,
-		Webhook:    webhook.NewDispatcher(database),
-	}, nil
+// timeUntil formats how long until a database timestamp, or "" once it
+// has passed.
+func timeUntil(t string) string {
+	parsed, ok := parseDBTime(t)
+	if !ok || !parsed.After(time.Now()) {
+		return ""
+	}
+	return formatAge(time.Until(parsed))
+}
+
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(math.Floor(d.Hours()/24)))
+	}
 }
 
 func (s *Server) Handler() http.Handler {
 	mux := http.NewServeMux()
 	s.registerRoutes(mux)
-	return LoggingMiddleware(RecoveryMiddleware(CSRFMiddleware(mux)))
+	return TracingMiddleware(LoggingMiddleware(RecoveryMiddleware(s.hstsMiddleware(CSRFMiddleware(limitMiddleware(mux))))))
 }
 
 // loadAuthCache reads password_hash and session_key from DB into memory.
@@ -0,0 +1,262 @@
+package httpserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the most a single write reserves from the limiters, so
+// a capped download sends steadily instead of in large bursts.
+const throttleChunk = 32 << 10
+
+// meterWindow is how many seconds of history a meter averages over.
+const meterWindow = 5
+
+// limiter is a token bucket refilled at rate bytes per second. Callers
+// reserve bytes up front and wait out any debt.
+type limiter struct {
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait
+// before sending them. Zero or negative rates mean unlimited.
+func (l *limiter) reserve(now time.Time, rate float64, n int) time.Duration {
+	if rate <= 0 {
+		l.tokens, l.last = 0, now
+		return 0
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+	}
+	l.last = now
+	// Allow at most a quarter second of burst after going idle.
+	l.tokens = min(l.tokens, max(rate/4, throttleChunk))
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / rate * float64(time.Second))
+}
+
+// meter counts bytes in one-second buckets to give a recent rate.
+type meter struct {
+	buckets [meterWindow + 1]int64
+	sec     int64 // unix second of the newest bucket
+	start   int64 // unix second counting began
+}
+
+func (m *meter) add(now time.Time, n int) {
+	if m.start == 0 {
+		m.start = now.Unix()
+	}
+	m.advance(now)
+	m.buckets[m.sec%int64(len(m.buckets))] += int64(n)
+}
+
+func (m *meter) advance(now time.Time) {
+	sec := now.Unix()
+	if sec-m.sec > int64(len(m.buckets)) {
+		m.buckets = [len(m.buckets)]int64{}
+		m.sec = sec
+	}
+	for m.sec < sec {
+		m.sec++
+		m.buckets[m.sec%int64(len(m.buckets))] = 0
+	}
+}
+
+// rate is the mean bytes per second over the last full seconds, or over
+// those since counting began if that is fewer.
+func (m *meter) rate(now time.Time) float64 {
+	m.advance(now)
+	var sum int64
+	for i := int64(1); i <= meterWindow; i++ {
+		sum += m.buckets[(m.sec-i+int64(len(m.buckets)))%int64(len(m.buckets))]
+	}
+	return float64(sum) / float64(min(max(m.sec-m.start, 1), meterWindow))
+}
+
+type clientBandwidth struct {
+	limiter
+	meter
+	active int
+	bytes  int64
+	since  time.Time
+}
+
+// bandwidth throttles and measures image downloads, across the server and
+// per client address.
+type bandwidth struct {
+	mu      sync.Mutex
+	global  limiter
+	meter   meter
+	total   int64
+	served  uint64
+	clients map[string]*clientBandwidth
+}
+
+// start registers a download from client and returns the writer to serve
+// it through; done must be called when the response is finished. limits
+// is asked again for every chunk, so a changed setting also slows or
+// frees downloads already under way.
+func (b *bandwidth) start(w http.ResponseWriter, r *http.Request, client string, limits func() (global, perClient float64)) (tw *throttledWriter, done func()) {
+	b.mu.Lock()
+	if b.clients == nil {
+		b.clients = make(map[string]*clientBandwidth)
+	}
+	c := b.clients[client]
+	if c == nil {
+		c = &clientBandwidth{since: time.Now()}
+		b.clients[client] = c
+	}
+	c.active++
+	b.mu.Unlock()
+
+	tw = &throttledWriter{ResponseWriter: w, ctx: r.Context(), b: b, c: c, limits: limits}
+	return tw, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		c.active--
+		b.served++
+		if c.active == 0 {
+			delete(b.clients, client)
+		}
+	}
+}
+
+// wait reserves n bytes for c and returns the longer of the two delays.
+func (b *bandwidth) wait(c *clientBandwidth, n int, global, perClient float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	d := max(b.global.reserve(now, global, n), c.reserve(now, perClient, n))
+	b.meter.add(now, n)
+	c.meter.add(now, n)
+	b.total += int64(n)
+	c.bytes += int64(n)
+	return d
+}
+
+// throttledWriter paces the body of an image download. It hides
+// io.ReaderFrom so the copy goes through Write rather than sendfile.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	b      *bandwidth
+	c      *clientBandwidth
+	limits func() (global, perClient float64)
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		global, perClient := tw.limits()
+		if d := tw.b.wait(tw.c, len(chunk), global, perClient); d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-tw.ctx.Done():
+				t.Stop()
+				return written, tw.ctx.Err()
+			}
+		}
+		n, err := tw.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// clientRate is one client's share in a bandwidth snapshot.
+type clientRate struct {
+	Client    string
+	Downloads int
+	Bytes     int64
+	Rate      float64 // bytes per second
+	Since     time.Time
+}
+
+// bandwidthSnapshot is the state of image serving at a moment.
+type bandwidthSnapshot struct {
+	Rate      float64 // bytes per second, all clients
+	Bytes     int64   // sent since start
+	Served    uint64  // finished downloads
+	Downloads int     // in progress
+	Clients   []clientRate
+	Limit     float64 // bytes per second; zero is unlimited
+	ClientCap float64
+}
+
+func (b *bandwidth) snapshot() bandwidthSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	snap := bandwidthSnapshot{Rate: b.meter.rate(now), Bytes: b.total, Served: b.served}
+	for addr, c := range b.clients {
+		snap.Downloads += c.active
+		snap.Clients = append(snap.Clients, clientRate{
+			Client: addr, Downloads: c.active, Bytes: c.bytes, Rate: c.meter.rate(now), Since: c.since,
+		})
+	}
+	slices.SortFunc(snap.Clients, func(a, b clientRate) int {
+		if a.Rate != b.Rate {
+			if a.Rate > b.Rate {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Client, b.Client)
+	})
+	return snap
+}
+
+// parseRate reads a bandwidth in bits per second, such as 500M or 1.5G,
+// and returns it in bytes per second.
+func parseRate(v string) (float64, error) {
+	v = strings.TrimSpace(v)
+	if v == "" || v == "0" {
+		return 0, nil
+	}
+	mult := 1.0
+	switch strings.ToUpper(v[len(v)-1:]) {
+	case "K":
+		mult = 1e3
+	case "M":
+		mult = 1e6
+	case "G":
+		mult = 1e9
+	}
+	if mult != 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", v)
+	}
+	return n * mult / 8, nil
+}
+
+// formatRate shows bytes per second as bits per second.
+func formatRate(bps float64) string {
+	bits := bps * 8
+	switch {
+	case bits >= 1e9:
+		return strconv.FormatFloat(bits/1e9, 'f', 1, 64) + " Gbit/s"
+	case bits >= 1e6:
+		return strconv.FormatFloat(bits/1e6, 'f', 1, 64) + " Mbit/s"
+	case bits >= 1e3:
+		return strconv.FormatFloat(bits/1e3, 'f', 0, 64) + " kbit/s"
+	}
+	return strconv.FormatFloat(bits, 'f', 0, 64) + " bit/s"
+}
@@ -0,0 +1,71 @@
+package httpserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// HSTS max-ages: a year normally, and the two years the preload list
+// asks for.
+const (
+	hstsMaxAge        = 365 * 24 * 60 * 60
+	hstsPreloadMaxAge = 2 * hstsMaxAge
+)
+
+// parseCipherSuites reads a comma- or space-separated list of TLS 1.2
+// cipher suite names, as crypto/tls names them. Suites Go considers
+// insecure are refused.
+func parseCipherSuites(v string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' }) {
+		name = strings.ToUpper(name)
+		i := slices.IndexFunc(tls.CipherSuites(), func(cs *tls.CipherSuite) bool { return cs.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %s", name)
+		}
+		id := tls.CipherSuites()[i].ID
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// ApplyTLSPolicy makes cfg follow the TLS settings — minimum version and
+// cipher suites — which are read on each handshake, so changes apply
+// without a restart.
+func (s *Server) ApplyTLSPolicy(cfg *tls.Config) {
+	base := cfg.Clone()
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := base.Clone()
+		if s.Setting("tls_min_version") == "1.3" {
+			c.MinVersion = tls.VersionTLS13
+		}
+		if ids, _ := parseCipherSuites(s.Setting("tls_ciphers")); len(ids) > 0 {
+			c.CipherSuites = ids
+		}
+		return c, nil
+	}
+}
+
+// hstsMiddleware sends a Strict-Transport-Security header on HTTPS
+// responses while the hsts setting is on, with preload if hsts_preload
+// is on too.
+func (s *Server) hstsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && s.SettingBool("hsts") {
+			v := fmt.Sprintf("max-age=%d", hstsMaxAge)
+			if s.SettingBool("hsts_preload") {
+				v = fmt.Sprintf("max-age=%d; includeSubDomains; preload", hstsPreloadMaxAge)
+			}
+			w.Header().Set("Strict-Transport-Security", v)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HTTPBootOnly reports whether HTTP serves only the boot chain.
+func (s *Server) HTTPBootOnly() bool { return s.SettingBool("http_boot_only") }
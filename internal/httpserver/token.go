@@ -2,97 +2,347 @@ package httpserver
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/justinpopa/duh/internal/db"
 )
 
 const tokenExpiry = 1 * time.Hour
 
+// chainTokenExpiry is short because the token only has to survive the gap
+// between iPXE's DHCP exchange and its fetch of boot.ipxe.
+const chainTokenExpiry = 5 * time.Minute
+
+// Token purposes. Each purpose signs with its own key derived from the
+// server signing key, so a token minted for one kind of resource can't be
+// replayed against another.
+const (
+	tokenPurposeImage     = "image"
+	tokenPurposeConfig    = "config"
+	tokenPurposeCallback  = "callback"
+	tokenPurposeOverlay   = "overlay"
+	tokenPurposeChain     = "chain"
+	tokenPurposeAck       = "ack"
+	tokenPurposeHeartbeat = "heartbeat"
+	tokenPurposeDriver    = "driver"
+	tokenPurposeWipe      = "wipe"
+	tokenPurposeTPM       = "tpm"
+)
+
+// purposeKey derives the signing key for a token purpose.
+func purposeKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("duh-url-token:" + purpose))
+	return mac.Sum(nil)
+}
+
+func tokenSignature(key []byte, purpose string, systemID, gen int64, attempt string, expiry int64, path string) []byte {
+	payload := fmt.Sprintf("%d|%d|%s|%d|%s", systemID, gen, attempt, expiry, path)
+	mac := hmac.New(sha256.New, purposeKey(key, purpose))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
 // signURL appends a tok= query parameter containing an HMAC-signed token
-// bound to the URL path with a 1-hour expiry.
-func (s *Server) signURL(rawURL string) string {
+// bound to the URL path, the purpose, and the system and provision attempt
+// it was issued for, with a 1-hour expiry. The system's token generation is
+// embedded so every token issued to it can be revoked by bumping the
+// generation.
+func (s *Server) signURL(purpose string, sys *db.System, rawURL string) string {
 	_, key := s.getAuthState()
 	if len(key) == 0 {
 		return rawURL
 	}
 
-	// Split URL into path and existing query
-	path := rawURL
-	query := ""
-	if i := strings.IndexByte(rawURL, '?'); i >= 0 {
-		path = rawURL[:i]
-		query = rawURL[i+1:]
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		log.Printf("http: sign url: %v", err)
+		return rawURL
 	}
 
 	expiry := time.Now().Add(tokenExpiry).Unix()
-	payload := fmt.Sprintf("%d|%s", expiry, path)
-
-	mac := hmac.New(sha256.New, key)
-	mac.Write([]byte(payload))
-	sig := mac.Sum(nil)
+	sig := tokenSignature(key, purpose, sys.ID, sys.TokenGen, sys.AttemptID, expiry, u.Path)
 
-	// Token format: base64url(expiry.signature)
+	// Token format: base64url(systemID.gen.attempt.expiry.signature)
 	token := base64.RawURLEncoding.EncodeToString(
-		[]byte(fmt.Sprintf("%d.%s", expiry, base64.RawURLEncoding.EncodeToString(sig))),
+		[]byte(fmt.Sprintf("%d.%d.%s.%d.%s", sys.ID, sys.TokenGen, sys.AttemptID, expiry, base64.RawURLEncoding.EncodeToString(sig))),
 	)
 
-	sep := "?"
-	if query != "" {
-		sep = "&"
-		return path + "?" + query + sep + "tok=" + token
+	q := u.Query()
+	q.Set("tok", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// heartbeatToken authorizes a host to post heartbeats for as long as the
+// install it was issued for lasts. Unlike signURL tokens it never expires
+// and survives the token generation bump on reaching ready; it is revoked
+// when the system is queued again and starts a new attempt.
+func (s *Server) heartbeatToken(sys *db.System) string {
+	_, key := s.getAuthState()
+	if len(key) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, purposeKey(key, tokenPurposeHeartbeat))
+	fmt.Fprintf(mac, "%d|%s", sys.ID, sys.AttemptID)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// heartbeatURL is where sys's host posts heartbeats.
+func (s *Server) heartbeatURL(serverURL string, sys *db.System) string {
+	u := fmt.Sprintf("%s/api/v1/systems/%s/heartbeat", serverURL, sys.MAC)
+	if tok := s.heartbeatToken(sys); tok != "" {
+		u += "?tok=" + tok
 	}
-	return rawURL + sep + "tok=" + token
+	return u
 }
 
-// validateToken checks the tok= query parameter against the request path.
-// Returns true if the token is valid and not expired, or if auth is not enabled.
-func (s *Server) validateToken(r *http.Request) bool {
+// validHeartbeatToken checks r's tok= parameter against sys. If auth is
+// not enabled every request is allowed.
+func (s *Server) validHeartbeatToken(r *http.Request, sys *db.System) bool {
+	want := s.heartbeatToken(sys)
+	if want == "" {
+		return true
+	}
+	return hmac.Equal([]byte(r.URL.Query().Get("tok")), []byte(want))
+}
+
+// wipeToken authorizes a system's wipe image to post its report. Like
+// heartbeatToken it doesn't expire, as erasing large disks can take a
+// day, but it is bound to the token generation, so it is revoked once the
+// system leaves decommissioning.
+func (s *Server) wipeToken(sys *db.System) string {
 	_, key := s.getAuthState()
 	if len(key) == 0 {
-		// No signing key means auth isn't set up; allow through
+		return ""
+	}
+	mac := hmac.New(sha256.New, purposeKey(key, tokenPurposeWipe))
+	fmt.Fprintf(mac, "%d|%d", sys.ID, sys.TokenGen)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validWipeToken checks r's tok= parameter against sys. If auth is not
+// enabled every request is allowed.
+func (s *Server) validWipeToken(r *http.Request, sys *db.System) bool {
+	want := s.wipeToken(sys)
+	if want == "" {
+		return true
+	}
+	return hmac.Equal([]byte(r.URL.Query().Get("tok")), []byte(want))
+}
+
+// imageBound reports whether sys may fetch files of image id: its assigned
+// image, its one-shot image or, while it is being decommissioned, the disk
+// wipe image.
+func (s *Server) imageBound(sys *db.System, id int64) bool {
+	if sys.ImageID != nil && *sys.ImageID == id {
+		return true
+	}
+	if sys.OneshotImageID != nil && *sys.OneshotImageID == id {
 		return true
 	}
+	if sys.State == "decommissioning" {
+		img, err := s.wipeImage()
+		return err == nil && img != nil && img.ID == id
+	}
+	return false
+}
+
+// validateToken checks the tok= query parameter against the request path and
+// purpose, and returns the system the token was issued to. Tokens are
+// rejected once expired or once the system's token generation or provision
+// attempt has moved on.
+// If auth is not enabled every request is allowed and the system is nil.
+func (s *Server) validateToken(r *http.Request, purpose string) (*db.System, bool) {
+	_, key := s.getAuthState()
+	if len(key) == 0 {
+		// No signing key means auth isn't set up; allow through
+		return nil, true
+	}
+	systemID, gen, attempt, ok := parseToken(r, key, purpose)
+	if !ok {
+		return nil, false
+	}
 
+	sys, err := db.GetSystemByID(s.DB, systemID)
+	if err != nil {
+		log.Printf("http: token system lookup: %v", err)
+		return nil, false
+	}
+	if sys == nil || sys.TokenGen != gen || sys.AttemptID != attempt {
+		return nil, false
+	}
+	return sys, true
+}
+
+// finishedCallback reports whether r carries a callback token for the
+// attempt its system has just finished: one generation old, as finishing
+// bumps it, but for the current attempt. Retries of the callback that
+// finished it come with such a token.
+func (s *Server) finishedCallback(r *http.Request) bool {
+	_, key := s.getAuthState()
+	if len(key) == 0 {
+		return false
+	}
+	systemID, gen, attempt, ok := parseToken(r, key, tokenPurposeCallback)
+	if !ok {
+		return false
+	}
+	sys, err := db.GetSystemByID(s.DB, systemID)
+	if err != nil {
+		log.Printf("http: token system lookup: %v", err)
+		return false
+	}
+	return sys != nil && sys.TokenGen == gen+1 && sys.AttemptID == attempt &&
+		(sys.State == "ready" || sys.State == "failed")
+}
+
+// parseToken checks the tok= query parameter's signature and expiry
+// against the request path and purpose, and returns the system, token
+// generation and attempt it was issued for.
+func parseToken(r *http.Request, key []byte, purpose string) (int64, int64, string, bool) {
 	tok := r.URL.Query().Get("tok")
 	if tok == "" {
-		return false
+		return 0, 0, "", false
 	}
 
-	// Decode the outer base64
 	decoded, err := base64.RawURLEncoding.DecodeString(tok)
 	if err != nil {
-		return false
+		return 0, 0, "", false
 	}
 
-	// Split into expiry and signature parts
-	parts := strings.SplitN(string(decoded), ".", 2)
-	if len(parts) != 2 {
-		return false
+	parts := strings.SplitN(string(decoded), ".", 5)
+	if len(parts) != 5 {
+		return 0, 0, "", false
 	}
-
-	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	systemID, err := strconv.ParseInt(parts[0], 10, 64)
 	if err != nil {
-		return false
+		return 0, 0, "", false
+	}
+	gen, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, "", false
+	}
+	attempt := parts[2]
+	expiry, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return 0, 0, "", false
 	}
 
 	if time.Now().Unix() > expiry {
+		return 0, 0, "", false
+	}
+
+	sigBytes, err := base64.RawURLEncoding.DecodeString(parts[4])
+	if err != nil {
+		return 0, 0, "", false
+	}
+	if !hmac.Equal(sigBytes, tokenSignature(key, purpose, systemID, gen, attempt, expiry, r.URL.Path)) {
+		return 0, 0, "", false
+	}
+
+	return systemID, gen, attempt, true
+}
+
+// getChainKey returns the key used for boot.ipxe chain tokens, generating
+// and storing one on first use. It is separate from the session key so
+// chain signing works whether or not a password is set.
+func (s *Server) getChainKey() ([]byte, error) {
+	s.chainKeyMu.Lock()
+	defer s.chainKeyMu.Unlock()
+	if s.chainKey != nil {
+		return s.chainKey, nil
+	}
+
+	keyHex, err := db.GetSetting(s.DB, "chain_key")
+	if err != nil {
+		return nil, err
+	}
+	if keyHex == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		keyHex = hex.EncodeToString(key)
+		if err := db.SetSetting(s.DB, "chain_key", keyHex); err != nil {
+			return nil, err
+		}
+	}
+	key, err := hex.DecodeString(keyHex)
+	if err != nil {
+		return nil, err
+	}
+	s.chainKey = key
+	return key, nil
+}
+
+func chainSignature(key []byte, mac string, expiry int64) []byte {
+	h := hmac.New(sha256.New, purposeKey(key, tokenPurposeChain))
+	h.Write([]byte(fmt.Sprintf("%s|%d", mac, expiry)))
+	return h.Sum(nil)
+}
+
+// ChainToken returns a short-lived token authorizing one MAC address to
+// fetch boot.ipxe. It returns "" if signed chains are off or no key is
+// available.
+func (s *Server) ChainToken(mac string) string {
+	if !s.SettingBool("signed_chain") {
+		return ""
+	}
+	mac, err := db.NormalizeMAC(mac)
+	if err != nil {
+		return ""
+	}
+	key, err := s.getChainKey()
+	if err != nil {
+		log.Printf("http: chain key: %v", err)
+		return ""
+	}
+	expiry := time.Now().Add(chainTokenExpiry).Unix()
+	sig := chainSignature(key, mac, expiry)
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(fmt.Sprintf("%d.%s", expiry, base64.RawURLEncoding.EncodeToString(sig))),
+	)
+}
+
+// validChainToken reports whether tok was issued by ChainToken for mac and
+// has not expired.
+func (s *Server) validChainToken(mac, tok string) bool {
+	mac, err := db.NormalizeMAC(mac)
+	if err != nil || tok == "" {
+		return false
+	}
+	key, err := s.getChainKey()
+	if err != nil {
+		log.Printf("http: chain key: %v", err)
 		return false
 	}
 
+	decoded, err := base64.RawURLEncoding.DecodeString(tok)
+	if err != nil {
+		return false
+	}
+	parts := strings.SplitN(string(decoded), ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return false
+	}
 	sigBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
 		return false
 	}
-
-	// Reconstruct the expected payload and verify
-	payload := fmt.Sprintf("%d|%s", expiry, r.URL.Path)
-	expected := hmac.New(sha256.New, key)
-	expected.Write([]byte(payload))
-
-	return hmac.Equal(sigBytes, expected.Sum(nil))
+	return hmac.Equal(sigBytes, chainSignature(key, mac, expiry))
 }
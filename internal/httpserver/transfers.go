@@ -0,0 +1,171 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/listing"
+)
+
+// transferWindow is how many of a system's latest fetches decide whether
+// it is slow or flaky.
+const transferWindow = 10
+
+// minRateSample is the smallest finished fetch counted towards a system's
+// throughput; smaller ones are mostly latency.
+const minRateSample = 1 << 20
+
+// flakyFailures is how many of the latest fetches must have failed for a
+// system to be flagged as flaky.
+const flakyFailures = 2
+
+// transferWriter counts what an image file response sends, and notes why
+// it stopped if a write failed.
+type transferWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	err    error
+}
+
+func (tw *transferWriter) WriteHeader(code int) {
+	tw.status = code
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *transferWriter) Write(p []byte) (int, error) {
+	n, err := tw.ResponseWriter.Write(p)
+	tw.bytes += int64(n)
+	if err != nil && tw.err == nil {
+		tw.err = err
+	}
+	return n, err
+}
+
+func (tw *transferWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// recordTransfer notes an image file fetch in the transfer history of the
+// system that made it: the one its URL was signed for, or else the one at
+// the client's address. Fetches from anything else, such as cache nodes,
+// aren't kept.
+func (s *Server) recordTransfer(r *http.Request, sys *db.System, name string, tw *transferWriter, elapsed time.Duration) {
+	if r.Method == http.MethodHead || tw.status == http.StatusNotModified {
+		return
+	}
+	client := clientAddr(r)
+	if sys == nil {
+		var err error
+		if sys, err = db.GetSystemByIP(s.DB, client); err != nil || sys == nil {
+			return
+		}
+	}
+	t := db.Transfer{File: name, ClientIP: client, Bytes: tw.bytes, Millis: elapsed.Milliseconds()}
+	t.Size, _ = strconv.ParseInt(tw.Header().Get("Content-Length"), 10, 64)
+	switch {
+	case tw.status >= 400:
+		t.Error = fmt.Sprintf("HTTP %d", tw.status)
+	case tw.bytes < t.Size && r.Context().Err() != nil:
+		t.Error = fmt.Sprintf("client hung up after %s of %s", fileSize(tw.bytes), fileSize(t.Size))
+	case tw.bytes < t.Size:
+		t.Error = fmt.Sprintf("stopped after %s of %s", fileSize(tw.bytes), fileSize(t.Size))
+		if tw.err != nil {
+			t.Error += ": " + tw.err.Error()
+		}
+	}
+	if err := db.RecordTransfer(s.DB, sys.ID, &t); err != nil {
+		log.Printf("http: %v", err)
+	}
+}
+
+// transferSummary sums up a system's latest fetches.
+type transferSummary struct {
+	Fetches int
+	Failed  int
+	Rate    float64 // bytes per second over finished fetches; 0 if none
+	Slow    bool    // Rate is under the slow_client_rate setting
+	Flaky   bool
+}
+
+func (s *Server) summarizeTransfers(transfers []db.Transfer) transferSummary {
+	var sum transferSummary
+	var bytes, millis int64
+	for _, t := range transfers[:min(len(transfers), transferWindow)] {
+		sum.Fetches++
+		if t.Error != "" {
+			sum.Failed++
+			continue
+		}
+		if t.Bytes >= minRateSample {
+			bytes += t.Bytes
+			millis += t.Millis
+		}
+	}
+	if millis > 0 {
+		sum.Rate = float64(bytes) / (float64(millis) / 1000)
+	}
+	sum.Slow = sum.Rate > 0 && sum.Rate < s.settingRate("slow_client_rate")
+	sum.Flaky = sum.Failed >= flakyFailures
+	return sum
+}
+
+// transferRate is how fast a fetch went, or "" if it was too short to
+// tell.
+func transferRate(t db.Transfer) string {
+	if t.Millis <= 0 || t.Bytes < minRateSample {
+		return ""
+	}
+	return formatRate(float64(t.Bytes) / (float64(t.Millis) / 1000))
+}
+
+// handleSystemTransfers returns a system's recent image file fetches and
+// whether it looks slow or flaky.
+func (s *Server) handleSystemTransfers(w http.ResponseWriter, r *http.Request) {
+	sys, ok := s.pathSystem(w, r)
+	if !ok {
+		return
+	}
+	transfers, err := db.ListTransfers(s.DB, sys.ID)
+	if err != nil {
+		log.Printf("http: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	sum := s.summarizeTransfers(transfers)
+	rows := make([]map[string]any, 0, len(transfers))
+	for _, t := range transfers {
+		rows = append(rows, map[string]any{
+			"id":         t.ID,
+			"file":       t.File,
+			"client_ip":  t.ClientIP,
+			"bytes":      t.Bytes,
+			"size":       t.Size,
+			"millis":     t.Millis,
+			"rate":       transferRate(t),
+			"error":      t.Error,
+			"created_at": t.CreatedAt,
+		})
+	}
+	summary := map[string]any{
+		"fetches": sum.Fetches,
+		"failed":  sum.Failed,
+		"rate":    "",
+		"slow":    sum.Slow,
+		"flaky":   sum.Flaky,
+	}
+	if sum.Rate > 0 {
+		summary["rate"] = formatRate(sum.Rate)
+	}
+	page, ok := listPage(w, r, rows, listing.Spec{Sort: "-id", Key: []string{"id"}})
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"summary": summary, "transfers": page.Rows, "next_cursor": page.Next})
+}
@@ -0,0 +1,221 @@
+package interop
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cobblerInherit is the value of a Cobbler field taken from the parent.
+const cobblerInherit = "<<inherit>>"
+
+// cobblerObject is a Cobbler system or profile as stored in its collection
+// files (/var/lib/cobbler/collections, or config/*.d before Cobbler 3).
+type cobblerObject struct {
+	Name            string                      `json:"name"`
+	Hostname        string                      `json:"hostname"`
+	Profile         string                      `json:"profile"`
+	Distro          string                      `json:"distro"`
+	Parent          string                      `json:"parent"`
+	Comment         string                      `json:"comment"`
+	Status          string                      `json:"status"`
+	Interfaces      map[string]cobblerInterface `json:"interfaces"`
+	KernelOptions   json.RawMessage             `json:"kernel_options"`
+	AutoinstallMeta json.RawMessage             `json:"autoinstall_meta"`
+	KSMeta          json.RawMessage             `json:"ks_meta"` // before Cobbler 3
+}
+
+type cobblerInterface struct {
+	MACAddress string `json:"mac_address"`
+}
+
+// ParseCobbler reads Cobbler systems and profiles from collection files:
+// one object per file, or several objects or arrays of them. Other
+// objects, such as distros, are ignored.
+func ParseCobbler(r io.Reader) (*Inventory, error) {
+	inv := &Inventory{Source: "cobbler"}
+	err := decodeObjects(r, func(raw json.RawMessage) error {
+		var o cobblerObject
+		if err := json.Unmarshal(raw, &o); err != nil {
+			return fmt.Errorf("cobbler object: %w", err)
+		}
+		meta := o.AutoinstallMeta
+		if len(meta) == 0 {
+			meta = o.KSMeta
+		}
+		switch {
+		case o.Interfaces != nil:
+			h := Host{Name: o.Hostname, Group: o.Profile, Vars: cobblerMeta(meta)}
+			if h.Name == "" || h.Name == cobblerInherit {
+				h.Name = o.Name
+			}
+			names := make([]string, 0, len(o.Interfaces))
+			for name := range o.Interfaces {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if mac := o.Interfaces[name].MACAddress; mac != "" && mac != cobblerInherit {
+					h.MACs = append(h.MACs, mac)
+				}
+			}
+			if o.Status != "" && o.Status != cobblerInherit {
+				h.Tags = append(h.Tags, "status:"+o.Status)
+			}
+			inv.Hosts = append(inv.Hosts, h)
+		case o.Distro != "" || o.Parent != "":
+			inv.Groups = append(inv.Groups, Group{
+				Name:         o.Name,
+				Description:  o.Comment,
+				KernelParams: cobblerKernelOptions(o.KernelOptions),
+				Vars:         cobblerMeta(meta),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// cobblerKernelOptions renders Cobbler kernel options, a string or a map
+// where "~" marks a bare flag, as a command line.
+func cobblerKernelOptions(raw json.RawMessage) string {
+	var v any
+	if len(raw) == 0 || json.Unmarshal(raw, &v) != nil {
+		return ""
+	}
+	switch v := v.(type) {
+	case string:
+		if v == cobblerInherit {
+			return ""
+		}
+		return v
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var parts []string
+		for _, k := range keys {
+			vals, ok := v[k].([]any)
+			if !ok {
+				vals = []any{v[k]}
+			}
+			for _, val := range vals {
+				if s := fmt.Sprint(val); val == nil || s == "~" || s == "" {
+					parts = append(parts, k)
+				} else {
+					parts = append(parts, k+"="+s)
+				}
+			}
+		}
+		return strings.Join(parts, " ")
+	}
+	return ""
+}
+
+// cobblerMeta reads Cobbler autoinstall metadata, a map or a string of
+// space-separated key=value pairs, as vars.
+func cobblerMeta(raw json.RawMessage) map[string]string {
+	var v any
+	if len(raw) == 0 || json.Unmarshal(raw, &v) != nil {
+		return nil
+	}
+	vars := map[string]string{}
+	switch v := v.(type) {
+	case string:
+		if v == cobblerInherit {
+			return nil
+		}
+		for _, f := range strings.Fields(v) {
+			k, val, _ := strings.Cut(f, "=")
+			vars[k] = val
+		}
+	case map[string]any:
+		for k, val := range v {
+			if val == nil {
+				vars[k] = ""
+			} else {
+				vars[k] = fmt.Sprint(val)
+			}
+		}
+	}
+	return vars
+}
+
+// ExportCobbler writes a shell script of cobbler commands that recreate
+// duh's profiles and systems on a Cobbler 3 server. Profiles are created
+// on the distro named by $DISTRO; systems without a profile are left out,
+// since Cobbler requires one.
+func ExportCobbler(w io.Writer, d *sql.DB) error {
+	e, err := loadExport(d)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "#!/bin/sh\n# Exported from duh on %s. Run on the Cobbler server:\n#   DISTRO=<distro> sh duh-cobbler.sh\n",
+		time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(bw, "set -e\n: \"${DISTRO:?set DISTRO to the Cobbler distro for the profiles}\"\n\n")
+
+	for _, p := range e.Profiles {
+		fmt.Fprintf(bw, "cobbler profile add --name=%s --distro=\"$DISTRO\"", shellQuote(p.Name))
+		if p.Description != "" {
+			fmt.Fprintf(bw, " --comment=%s", shellQuote(p.Description))
+		}
+		if p.KernelParams != "" {
+			fmt.Fprintf(bw, " --kernel-options=%s", shellQuote(p.KernelParams))
+		}
+		if meta := cobblerMetaString(p.DefaultVars); meta != "" {
+			fmt.Fprintf(bw, " --autoinstall-meta=%s", shellQuote(meta))
+		}
+		fmt.Fprintln(bw)
+	}
+	if len(e.Profiles) > 0 {
+		fmt.Fprintln(bw)
+	}
+
+	for i := range e.Systems {
+		sys := &e.Systems[i]
+		name := systemName(sys)
+		prof := e.profileName(sys)
+		if prof == "" {
+			fmt.Fprintf(bw, "# %s (%s) has no profile; skipped\n", name, sys.MAC)
+			continue
+		}
+		fmt.Fprintf(bw, "cobbler system add --name=%s --profile=%s --interface=eth0 --mac-address=%s",
+			shellQuote(name), shellQuote(prof), shellQuote(sys.MAC))
+		if sys.Hostname != "" {
+			fmt.Fprintf(bw, " --hostname=%s", shellQuote(sys.Hostname))
+		}
+		if sys.IPAddr != "" {
+			fmt.Fprintf(bw, " --ip-address=%s", shellQuote(sys.IPAddr))
+		}
+		if meta := cobblerMetaString(sys.Vars); meta != "" {
+			fmt.Fprintf(bw, " --autoinstall-meta=%s", shellQuote(meta))
+		}
+		fmt.Fprintln(bw)
+	}
+	fmt.Fprintln(bw, "\ncobbler sync")
+	return bw.Flush()
+}
+
+// cobblerMetaString renders vars as Cobbler's key=value metadata. Values
+// with spaces can't be expressed and are left out.
+func cobblerMetaString(varsJSON string) string {
+	var parts []string
+	for _, kv := range sortedVars(varsJSON) {
+		if strings.ContainsAny(kv[0]+kv[1], " \t\n") {
+			continue
+		}
+		parts = append(parts, kv[0]+"="+kv[1])
+	}
+	return strings.Join(parts, " ")
+}
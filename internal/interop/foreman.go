@@ -0,0 +1,262 @@
+package interop
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ForemanClient reads hosts and host groups from the Foreman API.
+type ForemanClient struct {
+	URL   string // e.g. https://foreman.example.com
+	User  string
+	Token string // password or personal access token
+	HTTP  *http.Client
+}
+
+func NewForemanClient(baseURL, user, token string) *ForemanClient {
+	return &ForemanClient{
+		URL:   strings.TrimRight(baseURL, "/"),
+		User:  user,
+		Token: token,
+		HTTP:  &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// foremanPerPage is the page size asked of the API.
+const foremanPerPage = 100
+
+// Inventory returns every host group and host.
+func (c *ForemanClient) Inventory(ctx context.Context) (*Inventory, error) {
+	inv := &Inventory{Source: "foreman"}
+	err := c.list(ctx, "/api/hostgroups", func(raw json.RawMessage) error {
+		g, err := foremanGroup(raw)
+		if err == nil {
+			inv.Groups = append(inv.Groups, g)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = c.list(ctx, "/api/hosts?include%5B%5D=all_parameters", func(raw json.RawMessage) error {
+		h, err := foremanHost(raw)
+		if err == nil {
+			inv.Hosts = append(inv.Hosts, h)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// list walks the pages of an index endpoint, calling fn with each result.
+func (c *ForemanClient) list(ctx context.Context, path string, fn func(json.RawMessage) error) error {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	for page := 1; ; page++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			fmt.Sprintf("%s%s%spage=%d&per_page=%d", c.URL, path, sep, page, foremanPerPage), nil)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(c.User, c.Token)
+		req.Header.Set("Accept", "application/json")
+		resp, err := c.HTTP.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode/100 != 2 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			resp.Body.Close()
+			return fmt.Errorf("foreman GET %s: %s: %s", req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+		}
+		var body struct {
+			Subtotal int               `json:"subtotal"`
+			Results  []json.RawMessage `json:"results"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("decode foreman %s: %w", req.URL.Path, err)
+		}
+		for _, r := range body.Results {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		if len(body.Results) < foremanPerPage || page*foremanPerPage >= body.Subtotal {
+			return nil
+		}
+	}
+}
+
+// ParseForeman reads Foreman hosts from files: pages saved from
+// /api/hosts, or the JSON output of "hammer --output json host list".
+func ParseForeman(r io.Reader) (*Inventory, error) {
+	inv := &Inventory{Source: "foreman"}
+	err := decodeObjects(r, func(raw json.RawMessage) error {
+		h, err := foremanHost(raw)
+		if err == nil {
+			inv.Hosts = append(inv.Hosts, h)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// foremanFields is a Foreman object with its keys normalized, so that the
+// API's "hostgroup_title" and hammer's "Host Group" can be looked up alike.
+type foremanFields map[string]json.RawMessage
+
+func parseForemanFields(raw json.RawMessage) (foremanFields, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("foreman object: %w", err)
+	}
+	f := make(foremanFields, len(m))
+	for k, v := range m {
+		f[strings.ReplaceAll(strings.ToLower(k), " ", "_")] = v
+	}
+	return f, nil
+}
+
+// str returns the first of keys that holds a string or number.
+func (f foremanFields) str(keys ...string) string {
+	for _, k := range keys {
+		var v any
+		if json.Unmarshal(f[k], &v) != nil {
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			if v != "" {
+				return v
+			}
+		case float64:
+			return fmt.Sprint(v)
+		}
+	}
+	return ""
+}
+
+// params returns a Foreman object's parameters as vars.
+func (f foremanFields) params() map[string]string {
+	for _, k := range []string{"all_parameters", "parameters"} {
+		var params []struct {
+			Name  string `json:"name"`
+			Value any    `json:"value"`
+		}
+		if json.Unmarshal(f[k], &params) != nil || len(params) == 0 {
+			continue
+		}
+		vars := make(map[string]string, len(params))
+		for _, p := range params {
+			if p.Value == nil {
+				vars[p.Name] = ""
+			} else if s, ok := p.Value.(string); ok {
+				vars[p.Name] = s
+			} else {
+				b, _ := json.Marshal(p.Value)
+				vars[p.Name] = string(b)
+			}
+		}
+		return vars
+	}
+	return nil
+}
+
+func foremanHost(raw json.RawMessage) (Host, error) {
+	f, err := parseForemanFields(raw)
+	if err != nil {
+		return Host{}, err
+	}
+	h := Host{
+		Name:  f.str("name"),
+		Group: f.str("hostgroup_title", "hostgroup_name", "host_group"),
+		Vars:  f.params(),
+	}
+	if mac := f.str("mac"); mac != "" {
+		h.MACs = []string{mac}
+	}
+	if loc := f.str("location_name", "location"); loc != "" {
+		h.Tags = append(h.Tags, "location:"+loc)
+	}
+	if org := f.str("organization_name", "organization"); org != "" {
+		h.Tags = append(h.Tags, "organization:"+org)
+	}
+	return h, nil
+}
+
+func foremanGroup(raw json.RawMessage) (Group, error) {
+	f, err := parseForemanFields(raw)
+	if err != nil {
+		return Group{}, err
+	}
+	return Group{
+		Name:        f.str("title", "name"),
+		Description: f.str("description"),
+		Vars:        f.params(),
+	}, nil
+}
+
+// ExportForeman writes a shell script of hammer commands that recreate
+// duh's profiles as host groups and its systems as hosts in those groups.
+// Options every host needs in the target Foreman, such as its organization
+// and location, go in $HAMMER_HOST_OPTIONS.
+func ExportForeman(w io.Writer, d *sql.DB) error {
+	e, err := loadExport(d)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "#!/bin/sh\n# Exported from duh on %s. Run where hammer is configured:\n#   HAMMER_HOST_OPTIONS='--organization Org --location Loc' sh duh-foreman.sh\n",
+		time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(bw, "set -e\n\n")
+
+	for _, p := range e.Profiles {
+		fmt.Fprintf(bw, "hammer hostgroup create --name %s", shellQuote(p.Name))
+		if p.Description != "" {
+			fmt.Fprintf(bw, " --description %s", shellQuote(p.Description))
+		}
+		fmt.Fprintln(bw)
+		for _, kv := range sortedVars(p.DefaultVars) {
+			fmt.Fprintf(bw, "hammer hostgroup set-parameter --hostgroup-title %s --name %s --value %s\n",
+				shellQuote(p.Name), shellQuote(kv[0]), shellQuote(kv[1]))
+		}
+	}
+	if len(e.Profiles) > 0 {
+		fmt.Fprintln(bw)
+	}
+
+	for i := range e.Systems {
+		sys := &e.Systems[i]
+		name := systemName(sys)
+		fmt.Fprintf(bw, "hammer host create --name %s --mac %s", shellQuote(name), shellQuote(sys.MAC))
+		if sys.IPAddr != "" {
+			fmt.Fprintf(bw, " --ip %s", shellQuote(sys.IPAddr))
+		}
+		if prof := e.profileName(sys); prof != "" {
+			fmt.Fprintf(bw, " --hostgroup-title %s", shellQuote(prof))
+		}
+		fmt.Fprintln(bw, " --build false $HAMMER_HOST_OPTIONS")
+		for _, kv := range sortedVars(sys.Vars) {
+			fmt.Fprintf(bw, "hammer host set-parameter --host %s --name %s --value %s\n",
+				shellQuote(name), shellQuote(kv[0]), shellQuote(kv[1]))
+		}
+	}
+	return bw.Flush()
+}
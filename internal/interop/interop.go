@@ -0,0 +1,306 @@
+// Package interop moves machines between duh and other provisioning
+// systems: it imports Cobbler systems and profiles and Foreman hosts and
+// host groups, and exports duh's systems and profiles as scripts that
+// recreate them in either.
+package interop
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/db"
+)
+
+// Host is a machine read from another provisioning system.
+type Host struct {
+	Name string // may be fully qualified
+	MACs []string
+	// Group is the Cobbler profile or Foreman host group the host uses,
+	// matched to a duh profile by name.
+	Group string
+	Vars  map[string]string
+	Tags  []string
+}
+
+// Group is a Cobbler profile or Foreman host group, imported as a profile.
+type Group struct {
+	Name         string
+	Description  string
+	KernelParams string
+	Vars         map[string]string
+}
+
+// Inventory is what an import read.
+type Inventory struct {
+	Source string // "cobbler" or "foreman"
+	Groups []Group
+	Hosts  []Host
+}
+
+// Result summarizes an import.
+type Result struct {
+	Profiles         int // profiles created
+	ProfilesExisting int // groups whose profile already existed
+	Created          []db.System
+	Updated          int // existing systems that gained a hostname, profile, vars or tags
+	Skipped          int // hosts without a MAC
+	Errors           []string
+}
+
+// Import creates a profile for every group with no profile of that name,
+// and creates or updates a system for every host. Like the NetBox sync, a
+// host whose MAC already belongs to a system keeps that system: the import
+// only fills in its hostname and profile if it has none, adds vars it
+// doesn't set, and adds tags.
+func Import(d *sql.DB, inv *Inventory) (*Result, error) {
+	profiles, err := db.ListProfiles(d)
+	if err != nil {
+		return nil, err
+	}
+	profileIDs := make(map[string]int64, len(profiles))
+	for _, p := range profiles {
+		profileIDs[p.Name] = p.ID
+	}
+
+	res := &Result{}
+	for _, g := range inv.Groups {
+		if _, ok := profileIDs[g.Name]; ok || g.Name == "" {
+			res.ProfilesExisting++
+			continue
+		}
+		desc := g.Description
+		if desc == "" {
+			desc = "Imported from " + inv.Source
+		}
+		id, err := db.CreateProfile(d, g.Name, desc, "custom", "", g.KernelParams, varsJSON(g.Vars), "", "", "")
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("profile %s: %v", g.Name, err))
+			continue
+		}
+		profileIDs[g.Name] = id
+		res.Profiles++
+	}
+
+	for _, h := range inv.Hosts {
+		if len(h.MACs) == 0 {
+			res.Skipped++
+			continue
+		}
+		if err := importHost(d, h, profileIDs, res); err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: %v", h.Name, err))
+		}
+	}
+	return res, nil
+}
+
+func importHost(d *sql.DB, h Host, profileIDs map[string]int64, res *Result) error {
+	macs := make([]string, 0, len(h.MACs))
+	for _, m := range h.MACs {
+		mac, err := db.NormalizeMAC(m)
+		if err != nil {
+			return err
+		}
+		macs = append(macs, mac)
+	}
+	var sys *db.System
+	for _, mac := range macs {
+		s, err := db.GetSystemByMAC(d, mac)
+		if err != nil {
+			return err
+		}
+		if s != nil {
+			sys = s
+			break
+		}
+	}
+
+	short, _, _ := strings.Cut(h.Name, ".")
+	hostname := db.NormalizeHostname(short)
+	created, changed := false, false
+	if sys == nil {
+		s, err := db.CreateSystem(d, macs[0], hostname)
+		if err != nil {
+			return err
+		}
+		sys, created = s, true
+	} else if sys.Hostname == "" && hostname != "" {
+		if err := db.UpdateSystemInfo(d, sys.ID, sys.MAC, hostname); err != nil {
+			return err
+		}
+		sys.Hostname = hostname
+		changed = true
+	}
+
+	if id, ok := profileIDs[h.Group]; ok && sys.ProfileID == nil {
+		if err := db.UpdateSystemProfile(d, sys.ID, &id); err != nil {
+			return err
+		}
+		sys.ProfileID = &id
+		changed = true
+	}
+
+	if len(h.Vars) > 0 {
+		vars := map[string]string{}
+		if sys.Vars != "" {
+			json.Unmarshal([]byte(sys.Vars), &vars)
+		}
+		added := false
+		for k, v := range h.Vars {
+			if _, ok := vars[k]; !ok {
+				vars[k] = v
+				added = true
+			}
+		}
+		if added {
+			v := varsJSON(vars)
+			if err := db.UpdateSystemVars(d, sys.ID, v); err != nil {
+				return err
+			}
+			sys.Vars = v
+			changed = true
+		}
+	}
+
+	if len(h.Tags) > 0 {
+		tags := db.NormalizeTags(sys.Tags + "," + strings.Join(h.Tags, ","))
+		if tags != sys.Tags {
+			if err := db.UpdateSystemTags(d, sys.ID, tags); err != nil {
+				return err
+			}
+			sys.Tags = tags
+			changed = true
+		}
+	}
+
+	switch {
+	case created:
+		res.Created = append(res.Created, *sys)
+	case changed:
+		res.Updated++
+	}
+	return nil
+}
+
+func varsJSON(vars map[string]string) string {
+	if len(vars) == 0 {
+		return "{}"
+	}
+	b, _ := json.Marshal(vars)
+	return string(b)
+}
+
+// decodeObjects calls fn with every JSON object in r, which may hold
+// several top-level values. Arrays are walked, and so is the results
+// array of an API page.
+func decodeObjects(r io.Reader, fn func(json.RawMessage) error) error {
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		raw = bytes.TrimSpace(raw)
+		if len(raw) == 0 {
+			continue
+		}
+		var items []json.RawMessage
+		switch raw[0] {
+		case '[':
+			if err := json.Unmarshal(raw, &items); err != nil {
+				return err
+			}
+		case '{':
+			var page struct {
+				Results []json.RawMessage `json:"results"`
+			}
+			if json.Unmarshal(raw, &page) == nil && page.Results != nil {
+				items = page.Results
+			} else {
+				items = []json.RawMessage{raw}
+			}
+		default:
+			return fmt.Errorf("expected a JSON object or array, got %.20s", raw)
+		}
+		for _, item := range items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// exportData is what the exporters write: every live profile and system.
+type exportData struct {
+	Profiles []db.Profile
+	Systems  []db.System
+	byID     map[int64]*db.Profile
+}
+
+func loadExport(d *sql.DB) (*exportData, error) {
+	profiles, err := db.ListProfiles(d)
+	if err != nil {
+		return nil, err
+	}
+	systems, err := db.ListSystems(d)
+	if err != nil {
+		return nil, err
+	}
+	// Oldest first, so a script reads in the order things were added.
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].ID < profiles[j].ID })
+	sort.Slice(systems, func(i, j int) bool { return systems[i].ID < systems[j].ID })
+	e := &exportData{Profiles: profiles, Systems: systems, byID: map[int64]*db.Profile{}}
+	for i := range e.Profiles {
+		e.byID[e.Profiles[i].ID] = &e.Profiles[i]
+	}
+	return e, nil
+}
+
+// profileName returns the name of a system's profile, or "" if it has none.
+func (e *exportData) profileName(sys *db.System) string {
+	if sys.ProfileID == nil {
+		return ""
+	}
+	if p := e.byID[*sys.ProfileID]; p != nil {
+		return p.Name
+	}
+	return ""
+}
+
+// systemName is what a system is called in the other system: its hostname,
+// or one made from its MAC.
+func systemName(sys *db.System) string {
+	if sys.Hostname != "" {
+		return sys.Hostname
+	}
+	return "duh-" + strings.ReplaceAll(sys.MAC, ":", "")
+}
+
+// sortedVars parses a vars JSON object into key-sorted pairs.
+func sortedVars(varsJSON string) [][2]string {
+	vars := map[string]string{}
+	if varsJSON != "" {
+		json.Unmarshal([]byte(varsJSON), &vars)
+	}
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([][2]string, len(keys))
+	for i, k := range keys {
+		out[i] = [2]string{k, vars[k]}
+	}
+	return out
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,74 @@
+package ipxe
+
+import "strings"
+
+// Client describes the iPXE build a script is rendered for, as reported in
+// the chain URL. Fields are empty when the client didn't report them, e.g.
+// when chained by a DHCP server that doesn't pass them along.
+type Client struct {
+	Platform  string   `json:"platform,omitempty"`  // "pcbios" or "efi"
+	BuildArch string   `json:"buildarch,omitempty"` // e.g. "x86_64", "i386", "arm64"
+	Version   string   `json:"version,omitempty"`   // e.g. "1.21.1+ (g1234567)"
+	Features  []string `json:"features,omitempty"`  // build features, e.g. "http", "https", "nfs"
+}
+
+// ParseFeatures splits a comma-separated feature list.
+func ParseFeatures(s string) []string {
+	var features []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.ToLower(strings.TrimSpace(f)); f != "" {
+			features = append(features, f)
+		}
+	}
+	return features
+}
+
+// Supports reports whether the client was built with feature. A client
+// that didn't report its features is assumed to have them all, which is how
+// scripts were rendered before clients reported anything.
+func (c Client) Supports(feature string) bool {
+	if len(c.Features) == 0 {
+		return true
+	}
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// EFI reports whether the client runs under UEFI firmware.
+func (c Client) EFI() bool {
+	return c.Platform == "efi"
+}
+
+// archFamilies maps the names iPXE, catalogs and distributions give an
+// architecture to the instruction set they stand for. A 32-bit x86 iPXE
+// runs on 64-bit machines and boots 64-bit kernels, so i386 is x86 too.
+var archFamilies = map[string]string{
+	"i386": "x86", "i686": "x86", "x86": "x86", "x86_64": "x86", "amd64": "x86", "x64": "x86",
+	"arm64": "arm64", "aarch64": "arm64",
+	"arm32": "arm32", "arm": "arm32", "armhf": "arm32", "armv7": "arm32",
+	"riscv64": "riscv64",
+	"loong64": "loong64", "loongarch64": "loong64",
+}
+
+// ArchFamily is the instruction set of an architecture however it is
+// spelled, so "amd64" and "x86_64" are both "x86". Names it doesn't know
+// are their own family.
+func ArchFamily(arch string) string {
+	arch = strings.ToLower(strings.TrimSpace(arch))
+	if f, ok := archFamilies[arch]; ok {
+		return f
+	}
+	return arch
+}
+
+// ArchMismatch reports whether an image for imageArch can't boot on a
+// machine whose iPXE reported buildArch. When either is unknown it can't
+// tell, and reports no mismatch.
+func ArchMismatch(buildArch, imageArch string) bool {
+	a, b := ArchFamily(buildArch), ArchFamily(imageArch)
+	return a != "" && b != "" && a != b
+}
@@ -0,0 +1,105 @@
+package ipxe
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"text/template"
+)
+
+// EmbedParams configures a script for embedding into an iPXE build.
+type EmbedParams struct {
+	ServerURL string
+
+	// Static addressing, for networks without DHCP. Leave IP empty to
+	// use DHCP on every interface.
+	Interface string // defaults to net0
+	IP        string
+	Netmask   string
+	Gateway   string
+	DNS       string
+}
+
+// embedTmpl brings up the network and chains to boot.ipxe, retrying until
+// the server answers, so a machine booted from the build keeps trying
+// through outages instead of falling through to the next boot device.
+var embedTmpl = template.Must(template.New("embed").Parse(`#!ipxe
+# Generated by duh for {{.ServerURL}}
+{{- if .IP}}
+set {{.Interface}}/ip {{.IP}}
+set {{.Interface}}/netmask {{.Netmask}}
+{{- if .Gateway}}
+set {{.Interface}}/gateway {{.Gateway}}
+{{- end}}
+{{- if .DNS}}
+set {{.Interface}}/dns {{.DNS}}
+{{- end}}
+ifopen {{.Interface}} || goto failed
+set mac ${ {{- .Interface}}/mac}
+{{- else}}
+
+:dhcp
+dhcp || goto dhcp_failed
+set mac ${netX/mac}
+{{- end}}
+
+:chain
+chain --autofree {{.ServerURL}}/boot.ipxe?mac=${mac}&platform=${platform:uristring}&buildarch=${buildarch:uristring}&version=${version:uristring} || goto failed
+exit
+
+{{- if not .IP}}
+
+:dhcp_failed
+echo duh: DHCP failed, retrying in 10 seconds
+sleep 10
+goto dhcp
+{{- end}}
+
+:failed
+echo duh: could not reach {{.ServerURL}}, retrying in 10 seconds
+sleep 10
+goto chain
+`))
+
+// EmbedScript renders a script to embed into an iPXE build (make
+// EMBED=...), so machines that can't be pointed at duh through DHCP still
+// boot from it.
+func EmbedScript(p EmbedParams) (string, error) {
+	p.ServerURL = strings.TrimSuffix(p.ServerURL, "/")
+	if p.ServerURL == "" {
+		return "", fmt.Errorf("server URL is required")
+	}
+	if p.Interface == "" {
+		p.Interface = "net0"
+	}
+	if !validSettingName(p.Interface) {
+		return "", fmt.Errorf("invalid interface %q", p.Interface)
+	}
+	if p.IP != "" {
+		if p.Netmask == "" {
+			return "", fmt.Errorf("netmask is required with a static IP")
+		}
+		for _, a := range []struct{ name, val string }{
+			{"IP", p.IP}, {"netmask", p.Netmask}, {"gateway", p.Gateway}, {"DNS", p.DNS},
+		} {
+			if a.val != "" && net.ParseIP(a.val).To4() == nil {
+				return "", fmt.Errorf("invalid %s %q", a.name, a.val)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := embedTmpl.Execute(&buf, p); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func validSettingName(s string) bool {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -3,35 +3,93 @@ package ipxe
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"text/template"
+	"time"
 )
 
-var linuxTmpl = template.Must(template.New("linux").Parse(`#!ipxe
-kernel {{.KernelURL}} {{.Cmdline}}
-initrd {{.InitrdURL}}
+// ackLine tells the server the client has fetched everything it needs and
+// is about to boot. A failed ack is logged on the console but doesn't stop
+// the boot.
+const ackLine = `{{if .AckURL}}
+imgfetch --name ack {{.AckURL}} && imgfree ack || echo duh: boot ack failed
+{{- end}}
+`
+
+// verifyTrust, kernelName, kernelVerify and initrdLines check the kernel
+// and initrds against their signatures with imgverify when the params
+// carry signature URLs. imgtrust then refuses to boot anything unverified.
+const verifyTrust = `{{- if .KernelSigURL}}
+imgtrust
+{{- end}}`
+
+const kernelName = `{{if .KernelSigURL}}--name kernel {{end}}`
+
+const kernelVerify = `{{- with .KernelSigURL}}
+imgverify kernel {{.}}
+{{- end}}`
+
+const initrdLines = `{{- range $i, $url := .InitrdURLs}}
+initrd {{if $.InitrdSigURLs}}--name initrd{{$i}} {{end}}{{$url}}
+{{- if $.InitrdSigURLs}}
+imgverify initrd{{$i}} {{index $.InitrdSigURLs $i}}
+{{- end}}
+{{- end}}`
+
+var linuxTmpl = template.Must(template.New("linux").Parse(`#!ipxe` + verifyTrust + `
+kernel ` + kernelName + `{{.KernelURL}} {{.Cmdline}}` + kernelVerify + initrdLines + `
 {{- range .OverlayURLs}}
 initrd {{.}}
-{{- end}}
-boot
+{{- end}}` + ackLine + `boot
 `))
 
 var wimbootTmpl = template.Must(template.New("wimboot").Parse(`#!ipxe
 kernel {{.KernelURL}}
 initrd --name BCD {{.ExtraFileURLs.BCD}}
 initrd --name boot.sdi {{.ExtraFileURLs.BootSDI}}
-initrd --name boot.wim {{.ExtraFileURLs.BootWIM}}
-boot
+initrd --name boot.wim {{.ExtraFileURLs.BootWIM}}` + ackLine + `boot
 `))
 
 var esxiTmpl = template.Must(template.New("esxi").Parse(`#!ipxe
-kernel {{.KernelURL}} -c {{.ExtraFileURLs.BootCfg}} {{.Cmdline}}
-boot
+kernel {{.KernelURL}} -c {{.ExtraFileURLs.BootCfg}} {{.Cmdline}}` + ackLine + `boot
 `))
 
+// isoTmpl boots an ISO with memdisk, which only runs on BIOS. UEFI
+// clients sanboot the ISO over HTTP instead.
 var isoTmpl = template.Must(template.New("iso").Parse(`#!ipxe
+{{- if .Client.EFI}}` + ackLine + `sanboot --no-describe {{.ExtraFileURLs.BootISO}}
+{{- else}}
 kernel {{.KernelURL}} iso raw
-initrd {{.ExtraFileURLs.BootISO}}
-boot
+initrd {{.ExtraFileURLs.BootISO}}` + ackLine + `boot
+{{- end}}
+`))
+
+// nfsTmpl boots a diskless system whose root filesystem is an NFS export.
+// The initrd must include NFS root support (e.g. dracut's nfs module).
+var nfsTmpl = template.Must(template.New("nfs").Parse(`#!ipxe` + verifyTrust + `
+kernel ` + kernelName + `{{.KernelURL}} root=/dev/nfs nfsroot={{.Target}} ip=dhcp rw {{.Cmdline}}` + kernelVerify + initrdLines + `
+{{- range .OverlayURLs}}
+initrd {{.}}
+{{- end}}` + ackLine + `boot
+`))
+
+// iscsiTmpl boots straight from an iSCSI LUN. If the image also has a
+// kernel, the LUN is hooked instead and the installer boots with it
+// described in the iBFT, so it can install onto the SAN disk.
+var iscsiTmpl = template.Must(template.New("iscsi").Parse(`#!ipxe
+set initiator-iqn {{.InitiatorIQN}}
+{{- if .KernelURL}}
+sanhook --drive 0x80 {{.Target}} || goto failed` + verifyTrust + `
+kernel ` + kernelName + `{{.KernelURL}} {{.Cmdline}}` + kernelVerify + initrdLines + `
+{{- range .OverlayURLs}}
+initrd {{.}}
+{{- end}}` + ackLine + `boot
+{{- else}}` + ackLine + `sanboot --drive 0x80 {{.Target}} || goto failed
+{{- end}}
+
+:failed
+echo duh: iSCSI boot from {{.Target}} failed
+exit
 `))
 
 // ExtraFileURLs holds pre-signed URLs for boot-type-specific extra files.
@@ -44,13 +102,41 @@ type ExtraFileURLs struct {
 }
 
 type ScriptParams struct {
+	ServerURL     string
+	ImageID       int64
 	KernelURL     string
-	InitrdURL     string
+	InitrdURL     string   // first of InitrdURLs, for custom scripts
+	InitrdURLs    []string // in the order the image lists them
 	Cmdline       string
 	MAC           string
 	Hostname      string
 	OverlayURLs   []string
 	ExtraFileURLs ExtraFileURLs
+	FileURLs      map[string]string // role → signed URL for every extra file on the image
+	RootfsURL     string
+	ChecksumsURL  string
+
+	// Signature URLs for imgverify, parallel to KernelURL, InitrdURLs and
+	// FileURLs. Empty unless clients verify boot files.
+	KernelSigURL  string
+	InitrdSigURLs []string
+	FileSigURLs   map[string]string
+	AckURL        string // fetched right before boot to mark the system provisioning
+	Target        string // nfs/iscsi: the image's boot target, rendered for this system
+	InitiatorIQN  string // iscsi: defaults to one derived from the hostname
+	Client        Client // the iPXE build requesting the script
+}
+
+// defaultInitiatorPrefix is the IQN naming authority iPXE itself uses.
+const defaultInitiatorPrefix = "iqn.2010-04.org.ipxe:"
+
+// UsesAck reports whether a rendered boot type will fetch AckURL. Custom
+// scripts only do so if they reference it.
+func UsesAck(bootType, ipxeScript string) bool {
+	if bootType == "custom" {
+		return strings.Contains(ipxeScript, ".AckURL")
+	}
+	return true
 }
 
 func RenderBootScript(bootType string, params ScriptParams, ipxeScript string) (string, error) {
@@ -63,6 +149,22 @@ func RenderBootScript(bootType string, params ScriptParams, ipxeScript string) (
 		tmpl = esxiTmpl
 	case "iso":
 		tmpl = isoTmpl
+	case "nfs", "iscsi":
+		if params.Target == "" {
+			return "", fmt.Errorf("%s image has no boot target", bootType)
+		}
+		target, err := renderTarget(params.Target, params)
+		if err != nil {
+			return "", err
+		}
+		params.Target = target
+		if params.InitiatorIQN == "" {
+			params.InitiatorIQN = defaultInitiatorPrefix + params.Hostname
+		}
+		tmpl = nfsTmpl
+		if bootType == "iscsi" {
+			tmpl = iscsiTmpl
+		}
 	case "custom":
 		if ipxeScript == "" {
 			return ExitScript(), nil
@@ -83,6 +185,24 @@ func RenderBootScript(bootType string, params ScriptParams, ipxeScript string) (
 	return buf.String(), nil
 }
 
+// renderTarget expands template actions in a boot target, so one image can
+// point each system at its own export or LUN, e.g.
+// iscsi:10.0.0.5::::iqn.2024-01.lan.san:{{.Hostname}}.
+func renderTarget(target string, params ScriptParams) (string, error) {
+	if !strings.Contains(target, "{{") {
+		return target, nil
+	}
+	t, err := template.New("target").Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("parse boot target: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, params); err != nil {
+		return "", fmt.Errorf("render boot target: %w", err)
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
 func WrapWithConfirmation(script, hostname, mac string) string {
 	label := mac
 	if hostname != "" {
@@ -120,3 +240,34 @@ func stripShebang(script string) string {
 func ExitScript() string {
 	return "#!ipxe\nexit\n"
 }
+
+// ExitParams customizes the script sent to a machine that isn't going to
+// be booted, so its console says why instead of moving straight on.
+type ExitParams struct {
+	Message string        // shown line by line; nothing is shown when empty
+	Wait    time.Duration // how long the message stays up
+	PingURL string        // fetched before exiting, if set
+}
+
+// RenderExitScript renders an exit script from p, or ExitScript when p
+// asks for nothing. A failed ping is ignored.
+func RenderExitScript(p ExitParams) string {
+	if p.Message == "" && p.PingURL == "" {
+		return ExitScript()
+	}
+	var b strings.Builder
+	b.WriteString("#!ipxe\n")
+	if p.Message != "" {
+		for _, line := range strings.Split(strings.TrimRight(p.Message, "\n"), "\n") {
+			b.WriteString("echo " + strings.TrimRight(line, "\r") + "\n")
+		}
+	}
+	if p.PingURL != "" {
+		fmt.Fprintf(&b, "imgfetch --name ping %s && imgfree ping ||\n", p.PingURL)
+	}
+	if p.Message != "" && p.Wait > 0 {
+		fmt.Fprintf(&b, "sleep %d\n", int(p.Wait.Seconds()))
+	}
+	b.WriteString("exit\n")
+	return b.String()
+}
@@ -0,0 +1,264 @@
+// Package jobs runs duh's background work — catalog downloads, webhook
+// deliveries, trash purges — from a queue kept in the database. A job that
+// fails is retried with backoff, and one that is queued or cut short when
+// duh stops runs again after it starts.
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+)
+
+// Handler does the work of one job type. It should stop when ctx is done,
+// which happens when duh shuts down and the job is taking too long; the job
+// is then run again on the next start.
+type Handler func(ctx context.Context, payload []byte) error
+
+// MaxAttempts is how many times a job is tried before it is left failed.
+const MaxAttempts = 5
+
+const (
+	pollInterval  = 5 * time.Second
+	retryBase     = 30 * time.Second
+	retryMax      = time.Hour
+	pruneInterval = time.Hour
+	// keepFinished is how long done, failed and cancelled jobs stay on
+	// the Jobs page.
+	keepFinished = 7 * 24 * time.Hour
+)
+
+// Queue hands queued jobs to their handlers.
+type Queue struct {
+	db *sql.DB
+
+	// Workers is how many jobs run at once.
+	Workers int
+	// DrainTimeout is how long Run lets running jobs finish after its
+	// context is done before interrupting them.
+	DrainTimeout time.Duration
+
+	mu       sync.RWMutex
+	handlers map[string]Handler
+	wake     chan struct{}
+}
+
+func New(database *sql.DB) *Queue {
+	return &Queue{
+		db:           database,
+		Workers:      4,
+		DrainTimeout: 30 * time.Second,
+		handlers:     map[string]Handler{},
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// Handle registers the handler for a job type.
+func (q *Queue) Handle(typ string, h Handler) {
+	q.mu.Lock()
+	q.handlers[typ] = h
+	q.mu.Unlock()
+}
+
+func (q *Queue) handler(typ string) Handler {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.handlers[typ]
+}
+
+// Enqueue queues a job with payload, marshalled as JSON, and returns its
+// ID.
+func (q *Queue) Enqueue(typ string, payload any) (int64, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return 0, fmt.Errorf("enqueue %s: %w", typ, err)
+	}
+	id, err := db.EnqueueJob(q.db, typ, string(b), MaxAttempts)
+	if err != nil {
+		return 0, err
+	}
+	q.Wake()
+	return id, nil
+}
+
+// EnqueueOnce is Enqueue, unless the same job is already queued or
+// running, whose ID it returns instead.
+func (q *Queue) EnqueueOnce(typ string, payload any) (int64, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return 0, fmt.Errorf("enqueue %s: %w", typ, err)
+	}
+	id, err := db.EnqueueJobOnce(q.db, typ, string(b), MaxAttempts)
+	if err != nil {
+		return 0, err
+	}
+	q.Wake()
+	return id, nil
+}
+
+// ScheduleOnce queues a job due after delay, unless the same job is already
+// queued, whose ID it returns instead.
+func (q *Queue) ScheduleOnce(typ string, payload any, delay time.Duration) (int64, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return 0, fmt.Errorf("schedule %s: %w", typ, err)
+	}
+	return db.ScheduleJobOnce(q.db, typ, string(b), MaxAttempts, delay)
+}
+
+// Wake has Run look for due jobs now rather than at its next poll.
+func (q *Queue) Wake() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// permanentError is a failure retrying won't fix.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks a handler's error as one retrying won't fix, so the job
+// fails at once.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// retryDelay is how long to wait before the next attempt after attempts
+// failed ones: doubling from retryBase up to retryMax.
+func retryDelay(attempts int) time.Duration {
+	d := retryBase
+	for i := 1; i < attempts && d < retryMax; i++ {
+		d *= 2
+	}
+	return min(d, retryMax)
+}
+
+// Run runs due jobs until ctx is done. Jobs left running by a previous
+// process are queued again first. On shutdown no new jobs start, and those
+// running get DrainTimeout to finish before their contexts are cancelled.
+func (q *Queue) Run(ctx context.Context) error {
+	if n, err := db.RequeueRunningJobs(q.db); err != nil {
+		log.Printf("jobs: %v", err)
+	} else if n > 0 {
+		log.Printf("jobs: resuming %d interrupted jobs", n)
+	}
+	q.prune()
+
+	// Jobs outlive ctx while draining.
+	jobCtx, interrupt := context.WithCancel(context.WithoutCancel(ctx))
+	defer interrupt()
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, max(q.Workers, 1))
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+	lastPrune := time.Now()
+
+	for ctx.Err() == nil {
+		for len(slots) < cap(slots) {
+			job, err := db.ClaimJob(q.db)
+			if err != nil {
+				log.Printf("jobs: %v", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			slots <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				q.run(jobCtx, job)
+				<-slots
+				q.Wake()
+			}()
+		}
+		if time.Since(lastPrune) > pruneInterval {
+			q.prune()
+			lastPrune = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+		case <-q.wake:
+		case <-poll.C:
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(q.DrainTimeout):
+		log.Printf("jobs: interrupting %d running jobs; they resume on the next start", len(slots))
+		interrupt()
+		<-drained
+	}
+	return nil
+}
+
+// run runs one claimed job and records how it went.
+func (q *Queue) run(ctx context.Context, job *db.Job) {
+	h := q.handler(job.Type)
+	if h == nil {
+		log.Printf("jobs: job %d: no handler for %s", job.ID, job.Type)
+		if err := db.FailJob(q.db, job.ID, "no handler for job type "+job.Type); err != nil {
+			log.Printf("jobs: %v", err)
+		}
+		return
+	}
+	err := call(ctx, h, []byte(job.Payload))
+	var perm permanentError
+	switch {
+	case err == nil:
+		err = db.FinishJob(q.db, job.ID)
+	case ctx.Err() != nil:
+		log.Printf("jobs: %s job %d interrupted: %v", job.Type, job.ID, err)
+		err = db.RequeueJob(q.db, job.ID)
+	case errors.As(err, &perm) || job.Attempts >= job.MaxAttempts:
+		log.Printf("jobs: %s job %d failed: %v", job.Type, job.ID, err)
+		err = db.FailJob(q.db, job.ID, err.Error())
+	default:
+		delay := retryDelay(job.Attempts)
+		log.Printf("jobs: %s job %d failed (attempt %d of %d), retrying in %s: %v",
+			job.Type, job.ID, job.Attempts, job.MaxAttempts, delay, err)
+		err = db.RetryJob(q.db, job.ID, err.Error(), delay)
+	}
+	if err != nil {
+		log.Printf("jobs: %v", err)
+	}
+}
+
+// call runs h, turning a panic into an error so one bad job doesn't take
+// duh down.
+func call(ctx context.Context, h Handler, payload []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = Permanent(fmt.Errorf("panic: %v", r))
+		}
+	}()
+	return h(ctx, payload)
+}
+
+func (q *Queue) prune() {
+	n, err := db.PruneJobs(q.db, keepFinished)
+	if err != nil {
+		log.Printf("jobs: %v", err)
+	} else if n > 0 {
+		log.Printf("jobs: pruned %d old jobs", n)
+	}
+}
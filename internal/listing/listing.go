@@ -0,0 +1,377 @@
+// Package listing pages, sorts, filters and trims the rows of API list
+// endpoints, so every list takes the same query parameters:
+//
+//	limit=50                     at most 50 rows (1 to MaxLimit); all if absent
+//	cursor=<next_cursor>         the page after the one that returned it
+//	sort=-created_at,name        sort keys, descending with a leading "-"
+//	fields=id,name               only these fields of each row
+//	filter=state=failed          rows matching every filter given
+//
+// A filter is a field, an operator and a value. The operators are =, !=,
+// ~ (contains, ignoring case), <, <=, > and >=. Numbers compare as
+// numbers, everything else as text; on a list field an operator matches
+// if any element does, except != which matches if none is equal.
+//
+// Cursors are keyset cursors: they hold the sort values of the last row
+// returned, so rows added or removed between pages don't shift the next
+// page. They are only good for the sort they were made with.
+//
+// Rows are the JSON maps handlers already build, worked on in memory.
+// Lists here are small enough for that; it keeps the rules in one place.
+package listing
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MaxLimit is the largest page a client may ask for.
+const MaxLimit = 1000
+
+// Spec is how a list is ordered when the client doesn't say.
+type Spec struct {
+	Sort string   // default sort, in the sort parameter's syntax
+	Key  []string // fields that together tell rows apart, the last sort keys
+}
+
+// SortKey is a field rows are ordered by.
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// Filter is a condition on a field.
+type Filter struct {
+	Field string
+	Op    string
+	Value string
+}
+
+// Query is a parsed list request.
+type Query struct {
+	Limit   int // 0 for all rows
+	Sort    []SortKey
+	Fields  []string // nil for every field
+	Filters []Filter
+	after   []any // sort values of the last row of the previous page
+}
+
+var (
+	fieldRe  = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	filterRe = regexp.MustCompile(`^([a-z][a-z0-9_]*)(!=|<=|>=|=|~|<|>)(.*)$`)
+)
+
+// Parse reads a list request's query parameters.
+func Parse(v url.Values, spec Spec) (*Query, error) {
+	q := &Query{}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > MaxLimit {
+			return nil, fmt.Errorf("limit must be a number from 1 to %d", MaxLimit)
+		}
+		q.Limit = n
+	}
+
+	sort := v.Get("sort")
+	if sort == "" {
+		sort = spec.Sort
+	}
+	seen := map[string]bool{}
+	for _, f := range strings.Split(sort, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		k := SortKey{Field: strings.TrimPrefix(f, "-"), Desc: strings.HasPrefix(f, "-")}
+		if !fieldRe.MatchString(k.Field) {
+			return nil, fmt.Errorf("can't sort by %q", f)
+		}
+		if !seen[k.Field] {
+			seen[k.Field] = true
+			q.Sort = append(q.Sort, k)
+		}
+	}
+	// The key breaks ties, so every row has its own place for cursors.
+	desc := len(q.Sort) > 0 && q.Sort[0].Desc
+	for _, f := range spec.Key {
+		if !seen[f] {
+			seen[f] = true
+			q.Sort = append(q.Sort, SortKey{Field: f, Desc: desc})
+		}
+	}
+
+	if s := v.Get("fields"); s != "" {
+		for _, f := range strings.Split(s, ",") {
+			f = strings.TrimSpace(f)
+			if !fieldRe.MatchString(f) {
+				return nil, fmt.Errorf("invalid field %q", f)
+			}
+			q.Fields = append(q.Fields, f)
+		}
+	}
+
+	for _, s := range v["filter"] {
+		m := filterRe.FindStringSubmatch(strings.TrimSpace(s))
+		if m == nil {
+			return nil, fmt.Errorf("filter %q is not field, operator, value", s)
+		}
+		q.Filters = append(q.Filters, Filter{Field: m[1], Op: m[2], Value: m[3]})
+	}
+
+	if s := v.Get("cursor"); s != "" {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err == nil {
+			err = json.Unmarshal(b, &q.after)
+		}
+		if err != nil || len(q.after) != len(q.Sort) {
+			return nil, errors.New("invalid cursor; cursors are only good for the sort they were made with")
+		}
+	}
+	return q, nil
+}
+
+// Page is one page of a list.
+type Page struct {
+	Rows []map[string]any
+	Next string // cursor of the page after this one, "" on the last
+}
+
+// Apply filters, sorts and pages rows. Fields are checked against the
+// rows themselves, so a query naming a field the list doesn't have is
+// refused as long as there are rows to tell.
+func (q *Query) Apply(rows []map[string]any) (Page, error) {
+	if len(rows) > 0 {
+		var names []string
+		for _, k := range q.Sort {
+			names = append(names, k.Field)
+		}
+		for _, f := range q.Filters {
+			names = append(names, f.Field)
+		}
+		for _, f := range append(names, q.Fields...) {
+			if _, ok := rows[0][f]; !ok {
+				return Page{}, fmt.Errorf("unknown field %q", f)
+			}
+		}
+	}
+
+	var out []map[string]any
+	for _, row := range rows {
+		if q.matches(row) {
+			out = append(out, row)
+		}
+	}
+	slices.SortStableFunc(out, q.compare)
+	if q.after != nil {
+		i, _ := slices.BinarySearchFunc(out, q.after, func(row map[string]any, after []any) int {
+			if c := q.compareValues(q.values(row), after); c != 0 {
+				return c
+			}
+			return -1 // the last row itself isn't repeated
+		})
+		out = out[i:]
+	}
+
+	var p Page
+	if q.Limit > 0 && len(out) > q.Limit {
+		out = out[:q.Limit]
+		b, _ := json.Marshal(q.values(out[len(out)-1]))
+		p.Next = base64.RawURLEncoding.EncodeToString(b)
+	}
+	p.Rows = make([]map[string]any, len(out))
+	for i, row := range out {
+		p.Rows[i] = q.trim(row)
+	}
+	return p, nil
+}
+
+func (q *Query) values(row map[string]any) []any {
+	vals := make([]any, len(q.Sort))
+	for i, k := range q.Sort {
+		vals[i] = normalize(row[k.Field])
+	}
+	return vals
+}
+
+func (q *Query) compare(a, b map[string]any) int {
+	return q.compareValues(q.values(a), q.values(b))
+}
+
+func (q *Query) compareValues(a, b []any) int {
+	for i, k := range q.Sort {
+		c := compare(normalize(a[i]), normalize(b[i]))
+		if k.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func (q *Query) matches(row map[string]any) bool {
+	for _, f := range q.Filters {
+		v := normalize(row[f.Field])
+		list, ok := v.([]any)
+		switch {
+		case !ok:
+			if !f.match(v) {
+				return false
+			}
+		case f.Op == "!=":
+			eq := Filter{Field: f.Field, Op: "=", Value: f.Value}
+			if slices.ContainsFunc(list, eq.match) {
+				return false
+			}
+		default:
+			if !slices.ContainsFunc(list, f.match) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (f Filter) match(v any) bool {
+	if f.Op == "~" {
+		return strings.Contains(strings.ToLower(text(v)), strings.ToLower(f.Value))
+	}
+	var c int
+	if n, ok := v.(float64); ok {
+		want, err := strconv.ParseFloat(f.Value, 64)
+		if err != nil {
+			return false
+		}
+		c = compare(n, want)
+	} else {
+		c = strings.Compare(text(v), f.Value)
+	}
+	switch f.Op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// trim keeps only the fields asked for.
+func (q *Query) trim(row map[string]any) map[string]any {
+	if q.Fields == nil {
+		return row
+	}
+	out := make(map[string]any, len(q.Fields))
+	for _, f := range q.Fields {
+		out[f] = row[f]
+	}
+	return out
+}
+
+// normalize reduces a row value to nil, float64, bool, string or []any,
+// the types it has once it has been through JSON, as a cursor's values
+// have.
+func normalize(v any) any {
+	switch v := v.(type) {
+	case nil, float64, bool, string, []any:
+		return v
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case *int64:
+		if v == nil {
+			return nil
+		}
+		return float64(*v)
+	case *string:
+		if v == nil {
+			return nil
+		}
+		return *v
+	case []string:
+		out := make([]any, len(v))
+		for i, s := range v {
+			out[i] = s
+		}
+		return out
+	case json.RawMessage:
+		return string(v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	var out any
+	if json.Unmarshal(b, &out) != nil {
+		return string(b)
+	}
+	return out
+}
+
+func text(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// compare orders normalized values: nil first, then false before true,
+// numbers, and text.
+func compare(a, b any) int {
+	rank := func(v any) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case bool:
+			return 1
+		case float64:
+			return 2
+		}
+		return 3
+	}
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+	switch a := a.(type) {
+	case nil:
+		return 0
+	case bool:
+		switch {
+		case a == b.(bool):
+			return 0
+		case !a:
+			return -1
+		}
+		return 1
+	case float64:
+		switch bf := b.(float64); {
+		case a < bf:
+			return -1
+		case a > bf:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(text(a), text(b))
+}
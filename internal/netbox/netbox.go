@@ -0,0 +1,197 @@
+// Package netbox imports devices from a NetBox DCIM as duh systems and
+// writes provisioning state back to them.
+package netbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client calls the NetBox REST API.
+type Client struct {
+	URL   string // e.g. https://netbox.example.com
+	Token string
+	HTTP  *http.Client
+}
+
+func New(baseURL, token string) *Client {
+	return &Client{
+		URL:   strings.TrimRight(baseURL, "/"),
+		Token: token,
+		HTTP:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Device is a NetBox device with the MACs of its non-management interfaces.
+type Device struct {
+	ID   int64
+	Name string
+	Role string // slug
+	Site string // slug
+	MACs []string
+}
+
+type ref struct {
+	ID   int64  `json:"id"`
+	Slug string `json:"slug"`
+}
+
+type apiDevice struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	Role *ref   `json:"role"`
+	// DeviceRole is the role field's name before NetBox 3.6.
+	DeviceRole *ref `json:"device_role"`
+	Site       *ref `json:"site"`
+}
+
+type apiInterface struct {
+	Device     ref    `json:"device"`
+	MACAddress string `json:"mac_address"`
+	// PrimaryMAC replaces MACAddress from NetBox 4.2.
+	PrimaryMAC *struct {
+		MACAddress string `json:"mac_address"`
+	} `json:"primary_mac_address"`
+}
+
+// Devices returns every device that has at least one interface MAC.
+// Management-only interfaces (BMCs) are left out: they never netboot.
+func (c *Client) Devices(ctx context.Context) ([]Device, error) {
+	var devices []apiDevice
+	if err := c.list(ctx, "/api/dcim/devices/?limit=500", &devices); err != nil {
+		return nil, err
+	}
+	var ifaces []apiInterface
+	if err := c.list(ctx, "/api/dcim/interfaces/?limit=500&mgmt_only=false", &ifaces); err != nil {
+		return nil, err
+	}
+	macs := map[int64][]string{}
+	for _, i := range ifaces {
+		mac := i.MACAddress
+		if i.PrimaryMAC != nil && i.PrimaryMAC.MACAddress != "" {
+			mac = i.PrimaryMAC.MACAddress
+		}
+		if mac != "" {
+			macs[i.Device.ID] = append(macs[i.Device.ID], strings.ToLower(mac))
+		}
+	}
+
+	var out []Device
+	for _, d := range devices {
+		if len(macs[d.ID]) == 0 {
+			continue
+		}
+		dev := Device{ID: d.ID, Name: d.Name, MACs: macs[d.ID]}
+		if d.Role != nil {
+			dev.Role = d.Role.Slug
+		} else if d.DeviceRole != nil {
+			dev.Role = d.DeviceRole.Slug
+		}
+		if d.Site != nil {
+			dev.Site = d.Site.Slug
+		}
+		out = append(out, dev)
+	}
+	return out, nil
+}
+
+// SetCustomField sets a text custom field on a device. The field must
+// already exist in NetBox and apply to devices.
+func (c *Client) SetCustomField(ctx context.Context, deviceID int64, field, value string) error {
+	body, err := json.Marshal(map[string]any{
+		"custom_fields": map[string]string{field: value},
+	})
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/api/dcim/devices/%d/", deviceID)
+	resp, err := c.do(ctx, http.MethodPatch, c.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// list follows a paginated endpoint, appending every page's results to out.
+func (c *Client) list(ctx context.Context, path string, out any) error {
+	var all []json.RawMessage
+	next := c.URL + path
+	for next != "" {
+		resp, err := c.do(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return err
+		}
+		var page struct {
+			Next    string            `json:"next"`
+			Results []json.RawMessage `json:"results"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("decode netbox %s: %w", path, err)
+		}
+		all = append(all, page.Results...)
+		next, err = c.sameHost(page.Next)
+		if err != nil {
+			return err
+		}
+	}
+	raw, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// sameHost rebases a "next" link onto the configured URL. NetBox builds it
+// from the request's Host, which is wrong behind some proxies.
+func (c *Client) sameHost(next string) (string, error) {
+	if next == "" {
+		return "", nil
+	}
+	u, err := url.Parse(next)
+	if err != nil {
+		return "", fmt.Errorf("netbox next link: %w", err)
+	}
+	base, err := url.Parse(c.URL)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme, u.Host = base.Scheme, base.Host
+	return u.String(), nil
+}
+
+func (c *Client) do(ctx context.Context, method, rawURL string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	auth := c.Token
+	if !strings.Contains(auth, " ") {
+		// A bare key; v2 tokens are pasted with their "Bearer" prefix.
+		auth = "Token " + auth
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("netbox %s %s: %s: %s", method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
@@ -0,0 +1,114 @@
+package netbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/db"
+)
+
+// Tag prefixes owned by the sync. Tags with these prefixes are replaced on
+// every sync; other tags are left alone.
+const (
+	roleTagPrefix = "role:"
+	siteTagPrefix = "site:"
+)
+
+// Result summarizes a sync.
+type Result struct {
+	Created []db.System // new systems, for the caller to announce
+	Updated int         // existing systems whose name, tags or link changed
+	Errors  []string
+}
+
+// Sync creates or updates a system for every NetBox device with a MAC. A
+// device whose MAC already belongs to a system keeps that system; the
+// device name only fills in a missing hostname.
+func Sync(ctx context.Context, d *sql.DB, c *Client) (*Result, error) {
+	devices, err := c.Devices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	for _, dev := range devices {
+		if err := syncDevice(d, dev, res); err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: %v", dev.Name, err))
+		}
+	}
+	return res, nil
+}
+
+func syncDevice(d *sql.DB, dev Device, res *Result) error {
+	var sys *db.System
+	for _, mac := range dev.MACs {
+		s, err := db.GetSystemByMAC(d, mac)
+		if err != nil {
+			return err
+		}
+		if s != nil {
+			sys = s
+			break
+		}
+	}
+
+	hostname := db.NormalizeHostname(dev.Name)
+	created, changed := false, false
+	if sys == nil {
+		s, err := db.CreateSystem(d, dev.MACs[0], hostname)
+		if err != nil {
+			return err
+		}
+		sys, created = s, true
+	} else if sys.Hostname == "" && hostname != "" {
+		if err := db.UpdateSystemInfo(d, sys.ID, sys.MAC, hostname); err != nil {
+			return err
+		}
+		changed = true
+	}
+
+	if tags := Tags(sys.Tags, dev); tags != sys.Tags {
+		if err := db.UpdateSystemTags(d, sys.ID, tags); err != nil {
+			return err
+		}
+		sys.Tags = tags
+		changed = true
+	}
+
+	link, err := db.GetNetBoxLink(d, sys.ID)
+	if err != nil {
+		return err
+	}
+	if link == nil || link.DeviceID != dev.ID || link.DeviceName != dev.Name {
+		changed = true
+	}
+	if err := db.SetNetBoxLink(d, sys.ID, dev.ID, dev.Name); err != nil {
+		return err
+	}
+
+	switch {
+	case created:
+		res.Created = append(res.Created, *sys)
+	case changed:
+		res.Updated++
+	}
+	return nil
+}
+
+// Tags returns current with the role and site tags replaced by dev's.
+func Tags(current string, dev Device) string {
+	var tags []string
+	for _, t := range db.SplitTags(current) {
+		if !strings.HasPrefix(t, roleTagPrefix) && !strings.HasPrefix(t, siteTagPrefix) {
+			tags = append(tags, t)
+		}
+	}
+	if dev.Role != "" {
+		tags = append(tags, roleTagPrefix+dev.Role)
+	}
+	if dev.Site != "" {
+		tags = append(tags, siteTagPrefix+dev.Site)
+	}
+	return db.NormalizeTags(strings.Join(tags, ","))
+}
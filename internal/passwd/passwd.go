@@ -0,0 +1,137 @@
+// Package passwd generates installer passwords and hashes them the way
+// /etc/shadow, kickstart, autoinstall and Ignition expect.
+package passwd
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"strings"
+)
+
+// passwordLength is the length of generated passwords: 20 characters
+// from a 56-character alphabet, about 116 bits.
+const passwordLength = 20
+
+// passwordAlphabet leaves out characters easily misread for one another
+// (0/O, 1/l/I) and any a shell or config file would need quoted.
+const passwordAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// cryptAlphabet is crypt(3)'s base64 alphabet, used for salts and hashes.
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// saltLength is the longest salt SHA-crypt uses.
+const saltLength = 16
+
+// rounds is SHA-crypt's default, written into the hash implicitly.
+const rounds = 5000
+
+// Generate returns a random password.
+func Generate() string {
+	return randomString(passwordAlphabet, passwordLength)
+}
+
+func randomString(alphabet string, n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	for i := range b {
+		// 256 isn't a multiple of either alphabet's length; the bias is
+		// well under a bit over the whole string.
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b)
+}
+
+// Hash returns password's SHA-512 crypt hash, "$6$salt$hash", with a new
+// random salt.
+func Hash(password string) string {
+	salt := randomString(cryptAlphabet, saltLength)
+	return "$6$" + salt + "$" + sha512Crypt([]byte(password), []byte(salt))
+}
+
+// sha512Crypt is the hash part of SHA-512 crypt, as specified in
+// https://www.akkadia.org/drepper/SHA-crypt.txt.
+func sha512Crypt(pw, salt []byte) string {
+	b := sha512.New()
+	b.Write(pw)
+	b.Write(salt)
+	b.Write(pw)
+	sumB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(pw)
+	a.Write(salt)
+	n := len(pw)
+	for ; n > sha512.Size; n -= sha512.Size {
+		a.Write(sumB)
+	}
+	a.Write(sumB[:n])
+	for n = len(pw); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(sumB)
+		} else {
+			a.Write(pw)
+		}
+	}
+	sumA := a.Sum(nil)
+
+	dp := sha512.New()
+	for range len(pw) {
+		dp.Write(pw)
+	}
+	p := repeat(dp.Sum(nil), len(pw))
+
+	ds := sha512.New()
+	for range 16 + int(sumA[0]) {
+		ds.Write(salt)
+	}
+	s := repeat(ds.Sum(nil), len(salt))
+
+	for i := range rounds {
+		c := sha512.New()
+		if i%2 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(sumA)
+		}
+		if i%3 != 0 {
+			c.Write(s)
+		}
+		if i%7 != 0 {
+			c.Write(p)
+		}
+		if i%2 != 0 {
+			c.Write(sumA)
+		} else {
+			c.Write(p)
+		}
+		sumA = c.Sum(nil)
+	}
+
+	// The digest is encoded in a fixed shuffle of its bytes: each group
+	// of three takes bytes i, i+21 and i+42, rotated by i.
+	var out strings.Builder
+	for i := range 21 {
+		g := [3]byte{sumA[i], sumA[i+21], sumA[i+42]}
+		r := i % 3
+		encode24(&out, g[r], g[(r+1)%3], g[(r+2)%3], 4)
+	}
+	encode24(&out, 0, 0, sumA[63], 2)
+	return out.String()
+}
+
+// repeat returns sum repeated, and cut, to n bytes.
+func repeat(sum []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, sum[:min(len(sum), n-len(out))]...)
+	}
+	return out
+}
+
+func encode24(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for range n {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,139 @@
+// Package pdf writes simple text-only PDF documents: lines and rows of
+// text on A4 pages, set in the standard Helvetica fonts, so nothing needs
+// embedding.
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	pageWidth  = 595 // A4 in points
+	pageHeight = 842
+	margin     = 50
+)
+
+// Margin is the left edge of the text, in points.
+const Margin = margin
+
+// Width is the usable width of a page, in points.
+const Width = pageWidth - 2*margin
+
+// Document is a PDF being written top to bottom. Text that doesn't fit on
+// the page starts a new one.
+type Document struct {
+	pages []*bytes.Buffer
+	y     float64
+}
+
+// New returns an empty document.
+func New() *Document {
+	d := &Document{}
+	d.newPage()
+	return d
+}
+
+func (d *Document) newPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.y = pageHeight - margin
+}
+
+// advance moves down by h, starting a page if there's no room left.
+func (d *Document) advance(h float64) {
+	if d.y-h < margin {
+		d.newPage()
+	}
+	d.y -= h
+}
+
+// Line writes s at the left margin on a new line.
+func (d *Document) Line(size float64, bold bool, s string) {
+	d.Row(size, bold, []float64{0}, []string{s})
+}
+
+// Row writes cells on a new line, each at its offset from the left
+// margin.
+func (d *Document) Row(size float64, bold bool, offsets []float64, cells []string) {
+	d.advance(size * 1.4)
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	page := d.pages[len(d.pages)-1]
+	for i, cell := range cells {
+		if i >= len(offsets) || cell == "" {
+			continue
+		}
+		fmt.Fprintf(page, "BT /%s %.1f Tf %.1f %.1f Td (%s) Tj ET\n", font, size, margin+offsets[i], d.y, escape(cell))
+	}
+}
+
+// Space leaves h points of blank space.
+func (d *Document) Space(h float64) {
+	d.advance(h)
+}
+
+// Bytes returns the finished PDF.
+func (d *Document) Bytes() []byte {
+	var b bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, b.Len())
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	b.WriteString("%PDF-1.4\n")
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, page := range d.pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, 6+2*i))
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.Bytes()))
+	}
+
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return b.Bytes()
+}
+
+// winAnsi maps the characters outside Latin-1 that WinAnsiEncoding has.
+var winAnsi = map[rune]byte{
+	'€': 0x80, '…': 0x85, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94,
+	'•': 0x95, '–': 0x96, '—': 0x97, '™': 0x99,
+}
+
+// escape encodes s as the body of a PDF string in WinAnsiEncoding.
+// Characters it can't show become "?".
+func escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		case winAnsi[r] != 0:
+			fmt.Fprintf(&b, "\\%03o", winAnsi[r])
+		case r == '\t':
+			b.WriteByte(' ')
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,197 @@
+// Package pki is duh's internal certificate authority. It issues
+// short-lived client certificates that identify provisioned systems, so
+// they can authenticate with mutual TLS instead of by MAC address or
+// signed URL.
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// caLifetime is how long a newly created CA is valid.
+const caLifetime = 10 * 365 * 24 * time.Hour
+
+// systemURIPrefix starts the URI SAN naming a system, followed by its ID.
+const systemURIPrefix = "urn:duh:system:"
+
+// CA signs machine certificates.
+type CA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+}
+
+// Issued is a certificate and key issued to a system.
+type Issued struct {
+	CertPEM  string
+	KeyPEM   string
+	Serial   string
+	NotAfter time.Time
+}
+
+// Identity is who a verified machine certificate belongs to.
+type Identity struct {
+	SystemID int64
+	MAC      string
+	Serial   string
+}
+
+// LoadOrCreate loads the CA kept in dir, creating it on first use.
+func LoadOrCreate(dir string) (*CA, error) {
+	certPath := filepath.Join(dir, "ca.pem")
+	keyPath := filepath.Join(dir, "ca-key.pem")
+
+	certPEM, err := os.ReadFile(certPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return create(certPath, keyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read CA cert: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read CA key: %w", err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("load CA: %w", err)
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("load CA: key is not ECDSA")
+	}
+	return &CA{cert: pair.Leaf, key: key, certPEM: certPEM}, nil
+}
+
+func create(certPath, keyPath string) (*CA, error) {
+	if err := os.MkdirAll(filepath.Dir(certPath), 0700); err != nil {
+		return nil, fmt.Errorf("create PKI dir: %w", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate CA key: %w", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "duh machine identity CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("create CA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse CA certificate: %w", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshal CA key: %w", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return nil, fmt.Errorf("write CA key: %w", err)
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return nil, fmt.Errorf("write CA cert: %w", err)
+	}
+	return &CA{cert: cert, key: key, certPEM: certPEM}, nil
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
+
+// CertPEM returns the CA certificate, for clients to trust.
+func (ca *CA) CertPEM() []byte { return ca.certPEM }
+
+// Pool returns a pool holding just the CA, for verifying client
+// certificates during the TLS handshake.
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// Issue creates a client certificate for a system, valid for ttl. The
+// subject common name is the system's MAC and a URI SAN carries its ID.
+func (ca *CA) Issue(systemID int64, mac string, ttl time.Duration) (Issued, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return Issued{}, fmt.Errorf("generate key: %w", err)
+	}
+	uri, err := url.Parse(systemURIPrefix + strconv.FormatInt(systemID, 10))
+	if err != nil {
+		return Issued{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: mac, OrganizationalUnit: []string{"duh systems"}},
+		URIs:         []*url.URL{uri},
+		NotBefore:    now.Add(-5 * time.Minute), // allow for clock skew
+		NotAfter:     now.Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if tmpl.NotAfter.After(ca.cert.NotAfter) {
+		tmpl.NotAfter = ca.cert.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return Issued{}, fmt.Errorf("sign certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return Issued{}, fmt.Errorf("marshal key: %w", err)
+	}
+	return Issued{
+		CertPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		KeyPEM:   string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		Serial:   tmpl.SerialNumber.Text(16),
+		NotAfter: tmpl.NotAfter,
+	}, nil
+}
+
+// Verify checks that cert was issued by the CA for client authentication
+// and is currently valid, and returns the system it names.
+func (ca *CA) Verify(cert *x509.Certificate) (Identity, error) {
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:     ca.Pool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return Identity{}, err
+	}
+	id := Identity{MAC: cert.Subject.CommonName, Serial: cert.SerialNumber.Text(16)}
+	for _, uri := range cert.URIs {
+		if rest, ok := strings.CutPrefix(uri.String(), systemURIPrefix); ok {
+			if id.SystemID, err = strconv.ParseInt(rest, 10, 64); err == nil {
+				return id, nil
+			}
+		}
+	}
+	return Identity{}, errors.New("certificate names no system")
+}
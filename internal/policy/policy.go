@@ -0,0 +1,859 @@
+// Package policy evaluates small expressions over system facts, for rules
+// that assign images and profiles or gate boots. The language is a subset
+// of CEL:
+//
+//	mac.startsWith("52:54:00") && "gpu" in tags
+//	arch == "arm64" || ip.inSubnet("10.20.0.0/16")
+//	vars.rack in ["r1", "r2"] && !hostname.matches("^test-")
+//
+// Values are strings, integers, booleans, lists, maps and null. Looking up
+// a key a map doesn't have gives null rather than an error, so rules can
+// test vars a system may not set.
+package policy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Program is a compiled expression.
+type Program struct {
+	src  string
+	root node
+}
+
+// Compile parses src. Identifiers other than function names must be in
+// names, so a misspelt fact is caught when a rule is saved rather than
+// when a system boots.
+func Compile(src string, names []string) (*Program, error) {
+	p := &parser{src: src}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	root, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tEOF {
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+	known := make(map[string]bool, len(names))
+	for _, n := range names {
+		known[n] = true
+	}
+	if err := check(root, known); err != nil {
+		return nil, err
+	}
+	return &Program{src: src, root: root}, nil
+}
+
+func (p *Program) String() string { return p.src }
+
+// Eval evaluates the program against facts. Fact values may be strings,
+// integers, booleans, nil, []string, map[string]string or the generic
+// []any and map[string]any.
+func (p *Program) Eval(facts map[string]any) (any, error) {
+	env := make(map[string]any, len(facts))
+	for k, v := range facts {
+		env[k] = normalize(v)
+	}
+	return p.root.eval(env)
+}
+
+// Match evaluates the program and requires a boolean result.
+func (p *Program) Match(facts map[string]any) (bool, error) {
+	v, err := p.Eval(facts)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression is %s, not bool", typeName(v))
+	}
+	return b, nil
+}
+
+func normalize(v any) any {
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case []string:
+		out := make([]any, len(v))
+		for i, s := range v {
+			out[i] = s
+		}
+		return out
+	case map[string]string:
+		out := make(map[string]any, len(v))
+		for k, s := range v {
+			out[k] = s
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = normalize(e)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = normalize(e)
+		}
+		return out
+	}
+	return v
+}
+
+func typeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case string:
+		return "string"
+	case []any:
+		return "list"
+	case map[string]any:
+		return "map"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// --- Lexer and parser ---
+
+type tokKind int
+
+const (
+	tEOF tokKind = iota
+	tIdent
+	tString
+	tInt
+	tOp
+)
+
+type token struct {
+	kind tokKind
+	text string
+	val  any
+	pos  int
+}
+
+type parser struct {
+	src  string
+	toks []token
+	i    int
+}
+
+func (p *parser) errorf(t token, format string, args ...any) error {
+	return fmt.Errorf("column %d: %s", t.pos+1, fmt.Sprintf(format, args...))
+}
+
+var twoCharOps = []string{"&&", "||", "==", "!=", "<=", ">="}
+
+func (p *parser) lex() error {
+	src := p.src
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || isLetter(c):
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || isLetter(src[j]) || isDigit(src[j])) {
+				j++
+			}
+			p.toks = append(p.toks, token{kind: tIdent, text: src[i:j], pos: i})
+			i = j
+		case isDigit(c):
+			j := i + 1
+			for j < len(src) && isDigit(src[j]) {
+				j++
+			}
+			n, err := strconv.ParseInt(src[i:j], 10, 64)
+			if err != nil {
+				return fmt.Errorf("column %d: invalid number %s", i+1, src[i:j])
+			}
+			p.toks = append(p.toks, token{kind: tInt, text: src[i:j], val: n, pos: i})
+			i = j
+		case c == '"' || c == '\'':
+			s, n, err := lexString(src[i:])
+			if err != nil {
+				return fmt.Errorf("column %d: %v", i+1, err)
+			}
+			p.toks = append(p.toks, token{kind: tString, text: src[i : i+n], val: s, pos: i})
+			i += n
+		default:
+			op := ""
+			for _, o := range twoCharOps {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+				}
+			}
+			if op == "" && strings.IndexByte("!<>()[].,-", c) >= 0 {
+				op = string(c)
+			}
+			if op == "" {
+				return fmt.Errorf("column %d: unexpected character %q", i+1, c)
+			}
+			p.toks = append(p.toks, token{kind: tOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	p.toks = append(p.toks, token{kind: tEOF, text: "end of expression", pos: len(src)})
+	return nil
+}
+
+// lexString reads a quoted string at the start of s, returning its value
+// and the number of bytes it took.
+func lexString(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '\\', '"', '\'':
+				b.WriteByte(s[i])
+			default:
+				// Keep unknown escapes, so regexes like "\d" read naturally.
+				b.WriteByte('\\')
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+
+func (p *parser) peek() token { return p.toks[p.i] }
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.kind == tOp && t.text == op {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return p.errorf(t, "expected %q, found %q", op, t.text)
+	}
+	return nil
+}
+
+// expr := and ('||' and)*
+func (p *parser) expr() (node, error) {
+	l, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l = &binary{op: "||", l: l, r: r}
+	}
+	return l, nil
+}
+
+// and := rel ('&&' rel)*
+func (p *parser) and() (node, error) {
+	l, err := p.rel()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		r, err := p.rel()
+		if err != nil {
+			return nil, err
+		}
+		l = &binary{op: "&&", l: l, r: r}
+	}
+	return l, nil
+}
+
+// rel := unary [relop unary]
+func (p *parser) rel() (node, error) {
+	l, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	op := ""
+	switch {
+	case t.kind == tOp && strings.Contains(" == != < <= > >= ", " "+t.text+" "):
+		op = t.text
+	case t.kind == tIdent && t.text == "in":
+		op = "in"
+	default:
+		return l, nil
+	}
+	p.next()
+	r, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return &binary{op: op, l: l, r: r}, nil
+}
+
+// unary := ('!' | '-') unary | postfix
+func (p *parser) unary() (node, error) {
+	for _, op := range []string{"!", "-"} {
+		if p.accept(op) {
+			x, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			return &unary{op: op, x: x}, nil
+		}
+	}
+	return p.postfix()
+}
+
+// postfix := primary ('.' ident ['(' args ')'] | '[' expr ']')*
+func (p *parser) postfix() (node, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			t := p.next()
+			if t.kind != tIdent {
+				return nil, p.errorf(t, "expected a name after '.', found %q", t.text)
+			}
+			if p.accept("(") {
+				args, err := p.args(")")
+				if err != nil {
+					return nil, err
+				}
+				x = &call{fn: t.text, args: append([]node{x}, args...), pos: t.pos}
+			} else {
+				x = &index{x: x, i: &lit{v: t.text}}
+			}
+		case p.accept("["):
+			i, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &index{x: x, i: i}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tString, tInt:
+		return &lit{v: t.val}, nil
+	case tIdent:
+		switch t.text {
+		case "true":
+			return &lit{v: true}, nil
+		case "false":
+			return &lit{v: false}, nil
+		case "null":
+			return &lit{v: nil}, nil
+		}
+		if p.accept("(") {
+			args, err := p.args(")")
+			if err != nil {
+				return nil, err
+			}
+			return &call{fn: t.text, args: args, pos: t.pos}, nil
+		}
+		return &ident{name: t.text, pos: t.pos}, nil
+	case tOp:
+		switch t.text {
+		case "(":
+			x, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			elems, err := p.args("]")
+			if err != nil {
+				return nil, err
+			}
+			return &list{elems: elems}, nil
+		}
+	}
+	return nil, p.errorf(t, "unexpected %q", t.text)
+}
+
+// args reads comma-separated expressions up to the closing token.
+func (p *parser) args(closing string) ([]node, error) {
+	var args []node
+	if p.accept(closing) {
+		return args, nil
+	}
+	for {
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, x)
+		if p.accept(closing) {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// check resolves identifiers and function names once, at compile time.
+func check(n node, known map[string]bool) error {
+	switch n := n.(type) {
+	case *ident:
+		if !known[n.name] {
+			return fmt.Errorf("column %d: unknown name %q", n.pos+1, n.name)
+		}
+	case *unary:
+		return check(n.x, known)
+	case *binary:
+		if err := check(n.l, known); err != nil {
+			return err
+		}
+		return check(n.r, known)
+	case *index:
+		if err := check(n.x, known); err != nil {
+			return err
+		}
+		return check(n.i, known)
+	case *list:
+		for _, e := range n.elems {
+			if err := check(e, known); err != nil {
+				return err
+			}
+		}
+	case *call:
+		f, ok := functions[n.fn]
+		if !ok {
+			return fmt.Errorf("column %d: unknown function %q", n.pos+1, n.fn)
+		}
+		if len(n.args) != f.arity {
+			return fmt.Errorf("column %d: wrong number of arguments to %s", n.pos+1, n.fn)
+		}
+		for _, a := range n.args {
+			if err := check(a, known); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// --- Evaluation ---
+
+type node interface {
+	eval(env map[string]any) (any, error)
+}
+
+type lit struct{ v any }
+
+func (n *lit) eval(map[string]any) (any, error) { return n.v, nil }
+
+type ident struct {
+	name string
+	pos  int
+}
+
+func (n *ident) eval(env map[string]any) (any, error) { return env[n.name], nil }
+
+type list struct{ elems []node }
+
+func (n *list) eval(env map[string]any) (any, error) {
+	out := make([]any, len(n.elems))
+	for i, e := range n.elems {
+		v, err := e.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+type unary struct {
+	op string
+	x  node
+}
+
+func (n *unary) eval(env map[string]any) (any, error) {
+	v, err := n.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "!":
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("'!' needs a bool, got %s", typeName(v))
+		}
+		return !b, nil
+	default:
+		i, ok := v.(int64)
+		if !ok {
+			return nil, fmt.Errorf("'-' needs an int, got %s", typeName(v))
+		}
+		return -i, nil
+	}
+}
+
+type index struct{ x, i node }
+
+func (n *index) eval(env map[string]any) (any, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	i, err := n.i.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch x := x.(type) {
+	case map[string]any:
+		k, ok := i.(string)
+		if !ok {
+			return nil, fmt.Errorf("map keys are strings, got %s", typeName(i))
+		}
+		return x[k], nil
+	case []any:
+		k, ok := i.(int64)
+		if !ok {
+			return nil, fmt.Errorf("list indexes are ints, got %s", typeName(i))
+		}
+		if k < 0 || k >= int64(len(x)) {
+			return nil, fmt.Errorf("index %d out of range", k)
+		}
+		return x[k], nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cannot index %s", typeName(x))
+}
+
+type binary struct {
+	op   string
+	l, r node
+}
+
+func (n *binary) eval(env map[string]any) (any, error) {
+	l, err := n.l.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "&&" || n.op == "||" {
+		lb, ok := l.(bool)
+		if !ok {
+			return nil, fmt.Errorf("'%s' needs bools, got %s", n.op, typeName(l))
+		}
+		if lb == (n.op == "||") {
+			return lb, nil
+		}
+		r, err := n.r.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		rb, ok := r.(bool)
+		if !ok {
+			return nil, fmt.Errorf("'%s' needs bools, got %s", n.op, typeName(r))
+		}
+		return rb, nil
+	}
+	r, err := n.r.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	case "in":
+		switch r := r.(type) {
+		case []any:
+			for _, e := range r {
+				if equal(l, e) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]any:
+			k, ok := l.(string)
+			if !ok {
+				return false, nil
+			}
+			_, found := r[k]
+			return found, nil
+		case nil:
+			return false, nil
+		}
+		return nil, fmt.Errorf("'in' needs a list or map, got %s", typeName(r))
+	}
+
+	var c int
+	switch l := l.(type) {
+	case int64:
+		ri, ok := r.(int64)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare int with %s", typeName(r))
+		}
+		c = compareInt(l, ri)
+	case string:
+		rs, ok := r.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare string with %s", typeName(r))
+		}
+		c = strings.Compare(l, rs)
+	default:
+		return nil, fmt.Errorf("cannot order %s values", typeName(l))
+	}
+	switch n.op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	default:
+		return c >= 0, nil
+	}
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func equal(a, b any) bool {
+	switch a := a.(type) {
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	switch b.(type) {
+	case []any, map[string]any:
+		return false
+	}
+	return a == b
+}
+
+type call struct {
+	fn   string
+	args []node
+	pos  int
+}
+
+func (n *call) eval(env map[string]any) (any, error) {
+	args := make([]any, len(n.args))
+	for i, a := range n.args {
+		v, err := a.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	v, err := functions[n.fn].fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", n.fn, err)
+	}
+	return v, nil
+}
+
+// --- Functions ---
+
+type function struct {
+	arity int
+	fn    func(args []any) (any, error)
+}
+
+// functions may be called as f(x, y) or, CEL style, as x.f(y).
+var functions = map[string]function{
+	"size":       {1, fnSize},
+	"lower":      {1, stringFn(strings.ToLower)},
+	"upper":      {1, stringFn(strings.ToUpper)},
+	"startsWith": {2, stringPred(strings.HasPrefix)},
+	"endsWith":   {2, stringPred(strings.HasSuffix)},
+	"contains":   {2, fnContains},
+	"matches":    {2, fnMatches},
+	"inSubnet":   {2, fnInSubnet},
+}
+
+// FunctionNames lists the functions expressions can call.
+func FunctionNames() []string {
+	names := make([]string, 0, len(functions))
+	for n := range functions {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func strings2(args []any) (string, string, error) {
+	a, ok1 := args[0].(string)
+	b, ok2 := args[1].(string)
+	if !ok1 || !ok2 {
+		return "", "", fmt.Errorf("needs strings, got %s and %s", typeName(args[0]), typeName(args[1]))
+	}
+	return a, b, nil
+}
+
+func stringFn(f func(string) string) func([]any) (any, error) {
+	return func(args []any) (any, error) {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("needs a string, got %s", typeName(args[0]))
+		}
+		return f(s), nil
+	}
+}
+
+func stringPred(f func(string, string) bool) func([]any) (any, error) {
+	return func(args []any) (any, error) {
+		if args[0] == nil {
+			return false, nil
+		}
+		a, b, err := strings2(args)
+		if err != nil {
+			return nil, err
+		}
+		return f(a, b), nil
+	}
+}
+
+func fnSize(args []any) (any, error) {
+	switch v := args[0].(type) {
+	case string:
+		return int64(len(v)), nil
+	case []any:
+		return int64(len(v)), nil
+	case map[string]any:
+		return int64(len(v)), nil
+	case nil:
+		return int64(0), nil
+	}
+	return nil, fmt.Errorf("needs a string, list or map, got %s", typeName(args[0]))
+}
+
+func fnContains(args []any) (any, error) {
+	switch v := args[0].(type) {
+	case []any:
+		for _, e := range v {
+			if equal(e, args[1]) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case nil:
+		return false, nil
+	}
+	return stringPred(strings.Contains)(args)
+}
+
+var (
+	regexMu    sync.Mutex
+	regexCache = map[string]*regexp.Regexp{}
+)
+
+func fnMatches(args []any) (any, error) {
+	if args[0] == nil {
+		return false, nil
+	}
+	s, pattern, err := strings2(args)
+	if err != nil {
+		return nil, err
+	}
+	regexMu.Lock()
+	re, ok := regexCache[pattern]
+	if !ok {
+		if re, err = regexp.Compile(pattern); err == nil && len(regexCache) < 1000 {
+			regexCache[pattern] = re
+		}
+	}
+	regexMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString(s), nil
+}
+
+func fnInSubnet(args []any) (any, error) {
+	if args[0] == nil || args[0] == "" {
+		return false, nil
+	}
+	addr, cidr, err := strings2(args)
+	if err != nil {
+		return nil, err
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(addr)
+	return ip != nil && subnet.Contains(ip), nil
+}
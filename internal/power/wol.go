@@ -0,0 +1,56 @@
+// Package power turns machines on for provisioning: Wake-on-LAN for plain
+// hosts, and Redfish for servers with a BMC.
+package power
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// DefaultWakeAddr is where magic packets go unless a subnet's broadcast
+// address is given.
+const DefaultWakeAddr = "255.255.255.255:9"
+
+// Wake sends a Wake-on-LAN magic packet for mac to addr, a broadcast
+// address with an optional port (9 if none). An empty addr uses
+// DefaultWakeAddr.
+func Wake(mac, addr string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	if len(hw) != 6 {
+		return fmt.Errorf("wake: %s is not an Ethernet MAC", mac)
+	}
+	addr, err = WakeAddr(addr)
+	if err != nil {
+		return err
+	}
+	packet := append(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(hw, 16)...)
+	conn, err := net.Dial("udp4", addr)
+	if err != nil {
+		return fmt.Errorf("wake: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(packet); err != nil {
+		return fmt.Errorf("wake: %w", err)
+	}
+	return nil
+}
+
+// WakeAddr checks a magic packet destination and fills in the default
+// port.
+func WakeAddr(addr string) (string, error) {
+	if addr == "" {
+		return DefaultWakeAddr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "9"
+	}
+	if net.ParseIP(host).To4() == nil {
+		return "", fmt.Errorf("wake: %q is not an IPv4 broadcast address", host)
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,245 @@
+package profile
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// butaneVersions maps the Butane specs duh can transpile, by variant and
+// version, to the Ignition spec each one produces.
+var butaneVersions = map[string]map[string]string{
+	"fcos": {
+		"1.0.0": "3.0.0",
+		"1.1.0": "3.1.0",
+		"1.2.0": "3.2.0",
+		"1.3.0": "3.2.0",
+		"1.4.0": "3.3.0",
+		"1.5.0": "3.4.0",
+		"1.6.0": "3.5.0",
+	},
+	"flatcar": {
+		"1.0.0": "3.3.0",
+		"1.1.0": "3.4.0",
+	},
+}
+
+// butaneUnsupported are Butane sugar that needs files from the machine
+// running Butane, or more of Butane than duh carries.
+var butaneUnsupported = map[string]string{
+	"boot_device": "boot_device (write the LUKS and RAID devices out in storage instead)",
+	"grub":        "grub",
+}
+
+// IgnitionFromButane returns config as Ignition JSON. A config that is
+// already JSON is returned as it is; otherwise it is read as a Butane
+// config of the fcos or flatcar variant and transpiled, like butane
+// --strict would for the sugar it supports: inline contents, filesystems
+// with_mount_unit and kernel_arguments. Local files and trees, which
+// Butane reads from the machine it runs on, can't be used.
+func IgnitionFromButane(config string) (string, error) {
+	if strings.HasPrefix(strings.TrimSpace(config), "{") {
+		return config, nil
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal([]byte(config), &doc); err != nil {
+		return "", fmt.Errorf("butane: %w", err)
+	}
+	if doc == nil {
+		return "", errors.New("butane: empty config")
+	}
+	variant, _ := doc["variant"].(string)
+	var version string
+	if v, ok := doc["version"]; ok {
+		version = fmt.Sprint(v)
+	}
+	versions, ok := butaneVersions[variant]
+	if !ok {
+		return "", fmt.Errorf("butane: variant must be fcos or flatcar, not %q", variant)
+	}
+	ignitionVersion, ok := versions[version]
+	if !ok {
+		return "", fmt.Errorf("butane: version %q of the %s variant is not supported", version, variant)
+	}
+	delete(doc, "variant")
+	delete(doc, "version")
+	for k, what := range butaneUnsupported {
+		if _, ok := doc[k]; ok {
+			return "", fmt.Errorf("butane: %s is not supported", what)
+		}
+	}
+
+	ign, _ := doc["ignition"].(map[string]any)
+	if ign == nil {
+		ign = map[string]any{}
+		doc["ignition"] = ign
+	}
+	ign["version"] = ignitionVersion
+	if err := butaneContents(doc, ""); err != nil {
+		return "", err
+	}
+	if storage, ok := doc["storage"].(map[string]any); ok {
+		if _, ok := storage["trees"]; ok {
+			return "", errors.New("butane: storage.trees is not supported, as it reads local files")
+		}
+		if err := butaneMountUnits(doc, storage); err != nil {
+			return "", err
+		}
+	}
+
+	data, err := json.Marshal(ignitionKeys(doc))
+	if err != nil {
+		return "", fmt.Errorf("butane: %w", err)
+	}
+	return string(data), nil
+}
+
+// butaneContents replaces, anywhere under v, the inline form of a
+// resource (file contents and appends, merged and replaced configs, CA
+// certificates) with the data URL Ignition takes.
+func butaneContents(v any, path string) error {
+	switch v := v.(type) {
+	case map[string]any:
+		if _, ok := v["local"]; ok {
+			return fmt.Errorf("butane: %s.local is not supported, as it reads local files; use inline", strings.TrimPrefix(path, "."))
+		}
+		if inline, ok := v["inline"]; ok {
+			s, ok := inline.(string)
+			if !ok {
+				return fmt.Errorf("butane: %s.inline must be a string", strings.TrimPrefix(path, "."))
+			}
+			delete(v, "inline")
+			v["source"] = "data:;base64," + base64.StdEncoding.EncodeToString([]byte(s))
+		}
+		for k, child := range v {
+			if err := butaneContents(child, path+"."+k); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for i, child := range v {
+			if err := butaneContents(child, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// butaneMountUnits adds a systemd mount unit for each filesystem with
+// with_mount_unit set.
+func butaneMountUnits(doc, storage map[string]any) error {
+	filesystems, _ := storage["filesystems"].([]any)
+	var units []any
+	for i, f := range filesystems {
+		fs, _ := f.(map[string]any)
+		if fs == nil {
+			continue
+		}
+		with, _ := fs["with_mount_unit"].(bool)
+		delete(fs, "with_mount_unit")
+		if !with {
+			continue
+		}
+		device, _ := fs["device"].(string)
+		format, _ := fs["format"].(string)
+		mountPath, _ := fs["path"].(string)
+		if format == "swap" {
+			units = append(units, map[string]any{
+				"name":     systemdEscapePath(device) + ".swap",
+				"enabled":  true,
+				"contents": fmt.Sprintf("[Unit]\nDescription=Swap on %s\n\n[Swap]\nWhat=%s\n\n[Install]\nRequiredBy=swap.target\n", device, device),
+			})
+			continue
+		}
+		if mountPath == "" {
+			return fmt.Errorf("butane: storage.filesystems[%d] has with_mount_unit but no path", i)
+		}
+		unit := fmt.Sprintf("[Unit]\nRequires=systemd-fsck@%s.service\nAfter=systemd-fsck@%s.service\n\n[Mount]\nWhere=%s\nWhat=%s\nType=%s\n",
+			systemdEscapePath(device), systemdEscapePath(device), mountPath, device, format)
+		if opts, ok := fs["mount_options"].([]any); ok && len(opts) > 0 {
+			var list []string
+			for _, o := range opts {
+				list = append(list, fmt.Sprint(o))
+			}
+			unit += "Options=" + strings.Join(list, ",") + "\n"
+		}
+		unit += "\n[Install]\nRequiredBy=local-fs.target\n"
+		units = append(units, map[string]any{
+			"name":     systemdEscapePath(mountPath) + ".mount",
+			"enabled":  true,
+			"contents": unit,
+		})
+	}
+	if len(units) == 0 {
+		return nil
+	}
+	systemd, _ := doc["systemd"].(map[string]any)
+	if systemd == nil {
+		systemd = map[string]any{}
+		doc["systemd"] = systemd
+	}
+	existing, _ := systemd["units"].([]any)
+	systemd["units"] = append(existing, units...)
+	return nil
+}
+
+// systemdEscapePath escapes a path for a unit name, as systemd-escape
+// --path does for the paths a config uses.
+func systemdEscapePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '.' && i > 0, c == ':':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+	}
+	return b.String()
+}
+
+// ignitionKeys returns v with its map keys in Ignition's camelCase, from
+// Butane's snake_case: wipe_table becomes wipeTable and size_mib sizeMiB.
+func ignitionKeys(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, child := range v {
+			out[camelKey(k)] = ignitionKeys(child)
+		}
+		return out
+	case []any:
+		for i, child := range v {
+			v[i] = ignitionKeys(child)
+		}
+		return v
+	}
+	return v
+}
+
+func camelKey(k string) string {
+	parts := strings.Split(k, "_")
+	for i := 1; i < len(parts); i++ {
+		switch parts[i] {
+		case "mib":
+			parts[i] = "MiB"
+		default:
+			if parts[i] != "" {
+				parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+			}
+		}
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,66 @@
+package profile
+
+import "reflect"
+
+// Field is a value config templates and kernel parameters can use.
+type Field struct {
+	Name  string `json:"name"` // as written in a template, such as .Hostname or .Identity.Cert
+	Doc   string `json:"doc"`
+	Keyed bool   `json:"keyed,omitempty"` // a map, used as .Name.key
+}
+
+// fieldDocs describes TemplateVars for the profile editor.
+var fieldDocs = map[string]string{
+	"MAC":                 "The system's MAC address",
+	"Hostname":            "The system's hostname",
+	"IP":                  "The address the system booted from",
+	"Site":                "The site of the subnet the system booted from, if it has one",
+	"SystemID":            "The system's ID in duh",
+	"ImageID":             "The ID of the image being installed",
+	"ServerURL":           "Base URL of duh",
+	"ConfigURL":           "Signed URL of this config",
+	"CallbackURL":         "URL the installer POSTs to when it finishes or fails",
+	"HeartbeatURL":        "URL the installed host POSTs heartbeats to",
+	"TPMURL":              "URL early boot POSTs the TPM's EK certificate or public key, and AK, to",
+	"AttemptID":           "The provision attempt this config is for",
+	"FileURLs":            "Signed URLs of the image's extra files, by role",
+	"RootfsURL":           "Signed URL of the image's rootfs, if it has one",
+	"ChecksumsURL":        "SHA256SUMS manifest of the image's files",
+	"TorrentURLs":         "Signed .torrent URLs of the image's files, by role, when torrents are on",
+	"DriversURL":          "Signed manifest of the profile's drivers",
+	"MirrorURL":           "Package mirror named after the profile's OS family, if any",
+	"Mirrors":             "Package mirror URLs, by name",
+	"Vars":                "The profile's default vars, overridden by the system's",
+	"PasswordHash":        "SHA-512 crypt hash of a random password generated for the system each time it is queued",
+	"Identity.Cert":       "The system's PEM client certificate, issued on first use",
+	"Identity.Key":        "The certificate's PEM private key",
+	"Identity.CA":         "The PEM CA certificate that issued it",
+	"Storage.Render":      "The storage layout in the OS family's syntax",
+	"Storage.Kickstart":   "The storage layout as kickstart commands",
+	"Storage.Autoinstall": "The storage layout as an Ubuntu autoinstall section",
+	"Storage.Ignition":    "The storage layout as an Ignition storage value",
+	"Secrets.Get":         `A key of a secret in the external store, as .Secrets.Get "path" "key", for the profile's allowed paths`,
+}
+
+// TemplateFields lists what templates can use, read from TemplateVars so
+// it can't fall out of step with it: each field, and the methods of those
+// that are objects such as Identity.
+func TemplateFields() []Field {
+	var fields []Field
+	t := reflect.TypeFor[TemplateVars]()
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if f.Type.Kind() == reflect.Pointer && f.Type.Elem().Kind() == reflect.Struct {
+			for j := range f.Type.NumMethod() {
+				name := f.Name + "." + f.Type.Method(j).Name
+				fields = append(fields, Field{Name: "." + name, Doc: fieldDocs[name]})
+			}
+			continue
+		}
+		fields = append(fields, Field{Name: "." + f.Name, Doc: fieldDocs[f.Name], Keyed: f.Type.Kind() == reflect.Map})
+	}
+	return fields
+}
@@ -0,0 +1,194 @@
+package profile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ConfigFormat is how a rendered config of an OS family is served: its
+// content type, a conversion from what the template is written in, and a
+// check of the result so a broken config is refused at /config instead of
+// failing a boot halfway through.
+type ConfigFormat struct {
+	ContentType string
+	Convert     func(config string) (string, error) // nil if served as rendered
+	Validate    func(config string) error           // nil if any text goes
+}
+
+// Prepare converts and checks a rendered config for serving.
+func (f ConfigFormat) Prepare(config string) (string, error) {
+	if f.Convert != nil {
+		var err error
+		if config, err = f.Convert(config); err != nil {
+			return "", err
+		}
+	}
+	if f.Validate != nil {
+		if err := f.Validate(config); err != nil {
+			return "", err
+		}
+	}
+	return config, nil
+}
+
+// configFormats are the OS families whose config format duh knows.
+var configFormats = map[string]ConfigFormat{
+	"coreos":  {ContentType: "application/vnd.coreos.ignition+json", Convert: IgnitionFromButane, Validate: ValidateIgnition},
+	"talos":   {ContentType: "application/yaml", Validate: ValidateTalos},
+	"esxi":    {ContentType: "text/plain", Validate: ValidateESXiKickstart},
+	"proxmox": {ContentType: "application/toml", Validate: ValidateProxmoxAnswer},
+}
+
+// FormatFor returns the config format of an OS family.
+func FormatFor(osFamily string) ConfigFormat {
+	if f, ok := configFormats[osFamily]; ok {
+		return f
+	}
+	return ConfigFormat{ContentType: "text/plain"}
+}
+
+// ignitionSections are the top-level keys of an Ignition 3 config.
+var ignitionSections = []string{"ignition", "kernelArguments", "passwd", "storage", "systemd"}
+
+// ValidateIgnition checks that config is an Ignition 3 config: a JSON
+// object with an ignition.version of 3.x, no unknown sections, and paths
+// and names on the entries that need them. It is not the full schema, but
+// catches what a template most often gets wrong.
+func ValidateIgnition(config string) error {
+	var c struct {
+		Ignition *struct {
+			Version string `json:"version"`
+		} `json:"ignition"`
+		Storage struct {
+			Files       []struct{ Path string } `json:"files"`
+			Directories []struct{ Path string } `json:"directories"`
+			Links       []struct {
+				Path   string
+				Target string
+			} `json:"links"`
+			Filesystems []struct{ Device string } `json:"filesystems"`
+		} `json:"storage"`
+		Systemd struct {
+			Units []struct{ Name string } `json:"units"`
+		} `json:"systemd"`
+		Passwd struct {
+			Users []struct{ Name string } `json:"users"`
+		} `json:"passwd"`
+	}
+	if err := json.Unmarshal([]byte(config), &c); err != nil {
+		return fmt.Errorf("ignition: not valid JSON: %w", err)
+	}
+	var sections map[string]json.RawMessage
+	json.Unmarshal([]byte(config), &sections)
+	for k := range sections {
+		if !slices.Contains(ignitionSections, k) {
+			return fmt.Errorf("ignition: unknown section %q", k)
+		}
+	}
+	if c.Ignition == nil || c.Ignition.Version == "" {
+		return errors.New("ignition: ignition.version is required")
+	}
+	if !strings.HasPrefix(c.Ignition.Version, "3.") {
+		return fmt.Errorf("ignition: version %s is not supported; use a 3.x spec", c.Ignition.Version)
+	}
+	for i, f := range c.Storage.Files {
+		if !strings.HasPrefix(f.Path, "/") {
+			return fmt.Errorf("ignition: storage.files[%d] needs an absolute path", i)
+		}
+	}
+	for i, d := range c.Storage.Directories {
+		if !strings.HasPrefix(d.Path, "/") {
+			return fmt.Errorf("ignition: storage.directories[%d] needs an absolute path", i)
+		}
+	}
+	for i, l := range c.Storage.Links {
+		if !strings.HasPrefix(l.Path, "/") || l.Target == "" {
+			return fmt.Errorf("ignition: storage.links[%d] needs an absolute path and a target", i)
+		}
+	}
+	for i, f := range c.Storage.Filesystems {
+		if f.Device == "" {
+			return fmt.Errorf("ignition: storage.filesystems[%d] needs a device", i)
+		}
+	}
+	for i, u := range c.Systemd.Units {
+		if u.Name == "" {
+			return fmt.Errorf("ignition: systemd.units[%d] needs a name", i)
+		}
+	}
+	for i, u := range c.Passwd.Users {
+		if u.Name == "" {
+			return fmt.Errorf("ignition: passwd.users[%d] needs a name", i)
+		}
+	}
+	return nil
+}
+
+// talosMachineTypes are the machine.type values Talos accepts.
+var talosMachineTypes = []string{"init", "controlplane", "worker"}
+
+// ValidateTalos checks that config is a Talos machine config: YAML whose
+// v1alpha1 document has version, machine and cluster sections and a known
+// machine.type. Further documents of a multi-document config (network or
+// extension settings) are left to Talos. Only the layout of the YAML is
+// looked at, not every value.
+func ValidateTalos(config string) error {
+	for n, doc := range strings.Split(config, "\n---") {
+		top, machineType, err := talosKeys(doc)
+		if err != nil {
+			return fmt.Errorf("talos: document %d: %w", n+1, err)
+		}
+		if top["version"] != "v1alpha1" {
+			continue
+		}
+		for _, k := range []string{"machine", "cluster"} {
+			if _, ok := top[k]; !ok {
+				return fmt.Errorf("talos: the %s section is required", k)
+			}
+		}
+		if !slices.Contains(talosMachineTypes, machineType) {
+			return fmt.Errorf("talos: machine.type must be one of %s", strings.Join(talosMachineTypes, ", "))
+		}
+		return nil
+	}
+	return errors.New("talos: no document with version: v1alpha1")
+}
+
+// talosKeys reads the top-level keys of a YAML document, with their values
+// where they're scalars, and machine.type.
+func talosKeys(doc string) (top map[string]string, machineType string, err error) {
+	top = map[string]string{}
+	section := ""
+	childIndent := 0 // of the keys directly under section
+	for i, line := range strings.Split(doc, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if strings.Contains(indent, "\t") {
+			return nil, "", fmt.Errorf("line %d is indented with a tab", i+1)
+		}
+		key, value, ok := strings.Cut(trimmed, ":")
+		value, _, _ = strings.Cut(value, " #")
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+		if indent == "" {
+			if !ok {
+				return nil, "", fmt.Errorf("line %d: expected a key", i+1)
+			}
+			section, childIndent = key, 0
+			top[key] = value
+			continue
+		}
+		if childIndent == 0 {
+			childIndent = len(indent)
+		}
+		if section == "machine" && len(indent) == childIndent && ok && key == "type" {
+			machineType = value
+		}
+	}
+	return top, machineType, nil
+}
@@ -0,0 +1,179 @@
+package profile
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// esxiCommands are the kickstart commands ESXi's weasel installer knows.
+var esxiCommands = []string{
+	"accepteula", "vmaccepteula", "clearpart", "dryrun", "install", "installorupgrade", "upgrade",
+	"keyboard", "serialnum", "vmserialnum", "network", "paranoid", "part", "partition", "reboot", "rootpw",
+}
+
+// ValidateESXiKickstart checks that config is an ESXi kickstart: only
+// commands ESXi knows outside the %pre, %post and %firstboot sections, the
+// EULA accepted, a root password, and an install or upgrade with a target
+// disk.
+func ValidateESXiKickstart(config string) error {
+	seen := map[string]string{}
+	inSection := false
+	for i, line := range strings.Split(config, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "%") {
+			switch section := strings.Fields(line)[0]; section {
+			case "%pre", "%post", "%firstboot":
+				inSection = true
+			case "%end":
+				inSection = false
+			case "%include":
+			default:
+				return fmt.Errorf("esxi kickstart: line %d: unknown section %s", i+1, section)
+			}
+			continue
+		}
+		if inSection {
+			continue
+		}
+		cmd := strings.Fields(line)[0]
+		if !slices.Contains(esxiCommands, cmd) {
+			return fmt.Errorf("esxi kickstart: line %d: unknown command %q", i+1, cmd)
+		}
+		seen[cmd] = line
+	}
+	if seen["vmaccepteula"] == "" && seen["accepteula"] == "" {
+		return errors.New("esxi kickstart: vmaccepteula is required")
+	}
+	if seen["rootpw"] == "" {
+		return errors.New("esxi kickstart: rootpw is required")
+	}
+	install := seen["install"] + seen["installorupgrade"] + seen["upgrade"]
+	if install == "" {
+		return errors.New("esxi kickstart: install, installorupgrade or upgrade is required")
+	}
+	if !strings.Contains(install, "--firstdisk") && !strings.Contains(install, "--disk") && !strings.Contains(install, "--drive") {
+		return errors.New("esxi kickstart: the install command needs --firstdisk or --disk")
+	}
+	return nil
+}
+
+// proxmoxFilesystems are the root filesystems the Proxmox VE installer
+// can set up.
+var proxmoxFilesystems = []string{"ext4", "xfs", "zfs", "btrfs"}
+
+// ValidateProxmoxAnswer checks that config is a Proxmox VE automated
+// installation answer file: TOML with the global, network and disk-setup
+// tables and the keys the installer requires in each. Keys may be written
+// in kebab-case or, as older installers took them, snake_case.
+func ValidateProxmoxAnswer(config string) error {
+	tables, err := tomlKeys(config)
+	if err != nil {
+		return fmt.Errorf("proxmox answer: %w", err)
+	}
+	for _, t := range []string{"global", "network", "disk-setup"} {
+		if _, ok := tables[t]; !ok {
+			return fmt.Errorf("proxmox answer: the [%s] table is required", t)
+		}
+	}
+	global := tables["global"]
+	for _, k := range []string{"keyboard", "country", "fqdn", "mailto", "timezone"} {
+		if _, ok := global[k]; !ok {
+			return fmt.Errorf("proxmox answer: global.%s is required", k)
+		}
+	}
+	if _, ok := global["root-password"]; !ok {
+		if _, ok := global["root-password-hashed"]; !ok {
+			return errors.New("proxmox answer: global.root-password or root-password-hashed is required")
+		}
+	}
+	network := tables["network"]
+	switch network["source"] {
+	case "from-dhcp":
+	case "from-answer":
+		for _, k := range []string{"cidr", "dns", "gateway"} {
+			if _, ok := network[k]; !ok {
+				return fmt.Errorf("proxmox answer: network.%s is required with source from-answer", k)
+			}
+		}
+	default:
+		return errors.New("proxmox answer: network.source must be from-dhcp or from-answer")
+	}
+	disk := tables["disk-setup"]
+	if !slices.Contains(proxmoxFilesystems, disk["filesystem"]) {
+		return fmt.Errorf("proxmox answer: disk-setup.filesystem must be one of %s", strings.Join(proxmoxFilesystems, ", "))
+	}
+	_, hasList := disk["disk-list"]
+	_, hasFilter := tables["disk-setup.filter"]
+	if hasList == hasFilter {
+		return errors.New("proxmox answer: disk-setup needs one of disk-list or a [disk-setup.filter] table")
+	}
+	return nil
+}
+
+// tomlKeys reads the tables of a TOML document and the keys in each, with
+// string values unquoted and other values as written. Keys and table names
+// have underscores read as hyphens. Keys before the first table are in "".
+// It reads only as much TOML as an answer file uses: no inline tables or
+// arrays of tables.
+func tomlKeys(doc string) (map[string]map[string]string, error) {
+	tables := map[string]map[string]string{"": {}}
+	table := ""
+	lines := strings.Split(doc, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			end := strings.Index(line, "]")
+			if end < 0 || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: invalid table header", i+1)
+			}
+			table = strings.ReplaceAll(strings.TrimSpace(line[1:end]), "_", "-")
+			if _, ok := tables[table]; ok {
+				return nil, fmt.Errorf("line %d: table [%s] is defined twice", i+1, table)
+			}
+			tables[table] = map[string]string{}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		key = strings.ReplaceAll(strings.Trim(strings.TrimSpace(key), `"`), "_", "-")
+		value = strings.TrimSpace(value)
+		switch {
+		case strings.HasPrefix(value, `"`):
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated string", i+1)
+			}
+			value = value[1 : end+1]
+		case strings.HasPrefix(value, "["):
+			// Arrays can run over several lines.
+			for !strings.Contains(value, "]") && i+1 < len(lines) {
+				i++
+				value += " " + strings.TrimSpace(lines[i])
+			}
+			if !strings.Contains(value, "]") {
+				return nil, fmt.Errorf("line %d: unterminated array", i+1)
+			}
+		default:
+			value, _, _ = strings.Cut(value, "#")
+			value = strings.TrimSpace(value)
+			if value == "" {
+				return nil, fmt.Errorf("line %d: %s has no value", i+1, key)
+			}
+		}
+		if _, ok := tables[table][key]; ok {
+			return nil, fmt.Errorf("line %d: %s is set twice", i+1, key)
+		}
+		tables[table][key] = value
+	}
+	return tables, nil
+}
@@ -3,25 +3,101 @@ package profile
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"text/template"
+	"sync"
 )
 
 type TemplateVars struct {
-	MAC         string
-	Hostname    string
-	IP          string
-	SystemID    int64
-	ImageID     int64
-	ServerURL   string
-	ConfigURL   string
-	CallbackURL string
-	Vars        map[string]string
+	MAC          string
+	Hostname     string
+	IP           string
+	Site         string // site of the subnet IP is on, if any
+	SystemID     int64
+	ImageID      int64
+	ServerURL    string
+	ConfigURL    string
+	CallbackURL  string
+	HeartbeatURL string // the installed host POSTs here periodically
+	TPMURL       string // early boot POSTs the TPM's endorsement and attestation keys here
+	AttemptID    string
+	FileURLs     map[string]string // role → signed URL for the image's extra files
+	RootfsURL    string            // FileURLs["rootfs"], if the image declares one
+	ChecksumsURL string            // SHA256SUMS manifest for the image's files
+	TorrentURLs  map[string]string // role → signed .torrent URL, when torrent distribution is on
+	DriversURL   string            // signed manifest of the profile's drivers
+	MirrorURL    string            // package mirror named after the profile's OS family, if any
+	Mirrors      map[string]string // package mirror name → URL
+	Vars         map[string]string
+	PasswordHash string    // SHA-512 crypt hash of the system's generated password
+	Identity     *Identity // machine certificate; nil where none can be issued
+	Storage      *Storage  // the profile's storage layout; nil without one
+	Secrets      *Secrets  // the external secret store; nil without one
 }
 
-func BuildVars(defaultVarsJSON, systemVarsJSON string) (map[string]string, error) {
+// Identity is a system's client certificate from duh's internal CA. The
+// certificate is issued the first time a template uses it, so configs
+// that don't use it issue none.
+type Identity struct {
+	caPEM string
+	issue func() (certPEM, keyPEM string, err error)
+
+	once    sync.Once
+	certPEM string
+	keyPEM  string
+	err     error
+}
+
+// NewIdentity returns an Identity that calls issue when first used.
+func NewIdentity(caPEM string, issue func() (certPEM, keyPEM string, err error)) *Identity {
+	return &Identity{caPEM: caPEM, issue: issue}
+}
+
+var errNoIdentity = errors.New("machine certificates are not enabled")
+
+func (i *Identity) load() error {
+	if i == nil {
+		return errNoIdentity
+	}
+	i.once.Do(func() { i.certPEM, i.keyPEM, i.err = i.issue() })
+	return i.err
+}
+
+// Cert is the system's PEM-encoded client certificate.
+func (i *Identity) Cert() (string, error) {
+	if err := i.load(); err != nil {
+		return "", err
+	}
+	return i.certPEM, nil
+}
+
+// Key is the certificate's PEM-encoded private key.
+func (i *Identity) Key() (string, error) {
+	if err := i.load(); err != nil {
+		return "", err
+	}
+	return i.keyPEM, nil
+}
+
+// CA is the PEM-encoded CA certificate that issued Cert.
+func (i *Identity) CA() (string, error) {
+	if i == nil {
+		return "", errNoIdentity
+	}
+	return i.caPEM, nil
+}
+
+// BuildVars merges the site-wide global vars, a profile's default vars
+// and a system's own, each overriding the one before.
+func BuildVars(globalVarsJSON, defaultVarsJSON, systemVarsJSON string) (map[string]string, error) {
 	merged := make(map[string]string)
 
+	if globalVarsJSON != "" && globalVarsJSON != "{}" {
+		if err := json.Unmarshal([]byte(globalVarsJSON), &merged); err != nil {
+			return nil, fmt.Errorf("parse global vars: %w", err)
+		}
+	}
+
 	if defaultVarsJSON != "" && defaultVarsJSON != "{}" {
 		if err := json.Unmarshal([]byte(defaultVarsJSON), &merged); err != nil {
 			return nil, fmt.Errorf("parse profile default_vars: %w", err)
@@ -41,8 +117,10 @@ func BuildVars(defaultVarsJSON, systemVarsJSON string) (map[string]string, error
 	return merged, nil
 }
 
-func RenderConfigTemplate(configTemplate string, vars TemplateVars) (string, error) {
-	tmpl, err := template.New("config").Parse(configTemplate)
+// RenderConfigTemplate renders a config template, with the snippets it
+// includes.
+func RenderConfigTemplate(configTemplate string, snippets Snippets, vars TemplateVars) (string, error) {
+	tmpl, err := parseTemplate("config", configTemplate, snippets)
 	if err != nil {
 		return "", fmt.Errorf("parse config template: %w", err)
 	}
@@ -53,11 +131,13 @@ func RenderConfigTemplate(configTemplate string, vars TemplateVars) (string, err
 	return buf.String(), nil
 }
 
-func RenderKernelParams(kernelParams string, vars TemplateVars) (string, error) {
+// RenderKernelParams renders a profile's kernel parameters, with the
+// snippets they include.
+func RenderKernelParams(kernelParams string, snippets Snippets, vars TemplateVars) (string, error) {
 	if kernelParams == "" {
 		return "", nil
 	}
-	tmpl, err := template.New("kparams").Parse(kernelParams)
+	tmpl, err := parseTemplate("kparams", kernelParams, snippets)
 	if err != nil {
 		return "", fmt.Errorf("parse kernel_params template: %w", err)
 	}
@@ -0,0 +1,102 @@
+package profile
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Secrets reads secrets from the external secret store while a template
+// renders, limited to the paths its profile allows. Each secret is read
+// at most once per render and never stored.
+type Secrets struct {
+	allowed []string
+	fetch   func(path string) (map[string]string, error)
+	denied  error // why no secret may be read, if none may
+
+	mu    sync.Mutex
+	cache map[string]map[string]string
+}
+
+// NewSecrets returns Secrets that read the paths matching allowed with
+// fetch. See ParseSecretPaths for the patterns.
+func NewSecrets(allowed []string, fetch func(path string) (map[string]string, error)) *Secrets {
+	return &Secrets{allowed: allowed, fetch: fetch, cache: map[string]map[string]string{}}
+}
+
+var errNoSecrets = errors.New("no secret store is configured")
+
+// DeniedSecrets returns Secrets that refuse every read with err, for a
+// system that mustn't be given any.
+func DeniedSecrets(err error) *Secrets {
+	return &Secrets{denied: err}
+}
+
+// ParseSecretPaths reads a profile's allowed secret paths, one per line
+// or separated by spaces. Each is a path.Match pattern such as
+// secret/db/*, or a prefix ending in "/" that allows everything under it.
+// Blank lines and lines starting with # are skipped.
+func ParseSecretPaths(s string) ([]string, error) {
+	var paths []string
+	for line := range strings.Lines(s) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, p := range strings.Fields(line) {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("secret path %q: %w", p, err)
+			}
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// allows reports whether a secret path is one of the allowed ones.
+func (s *Secrets) allows(p string) bool {
+	for _, a := range s.allowed {
+		if strings.HasSuffix(a, "/") && strings.HasPrefix(p, a) {
+			return true
+		}
+		if ok, _ := path.Match(a, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Get is the value of key in the secret at path, as in
+// {{.Secrets.Get "secret/db/prod" "password"}}.
+func (s *Secrets) Get(p, key string) (string, error) {
+	if s == nil {
+		return "", errNoSecrets
+	}
+	if s.denied != nil {
+		return "", s.denied
+	}
+	p = strings.Trim(p, "/")
+	if path.Clean(p) != p || p == "." || strings.HasPrefix(p, "..") {
+		return "", fmt.Errorf("invalid secret path %q", p)
+	}
+	if !s.allows(p) {
+		return "", fmt.Errorf("secret %s is not in the profile's allowed secret paths", p)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secret, ok := s.cache[p]
+	if !ok {
+		var err error
+		if secret, err = s.fetch(p); err != nil {
+			return "", err
+		}
+		s.cache[p] = secret
+	}
+	v, ok := secret[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %q", p, key)
+	}
+	return v, nil
+}
@@ -0,0 +1,137 @@
+package profile
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"text/template"
+	"text/template/parse"
+)
+
+// Snippets are named template partials, by name, that config templates
+// and kernel parameters include with {{template "name" .}}.
+type Snippets map[string]string
+
+// reservedNames are what templates themselves are parsed as.
+var reservedNames = []string{"config", "kparams"}
+
+// MissingSnippetError is returned for a template including a snippet
+// there is none of.
+type MissingSnippetError struct {
+	Name string
+}
+
+func (e *MissingSnippetError) Error() string {
+	return fmt.Sprintf("no snippet named %q", e.Name)
+}
+
+// CheckSnippet reports what is wrong with a snippet, if anything: a name
+// templates are parsed as, text that doesn't parse, or a {{define}} of
+// its own, which would clash with other snippets.
+func CheckSnippet(name, text string) error {
+	if slices.Contains(reservedNames, name) {
+		return fmt.Errorf("the snippet name %q is reserved", name)
+	}
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return fmt.Errorf("parse snippet: %w", err)
+	}
+	for _, d := range t.Templates() {
+		if d.Name() != name {
+			return errors.New("snippets can't define templates; make each one a snippet of its own")
+		}
+	}
+	return nil
+}
+
+// parseTemplate parses text as name along with the snippets it includes,
+// and those they include in turn, so each render assembles only the
+// snippets its profile uses.
+func parseTemplate(name, text string, snippets Snippets) (*template.Template, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var queue []string
+	for _, t := range tmpl.Templates() {
+		queue = append(queue, includes(t)...)
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if tmpl.Lookup(n) != nil {
+			continue
+		}
+		body, ok := snippets[n]
+		if !ok {
+			return nil, &MissingSnippetError{Name: n}
+		}
+		t, err := tmpl.New(n).Parse(body)
+		if err != nil {
+			return nil, fmt.Errorf("snippet %s: %w", n, err)
+		}
+		queue = append(queue, includes(t)...)
+	}
+	return tmpl, nil
+}
+
+// UsedSnippets lists the snippets text includes, directly or through
+// other snippets. A template that doesn't parse uses none.
+func UsedSnippets(text string, snippets Snippets) []string {
+	tmpl, err := parseTemplate("config", text, snippets)
+	if err != nil {
+		return nil
+	}
+	var used []string
+	for _, t := range tmpl.Templates() {
+		if _, ok := snippets[t.Name()]; ok {
+			used = append(used, t.Name())
+		}
+	}
+	slices.Sort(used)
+	return used
+}
+
+// CheckIncludes returns a *MissingSnippetError if text includes a
+// snippet there is none of. Other problems are left for rendering to
+// report.
+func CheckIncludes(text string, snippets Snippets) error {
+	_, err := parseTemplate("config", text, snippets)
+	var missing *MissingSnippetError
+	if errors.As(err, &missing) {
+		return err
+	}
+	return nil
+}
+
+// includes lists the templates t includes.
+func includes(t *template.Template) []string {
+	var names []string
+	var walk func(parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+		case *parse.IfNode:
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.TemplateNode:
+			names = append(names, n.Name)
+		}
+	}
+	if t.Tree != nil {
+		walk(t.Tree.Root)
+	}
+	return names
+}
@@ -0,0 +1,611 @@
+package profile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Layout is a profile's storage layout: disks and their partitions, with
+// optional software RAID arrays and LVM volume groups built on them. It is
+// kept as JSON on the profile and rendered into the installer's own syntax
+// by Storage, so templates don't spell out partitioning by hand.
+//
+// Partitions, arrays and volume groups are referred to by Name. A
+// partition or array with no filesystem is a member of an array or a
+// physical volume of a volume group.
+type Layout struct {
+	Disks        []Disk        `json:"disks"`
+	RAID         []RAID        `json:"raid,omitempty"`
+	VolumeGroups []VolumeGroup `json:"volume_groups,omitempty"`
+}
+
+// Disk is a whole disk, wiped and given a new partition table.
+type Disk struct {
+	Device     string      `json:"device"` // sda, nvme0n1 or /dev/disk/by-path/...
+	Partitions []Partition `json:"partitions"`
+}
+
+// Partition is a partition of a Disk. Size is a size such as 512M, 20G or
+// 2T, or * for the rest of the disk; only a disk's last partition can take
+// the rest.
+type Partition struct {
+	Name  string `json:"name"`
+	Size  string `json:"size"`
+	FS    string `json:"fs,omitempty"` // see layoutFilesystems; "" for a RAID member or LVM physical volume
+	Mount string `json:"mount,omitempty"`
+}
+
+// RAID is a software RAID array over partitions.
+type RAID struct {
+	Name    string   `json:"name"`
+	Level   string   `json:"level"` // 0, 1, 5, 6 or 10
+	Members []string `json:"members"`
+	FS      string   `json:"fs,omitempty"`
+	Mount   string   `json:"mount,omitempty"`
+}
+
+// VolumeGroup is an LVM volume group over partitions or arrays.
+type VolumeGroup struct {
+	Name    string          `json:"name"`
+	PVs     []string        `json:"pvs"`
+	Volumes []LogicalVolume `json:"volumes"`
+}
+
+// LogicalVolume is a logical volume of a VolumeGroup. Its Size is as for a
+// Partition; only a group's last volume can take the rest.
+type LogicalVolume struct {
+	Name  string `json:"name"`
+	Size  string `json:"size"`
+	FS    string `json:"fs"`
+	Mount string `json:"mount,omitempty"`
+}
+
+// layoutFilesystems are the filesystems a layout can format. efi is a FAT
+// EFI system partition and biosboot the small partition GRUB needs to
+// boot a GPT disk on BIOS; neither takes a mount point of its own choosing.
+var layoutFilesystems = []string{"ext4", "xfs", "btrfs", "vfat", "swap", "efi", "biosboot"}
+
+var raidLevels = []string{"0", "1", "5", "6", "10"}
+
+var (
+	layoutNameRe   = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]{0,31}$`)
+	layoutDeviceRe = regexp.MustCompile(`^[A-Za-z0-9/_.:+-]+$`)
+	layoutMountRe  = regexp.MustCompile(`^/[A-Za-z0-9/_.-]*$`)
+)
+
+// layoutRest is the size that takes the rest of a disk or volume group.
+const layoutRest = "*"
+
+// ParseLayout reads and checks a storage layout. An empty string is no
+// layout, returned as nil.
+func ParseLayout(s string) (*Layout, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.DisallowUnknownFields()
+	var l Layout
+	if err := dec.Decode(&l); err != nil {
+		return nil, fmt.Errorf("parse storage layout: %w", err)
+	}
+	if err := l.validate(); err != nil {
+		return nil, fmt.Errorf("storage layout: %w", err)
+	}
+	return &l, nil
+}
+
+// sizeMiB reads a layout size in MiB. The rest is 0.
+func sizeMiB(orig string) (int64, error) {
+	size := strings.TrimSpace(orig)
+	if size == layoutRest {
+		return 0, nil
+	}
+	mult := int64(1)
+	switch strings.ToUpper(size[max(len(size)-1, 0):]) {
+	case "M":
+		size = size[:len(size)-1]
+	case "G":
+		mult, size = 1<<10, size[:len(size)-1]
+	case "T":
+		mult, size = 1<<20, size[:len(size)-1]
+	}
+	n, err := strconv.ParseFloat(size, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q: use e.g. 512M, 20G or %s for the rest", orig, layoutRest)
+	}
+	return max(int64(n*float64(mult)), 1), nil
+}
+
+func (l *Layout) validate() error {
+	if len(l.Disks) == 0 {
+		return errors.New("no disks")
+	}
+	names := map[string]string{} // name → what it names
+	claim := func(kind, name string) error {
+		if !layoutNameRe.MatchString(name) {
+			return fmt.Errorf("invalid %s name %q", kind, name)
+		}
+		if other, ok := names[name]; ok {
+			return fmt.Errorf("%s name %q is already used by a %s", kind, name, other)
+		}
+		names[name] = kind
+		return nil
+	}
+	checkFS := func(what, fs, mount string, member bool) error {
+		switch {
+		case fs == "" && member:
+			if mount != "" {
+				return fmt.Errorf("%s is a member and can't be mounted", what)
+			}
+			return nil
+		case fs == "":
+			return fmt.Errorf("%s has no filesystem and isn't a RAID member or LVM physical volume", what)
+		case member:
+			return fmt.Errorf("%s is a member, so it can't have a filesystem", what)
+		case !slices.Contains(layoutFilesystems, fs):
+			return fmt.Errorf("%s: unknown filesystem %q (use %s)", what, fs, strings.Join(layoutFilesystems, ", "))
+		case fs == "swap" || fs == "biosboot":
+			if mount != "" {
+				return fmt.Errorf("%s: %s isn't mounted", what, fs)
+			}
+		case fs == "efi":
+			if mount != "" && mount != "/boot/efi" {
+				return fmt.Errorf("%s: the EFI system partition is mounted at /boot/efi", what)
+			}
+		case !layoutMountRe.MatchString(mount):
+			return fmt.Errorf("%s needs a mount point such as / or /var", what)
+		}
+		return nil
+	}
+	checkSizes := func(what string, sizes []string) error {
+		for i, size := range sizes {
+			if size == layoutRest && i != len(sizes)-1 {
+				return fmt.Errorf("%s: only the last can take the rest (%s)", what, layoutRest)
+			}
+			if _, err := sizeMiB(size); err != nil {
+				return fmt.Errorf("%s: %w", what, err)
+			}
+		}
+		return nil
+	}
+
+	// Members are whatever an array or volume group is built on.
+	used := map[string]string{}
+	use := func(user, name string) error {
+		if prev, ok := used[name]; ok {
+			return fmt.Errorf("%s and %s both use %q", prev, user, name)
+		}
+		used[name] = user
+		return nil
+	}
+	for _, r := range l.RAID {
+		for _, m := range r.Members {
+			if err := use("array "+r.Name, m); err != nil {
+				return err
+			}
+		}
+	}
+	for _, vg := range l.VolumeGroups {
+		for _, pv := range vg.PVs {
+			if err := use("volume group "+vg.Name, pv); err != nil {
+				return err
+			}
+		}
+	}
+
+	partitions := map[string]bool{}
+	for _, d := range l.Disks {
+		if !layoutDeviceRe.MatchString(d.Device) {
+			return fmt.Errorf("invalid disk device %q", d.Device)
+		}
+		if len(d.Partitions) == 0 {
+			return fmt.Errorf("disk %s has no partitions", d.Device)
+		}
+		var sizes []string
+		for _, p := range d.Partitions {
+			if err := claim("partition", p.Name); err != nil {
+				return err
+			}
+			partitions[p.Name] = true
+			_, member := used[p.Name]
+			if err := checkFS("partition "+p.Name, p.FS, p.Mount, member); err != nil {
+				return err
+			}
+			sizes = append(sizes, p.Size)
+		}
+		if err := checkSizes("disk "+d.Device, sizes); err != nil {
+			return err
+		}
+	}
+	arrays := map[string]bool{}
+	for _, r := range l.RAID {
+		if err := claim("array", r.Name); err != nil {
+			return err
+		}
+		arrays[r.Name] = true
+		if !slices.Contains(raidLevels, r.Level) {
+			return fmt.Errorf("array %s: RAID level must be one of %s", r.Name, strings.Join(raidLevels, ", "))
+		}
+		if len(r.Members) < 2 {
+			return fmt.Errorf("array %s needs at least two members", r.Name)
+		}
+		for _, m := range r.Members {
+			if !partitions[m] {
+				return fmt.Errorf("array %s: %q is not a partition", r.Name, m)
+			}
+		}
+		_, member := used[r.Name]
+		if err := checkFS("array "+r.Name, r.FS, r.Mount, member); err != nil {
+			return err
+		}
+	}
+	for _, vg := range l.VolumeGroups {
+		if err := claim("volume group", vg.Name); err != nil {
+			return err
+		}
+		if len(vg.PVs) == 0 {
+			return fmt.Errorf("volume group %s has no physical volumes", vg.Name)
+		}
+		for _, pv := range vg.PVs {
+			if !partitions[pv] && !arrays[pv] {
+				return fmt.Errorf("volume group %s: %q is not a partition or array", vg.Name, pv)
+			}
+		}
+		if len(vg.Volumes) == 0 {
+			return fmt.Errorf("volume group %s has no volumes", vg.Name)
+		}
+		var sizes []string
+		lvs := map[string]bool{}
+		for _, lv := range vg.Volumes {
+			if !layoutNameRe.MatchString(lv.Name) || lvs[lv.Name] {
+				return fmt.Errorf("volume group %s: invalid or repeated volume name %q", vg.Name, lv.Name)
+			}
+			lvs[lv.Name] = true
+			what := "volume " + vg.Name + "/" + lv.Name
+			if lv.FS == "efi" || lv.FS == "biosboot" {
+				return fmt.Errorf("%s: %s must be a partition", what, lv.FS)
+			}
+			if err := checkFS(what, lv.FS, lv.Mount, false); err != nil {
+				return err
+			}
+			sizes = append(sizes, lv.Size)
+		}
+		if err := checkSizes("volume group "+vg.Name, sizes); err != nil {
+			return err
+		}
+	}
+	for name, user := range used {
+		if !partitions[name] && !arrays[name] {
+			return fmt.Errorf("%s uses %q, which isn't defined", user, name)
+		}
+	}
+	return nil
+}
+
+// mounted is a filesystem the layout mounts, in mount order.
+type mounted struct {
+	fs, mount string
+}
+
+// Storage is a profile's storage layout as config templates see it: each
+// method renders it in one installer's syntax. A nil Storage, for a profile
+// without a layout, renders as nothing.
+type Storage struct {
+	layout   *Layout
+	osFamily string
+}
+
+// NewStorage returns the Storage for a profile's layout, or nil if it has
+// none.
+func NewStorage(layoutJSON, osFamily string) (*Storage, error) {
+	l, err := ParseLayout(layoutJSON)
+	if err != nil || l == nil {
+		return nil, err
+	}
+	return &Storage{layout: l, osFamily: osFamily}, nil
+}
+
+// storageSyntax maps OS families to the syntax their installers take.
+var storageSyntax = map[string]string{
+	"rhel":   "kickstart",
+	"ubuntu": "autoinstall",
+	"coreos": "ignition",
+}
+
+// Render renders the layout for the profile's OS family: kickstart for
+// RHEL, autoinstall for Ubuntu and Ignition for CoreOS.
+func (s *Storage) Render() (string, error) {
+	if s == nil {
+		return "", nil
+	}
+	switch storageSyntax[s.osFamily] {
+	case "kickstart":
+		return s.Kickstart()
+	case "autoinstall":
+		return s.Autoinstall()
+	case "ignition":
+		return s.Ignition()
+	}
+	return "", fmt.Errorf("no storage layout syntax for OS family %q; use .Storage.Kickstart, .Storage.Autoinstall or .Storage.Ignition", s.osFamily)
+}
+
+// kickstartDisk is a disk's name as kickstart's --ondisk takes it.
+func kickstartDisk(device string) string {
+	return strings.TrimPrefix(device, "/dev/")
+}
+
+// Kickstart renders the layout as kickstart commands, wiping every disk in
+// it and no others.
+func (s *Storage) Kickstart() (string, error) {
+	if s == nil {
+		return "", nil
+	}
+	l := s.layout
+	var b strings.Builder
+	var drives []string
+	for _, d := range l.Disks {
+		drives = append(drives, kickstartDisk(d.Device))
+	}
+	fmt.Fprintf(&b, "ignoredisk --only-use=%s\n", strings.Join(drives, ","))
+	b.WriteString("zerombr\n")
+	fmt.Fprintf(&b, "clearpart --all --initlabel --disklabel=gpt --drives=%s\n", strings.Join(drives, ","))
+
+	// Kickstart names RAID members raid.<name> and physical volumes
+	// pv.<name>.
+	role := map[string]string{}
+	for _, r := range l.RAID {
+		for _, m := range r.Members {
+			role[m] = "raid." + m
+		}
+	}
+	for _, vg := range l.VolumeGroups {
+		for _, pv := range vg.PVs {
+			role[pv] = "pv." + pv
+		}
+	}
+	size := func(sz string) string {
+		mib, _ := sizeMiB(sz)
+		if mib == 0 {
+			return "--size=1 --grow"
+		}
+		return fmt.Sprintf("--size=%d", mib)
+	}
+	fsArgs := func(fs string) string {
+		switch fs {
+		case "":
+			return ""
+		case "efi":
+			return " --fstype=efi"
+		}
+		return " --fstype=" + fs
+	}
+	target := func(name, fs, mount string) string {
+		switch {
+		case role[name] != "":
+			return role[name]
+		case fs == "efi":
+			return "/boot/efi"
+		case fs == "swap" || fs == "biosboot":
+			return fs
+		}
+		return mount
+	}
+	for _, d := range l.Disks {
+		for _, p := range d.Partitions {
+			fmt.Fprintf(&b, "part %s%s %s --ondisk=%s\n", target(p.Name, p.FS, p.Mount), fsArgs(p.FS), size(p.Size), kickstartDisk(d.Device))
+		}
+	}
+	for _, r := range l.RAID {
+		var members []string
+		for _, m := range r.Members {
+			members = append(members, role[m])
+		}
+		fmt.Fprintf(&b, "raid %s --device=%s --level=%s%s %s\n", target(r.Name, r.FS, r.Mount), r.Name, r.Level, fsArgs(r.FS), strings.Join(members, " "))
+	}
+	for _, vg := range l.VolumeGroups {
+		var pvs []string
+		for _, pv := range vg.PVs {
+			pvs = append(pvs, role[pv])
+		}
+		fmt.Fprintf(&b, "volgroup %s %s\n", vg.Name, strings.Join(pvs, " "))
+		for _, lv := range vg.Volumes {
+			fmt.Fprintf(&b, "logvol %s --vgname=%s --name=%s%s %s\n", target(lv.Name, lv.FS, lv.Mount), vg.Name, lv.Name, fsArgs(lv.FS), size(lv.Size))
+		}
+	}
+	return b.String(), nil
+}
+
+// Autoinstall renders the layout as the storage section of an Ubuntu
+// autoinstall config, indented to sit under autoinstall:.
+func (s *Storage) Autoinstall() (string, error) {
+	if s == nil {
+		return "", nil
+	}
+	l := s.layout
+	var b strings.Builder
+	b.WriteString("  storage:\n    config:\n")
+	item := func(format string, args ...any) {
+		fmt.Fprintf(&b, "      - {"+format+"}\n", args...)
+	}
+	curtinFS := map[string]string{"efi": "fat32", "vfat": "fat32"}
+	format := func(id, fs, mount string) {
+		if fs == "" || fs == "biosboot" {
+			return
+		}
+		fstype := fs
+		if f, ok := curtinFS[fs]; ok {
+			fstype = f
+		}
+		item("type: format, id: %s-fs, volume: %s, fstype: %s, preserve: false", id, id, fstype)
+		switch fs {
+		case "swap":
+			mount = "none"
+		case "efi":
+			mount = "/boot/efi"
+		}
+		item("type: mount, id: %s-mount, device: %s-fs, path: %s", id, id, mount)
+	}
+	size := func(sz string) string {
+		mib, _ := sizeMiB(sz)
+		if mib == 0 {
+			return "-1"
+		}
+		return fmt.Sprintf("%dM", mib)
+	}
+	flags := map[string]string{}
+	for _, r := range l.RAID {
+		for _, m := range r.Members {
+			flags[m] = "raid"
+		}
+	}
+	for _, vg := range l.VolumeGroups {
+		for _, pv := range vg.PVs {
+			flags[pv] = "lvm"
+		}
+	}
+	for i, d := range l.Disks {
+		path := d.Device
+		if !strings.HasPrefix(path, "/") {
+			path = "/dev/" + path
+		}
+		bios := slices.ContainsFunc(d.Partitions, func(p Partition) bool { return p.FS == "biosboot" })
+		item("type: disk, id: disk%d, path: %s, ptable: gpt, wipe: superblock-recursive, preserve: false, grub_device: %t", i, path, bios)
+		for _, p := range d.Partitions {
+			extra := ""
+			switch {
+			case p.FS == "efi":
+				extra = ", flag: boot, grub_device: true"
+			case p.FS == "biosboot":
+				extra = ", flag: bios_grub"
+			case p.FS == "swap":
+				extra = ", flag: swap"
+			case flags[p.Name] != "":
+				extra = ", flag: " + flags[p.Name]
+			}
+			item("type: partition, id: %s, device: disk%d, size: %s, wipe: superblock, preserve: false%s", p.Name, i, size(p.Size), extra)
+		}
+	}
+	for _, d := range l.Disks {
+		for _, p := range d.Partitions {
+			format(p.Name, p.FS, p.Mount)
+		}
+	}
+	for _, r := range l.RAID {
+		item("type: raid, id: %s, name: %s, raidlevel: raid%s, devices: [%s], preserve: false", r.Name, r.Name, r.Level, strings.Join(r.Members, ", "))
+		format(r.Name, r.FS, r.Mount)
+	}
+	for _, vg := range l.VolumeGroups {
+		item("type: lvm_volgroup, id: %s, name: %s, devices: [%s], preserve: false", vg.Name, vg.Name, strings.Join(vg.PVs, ", "))
+		for _, lv := range vg.Volumes {
+			id := vg.Name + "-" + lv.Name
+			sz := ""
+			if mib, _ := sizeMiB(lv.Size); mib > 0 {
+				sz = fmt.Sprintf(", size: %dM", mib)
+			}
+			item("type: lvm_partition, id: %s, name: %s, volgroup: %s%s, preserve: false", id, lv.Name, vg.Name, sz)
+			format(id, lv.FS, lv.Mount)
+		}
+	}
+	return b.String(), nil
+}
+
+// GPT partition types Ignition is told to use.
+var ignitionTypeGUIDs = map[string]string{
+	"efi":      "C12A7328-F81F-11D2-BA4B-00A0C93EC93B",
+	"biosboot": "21686148-6449-6E6F-744E-656564454649",
+	"swap":     "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F",
+	"raid":     "A19D880F-05FC-4D3B-A006-743F0F84911E",
+}
+
+// Ignition renders the layout as the JSON value of an Ignition config's
+// storage key. Partitions are labelled with their names. Ignition has no
+// LVM, so a layout with volume groups can't be rendered.
+func (s *Storage) Ignition() (string, error) {
+	if s == nil {
+		return "", nil
+	}
+	l := s.layout
+	if len(l.VolumeGroups) > 0 {
+		return "", errors.New("ignition can't create LVM volume groups")
+	}
+	type partition struct {
+		Label    string `json:"label"`
+		Number   int    `json:"number"`
+		SizeMiB  int64  `json:"sizeMiB"`
+		TypeGUID string `json:"typeGuid,omitempty"`
+	}
+	type disk struct {
+		Device     string      `json:"device"`
+		WipeTable  bool        `json:"wipeTable"`
+		Partitions []partition `json:"partitions"`
+	}
+	type raid struct {
+		Name    string   `json:"name"`
+		Level   string   `json:"level"`
+		Devices []string `json:"devices"`
+	}
+	type filesystem struct {
+		Device         string `json:"device"`
+		Format         string `json:"format"`
+		Path           string `json:"path,omitempty"`
+		Label          string `json:"label,omitempty"`
+		WipeFilesystem bool   `json:"wipeFilesystem"`
+	}
+	var out struct {
+		Disks       []disk       `json:"disks"`
+		RAID        []raid       `json:"raid,omitempty"`
+		Filesystems []filesystem `json:"filesystems,omitempty"`
+	}
+
+	members := map[string]bool{}
+	for _, r := range l.RAID {
+		for _, m := range r.Members {
+			members[m] = true
+		}
+	}
+	partLabel := func(name string) string { return "/dev/disk/by-partlabel/" + name }
+	addFS := func(device, name, fs, mount string) {
+		switch fs {
+		case "", "biosboot":
+			return
+		case "efi":
+			fs, mount = "vfat", "/boot/efi"
+		}
+		out.Filesystems = append(out.Filesystems, filesystem{Device: device, Format: fs, Path: mount, Label: name, WipeFilesystem: true})
+	}
+	for _, d := range l.Disks {
+		path := d.Device
+		if !strings.HasPrefix(path, "/") {
+			path = "/dev/" + path
+		}
+		od := disk{Device: path, WipeTable: true}
+		for i, p := range d.Partitions {
+			mib, _ := sizeMiB(p.Size)
+			guid := ignitionTypeGUIDs[p.FS]
+			if members[p.Name] {
+				guid = ignitionTypeGUIDs["raid"]
+			}
+			od.Partitions = append(od.Partitions, partition{Label: p.Name, Number: i + 1, SizeMiB: mib, TypeGUID: guid})
+			addFS(partLabel(p.Name), p.Name, p.FS, p.Mount)
+		}
+		out.Disks = append(out.Disks, od)
+	}
+	for _, r := range l.RAID {
+		or := raid{Name: r.Name, Level: "raid" + r.Level}
+		for _, m := range r.Members {
+			or.Devices = append(or.Devices, partLabel(m))
+		}
+		out.RAID = append(out.RAID, or)
+		addFS("/dev/md/"+r.Name, r.Name, r.FS, r.Mount)
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
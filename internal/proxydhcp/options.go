@@ -0,0 +1,95 @@
+package proxydhcp
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Option is an extra DHCP option added to every proxy DHCP reply. It
+// replaces any option duh would otherwise send with the same code, such as
+// the vendor options (43) or the class identifier (60).
+type Option struct {
+	Code  uint8
+	Value []byte
+}
+
+// reservedOptions can't be overridden without breaking the exchange: the
+// message type and server identifier, the boot file (set per architecture
+// from the boot file mapping), and the pad and end markers.
+var reservedOptions = map[uint8]bool{0: true, 53: true, 54: true, 67: true, 255: true}
+
+// ParseOptions parses extra options, one per line, as
+//
+//	<code> <type> <value>
+//
+// where type is one of string, hex, ip, uint8, uint16 or uint32. hex values
+// may separate bytes with colons (e.g. "175 hex 15:01:01"), ip takes a
+// comma-separated list. Blank lines and lines starting with # are ignored.
+func ParseOptions(text string) ([]Option, error) {
+	var opts []Option
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		opt, err := parseOption(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
+
+func parseOption(line string) (Option, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return Option{}, fmt.Errorf("want <code> <type> <value>")
+	}
+	code, err := strconv.ParseUint(fields[0], 10, 8)
+	if err != nil {
+		return Option{}, fmt.Errorf("invalid option code %q", fields[0])
+	}
+	if reservedOptions[uint8(code)] {
+		return Option{}, fmt.Errorf("option %d can't be overridden", code)
+	}
+	typ := strings.ToLower(fields[1])
+	// Strings keep their inner spacing.
+	raw := strings.TrimSpace(strings.SplitN(line, fields[1], 2)[1])
+
+	var value []byte
+	switch typ {
+	case "string":
+		value = []byte(raw)
+	case "hex":
+		value, err = hex.DecodeString(strings.ReplaceAll(raw, ":", ""))
+		if err != nil {
+			return Option{}, fmt.Errorf("invalid hex value %q", raw)
+		}
+	case "ip":
+		for _, s := range strings.Split(raw, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s)).To4()
+			if ip == nil {
+				return Option{}, fmt.Errorf("invalid IPv4 address %q", s)
+			}
+			value = append(value, ip...)
+		}
+	case "uint8", "uint16", "uint32":
+		bits, _ := strconv.Atoi(typ[4:])
+		n, err := strconv.ParseUint(raw, 10, bits)
+		if err != nil {
+			return Option{}, fmt.Errorf("invalid %s value %q", typ, raw)
+		}
+		value = binary.BigEndian.AppendUint32(nil, uint32(n))[4-bits/8:]
+	default:
+		return Option{}, fmt.Errorf("unknown type %q (want string, hex, ip, uint8, uint16 or uint32)", fields[1])
+	}
+	if len(value) > 255 {
+		return Option{}, fmt.Errorf("value is %d bytes, at most 255 fit in an option", len(value))
+	}
+	return Option{Code: uint8(code), Value: value}, nil
+}
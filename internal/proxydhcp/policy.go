@@ -0,0 +1,124 @@
+package proxydhcp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Policy decides which PXE clients proxy DHCP answers. The zero Policy
+// answers everyone. Clients that aren't answered still get an address from
+// the network's DHCP server; they just don't netboot from duh.
+type Policy struct {
+	KnownOnly  bool         // only systems already registered in duh
+	Prefixes   []string     // allowed MAC prefixes (e.g. OUIs), as lowercase hex; empty allows all
+	Subnets    []*net.IPNet // allowed client subnets; empty allows all
+	IgnoreMACs []string     // never answered, as lowercase hex
+}
+
+// ParsePolicy builds a Policy from the lists the setup page saves: one MAC
+// prefix, CIDR or MAC per line, with blank lines and # comments ignored.
+func ParsePolicy(knownOnly bool, prefixes, subnets, ignoreMACs string) (Policy, error) {
+	p := Policy{KnownOnly: knownOnly}
+	for _, line := range policyLines(prefixes) {
+		h, err := macHex(line)
+		if err != nil || len(h) > 12 {
+			return Policy{}, fmt.Errorf("invalid MAC prefix %q", line)
+		}
+		p.Prefixes = append(p.Prefixes, h)
+	}
+	nets, err := ParseSubnets(subnets)
+	if err != nil {
+		return Policy{}, err
+	}
+	p.Subnets = nets
+	for _, line := range policyLines(ignoreMACs) {
+		h, err := macHex(line)
+		if err != nil || len(h) != 12 {
+			return Policy{}, fmt.Errorf("invalid MAC address %q", line)
+		}
+		p.IgnoreMACs = append(p.IgnoreMACs, h)
+	}
+	return p, nil
+}
+
+// ParseSubnets reads one CIDR per line, with blank lines and # comments
+// ignored.
+func ParseSubnets(text string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, line := range policyLines(text) {
+		_, n, err := net.ParseCIDR(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q", line)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func policyLines(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// macHex strips the separators from a MAC address or prefix, leaving
+// lowercase hex of whole bytes.
+func macHex(s string) (string, error) {
+	h := strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(s))
+	if h == "" || len(h)%2 != 0 {
+		return "", fmt.Errorf("invalid MAC %q", s)
+	}
+	if _, err := hex.DecodeString(h); err != nil {
+		return "", fmt.Errorf("invalid MAC %q", s)
+	}
+	return h, nil
+}
+
+// Allows reports whether to answer a client, and if not, why. ip is the
+// best known address for the client's subnet and known whether duh already
+// has the system registered.
+func (p Policy) Allows(mac net.HardwareAddr, ip net.IP, known bool) (bool, string) {
+	h := hex.EncodeToString(mac)
+	for _, m := range p.IgnoreMACs {
+		if h == m {
+			return false, "MAC is ignored"
+		}
+	}
+	if p.KnownOnly && !known {
+		return false, "not a known system"
+	}
+	if len(p.Prefixes) > 0 {
+		ok := false
+		for _, pre := range p.Prefixes {
+			if strings.HasPrefix(h, pre) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false, "MAC prefix not allowed"
+		}
+	}
+	if len(p.Subnets) > 0 && !containsIP(p.Subnets, ip) {
+		return false, fmt.Sprintf("subnet of %s not allowed", ip)
+	}
+	return true, ""
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
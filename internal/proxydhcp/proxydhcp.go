@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"slices"
+	"strings"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
@@ -19,6 +21,63 @@ type Server struct {
 	HTTPAddr  string
 	ServerURL string
 	iface     string
+
+	// CurrentServerURL, if set, is called for every reply and overrides
+	// ServerURL, letting the URL change while the server runs.
+	CurrentServerURL func() string
+
+	// ChainToken, if set, is called with the client MAC and its result is
+	// appended to the boot.ipxe chain URL as the chain= parameter.
+	ChainToken func(mac string) string
+
+	// BootFile, if set, maps an architecture name (see Arches) to the boot
+	// file to hand out. An empty result falls back to DefaultBootFiles.
+	BootFile func(arch string) string
+
+	// ExtraOptions, if set, returns options to add to every reply.
+	ExtraOptions func() []Option
+
+	// Policy, if set, returns the policy deciding which clients to answer.
+	// KnownSystem reports whether a MAC belongs to a registered system, for
+	// policies limited to known systems.
+	Policy      func() Policy
+	KnownSystem func(mac string) bool
+
+	// SystemSubnets, if set, returns the subnets a registered system may
+	// be answered on, e.g. those of the tenant it belongs to. An empty
+	// result allows any.
+	SystemSubnets func(mac string) []*net.IPNet
+
+	// Listening, if set, is called with the ports bound once
+	// ListenAndServe is ready to answer.
+	Listening func(ports []int)
+}
+
+// Arches lists the client architectures duh maps to boot files, in the
+// order the setup page shows them.
+var Arches = []string{"bios", "efi-ia32", "efi-x64", "efi-arm64", "efi-riscv64"}
+
+// DefaultBootFiles is the boot file each architecture gets unless
+// overridden. ia32 and riscv64 builds aren't embedded and must be uploaded.
+var DefaultBootFiles = map[string]string{
+	"bios":        "undionly.kpxe",
+	"efi-ia32":    "ipxe-ia32.efi",
+	"efi-x64":     "ipxe.efi",
+	"efi-arm64":   "ipxe-arm64.efi",
+	"efi-riscv64": "ipxe-riscv64.efi",
+}
+
+func (s *Server) bootFileFor(arch string) string {
+	if s.BootFile != nil {
+		if f := s.BootFile(arch); f != "" {
+			return f
+		}
+	}
+	if f, ok := DefaultBootFiles[arch]; ok {
+		return f
+	}
+	// Unknown architectures get the legacy BIOS loader, as before.
+	return DefaultBootFiles["bios"]
 }
 
 func New(serverIP net.IP, tftpAddr, httpAddr, serverURL, iface string) *Server {
@@ -31,31 +90,72 @@ func New(serverIP net.IP, tftpAddr, httpAddr, serverURL, iface string) *Server {
 	}
 }
 
+// ListenAndServe answers on port 67, where clients broadcast their
+// DHCPDISCOVER, and on port 4011, where PXE clients send a unicast
+// DHCPREQUEST when the DHCP server itself says PXEClient, and for boot
+// server discovery. Port 67 is skipped if another DHCP server on this host
+// already holds it.
 func (s *Server) ListenAndServe(ctx context.Context) error {
-	laddr := &net.UDPAddr{IP: net.IPv4(0, 0, 0, 0), Port: 67}
-
-	srv, err := server4.NewServer(s.iface, laddr, s.handler)
-	if err != nil {
-		// If port 67 fails (e.g. another DHCP server on this host), try port 4011
-		laddr.Port = 4011
-		srv, err = server4.NewServer(s.iface, laddr, s.handler)
+	var servers []*server4.Server
+	var ports []int
+	for _, port := range []int{67, 4011} {
+		laddr := &net.UDPAddr{IP: net.IPv4(0, 0, 0, 0), Port: port}
+		srv, err := server4.NewServer(s.iface, laddr, s.handler(port))
 		if err != nil {
-			return fmt.Errorf("proxy dhcp: %w", err)
+			log.Printf("proxydhcp: can't listen on port %d: %v", port, err)
+			continue
 		}
+		log.Printf("proxydhcp: listening on %s port %d", s.iface, port)
+		servers = append(servers, srv)
+		ports = append(ports, port)
+	}
+	if len(servers) == 0 {
+		return fmt.Errorf("proxy dhcp: can't listen on port 67 or 4011")
+	}
+	if s.Listening != nil {
+		s.Listening(ports)
 	}
 
 	go func() {
 		<-ctx.Done()
-		srv.Close()
+		for _, srv := range servers {
+			srv.Close()
+		}
 	}()
 
-	log.Printf("proxydhcp: listening on %s port %d", s.iface, laddr.Port)
-	return srv.Serve()
+	errc := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() { errc <- srv.Serve() }()
+	}
+	err := <-errc
+	for _, srv := range servers {
+		srv.Close()
+	}
+	return err
+}
+
+func (s *Server) handler(port int) server4.Handler {
+	return func(conn net.PacketConn, peer net.Addr, pkt *dhcpv4.DHCPv4) {
+		s.handle(conn, peer, pkt, port == 4011)
+	}
 }
 
-func (s *Server) handler(conn net.PacketConn, peer net.Addr, pkt *dhcpv4.DHCPv4) {
-	// Only respond to DHCP DISCOVERs and REQUESTs from PXE clients
-	if pkt.MessageType() != dhcpv4.MessageTypeDiscover && pkt.MessageType() != dhcpv4.MessageTypeRequest {
+// handle answers one request. On port 67 it offers boot info alongside the
+// DHCP server's offer; on port 4011 (pxePort) it acknowledges the client's
+// unicast request directly.
+func (s *Server) handle(conn net.PacketConn, peer net.Addr, pkt *dhcpv4.DHCPv4, pxePort bool) {
+	switch pkt.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		// Discovery is always broadcast to port 67.
+		if pxePort {
+			return
+		}
+	case dhcpv4.MessageTypeRequest:
+	case dhcpv4.MessageTypeInform:
+		if !pxePort {
+			return
+		}
+	default:
 		return
 	}
 
@@ -65,6 +165,22 @@ func (s *Server) handler(conn net.PacketConn, peer net.Addr, pkt *dhcpv4.DHCPv4)
 		return
 	}
 
+	if s.Policy != nil {
+		known := s.KnownSystem != nil && s.KnownSystem(pkt.ClientHWAddr.String())
+		if ok, why := s.Policy().Allows(pkt.ClientHWAddr, clientSubnetIP(pkt, peer, pxePort, s.ServerIP), known); !ok {
+			log.Printf("proxydhcp: ignoring %s from %s: %s", pkt.MessageType(), pkt.ClientHWAddr, why)
+			return
+		}
+	}
+	if s.SystemSubnets != nil {
+		if nets := s.SystemSubnets(pkt.ClientHWAddr.String()); len(nets) > 0 {
+			if ip := clientSubnetIP(pkt, peer, pxePort, s.ServerIP); !containsIP(nets, ip) {
+				log.Printf("proxydhcp: ignoring %s from %s: subnet of %s is outside its tenant's", pkt.MessageType(), pkt.ClientHWAddr, ip)
+				return
+			}
+		}
+	}
+
 	// Detect if this is an iPXE client (user-class option 77)
 	isIPXE := isIPXEClient(pkt)
 
@@ -76,9 +192,12 @@ func (s *Server) handler(conn net.PacketConn, peer net.Addr, pkt *dhcpv4.DHCPv4)
 		method = "http"
 	}
 	log.Printf("proxydhcp: %s from %s arch=%s ipxe=%v method=%s",
-		pkt.MessageType(), pkt.ClientHWAddr, archName(arch), isIPXE, method)
+		pkt.MessageType(), pkt.ClientHWAddr, ArchName(arch), isIPXE, method)
 
 	serverURL := s.ServerURL
+	if s.CurrentServerURL != nil {
+		serverURL = s.CurrentServerURL()
+	}
 	if serverURL == "" {
 		serverURL = fmt.Sprintf("http://%s%s", s.ServerIP, s.HTTPAddr)
 	}
@@ -88,26 +207,29 @@ func (s *Server) handler(conn net.PacketConn, peer net.Addr, pkt *dhcpv4.DHCPv4)
 		// iPXE is loaded - chain to our boot script
 		// Use the actual MAC from the DHCP packet, not iPXE variable expansion,
 		// to handle systems with multiple NICs correctly
+		features := ipxeFeatures(pkt)
+		if strings.HasPrefix(serverURL, "https://") && len(features) > 0 && !slices.Contains(features, "https") {
+			// This build can't fetch https:// URLs at all.
+			serverURL = fmt.Sprintf("http://%s%s", s.ServerIP, s.HTTPAddr)
+		}
 		bootFile = fmt.Sprintf("%s/boot.ipxe?mac=%s", serverURL, pkt.ClientHWAddr)
+		// iPXE expands settings in the filename, so the script can be
+		// tailored to the build that fetches it.
+		bootFile += "&platform=${platform:uristring}&buildarch=${buildarch:uristring}&version=${version:uristring}"
+		if len(features) > 0 {
+			bootFile += "&features=" + strings.Join(features, ",")
+		}
+		if s.ChainToken != nil {
+			if tok := s.ChainToken(pkt.ClientHWAddr.String()); tok != "" {
+				bootFile += "&chain=" + tok
+			}
+		}
 	} else if httpBoot {
 		// HTTP boot — serve iPXE binary as full URL
-		switch arch {
-		case iana.EFI_ARM64:
-			bootFile = fmt.Sprintf("%s/ipxe-arm64.efi", serverURL)
-		default:
-			bootFile = fmt.Sprintf("%s/ipxe.efi", serverURL)
-		}
+		bootFile = fmt.Sprintf("%s/ipxe/%s", serverURL, s.bootFileFor(ArchName(arch)))
 	} else {
 		// Raw PXE - serve the right iPXE binary via TFTP
-		switch arch {
-		case iana.EFI_X86_64, iana.EFI_BC:
-			bootFile = "ipxe.efi"
-		case iana.EFI_ARM64:
-			bootFile = "ipxe-arm64.efi"
-		default:
-			// BIOS / IA32 / unknown → legacy
-			bootFile = "undionly.kpxe"
-		}
+		bootFile = s.bootFileFor(ArchName(arch))
 	}
 
 	opts := []dhcpv4.Modifier{
@@ -120,7 +242,12 @@ func (s *Server) handler(conn net.PacketConn, peer net.Addr, pkt *dhcpv4.DHCPv4)
 		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptClassIdentifier("HTTPClient")))
 	} else {
 		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient")))
-		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, vendorOpts())))
+		opts = append(opts, dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, vendorOpts(pkt))))
+	}
+	if s.ExtraOptions != nil {
+		for _, o := range s.ExtraOptions() {
+			opts = append(opts, dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(o.Code), o.Value)))
+		}
 	}
 
 	resp, err := dhcpv4.NewReplyFromRequest(pkt, opts...)
@@ -129,8 +256,8 @@ func (s *Server) handler(conn net.PacketConn, peer net.Addr, pkt *dhcpv4.DHCPv4)
 		return
 	}
 
-	// For REQUESTs, respond with ACK
-	if pkt.MessageType() == dhcpv4.MessageTypeRequest {
+	// Requests (and anything on port 4011) get an ACK
+	if pxePort || pkt.MessageType() == dhcpv4.MessageTypeRequest {
 		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
 	}
 
@@ -142,13 +269,47 @@ func (s *Server) handler(conn net.PacketConn, peer net.Addr, pkt *dhcpv4.DHCPv4)
 	// Don't assign an IP - this is proxy DHCP
 	resp.YourIPAddr = net.IPv4(0, 0, 0, 0)
 
-	if _, err := conn.WriteTo(resp.ToBytes(), peer); err != nil {
+	if _, err := conn.WriteTo(resp.ToBytes(), replyAddr(pkt, peer, pxePort)); err != nil {
 		log.Printf("proxydhcp: send error: %v", err)
 	}
 
 	log.Printf("proxydhcp: → %s boot=%s method=%s", pkt.ClientHWAddr, bootFile, method)
 }
 
+// replyAddr is where a reply goes (RFC 2131 section 4.1, PXE 2.1 section
+// 2.2.5): back through the relay agent if there is one, straight back to
+// the sender on port 4011 (the client has an address by then), to the
+// client's address if it has one, and otherwise broadcast, since a client
+// without an address can't receive unicast.
+func replyAddr(pkt *dhcpv4.DHCPv4, peer net.Addr, pxePort bool) net.Addr {
+	switch {
+	case len(pkt.GatewayIPAddr) > 0 && !pkt.GatewayIPAddr.IsUnspecified():
+		return &net.UDPAddr{IP: pkt.GatewayIPAddr, Port: dhcpv4.ServerPort}
+	case pxePort:
+		return peer
+	case len(pkt.ClientIPAddr) > 0 && !pkt.ClientIPAddr.IsUnspecified():
+		return &net.UDPAddr{IP: pkt.ClientIPAddr, Port: dhcpv4.ClientPort}
+	default:
+		return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+	}
+}
+
+// clientSubnetIP is an address on the client's subnet: its own once it has
+// one, else the relay agent's, else duh's, since an unrelayed broadcast
+// comes from duh's own segment.
+func clientSubnetIP(pkt *dhcpv4.DHCPv4, peer net.Addr, pxePort bool, serverIP net.IP) net.IP {
+	switch {
+	case len(pkt.ClientIPAddr) > 0 && !pkt.ClientIPAddr.IsUnspecified():
+		return pkt.ClientIPAddr
+	case len(pkt.GatewayIPAddr) > 0 && !pkt.GatewayIPAddr.IsUnspecified():
+		return pkt.GatewayIPAddr
+	}
+	if u, ok := peer.(*net.UDPAddr); ok && pxePort && !u.IP.IsUnspecified() {
+		return u.IP
+	}
+	return serverIP
+}
+
 func isPXEClient(pkt *dhcpv4.DHCPv4) bool {
 	vc := pkt.Options.Get(dhcpv4.OptionClassIdentifier)
 	if vc == nil {
@@ -175,6 +336,61 @@ func isIPXEClient(pkt *dhcpv4.DHCPv4) bool {
 	return string(uc) == "iPXE" || string(uc) == "\x04iPXE"
 }
 
+// ipxeFeatureNames maps the feature flags iPXE reports in its encapsulated
+// options (option 175) to the names used in boot.ipxe's features parameter.
+var ipxeFeatureNames = []struct {
+	code byte
+	name string
+}{
+	{0x11, "iscsi"},
+	{0x12, "aoe"},
+	{0x13, "http"},
+	{0x14, "https"},
+	{0x15, "tftp"},
+	{0x17, "dns"},
+	{0x18, "bzimage"},
+	{0x24, "efi"},
+	{0x25, "fcoe"},
+	{0x27, "menu"},
+	{0x28, "sdi"},
+	{0x29, "nfs"},
+}
+
+// ipxeFeatures returns the features an iPXE client was built with, or nil
+// if it didn't say.
+func ipxeFeatures(pkt *dhcpv4.DHCPv4) []string {
+	present := encapsulated(pkt.Options.Get(dhcpv4.GenericOptionCode(175)))
+	var names []string
+	for _, f := range ipxeFeatureNames {
+		if v := present[f.code]; len(v) > 0 && v[0] != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// encapsulated splits an option holding encapsulated sub-options (such as
+// 43 or 175) into a map of sub-option code to value.
+func encapsulated(enc []byte) map[byte][]byte {
+	subs := make(map[byte][]byte)
+	for len(enc) > 0 && enc[0] != 0xff {
+		if enc[0] == 0 { // pad
+			enc = enc[1:]
+			continue
+		}
+		if len(enc) < 2 {
+			break
+		}
+		code, n := enc[0], int(enc[1])
+		if len(enc) < 2+n {
+			break
+		}
+		subs[code] = enc[2 : 2+n]
+		enc = enc[2+n:]
+	}
+	return subs
+}
+
 func clientArch(pkt *dhcpv4.DHCPv4) iana.Arch {
 	archs := pkt.ClientArch()
 	if len(archs) == 0 {
@@ -183,29 +399,39 @@ func clientArch(pkt *dhcpv4.DHCPv4) iana.Arch {
 	return archs[0]
 }
 
-func archName(a iana.Arch) string {
+// ArchName returns duh's name for a client architecture (option 93). HTTP
+// boot variants share the name of their PXE counterpart, and EFI byte code
+// is treated as x86-64 as nearly all such firmware is.
+func ArchName(a iana.Arch) string {
 	switch a {
-	case iana.INTEL_X86PC:
+	case iana.INTEL_X86PC, iana.INTEL_X86PC_HTTP:
 		return "bios"
-	case iana.EFI_X86_64:
+	case iana.EFI_IA32, iana.EFI_X86_HTTP:
+		return "efi-ia32"
+	case iana.EFI_X86_64, iana.EFI_X86_64_HTTP, iana.EFI_BC, iana.EFI_BC_HTTP:
 		return "efi-x64"
-	case iana.EFI_BC:
-		return "efi-bc"
-	case iana.EFI_ARM64:
+	case iana.EFI_ARM64, iana.EFI_ARM64_HTTP:
 		return "efi-arm64"
-	case iana.EFI_IA32:
-		return "efi-ia32"
+	case iana.EFI_RISCV64, iana.EFI_RISCV64_HTTP:
+		return "efi-riscv64"
 	default:
 		return fmt.Sprintf("unknown(%d)", a)
 	}
 }
 
 // vendorOpts returns PXE vendor options telling the client we're a proxy
-func vendorOpts() []byte {
+// vendorOpts builds the PXE vendor options (option 43) for a reply.
+func vendorOpts(pkt *dhcpv4.DHCPv4) []byte {
 	// PXE discovery control: disable multicast/broadcast discovery,
 	// just use the boot server we provide
-	return []byte{
+	opts := []byte{
 		6, 1, 8, // Option 6 (PXE discovery control): value 8 = skip discovery
-		255, // End
 	}
+	// A boot server discovery request names the boot item it wants; the
+	// ACK must echo it or the client ignores the reply.
+	if item := encapsulated(pkt.Options.Get(dhcpv4.OptionVendorSpecificInformation))[71]; len(item) == 4 {
+		opts = append(opts, 71, 4)
+		opts = append(opts, item...)
+	}
+	return append(opts, 255) // End
 }
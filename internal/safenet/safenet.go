@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -20,26 +21,57 @@ func NewClient(timeout time.Duration) *http.Client {
 }
 
 // SafeDialContext is a DialContext function that resolves the host and blocks
-// connections to private/internal IP addresses.
+// connections to private/internal IP addresses. It dials the addresses it
+// checked, so a name that resolves differently a second time can't get past.
 func SafeDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, fmt.Errorf("invalid address: %w", err)
 	}
 
-	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	ips, err := lookupPublic(ctx, host)
 	if err != nil {
 		return nil, err
 	}
 
+	var dialer net.Dialer
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// CheckURL refuses a URL whose host resolves to a private/internal IP
+// address, so a bad URL is reported when it is given rather than when it
+// is fetched. SafeDialContext still checks each connection.
+func CheckURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	_, err = lookupPublic(ctx, u.Hostname())
+	return err
+}
+
+// lookupPublic resolves host, failing if any of its addresses is private.
+func lookupPublic(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
 	for _, ip := range ips {
 		if isPrivateIP(ip.IP) {
 			return nil, fmt.Errorf("blocked connection to private IP %s (resolved from %s)", ip.IP, host)
 		}
 	}
-
-	var dialer net.Dialer
-	return dialer.DialContext(ctx, network, net.JoinHostPort(host, port))
+	return ips, nil
 }
 
 func isPrivateIP(ip net.IP) bool {
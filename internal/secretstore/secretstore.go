@@ -0,0 +1,148 @@
+// Package secretstore reads secrets from an external store, HashiCorp
+// Vault or a plain HTTP key-value service, for config templates to use
+// when they are rendered. Nothing it reads is kept.
+package secretstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Kinds of store.
+const (
+	// KindVault is a Vault KV version 2 secrets engine. A path's first
+	// segment names the engine's mount: "secret/db/prod" is read from
+	// /v1/secret/data/db/prod.
+	KindVault = "vault"
+	// KindHTTP is any service answering GET {url}/{path} with a JSON
+	// object of strings, sent the token as a bearer token.
+	KindHTTP = "http"
+)
+
+// maxSecretSize bounds a store's reply.
+const maxSecretSize = 1 << 20
+
+// Client reads secrets from a store.
+type Client struct {
+	Kind  string
+	URL   string // e.g. https://vault.example.com:8200
+	Token string
+	HTTP  *http.Client
+}
+
+func New(kind, baseURL, token string) *Client {
+	return &Client{
+		Kind:  kind,
+		URL:   strings.TrimRight(baseURL, "/"),
+		Token: token,
+		HTTP:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// CleanPath checks a secret path and returns it without surrounding
+// slashes. Paths are slash-separated names; empty, "." and ".." segments
+// are refused so a path can't reach outside what it names.
+func CleanPath(p string) (string, error) {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return "", errors.New("empty secret path")
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return "", fmt.Errorf("invalid secret path %q", p)
+		}
+	}
+	return p, nil
+}
+
+// Get returns the secret at path as its keys and values.
+func (c *Client) Get(ctx context.Context, path string) (map[string]string, error) {
+	path, err := CleanPath(path)
+	if err != nil {
+		return nil, err
+	}
+	var rawURL string
+	switch c.Kind {
+	case KindVault:
+		mount, rest, ok := strings.Cut(path, "/")
+		if !ok {
+			return nil, fmt.Errorf("vault path %q needs a mount and a secret, e.g. secret/%s", path, path)
+		}
+		rawURL = c.URL + "/v1/" + escapePath(mount) + "/data/" + escapePath(rest)
+	case KindHTTP:
+		rawURL = c.URL + "/" + escapePath(path)
+	default:
+		return nil, fmt.Errorf("unknown secret store %q", c.Kind)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Kind == KindVault {
+		req.Header.Set("X-Vault-Token", c.Token)
+	} else if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("secret %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("secret %s not found", path)
+	}
+	if resp.StatusCode/100 != 2 {
+		// The reply isn't quoted: a store's error could echo what it was sent.
+		return nil, fmt.Errorf("secret %s: %s", path, resp.Status)
+	}
+
+	body := io.LimitReader(resp.Body, maxSecretSize)
+	if c.Kind == KindVault {
+		var v struct {
+			Data struct {
+				Data map[string]any `json:"data"`
+			} `json:"data"`
+		}
+		if err := json.NewDecoder(body).Decode(&v); err != nil {
+			return nil, fmt.Errorf("decode secret %s: %w", path, err)
+		}
+		return stringValues(v.Data.Data), nil
+	}
+	var v map[string]any
+	if err := json.NewDecoder(body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("decode secret %s: %w", path, err)
+	}
+	return stringValues(v), nil
+}
+
+// stringValues keeps a secret's values as text: strings as they are and
+// anything else, such as numbers, as JSON.
+func stringValues(m map[string]any) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		if s, ok := v.(string); ok {
+			out[k] = s
+			continue
+		}
+		b, _ := json.Marshal(v)
+		out[k] = string(b)
+	}
+	return out
+}
+
+func escapePath(p string) string {
+	segs := strings.Split(p, "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	return strings.Join(segs, "/")
+}
@@ -0,0 +1,172 @@
+package tftpserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Binaries serves boot binaries from Dir, falling back to the active
+// bundle in BundleDir and then to the iPXE builds embedded in duh.
+// Uploading a file with an embedded name overrides it; other names add
+// payloads for architectures duh doesn't ship, such as ipxe-riscv64.efi or
+// ipxe-ia32.efi.
+type Binaries struct {
+	Dir       string
+	BundleDir string // installed bundles; see InstallBundle
+
+	stats *Stats // set by NewServer
+}
+
+// Binary describes one boot binary available to clients.
+type Binary struct {
+	Name     string
+	Size     int64
+	Custom   bool   // uploaded to Dir
+	Embedded bool   // shipped with duh; Custom and Embedded means overridden
+	Bundle   string // version of the active bundle it comes from, unless Custom
+}
+
+// ErrInvalidName is returned for names that aren't a plain file name.
+var ErrInvalidName = errors.New("invalid boot binary name")
+
+func validName(name string) bool {
+	return name != "" && name == filepath.Base(name) && name != "." && name != ".." && !strings.HasPrefix(name, ".")
+}
+
+// Read returns a binary's contents, preferring an uploaded copy, then the
+// active bundle's.
+func (b *Binaries) Read(name string) ([]byte, error) {
+	if !validName(name) {
+		return nil, ErrInvalidName
+	}
+	if b.Dir != "" {
+		data, err := os.ReadFile(filepath.Join(b.Dir, name))
+		if err == nil {
+			return data, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	data, err := b.bundleRead(name)
+	if err == nil {
+		return data, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	path, ok := files[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown boot binary: %s", name)
+	}
+	return ipxeFS.ReadFile(path)
+}
+
+// List returns every binary available, embedded and uploaded, by name.
+func (b *Binaries) List() ([]Binary, error) {
+	byName := make(map[string]*Binary)
+	for name, path := range files {
+		data, err := ipxeFS.ReadFile(path)
+		if err != nil {
+			// Not built into this binary (e.g. a dev build without iPXE).
+			continue
+		}
+		byName[name] = &Binary{Name: name, Size: int64(len(data)), Embedded: true}
+	}
+
+	if v := b.ActiveBundle(); v != "" {
+		entries, err := os.ReadDir(filepath.Join(b.BundleDir, v))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.Type().IsRegular() || !validName(e.Name()) || e.Name() == "LICENSE" {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			bin := byName[e.Name()]
+			if bin == nil {
+				bin = &Binary{Name: e.Name()}
+				byName[e.Name()] = bin
+			}
+			bin.Size = info.Size()
+			bin.Bundle = v
+		}
+	}
+
+	if b.Dir != "" {
+		entries, err := os.ReadDir(b.Dir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.Type().IsRegular() || !validName(e.Name()) {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			bin := byName[e.Name()]
+			if bin == nil {
+				bin = &Binary{Name: e.Name()}
+				byName[e.Name()] = bin
+			}
+			bin.Size = info.Size()
+			bin.Custom = true
+		}
+	}
+
+	list := make([]Binary, 0, len(byName))
+	for _, bin := range byName {
+		list = append(list, *bin)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// Save stores an uploaded binary, replacing any earlier upload of the same
+// name.
+func (b *Binaries) Save(name string, r io.Reader) error {
+	if !validName(name) {
+		return ErrInvalidName
+	}
+	if err := os.MkdirAll(b.Dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(b.Dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(b.Dir, name))
+}
+
+// Remove deletes an uploaded binary. An embedded binary of the same name
+// takes over again.
+func (b *Binaries) Remove(name string) error {
+	if !validName(name) {
+		return ErrInvalidName
+	}
+	err := os.Remove(filepath.Join(b.Dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,251 @@
+package tftpserver
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A bundle is a tar.gz of iPXE binaries for updating the embedded ones
+// without rebuilding duh, e.g. for an iPXE security fix on an air-gapped
+// network. It holds a VERSION file naming the build and the binaries at
+// its top level. Installed bundles are kept in BundleDir/<version>/ so an
+// update can be rolled back.
+
+// bundleVersionFile names the file in a bundle that holds its version.
+const bundleVersionFile = "VERSION"
+
+// activeBundleFile, in BundleDir, holds the version of the active bundle.
+// Its leading dot keeps it from clashing with a version.
+const activeBundleFile = ".active"
+
+// maxBundleFile caps each file unpacked from a bundle.
+const maxBundleFile = 64 << 20
+
+var bundleVersionRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]{0,63}$`)
+
+// ErrBadBundle is wrapped by the errors for bundles that aren't laid out
+// as InstallBundle expects.
+var ErrBadBundle = errors.New("invalid iPXE bundle")
+
+// Bundle is an installed bundle of iPXE binaries.
+type Bundle struct {
+	Version   string
+	Files     []string
+	Installed time.Time
+	Active    bool
+}
+
+// EmbeddedVersion returns the iPXE commit the embedded binaries were built
+// from, as recorded in their LICENSE, or "" if it isn't known.
+func EmbeddedVersion() string {
+	data, err := ipxeFS.ReadFile("ipxebin/LICENSE")
+	if err != nil {
+		return ""
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		if commit, ok := strings.CutPrefix(sc.Text(), "Commit: "); ok {
+			commit = strings.TrimSpace(commit)
+			return commit[:min(len(commit), 12)]
+		}
+	}
+	return ""
+}
+
+// ActiveBundle returns the version of the bundle served in place of the
+// embedded binaries, or "" if there is none.
+func (b *Binaries) ActiveBundle() string {
+	if b.BundleDir == "" {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(b.BundleDir, activeBundleFile))
+	if err != nil {
+		return ""
+	}
+	v := strings.TrimSpace(string(data))
+	if !bundleVersionRe.MatchString(v) {
+		return ""
+	}
+	return v
+}
+
+// bundleRead returns a binary from the active bundle, or fs.ErrNotExist.
+func (b *Binaries) bundleRead(name string) ([]byte, error) {
+	v := b.ActiveBundle()
+	if v == "" {
+		return nil, fs.ErrNotExist
+	}
+	return os.ReadFile(filepath.Join(b.BundleDir, v, name))
+}
+
+// Bundles returns the installed bundles, newest first.
+func (b *Binaries) Bundles() ([]Bundle, error) {
+	if b.BundleDir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(b.BundleDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	active := b.ActiveBundle()
+	var bundles []Bundle
+	for _, e := range entries {
+		if !e.IsDir() || !bundleVersionRe.MatchString(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(b.BundleDir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		bundle := Bundle{Version: e.Name(), Installed: info.ModTime(), Active: e.Name() == active}
+		for _, f := range files {
+			if f.Type().IsRegular() && validName(f.Name()) {
+				bundle.Files = append(bundle.Files, f.Name())
+			}
+		}
+		bundles = append(bundles, bundle)
+	}
+	sort.Slice(bundles, func(i, j int) bool { return bundles[i].Installed.After(bundles[j].Installed) })
+	return bundles, nil
+}
+
+// InstallBundle unpacks a bundle into BundleDir and returns its version.
+// It doesn't make it active. Installing a version again replaces it.
+func (b *Binaries) InstallBundle(r io.Reader) (string, error) {
+	if b.BundleDir == "" {
+		return "", errors.New("bundles are not enabled")
+	}
+	if err := os.MkdirAll(b.BundleDir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.MkdirTemp(b.BundleDir, ".install-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return "", fmt.Errorf("%w: not a tar.gz: %v", ErrBadBundle, err)
+	}
+	tr := tar.NewReader(zr)
+	var version string
+	binaries := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrBadBundle, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if hdr.Typeflag != tar.TypeReg || !validName(name) {
+			return "", fmt.Errorf("%w: %q is not a plain file at the top level", ErrBadBundle, hdr.Name)
+		}
+		if hdr.Size > maxBundleFile {
+			return "", fmt.Errorf("%w: %s is too large", ErrBadBundle, name)
+		}
+		if name == bundleVersionFile {
+			data, err := io.ReadAll(io.LimitReader(tr, 256))
+			if err != nil {
+				return "", fmt.Errorf("%w: %v", ErrBadBundle, err)
+			}
+			version = strings.TrimSpace(string(data))
+			continue
+		}
+		f, err := os.Create(filepath.Join(tmp, name))
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(f, io.LimitReader(tr, maxBundleFile))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", fmt.Errorf("unpack %s: %w", name, err)
+		}
+		if name != "LICENSE" {
+			binaries++
+		}
+	}
+	if !bundleVersionRe.MatchString(version) {
+		return "", fmt.Errorf("%w: no valid %s file", ErrBadBundle, bundleVersionFile)
+	}
+	if binaries == 0 {
+		return "", fmt.Errorf("%w: no binaries", ErrBadBundle)
+	}
+
+	dst := filepath.Join(b.BundleDir, version)
+	if err := os.RemoveAll(dst); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	os.Chtimes(dst, now, now)
+	return version, nil
+}
+
+// ActivateBundle serves an installed bundle's binaries in place of the
+// embedded ones. An empty version goes back to the embedded binaries.
+// Uploaded binaries still take precedence either way.
+func (b *Binaries) ActivateBundle(version string) error {
+	if b.BundleDir == "" {
+		return errors.New("bundles are not enabled")
+	}
+	p := filepath.Join(b.BundleDir, activeBundleFile)
+	if version == "" {
+		err := os.Remove(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if !bundleVersionRe.MatchString(version) {
+		return ErrInvalidName
+	}
+	if info, err := os.Stat(filepath.Join(b.BundleDir, version)); err != nil || !info.IsDir() {
+		return fmt.Errorf("bundle %s is not installed", version)
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, []byte(version+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// RemoveBundle deletes an installed bundle that isn't active.
+func (b *Binaries) RemoveBundle(version string) error {
+	if !bundleVersionRe.MatchString(version) {
+		return ErrInvalidName
+	}
+	if version == b.ActiveBundle() {
+		return errors.New("the active bundle can't be removed")
+	}
+	return os.RemoveAll(filepath.Join(b.BundleDir, version))
+}
@@ -0,0 +1,207 @@
+package tftpserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pin/tftp/v3"
+)
+
+// Inbox accepts TFTP uploads from known systems, such as crash logs pushed
+// by firmware or an installer. Each system's files land in Dir/<mac>/; the
+// client chooses only the file name, never the directory.
+type Inbox struct {
+	Dir      string
+	MaxFile  int64 // largest single upload
+	MaxTotal int64 // most a single system may store
+
+	// ClientMAC maps a client address to the MAC of the system it belongs
+	// to, or "" if the client isn't known. Unknown clients can't upload.
+	ClientMAC func(ip net.IP) string
+
+	// Room, if set, returns how much more the whole inbox may take, or a
+	// negative number for no limit.
+	Room func() int64
+
+	stats *Stats // set by NewServer
+}
+
+// InboxFile is one uploaded file.
+type InboxFile struct {
+	MAC     string
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+var errTooLarge = errors.New("upload exceeds size limit")
+
+func (in *Inbox) writeHandler(filename string, wt io.WriterTo) error {
+	it := wt.(tftp.IncomingTransfer)
+	addr := it.RemoteAddr()
+	name := strings.TrimLeft(filename, "/")
+	if !validName(name) {
+		log.Printf("tftp: rejected upload %q from %s: invalid name", filename, addr.IP)
+		return fmt.Errorf("access violation: %s", filename)
+	}
+	mac := in.ClientMAC(addr.IP)
+	if mac == "" {
+		log.Printf("tftp: rejected upload %s from unknown client %s", name, addr.IP)
+		return fmt.Errorf("access violation: %s", filename)
+	}
+
+	dir := filepath.Join(in.Dir, mac)
+	used, err := dirSize(dir, name)
+	if err != nil {
+		return err
+	}
+	limit := in.MaxFile
+	if room := in.MaxTotal - used; room < limit {
+		limit = room
+	}
+	if in.Room != nil {
+		if room := in.Room(); room >= 0 && room < limit {
+			limit = room
+		}
+	}
+	if size, ok := it.Size(); ok {
+		if size > limit {
+			log.Printf("tftp: rejected upload %s from %s: %d bytes exceeds limit", name, mac, size)
+			return errTooLarge
+		}
+		if in.stats != nil {
+			in.stats.noteSize(filename, size)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := wt.WriteTo(&limitWriter{w: tmp, n: limit})
+	if err != nil {
+		tmp.Close()
+		log.Printf("tftp: upload %s from %s failed: %v", name, mac, err)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	log.Printf("tftp: received %s from %s (%d bytes)", name, mac, n)
+	return nil
+}
+
+// dirSize totals the files in dir, except skip, which an upload of the same
+// name would replace.
+func dirSize(dir, skip string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, e := range entries {
+		if e.Name() == skip || !e.Type().IsRegular() {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			total += info.Size()
+		}
+	}
+	return total, nil
+}
+
+// limitWriter fails once more than n bytes have been written.
+type limitWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, errTooLarge
+	}
+	n, err := l.w.Write(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// List returns every uploaded file, newest first.
+func (in *Inbox) List() ([]InboxFile, error) {
+	dirs, err := os.ReadDir(in.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []InboxFile
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(in.Dir, d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.Type().IsRegular() || !validName(e.Name()) {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			files = append(files, InboxFile{MAC: d.Name(), Name: e.Name(), Size: info.Size(), ModTime: info.ModTime()})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime.After(files[j].ModTime) })
+	return files, nil
+}
+
+func (in *Inbox) path(mac, name string) (string, error) {
+	if !validName(mac) || !validName(name) {
+		return "", ErrInvalidName
+	}
+	return filepath.Join(in.Dir, mac, name), nil
+}
+
+// Open opens an uploaded file for reading.
+func (in *Inbox) Open(mac, name string) (*os.File, error) {
+	p, err := in.path(mac, name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// Remove deletes an uploaded file.
+func (in *Inbox) Remove(mac, name string) error {
+	p, err := in.path(mac, name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,119 @@
+package tftpserver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pin/tftp/v3"
+)
+
+// recentTransfers is how many transfers Stats keeps for the diagnostics page.
+const recentTransfers = 100
+
+// Transfer is one completed or failed TFTP read.
+type Transfer struct {
+	Time        time.Time
+	Client      string
+	File        string
+	Bytes       int64
+	Duration    time.Duration
+	BlockSize   string // as negotiated; empty means the 512-byte default
+	Retransmits int    // datagrams sent but never acknowledged
+	Error       string
+}
+
+// Stats records TFTP transfers. It is installed as the server's hook.
+type Stats struct {
+	mu          sync.Mutex
+	recent      []Transfer // ring buffer, next points at the oldest entry
+	next        int
+	sizes       map[string]int64
+	succeeded   uint64
+	failed      uint64
+	bytes       uint64
+	retransmits uint64
+	seconds     float64 // total transfer time
+}
+
+func NewStats() *Stats {
+	return &Stats{sizes: make(map[string]int64)}
+}
+
+// noteSize remembers a file's size, since the hook only gets its name.
+func (st *Stats) noteSize(name string, size int64) {
+	st.mu.Lock()
+	st.sizes[name] = size
+	st.mu.Unlock()
+}
+
+func (st *Stats) OnSuccess(ts tftp.TransferStats) {
+	st.record(ts, nil)
+}
+
+func (st *Stats) OnFailure(ts tftp.TransferStats, err error) {
+	st.record(ts, err)
+}
+
+func (st *Stats) record(ts tftp.TransferStats, err error) {
+	retransmits := ts.DatagramsSent - ts.DatagramsAcked
+	if retransmits < 0 {
+		retransmits = 0
+	}
+	t := Transfer{
+		Time:        time.Now(),
+		File:        ts.Filename,
+		Duration:    ts.Duration,
+		BlockSize:   ts.Opts["blksize"],
+		Retransmits: retransmits,
+	}
+	if ts.RemoteAddr != nil {
+		t.Client = ts.RemoteAddr.String()
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err != nil {
+		t.Error = err.Error()
+		st.failed++
+	} else {
+		t.Bytes = st.sizes[ts.Filename]
+		st.succeeded++
+		st.bytes += uint64(t.Bytes)
+	}
+	st.retransmits += uint64(retransmits)
+	st.seconds += ts.Duration.Seconds()
+
+	if len(st.recent) < recentTransfers {
+		st.recent = append(st.recent, t)
+	} else {
+		st.recent[st.next] = t
+		st.next = (st.next + 1) % recentTransfers
+	}
+}
+
+// Snapshot is a consistent copy of Stats.
+type Snapshot struct {
+	Succeeded   uint64
+	Failed      uint64
+	Bytes       uint64
+	Retransmits uint64
+	Seconds     float64
+	Recent      []Transfer // newest first
+}
+
+func (st *Stats) Snapshot() Snapshot {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	snap := Snapshot{
+		Succeeded:   st.succeeded,
+		Failed:      st.failed,
+		Bytes:       st.bytes,
+		Retransmits: st.retransmits,
+		Seconds:     st.seconds,
+		Recent:      make([]Transfer, 0, len(st.recent)),
+	}
+	for i := len(st.recent) - 1; i >= 0; i-- {
+		snap.Recent = append(snap.Recent, st.recent[(st.next+i)%len(st.recent)])
+	}
+	return snap
+}
@@ -15,24 +15,21 @@ var ipxeFS embed.FS
 
 var files = map[string]string{
 	"undionly.kpxe":  "ipxebin/undionly.kpxe",
-	"ipxe.efi":      "ipxebin/ipxe.efi",
+	"ipxe.efi":       "ipxebin/ipxe.efi",
 	"ipxe-arm64.efi": "ipxebin/ipxe-arm64.efi",
 }
 
-func readHandler(filename string, rf io.ReaderFrom) error {
-	path, ok := files[filename]
-	if !ok {
-		log.Printf("tftp: file not found: %s", filename)
-		return fmt.Errorf("file not found: %s", filename)
-	}
-
-	data, err := ipxeFS.ReadFile(path)
+func (b *Binaries) readHandler(filename string, rf io.ReaderFrom) error {
+	data, err := b.Read(filename)
 	if err != nil {
-		log.Printf("tftp: error reading embedded file %s: %v", path, err)
-		return fmt.Errorf("read embedded file: %w", err)
+		log.Printf("tftp: %s: %v", filename, err)
+		return fmt.Errorf("file not found: %s", filename)
 	}
 
 	rf.(tftp.OutgoingTransfer).SetSize(int64(len(data)))
+	if b.stats != nil {
+		b.stats.noteSize(filename, int64(len(data)))
+	}
 
 	n, err := rf.ReadFrom(newBytesReader(data))
 	if err != nil {
@@ -43,18 +40,57 @@ func readHandler(filename string, rf io.ReaderFrom) error {
 	return nil
 }
 
-func GetIPXEBinary(name string) ([]byte, error) {
-	path, ok := files[name]
-	if !ok {
-		return nil, fmt.Errorf("unknown iPXE binary: %s", name)
+// Options tunes the TFTP server. Zero values keep the defaults.
+type Options struct {
+	BlockSize  int           // largest blksize a client may negotiate (512-65456)
+	WindowSize int           // blocks sent before waiting for an ACK; >1 enables it
+	Timeout    time.Duration // per-packet retransmit timeout
+	Retries    int           // retransmits before a transfer is abandoned
+}
+
+// DefaultOptions are used for any Options field left at zero.
+var DefaultOptions = Options{
+	BlockSize:  1468, // fills an Ethernet frame
+	WindowSize: 1,
+	Timeout:    5 * time.Second,
+	Retries:    3,
+}
+
+// WithDefaults returns o with zero fields filled from DefaultOptions.
+func (o Options) WithDefaults() Options {
+	if o.BlockSize == 0 {
+		o.BlockSize = DefaultOptions.BlockSize
+	}
+	if o.WindowSize == 0 {
+		o.WindowSize = DefaultOptions.WindowSize
+	}
+	if o.Timeout == 0 {
+		o.Timeout = DefaultOptions.Timeout
 	}
-	return ipxeFS.ReadFile(path)
+	if o.Retries == 0 {
+		o.Retries = DefaultOptions.Retries
+	}
+	return o
 }
 
-func NewServer(addr string) *tftp.Server {
-	s := tftp.NewServer(readHandler, nil)
-	s.SetTimeout(5 * time.Second)
-	s.SetRetries(3)
+// NewServer returns a TFTP server for bins. Uploads are refused unless inbox
+// is non-nil. If stats is non-nil every transfer is recorded in it.
+func NewServer(addr string, bins *Binaries, inbox *Inbox, stats *Stats, opts Options) *tftp.Server {
+	opts = opts.WithDefaults()
+	bins.stats = stats
+	var write func(string, io.WriterTo) error
+	if inbox != nil {
+		inbox.stats = stats
+		write = inbox.writeHandler
+	}
+	s := tftp.NewServer(bins.readHandler, write)
+	s.SetTimeout(opts.Timeout)
+	s.SetRetries(opts.Retries)
+	s.SetBlockSize(opts.BlockSize)
+	s.SetAnticipate(uint(opts.WindowSize))
+	if stats != nil {
+		s.SetHook(stats)
+	}
 	return s
 }
 
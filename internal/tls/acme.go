@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/caddyserver/certmagic"
@@ -14,15 +15,17 @@ import (
 
 // ACMEConfig holds configuration for ACME certificate management.
 type ACMEConfig struct {
-	Domain  string
+	Domains []string // may include wildcards such as *.example.com
 	Email   string
 	Staging bool
 	DataDir string
 }
 
 // NewACMETLS configures CertMagic with Route53 DNS-01 and obtains/renews
-// a certificate for the configured domain. Returns a tls.Config with
-// GetCertificate wired up to CertMagic.
+// a certificate for each configured domain. Wildcard domains work because
+// DNS-01 is the only challenge used. Returns a tls.Config with
+// GetCertificate wired up to CertMagic, which picks the certificate
+// matching each connection's server name.
 //
 // AWS credentials are loaded from the standard environment variables
 // (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_REGION) or IAM role.
@@ -57,16 +60,28 @@ func NewACMETLS(ctx context.Context, cfg ACMEConfig) (*tls.Config, error) {
 	})
 	magic.Issuers = []certmagic.Issuer{issuer}
 
-	log.Printf("tls: obtaining ACME certificate for %s (staging=%v)", cfg.Domain, cfg.Staging)
+	domains := strings.Join(cfg.Domains, ", ")
+	log.Printf("tls: obtaining ACME certificates for %s (staging=%v)", domains, cfg.Staging)
 
-	if err := magic.ManageSync(ctx, []string{cfg.Domain}); err != nil {
+	if err := magic.ManageSync(ctx, cfg.Domains); err != nil {
 		return nil, fmt.Errorf("certmagic manage: %w", err)
 	}
 
-	log.Printf("tls: ACME certificate ready for %s", cfg.Domain)
+	log.Printf("tls: ACME certificates ready for %s", domains)
 
 	tlsCfg := magic.TLSConfig()
 	tlsCfg.NextProtos = []string{"h2", "http/1.1"}
 	tlsCfg.MinVersion = tls.VersionTLS12
 	return tlsCfg, nil
 }
+
+// DomainCovers reports whether a certificate for domain, which may be a
+// wildcard, is valid for host. A wildcard covers exactly one label.
+func DomainCovers(domain, host string) bool {
+	domain, host = strings.ToLower(domain), strings.ToLower(host)
+	if base, ok := strings.CutPrefix(domain, "*."); ok {
+		label, rest, found := strings.Cut(host, ".")
+		return found && label != "" && rest == base
+	}
+	return domain == host
+}
@@ -3,47 +3,58 @@ package tls
 import (
 	"context"
 	"crypto/tls"
-	"fmt"
 	"log"
 )
 
 // Options holds all TLS-related configuration.
 type Options struct {
-	DataDir    string
-	CertFile   string
-	KeyFile    string
-	ACMEDomain string
-	ACMEEmail  string
+	DataDir     string
+	CertFile    string
+	KeyFile     string
+	ACMEDomains []string
+	ACMEEmail   string
 	ACMEStaging bool
+
+	// SelfSigned applies when neither ACME nor a keypair is configured.
+	SelfSigned SelfSignedOptions
 }
 
 // ProvideTLS returns a *tls.Config based on the following decision tree:
-//  1. ACME domain set → obtain cert via CertMagic with Route53 DNS-01
-//  2. Cert + key files provided → load user-supplied keypair
-//  3. Otherwise → self-signed with auto-discovered SANs
-func ProvideTLS(ctx context.Context, opts Options) (*tls.Config, error) {
-	if opts.ACMEDomain != "" {
+//  1. ACME domains set → obtain certs via CertMagic with Route53 DNS-01
+//  2. Cert + key files provided → load user-supplied keypair, reloading
+//     it when the files change
+//  3. Otherwise → self-signed with auto-discovered or pinned SANs
+//
+// The *SelfSigned is non-nil only in the last case, so the caller can
+// regenerate the certificate on request.
+func ProvideTLS(ctx context.Context, opts Options) (*tls.Config, *SelfSigned, error) {
+	if len(opts.ACMEDomains) > 0 {
 		log.Print("tls: using ACME/CertMagic provider")
-		return NewACMETLS(ctx, ACMEConfig{
-			Domain:  opts.ACMEDomain,
+		cfg, err := NewACMETLS(ctx, ACMEConfig{
+			Domains: opts.ACMEDomains,
 			Email:   opts.ACMEEmail,
 			Staging: opts.ACMEStaging,
 			DataDir: opts.DataDir,
 		})
+		return cfg, nil, err
 	}
 
 	if opts.CertFile != "" && opts.KeyFile != "" {
 		log.Print("tls: using user-provided certificate")
-		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		r, err := newKeypairReloader(ctx, opts.CertFile, opts.KeyFile)
 		if err != nil {
-			return nil, fmt.Errorf("load TLS keypair: %w", err)
+			return nil, nil, err
 		}
 		return &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			MinVersion:   tls.VersionTLS12,
-		}, nil
+			GetCertificate: r.getCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}, nil, nil
 	}
 
 	log.Print("tls: using self-signed certificate")
-	return LoadOrGenerateSelfSigned(opts.DataDir)
+	ss, err := LoadOrGenerateSelfSigned(opts.DataDir, opts.SelfSigned)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ss.TLSConfig(), ss, nil
 }
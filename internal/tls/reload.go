@@ -0,0 +1,102 @@
+package tls
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// reloadInterval is how often a user-provided keypair is checked for
+// changes.
+const reloadInterval = 30 * time.Second
+
+// keypairReloader serves a certificate loaded from files, reloading it
+// when either file changes so a renewed certificate is picked up without
+// a restart.
+type keypairReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newKeypairReloader(ctx context.Context, certFile, keyFile string) (*keypairReloader, error) {
+	r := &keypairReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	go r.watch(ctx)
+	return r, nil
+}
+
+// changedAt returns the later of the two files' modification times.
+func (r *keypairReloader) changedAt() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *keypairReloader) load() error {
+	modTime, err := r.changedAt()
+	if err != nil {
+		return fmt.Errorf("stat TLS keypair: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load TLS keypair: %w", err)
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *keypairReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		modTime, err := r.changedAt()
+		if err != nil {
+			log.Printf("tls: %v", err)
+			continue
+		}
+		r.mu.RLock()
+		unchanged := modTime.Equal(r.modTime)
+		r.mu.RUnlock()
+		if unchanged {
+			continue
+		}
+		// A half-written pair fails to load; the old certificate stays
+		// in use and the next tick tries again.
+		if err := r.load(); err != nil {
+			log.Printf("tls: reload %s: %v", r.certFile, err)
+			continue
+		}
+		log.Printf("tls: reloaded certificate from %s", r.certFile)
+	}
+}
+
+func (r *keypairReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
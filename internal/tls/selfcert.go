@@ -18,6 +18,7 @@ import (
 	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -133,10 +134,62 @@ func sansMatch(cert *x509.Certificate, wantDNS []string, wantIPs []net.IP) bool
 	return slices.Equal(haveIPs, wantIPStrs)
 }
 
+// pinnedSANs splits explicit SANs into DNS names and IPs, in the same
+// order discoverSANs uses.
+func pinnedSANs(sans []string) (dnsNames []string, ips []net.IP) {
+	for _, san := range sans {
+		san = strings.TrimSpace(san)
+		if san == "" {
+			continue
+		}
+		if ip := net.ParseIP(san); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			dnsNames = append(dnsNames, strings.ToLower(san))
+		}
+	}
+	sort.Strings(dnsNames)
+	sort.Slice(ips, func(i, j int) bool {
+		return ips[i].String() < ips[j].String()
+	})
+	return dnsNames, ips
+}
+
+// SelfSignedOptions controls the names on a self-signed certificate and
+// when it is replaced.
+type SelfSignedOptions struct {
+	// SANs pins the certificate's DNS names and IP addresses. When empty
+	// they are discovered from the hostname and interfaces.
+	SANs []string
+
+	// NoRegen keeps an existing certificate even when the wanted SANs
+	// change or it nears expiry, so clients that pinned it keep trusting
+	// it. Regenerate still replaces it.
+	NoRegen bool
+}
+
+// SelfSigned serves a self-signed certificate kept in the data directory.
+type SelfSigned struct {
+	certPath string
+	keyPath  string
+	opts     SelfSignedOptions
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func (s *SelfSigned) wantSANs() ([]string, []net.IP) {
+	if len(s.opts.SANs) > 0 {
+		return pinnedSANs(s.opts.SANs)
+	}
+	return discoverSANs()
+}
+
 // loadAndCheckSelfSigned loads an existing self-signed cert and checks whether
-// it is still valid (not expired, SANs match). Returns the tls.Config if valid,
-// or nil if the cert should be regenerated.
-func loadAndCheckSelfSigned(certPath, keyPath string, wantDNS []string, wantIPs []net.IP) *tls.Config {
+// it is still valid (not expired, SANs match). Returns the certificate if valid,
+// or nil if the cert should be regenerated. With noRegen set, only a missing or
+// unreadable cert is regenerated.
+func loadAndCheckSelfSigned(certPath, keyPath string, wantDNS []string, wantIPs []net.IP, noRegen bool) *tls.Certificate {
 	certPEM, err := os.ReadFile(certPath)
 	if err != nil {
 		return nil
@@ -152,13 +205,16 @@ func loadAndCheckSelfSigned(certPath, keyPath string, wantDNS []string, wantIPs
 		return nil
 	}
 
+	switch {
+	case noRegen:
+		if !sansMatch(x509Cert, wantDNS, wantIPs) {
+			log.Print("tls: SANs changed, keeping self-signed cert since regeneration is disabled")
+		}
 	// Check expiry (regenerate if less than 30 days remaining)
-	if time.Until(x509Cert.NotAfter) < 30*24*time.Hour {
+	case time.Until(x509Cert.NotAfter) < 30*24*time.Hour:
 		log.Print("tls: self-signed cert expiring soon, regenerating")
 		return nil
-	}
-
-	if !sansMatch(x509Cert, wantDNS, wantIPs) {
+	case !sansMatch(x509Cert, wantDNS, wantIPs):
 		log.Print("tls: SANs changed, regenerating self-signed cert")
 		return nil
 	}
@@ -167,35 +223,73 @@ func loadAndCheckSelfSigned(certPath, keyPath string, wantDNS []string, wantIPs
 	if err != nil {
 		return nil
 	}
-
-	return &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-		MinVersion:   tls.VersionTLS12,
-	}
+	return &tlsCert
 }
 
-// LoadOrGenerateSelfSigned returns a TLS config using a self-signed certificate
-// with SANs covering all local interfaces, the hostname, and localhost.
-// If an existing cert at the standard path is still valid and has matching SANs,
-// it is reused.
-func LoadOrGenerateSelfSigned(dataDir string) (*tls.Config, error) {
-	certPath := filepath.Join(dataDir, "tls", "cert.pem")
-	keyPath := filepath.Join(dataDir, "tls", "key.pem")
-
-	dnsNames, ipAddrs := discoverSANs()
+// LoadOrGenerateSelfSigned returns a self-signed certificate with SANs
+// covering all local interfaces, the hostname, and localhost, or the pinned
+// ones in opts. If an existing cert at the standard path is still valid and
+// has matching SANs, it is reused.
+func LoadOrGenerateSelfSigned(dataDir string, opts SelfSignedOptions) (*SelfSigned, error) {
+	s := &SelfSigned{
+		certPath: filepath.Join(dataDir, "tls", "cert.pem"),
+		keyPath:  filepath.Join(dataDir, "tls", "key.pem"),
+		opts:     opts,
+	}
 
-	log.Printf("tls: discovered SANs — DNS: %v, IPs: %v", dnsNames, ipAddrs)
+	dnsNames, ipAddrs := s.wantSANs()
+	if len(opts.SANs) > 0 {
+		log.Printf("tls: pinned SANs — DNS: %v, IPs: %v", dnsNames, ipAddrs)
+	} else {
+		log.Printf("tls: discovered SANs — DNS: %v, IPs: %v", dnsNames, ipAddrs)
+	}
 
-	if cfg := loadAndCheckSelfSigned(certPath, keyPath, dnsNames, ipAddrs); cfg != nil {
+	if cert := loadAndCheckSelfSigned(s.certPath, s.keyPath, dnsNames, ipAddrs, opts.NoRegen); cert != nil {
 		log.Print("tls: reusing existing self-signed cert")
-		return cfg, nil
+		s.cert = cert
+		return s, nil
 	}
 
 	log.Print("tls: generating new self-signed cert")
-	return generateSelfSigned(certPath, keyPath, dnsNames, ipAddrs)
+	cert, err := generateSelfSigned(s.certPath, s.keyPath, dnsNames, ipAddrs)
+	if err != nil {
+		return nil, err
+	}
+	s.cert = cert
+	return s, nil
 }
 
-func generateSelfSigned(certPath, keyPath string, dnsNames []string, ipAddrs []net.IP) (*tls.Config, error) {
+// Regenerate replaces the certificate with a new one for the wanted SANs,
+// whether or not the current one still matches them. Connections made
+// afterwards get the new certificate.
+func (s *SelfSigned) Regenerate() error {
+	dnsNames, ipAddrs := s.wantSANs()
+	log.Printf("tls: regenerating self-signed cert — DNS: %v, IPs: %v", dnsNames, ipAddrs)
+	cert, err := generateSelfSigned(s.certPath, s.keyPath, dnsNames, ipAddrs)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.cert = cert
+	s.mu.Unlock()
+	return nil
+}
+
+// TLSConfig returns a config serving the current certificate.
+func (s *SelfSigned) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+func (s *SelfSigned) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, nil
+}
+
+func generateSelfSigned(certPath, keyPath string, dnsNames []string, ipAddrs []net.IP) (*tls.Certificate, error) {
 	if err := os.MkdirAll(filepath.Dir(certPath), 0755); err != nil {
 		return nil, fmt.Errorf("create TLS dir: %w", err)
 	}
@@ -241,9 +335,5 @@ func generateSelfSigned(certPath, keyPath string, dnsNames []string, ipAddrs []n
 	if err != nil {
 		return nil, fmt.Errorf("parse generated keypair: %w", err)
 	}
-
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12,
-	}, nil
+	return &cert, nil
 }
@@ -0,0 +1,137 @@
+// Package torrent builds BitTorrent metafiles for image files and runs a
+// small private tracker, so machines installing the same image can share
+// its pieces instead of each pulling every byte from duh. duh itself is
+// listed as a web seed (BEP 19), so a swarm always has a full source.
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// Info is the info dictionary of a single-file torrent.
+type Info struct {
+	Name        string
+	Length      int64
+	PieceLength int64
+	Pieces      []byte // SHA-1 of each piece, concatenated
+}
+
+// pieceLength picks a power of two giving roughly 1500 pieces, between
+// 256 KiB and 16 MiB.
+func pieceLength(size int64) int64 {
+	n := int64(256 << 10)
+	for n < 16<<20 && size/n > 1500 {
+		n *= 2
+	}
+	return n
+}
+
+// HashFile reads the file at path and hashes its pieces.
+func HashFile(path, name string) (*Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	info := &Info{Name: name, Length: st.Size(), PieceLength: pieceLength(st.Size())}
+	buf := make([]byte, info.PieceLength)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			sum := sha1.Sum(buf[:n])
+			info.Pieces = append(info.Pieces, sum[:]...)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("hash %s: %w", name, err)
+		}
+	}
+	return info, nil
+}
+
+func (i *Info) dict() map[string]any {
+	return map[string]any{
+		"name":         i.Name,
+		"length":       i.Length,
+		"piece length": i.PieceLength,
+		"pieces":       i.Pieces,
+		"private":      1,
+	}
+}
+
+// Hash is the torrent's info hash.
+func (i *Info) Hash() [20]byte {
+	return sha1.Sum(Encode(i.dict()))
+}
+
+// Metafile is the .torrent for info, announcing to announce and listing
+// webSeeds as HTTP sources of the whole file.
+func Metafile(info *Info, announce string, webSeeds []string) []byte {
+	m := map[string]any{
+		"announce":   announce,
+		"created by": "duh",
+		"info":       info.dict(),
+	}
+	if len(webSeeds) > 0 {
+		seeds := make([]any, len(webSeeds))
+		for i, s := range webSeeds {
+			seeds[i] = s
+		}
+		m["url-list"] = seeds
+	}
+	return Encode(m)
+}
+
+// Encode bencodes strings, byte slices, integers, lists and dictionaries
+// with string keys.
+func Encode(v any) []byte {
+	var b bytes.Buffer
+	encode(&b, v)
+	return b.Bytes()
+}
+
+func encode(b *bytes.Buffer, v any) {
+	switch v := v.(type) {
+	case string:
+		b.WriteString(strconv.Itoa(len(v)) + ":" + v)
+	case []byte:
+		b.WriteString(strconv.Itoa(len(v)) + ":")
+		b.Write(v)
+	case int:
+		b.WriteString("i" + strconv.Itoa(v) + "e")
+	case int64:
+		b.WriteString("i" + strconv.FormatInt(v, 10) + "e")
+	case []any:
+		b.WriteByte('l')
+		for _, e := range v {
+			encode(b, e)
+		}
+		b.WriteByte('e')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		b.WriteByte('d')
+		for _, k := range keys {
+			encode(b, k)
+			encode(b, v[k])
+		}
+		b.WriteByte('e')
+	default:
+		panic(fmt.Sprintf("torrent: can't bencode %T", v))
+	}
+}
@@ -0,0 +1,140 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// announceInterval is how often clients are asked to announce again.
+const announceInterval = 60 * time.Second
+
+type peer struct {
+	ip       net.IP
+	port     int
+	seeding  bool
+	lastSeen time.Time
+}
+
+// Tracker is an HTTP tracker for the torrents duh hands out. It answers
+// only for info hashes it was told about, so it can't be used as a public
+// tracker.
+type Tracker struct {
+	mu     sync.Mutex
+	swarms map[[20]byte]map[string]*peer // keyed by peer ID
+}
+
+// Allow lets clients announce for a torrent.
+func (t *Tracker) Allow(hash [20]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.swarms == nil {
+		t.swarms = make(map[[20]byte]map[string]*peer)
+	}
+	if t.swarms[hash] == nil {
+		t.swarms[hash] = make(map[string]*peer)
+	}
+}
+
+// Stats reports the peers in a torrent's swarm.
+func (t *Tracker) Stats(hash [20]byte) (seeders, leechers int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range t.swarms[hash] {
+		if p.seeding {
+			seeders++
+		} else {
+			leechers++
+		}
+	}
+	return seeders, leechers
+}
+
+func failure(w http.ResponseWriter, reason string) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(Encode(map[string]any{"failure reason": reason}))
+}
+
+// ServeHTTP handles announce requests, replying with peers in the compact
+// format (BEP 23). The peer's address is taken from the connection.
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var hash [20]byte
+	if len(q.Get("info_hash")) != len(hash) {
+		failure(w, "invalid info_hash")
+		return
+	}
+	copy(hash[:], q.Get("info_hash"))
+	peerID := q.Get("peer_id")
+	port, err := strconv.Atoi(q.Get("port"))
+	if peerID == "" || err != nil || port <= 0 || port > 65535 {
+		failure(w, "invalid peer")
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		failure(w, "invalid peer address")
+		return
+	}
+	numWant := 50
+	if n, err := strconv.Atoi(q.Get("numwant")); err == nil && n >= 0 && n < numWant {
+		numWant = n
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	swarm, ok := t.swarms[hash]
+	if !ok {
+		t.mu.Unlock()
+		failure(w, "unknown torrent")
+		return
+	}
+	for id, p := range swarm {
+		if now.Sub(p.lastSeen) > 3*announceInterval {
+			delete(swarm, id)
+		}
+	}
+	if q.Get("event") == "stopped" {
+		delete(swarm, peerID)
+	} else {
+		swarm[peerID] = &peer{ip: ip, port: port, seeding: q.Get("left") == "0", lastSeen: now}
+	}
+	var peers4, peers6 []byte
+	complete, incomplete := 0, 0
+	for id, p := range swarm {
+		if p.seeding {
+			complete++
+		} else {
+			incomplete++
+		}
+		if id == peerID || numWant == 0 {
+			continue
+		}
+		if ip4 := p.ip.To4(); ip4 != nil {
+			peers4 = binary.BigEndian.AppendUint16(append(peers4, ip4...), uint16(p.port))
+		} else {
+			peers6 = binary.BigEndian.AppendUint16(append(peers6, p.ip.To16()...), uint16(p.port))
+		}
+		numWant--
+	}
+	t.mu.Unlock()
+
+	resp := map[string]any{
+		"interval":   int(announceInterval.Seconds()),
+		"complete":   complete,
+		"incomplete": incomplete,
+		"peers":      peers4,
+	}
+	if len(peers6) > 0 {
+		resp["peers6"] = peers6
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(Encode(resp))
+}
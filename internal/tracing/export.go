@@ -0,0 +1,375 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// exporter batches finished spans and posts them to the collector.
+type exporter struct {
+	endpoint  string
+	headers   map[string]string
+	resource  map[string]any
+	client    *http.Client
+	sampler   string
+	ratio     float64
+	delay     time.Duration
+	batchSize int
+
+	mu      sync.RWMutex // guards closing ch against sends
+	closed  bool
+	ch      chan *Span
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+// Setup starts exporting spans if the environment configures an OTLP
+// endpoint, following the OpenTelemetry SDK variables:
+//
+//	OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+//	OTEL_EXPORTER_OTLP_HEADERS, OTEL_EXPORTER_OTLP_TRACES_HEADERS
+//	OTEL_EXPORTER_OTLP_TIMEOUT, OTEL_EXPORTER_OTLP_TRACES_TIMEOUT
+//	OTEL_SERVICE_NAME, OTEL_RESOURCE_ATTRIBUTES
+//	OTEL_TRACES_SAMPLER, OTEL_TRACES_SAMPLER_ARG
+//	OTEL_BSP_SCHEDULE_DELAY, OTEL_BSP_MAX_QUEUE_SIZE, OTEL_BSP_MAX_EXPORT_BATCH_SIZE
+//	OTEL_SDK_DISABLED, OTEL_TRACES_EXPORTER
+//
+// Only the http/json protocol is spoken. The returned function flushes
+// queued spans and stops the exporter; it is safe to call when tracing is
+// off.
+func Setup(serviceVersion string) (func(), error) {
+	noop := func() {}
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return noop, nil
+	}
+	if exp := os.Getenv("OTEL_TRACES_EXPORTER"); exp != "" && exp != "otlp" {
+		if exp != "none" {
+			log.Printf("tracing: exporter %q is not supported, only otlp; tracing is off", exp)
+		}
+		return noop, nil
+	}
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return noop, nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("OTLP endpoint %q must be an http or https URL", endpoint)
+	}
+	proto := firstEnv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "OTEL_EXPORTER_OTLP_PROTOCOL")
+	if proto != "" && proto != "http/json" {
+		log.Printf("tracing: OTLP protocol %q is not supported; sending http/json to %s", proto, endpoint)
+	}
+
+	e := &exporter{
+		endpoint: endpoint,
+		headers:  map[string]string{},
+		resource: map[string]any{},
+		sampler:  "parentbased_always_on",
+		ratio:    1,
+	}
+	if err := parsePairs(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), e.headers); err != nil {
+		return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS: %w", err)
+	}
+	if err := parsePairs(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS"), e.headers); err != nil {
+		return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_TRACES_HEADERS: %w", err)
+	}
+	attrs := map[string]string{}
+	if err := parsePairs(os.Getenv("OTEL_RESOURCE_ATTRIBUTES"), attrs); err != nil {
+		return nil, fmt.Errorf("OTEL_RESOURCE_ATTRIBUTES: %w", err)
+	}
+	for k, v := range attrs {
+		e.resource[k] = v
+	}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		e.resource["service.name"] = name
+	} else if e.resource["service.name"] == nil {
+		e.resource["service.name"] = "duh"
+	}
+	if serviceVersion != "" {
+		e.resource["service.version"] = serviceVersion
+	}
+
+	timeout, err := envMillis(10*time.Second, "OTEL_EXPORTER_OTLP_TRACES_TIMEOUT", "OTEL_EXPORTER_OTLP_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	e.client = &http.Client{Timeout: timeout}
+	if e.delay, err = envMillis(5*time.Second, "OTEL_BSP_SCHEDULE_DELAY"); err != nil {
+		return nil, err
+	}
+	queueSize, err := envInt(2048, "OTEL_BSP_MAX_QUEUE_SIZE")
+	if err != nil {
+		return nil, err
+	}
+	if e.batchSize, err = envInt(512, "OTEL_BSP_MAX_EXPORT_BATCH_SIZE"); err != nil {
+		return nil, err
+	}
+
+	if s := os.Getenv("OTEL_TRACES_SAMPLER"); s != "" {
+		e.sampler = s
+	}
+	switch e.sampler {
+	case "always_on", "always_off", "parentbased_always_on", "parentbased_always_off":
+	case "traceidratio", "parentbased_traceidratio":
+		if arg := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); arg != "" {
+			e.ratio, err = strconv.ParseFloat(arg, 64)
+			if err != nil || e.ratio < 0 || e.ratio > 1 {
+				return nil, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG must be a number from 0 to 1, got %q", arg)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("OTEL_TRACES_SAMPLER %q is not supported", e.sampler)
+	}
+
+	e.ch = make(chan *Span, queueSize)
+	e.done = make(chan struct{})
+	go e.worker()
+	active = e
+	log.Printf("tracing: exporting spans to %s", endpoint)
+	return e.shutdown, nil
+}
+
+// sample decides whether a new trace, or a trace continued from a remote
+// caller, is recorded.
+func (e *exporter) sample(traceID [16]byte, remote, parentSampled bool) bool {
+	sampler := e.sampler
+	if p, ok := strings.CutPrefix(sampler, "parentbased_"); ok {
+		if remote {
+			return parentSampled
+		}
+		sampler = p
+	}
+	switch sampler {
+	case "always_on":
+		return true
+	case "always_off":
+		return false
+	}
+	// traceidratio: compare the low 63 bits of the trace ID to the ratio,
+	// as the OpenTelemetry SDKs do, so every service samples alike.
+	bound := uint64(e.ratio * math.Exp2(63))
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < bound
+}
+
+func (e *exporter) enqueue(s *Span) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.ch <- s:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+func (e *exporter) worker() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.delay)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s, ok := <-e.ch:
+			if !ok {
+				e.export(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= e.batchSize {
+				e.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.export(batch)
+			batch = nil
+		}
+	}
+}
+
+func (e *exporter) shutdown() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	close(e.ch)
+	e.mu.Unlock()
+	select {
+	case <-e.done:
+	case <-time.After(e.client.Timeout + time.Second):
+		log.Print("tracing: timed out flushing spans")
+	}
+}
+
+func (e *exporter) export(batch []*Span) {
+	if dropped := e.dropped.Swap(0); dropped > 0 {
+		log.Printf("tracing: queue full, dropped %d spans", dropped)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		log.Printf("tracing: encode spans: %v", err)
+		return
+	}
+	req, err := http.NewRequestWithContext(context.Background(), "POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("tracing: export: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		log.Printf("tracing: export %d spans: %v", len(batch), err)
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("tracing: export %d spans: status %d", len(batch), resp.StatusCode)
+	}
+}
+
+// encode builds an OTLP ExportTraceServiceRequest in its JSON mapping.
+func (e *exporter) encode(batch []*Span) map[string]any {
+	spans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		span := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        encodeAttrs(s.attrs),
+		}
+		if s.parent != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		if s.errored {
+			span["status"] = map[string]any{"code": 2, "message": s.statusMsg}
+		}
+		s.mu.Unlock()
+		spans = append(spans, span)
+	}
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": encodeAttrs(e.resource)},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "github.com/justinpopa/duh"},
+				"spans": spans,
+			}},
+		}},
+	}
+}
+
+func encodeAttrs(attrs map[string]any) []any {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]any, 0, len(keys))
+	for _, k := range keys {
+		var v map[string]any
+		switch a := attrs[k].(type) {
+		case string:
+			v = map[string]any{"stringValue": a}
+		case bool:
+			v = map[string]any{"boolValue": a}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(a)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(a, 10)}
+		case float64:
+			v = map[string]any{"doubleValue": a}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(a)}
+		}
+		out = append(out, map[string]any{"key": k, "value": v})
+	}
+	return out
+}
+
+// parsePairs reads the "key=value,key2=value2" lists OTEL variables use;
+// values are URL-encoded.
+func parsePairs(s string, into map[string]string) error {
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("%q is not key=value", pair)
+		}
+		val, err := url.PathUnescape(strings.TrimSpace(v))
+		if err != nil {
+			return err
+		}
+		into[strings.TrimSpace(k)] = val
+	}
+	return nil
+}
+
+func firstEnv(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// envMillis reads the first set variable as a count of milliseconds.
+func envMillis(def time.Duration, names ...string) (time.Duration, error) {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			ms, err := strconv.Atoi(v)
+			if err != nil || ms <= 0 {
+				return 0, fmt.Errorf("%s must be a positive number of milliseconds, got %q", n, v)
+			}
+			return time.Duration(ms) * time.Millisecond, nil
+		}
+	}
+	return def, nil
+}
+
+func envInt(def int, name string) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number, got %q", name, v)
+	}
+	return n, nil
+}
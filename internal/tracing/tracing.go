@@ -0,0 +1,202 @@
+// Package tracing records spans and exports them to an OpenTelemetry
+// collector over OTLP/HTTP with JSON encoding. It is configured by the
+// standard OTEL_* environment variables and does nothing unless an OTLP
+// endpoint is set, so untraced code paths cost a nil check.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, as numbered by OTLP.
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// Span is one timed operation. A nil *Span is valid and records nothing,
+// which is what Start returns while tracing is off.
+type Span struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	sampled bool
+	name    string
+	kind    int
+	start   time.Time
+
+	mu        sync.Mutex
+	end       time.Time
+	attrs     map[string]any
+	errored   bool
+	statusMsg string
+	ended     bool
+}
+
+type spanKey struct{}
+
+// active is the exporter set up by Setup; nil while tracing is off.
+var active *exporter
+
+// Enabled reports whether spans are being exported.
+func Enabled() bool { return active != nil }
+
+// FromContext returns the span carried by ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start begins an internal span as a child of the span in ctx, or as a new
+// trace if there is none. End it when the operation finishes.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return StartKind(ctx, name, KindInternal)
+}
+
+// StartKind is Start with an explicit span kind.
+func StartKind(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if active == nil {
+		return ctx, nil
+	}
+	parent := FromContext(ctx)
+	s := &Span{name: name, kind: kind, start: time.Now()}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parent = parent.spanID
+		s.sampled = parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = active.sample(s.traceID, false, false)
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// StartServer begins a server span for an incoming request, continuing
+// the caller's trace when it sent a W3C traceparent header.
+func StartServer(r *http.Request, name string) (context.Context, *Span) {
+	ctx := r.Context()
+	if active == nil {
+		return ctx, nil
+	}
+	traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent"))
+	if !ok {
+		return StartKind(ctx, name, KindServer)
+	}
+	s := &Span{name: name, kind: KindServer, start: time.Now(), traceID: traceID, parent: parentID}
+	s.sampled = active.sample(traceID, true, sampled)
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Inject adds the traceparent header for the span in ctx to an outgoing
+// request, so the receiver can continue the trace.
+func Inject(ctx context.Context, h http.Header) {
+	s := FromContext(ctx)
+	if s == nil {
+		return
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	h.Set("traceparent", fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]), flags))
+}
+
+func parseTraceparent(v string) (traceID [16]byte, spanID [8]byte, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil || spanID == [8]byte{} {
+		return
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return
+	}
+	return traceID, spanID, flags[0]&1 == 1, true
+}
+
+// SetName renames the span, e.g. once the route a request matched is
+// known.
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+// SetAttr records an attribute. Values may be strings, bools, integers or
+// floats; anything else is recorded as its fmt representation.
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]any)
+	}
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks the span failed. A nil err does nothing.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Fail(err.Error())
+}
+
+// Fail marks the span failed with a message.
+func (s *Span) Fail(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errored = true
+	s.statusMsg = msg
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export. Only the first call
+// counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.sampled && active != nil {
+		active.enqueue(s)
+	}
+}
+
+// TraceID returns the span's trace ID in hex, for logs. It is empty for a
+// nil span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
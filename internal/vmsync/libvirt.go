@@ -0,0 +1,158 @@
+package vmsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Libvirt manages domains through the virsh command, so it works with any
+// connection URI virsh does (qemu:///system, qemu+ssh://host/system, ...).
+type Libvirt struct {
+	URI   string
+	Virsh string // path to virsh; "virsh" if empty
+}
+
+func (l *Libvirt) Name() string { return "libvirt" }
+
+type domainXML struct {
+	Name       string `xml:"name"`
+	UUID       string `xml:"uuid"`
+	Interfaces []struct {
+		MAC struct {
+			Address string `xml:"address,attr"`
+		} `xml:"mac"`
+	} `xml:"devices>interface"`
+}
+
+func (l *Libvirt) List(ctx context.Context) ([]VM, error) {
+	out, err := l.virsh(ctx, "list", "--all", "--uuid")
+	if err != nil {
+		return nil, err
+	}
+	var vms []VM
+	for _, uuid := range strings.Fields(string(out)) {
+		raw, err := l.virsh(ctx, "dumpxml", "--inactive", uuid)
+		if err != nil {
+			return nil, err
+		}
+		var dom domainXML
+		if err := xml.Unmarshal(raw, &dom); err != nil {
+			return nil, fmt.Errorf("parse domain %s: %w", uuid, err)
+		}
+		vm := VM{ID: dom.UUID, Name: dom.Name}
+		for _, iface := range dom.Interfaces {
+			if iface.MAC.Address != "" {
+				vm.MACs = append(vm.MACs, strings.ToLower(iface.MAC.Address))
+			}
+		}
+		vms = append(vms, vm)
+	}
+	return vms, nil
+}
+
+func (l *Libvirt) NetworkBoot(ctx context.Context, id, mac string) error {
+	raw, err := l.virsh(ctx, "dumpxml", "--inactive", id)
+	if err != nil {
+		return err
+	}
+	edited, err := networkFirst(string(raw), mac)
+	if err != nil {
+		return fmt.Errorf("domain %s: %w", id, err)
+	}
+	f, err := os.CreateTemp("", "duh-domain-*.xml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(edited); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	_, err = l.virsh(ctx, "define", f.Name())
+	return err
+}
+
+func (l *Libvirt) virsh(ctx context.Context, args ...string) ([]byte, error) {
+	bin := l.Virsh
+	if bin == "" {
+		bin = "virsh"
+	}
+	if l.URI != "" {
+		args = append([]string{"--connect", l.URI}, args...)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("virsh %s: %v: %s", args[len(args)-1], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+var (
+	interfaceRe = regexp.MustCompile(`(?s)<interface\b.*?</interface>`)
+	bootOrderRe = regexp.MustCompile(`<boot\s+order=['"](\d+)['"]\s*/>`)
+	ifaceBootRe = regexp.MustCompile(`\s*<boot\s+order=['"]\d+['"]\s*/>`)
+	osBootRe    = regexp.MustCompile(`\s*<boot\s+dev=['"][a-z]+['"]\s*/>`)
+	osEndRe     = regexp.MustCompile(`(\s*)</os>`)
+)
+
+// networkFirst edits domain XML so the interface with mac boots first.
+// Domains using per-device boot order get that interface at order 1 with
+// every other device moved down one; domains using <os><boot dev=...>
+// (which can't be mixed with per-device order) get network put first.
+func networkFirst(domain, mac string) (string, error) {
+	loc := -1
+	var iface string
+	for _, m := range interfaceRe.FindAllStringIndex(domain, -1) {
+		if strings.Contains(strings.ToLower(domain[m[0]:m[1]]), strings.ToLower(mac)) {
+			loc, iface = m[0], domain[m[0]:m[1]]
+			break
+		}
+	}
+	if loc < 0 {
+		return "", fmt.Errorf("no interface with mac %s", mac)
+	}
+
+	if !bootOrderRe.MatchString(domain) {
+		start := strings.Index(domain, "<os")
+		end := osEndRe.FindStringSubmatchIndex(domain)
+		if start < 0 || end == nil {
+			return "", fmt.Errorf("no <os> element")
+		}
+		body := domain[start:end[0]]
+		var devs []string
+		for _, m := range osBootRe.FindAllString(body, -1) {
+			if !strings.Contains(m, "network") {
+				devs = append(devs, strings.TrimSpace(m))
+			}
+		}
+		if len(devs) == 0 {
+			devs = []string{"<boot dev='hd'/>"}
+		}
+		indent := domain[end[2]:end[3]] + "  "
+		boot := indent + "<boot dev='network'/>" + indent + strings.Join(devs, indent)
+		return domain[:start] + osBootRe.ReplaceAllString(body, "") + boot + domain[end[0]:], nil
+	}
+
+	// Drop the interface's own entry, then shift everything else down.
+	stripped := ifaceBootRe.ReplaceAllString(iface, "")
+	stripped = strings.Replace(stripped, "</interface>", "  <boot order='1'/>\n    </interface>", 1)
+	rest := domain[:loc] + "\x00" + domain[loc+len(iface):]
+	rest = bootOrderRe.ReplaceAllStringFunc(rest, func(s string) string {
+		n, _ := strconv.Atoi(bootOrderRe.FindStringSubmatch(s)[1])
+		return fmt.Sprintf("<boot order='%d'/>", n+1)
+	})
+	return strings.Replace(rest, "\x00", stripped, 1), nil
+}
@@ -0,0 +1,209 @@
+package vmsync
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Proxmox talks to the Proxmox VE API with an API token. Only QEMU guests
+// are listed; containers can't netboot.
+type Proxmox struct {
+	URL    string // e.g. https://pve.example.com:8006
+	Token  string // user@realm!tokenid=secret
+	Client *http.Client
+}
+
+// NewProxmox returns a Proxmox provider. insecure skips certificate
+// verification, for hosts still on their self-signed certificate.
+func NewProxmox(baseURL, token string, insecure bool) *Proxmox {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if insecure {
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &Proxmox{
+		URL:    strings.TrimRight(baseURL, "/"),
+		Token:  token,
+		Client: &http.Client{Timeout: 30 * time.Second, Transport: tr},
+	}
+}
+
+func (p *Proxmox) Name() string { return "proxmox" }
+
+type pveResource struct {
+	VMID     int    `json:"vmid"`
+	Node     string `json:"node"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Template int    `json:"template"`
+}
+
+func (p *Proxmox) List(ctx context.Context) ([]VM, error) {
+	guests, err := p.guests(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var vms []VM
+	for _, g := range guests {
+		cfg, err := p.config(ctx, g)
+		if err != nil {
+			return nil, err
+		}
+		vm := VM{ID: strconv.Itoa(g.VMID), Name: g.Name}
+		for _, n := range pveNICs(cfg) {
+			vm.MACs = append(vm.MACs, n.mac)
+		}
+		vms = append(vms, vm)
+	}
+	return vms, nil
+}
+
+func (p *Proxmox) NetworkBoot(ctx context.Context, id, mac string) error {
+	guests, err := p.guests(ctx)
+	if err != nil {
+		return err
+	}
+	for _, g := range guests {
+		if strconv.Itoa(g.VMID) != id {
+			continue
+		}
+		cfg, err := p.config(ctx, g)
+		if err != nil {
+			return err
+		}
+		for _, n := range pveNICs(cfg) {
+			if strings.EqualFold(n.mac, mac) {
+				form := url.Values{"boot": {pveBootOrder(cfg, n.key)}}
+				path := fmt.Sprintf("/nodes/%s/qemu/%d/config", url.PathEscape(g.Node), g.VMID)
+				return p.do(ctx, http.MethodPut, path, form, nil)
+			}
+		}
+		return fmt.Errorf("vm %s has no nic %s", id, mac)
+	}
+	return fmt.Errorf("vm %s not found", id)
+}
+
+// guests returns the cluster's QEMU VMs, skipping templates.
+func (p *Proxmox) guests(ctx context.Context) ([]pveResource, error) {
+	var all []pveResource
+	if err := p.do(ctx, http.MethodGet, "/cluster/resources?type=vm", nil, &all); err != nil {
+		return nil, err
+	}
+	var guests []pveResource
+	for _, r := range all {
+		if r.Type == "qemu" && r.Template == 0 {
+			guests = append(guests, r)
+		}
+	}
+	sort.Slice(guests, func(i, j int) bool { return guests[i].VMID < guests[j].VMID })
+	return guests, nil
+}
+
+func (p *Proxmox) config(ctx context.Context, g pveResource) (map[string]any, error) {
+	var cfg map[string]any
+	path := fmt.Sprintf("/nodes/%s/qemu/%d/config", url.PathEscape(g.Node), g.VMID)
+	if err := p.do(ctx, http.MethodGet, path, nil, &cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// do calls the API and decodes the "data" member of the response into out.
+func (p *Proxmox) do(ctx context.Context, method, path string, form url.Values, out any) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.URL+"/api2/json"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "PVEAPIToken="+p.Token)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("proxmox %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("decode proxmox response: %w", err)
+	}
+	return json.Unmarshal(envelope.Data, out)
+}
+
+type pveNIC struct {
+	key string // net0, net1, ...
+	mac string
+}
+
+// pveNICs returns a VM's NICs in index order. A NIC is configured as e.g.
+// "virtio=BC:24:11:00:00:01,bridge=vmbr0".
+func pveNICs(cfg map[string]any) []pveNIC {
+	var nics []pveNIC
+	for key, v := range cfg {
+		if !strings.HasPrefix(key, "net") {
+			continue
+		}
+		if _, err := strconv.Atoi(key[3:]); err != nil {
+			continue
+		}
+		s, _ := v.(string)
+		model, _, _ := strings.Cut(s, ",")
+		_, mac, ok := strings.Cut(model, "=")
+		if !ok {
+			continue
+		}
+		nics = append(nics, pveNIC{key: key, mac: strings.ToLower(mac)})
+	}
+	sort.Slice(nics, func(i, j int) bool {
+		a, _ := strconv.Atoi(nics[i].key[3:])
+		b, _ := strconv.Atoi(nics[j].key[3:])
+		return a < b
+	})
+	return nics
+}
+
+// pveBootOrder returns the boot option with nic moved to the front. The
+// legacy letter format is replaced by an explicit order that keeps the
+// VM's boot disk second.
+func pveBootOrder(cfg map[string]any, nic string) string {
+	boot, _ := cfg["boot"].(string)
+	var order []string
+	for _, part := range strings.Split(boot, ",") {
+		if devs, ok := strings.CutPrefix(part, "order="); ok {
+			order = strings.Split(devs, ";")
+		}
+	}
+	if order == nil {
+		if disk, _ := cfg["bootdisk"].(string); disk != "" {
+			order = []string{disk}
+		}
+	}
+	devs := []string{nic}
+	for _, d := range order {
+		if d != "" && d != nic {
+			devs = append(devs, d)
+		}
+	}
+	return "order=" + strings.Join(devs, ";")
+}
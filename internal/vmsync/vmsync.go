@@ -0,0 +1,95 @@
+// Package vmsync mirrors virtual machines from a hypervisor into duh's
+// systems, and moves their boot order to the network before a reimage.
+package vmsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/justinpopa/duh/internal/db"
+)
+
+// VM is a virtual machine as reported by a provider.
+type VM struct {
+	ID   string   // provider-specific: a Proxmox VMID or libvirt domain UUID
+	Name string   // display name
+	MACs []string // in NIC order
+}
+
+// Provider enumerates VMs on one hypervisor and can change their boot order.
+type Provider interface {
+	Name() string
+	List(ctx context.Context) ([]VM, error)
+	// NetworkBoot puts the NIC with mac first in the VM's boot order.
+	NetworkBoot(ctx context.Context, id, mac string) error
+}
+
+// Result summarizes a sync.
+type Result struct {
+	Provider string
+	Created  []db.System // new systems, for the caller to announce
+	Updated  int         // existing systems that were named or linked
+	Skipped  int         // VMs without a NIC
+	Errors   []string
+}
+
+// Sync creates a system for every VM the provider lists and links it to
+// the VM. A VM whose NIC already belongs to a system keeps that system;
+// the VM name only fills in a missing hostname.
+func Sync(ctx context.Context, d *sql.DB, p Provider) (*Result, error) {
+	vms, err := p.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list %s vms: %w", p.Name(), err)
+	}
+	res := &Result{Provider: p.Name()}
+	for _, vm := range vms {
+		if len(vm.MACs) == 0 {
+			res.Skipped++
+			continue
+		}
+		if err := syncVM(d, p.Name(), vm, res); err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: %v", vm.Name, err))
+		}
+	}
+	return res, nil
+}
+
+func syncVM(d *sql.DB, provider string, vm VM, res *Result) error {
+	var sys *db.System
+	for _, mac := range vm.MACs {
+		s, err := db.GetSystemByMAC(d, mac)
+		if err != nil {
+			return err
+		}
+		if s != nil {
+			sys = s
+			break
+		}
+	}
+
+	hostname := db.NormalizeHostname(vm.Name)
+	switch {
+	case sys == nil:
+		s, err := db.CreateSystem(d, vm.MACs[0], hostname)
+		if err != nil {
+			return err
+		}
+		sys = s
+		res.Created = append(res.Created, *s)
+	case sys.Hostname == "" && hostname != "":
+		if err := db.UpdateSystemInfo(d, sys.ID, sys.MAC, hostname); err != nil {
+			return err
+		}
+		res.Updated++
+	default:
+		link, err := db.GetVMLink(d, sys.ID)
+		if err != nil {
+			return err
+		}
+		if link == nil || link.Provider != provider || link.VMID != vm.ID {
+			res.Updated++
+		}
+	}
+	return db.SetVMLink(d, sys.ID, provider, vm.ID, vm.Name)
+}
@@ -0,0 +1,106 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/jobs"
+)
+
+// JobFlush is the job type that sends a batched or digest webhook the
+// events held for it; its payload is a flushJob.
+const JobFlush = "webhook.flush"
+
+// flushJob is the payload of a JobFlush job.
+type flushJob struct {
+	WebhookID int64 `json:"webhook_id"`
+}
+
+// maxBatchEvents caps the events sent in one batch. A flush that leaves
+// more held queues another straight away.
+const maxBatchEvents = 500
+
+// digestInterval is how long a digest webhook collects events.
+const digestInterval = 24 * time.Hour
+
+// batchInterval is how long wh collects events before sending them.
+func batchInterval(wh db.Webhook) time.Duration {
+	if wh.Mode == db.WebhookDigest {
+		return digestInterval
+	}
+	return time.Duration(wh.BatchInterval) * time.Second
+}
+
+// hold keeps event for wh's next batch, scheduling the batch to go out
+// when the interval that its first event started is up.
+func (d *Dispatcher) hold(wh db.Webhook, event Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if err := db.AddPendingEvent(d.db, wh.ID, string(b)); err != nil {
+		return err
+	}
+	_, err = d.queue.ScheduleOnce(JobFlush, flushJob{WebhookID: wh.ID}, batchInterval(wh))
+	return err
+}
+
+// flush runs a JobFlush job, posting the events held for a webhook as one
+// event of type "batch" or "digest" whose data lists them oldest first.
+// Events stay held until a batch carrying them is delivered, so those of a
+// batch that fails go out again with the next.
+func (d *Dispatcher) flush(ctx context.Context, payload []byte) error {
+	var job flushJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return jobs.Permanent(err)
+	}
+	wh, err := db.GetWebhook(d.db, job.WebhookID)
+	if err != nil {
+		return err
+	}
+	if wh == nil {
+		return nil
+	}
+	held, err := db.ListPendingEvents(d.db, wh.ID, maxBatchEvents)
+	if err != nil {
+		return err
+	}
+	if len(held) == 0 {
+		return nil
+	}
+	last := held[len(held)-1].ID
+	if !wh.Enabled {
+		// Disabled since the events fired.
+		return db.DeletePendingEvents(d.db, wh.ID, last)
+	}
+
+	events := make([]json.RawMessage, len(held))
+	for i, e := range held {
+		events[i] = json.RawMessage(e.Event)
+	}
+	typ := "batch"
+	if wh.Mode == db.WebhookDigest {
+		typ = "digest"
+	}
+	err = d.send(ctx, wh, Event{
+		Type:      typ,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data: map[string]any{
+			"count":  len(events),
+			"since":  held[0].CreatedAt,
+			"events": events,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := db.DeletePendingEvents(d.db, wh.ID, last); err != nil {
+		return err
+	}
+	if len(held) == maxBatchEvents {
+		_, err = d.queue.ScheduleOnce(JobFlush, job, 0)
+	}
+	return err
+}
@@ -2,18 +2,23 @@ package webhook
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/justinpopa/duh/internal/db"
+	"github.com/justinpopa/duh/internal/jobs"
 	"github.com/justinpopa/duh/internal/safenet"
+	"github.com/justinpopa/duh/internal/tracing"
 )
 
 type Event struct {
@@ -22,74 +27,123 @@ type Event struct {
 	Data      map[string]any `json:"data"`
 }
 
+// JobDeliver is the job type that delivers an event to one webhook; its
+// payload is a delivery.
+const JobDeliver = "webhook.deliver"
+
+// delivery is the payload of a JobDeliver job.
+type delivery struct {
+	WebhookID int64 `json:"webhook_id"`
+	Event     Event `json:"event"`
+}
+
+// Dispatcher delivers events to the webhooks subscribed to them, through
+// the job queue, so deliveries are retried and outlast restarts.
 type Dispatcher struct {
-	db   *sql.DB
-	ch   chan Event
-	done chan struct{}
+	db     *sql.DB
+	queue  *jobs.Queue
+	client *http.Client
 }
 
-func NewDispatcher(database *sql.DB) *Dispatcher {
+func NewDispatcher(database *sql.DB, queue *jobs.Queue) *Dispatcher {
 	d := &Dispatcher{
-		db:   database,
-		ch:   make(chan Event, 100),
-		done: make(chan struct{}),
+		db:     database,
+		queue:  queue,
+		client: safenet.NewClient(10 * time.Second),
 	}
-	go d.worker()
+	queue.Handle(JobDeliver, d.deliver)
+	queue.Handle(JobFlush, d.flush)
 	return d
 }
 
+// Fire queues a delivery of event to each enabled webhook subscribed to
+// it whose filter it matches, or holds it for the webhook's next batch. A
+// filter that fails to evaluate keeps the event from that webhook.
 func (d *Dispatcher) Fire(event Event) {
 	if event.Timestamp == "" {
 		event.Timestamp = time.Now().UTC().Format(time.RFC3339)
 	}
-	select {
-	case d.ch <- event:
-	default:
-		log.Printf("webhook: event channel full, dropping %s event", event.Type)
+	webhooks, err := db.ListEnabledWebhooks(d.db)
+	if err != nil {
+		log.Printf("webhook: list enabled: %v", err)
+		return
 	}
-}
-
-func (d *Dispatcher) Close() {
-	close(d.ch)
-	<-d.done
-}
-
-func (d *Dispatcher) worker() {
-	defer close(d.done)
-	client := safenet.NewClient(10 * time.Second)
-
-	for event := range d.ch {
-		webhooks, err := db.ListEnabledWebhooks(d.db)
-		if err != nil {
-			log.Printf("webhook: list enabled: %v", err)
+	for _, wh := range webhooks {
+		if !matchEvent(wh.Events, event.Type) {
 			continue
 		}
-
-		body, err := json.Marshal(event)
-		if err != nil {
-			log.Printf("webhook: marshal event: %v", err)
+		if ok, err := matchFilter(wh.Filter, event); err != nil {
+			log.Printf("webhook: filter of %s on %s event: %v", wh.URL, event.Type, err)
+			continue
+		} else if !ok {
 			continue
 		}
-
-		for _, wh := range webhooks {
-			if !matchEvent(wh.Events, event.Type) {
-				continue
+		if wh.Mode == db.WebhookBatch || wh.Mode == db.WebhookDigest {
+			if err := d.hold(wh, event); err != nil {
+				log.Printf("webhook: hold %s event for %s: %v", event.Type, wh.URL, err)
 			}
-			d.deliver(client, wh, body)
+			continue
+		}
+		if _, err := d.queue.Enqueue(JobDeliver, delivery{WebhookID: wh.ID, Event: event}); err != nil {
+			log.Printf("webhook: queue %s event for %s: %v", event.Type, wh.URL, err)
 		}
 	}
 }
 
-func (d *Dispatcher) deliver(client *http.Client, wh db.Webhook, body []byte) {
-	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(body))
+// deliver runs a JobDeliver job.
+func (d *Dispatcher) deliver(ctx context.Context, payload []byte) error {
+	var job delivery
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return jobs.Permanent(err)
+	}
+	wh, err := db.GetWebhook(d.db, job.WebhookID)
 	if err != nil {
-		log.Printf("webhook: create request for %s: %v", wh.URL, err)
-		return
+		return err
+	}
+	if wh == nil || !wh.Enabled {
+		// Deleted or disabled since the event fired.
+		return nil
+	}
+	return d.send(ctx, wh, job.Event)
+}
+
+// send posts event to wh, for a job. A receiver that answers with a client
+// error won't change its mind, so that is a permanent failure.
+func (d *Dispatcher) send(ctx context.Context, wh *db.Webhook, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	resp, err := post(ctx, d.client, wh.URL, wh.Secret, event.Type, body)
+	if err != nil {
+		return fmt.Errorf("POST %s: %w", wh.URL, err)
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+		return jobs.Permanent(fmt.Errorf("POST %s: status %d", wh.URL, resp.StatusCode))
+	case resp.StatusCode >= 400:
+		return fmt.Errorf("POST %s: status %d", wh.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+// post sends a JSON body, signed with secret when one is set. The delivery
+// is traced as a child of the span in ctx, if any.
+func post(ctx context.Context, client *http.Client, url, secret, eventType string, body []byte) (*http.Response, error) {
+	ctx, span := tracing.StartKind(ctx, "webhook "+eventType, tracing.KindClient)
+	defer span.End()
+	span.SetAttr("url.full", url)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		span.SetError(err)
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, req.Header)
 
-	if wh.Secret != "" {
-		mac := hmac.New(sha256.New, []byte(wh.Secret))
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
 		mac.Write(body)
 		sig := hex.EncodeToString(mac.Sum(nil))
 		req.Header.Set("X-Webhook-Signature", sig)
@@ -97,13 +151,14 @@ func (d *Dispatcher) deliver(client *http.Client, wh db.Webhook, body []byte) {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("webhook: POST %s: %v", wh.URL, err)
-		return
+		span.SetError(err)
+		return nil, err
 	}
-	resp.Body.Close()
+	span.SetAttr("http.response.status_code", resp.StatusCode)
 	if resp.StatusCode >= 400 {
-		log.Printf("webhook: POST %s: status %d", wh.URL, resp.StatusCode)
+		span.Fail(resp.Status)
 	}
+	return resp, nil
 }
 
 func matchEvent(pattern, eventType string) bool {
@@ -121,32 +176,67 @@ func matchEvent(pattern, eventType string) bool {
 // DeliverSingle sends a single event to a specific webhook synchronously.
 // Used for the test endpoint.
 func DeliverSingle(wh db.Webhook, event Event) error {
-	if event.Timestamp == "" {
-		event.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	body, err := marshal(event)
+	if err != nil {
+		return err
 	}
-	body, err := json.Marshal(event)
+	resp, err := post(context.Background(), safenet.NewClient(10*time.Second), wh.URL, wh.Secret, event.Type, body)
 	if err != nil {
 		return err
 	}
+	resp.Body.Close()
+	return nil
+}
 
-	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(body))
+// Deliver sends an event to url synchronously, like DeliverSingle, but
+// also treats an error status from the receiver as a failure.
+func Deliver(url, secret string, event Event) error {
+	body, err := marshal(event)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-
-	if wh.Secret != "" {
-		mac := hmac.New(sha256.New, []byte(wh.Secret))
-		mac.Write(body)
-		sig := hex.EncodeToString(mac.Sum(nil))
-		req.Header.Set("X-Webhook-Signature", sig)
+	resp, err := post(context.Background(), safenet.NewClient(10*time.Second), url, secret, event.Type, body)
+	if err != nil {
+		return err
 	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("POST %s: status %d", url, resp.StatusCode)
+	}
+	return nil
+}
 
-	client := safenet.NewClient(10 * time.Second)
-	resp, err := client.Do(req)
+// Call sends an event to url synchronously and decodes the receiver's JSON
+// reply into out. An empty reply leaves out as it was.
+func Call(ctx context.Context, url, secret string, event Event, timeout time.Duration, out any) error {
+	body, err := marshal(event)
 	if err != nil {
 		return err
 	}
-	resp.Body.Close()
+	resp, err := post(ctx, safenet.NewClient(timeout), url, secret, event.Type, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("POST %s: status %d", url, resp.StatusCode)
+	}
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("read reply from %s: %w", url, err)
+	}
+	if len(bytes.TrimSpace(reply)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(reply, out); err != nil {
+		return fmt.Errorf("parse reply from %s: %w", url, err)
+	}
 	return nil
 }
+
+func marshal(event Event) ([]byte, error) {
+	if event.Timestamp == "" {
+		event.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	}
+	return json.Marshal(event)
+}
@@ -0,0 +1,75 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/justinpopa/duh/internal/policy"
+)
+
+// filterNames are what a webhook filter can refer to: the event's type and
+// its data, addressed by path as in the delivered JSON, e.g. data.hostname.
+var filterNames = []string{"type", "data"}
+
+// CompileFilter parses a webhook filter: an expression in the policy rule
+// language that an event must match to be delivered, such as
+//
+//	"prod" in data.tags && data.environment == "prod"
+func CompileFilter(src string) (*policy.Program, error) {
+	return policy.Compile(src, filterNames)
+}
+
+// matchFilter reports whether event passes filter. An empty filter passes
+// every event.
+func matchFilter(filter string, event Event) (bool, error) {
+	if strings.TrimSpace(filter) == "" {
+		return true, nil
+	}
+	prog, err := CompileFilter(filter)
+	if err != nil {
+		return false, err
+	}
+	data, err := eventData(event)
+	if err != nil {
+		return false, err
+	}
+	return prog.Match(map[string]any{"type": event.Type, "data": data})
+}
+
+// eventData is event's data as a receiver decodes it from the delivered
+// JSON, with whole numbers as integers so filters can compare IDs.
+func eventData(event Event) (map[string]any, error) {
+	b, err := json.Marshal(event.Data)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var data map[string]any
+	if err := dec.Decode(&data); err != nil {
+		return nil, err
+	}
+	return jsonNumbers(data).(map[string]any), nil
+}
+
+// jsonNumbers turns the json.Numbers in a decoded value into int64s, or
+// strings for those that aren't whole.
+func jsonNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		return v.String()
+	case []any:
+		for i, e := range v {
+			v[i] = jsonNumbers(e)
+		}
+	case map[string]any:
+		for k, e := range v {
+			v[k] = jsonNumbers(e)
+		}
+	}
+	return v
+}